@@ -19,13 +19,17 @@ var firstbootCompleteMachineconfig = &cobra.Command{
 	Run:                   executeFirstbootCompleteMachineConfig,
 }
 
-var persistNics bool
+var (
+	persistNics       bool
+	machineConfigPath string
+)
 
 // init executes upon import
 func init() {
 	rootCmd.AddCommand(firstbootCompleteMachineconfig)
 	firstbootCompleteMachineconfig.PersistentFlags().StringVar(&startOpts.rootMount, "root-mount", "/rootfs", "where the nodes root filesystem is mounted for chroot and file manipulation.")
 	firstbootCompleteMachineconfig.PersistentFlags().BoolVar(&persistNics, "persist-nics", false, "Run nmstatectl persist-nic-names")
+	firstbootCompleteMachineconfig.PersistentFlags().StringVar(&machineConfigPath, "machineconfig", "", "Complete the boot into the MachineConfig at this path on the host, e.g. provided by a device agent, rather than the one encapsulated by the MCS")
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 }
 
@@ -55,6 +59,9 @@ func runFirstBootCompleteMachineConfig(_ *cobra.Command, _ []string) error {
 		return err
 	}
 
+	if machineConfigPath != "" {
+		return dn.RunFirstbootCompleteMachineconfigFromFile(machineConfigPath)
+	}
 	return dn.RunFirstbootCompleteMachineconfig()
 }
 
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"net/url"
 	"os"
+	"time"
 
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -35,6 +36,11 @@ var (
 		kubeletHealthzEnabled      bool
 		kubeletHealthzEndpoint     string
 		promMetricsURL             string
+		driftRemediation           bool
+		driftRemediationExclude    []string
+		driftEventSink             string
+		driftScanInterval          time.Duration
+		driftScanBytesPerSecond    int64
 	}
 )
 
@@ -49,6 +55,11 @@ func init() {
 	startCmd.PersistentFlags().BoolVar(&startOpts.kubeletHealthzEnabled, "kubelet-healthz-enabled", true, "kubelet healthz endpoint monitoring")
 	startCmd.PersistentFlags().StringVar(&startOpts.kubeletHealthzEndpoint, "kubelet-healthz-endpoint", "http://localhost:10248/healthz", "healthz endpoint to check health")
 	startCmd.PersistentFlags().StringVar(&startOpts.promMetricsURL, "metrics-url", "127.0.0.1:8797", "URL for prometheus metrics listener")
+	startCmd.PersistentFlags().BoolVar(&startOpts.driftRemediation, "drift-remediation", false, "Restore files and units that drifted from the current config instead of degrading")
+	startCmd.PersistentFlags().StringSliceVar(&startOpts.driftRemediationExclude, "drift-remediation-exclude", nil, "Path patterns that are never restored by drift remediation")
+	startCmd.PersistentFlags().StringVar(&startOpts.driftEventSink, "drift-event-sink", "", "File or unix socket to write config drift events to as JSON lines")
+	startCmd.PersistentFlags().DurationVar(&startOpts.driftScanInterval, "drift-scan-interval", 0, "Interval of full scans of all managed files for config drift, disabled if 0")
+	startCmd.PersistentFlags().Int64Var(&startOpts.driftScanBytesPerSecond, "drift-scan-rate", 0, "Bytes per second full drift scans read at, 4MiB/s if 0")
 }
 
 func runStartCmd(_ *cobra.Command, _ []string) {
@@ -95,6 +106,15 @@ func runStartCmd(_ *cobra.Command, _ []string) {
 	if err != nil {
 		klog.Fatalf("Failed to initialize single run daemon: %v", err)
 	}
+	if startOpts.driftRemediation {
+		daemon.WithConfigDriftRemediation(daemon.ConfigDriftRemediation{ExcludePaths: startOpts.driftRemediationExclude})(dn)
+	}
+	if startOpts.driftEventSink != "" {
+		daemon.WithConfigDriftEventSink(daemon.ConfigDriftEventSink{Path: startOpts.driftEventSink})(dn)
+	}
+	if startOpts.driftScanInterval > 0 {
+		daemon.WithConfigDriftFullScan(daemon.ConfigDriftFullScan{Interval: startOpts.driftScanInterval, BytesPerSecond: startOpts.driftScanBytesPerSecond})(dn)
+	}
 
 	// If we are asked to run once and it's a valid file system path use
 	// the bare Daemon
@@ -0,0 +1,205 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"sigs.k8s.io/yaml"
+)
+
+// ContentNormalizer maps the contents of a file to the form they are compared
+// in, so that changes that don't matter to whatever reads the file, e.g. to
+// its comments, aren't changes of the file.
+type ContentNormalizer func(contents []byte) ([]byte, error)
+
+type contentNormalizerEntry struct {
+	pattern    string
+	normalizer ContentNormalizer
+}
+
+var (
+	contentNormalizersLock sync.RWMutex
+	contentNormalizers     []*contentNormalizerEntry
+)
+
+// RegisterContentNormalizer makes WithoutEquivalentFiles, and the config drift
+// checks of the daemon, compare the contents of the files whose paths match
+// pattern, as by filepath.Match, after normalizing them. The normalizers
+// of all patterns a path matches are applied in the order they were
+// registered. The returned function removes the normalizer again.
+func RegisterContentNormalizer(pattern string, normalizer ContentNormalizer) (func(), error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid content normalizer pattern %q: %w", pattern, err)
+	}
+	entry := &contentNormalizerEntry{pattern: pattern, normalizer: normalizer}
+	contentNormalizersLock.Lock()
+	defer contentNormalizersLock.Unlock()
+	contentNormalizers = append(contentNormalizers, entry)
+	return func() {
+		contentNormalizersLock.Lock()
+		defer contentNormalizersLock.Unlock()
+		for i, e := range contentNormalizers {
+			if e == entry {
+				contentNormalizers = append(contentNormalizers[:i:i], contentNormalizers[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+// HasContentNormalizer returns true if normalizers are registered for the file
+// at path.
+func HasContentNormalizer(path string) bool {
+	contentNormalizersLock.RLock()
+	defer contentNormalizersLock.RUnlock()
+	for _, e := range contentNormalizers {
+		if ok, _ := filepath.Match(e.pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeFileContents returns the contents of the file at path normalized
+// by the normalizers registered for it, and false if there are none.
+func NormalizeFileContents(path string, contents []byte) ([]byte, bool, error) {
+	contentNormalizersLock.RLock()
+	defer contentNormalizersLock.RUnlock()
+	normalized := false
+	for _, e := range contentNormalizers {
+		if ok, _ := filepath.Match(e.pattern, path); !ok {
+			continue
+		}
+		var err error
+		if contents, err = e.normalizer(contents); err != nil {
+			return nil, false, fmt.Errorf("normalizing %q: %w", path, err)
+		}
+		normalized = true
+	}
+	return contents, normalized, nil
+}
+
+// FileContentsEquivalent returns true if the contents a and b of the file at
+// path are the same once normalized. Contents that fail to normalize are
+// only equivalent if they are equal.
+func FileContentsEquivalent(path string, a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	normalizedA, ok, err := NormalizeFileContents(path, a)
+	if err != nil || !ok {
+		return false
+	}
+	normalizedB, _, err := NormalizeFileContents(path, b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(normalizedA, normalizedB)
+}
+
+// WithoutEquivalentFiles returns the paths of diffFileSet, as returned by
+// CalculateConfigFileDiffs, except for the files whose entries in oldIgnConfig
+// and newIgnConfig only differ in contents that are equivalent. Those files
+// are still written, but call for no post config change action.
+func WithoutEquivalentFiles(oldIgnConfig, newIgnConfig *ign3types.Config, diffFileSet []string) []string {
+	oldFiles := make(map[string]ign3types.File, len(oldIgnConfig.Storage.Files))
+	for _, f := range oldIgnConfig.Storage.Files {
+		oldFiles[f.Path] = f
+	}
+	newFiles := make(map[string]ign3types.File, len(newIgnConfig.Storage.Files))
+	for _, f := range newIgnConfig.Storage.Files {
+		newFiles[f.Path] = f
+	}
+	changed := make([]string, 0, len(diffFileSet))
+	for _, path := range diffFileSet {
+		oldFile, inOld := oldFiles[path]
+		newFile, inNew := newFiles[path]
+		// Files written again as they are, e.g. restored ones, are kept
+		if inOld && inNew && !reflect.DeepEqual(oldFile, newFile) && filesEquivalent(oldFile, newFile) {
+			continue
+		}
+		changed = append(changed, path)
+	}
+	return changed
+}
+
+// filesEquivalent returns true if the two entries of a file only differ in
+// contents that are equivalent. Contents that can't be decoded, i.e. remote
+// ones, are never equivalent.
+func filesEquivalent(oldFile, newFile ign3types.File) bool {
+	oldContents, err := DecodeIgnitionFileContents(oldFile.Contents.Source, oldFile.Contents.Compression)
+	if err != nil {
+		return false
+	}
+	newContents, err := DecodeIgnitionFileContents(newFile.Contents.Source, newFile.Contents.Compression)
+	if err != nil || !FileContentsEquivalent(newFile.Path, oldContents, newContents) {
+		return false
+	}
+	newFile.Contents = oldFile.Contents
+	return reflect.DeepEqual(oldFile, newFile)
+}
+
+// StripLineComments returns a ContentNormalizer removing the lines that start
+// with one of prefixes, after any indentation.
+func StripLineComments(prefixes ...string) ContentNormalizer {
+	return func(contents []byte) ([]byte, error) {
+		lines := strings.SplitAfter(string(contents), "\n")
+		kept := lines[:0]
+		for _, line := range lines {
+			trimmed := strings.TrimSpace(line)
+			comment := false
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(trimmed, prefix) {
+					comment = true
+					break
+				}
+			}
+			if !comment {
+				kept = append(kept, line)
+			}
+		}
+		return []byte(strings.Join(kept, "")), nil
+	}
+}
+
+// TrimTrailingWhitespace is a ContentNormalizer removing the whitespace at the
+// end of lines, and the empty lines at the end of the contents.
+func TrimTrailingWhitespace(contents []byte) ([]byte, error) {
+	lines := strings.Split(string(contents), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return []byte(strings.TrimRight(strings.Join(lines, "\n"), "\n")), nil
+}
+
+// CanonicalizeJSON is a ContentNormalizer formatting JSON documents with their
+// object keys sorted and without whitespace.
+func CanonicalizeJSON(contents []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// CanonicalizeYAML is a ContentNormalizer formatting YAML documents with their
+// mapping keys sorted and without comments. Only single documents are
+// supported.
+func CanonicalizeYAML(contents []byte) ([]byte, error) {
+	doc, err := yaml.YAMLToJSON(contents)
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = CanonicalizeJSON(doc); err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(doc)
+}
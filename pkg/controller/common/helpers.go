@@ -30,6 +30,7 @@ import (
 	ign2_3 "github.com/coreos/ignition/config/v2_3"
 	validate2 "github.com/coreos/ignition/config/validate"
 	ign3error "github.com/coreos/ignition/v2/config/shared/errors"
+	"github.com/coreos/ignition/v2/config/translate"
 	translate3_1 "github.com/coreos/ignition/v2/config/v3_1/translate"
 	ign3_1types "github.com/coreos/ignition/v2/config/v3_1/types"
 	translate3_2 "github.com/coreos/ignition/v2/config/v3_2/translate"
@@ -41,6 +42,8 @@ import (
 	ign3_4 "github.com/coreos/ignition/v2/config/v3_4"
 	translate3 "github.com/coreos/ignition/v2/config/v3_4/translate"
 	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ign3_5 "github.com/coreos/ignition/v2/config/v3_5"
+	ign3_5types "github.com/coreos/ignition/v2/config/v3_5/types"
 	validate3 "github.com/coreos/ignition/v2/config/validate"
 	"github.com/ghodss/yaml"
 	"github.com/vincent-petithory/dataurl"
@@ -456,6 +459,45 @@ func convertIgnition34to22(ign3config ign3types.Config) (ign2types.Config, error
 	return converted2, nil
 }
 
+// convertIgnition35to34 takes an ignition spec v3.5 config and returns a v3.4
+// config. The only field added in v3.5, storage.luks.cex, can't be represented
+// in v3.4, so configs enabling it are rejected: dropping it would have nodes
+// provisioned from the rendered config encrypt the volume without the CEX
+// secure key.
+func convertIgnition35to34(ign3config ign3_5types.Config) (ign3types.Config, error) {
+	for _, luks := range ign3config.Storage.Luks {
+		if luks.Cex.Enabled != nil && *luks.Cex.Enabled {
+			return ign3types.Config{}, fmt.Errorf("unable to convert Ignition spec v3_5 config to v3_4: storage.luks.%s.cex is not supported in spec v3_4", luks.Name)
+		}
+	}
+
+	tr := translate.NewTranslator()
+	tr.AddCustomTranslator(func(old ign3_5types.Ignition) (ret ign3types.Ignition) {
+		translate.NewTranslator().Translate(&old, &ret)
+		ret.Version = ign3types.MaxVersion.String()
+		return
+	})
+	tr.AddCustomTranslator(func(old ign3_5types.Luks) (ret ign3types.Luks) {
+		luksTr := translate.NewTranslator()
+		luksTr.Translate(&old.Clevis, &ret.Clevis)
+		luksTr.Translate(&old.Device, &ret.Device)
+		luksTr.Translate(&old.Discard, &ret.Discard)
+		luksTr.Translate(&old.KeyFile, &ret.KeyFile)
+		luksTr.Translate(&old.Label, &ret.Label)
+		luksTr.Translate(&old.Name, &ret.Name)
+		luksTr.Translate(&old.OpenOptions, &ret.OpenOptions)
+		luksTr.Translate(&old.Options, &ret.Options)
+		luksTr.Translate(&old.UUID, &ret.UUID)
+		luksTr.Translate(&old.WipeVolume, &ret.WipeVolume)
+		return
+	})
+	var converted34 ign3types.Config
+	tr.Translate(&ign3config, &converted34)
+	klog.V(4).Infof("Successfully translated Ignition spec v3_5 config to Ignition spec v3_4 config: %v", converted34)
+
+	return converted34, nil
+}
+
 // convertIgnition34to33 takes an ignition spec v3.4config and returns a v3.3 config
 func convertIgnition34to33(ign3config ign3types.Config) (ign3_3types.Config, error) {
 	converted33, err := v34tov33.Translate(ign3config)
@@ -545,36 +587,40 @@ func validateIgn3FileModes(cfg ign3types.Config) error {
 // This function does not handle remote resources; it assumes they have already
 // been fetched.
 func DecodeIgnitionFileContents(source, compression *string) ([]byte, error) {
-	var contentsBytes []byte
-
 	// To allow writing of "empty" files we'll allow source to be nil
-	if source != nil {
-		source, err := dataurl.DecodeString(*source)
+	if source == nil {
+		return nil, nil
+	}
+	decoded, err := dataurl.DecodeString(*source)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not decode file content string: %w", err)
+	}
+	return DecompressIgnitionFileContents(decoded.Data, compression)
+}
+
+// DecompressIgnitionFileContents decompresses the contents of a file as
+// specified by its compression field.
+func DecompressIgnitionFileContents(data []byte, compression *string) ([]byte, error) {
+	if compression == nil {
+		return data, nil
+	}
+	switch *compression {
+	case "":
+		return data, nil
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
 		if err != nil {
-			return []byte{}, fmt.Errorf("could not decode file content string: %w", err)
+			return []byte{}, fmt.Errorf("could not create gzip reader: %w", err)
 		}
-		if compression != nil {
-			switch *compression {
-			case "":
-				contentsBytes = source.Data
-			case "gzip":
-				reader, err := gzip.NewReader(bytes.NewReader(source.Data))
-				if err != nil {
-					return []byte{}, fmt.Errorf("could not create gzip reader: %w", err)
-				}
-				defer reader.Close()
-				contentsBytes, err = io.ReadAll(reader)
-				if err != nil {
-					return []byte{}, fmt.Errorf("failed decompressing: %w", err)
-				}
-			default:
-				return []byte{}, fmt.Errorf("unsupported compression type %q", *compression)
-			}
-		} else {
-			contentsBytes = source.Data
+		defer reader.Close()
+		contentsBytes, err := io.ReadAll(reader)
+		if err != nil {
+			return []byte{}, fmt.Errorf("failed decompressing: %w", err)
 		}
+		return contentsBytes, nil
+	default:
+		return []byte{}, fmt.Errorf("unsupported compression type %q", *compression)
 	}
-	return contentsBytes, nil
 }
 
 // InSlice search for an element in slice and return true if found, otherwise return false
@@ -618,10 +664,14 @@ func IgnParseWrapper(rawIgn []byte) (interface{}, error) {
 	// ErrInvalidVersion ("I can't parse it to find out what it is"), but our old 3.2 logic didn't, so this is here to make sure
 	// our error message for invalid version is still helpful.
 	if errV3.Error() == ign3error.ErrInvalidVersion.Error() {
-		return ign3types.Config{}, fmt.Errorf("parsing Ignition config failed: invalid version. Supported spec versions: 2.2, 3.0, 3.1, 3.2, 3.3, 3.4")
+		return ign3types.Config{}, fmt.Errorf("parsing Ignition config failed: invalid version. Supported spec versions: 2.2, 3.0, 3.1, 3.2, 3.3, 3.4, 3.5")
 	}
 
 	if errV3.Error() == ign3error.ErrUnknownVersion.Error() {
+		if ignCfgV35, ok, err := parseIgnition35As34(rawIgn); ok {
+			return ignCfgV35, err
+		}
+
 		ignCfgV2, rptV2, errV2 := ign2.Parse(rawIgn)
 		if errV2 == nil && !rptV2.IsFatal() {
 			return ignCfgV2, nil
@@ -629,7 +679,7 @@ func IgnParseWrapper(rawIgn []byte) (interface{}, error) {
 
 		// If the error is still UnknownVersion it's not a 3.3/3.2/3.1/3.0 or 2.x config, thus unsupported
 		if errV2.Error() == ign2error.ErrUnknownVersion.Error() {
-			return ign3types.Config{}, fmt.Errorf("parsing Ignition config failed: unknown version. Supported spec versions: 2.2, 3.0, 3.1, 3.2, 3.3, 3.4")
+			return ign3types.Config{}, fmt.Errorf("parsing Ignition config failed: unknown version. Supported spec versions: 2.2, 3.0, 3.1, 3.2, 3.3, 3.4, 3.5")
 		}
 		return ign3types.Config{}, fmt.Errorf("parsing Ignition spec v2 failed with error: %v\nReport: %v", errV2, rptV2)
 	}
@@ -637,6 +687,20 @@ func IgnParseWrapper(rawIgn []byte) (interface{}, error) {
 	return ign3types.Config{}, fmt.Errorf("parsing Ignition config spec v3 failed with error: %v\nReport: %v", errV3, rptV3)
 }
 
+// parseIgnition35As34 parses a spec 3.5 config and converts it to a 3.4 config.
+// It returns false if rawIgn isn't a 3.5 config.
+func parseIgnition35As34(rawIgn []byte) (ign3types.Config, bool, error) {
+	ignCfgV35, rpt, err := ign3_5.Parse(rawIgn)
+	if errors.Is(err, ign3error.ErrUnknownVersion) {
+		return ign3types.Config{}, false, nil
+	}
+	if err != nil || rpt.IsFatal() {
+		return ign3types.Config{}, true, fmt.Errorf("parsing Ignition config spec v3.5 failed with error: %v\nReport: %v", err, rpt)
+	}
+	ignCfg, err := convertIgnition35to34(ignCfgV35)
+	return ignCfg, true, err
+}
+
 // ParseAndConvertConfig parses rawIgn for both V2 and V3 ignition configs and returns
 // a V3 or an error.
 func ParseAndConvertConfig(rawIgn []byte) (ign3types.Config, error) {
@@ -968,23 +1032,16 @@ func dedupePasswdUserSSHKeys(passwdUser ign2types.PasswdUser) ign2types.PasswdUs
 	return passwdUser
 }
 
-// CalculateConfigFileDiffs compares the files present in two ignition configurations and returns the list of files
-// that are different between them
+// CalculateConfigFileDiffs compares the files, directories and links present in two ignition configurations and
+// returns the list of paths that are different between them
 func CalculateConfigFileDiffs(oldIgnConfig, newIgnConfig *ign3types.Config) []string {
-	// Go through the files and see what is new or different
-	oldFileSet := make(map[string]ign3types.File)
-	for _, f := range oldIgnConfig.Storage.Files {
-		oldFileSet[f.Path] = f
-	}
-	newFileSet := make(map[string]ign3types.File)
-	for _, f := range newIgnConfig.Storage.Files {
-		newFileSet[f.Path] = f
-	}
+	oldNodes := storageNodesByPath(oldIgnConfig)
+	newNodes := storageNodesByPath(newIgnConfig)
 	diffFileSet := []string{}
 
 	// First check if any files were removed
-	for path := range oldFileSet {
-		_, ok := newFileSet[path]
+	for path := range oldNodes {
+		_, ok := newNodes[path]
 		if !ok {
 			// debug: remove
 			klog.Infof("File diff: %v was deleted", path)
@@ -993,21 +1050,38 @@ func CalculateConfigFileDiffs(oldIgnConfig, newIgnConfig *ign3types.Config) []st
 	}
 
 	// Now check if any files were added/changed
-	for path, newFile := range newFileSet {
-		oldFile, ok := oldFileSet[path]
+	for path, newNode := range newNodes {
+		oldNode, ok := oldNodes[path]
 		if !ok {
 			// debug: remove
 			klog.Infof("File diff: %v was added", path)
 			diffFileSet = append(diffFileSet, path)
-		} else if !reflect.DeepEqual(oldFile, newFile) {
+		} else if !reflect.DeepEqual(oldNode, newNode) {
 			// debug: remove
-			klog.Infof("File diff: detected change to %v", newFile.Path)
+			klog.Infof("File diff: detected change to %v", path)
 			diffFileSet = append(diffFileSet, path)
 		}
 	}
 	return diffFileSet
 }
 
+// storageNodesByPath returns the files, directories and links of an ignition
+// configuration by their path. A path changing from e.g. a file to a link is a
+// change of the node at the path.
+func storageNodesByPath(ignConfig *ign3types.Config) map[string]interface{} {
+	nodes := make(map[string]interface{}, len(ignConfig.Storage.Files)+len(ignConfig.Storage.Directories)+len(ignConfig.Storage.Links))
+	for _, f := range ignConfig.Storage.Files {
+		nodes[f.Path] = f
+	}
+	for _, d := range ignConfig.Storage.Directories {
+		nodes[d.Path] = d
+	}
+	for _, l := range ignConfig.Storage.Links {
+		nodes[l.Path] = l
+	}
+	return nodes
+}
+
 // NewIgnFile returns a simple ignition3 file from just path and file contents.
 // It also ensures the compression field is set to the empty string, which is
 // currently required for ensuring child configs that may be merged layer
@@ -2,6 +2,7 @@ package common
 
 import (
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
@@ -244,6 +245,30 @@ func TestParseAndConvert(t *testing.T) {
 	testIgn3Config.Ignition.Version = InternalMCOIgnitionVersion
 	assert.Equal(t, testIgn3Config, convertedIgn)
 
+	// Make a valid Ign 3.5 cfg
+	testIgn3Config.Ignition.Version = "3.5.0"
+	// turn it into a raw []byte
+	rawIgn = helpers.MarshalOrDie(testIgn3Config)
+	// check that it was parsed successfully back to the default version
+	convertedIgn, err = ParseAndConvertConfig(rawIgn)
+	require.Nil(t, err)
+	testIgn3Config.Ignition.Version = InternalMCOIgnitionVersion
+	assert.Equal(t, testIgn3Config, convertedIgn)
+
+	// Fields added in Ign 3.5 can't be converted
+	rawIgn = []byte(`{"ignition":{"version":"3.5.0"},"storage":{"luks":[{"name":"root","device":"/dev/sda","cex":{"enabled":true}}]}}`)
+	convertedIgn, err = ParseAndConvertConfig(rawIgn)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "storage.luks.root.cex is not supported in spec v3_4")
+	assert.Equal(t, ign3types.Config{}, convertedIgn)
+
+	// Unless they are unset
+	rawIgn = []byte(`{"ignition":{"version":"3.5.0"},"storage":{"luks":[{"name":"root","device":"/dev/sda","cex":{"enabled":false}}]}}`)
+	convertedIgn, err = ParseAndConvertConfig(rawIgn)
+	require.Nil(t, err)
+	assert.Equal(t, InternalMCOIgnitionVersion, convertedIgn.Ignition.Version)
+	assert.Equal(t, []ign3types.Luks{{Name: "root", Device: helpers.StrToPtr("/dev/sda")}}, convertedIgn.Storage.Luks)
+
 	// Make a bad Ign3 cfg
 	testIgn3Config.Ignition.Version = "21.0.0"
 	rawIgn = helpers.MarshalOrDie(testIgn3Config)
@@ -754,6 +779,72 @@ func TestCalculateConfigFileDiffs(t *testing.T) {
 	if !reflect.DeepEqual(unchangedDiffFileset, []string{}) {
 		t.Errorf("File changes detected where there should have been none: %s", unchangedDiffFileset)
 	}
+
+	// Directories and links are compared too, and a file turning into a link
+	// is a change
+	target := "/etc/pki/kubelet-ca.crt"
+	testIgn3ConfigNew.Storage.Files = nil
+	testIgn3ConfigNew.Storage.Directories = []ign3types.Directory{{Node: ign3types.Node{Path: "/etc/kubernetes/manifests"}}}
+	testIgn3ConfigNew.Storage.Links = []ign3types.Link{{
+		Node:          ign3types.Node{Path: "/etc/kubernetes/kubelet-ca.crt"},
+		LinkEmbedded1: ign3types.LinkEmbedded1{Target: &target},
+	}}
+	actualDiffFileSet = CalculateConfigFileDiffs(&testIgn3ConfigOld, &testIgn3ConfigNew)
+	sort.Strings(actualDiffFileSet)
+	assert.Equal(t, []string{"/etc/kubernetes/kubelet-ca.crt", "/etc/kubernetes/manifests"}, actualDiffFileSet)
+}
+
+func TestContentNormalizers(t *testing.T) {
+	unregisterConf, err := RegisterContentNormalizer("/etc/*.conf", StripLineComments("#"))
+	require.NoError(t, err)
+	defer unregisterConf()
+	unregisterWhitespace, err := RegisterContentNormalizer("/etc/*.conf", TrimTrailingWhitespace)
+	require.NoError(t, err)
+	defer unregisterWhitespace()
+	unregisterJSON, err := RegisterContentNormalizer("/etc/*.json", CanonicalizeJSON)
+	require.NoError(t, err)
+	defer unregisterJSON()
+	_, err = RegisterContentNormalizer("[", TrimTrailingWhitespace)
+	assert.Error(t, err)
+	assert.True(t, HasContentNormalizer("/etc/a.conf"))
+	assert.False(t, HasContentNormalizer("/etc/c.txt"))
+
+	oldIgn := ign3types.Config{Ignition: ign3types.Ignition{Version: InternalMCOIgnitionVersion}}
+	oldIgn.Storage.Files = []ign3types.File{
+		NewIgnFile("/etc/a.conf", "key=value\n"),
+		NewIgnFile("/etc/b.json", `{"a": 1, "b": [true]}`),
+		NewIgnFile("/etc/c.txt", "# text\n"),
+		NewIgnFile("/etc/d.json", `{"a": 1}`),
+	}
+	newIgn := oldIgn
+	newIgn.Storage.Files = []ign3types.File{
+		NewIgnFile("/etc/a.conf", "# managed\nkey=value  \n\n"),
+		NewIgnFile("/etc/b.json", `{"b":[true],"a":1}`),
+		NewIgnFile("/etc/c.txt", "# other text\n"),
+		NewIgnFile("/etc/d.json", `{"a": 2}`),
+	}
+	// The files are still written, but don't call for actions
+	diffFileSet := CalculateConfigFileDiffs(&oldIgn, &newIgn)
+	assert.ElementsMatch(t, []string{"/etc/a.conf", "/etc/b.json", "/etc/c.txt", "/etc/d.json"}, diffFileSet)
+	assert.ElementsMatch(t, []string{"/etc/c.txt", "/etc/d.json"}, WithoutEquivalentFiles(&oldIgn, &newIgn, diffFileSet))
+	// as opposed to files written again as they are
+	assert.Equal(t, []string{"/etc/a.conf"}, WithoutEquivalentFiles(&oldIgn, &oldIgn, []string{"/etc/a.conf"}))
+
+	// Other changes to the file are still changes
+	mode := 0600
+	newIgn.Storage.Files[0].Mode = &mode
+	assert.ElementsMatch(t, []string{"/etc/a.conf", "/etc/c.txt", "/etc/d.json"}, WithoutEquivalentFiles(&oldIgn, &newIgn, CalculateConfigFileDiffs(&oldIgn, &newIgn)))
+
+	// Contents that don't normalize are only equivalent if equal
+	assert.False(t, FileContentsEquivalent("/etc/e.json", []byte("{"), []byte("{ ")))
+	assert.True(t, FileContentsEquivalent("/etc/e.json", []byte("{"), []byte("{")))
+
+	unregisterJSON()
+	assert.False(t, FileContentsEquivalent("/etc/b.json", []byte(`{"a":1,"b":2}`), []byte(`{"b":2,"a":1}`)))
+
+	canonical, err := CanonicalizeYAML([]byte("b: 1 # one\na:\n  - x\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "a:\n- x\nb: 1\n", string(canonical))
 }
 
 func TestParseAndConvertGzippedConfig(t *testing.T) {
@@ -0,0 +1,79 @@
+// Package offline renders MachineConfigPools into rendered MachineConfigs
+// without a cluster, using the generation logic of the template and render
+// controllers, so the whole "templates + MachineConfigs -> rendered config"
+// pipeline can run on an air-gapped device.
+package offline
+
+import (
+	"fmt"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/openshift/library-go/pkg/operator/configobserver/featuregates"
+
+	"github.com/openshift/machine-config-operator/pkg/controller/render"
+	"github.com/openshift/machine-config-operator/pkg/controller/template"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/pkg/version"
+)
+
+// RenderPools generates the MachineConfigs from the templates in templatesDir
+// for cconfig, and merges them with configs into a rendered MachineConfig for
+// each of pools, the same way the controllers do in a cluster. pullSecret is
+// the raw docker config JSON of the pull secret. It returns copies of pools
+// with their configuration set to the rendered MachineConfigs, and the
+// rendered MachineConfigs. None of the arguments are modified.
+//
+// Unlike the bootstrap controller, RenderPools doesn't generate configs for
+// KubeletConfigs, ContainerRuntimeConfigs or image policies; pass in their
+// generated MachineConfigs as part of configs if needed.
+func RenderPools(templatesDir string, cconfig *mcfgv1.ControllerConfig, pullSecret []byte, featureGateAccess featuregates.FeatureGateAccess, pools []*mcfgv1.MachineConfigPool, configs []*mcfgv1.MachineConfig) ([]*mcfgv1.MachineConfigPool, []*mcfgv1.MachineConfig, error) {
+	if cconfig == nil {
+		return nil, nil, fmt.Errorf("no ControllerConfig provided")
+	}
+	if featureGateAccess == nil {
+		featureGateAccess = featuregates.NewHardcodedFeatureGateAccess(nil, nil)
+	}
+
+	// The render controller only renders controller configs generated by
+	// its own version. We're rendering with the same version we template with.
+	cc := cconfig.DeepCopy()
+	if cc.Annotations == nil {
+		cc.Annotations = map[string]string{}
+	}
+	cc.Annotations[daemonconsts.GeneratedByVersionAnnotationKey] = version.Raw
+
+	templateConfigs, err := template.RunBootstrap(templatesDir, cc, pullSecret, featureGateAccess)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating MachineConfigs from templates: %w", err)
+	}
+
+	allConfigs := make([]*mcfgv1.MachineConfig, 0, len(configs)+len(templateConfigs))
+	for _, config := range configs {
+		allConfigs = append(allConfigs, config.DeepCopy())
+	}
+	allConfigs = append(allConfigs, templateConfigs...)
+
+	poolCopies := make([]*mcfgv1.MachineConfigPool, 0, len(pools))
+	for _, pool := range pools {
+		poolCopies = append(poolCopies, pool.DeepCopy())
+	}
+
+	renderedPools, renderedConfigs, err := render.RunBootstrap(poolCopies, allConfigs, cc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rendering MachineConfigs: %w", err)
+	}
+	return renderedPools, renderedConfigs, nil
+}
+
+// RenderPool is like RenderPools for a single pool, and returns just its
+// rendered MachineConfig.
+func RenderPool(templatesDir string, cconfig *mcfgv1.ControllerConfig, pullSecret []byte, featureGateAccess featuregates.FeatureGateAccess, pool *mcfgv1.MachineConfigPool, configs []*mcfgv1.MachineConfig) (*mcfgv1.MachineConfig, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("no MachineConfigPool provided")
+	}
+	_, rendered, err := RenderPools(templatesDir, cconfig, pullSecret, featureGateAccess, []*mcfgv1.MachineConfigPool{pool}, configs)
+	if err != nil {
+		return nil, err
+	}
+	return rendered[0], nil
+}
@@ -0,0 +1,58 @@
+package offline
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+)
+
+const templateDir = "../../../templates"
+
+func TestRenderPool(t *testing.T) {
+	ccRaw, err := os.ReadFile("../template/test_data/controller_config_libvirt.yaml")
+	require.Nil(t, err)
+	cconfig := &mcfgv1.ControllerConfig{}
+	require.Nil(t, yaml.Unmarshal(ccRaw, cconfig))
+
+	role := map[string]string{ctrlcommon.MachineConfigRoleLabel: "worker"}
+	pool := helpers.NewMachineConfigPool("worker", metav1.SetAsLabelSelector(role), nil, "")
+	device := helpers.NewMachineConfig("99-worker-device", role, "", []ign3types.File{
+		ctrlcommon.NewIgnFile("/etc/device", "device"),
+	})
+
+	rendered, err := RenderPool(templateDir, cconfig, []byte(`{"dummy": "dummy"}`), nil, pool, []*mcfgv1.MachineConfig{device})
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(rendered.Name, "rendered-worker-"), rendered.Name)
+
+	ignCfg, err := ctrlcommon.ParseAndConvertConfig(rendered.Spec.Config.Raw)
+	require.Nil(t, err)
+	paths := map[string]bool{}
+	for _, f := range ignCfg.Storage.Files {
+		paths[f.Path] = true
+	}
+	// Both the device config and the templated configs are merged in
+	assert.True(t, paths["/etc/device"])
+	assert.True(t, paths["/etc/kubernetes/kubelet.conf"])
+
+	// The inputs aren't modified
+	assert.Empty(t, pool.Spec.Configuration.Name)
+	assert.NotContains(t, cconfig.Annotations, "machineconfiguration.openshift.io/generated-by-version")
+
+	// Rendering is deterministic
+	again, err := RenderPool(templateDir, cconfig, []byte(`{"dummy": "dummy"}`), nil, pool, []*mcfgv1.MachineConfig{device})
+	require.Nil(t, err)
+	assert.Equal(t, rendered.Name, again.Name)
+
+	_, err = RenderPool(templateDir, nil, nil, nil, pool, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,150 @@
+package agentserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon"
+)
+
+// D-Bus names of the device agent interface.
+const (
+	DBusName      = "org.openshift.MachineConfigDaemon"
+	DBusPath      = "/org/openshift/MachineConfigDaemon"
+	DBusInterface = "org.openshift.MachineConfigDaemon"
+)
+
+// DBusIntrospection describes the D-Bus interface of the device agent.
+// ApplyUpdate takes and returns the JSON encoded ApplyConfigRequest and
+// UpdateResult, GetCurrentConfig returns the name of the current config on
+// disk. UpdateProgress is emitted for every phase started, file written, OS
+// change and error of an update.
+const DBusIntrospection = `<node>
+  <interface name="` + DBusInterface + `">
+    <method name="ApplyUpdate">
+      <arg name="request" type="s" direction="in"/>
+      <arg name="result" type="s" direction="out"/>
+    </method>
+    <method name="GetCurrentConfig">
+      <arg name="name" type="s" direction="out"/>
+    </method>
+    <signal name="UpdateProgress">
+      <arg name="event" type="s"/>
+      <arg name="phase" type="s"/>
+      <arg name="detail" type="s"/>
+    </signal>
+  </interface>` + introspect.IntrospectDataString + `</node>`
+
+// UpdateProgress events.
+const (
+	DBusEventPhaseStart  = "phase-start"
+	DBusEventFileWritten = "file-written"
+	DBusEventOSChange    = "os-change"
+	DBusEventError       = "error"
+)
+
+// ExportDBus exports the methods of DBusIntrospection on conn at DBusPath,
+// served by s, and requests DBusName for them. Pass a NewDBusProgressEmitter
+// for conn to the daemon WithUpdateObserver for the UpdateProgress signal.
+func (s *Server) ExportDBus(conn *dbus.Conn) error {
+	if err := conn.Export(&dbusObject{s: s}, DBusPath, DBusInterface); err != nil {
+		return fmt.Errorf("exporting %s: %w", DBusInterface, err)
+	}
+	if err := conn.Export(introspect.Introspectable(DBusIntrospection), DBusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return fmt.Errorf("exporting introspection data: %w", err)
+	}
+	reply, err := conn.RequestName(DBusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return fmt.Errorf("requesting %s: %w", DBusName, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("%s is already owned", DBusName)
+	}
+	klog.Infof("Serving device agent on D-Bus as %s", DBusName)
+	return nil
+}
+
+// dbusObject holds the D-Bus methods, which godbus requires to return a
+// *dbus.Error.
+type dbusObject struct {
+	s *Server
+}
+
+// ApplyUpdate applies the config of the JSON encoded ApplyConfigRequest.
+func (o *dbusObject) ApplyUpdate(request string) (string, *dbus.Error) {
+	req := &ApplyConfigRequest{}
+	if err := json.Unmarshal([]byte(request), req); err != nil {
+		return "", dbus.MakeFailedError(fmt.Errorf("parsing request: %w", err))
+	}
+	result, err := o.s.ApplyConfig(context.Background(), req)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(b), nil
+}
+
+// GetCurrentConfig returns the name of the current config on disk.
+func (o *dbusObject) GetCurrentConfig() (string, *dbus.Error) {
+	status, err := o.s.Status()
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return status.CurrentConfigName, nil
+}
+
+// signalEmitter is implemented by *dbus.Conn.
+type signalEmitter interface {
+	Emit(path dbus.ObjectPath, name string, values ...interface{}) error
+}
+
+// DBusProgressEmitter is a daemon.UpdateObserver that emits the UpdateProgress
+// signal on a D-Bus connection. Failing to emit a signal doesn't fail the
+// update, it is only logged.
+type DBusProgressEmitter struct {
+	// phase is the phase the update is in, sent along with every event.
+	phase daemon.UpdatePhase
+	conn  signalEmitter
+}
+
+// NewDBusProgressEmitter returns a DBusProgressEmitter emitting on conn, the
+// connection the Server is exported on.
+func NewDBusProgressEmitter(conn *dbus.Conn) *DBusProgressEmitter {
+	return &DBusProgressEmitter{conn: conn}
+}
+
+func (e *DBusProgressEmitter) emit(event, detail string) {
+	if err := e.conn.Emit(DBusPath, DBusInterface+".UpdateProgress", event, string(e.phase), detail); err != nil {
+		klog.Warningf("Failed to emit UpdateProgress signal: %v", err)
+	}
+}
+
+// OnPhaseStart implements daemon.UpdateObserver.
+func (e *DBusProgressEmitter) OnPhaseStart(phase daemon.UpdatePhase) {
+	e.phase = phase
+	e.emit(DBusEventPhaseStart, "")
+}
+
+// OnFileWritten implements daemon.UpdateObserver.
+func (e *DBusProgressEmitter) OnFileWritten(path string) {
+	e.emit(DBusEventFileWritten, path)
+}
+
+// OnOSChange implements daemon.UpdateObserver.
+func (e *DBusProgressEmitter) OnOSChange(change string) {
+	e.emit(DBusEventOSChange, change)
+}
+
+// OnError implements daemon.UpdateObserver.
+func (e *DBusProgressEmitter) OnError(phase daemon.UpdatePhase, err error) {
+	e.phase = phase
+	e.emit(DBusEventError, err.Error())
+}
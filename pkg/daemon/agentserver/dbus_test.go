@@ -0,0 +1,107 @@
+package agentserver
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon"
+)
+
+type fakeSignalEmitter struct {
+	sent [][]interface{}
+}
+
+func (f *fakeSignalEmitter) Emit(path dbus.ObjectPath, name string, values ...interface{}) error {
+	f.sent = append(f.sent, append([]interface{}{path, name}, values...))
+	return fmt.Errorf("no bus")
+}
+
+func TestDBusProgressEmitter(t *testing.T) {
+	conn := &fakeSignalEmitter{}
+	e := &DBusProgressEmitter{conn: conn}
+
+	e.OnPhaseStart(daemon.UpdatePhaseFiles)
+	e.OnFileWritten("/etc/foo")
+	e.OnError(daemon.UpdatePhaseUnits, fmt.Errorf("unit failed"))
+
+	signal := DBusInterface + ".UpdateProgress"
+	assert.Equal(t, [][]interface{}{
+		{dbus.ObjectPath(DBusPath), signal, "phase-start", "files", ""},
+		{dbus.ObjectPath(DBusPath), signal, "file-written", "files", "/etc/foo"},
+		{dbus.ObjectPath(DBusPath), signal, "error", "units", "unit failed"},
+	}, conn.sent)
+}
+
+// startTestBus starts a private session bus and returns its address.
+func startTestBus(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	require.Nil(t, err)
+	require.Nil(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	require.Nil(t, err)
+	return strings.TrimSpace(address)
+}
+
+func TestDBusExport(t *testing.T) {
+	address := startTestBus(t)
+
+	testDir := t.TempDir()
+	dn, err := daemon.NewClusterlessDaemon(
+		daemon.WithCurrentConfigPath(filepath.Join(testDir, "currentconfig")),
+		daemon.WithCurrentImagePath(filepath.Join(testDir, "currentimage")),
+	)
+	require.Nil(t, err)
+	s := New(dn, WithRollbackConfigPath(filepath.Join(testDir, "rollbackconfig")))
+
+	serverConn, err := dbus.Connect(address)
+	require.Nil(t, err)
+	defer serverConn.Close()
+	require.Nil(t, s.ExportDBus(serverConn))
+
+	clientConn, err := dbus.Connect(address)
+	require.Nil(t, err)
+	defer clientConn.Close()
+	obj := clientConn.Object(DBusName, DBusPath)
+
+	var introspection string
+	require.Nil(t, obj.Call("org.freedesktop.DBus.Introspectable.Introspect", 0).Store(&introspection))
+	assert.Contains(t, introspection, `<method name="ApplyUpdate">`)
+
+	var name string
+	require.Nil(t, obj.Call(DBusInterface+".GetCurrentConfig", 0).Store(&name))
+	assert.Equal(t, "", name)
+
+	var result string
+	err = obj.Call(DBusInterface+".ApplyUpdate", 0, "{}").Store(&result)
+	assert.ErrorContains(t, err, "no config provided")
+
+	require.Nil(t, clientConn.AddMatchSignal(dbus.WithMatchInterface(DBusInterface), dbus.WithMatchMember("UpdateProgress")))
+	signals := make(chan *dbus.Signal, 1)
+	clientConn.Signal(signals)
+	NewDBusProgressEmitter(serverConn).OnPhaseStart(daemon.UpdatePhaseFiles)
+	select {
+	case signal := <-signals:
+		assert.Equal(t, DBusInterface+".UpdateProgress", signal.Name)
+		assert.Equal(t, []interface{}{"phase-start", "files", ""}, signal.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("UpdateProgress signal not received")
+	}
+}
@@ -0,0 +1,406 @@
+// Package agentserver exposes a Daemon in device agent mode over gRPC on a
+// unix socket, so management agents that are not written in Go can drive it
+// without linking it as a library.
+//
+// The service is machineconfigdaemon.agent.v1.Agent, defined in
+// agentpb/agent.proto.
+package agentserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon"
+	"github.com/openshift/machine-config-operator/pkg/daemon/agentserver/agentpb"
+)
+
+// DefaultRollbackConfigPath is where the config Rollback applies is kept
+// unless set WithRollbackConfigPath.
+const DefaultRollbackConfigPath = "/etc/machine-config-daemon/agent-rollbackconfig"
+
+// ApplyConfigRequest asks for a config to be applied. The current config on
+// disk is updated from.
+type ApplyConfigRequest struct {
+	Config *mcfgv1.MachineConfig `json:"config"`
+	// Selector chooses the sections to apply. Defaults to all sections.
+	Selector *daemon.ApplySelector `json:"selector,omitempty"`
+	// Policy decides what happens on failure. Defaults to rolling back.
+	Policy *daemon.UpdatePolicy `json:"policy,omitempty"`
+}
+
+// PlanConfigRequest asks what applying a config would do.
+type PlanConfigRequest struct {
+	Config   *mcfgv1.MachineConfig `json:"config"`
+	Selector *daemon.ApplySelector `json:"selector,omitempty"`
+}
+
+// RollbackRequest asks for the config that was current before the last
+// successful ApplyConfig to be applied again.
+type RollbackRequest struct {
+	Selector *daemon.ApplySelector `json:"selector,omitempty"`
+	Policy   *daemon.UpdatePolicy  `json:"policy,omitempty"`
+}
+
+// Status describes the state of the daemon.
+type Status struct {
+	// CurrentConfigName is the name of the current config on disk, if any.
+	CurrentConfigName string `json:"currentConfigName,omitempty"`
+	// LastResult is the result of the last update made through the server.
+	LastResult *daemon.UpdateResult `json:"lastResult,omitempty"`
+	// LastError is the error of the last update made through the server.
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorCode classifies LastError.
+	LastErrorCode daemon.ErrorCode `json:"lastErrorCode,omitempty"`
+	// RollbackConfigName is the name of the config Rollback would apply.
+	RollbackConfigName string `json:"rollbackConfigName,omitempty"`
+}
+
+var (
+	errNoConfig          = errors.New("no config provided")
+	errNothingToRollBack = errors.New("no config to roll back to")
+)
+
+// Server serves the RPCs for a Daemon. Updates are serialized, the read-only
+// RPCs don't wait for them and see the state from before the update in
+// flight.
+type Server struct {
+	dn *daemon.Daemon
+	// rollbackConfigPath is where the config that was current before the
+	// last successful ApplyConfig is kept, so Rollback survives restarts.
+	rollbackConfigPath string
+
+	// mu is held for the whole of an update
+	mu sync.Mutex
+
+	// resultMu guards the outcome of the last update
+	resultMu   sync.Mutex
+	lastResult *daemon.UpdateResult
+	lastError  error
+
+	grpcServer *grpc.Server
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithRollbackConfigPath keeps the config Rollback applies at path.
+func WithRollbackConfigPath(path string) Option {
+	return func(s *Server) {
+		s.rollbackConfigPath = path
+	}
+}
+
+// New returns a Server for dn.
+func New(dn *daemon.Daemon, opts ...Option) *Server {
+	s := &Server{dn: dn, rollbackConfigPath: DefaultRollbackConfigPath}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.grpcServer = grpc.NewServer()
+	agentpb.RegisterAgentServer(s.grpcServer, &grpcService{s: s})
+	return s
+}
+
+// ListenAndServe listens on the unix socket at socketPath, replacing a stale
+// socket, and serves connections until Close is called. The socket is only
+// accessible by the owner.
+func (s *Server) ListenAndServe(socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o755); err != nil {
+		return fmt.Errorf("creating socket directory: %w", err)
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		l.Close()
+		return fmt.Errorf("restricting access to %s: %w", socketPath, err)
+	}
+	return s.Serve(l)
+}
+
+// Serve serves connections accepted from l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	klog.Infof("Serving device agent on %s", l.Addr())
+	if err := s.grpcServer.Serve(l); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("serving device agent: %w", err)
+	}
+	return nil
+}
+
+// Close stops accepting connections and waits for the RPCs in flight.
+func (s *Server) Close() error {
+	s.grpcServer.GracefulStop()
+	return nil
+}
+
+// ApplyConfig applies a config on top of the current config on disk.
+func (s *Server) ApplyConfig(ctx context.Context, req *ApplyConfigRequest) (*daemon.UpdateResult, error) {
+	if req.Config == nil {
+		return nil, errNoConfig
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply(ctx, req.Config, req.Selector, req.Policy)
+}
+
+// PlanConfig computes what applying a config would do, without applying it.
+func (s *Server) PlanConfig(req *PlanConfigRequest) (*daemon.UpdateResult, error) {
+	if req.Config == nil {
+		return nil, errNoConfig
+	}
+
+	current, err := s.dn.CurrentConfigInAgentMode()
+	if err != nil {
+		return nil, err
+	}
+	return s.dn.PlanInDeviceAgentMode(current, req.Config, selectorOrDefault(req.Selector))
+}
+
+// Status returns the status of the daemon.
+func (s *Server) Status() (*Status, error) {
+	current, err := s.dn.CurrentConfigInAgentMode()
+	if err != nil {
+		return nil, err
+	}
+	previous, err := s.rollbackConfig()
+	if err != nil {
+		return nil, err
+	}
+	s.resultMu.Lock()
+	lastResult, lastError := s.lastResult, s.lastError
+	s.resultMu.Unlock()
+
+	status := &Status{LastResult: lastResult}
+	if current != nil {
+		status.CurrentConfigName = current.GetName()
+	}
+	if lastError != nil {
+		status.LastError = lastError.Error()
+		status.LastErrorCode = daemon.ErrorCodeOf(lastError)
+	}
+	if previous != nil {
+		status.RollbackConfigName = previous.GetName()
+	}
+	return status, nil
+}
+
+// Rollback applies the config that was current before the last successful
+// ApplyConfig again.
+func (s *Server) Rollback(ctx context.Context, req *RollbackRequest) (*daemon.UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, err := s.rollbackConfig()
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return nil, errNothingToRollBack
+	}
+	return s.apply(ctx, previous, req.Selector, req.Policy)
+}
+
+// apply must be called with s.mu held.
+func (s *Server) apply(ctx context.Context, config *mcfgv1.MachineConfig, selector *daemon.ApplySelector, policy *daemon.UpdatePolicy) (*daemon.UpdateResult, error) {
+	current, err := s.dn.CurrentConfigInAgentMode()
+	if err != nil {
+		return nil, err
+	}
+
+	updatePolicy := daemon.DefaultUpdatePolicy()
+	if policy != nil {
+		updatePolicy = *policy
+	}
+
+	result, err := s.dn.RunOnceInDeviceAgentMode(ctx, current, config, selectorOrDefault(selector), updatePolicy)
+	s.resultMu.Lock()
+	s.lastResult, s.lastError = result, err
+	s.resultMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// Updates that changed nothing keep the config to roll back to, or
+	// Rollback would apply the current config again
+	if current != nil && !result.NoOp && !reflect.DeepEqual(current.Spec, config.Spec) {
+		if err := s.storeRollbackConfig(current); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// rollbackConfig returns the config Rollback applies, or nil if there is none.
+func (s *Server) rollbackConfig() (*mcfgv1.MachineConfig, error) {
+	b, err := os.ReadFile(s.rollbackConfigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading rollback config: %w", err)
+	}
+	config := &mcfgv1.MachineConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("parsing rollback config %s: %w", s.rollbackConfigPath, err)
+	}
+	return config, nil
+}
+
+// storeRollbackConfig atomically replaces the config Rollback applies.
+func (s *Server) storeRollbackConfig(config *mcfgv1.MachineConfig) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.rollbackConfigPath), 0o755); err != nil {
+		return fmt.Errorf("creating rollback config directory: %w", err)
+	}
+	tmp := s.rollbackConfigPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("writing rollback config: %w", err)
+	}
+	if err := os.Rename(tmp, s.rollbackConfigPath); err != nil {
+		return fmt.Errorf("writing rollback config: %w", err)
+	}
+	return nil
+}
+
+func selectorOrDefault(selector *daemon.ApplySelector) daemon.ApplySelector {
+	if selector == nil {
+		return daemon.ApplyAll
+	}
+	return *selector
+}
+
+// grpcService translates the messages of agentpb to and from the requests and
+// results of Server.
+type grpcService struct {
+	agentpb.UnimplementedAgentServer
+	s *Server
+}
+
+func (g *grpcService) ApplyConfig(ctx context.Context, req *agentpb.ApplyConfigRequest) (*agentpb.UpdateResult, error) {
+	config, err := decodeConfig(req.Config)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := decodePolicy(req.Policy)
+	if err != nil {
+		return nil, err
+	}
+	result, err := g.s.ApplyConfig(ctx, &ApplyConfigRequest{Config: config, Selector: decodeSelector(req.Selector), Policy: policy})
+	return encodeResult(result, err)
+}
+
+func (g *grpcService) PlanConfig(_ context.Context, req *agentpb.PlanConfigRequest) (*agentpb.UpdateResult, error) {
+	config, err := decodeConfig(req.Config)
+	if err != nil {
+		return nil, err
+	}
+	result, err := g.s.PlanConfig(&PlanConfigRequest{Config: config, Selector: decodeSelector(req.Selector)})
+	return encodeResult(result, err)
+}
+
+func (g *grpcService) Rollback(ctx context.Context, req *agentpb.RollbackRequest) (*agentpb.UpdateResult, error) {
+	policy, err := decodePolicy(req.Policy)
+	if err != nil {
+		return nil, err
+	}
+	result, err := g.s.Rollback(ctx, &RollbackRequest{Selector: decodeSelector(req.Selector), Policy: policy})
+	return encodeResult(result, err)
+}
+
+func (g *grpcService) GetStatus(context.Context, *agentpb.GetStatusRequest) (*agentpb.Status, error) {
+	st, err := g.s.Status()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	reply := &agentpb.Status{
+		CurrentConfigName:  st.CurrentConfigName,
+		LastError:          st.LastError,
+		LastErrorCode:      string(st.LastErrorCode),
+		RollbackConfigName: st.RollbackConfigName,
+	}
+	if st.LastResult != nil {
+		if reply.LastResult, err = json.Marshal(st.LastResult); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return reply, nil
+}
+
+func decodeConfig(b []byte) (*mcfgv1.MachineConfig, error) {
+	if len(b) == 0 {
+		return nil, status.Error(codes.InvalidArgument, errNoConfig.Error())
+	}
+	config := &mcfgv1.MachineConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "parsing config: %v", err)
+	}
+	return config, nil
+}
+
+func decodePolicy(b []byte) (*daemon.UpdatePolicy, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	policy := &daemon.UpdatePolicy{}
+	if err := json.Unmarshal(b, policy); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "parsing policy: %v", err)
+	}
+	return policy, nil
+}
+
+func decodeSelector(selector *uint32) *daemon.ApplySelector {
+	if selector == nil {
+		return nil
+	}
+	s := daemon.ApplySelector(*selector)
+	return &s
+}
+
+// encodeResult returns the result of an update, or its error with a gRPC code
+// after its daemon.ErrorCode.
+func encodeResult(result *daemon.UpdateResult, err error) (*agentpb.UpdateResult, error) {
+	if err != nil {
+		return nil, status.Error(grpcCode(err), err.Error())
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &agentpb.UpdateResult{Result: b}, nil
+}
+
+func grpcCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, errNoConfig):
+		return codes.InvalidArgument
+	case errors.Is(err, errNothingToRollBack):
+		return codes.FailedPrecondition
+	}
+	switch daemon.ErrorCodeOf(err) {
+	case daemon.ErrorCodeUnreconcilable:
+		return codes.FailedPrecondition
+	case daemon.ErrorCodeCanceled:
+		return codes.Canceled
+	default:
+		return codes.Unknown
+	}
+}
@@ -0,0 +1,177 @@
+package agentserver
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/pkg/daemon"
+	"github.com/openshift/machine-config-operator/pkg/daemon/agentserver/agentpb"
+	"github.com/openshift/machine-config-operator/test/helpers"
+)
+
+func newTestClient(t *testing.T, testDir string) agentpb.AgentClient {
+	t.Helper()
+
+	dn, err := daemon.NewClusterlessDaemon(
+		daemon.WithCurrentConfigPath(filepath.Join(testDir, "currentconfig")),
+		daemon.WithCurrentImagePath(filepath.Join(testDir, "currentimage")),
+	)
+	require.Nil(t, err)
+
+	s := New(dn, WithRollbackConfigPath(filepath.Join(testDir, "rollbackconfig")))
+	socketPath := filepath.Join(testDir, "agent.sock")
+	served := make(chan error)
+	go func() {
+		served <- s.ListenAndServe(socketPath)
+	}()
+	t.Cleanup(func() {
+		require.Nil(t, s.Close())
+		require.Nil(t, <-served)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return agentpb.NewAgentClient(conn)
+}
+
+func encodeConfig(t *testing.T, config *mcfgv1.MachineConfig) []byte {
+	b, err := json.Marshal(config)
+	require.Nil(t, err)
+	return b
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t, t.TempDir())
+
+	st, err := client.GetStatus(ctx, &agentpb.GetStatusRequest{})
+	require.Nil(t, err)
+	assert.Equal(t, "", st.CurrentConfigName)
+	assert.Equal(t, "", st.RollbackConfigName)
+	assert.Empty(t, st.LastResult)
+
+	ignCfg := ctrlcommon.NewIgnConfig()
+	ignCfg.Storage.Files = []ign3types.File{ctrlcommon.NewIgnFile("/etc/agentserver-test", "hello")}
+	newConfig := helpers.CreateMachineConfigFromIgnition(ignCfg)
+	newConfig.Name = "rendered-1"
+
+	reply, err := client.PlanConfig(ctx, &agentpb.PlanConfigRequest{Config: encodeConfig(t, newConfig)})
+	require.Nil(t, err)
+	result := daemon.UpdateResult{}
+	require.Nil(t, json.Unmarshal(reply.Result, &result))
+	assert.True(t, result.DryRun)
+	assert.Equal(t, "rendered-1", result.NewConfigName)
+	assert.Equal(t, []string{"/etc/agentserver-test"}, result.FilesWritten)
+
+	_, err = client.ApplyConfig(ctx, &agentpb.ApplyConfigRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "no config provided", status.Convert(err).Message())
+
+	_, err = client.Rollback(ctx, &agentpb.RollbackRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, "no config to roll back to", status.Convert(err).Message())
+}
+
+func TestServerRollbackConfigSurvivesRestart(t *testing.T) {
+	testDir := t.TempDir()
+
+	dn, err := daemon.NewClusterlessDaemon(
+		daemon.WithCurrentConfigPath(filepath.Join(testDir, "currentconfig")),
+		daemon.WithCurrentImagePath(filepath.Join(testDir, "currentimage")),
+	)
+	require.Nil(t, err)
+	previous := helpers.CreateMachineConfigFromIgnition(ctrlcommon.NewIgnConfig())
+	previous.Name = "rendered-0"
+	s := New(dn, WithRollbackConfigPath(filepath.Join(testDir, "rollbackconfig")))
+	require.Nil(t, s.storeRollbackConfig(previous))
+
+	client := newTestClient(t, testDir)
+	st, err := client.GetStatus(context.Background(), &agentpb.GetStatusRequest{})
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-0", st.RollbackConfigName)
+}
+
+func TestServerRollbackConfigKeptByNoOpUpdates(t *testing.T) {
+	ctx := context.Background()
+	testDir := t.TempDir()
+
+	dn, err := daemon.NewClusterlessDaemon(
+		daemon.WithCurrentConfigPath(filepath.Join(testDir, "currentconfig")),
+		daemon.WithCurrentImagePath(filepath.Join(testDir, "currentimage")),
+	)
+	require.Nil(t, err)
+	s := New(dn, WithRollbackConfigPath(filepath.Join(testDir, "rollbackconfig")))
+
+	newConfig := func(name, contents string) *mcfgv1.MachineConfig {
+		ignCfg := ctrlcommon.NewIgnConfig()
+		ignCfg.Storage.Files = []ign3types.File{ctrlcommon.NewIgnFile(filepath.Join(testDir, "agent.conf"), contents)}
+		config := helpers.CreateMachineConfigFromIgnition(ignCfg)
+		config.Name = name
+		return config
+	}
+	selector := daemon.ApplyFiles
+	_, err = s.ApplyConfig(ctx, &ApplyConfigRequest{Config: newConfig("rendered-0", "0"), Selector: &selector})
+	require.Nil(t, err)
+	_, err = s.ApplyConfig(ctx, &ApplyConfigRequest{Config: newConfig("rendered-1", "1"), Selector: &selector})
+	require.Nil(t, err)
+
+	result, err := s.ApplyConfig(ctx, &ApplyConfigRequest{Config: newConfig("rendered-1", "1"), Selector: &selector})
+	require.Nil(t, err)
+	assert.True(t, result.NoOp)
+	st, err := s.Status()
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-1", st.CurrentConfigName)
+	assert.Equal(t, "rendered-0", st.RollbackConfigName)
+
+	// Neither do forced updates to the same config
+	policy := daemon.DefaultUpdatePolicy()
+	policy.ForceApply = true
+	result, err = s.ApplyConfig(ctx, &ApplyConfigRequest{Config: newConfig("rendered-1", "1"), Selector: &selector, Policy: &policy})
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	st, err = s.Status()
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-0", st.RollbackConfigName)
+}
+
+func TestServerStatusDuringUpdate(t *testing.T) {
+	testDir := t.TempDir()
+
+	dn, err := daemon.NewClusterlessDaemon(
+		daemon.WithCurrentConfigPath(filepath.Join(testDir, "currentconfig")),
+		daemon.WithCurrentImagePath(filepath.Join(testDir, "currentimage")),
+	)
+	require.Nil(t, err)
+	s := New(dn, WithRollbackConfigPath(filepath.Join(testDir, "rollbackconfig")))
+
+	// An update in flight holds s.mu
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done := make(chan error)
+	go func() {
+		_, err := s.Status()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Status waited for the update in flight")
+	}
+}
@@ -0,0 +1,176 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// ostreeBootedPath exists if the system was booted from an ostree deployment.
+const ostreeBootedPath = "/run/ostree-booted"
+
+// BootcClient updates the OS of image mode hosts built with bootc, which have
+// no rpm-ostree, with the bootc CLI. The OS is changed by switching to
+// another image only: kernel arguments and extensions are part of the image,
+// and kernel types select the image; see
+// MachineConfigKernelTypeImagesAnnotationKey.
+type BootcClient struct {
+	run    func(ctx context.Context, args ...string) error
+	output func(args ...string) ([]byte, error)
+}
+
+// NewBootcClient returns a BootcClient running bootc.
+func NewBootcClient() *BootcClient {
+	return &BootcClient{
+		run: func(ctx context.Context, args ...string) error {
+			return runCmdSyncContext(ctx, "bootc", args...)
+		},
+		output: func(args ...string) ([]byte, error) {
+			return runGetOut("bootc", args...)
+		},
+	}
+}
+
+// isBootcHost returns true if the system was booted from an ostree deployment
+// and is managed by bootc rather than rpm-ostree.
+func isBootcHost() bool {
+	if _, err := os.Stat(ostreeBootedPath); err != nil {
+		return false
+	}
+	if _, err := exec.LookPath("rpm-ostree"); err == nil {
+		return false
+	}
+	_, err := exec.LookPath("bootc")
+	return err == nil
+}
+
+// bootcHost is the part of the output of bootc status --json we use.
+type bootcHost struct {
+	Status struct {
+		Booted   *bootcBootEntry `json:"booted"`
+		Staged   *bootcBootEntry `json:"staged"`
+		Rollback *bootcBootEntry `json:"rollback"`
+	} `json:"status"`
+}
+
+// bootcBootEntry is a deployment of bootc status.
+type bootcBootEntry struct {
+	Image *struct {
+		Image struct {
+			Image     string `json:"image"`
+			Transport string `json:"transport"`
+		} `json:"image"`
+		Version     string `json:"version"`
+		ImageDigest string `json:"imageDigest"`
+	} `json:"image"`
+	Pinned bool `json:"pinned"`
+}
+
+// QueryStatus returns the deployments of the host.
+func (b *BootcClient) QueryStatus() (*bootcHost, error) {
+	out, err := b.output("status", "--json", "--format-version=1")
+	if err != nil {
+		return nil, err
+	}
+	host := &bootcHost{}
+	if err := json.Unmarshal(out, host); err != nil {
+		return nil, fmt.Errorf("parsing bootc status: %w", err)
+	}
+	return host, nil
+}
+
+// GetStatus returns the human readable status of the deployments.
+func (b *BootcClient) GetStatus() (string, error) {
+	out, err := b.output("status")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// GetBootedOSImageURL returns the image, version and digest of the booted
+// deployment. Images not pulled from a registry start with their transport.
+func (b *BootcClient) GetBootedOSImageURL() (string, string, string, error) {
+	host, err := b.QueryStatus()
+	if err != nil {
+		return "", "", "", err
+	}
+	booted := host.Status.Booted
+	if booted == nil || booted.Image == nil {
+		return "", "", "", fmt.Errorf("no booted bootc image found")
+	}
+	return joinOSImageTransport(booted.Image.Image.Transport, booted.Image.Image.Image), booted.Image.Version, booted.Image.ImageDigest, nil
+}
+
+// HasStagedDeployment returns true if a deployment is staged for the next
+// boot.
+func (b *BootcClient) HasStagedDeployment() (bool, error) {
+	host, err := b.QueryStatus()
+	if err != nil {
+		return false, err
+	}
+	return host.Status.Staged != nil, nil
+}
+
+// Switch pulls or imports imgURL and stages it for the next boot, killing
+// bootc if ctx is done first.
+func (b *BootcClient) Switch(ctx context.Context, imgURL string) error {
+	transport, image := splitOSImageTransport(imgURL)
+	if err := b.run(ctx, "switch", "--transport", transport, image); err != nil {
+		return fmt.Errorf("failed to switch OS to %s: %w", imgURL, err)
+	}
+	logSystem("Staged OS image %s", imgURL)
+	return nil
+}
+
+// Rollback queues the previous deployment for the next boot, discarding a
+// staged one.
+func (b *BootcClient) Rollback() error {
+	return b.run(context.Background(), "rollback")
+}
+
+// UsrOverlay mounts a transient writable overlay over /usr, which is
+// discarded on reboot.
+func (b *BootcClient) UsrOverlay(ctx context.Context) error {
+	return b.run(ctx, "usr-overlay")
+}
+
+// checkBootcOSChanges returns an error if changes include the kernel arguments
+// or extensions, which bootc hosts get from their image only.
+func checkBootcOSChanges(changes OSChangeSet) error {
+	switch {
+	case changes.KernelArguments:
+		return fmt.Errorf("kernel arguments can't be changed on bootc hosts, build them into the OS image instead")
+	case changes.Extensions:
+		return fmt.Errorf("extensions can't be installed on bootc hosts, build them into the OS image instead")
+	}
+	return nil
+}
+
+// discardStaged removes a staged deployment with ostree admin undeploy, as
+// bootc has no command for it and bootc hosts have no rpm-ostree.
+func (b *BootcClient) discardStaged() error {
+	host, err := b.QueryStatus()
+	if err != nil {
+		return err
+	}
+	if host.Status.Staged == nil {
+		return nil
+	}
+	out, err := runGetOut("ostree", "admin", "status")
+	if err != nil {
+		return fmt.Errorf("querying deployments: %w", err)
+	}
+	for i, d := range parseOstreeDeployments(string(out)) {
+		if d.Staged {
+			klog.Infof("Removing staged deployment %s", d.ID)
+			return runCmdSync("ostree", "admin", "undeploy", strconv.Itoa(i))
+		}
+	}
+	return fmt.Errorf("staged deployment not found in ostree admin status")
+}
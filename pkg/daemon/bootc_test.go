@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootcClient(t *testing.T) {
+	status := `{"status": {
+		"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}, "version": "1.0", "imageDigest": "sha256:aaa"}},
+		"staged": {"image": {"image": {"image": "quay.io/example/os:2", "transport": "registry"}, "version": "2.0", "imageDigest": "sha256:bbb"}}
+	}}`
+	var runs [][]string
+	b := &BootcClient{
+		run: func(_ context.Context, args ...string) error {
+			runs = append(runs, args)
+			return nil
+		},
+		output: func(args ...string) ([]byte, error) {
+			assert.Equal(t, []string{"status", "--json", "--format-version=1"}, args)
+			return []byte(status), nil
+		},
+	}
+
+	image, version, imageDigest, err := b.GetBootedOSImageURL()
+	require.Nil(t, err)
+	assert.Equal(t, "quay.io/example/os:1", image)
+	assert.Equal(t, "1.0", version)
+	assert.Equal(t, "sha256:aaa", imageDigest)
+	staged, err := b.HasStagedDeployment()
+	require.Nil(t, err)
+	assert.True(t, staged)
+
+	// The staged deployment is undeployed rather than replaced
+	ostreeStatus, ostreeCalls := fakeOstree(t, t.TempDir())
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("  fedora 3c1e5a.0 (staged)\n* fedora 9f2b44.0\n"), 0o644))
+	require.Nil(t, b.Switch(context.Background(), "docker://quay.io/example/os:3"))
+	require.Nil(t, b.discardStaged())
+	assert.Equal(t, [][]string{
+		{"switch", "--transport", "registry", "quay.io/example/os:3"},
+	}, runs)
+	assert.Equal(t, "admin undeploy 0\n", ostreeCalls())
+
+	// Without a staged deployment there's nothing to discard
+	status = `{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}}}}}`
+	runs = nil
+	require.Nil(t, b.discardStaged())
+	assert.Empty(t, runs)
+	assert.Empty(t, ostreeCalls())
+
+	assert.Error(t, checkBootcOSChanges(OSChangeSet{KernelArguments: true}))
+	assert.Error(t, checkBootcOSChanges(OSChangeSet{Extensions: true}))
+	assert.Nil(t, checkBootcOSChanges(OSChangeSet{OSImageURL: true}))
+
+	ids, booted := parseOstreeAdminStatus(`  fedora 3c1e5a.0 (staged)
+    origin: <unknown origin type>
+* fedora 9f2b44.0
+    origin: <unknown origin type>
+  fedora 77aa01.0 (rollback)
+`)
+	assert.Equal(t, []string{"3c1e5a.0", "9f2b44.0", "77aa01.0"}, ids)
+	assert.Equal(t, 1, booted)
+	_, booted = parseOstreeAdminStatus("")
+	assert.Equal(t, -1, booted)
+}
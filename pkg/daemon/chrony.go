@@ -0,0 +1,35 @@
+package daemon
+
+import (
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// chronyConfigPath and chronyConfigDir hold the chrony configuration,
+	// which is applied live by restarting chronyd.
+	chronyConfigPath = "/etc/chrony.conf"
+	chronyConfigDir  = "/etc/chrony.d"
+)
+
+// isChronyConfigFile returns true if path is part of the chrony
+// configuration.
+func isChronyConfigFile(path string) bool {
+	return path == chronyConfigPath || strings.HasPrefix(path, chronyConfigDir+"/")
+}
+
+// restartChronyd restarts chronyd and waits up to a minute for it to
+// synchronize the clock with its new sources, returning whether it did. Not
+// synchronizing isn't an error, as devices may well be offline.
+func restartChronyd() (bool, error) {
+	if err := runCmdSync("systemctl", "restart", "chronyd"); err != nil {
+		return false, err
+	}
+	// At most 60 tries a second apart, with any correction and skew
+	if err := runCmdSync("chronyc", "waitsync", "60", "0", "0", "1"); err != nil {
+		klog.Warningf("chronyd did not synchronize the clock after restarting: %v", err)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/osrelease"
+)
+
+// Option configures a Daemon created by NewClusterlessDaemon.
+type Option func(*Daemon)
+
+// WithNodeName sets the name the daemon uses to identify the machine in logs
+// and events. It defaults to the hostname.
+func WithNodeName(name string) Option {
+	return func(dn *Daemon) {
+		dn.name = name
+	}
+}
+
+// WithStatusReporter sets the StatusReporter used to report update progress.
+func WithStatusReporter(reporter StatusReporter) Option {
+	return func(dn *Daemon) {
+		dn.statusReporter = reporter
+	}
+}
+
+// WithUpdateObserver registers an UpdateObserver.
+func WithUpdateObserver(observer UpdateObserver) Option {
+	return func(dn *Daemon) {
+		dn.updateObservers = append(dn.updateObservers, observer)
+	}
+}
+
+// WithCurrentConfigPath overrides where the current config is stored on disk.
+func WithCurrentConfigPath(path string) Option {
+	return func(dn *Daemon) {
+		dn.currentConfigPath = path
+	}
+}
+
+// WithCurrentImagePath overrides where the current image is stored on disk.
+func WithCurrentImagePath(path string) Option {
+	return func(dn *Daemon) {
+		dn.currentImagePath = path
+	}
+}
+
+// NewClusterlessDaemon creates a Daemon that can be used with
+// RunOnceInDeviceAgentMode and PlanInDeviceAgentMode without clientsets,
+// informers or a node object. It manages the root filesystem the process
+// runs in; commands running with the host's root filesystem mounted elsewhere
+// chroot into it first, e.g. with ReexecuteForTargetRoot as the MCD does for
+// --root-mount.
+func NewClusterlessDaemon(opts ...Option) (*Daemon, error) {
+	mock := false
+	if os.Getuid() != 0 {
+		mock = true
+	}
+
+	hostos := osrelease.OperatingSystem{}
+	if !mock {
+		var err error
+		hostos, err = osrelease.GetHostRunningOS()
+		if err != nil {
+			hostOS.WithLabelValues("unsupported", "").Set(1)
+			return nil, fmt.Errorf("checking operating system: %w", err)
+		}
+	}
+
+	dn, err := newDaemonForOS(nil, hostos, mock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing to sync against, so we are never waiting for a first sync
+	dn.booting = false
+	dn.skipReboot = true
+	if dn.name, err = os.Hostname(); err != nil {
+		klog.Warningf("Failed to get hostname: %v", err)
+	}
+
+	if dn.remoteFetcher, err = newRemoteFetcher(DefaultRemoteContentOptions()); err != nil {
+		return nil, err
+	}
+	dn.templateValuesPath = defaultTemplateValuesPath
+	dn.contentStore = &contentStore{dir: defaultContentStoreDirPath}
+	dn.deltaWrites = true
+	backupRetention := DefaultBackupRetentionPolicy()
+	dn.backupRetention = &backupRetention
+
+	for _, opt := range opts {
+		opt(dn)
+	}
+
+	return dn, nil
+}
@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClusterlessDaemon(t *testing.T) {
+	testDir := t.TempDir()
+	observer := &recordingUpdateObserver{}
+
+	d, err := NewClusterlessDaemon(
+		WithNodeName("device"),
+		WithCurrentConfigPath(filepath.Join(testDir, "currentconfig")),
+		WithCurrentImagePath(filepath.Join(testDir, "currentimage")),
+		WithUpdateObserver(observer),
+		WithStatusReporter(NewNoopStatusReporter()),
+	)
+	require.Nil(t, err)
+
+	assert.Equal(t, "device", d.name)
+	assert.Nil(t, d.kubeClient)
+	assert.Nil(t, d.nodeWriter)
+	assert.Nil(t, d.node)
+	assert.True(t, d.skipReboot)
+	assert.Equal(t, filepath.Join(testDir, "currentconfig"), d.currentConfigPath)
+	assert.Equal(t, []UpdateObserver{observer}, d.updateObservers)
+	assert.NotNil(t, d.statusReporter)
+}
@@ -0,0 +1,202 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"k8s.io/klog/v2"
+)
+
+// ConfigDriftEvent is a drift found by the Config Drift Monitor, as written
+// to its event sink.
+type ConfigDriftEvent struct {
+	Time     time.Time           `json:"time"`
+	Category ConfigDriftCategory `json:"category"`
+	// ConfigName is the MachineConfig the host drifted from.
+	ConfigName string `json:"configName"`
+	// Path is the drifted file, or the unit whose enablement drifted.
+	Path string `json:"path,omitempty"`
+	// ExpectedHash is the sha256 of the contents the config has for the
+	// path, as "sha256-<hex>", for file and unit drift. For remote contents,
+	// it is their verification hash, e.g. "sha512-<hex>", if they have one.
+	ExpectedHash string `json:"expectedHash,omitempty"`
+	// FoundHash is the sha256 of the contents on disk, empty if the path
+	// doesn't exist. It equals ExpectedHash if only the mode drifted.
+	FoundHash string `json:"foundHash,omitempty"`
+	// Expected and Found are the expected and found state for the other
+	// categories, e.g. the kernel arguments.
+	Expected string `json:"expected,omitempty"`
+	Found    string `json:"found,omitempty"`
+	// Reason is why the path counts as drifted.
+	Reason string `json:"reason"`
+	// Remediated is true if the path was restored by ConfigDriftRemediation.
+	Remediated bool `json:"remediated,omitempty"`
+}
+
+// ConfigDriftEventSink is where the Config Drift Monitor writes a
+// ConfigDriftEvent for every drifted path, in addition to reporting the drift
+// to OnDrift, so agents can consume drift programmatically.
+type ConfigDriftEventSink struct {
+	// Path is a unix socket the events are sent to as JSON lines, or as
+	// one datagram each for datagram sockets, or otherwise a file they are
+	// appended to as JSON lines.
+	Path string
+}
+
+// driftEventSinkTimeout bounds connecting to a socket sink and sending the
+// events to it, so a stuck consumer doesn't stall drift handling. Overridden
+// by tests.
+var driftEventSinkTimeout = 5 * time.Second
+
+// WithConfigDriftEventSink makes the Config Drift Monitor of the daemon write
+// drift events to sink.
+func WithConfigDriftEventSink(sink ConfigDriftEventSink) Option {
+	return func(dn *Daemon) {
+		dn.driftEventSink = &sink
+	}
+}
+
+// emit writes events to the sink.
+func (s *ConfigDriftEventSink) emit(events []ConfigDriftEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	lines := make([][]byte, 0, len(events))
+	for _, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, append(b, '\n'))
+	}
+
+	if info, err := os.Stat(s.Path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		return sendDriftEvents(s.Path, lines)
+	}
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, defaultFilePermissions)
+	if err != nil {
+		return fmt.Errorf("opening drift event sink: %w", err)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := f.Write(line); err != nil {
+			return fmt.Errorf("writing drift event: %w", err)
+		}
+	}
+	return nil
+}
+
+// sendDriftEvents sends lines to the unix socket at path, as a stream or as
+// one datagram each.
+func sendDriftEvents(path string, lines [][]byte) error {
+	conn, err := net.DialTimeout("unix", path, driftEventSinkTimeout)
+	if errors.Is(err, syscall.EPROTOTYPE) {
+		conn, err = net.DialTimeout("unixgram", path, driftEventSinkTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to drift event sink: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(driftEventSinkTimeout)); err != nil {
+		return fmt.Errorf("setting drift event sink deadline: %w", err)
+	}
+	for _, line := range lines {
+		if _, err := conn.Write(line); err != nil {
+			return fmt.Errorf("sending drift event: %w", err)
+		}
+	}
+	return nil
+}
+
+// configDriftEvents returns an event for every file and unit of mc that
+// drifted on disk, as of now.
+func configDriftEvents(mc *mcfgv1.MachineConfig, systemdPath string, now time.Time) ([]ConfigDriftEvent, error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(mc.Spec.Config.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []ConfigDriftEvent
+	add := func(category ConfigDriftCategory, path, expectedHash string, drift error) {
+		event := ConfigDriftEvent{
+			Time:         now,
+			Category:     category,
+			ConfigName:   mc.GetName(),
+			Path:         path,
+			ExpectedHash: expectedHash,
+			Reason:       drift.Error(),
+		}
+		if found, err := hashFile(path); err == nil {
+			event.FoundHash = found
+		}
+		events = append(events, event)
+	}
+	for _, f := range ignConfig.Storage.Files {
+		if f.Path == caBundleFilePath || usrHotfixDiscarded(f.Path) {
+			continue
+		}
+		if drift := checkV3File(f); drift != nil {
+			add(ConfigDriftFile, f.Path, expectedFileHash(f), drift)
+		}
+	}
+	for _, u := range ignConfig.Systemd.Units {
+		for _, d := range u.Dropins {
+			if drift := checkV3Dropin(systemdPath, u, d); drift != nil {
+				add(ConfigDriftUnit, getIgn3SystemdDropinPath(systemdPath, u, d), hashContents([]byte(describeString(d.Contents))), drift)
+			}
+		}
+		// Only the unit itself, its dropins were checked above
+		if drift := checkV3Unit(ign3types.Unit{Name: u.Name, Contents: u.Contents, Mask: u.Mask}, systemdPath); drift != nil {
+			add(ConfigDriftUnit, getIgn3SystemdUnitPath(systemdPath, u), hashContents([]byte(describeString(u.Contents))), drift)
+		}
+	}
+	return events, nil
+}
+
+// expectedFileHash returns the hash of the contents the config has for f:
+// the verification hash for remote contents, and "" if it has none or the
+// contents can't be decoded.
+func expectedFileHash(f ign3types.File) string {
+	if isRemoteSource(f.Contents.Source) {
+		if f.Contents.Verification.Hash == nil {
+			return ""
+		}
+		return *f.Contents.Verification.Hash
+	}
+	contents, err := decodeFileContents(f)
+	if err != nil {
+		klog.Warningf("Could not decode file %q for its drift event: %v", f.Path, err)
+		return ""
+	}
+	return hashContents(contents)
+}
+
+// markRemediated marks the events for the restored paths, and for the dropins
+// of restored units, as remediated.
+func markRemediated(events []ConfigDriftEvent, restored []string) {
+	for i := range events {
+		for _, path := range restored {
+			if events[i].Path == path || strings.HasPrefix(events[i].Path, path+".d/") {
+				events[i].Remediated = true
+			}
+		}
+	}
+}
+
+// hashContents returns the sha256 of contents, as "sha256-<hex>".
+func hashContents(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256-" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"time"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultScanBytesPerSecond is the read rate of full scans unless set.
+	defaultScanBytesPerSecond = 4 * 1024 * 1024
+
+	scanChunkSize = 64 * 1024
+
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// ConfigDriftFullScan makes the Config Drift Monitor periodically read all
+// files, units and dropins of the currently applied MachineConfig and compare
+// their checksums and modes, to catch drift that inotify misses, e.g. by
+// writes to the block device or while the monitor was stopped. The first scan
+// runs when the monitor starts. Drift found is handled as if a file event
+// reported it.
+type ConfigDriftFullScan struct {
+	// Interval is the time between the end of a scan and the start of the
+	// next. It must be positive.
+	Interval time.Duration
+	// BytesPerSecond limits the rate files are read at. Defaults to 4MiB/s.
+	BytesPerSecond int64
+}
+
+// WithConfigDriftFullScan makes the Config Drift Monitor of the daemon scan
+// all managed files as scan says.
+func WithConfigDriftFullScan(scan ConfigDriftFullScan) Option {
+	return func(dn *Daemon) {
+		if scan.Interval <= 0 {
+			// Options can't fail; scans without a pause would keep the disk
+			// busy
+			klog.Errorf("Invalid config drift full scan interval %v, not scanning", scan.Interval)
+			dn.driftFullScan = nil
+			return
+		}
+		dn.driftFullScan = &scan
+	}
+}
+
+// Runs a full scan every interval until the monitor stops, and sends the
+// result of those that found drift to the scan channel. Scans run with idle IO
+// priority.
+func (c *configDriftWatcher) runFullScans() {
+	// The IO priority is that of the thread. It is never unlocked, so the
+	// thread exits with the scans instead of running other goroutines at idle
+	// priority.
+	runtime.LockOSThread()
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift); errno != 0 {
+		klog.V(4).Infof("Could not lower IO priority of config drift scans: %v", errno)
+	}
+
+	for {
+		drifted, err := c.fullScan()
+		if errors.Is(err, errScanStopped) {
+			return
+		}
+		if drifted || err != nil {
+			select {
+			case c.scanCh <- err:
+			case <-c.scanStopCh:
+				return
+			}
+		}
+		select {
+		case <-time.After(c.FullScan.Interval):
+		case <-c.scanStopCh:
+			return
+		}
+	}
+}
+
+// Reads all files, units and dropins of the MachineConfig, and returns true if
+// one of them is missing, or has a mode or checksum other than the config
+// says. Remote files are only checked for their mode, files whose contents
+// can't be decoded and units and dropins without contents are skipped.
+func (c *configDriftWatcher) fullScan() (bool, error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(c.MachineConfig.Spec.Config.Raw)
+	if err != nil {
+		return false, err
+	}
+
+	rate := c.FullScan.BytesPerSecond
+	if rate <= 0 {
+		rate = defaultScanBytesPerSecond
+	}
+	s := &throttledScan{rate: rate, start: time.Now(), stopCh: c.scanStopCh}
+
+	for _, f := range ignConfig.Storage.Files {
+		if f.Path == caBundleFilePath || usrHotfixDiscarded(f.Path) {
+			continue
+		}
+		mode := defaultFilePermissions
+		if f.Mode != nil {
+			mode = os.FileMode(*f.Mode)
+		}
+		var contents []byte
+		if !isRemoteSource(f.Contents.Source) {
+			if contents, err = decodeFileContents(f); err != nil {
+				klog.Warningf("Not scanning %q: could not decode its contents: %v", f.Path, err)
+				continue
+			}
+		}
+		if drifted, err := s.drifted(f.Path, contents, mode, !isRemoteSource(f.Contents.Source)); drifted || err != nil {
+			return drifted, err
+		}
+	}
+	for _, u := range ignConfig.Systemd.Units {
+		for _, d := range u.Dropins {
+			if d.Contents == nil || *d.Contents == "" {
+				continue
+			}
+			if drifted, err := s.drifted(getIgn3SystemdDropinPath(c.SystemdPath, u, d), []byte(*d.Contents), defaultFilePermissions, true); drifted || err != nil {
+				return drifted, err
+			}
+		}
+		// Masked units are links to /dev/null
+		if u.Contents == nil || *u.Contents == "" || isTrue(u.Mask) {
+			continue
+		}
+		if drifted, err := s.drifted(getIgn3SystemdUnitPath(c.SystemdPath, u), []byte(*u.Contents), defaultFilePermissions, true); drifted || err != nil {
+			return drifted, err
+		}
+	}
+	return false, nil
+}
+
+// throttledScan reads files at no more than rate bytes per second since start.
+type throttledScan struct {
+	rate   int64
+	start  time.Time
+	read   int64
+	stopCh <-chan struct{}
+}
+
+var errScanStopped = errors.New("config drift scan stopped")
+
+// drifted returns true if the file at path is missing or has another mode
+// than mode, or, if compare is set, other contents than contents. Files with
+// content normalizers are read in full and compared once normalized.
+func (s *throttledScan) drifted(path string, contents []byte, mode os.FileMode, compare bool) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Mode().Perm() != mode.Perm() {
+		return true, nil
+	}
+	if !compare {
+		return false, nil
+	}
+	normalize := ctrlcommon.HasContentNormalizer(path)
+	if !normalize && info.Size() != int64(len(contents)) {
+		return true, nil
+	}
+
+	// Read from disk rather than from the page cache, where it can be
+	// helped
+	_ = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+	h := sha256.New()
+	var onDisk bytes.Buffer
+	var w io.Writer = h
+	if normalize {
+		w = &onDisk
+	}
+	buf := make([]byte, scanChunkSize)
+	for {
+		n, err := f.Read(buf)
+		w.Write(buf[:n])
+		if err := s.throttle(int64(n)); err != nil {
+			return false, err
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if normalize {
+		return !ctrlcommon.FileContentsEquivalent(path, onDisk.Bytes(), contents), nil
+	}
+	expected := sha256.Sum256(contents)
+	return !bytes.Equal(h.Sum(nil), expected[:]), nil
+}
+
+// throttle accounts for n bytes read, and waits until they are within the
+// rate.
+func (s *throttledScan) throttle(n int64) error {
+	s.read += n
+	wait := time.Duration(s.read*int64(time.Second)/s.rate) - time.Since(s.start)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-s.stopCh:
+		return errScanStopped
+	}
+}
@@ -0,0 +1,244 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// ostree swaps the boot loader entries for every new deployment, including
+// changes of the kernel arguments, and records deployments staged for the next
+// boot.
+var defaultDeploymentPaths = []string{"/boot/loader", "/run/ostree/staged-deployment"}
+
+// nextBootKernelArguments returns the kernel arguments of the deployment the
+// host boots next.
+func nextBootKernelArguments() ([]string, error) {
+	out, err := runGetOut("rpm-ostree", "kargs")
+	if err != nil {
+		return nil, err
+	}
+	return splitKernelArguments(strings.TrimSpace(string(out))), nil
+}
+
+// nextBootOSDeployment returns the checksum of the deployment the host boots
+// next, i.e. the staged one, if any.
+func (dn *Daemon) nextBootOSDeployment() (string, error) {
+	booted, staged, err := dn.NodeUpdaterClient.GetBootedAndStagedDeployment()
+	if err != nil {
+		return "", err
+	}
+	if staged != nil {
+		return staged.Checksum, nil
+	}
+	return booted.Checksum, nil
+}
+
+// Adds the symlinks enabling the units whose enablement the MachineConfig sets
+// to the watched file paths, and returns the directories they are in.
+func (c *configDriftWatcher) watchUnitEnablement() (sets.Set[string], error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(c.MachineConfig.Spec.Config.Raw)
+	if err != nil {
+		return nil, err
+	}
+	dirs := sets.Set[string]{}
+	for _, u := range ignConfig.Systemd.Units {
+		if u.Enabled == nil {
+			continue
+		}
+		for _, link := range unitInstallLinks(u, c.SystemdPath) {
+			c.filePaths.Insert(link)
+			dirs.Insert(filepath.Dir(link))
+		}
+	}
+	// Creating a directory is an event of its parent, e.g. the systemd path
+	c.filePaths = c.filePaths.Union(dirs)
+	return dirs, nil
+}
+
+// Records the kernel arguments and OS deployment as of now, and adds the
+// deployment paths to the watched file paths.
+func (c *configDriftWatcher) watchDeployment() error {
+	if c.KernelArguments == nil && c.OSDeployment == nil {
+		return nil
+	}
+	var err error
+	if c.KernelArguments != nil {
+		if c.kernelArguments, err = c.KernelArguments(); err != nil {
+			return fmt.Errorf("could not get kernel arguments: %w", err)
+		}
+	}
+	if c.OSDeployment != nil {
+		if c.osDeployment, err = c.OSDeployment(); err != nil {
+			return fmt.Errorf("could not get OS deployment: %w", err)
+		}
+	}
+	c.filePaths.Insert(c.DeploymentPaths...)
+	return nil
+}
+
+// Returns an event for the kernel arguments and the OS deployment, if they
+// drifted.
+func (c *configDriftWatcher) deploymentDrift(now time.Time) ([]ConfigDriftEvent, error) {
+	var events []ConfigDriftEvent
+	if c.KernelArguments != nil {
+		kargs, err := c.KernelArguments()
+		if err != nil {
+			return nil, fmt.Errorf("could not get kernel arguments: %w", err)
+		}
+		var reasons []string
+		if missing := subtractStrings(parseKernelArguments(c.MachineConfig.Spec.KernelArguments), kargs); len(missing) > 0 {
+			reasons = append(reasons, fmt.Sprintf("missing expected kernel arguments: %v", missing))
+		}
+		if added := subtractStrings(kargs, c.kernelArguments); len(added) > 0 {
+			reasons = append(reasons, fmt.Sprintf("added kernel arguments: %v", added))
+		}
+		if removed := subtractStrings(c.kernelArguments, kargs); len(removed) > 0 {
+			reasons = append(reasons, fmt.Sprintf("removed kernel arguments: %v", removed))
+		}
+		if len(reasons) > 0 {
+			events = append(events, ConfigDriftEvent{
+				Time:       now,
+				Category:   ConfigDriftKernelArguments,
+				ConfigName: c.MachineConfig.GetName(),
+				Expected:   strings.Join(c.kernelArguments, " "),
+				Found:      strings.Join(kargs, " "),
+				Reason:     strings.Join(reasons, "; "),
+			})
+		}
+	}
+	if c.OSDeployment != nil {
+		deployment, err := c.OSDeployment()
+		if err != nil {
+			return nil, fmt.Errorf("could not get OS deployment: %w", err)
+		}
+		if deployment != c.osDeployment {
+			events = append(events, ConfigDriftEvent{
+				Time:       now,
+				Category:   ConfigDriftOSDeployment,
+				ConfigName: c.MachineConfig.GetName(),
+				Expected:   c.osDeployment,
+				Found:      deployment,
+				Reason:     fmt.Sprintf("OS deployment changed from %s to %s", c.osDeployment, deployment),
+			})
+		}
+	}
+	return events, nil
+}
+
+// Returns an event for every unit of the MachineConfig that is enabled or
+// disabled other than it says.
+func (c *configDriftWatcher) unitEnablementDrift(now time.Time) ([]ConfigDriftEvent, error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(c.MachineConfig.Spec.Config.Raw)
+	if err != nil {
+		return nil, err
+	}
+	var events []ConfigDriftEvent
+	for _, u := range ignConfig.Systemd.Units {
+		if u.Enabled == nil || isTrue(u.Mask) {
+			continue
+		}
+		links := unitInstallLinks(u, c.SystemdPath)
+		if len(links) == 0 {
+			continue
+		}
+		enabled := false
+		for _, link := range links {
+			if _, err := os.Lstat(link); err == nil {
+				enabled = true
+				break
+			}
+		}
+		if enabled == *u.Enabled {
+			continue
+		}
+		events = append(events, ConfigDriftEvent{
+			Time:       now,
+			Category:   ConfigDriftUnitEnablement,
+			ConfigName: c.MachineConfig.GetName(),
+			Path:       getIgn3SystemdUnitPath(c.SystemdPath, u),
+			Expected:   describeEnablement(*u.Enabled),
+			Found:      describeEnablement(enabled),
+			Reason:     fmt.Sprintf("unit %q is %s, expected %s", u.Name, describeEnablement(enabled), describeEnablement(*u.Enabled)),
+		})
+	}
+	return events, nil
+}
+
+// unitInstallLinks returns the paths of the symlinks enabling unit, as by the
+// WantedBy and RequiredBy settings of its [Install] section. The unit contents
+// are those of the config, or else those on disk. Template units have none.
+func unitInstallLinks(unit ign3types.Unit, systemdPath string) []string {
+	if strings.Contains(unit.Name, "@") {
+		return nil
+	}
+	contents := describeString(unit.Contents)
+	if contents == "" {
+		for _, path := range []string{getIgn3SystemdUnitPath(systemdPath, unit), filepath.Join("/usr/lib/systemd/system", unit.Name)} {
+			if b, err := os.ReadFile(path); err == nil {
+				contents = string(b)
+				break
+			} else if !errors.Is(err, os.ErrNotExist) {
+				klog.Warningf("Could not read unit %q: %v", path, err)
+			}
+		}
+	}
+
+	var links []string
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if section != "[Install]" || !ok {
+			continue
+		}
+		suffix := map[string]string{"WantedBy": ".wants", "RequiredBy": ".requires"}[strings.TrimSpace(key)]
+		if suffix == "" {
+			continue
+		}
+		for _, target := range strings.Fields(value) {
+			links = append(links, filepath.Join(getSystemdPath(systemdPath), target+suffix, unit.Name))
+		}
+	}
+	return links
+}
+
+// configDriftErrFor returns the drift of the first of events, for OnDrift, or
+// nil if there are none.
+func configDriftErrFor(events []ConfigDriftEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	err := errors.New(events[0].Reason)
+	switch events[0].Category {
+	case ConfigDriftUnitEnablement:
+		return &configDriftErr{&unitEnablementConfigDriftErr{err}}
+	case ConfigDriftKernelArguments:
+		return &configDriftErr{&kernelArgumentsConfigDriftErr{err}}
+	case ConfigDriftOSDeployment:
+		return &configDriftErr{&osDeploymentConfigDriftErr{err}}
+	default:
+		return &configDriftErr{err}
+	}
+}
+
+func describeEnablement(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
@@ -6,12 +6,14 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	ign2types "github.com/coreos/ignition/config/v2_2/types"
 	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
 	"github.com/fsnotify/fsnotify"
 	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
 	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	kubeErrs "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2"
 )
@@ -21,6 +23,11 @@ type configDriftErr struct {
 	error
 }
 
+// Unwrap returns the drift, so its category can be told by errors.As.
+func (e *configDriftErr) Unwrap() error {
+	return e.error
+}
+
 // Error type for file config drifts
 type fileConfigDriftErr struct {
 	error
@@ -31,6 +38,67 @@ type unitConfigDriftErr struct {
 	error
 }
 
+// Error type for systemd unit enablement drifts
+type unitEnablementConfigDriftErr struct {
+	error
+}
+
+// Error type for kernel argument drifts
+type kernelArgumentsConfigDriftErr struct {
+	error
+}
+
+// Error type for OS deployment drifts, e.g. out of band rebases
+type osDeploymentConfigDriftErr struct {
+	error
+}
+
+// ConfigDriftCategory is what kind of host state drifted.
+type ConfigDriftCategory string
+
+const (
+	// ConfigDriftFile is a file whose contents or mode drifted.
+	ConfigDriftFile ConfigDriftCategory = "File"
+	// ConfigDriftUnit is a systemd unit or dropin whose contents or mode
+	// drifted, or a masked unit that was unmasked.
+	ConfigDriftUnit ConfigDriftCategory = "Unit"
+	// ConfigDriftUnitEnablement is a systemd unit that was enabled or
+	// disabled out of band.
+	ConfigDriftUnitEnablement ConfigDriftCategory = "UnitEnablement"
+	// ConfigDriftKernelArguments is a change of the kernel arguments the host
+	// boots with next.
+	ConfigDriftKernelArguments ConfigDriftCategory = "KernelArguments"
+	// ConfigDriftOSDeployment is a change of the OS deployment the host boots
+	// next, e.g. by an out of band rebase.
+	ConfigDriftOSDeployment ConfigDriftCategory = "OSDeployment"
+)
+
+// ConfigDriftCategoryOf returns the category of a drift reported to OnDrift,
+// or "" for other errors.
+func ConfigDriftCategoryOf(err error) ConfigDriftCategory {
+	var (
+		fileErr           *fileConfigDriftErr
+		unitErr           *unitConfigDriftErr
+		unitEnablementErr *unitEnablementConfigDriftErr
+		kernelArgsErr     *kernelArgumentsConfigDriftErr
+		osDeploymentErr   *osDeploymentConfigDriftErr
+	)
+	switch {
+	case errors.As(err, &fileErr):
+		return ConfigDriftFile
+	case errors.As(err, &unitErr):
+		return ConfigDriftUnit
+	case errors.As(err, &unitEnablementErr):
+		return ConfigDriftUnitEnablement
+	case errors.As(err, &kernelArgsErr):
+		return ConfigDriftKernelArguments
+	case errors.As(err, &osDeploymentErr):
+		return ConfigDriftOSDeployment
+	default:
+		return ""
+	}
+}
+
 type ConfigDriftMonitor interface {
 	Start(ConfigDriftMonitorOpts) error
 	Done() <-chan struct{}
@@ -48,6 +116,61 @@ type ConfigDriftMonitorOpts struct {
 	SystemdPath string
 	// Channel to report unknown errors
 	ErrChan chan<- error
+	// Restores drifted files and units instead of reporting them, if set.
+	Remediation *ConfigDriftRemediation
+	// Called with the paths of the files and units that were restored.
+	OnRemediated func([]string)
+	// Called with the paths of the restored files and units to make them
+	// take effect, if set.
+	ApplyRemediated func(files, units []string) error
+	// Receives an event for every drift, if set.
+	EventSink *ConfigDriftEventSink
+	// Periodically scans all files for drift inotify misses, if set.
+	FullScan *ConfigDriftFullScan
+	// Returns the kernel arguments the host boots with next, if set, to
+	// report those of the MachineConfig that are missing, and changes since
+	// the monitor started.
+	KernelArguments func() ([]string, error)
+	// Returns the checksum of the OS deployment the host boots next, if set,
+	// to report changes since the monitor started.
+	OSDeployment func() (string, error)
+	// The paths whose changes trigger the kernel argument and OS deployment
+	// checks. Defaults to the ostree boot loader entries and staged
+	// deployment.
+	DeploymentPaths []string
+}
+
+// ConfigDriftRemediation makes the Config Drift Monitor restore the files and
+// units that drifted from the currently applied MachineConfig, writing them
+// again with their contents, mode and ownership. Drift is only reported to
+// OnDrift if it remains after that, e.g. for excluded paths, or files whose
+// contents are remote or can't be decoded.
+type ConfigDriftRemediation struct {
+	// ExcludePaths are patterns, as by filepath.Match, of the paths that are
+	// never restored. A unit is excluded if its path or the path of one of
+	// its dropins is.
+	ExcludePaths []string
+}
+
+// WithConfigDriftRemediation makes the Config Drift Monitor of the daemon
+// restore drifted files and units as remediation says, rather than degrade the
+// node right away.
+func WithConfigDriftRemediation(remediation ConfigDriftRemediation) Option {
+	return func(dn *Daemon) {
+		dn.driftRemediation = &remediation
+	}
+}
+
+// excluded returns true if any of paths matches an excluded pattern.
+func (r *ConfigDriftRemediation) excluded(paths ...string) bool {
+	for _, pattern := range r.ExcludePaths {
+		for _, path := range paths {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Holds the Config Drift Watcher and ensures we only have a single instance
@@ -63,8 +186,17 @@ type configDriftWatcher struct {
 	ConfigDriftMonitorOpts
 	watcher   *fsnotify.Watcher
 	filePaths sets.Set[string]
-	wg        sync.WaitGroup
-	stopCh    chan struct{}
+	// The wants and requires directories of the targets of units whose
+	// enablement is checked, watched once they exist.
+	installDirs sets.Set[string]
+	// The kernel arguments and OS deployment when the monitor started.
+	kernelArguments []string
+	osDeployment    string
+	// Reports full scans that found drift, and stops them.
+	scanCh     chan error
+	scanStopCh chan struct{}
+	wg         sync.WaitGroup
+	stopCh     chan struct{}
 }
 
 // Holds a single Config Drift Watcher and starts / stops it as necessary while
@@ -157,6 +289,14 @@ func newConfigDriftWatcher(opts ConfigDriftMonitorOpts) (*configDriftWatcher, er
 		opts.SystemdPath = pathSystemd
 	}
 
+	if opts.FullScan != nil && opts.FullScan.Interval <= 0 {
+		return nil, fmt.Errorf("no full scan interval provided")
+	}
+
+	if opts.DeploymentPaths == nil {
+		opts.DeploymentPaths = defaultDeploymentPaths
+	}
+
 	c := &configDriftWatcher{
 		ConfigDriftMonitorOpts: opts,
 		stopCh:                 make(chan struct{}),
@@ -195,6 +335,17 @@ func (c *configDriftWatcher) initialize() error {
 		return fmt.Errorf("could not get file paths from machine config: %w", err)
 	}
 
+	// Units are enabled and disabled by symlinks in the wants and requires
+	// directories of their targets, which may not exist yet.
+	c.installDirs, err = c.watchUnitEnablement()
+	if err != nil {
+		return fmt.Errorf("could not get unit install paths from machine config: %w", err)
+	}
+
+	if err := c.watchDeployment(); err != nil {
+		return err
+	}
+
 	// fsnotify (presently) uses inotify instead of fanotify on Linux.
 	// See: https://github.com/fsnotify/fsnotify/issues/114
 	//
@@ -208,6 +359,10 @@ func (c *configDriftWatcher) initialize() error {
 
 	// Wire up fsnotify to watch our config dirs
 	for _, path := range dirPaths {
+		// Only the wants and requires directories may be missing
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
 		klog.V(4).Infof("Watching dir: \"%s\"", path)
 		if err := c.watcher.Add(path); err != nil {
 			return fmt.Errorf("could not add fsnotify watcher to dir \"%s\": %w", path, err)
@@ -222,10 +377,25 @@ func (c *configDriftWatcher) start() {
 	c.wg = sync.WaitGroup{}
 	c.wg.Add(1)
 
+	if c.FullScan != nil {
+		c.scanCh = make(chan error)
+		c.scanStopCh = make(chan struct{})
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.runFullScans()
+		}()
+	}
+
 	go func() {
 		defer c.wg.Done()
 		for {
 			select {
+			case err := <-c.scanCh:
+				// A full scan found drift inotify didn't report, or failed.
+				if err := c.handleFullScan(err); err != nil {
+					c.ErrChan <- err
+				}
 			case event := <-c.watcher.Events:
 				// Our watcher is reporting an event that we should look at.
 				if err := c.handleFileEvent(event); err != nil {
@@ -250,6 +420,9 @@ func (c *configDriftWatcher) start() {
 // Note: Once a Config Drift Watcher has been stopped, it cannot be started
 // again. A new instance must be created.
 func (c *configDriftWatcher) stop() {
+	if c.scanStopCh != nil {
+		close(c.scanStopCh)
+	}
 	c.stopCh <- struct{}{}
 	c.wg.Wait()
 	klog.Info("Config Drift Monitor has shut down")
@@ -258,8 +431,29 @@ func (c *configDriftWatcher) stop() {
 // Handles the filesystem event for any of the files we're watching and
 // filters any config drift errors to the provided callback.
 func (c *configDriftWatcher) handleFileEvent(event fsnotify.Event) error {
-	err := c.checkMachineConfigForEvent(event)
+	if c.installDirs.Has(event.Name) && event.Has(fsnotify.Create) {
+		if err := c.watcher.Add(event.Name); err != nil {
+			return fmt.Errorf("could not add fsnotify watcher to dir \"%s\": %w", event.Name, err)
+		}
+	}
+
+	return c.handleDriftCheck(c.checkMachineConfigForEvent(event))
+}
+
+// Handles the result of a full scan like that of a file event, checking the
+// on disk state again if the scan found drift. Failed scans are only logged,
+// e.g. for files vanishing while they're read.
+func (c *configDriftWatcher) handleFullScan(err error) error {
+	if err != nil {
+		klog.Warningf("Config drift scan failed: %v", err)
+		return nil
+	}
+	klog.Infof("Config drift scan found files that changed without a file event")
+	return c.handleDriftCheck(c.checkOnDiskState())
+}
 
+// Filters config drift errors to the provided callback.
+func (c *configDriftWatcher) handleDriftCheck(err error) error {
 	if err == nil {
 		return nil
 	}
@@ -276,16 +470,163 @@ func (c *configDriftWatcher) handleFileEvent(event fsnotify.Event) error {
 
 // Validates on disk state for potential config drift.
 func (c *configDriftWatcher) checkMachineConfigForEvent(event fsnotify.Event) error {
+	if ctrlcommon.InSlice(event.Name, c.DeploymentPaths) {
+		events, err := c.deploymentDrift(time.Now())
+		if err != nil {
+			return err
+		}
+		c.emit(events)
+		return configDriftErrFor(events)
+	}
+
 	// Ignore events for files not found in the MachineConfig.
 	if !c.filePaths.Has(event.Name) {
 		return nil
 	}
 
-	if err := validateOnDiskState(c.MachineConfig, c.SystemdPath); err != nil {
+	return c.checkOnDiskState()
+}
+
+// Validates the files and units of the MachineConfig on disk, remediating
+// drift if configured to.
+func (c *configDriftWatcher) checkOnDiskState() error {
+	// Emitted once remediation marked what it restored
+	var events []ConfigDriftEvent
+	defer func() {
+		c.emit(events)
+	}()
+
+	err := validateOnDiskState(c.MachineConfig, c.SystemdPath)
+	if err != nil && c.EventSink != nil {
+		// Hash what drifted before remediation restores it
+		var eerr error
+		if events, eerr = configDriftEvents(c.MachineConfig, c.SystemdPath, time.Now()); eerr != nil {
+			klog.Warningf("Could not collect config drift events: %v", eerr)
+		}
+	}
+	if err != nil && c.Remediation != nil {
+		files, units, rerr := c.remediate()
+		restored := append(files, units...)
+		if len(restored) > 0 && c.OnRemediated != nil {
+			c.OnRemediated(restored)
+		}
+		if len(restored) > 0 && c.ApplyRemediated != nil {
+			if aerr := c.ApplyRemediated(files, units); aerr != nil {
+				klog.Warningf("Could not apply restored files and units: %v", aerr)
+			}
+		}
+		markRemediated(events, restored)
+		if rerr != nil {
+			return fmt.Errorf("could not remediate config drift: %w", rerr)
+		}
+		err = validateOnDiskState(c.MachineConfig, c.SystemdPath)
+	}
+	if err != nil {
 		return &configDriftErr{err}
 	}
 
-	return nil
+	enablementEvents, err := c.unitEnablementDrift(time.Now())
+	if err != nil {
+		return err
+	}
+	events = append(events, enablementEvents...)
+	return configDriftErrFor(enablementEvents)
+}
+
+// Writes events to the event sink, if any.
+func (c *configDriftWatcher) emit(events []ConfigDriftEvent) {
+	if c.EventSink == nil {
+		return
+	}
+	if err := c.EventSink.emit(events); err != nil {
+		klog.Warningf("Could not emit config drift events: %v", err)
+	}
+}
+
+// Restores the files and units that drifted from the MachineConfig, unless
+// excluded, and returns the paths of the files and units restored. Files and
+// units that fail to be restored are skipped, and reported as drift by the
+// validation that follows.
+func (c *configDriftWatcher) remediate() (files, units []string, err error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(c.MachineConfig.Spec.Config.Raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, f := range ignConfig.Storage.Files {
+		if f.Path == caBundleFilePath || usrHotfixDiscarded(f.Path) || c.Remediation.excluded(f.Path) || checkV3File(f) == nil {
+			continue
+		}
+		// The contents are written again from the MachineConfig
+		if err := restoreFile(f); err != nil {
+			klog.Warningf("Not restoring drifted file: %v", err)
+			continue
+		}
+		klog.Infof("Restored drifted file %q", f.Path)
+		files = append(files, f.Path)
+	}
+	for _, u := range ignConfig.Systemd.Units {
+		paths := []string{getIgn3SystemdUnitPath(c.SystemdPath, u)}
+		for _, d := range u.Dropins {
+			paths = append(paths, getIgn3SystemdDropinPath(c.SystemdPath, u, d))
+		}
+		if c.Remediation.excluded(paths...) || checkV3Unit(u, c.SystemdPath) == nil {
+			continue
+		}
+		if err := writeUnit(u, c.SystemdPath, false); err != nil {
+			klog.Warningf("Not restoring drifted unit %q: %v", u.Name, err)
+			continue
+		}
+		klog.Infof("Restored drifted unit %q", u.Name)
+		units = append(units, paths[0])
+	}
+	return files, units, nil
+}
+
+// Makes restored files and units take effect: systemd is reloaded for units,
+// and the post config change actions of the files are taken, except for
+// reboots; those files take effect on the next boot.
+func applyRemediatedPaths(files, units []string) error {
+	var errs []error
+	if len(units) > 0 {
+		if err := runCmdSync("systemctl", "daemon-reload"); err != nil {
+			errs = append(errs, fmt.Errorf("reloading systemd: %w", err))
+		}
+	}
+	for _, path := range files {
+		var err error
+		switch action := postConfigChangeActionForFile(path, false); action {
+		case postConfigChangeActionReloadCrio:
+			err = reloadService("crio")
+		case postConfigChangeActionReboot:
+			klog.Infof("Restored file %q takes effect on the next reboot", path)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("applying restored file %q: %w", path, err))
+		}
+	}
+	return kubeErrs.NewAggregate(errs)
+}
+
+// Writes the inline contents of a file with its mode and ownership. Remote
+// contents aren't fetched again.
+func restoreFile(f ign3types.File) error {
+	if isRemoteSource(f.Contents.Source) {
+		return fmt.Errorf("file %q has remote contents", f.Path)
+	}
+	contents, err := decodeFileContents(f)
+	if err != nil {
+		return fmt.Errorf("could not decode file %q: %w", f.Path, err)
+	}
+	mode := defaultFilePermissions
+	if f.Mode != nil {
+		mode = os.FileMode(*f.Mode)
+	}
+	uid, gid, err := getFileOwnership(f)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve file ownership for file %q: %w", f.Path, err)
+	}
+	return writeFileAtomically(f.Path, contents, defaultDirectoryPermissions, mode, uid, gid)
 }
 
 // Finds the paths for all files in a given MachineConfig.
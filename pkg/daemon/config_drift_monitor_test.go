@@ -1,16 +1,24 @@
 package daemon
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
 	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
 	"github.com/openshift/machine-config-operator/test/helpers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -197,6 +205,41 @@ func TestConfigDriftMonitor(t *testing.T) {
 			expectedErr:  unitErr,
 			mutateDropin: chmodFile,
 		},
+		// Remediation tests
+		// Drift is restored rather than reported, unless excluded. The
+		// excluded paths are prefixed with the temp directory.
+		{
+			name:        "ign file content drift remediated",
+			remediation: &ConfigDriftRemediation{},
+			mutateFile:  changeFileContent,
+		},
+		{
+			name:        "ign file chmod remediated",
+			remediation: &ConfigDriftRemediation{},
+			mutateFile:  chmodFile,
+		},
+		{
+			name:        "ign file delete remediated",
+			remediation: &ConfigDriftRemediation{},
+			mutateFile:  os.Remove,
+		},
+		{
+			name:         "ign dropin content drift remediated",
+			remediation:  &ConfigDriftRemediation{},
+			mutateDropin: changeFileContent,
+		},
+		{
+			name:        "ign file content drift excluded from remediation",
+			expectedErr: fileErr,
+			remediation: &ConfigDriftRemediation{ExcludePaths: []string{"/etc/a-config-*"}},
+			mutateFile:  changeFileContent,
+		},
+		{
+			name:         "ign dropin content drift excluded from remediation",
+			expectedErr:  unitErr,
+			remediation:  &ConfigDriftRemediation{ExcludePaths: []string{"/etc/systemd/system/unittest.service.d/*.conf"}},
+			mutateDropin: changeFileContent,
+		},
 	}
 
 	// Create a mutex for our test cases The mutex is needed because we now
@@ -245,6 +288,8 @@ type configDriftMonitorTestCase struct {
 	mutateUnit func(string) error
 	// The mutation to apply to the systemd dropin file
 	mutateDropin func(string) error
+	// The remediation of drift, if any
+	remediation *ConfigDriftRemediation
 	// Mutex to ensure that parallel tests do not stomp on one another
 	testMutex *sync.Mutex
 }
@@ -295,10 +340,20 @@ func (tc configDriftMonitorTestCase) run(t *testing.T) {
 	}()
 
 	onDriftCalled := false
+	var remediated, applied []string
+	remediatedMutex := sync.Mutex{}
 
 	// To listen on when
 	onDriftChan := make(chan struct{})
 
+	var remediation *ConfigDriftRemediation
+	if tc.remediation != nil {
+		remediation = &ConfigDriftRemediation{}
+		for _, pattern := range tc.remediation.ExcludePaths {
+			remediation.ExcludePaths = append(remediation.ExcludePaths, filepath.Join(tc.tmpDir, pattern))
+		}
+	}
+
 	// Configure the config drift monitor
 	opts := ConfigDriftMonitorOpts{
 		ErrChan:       errChan,
@@ -311,6 +366,19 @@ func (tc configDriftMonitorTestCase) run(t *testing.T) {
 			onDriftCalled = true
 			tc.onDriftFunc(t, err)
 		},
+		Remediation: remediation,
+		EventSink:   &ConfigDriftEventSink{Path: filepath.Join(tc.tmpDir, "drift-events.jsonl")},
+		OnRemediated: func(paths []string) {
+			remediatedMutex.Lock()
+			defer remediatedMutex.Unlock()
+			remediated = append(remediated, paths...)
+		},
+		ApplyRemediated: func(files, units []string) error {
+			remediatedMutex.Lock()
+			defer remediatedMutex.Unlock()
+			applied = append(append(applied, files...), units...)
+			return nil
+		},
 	}
 
 	// Start the config drift monitor
@@ -360,6 +428,155 @@ func (tc configDriftMonitorTestCase) run(t *testing.T) {
 	} else {
 		assert.True(t, onDriftCalled, "expected onDrift to be called")
 	}
+
+	// Remediated drift is gone from disk
+	if tc.remediation != nil && tc.expectedErr == nil {
+		remediatedMutex.Lock()
+		defer remediatedMutex.Unlock()
+		assert.NotEmpty(t, remediated, "expected drift to be remediated")
+		assert.Equal(t, remediated, applied, "expected the restored paths to be applied")
+		assert.NoError(t, validateOnDiskState(mc, tc.systemdPath))
+	}
+
+	tc.checkDriftEvents(t, mc)
+}
+
+// Checks the events written to the event sink: one per drifted path, marked
+// remediated if the drift was.
+func (tc configDriftMonitorTestCase) checkDriftEvents(t *testing.T, mc *mcfgv1.MachineConfig) {
+	t.Helper()
+
+	contents, err := os.ReadFile(filepath.Join(tc.tmpDir, "drift-events.jsonl"))
+	if tc.expectedErr == nil && tc.remediation == nil {
+		assert.ErrorIs(t, err, fs.ErrNotExist, "expected no drift events")
+		return
+	}
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.NotEmpty(t, lines)
+	for _, line := range lines {
+		var event ConfigDriftEvent
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		assert.Equal(t, mc.Name, event.ConfigName)
+		assert.NotEmpty(t, event.Path)
+		assert.NotEmpty(t, event.Reason)
+		assert.False(t, event.Time.IsZero())
+		assert.True(t, strings.HasPrefix(event.ExpectedHash, "sha256-"))
+		assert.Equal(t, tc.expectedErr == nil, event.Remediated)
+	}
+}
+
+func TestConfigDriftEventSink(t *testing.T) {
+	events := []ConfigDriftEvent{
+		{Path: "/etc/a", ExpectedHash: hashContents([]byte("a")), Reason: "content mismatch"},
+		{Path: "/etc/b", ExpectedHash: hashContents([]byte("b")), Reason: "mode mismatch"},
+	}
+
+	readEvents := func(t *testing.T, contents []byte) []ConfigDriftEvent {
+		var out []ConfigDriftEvent
+		for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+			var event ConfigDriftEvent
+			require.NoError(t, json.Unmarshal([]byte(line), &event))
+			out = append(out, event)
+		}
+		return out
+	}
+
+	t.Run("file", func(t *testing.T) {
+		sink := &ConfigDriftEventSink{Path: filepath.Join(t.TempDir(), "events")}
+		require.NoError(t, sink.emit(events[:1]))
+		require.NoError(t, sink.emit(events[1:]))
+		contents, err := os.ReadFile(sink.Path)
+		require.NoError(t, err)
+		assert.Equal(t, events, readEvents(t, contents))
+	})
+
+	t.Run("stream socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "events.sock")
+		l, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		defer l.Close()
+		received := make(chan []byte)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				close(received)
+				return
+			}
+			defer conn.Close()
+			contents, _ := io.ReadAll(conn)
+			received <- contents
+		}()
+
+		require.NoError(t, (&ConfigDriftEventSink{Path: path}).emit(events))
+		assert.Equal(t, events, readEvents(t, <-received))
+	})
+
+	t.Run("datagram socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "events.sock")
+		conn, err := net.ListenPacket("unixgram", path)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, (&ConfigDriftEventSink{Path: path}).emit(events))
+		buf := make([]byte, 4096)
+		for _, want := range events {
+			n, _, err := conn.ReadFrom(buf)
+			require.NoError(t, err)
+			assert.Equal(t, []ConfigDriftEvent{want}, readEvents(t, buf[:n]))
+		}
+	})
+
+	t.Run("stuck stream socket", func(t *testing.T) {
+		oldTimeout := driftEventSinkTimeout
+		driftEventSinkTimeout = 100 * time.Millisecond
+		defer func() { driftEventSinkTimeout = oldTimeout }()
+
+		path := filepath.Join(t.TempDir(), "events.sock")
+		l, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		defer l.Close()
+		// Accepted, but never read
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				defer conn.Close()
+				time.Sleep(5 * time.Second)
+			}
+		}()
+
+		many := make([]ConfigDriftEvent, 1000)
+		for i := range many {
+			many[i] = ConfigDriftEvent{Path: "/etc/a", Reason: strings.Repeat("x", 4096)}
+		}
+		start := time.Now()
+		err = (&ConfigDriftEventSink{Path: path}).emit(many)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("no events", func(t *testing.T) {
+		sink := &ConfigDriftEventSink{Path: filepath.Join(t.TempDir(), "events")}
+		require.NoError(t, sink.emit(nil))
+		assert.NoFileExists(t, sink.Path)
+	})
+}
+
+func TestConfigDriftEventsRemoteFiles(t *testing.T) {
+	dir := t.TempDir()
+	hash := "sha512-" + strings.Repeat("0", 128)
+	remote := setDefaultUIDandGID(helpers.CreateIgn3File(filepath.Join(dir, "remote"), "https://example.com/remote", int(defaultFilePermissions)))
+	remote.Contents.Verification.Hash = &hash
+	unverified := setDefaultUIDandGID(helpers.CreateIgn3File(filepath.Join(dir, "unverified"), "https://example.com/unverified", int(defaultFilePermissions)))
+	ignConfig := ctrlcommon.NewIgnConfig()
+	ignConfig.Storage.Files = []ign3types.File{remote, unverified}
+
+	events, err := configDriftEvents(helpers.CreateMachineConfigFromIgnition(ignConfig), filepath.Join(dir, "systemd"), time.Now())
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, hash, events[0].ExpectedHash)
+	assert.Empty(t, events[1].ExpectedHash)
 }
 
 // Permissions in CI are a bit more complicated than they are on an end-user
@@ -482,6 +699,8 @@ func (tc *configDriftMonitorTestCase) writeIgnitionConfig(t *testing.T, ignConfi
 		"usrPath":             &usrPath,
 		"origParentDirPath":   &origParentDirPath,
 		"noOrigParentDirPath": &noOrigParentDirPath,
+		"stagedFilesDirPath":  &stagedFilesDirPath,
+		"selinuxEnforcePath":  &selinuxEnforcePath,
 	}
 
 	for name := range globals {
@@ -492,7 +711,7 @@ func (tc *configDriftMonitorTestCase) writeIgnitionConfig(t *testing.T, ignConfi
 	// Write files the same way the MCD does.
 	// NOTE: We manually handle the errors here because using require.Nil or
 	// require.NoError will skip the deferred functions, which is undesirable.
-	if err := writeFiles(ignConfig.Storage.Files, true); err != nil {
+	if err := (&Daemon{}).writeFiles(context.TODO(), ignConfig.Storage.Files, nil, true); err != nil {
 		return fmt.Errorf("could not write ignition config files: %w", err)
 	}
 
@@ -527,3 +746,318 @@ func (tc configDriftMonitorTestCase) onDriftFunc(t *testing.T, err error) {
 		assert.ErrorAs(t, err, &uErr)
 	}
 }
+
+func TestConfigDriftMonitorHostState(t *testing.T) {
+	unitContents := "[Unit]\nDescription=Enablement test\n[Install]\nWantedBy=multi-user.target\n"
+
+	testCases := []struct {
+		name             string
+		enabled          bool
+		mutate           func(t *testing.T, link string, kargs, deployment *string)
+		expectedCategory ConfigDriftCategory
+	}{
+		{
+			name:    "unit disabled out of band",
+			enabled: true,
+			mutate: func(t *testing.T, link string, _, _ *string) {
+				require.NoError(t, os.Remove(link))
+			},
+			expectedCategory: ConfigDriftUnitEnablement,
+		},
+		{
+			name:    "unit enabled out of band",
+			enabled: false,
+			mutate: func(t *testing.T, link string, _, _ *string) {
+				require.NoError(t, os.Symlink("/dev/null", link))
+			},
+			expectedCategory: ConfigDriftUnitEnablement,
+		},
+		{
+			name:    "kernel argument added",
+			enabled: true,
+			mutate: func(_ *testing.T, _ string, kargs, _ *string) {
+				*kargs = "nosmt foo=bar debug"
+			},
+			expectedCategory: ConfigDriftKernelArguments,
+		},
+		{
+			name:    "expected kernel argument removed",
+			enabled: true,
+			mutate: func(_ *testing.T, _ string, kargs, _ *string) {
+				*kargs = "nosmt"
+			},
+			expectedCategory: ConfigDriftKernelArguments,
+		},
+		{
+			name:    "out of band rebase",
+			enabled: true,
+			mutate: func(_ *testing.T, _ string, _, deployment *string) {
+				*deployment = "rebased"
+			},
+			expectedCategory: ConfigDriftOSDeployment,
+		},
+		{
+			name:    "new deployment with the same state",
+			enabled: true,
+			mutate:  func(*testing.T, string, *string, *string) {},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmpDir := t.TempDir()
+			systemdPath := filepath.Join(tmpDir, pathSystemd)
+			wantsDir := filepath.Join(systemdPath, "multi-user.target.wants")
+			bootDir := filepath.Join(tmpDir, "boot")
+			require.NoError(t, os.MkdirAll(wantsDir, 0o755))
+			require.NoError(t, os.MkdirAll(bootDir, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(systemdPath, "enablement.service"), []byte(unitContents), defaultFilePermissions))
+			link := filepath.Join(wantsDir, "enablement.service")
+			if testCase.enabled {
+				require.NoError(t, os.Symlink(filepath.Join(systemdPath, "enablement.service"), link))
+			}
+
+			ignConfig := ctrlcommon.NewIgnConfig()
+			ignConfig.Systemd.Units = []ign3types.Unit{{
+				Name:     "enablement.service",
+				Contents: helpers.StrToPtr(unitContents),
+				Enabled:  helpers.BoolToPtr(testCase.enabled),
+			}}
+			mc := helpers.CreateMachineConfigFromIgnition(ignConfig)
+			mc.Name = "config-drift-monitor-host-state"
+			mc.Spec.KernelArguments = []string{"foo=bar"}
+
+			var mu sync.Mutex
+			kargs, deployment := "nosmt foo=bar", "booted"
+			drift := make(chan error, 10)
+			errChan := make(chan error, 10)
+			cdm := NewConfigDriftMonitor()
+			go func() {
+				<-cdm.Done()
+			}()
+			require.NoError(t, cdm.Start(ConfigDriftMonitorOpts{
+				ErrChan:       errChan,
+				SystemdPath:   systemdPath,
+				MachineConfig: mc,
+				OnDrift: func(err error) {
+					drift <- err
+				},
+				KernelArguments: func() ([]string, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					return splitKernelArguments(kargs), nil
+				},
+				OSDeployment: func() (string, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					return deployment, nil
+				},
+				DeploymentPaths: []string{filepath.Join(bootDir, "loader")},
+			}))
+			defer cdm.Stop()
+
+			mu.Lock()
+			testCase.mutate(t, link, &kargs, &deployment)
+			mu.Unlock()
+			// As ostree, swap the boot loader entries
+			require.NoError(t, os.Symlink("loader.1", filepath.Join(bootDir, "loader")))
+
+			select {
+			case err := <-drift:
+				assert.Equal(t, testCase.expectedCategory, ConfigDriftCategoryOf(err), "%v", err)
+			case err := <-errChan:
+				t.Fatalf("unexpected error: %v", err)
+			case <-time.After(time.Second):
+				assert.Empty(t, testCase.expectedCategory, "expected onDrift to be called")
+			}
+		})
+	}
+}
+
+func TestConfigDriftMonitorFullScan(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fullScan *ConfigDriftFullScan
+		// Applied before the monitor starts, so inotify doesn't see it
+		mutate           func(path string) error
+		expectedCategory ConfigDriftCategory
+	}{
+		{
+			name:     "drift while stopped found by scan",
+			fullScan: &ConfigDriftFullScan{Interval: time.Hour},
+			mutate: func(path string) error {
+				return os.WriteFile(path, []byte("notthecontents!!"), defaultFilePermissions)
+			},
+			expectedCategory: ConfigDriftFile,
+		},
+		{
+			name:     "chmod while stopped found by scan",
+			fullScan: &ConfigDriftFullScan{Interval: time.Hour},
+			mutate: func(path string) error {
+				return os.Chmod(path, 0o755)
+			},
+			expectedCategory: ConfigDriftFile,
+		},
+		{
+			name:     "delete while stopped found by scan",
+			fullScan: &ConfigDriftFullScan{Interval: time.Hour},
+			// Files missing when the monitor starts aren't watched at all
+			mutate:           os.Remove,
+			expectedCategory: ConfigDriftFile,
+		},
+		{
+			name: "drift while stopped without scan",
+			mutate: func(path string) error {
+				return os.WriteFile(path, []byte("notthecontents!!"), defaultFilePermissions)
+			},
+		},
+		{
+			name:     "no drift",
+			fullScan: &ConfigDriftFullScan{Interval: 10 * time.Millisecond},
+			mutate:   func(string) error { return nil },
+		},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "etc", "scanned-file")
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+			require.NoError(t, writeFileAtomicallyWithDefaults(path, []byte("thefilecontents!")))
+			ignConfig := ctrlcommon.NewIgnConfig()
+			ignConfig.Storage.Files = []ign3types.File{setDefaultUIDandGID(helpers.CreateEncodedIgn3File(path, "thefilecontents!", int(defaultFilePermissions)))}
+			mc := helpers.CreateMachineConfigFromIgnition(ignConfig)
+			mc.Name = "config-drift-monitor-full-scan"
+			require.NoError(t, validateOnDiskState(mc, ""))
+
+			require.NoError(t, testCase.mutate(path))
+
+			drift := make(chan error, 10)
+			errChan := make(chan error, 10)
+			cdm := NewConfigDriftMonitor()
+			go func() {
+				<-cdm.Done()
+			}()
+			require.NoError(t, cdm.Start(ConfigDriftMonitorOpts{
+				ErrChan:       errChan,
+				SystemdPath:   filepath.Join(filepath.Dir(path), "systemd"),
+				MachineConfig: mc,
+				OnDrift: func(err error) {
+					drift <- err
+				},
+				FullScan: testCase.fullScan,
+			}))
+			defer cdm.Stop()
+
+			select {
+			case err := <-drift:
+				assert.Equal(t, testCase.expectedCategory, ConfigDriftCategoryOf(err), "%v", err)
+			case err := <-errChan:
+				t.Fatalf("unexpected error: %v", err)
+			case <-time.After(300 * time.Millisecond):
+				assert.Empty(t, testCase.expectedCategory, "expected onDrift to be called")
+			}
+		})
+	}
+}
+
+func TestThrottledScan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scanned-file")
+	contents := bytes.Repeat([]byte("a"), 32*1024)
+	require.NoError(t, os.WriteFile(path, contents, defaultFilePermissions))
+
+	start := time.Now()
+	s := &throttledScan{rate: 256 * 1024, start: start}
+	drifted, err := s.drifted(path, contents, defaultFilePermissions, true)
+	require.NoError(t, err)
+	assert.False(t, drifted)
+	assert.GreaterOrEqual(t, time.Since(start), 125*time.Millisecond, "expected reads to be throttled")
+
+	// Same size, other contents
+	changed := bytes.Repeat([]byte("b"), 32*1024)
+	drifted, err = (&throttledScan{rate: defaultScanBytesPerSecond, start: time.Now()}).drifted(path, changed, defaultFilePermissions, true)
+	require.NoError(t, err)
+	assert.True(t, drifted)
+
+	// Remote contents are only checked for their mode
+	drifted, err = (&throttledScan{rate: defaultScanBytesPerSecond, start: time.Now()}).drifted(path, nil, defaultFilePermissions, false)
+	require.NoError(t, err)
+	assert.False(t, drifted)
+
+	// Contents are compared once normalized, whatever their size
+	unregister, err := ctrlcommon.RegisterContentNormalizer(path, ctrlcommon.StripLineComments("#"))
+	require.NoError(t, err)
+	defer unregister()
+	require.NoError(t, os.WriteFile(path, []byte("# local comment\nkey=value\n"), defaultFilePermissions))
+	drifted, err = (&throttledScan{rate: defaultScanBytesPerSecond, start: time.Now()}).drifted(path, []byte("key=value\n"), defaultFilePermissions, true)
+	require.NoError(t, err)
+	assert.False(t, drifted)
+	drifted, err = (&throttledScan{rate: defaultScanBytesPerSecond, start: time.Now()}).drifted(path, []byte("key=other\n"), defaultFilePermissions, true)
+	require.NoError(t, err)
+	assert.True(t, drifted)
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	_, err = (&throttledScan{rate: 1024, start: time.Now(), stopCh: stopCh}).drifted(path, contents, defaultFilePermissions, true)
+	assert.ErrorIs(t, err, errScanStopped)
+}
+
+func TestFullScanSkipsUndecodableFiles(t *testing.T) {
+	dir := t.TempDir()
+	undecodable := filepath.Join(dir, "undecodable")
+	drifted := filepath.Join(dir, "drifted")
+	require.NoError(t, os.WriteFile(drifted, []byte("tampered"), defaultFilePermissions))
+	// Not gzip compressed, though it says so
+	undecodableFile := helpers.CreateEncodedIgn3File(undecodable, "contents", int(defaultFilePermissions))
+	undecodableFile.Contents.Compression = helpers.StrToPtr("gzip")
+	ignConfig := ctrlcommon.NewIgnConfig()
+	ignConfig.Storage.Files = []ign3types.File{
+		undecodableFile,
+		helpers.CreateEncodedIgn3File(drifted, "contents", int(defaultFilePermissions)),
+	}
+	mc := helpers.CreateMachineConfigFromIgnition(ignConfig)
+
+	c := &configDriftWatcher{ConfigDriftMonitorOpts: ConfigDriftMonitorOpts{
+		MachineConfig: mc,
+		SystemdPath:   filepath.Join(dir, "systemd"),
+		FullScan:      &ConfigDriftFullScan{Interval: time.Hour},
+	}}
+	found, err := c.fullScan()
+	require.NoError(t, err)
+	assert.True(t, found, "expected the files after the undecodable one to be scanned")
+}
+
+func TestRemediateSkipsUnrestorableFiles(t *testing.T) {
+	dir := t.TempDir()
+	remote := setDefaultUIDandGID(helpers.CreateIgn3File(filepath.Join(dir, "remote"), "https://example.com/remote", int(defaultFilePermissions)))
+	undecodable := setDefaultUIDandGID(helpers.CreateEncodedIgn3File(filepath.Join(dir, "undecodable"), "contents", int(defaultFilePermissions)))
+	undecodable.Contents.Compression = helpers.StrToPtr("gzip")
+	restored := setDefaultUIDandGID(helpers.CreateEncodedIgn3File(filepath.Join(dir, "restored"), "contents", int(defaultFilePermissions)))
+	ignConfig := ctrlcommon.NewIgnConfig()
+	ignConfig.Storage.Files = []ign3types.File{remote, undecodable, restored}
+
+	c := &configDriftWatcher{ConfigDriftMonitorOpts: ConfigDriftMonitorOpts{
+		MachineConfig: helpers.CreateMachineConfigFromIgnition(ignConfig),
+		SystemdPath:   filepath.Join(dir, "systemd"),
+		Remediation:   &ConfigDriftRemediation{},
+	}}
+	files, units, err := c.remediate()
+	require.NoError(t, err)
+	assert.Equal(t, []string{restored.Path}, files)
+	assert.Empty(t, units)
+	assert.FileExists(t, restored.Path)
+	assert.NoFileExists(t, remote.Path)
+	assert.NoFileExists(t, undecodable.Path)
+}
+
+func TestWithConfigDriftFullScan(t *testing.T) {
+	dn := &Daemon{}
+	WithConfigDriftFullScan(ConfigDriftFullScan{Interval: time.Hour})(dn)
+	require.NotNil(t, dn.driftFullScan)
+	WithConfigDriftFullScan(ConfigDriftFullScan{})(dn)
+	assert.Nil(t, dn.driftFullScan)
+}
@@ -20,6 +20,7 @@ import (
 
 	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
 	"github.com/google/renameio"
+	"github.com/sigstore/sigstore/pkg/signature"
 	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -60,6 +61,65 @@ type Daemon struct {
 	// NodeUpdaterClient wraps rpm-ostree and will eventually be removed with a direct rpmostreeclient value
 	NodeUpdaterClient *RpmOstreeClient
 
+	// bootc updates the OS of bootc hosts without rpm-ostree in device agent
+	// mode, if this is one
+	bootc *BootcClient
+
+	// osUpdater replaces the OS updater of the host in device agent mode
+	osUpdater OSUpdater
+
+	// imageSignaturePolicy verifies OS images before rebasing to them in
+	// device agent mode
+	imageSignaturePolicy *ImageSignaturePolicy
+
+	// osImagePullBandwidth caps OS image pulls in device agent mode, in bytes
+	// per second, if set
+	osImagePullBandwidth int64
+
+	// deploymentRetention is enforced after updates in device agent mode, if
+	// set
+	deploymentRetention *DeploymentRetentionPolicy
+
+	// backupRetention is enforced on the backups of locally modified files
+	// after they are taken in device agent mode, if set
+	backupRetention *BackupRetentionPolicy
+
+	// extensionsRepoDir has the extensions of configs without an extensions
+	// container in device agent mode, if set
+	extensionsRepoDir string
+
+	// osImagePrefetch makes updates in device agent mode pull changed OS
+	// images alongside the other phases, if set
+	osImagePrefetch *OSImagePrefetchPolicy
+
+	// stagedDeploymentProbe checks the deployments staged by updates in
+	// device agent mode before the reboot, if set
+	stagedDeploymentProbe *StagedDeploymentProbe
+
+	// reconcileKernelArguments diffs kernel arguments against the running
+	// ones in device agent mode
+	reconcileKernelArguments bool
+
+	// reconcilePolicy accepts unreconcilable changes in device agent mode,
+	// if set
+	reconcilePolicy *ReconcilePolicy
+
+	// driftPolicy decides what updates in device agent mode do with files
+	// that drifted from the old config, if set
+	driftPolicy DriftPolicy
+
+	// driftRemediation makes the Config Drift Monitor restore drifted files
+	// and units, if set
+	driftRemediation *ConfigDriftRemediation
+
+	// driftEventSink receives the drift events of the Config Drift Monitor,
+	// if set
+	driftEventSink *ConfigDriftEventSink
+
+	// driftFullScan makes the Config Drift Monitor periodically scan all
+	// managed files, if set
+	driftFullScan *ConfigDriftFullScan
+
 	// bootID is a unique value per boot (generated by the kernel)
 	bootID string
 
@@ -94,6 +154,10 @@ type Daemon struct {
 
 	updateActive     bool
 	updateActiveLock sync.Mutex
+	// cancelUpdate cancels the running cluster update on SIGTERM outside of
+	// its protected steps, updateDone is closed once it returned.
+	cancelUpdate context.CancelFunc
+	updateDone   chan struct{}
 
 	nodeWriter NodeWriter
 
@@ -132,6 +196,42 @@ type Daemon struct {
 
 	// Used for Hypershift
 	hypershiftConfigMap string
+
+	// updateObservers are notified of the progress of updates in device agent mode
+	updateObservers []UpdateObserver
+
+	// statusReporter reports the state of updates in device agent mode
+	statusReporter StatusReporter
+
+	// manageUnits makes updates in device agent mode write and restart systemd units
+	manageUnits bool
+
+	// bootHealthCheck makes updates in device agent mode that require a reboot
+	// install a greenboot health check
+	bootHealthCheck         bool
+	bootHealthRequiredUnits []string
+
+	// rebootWindow defers the finalization of OS updates in device agent mode
+	// outside of the window
+	rebootWindow *RebootWindow
+
+	// signatureVerifier, if set, must verify configs applied in device agent
+	// mode
+	signatureVerifier signature.Verifier
+
+	// remoteFetcher, if set, fetches file contents referencing http(s) URLs
+	remoteFetcher *remoteFetcher
+
+	// templateValuesPath, if set, holds the values templated files in device
+	// agent mode can use
+	templateValuesPath string
+
+	// contentStore, if set, deduplicates large file contents written in
+	// device agent mode
+	contentStore *contentStore
+
+	// deltaWrites updates large files in place in device agent mode
+	deltaWrites bool
 }
 
 // CoreOSDaemon protects the methods that should only be called on CoreOS variants
@@ -237,13 +337,7 @@ func New(
 		mock = true
 	}
 
-	var (
-		osImageURL string
-		osVersion  string
-		osCommit   string
-		err        error
-	)
-
+	var err error
 	hostos := osrelease.OperatingSystem{}
 	if !mock {
 		hostos, err = osrelease.GetHostRunningOS()
@@ -253,10 +347,31 @@ func New(
 		}
 	}
 
+	return newDaemonForOS(exitCh, hostos, mock)
+}
+
+// newDaemonForOS finishes constructing a Daemon for the detected host OS.
+func newDaemonForOS(exitCh chan<- error, hostos osrelease.OperatingSystem, mock bool) (*Daemon, error) {
+	var (
+		osImageURL string
+		osVersion  string
+		osCommit   string
+		err        error
+	)
+
 	var nodeUpdaterClient *RpmOstreeClient
+	var bootc *BootcClient
 
-	// Only pull the osImageURL from OSTree when we are on RHCOS or FCOS
-	if hostos.IsCoreOSVariant() {
+	// Only pull the osImageURL from OSTree when we are on RHCOS or FCOS, or
+	// from bootc on image mode hosts without rpm-ostree
+	if !hostos.IsCoreOSVariant() && !mock && isBootcHost() {
+		bootc = NewBootcClient()
+		osImageURL, osVersion, osCommit, err = bootc.GetBootedOSImageURL()
+		if err != nil {
+			return nil, fmt.Errorf("error reading osImageURL from bootc: %w", err)
+		}
+		klog.Infof("Booted bootc image: %s (%s) %s", osImageURL, osVersion, osCommit)
+	} else if hostos.IsCoreOSVariant() {
 		nodeUpdaterClientVal := NewNodeUpdaterClient()
 		nodeUpdaterClient = &nodeUpdaterClientVal
 		err := nodeUpdaterClient.Initialize()
@@ -286,6 +401,7 @@ func New(
 		rebootQueued:       false,
 		os:                 hostos,
 		NodeUpdaterClient:  nodeUpdaterClient,
+		bootc:              bootc,
 		bootedOSImageURL:   osImageURL,
 		bootedOSCommit:     osCommit,
 		bootID:             bootID,
@@ -940,7 +1056,9 @@ func (dn *Daemon) syncNodeHypershift(key string) error {
 	if err != nil {
 		return fmt.Errorf("parsing new Ignition config failed: %w", err)
 	}
-	diffFileSet := ctrlcommon.CalculateConfigFileDiffs(&oldIgnConfig, &newIgnConfig)
+	// All files are written, those whose contents are equivalent call for no
+	// actions
+	diffFileSet := ctrlcommon.WithoutEquivalentFiles(&oldIgnConfig, &newIgnConfig, ctrlcommon.CalculateConfigFileDiffs(&oldIgnConfig, &newIgnConfig))
 	actions, err := calculatePostConfigChangeAction(mcDiff, diffFileSet)
 	if err != nil {
 		return err
@@ -1019,6 +1137,11 @@ func (dn *Daemon) syncNodeHypershift(key string) error {
 // RunOnceFrom is the primary entrypoint for the non-cluster case
 func (dn *Daemon) RunOnceFrom(onceFrom string, skipReboot bool) error {
 	dn.skipReboot = skipReboot
+	release, err := acquireUpdateLock()
+	if err != nil {
+		return err
+	}
+	defer release()
 	configi, contentFrom, err := dn.senseAndLoadOnceFrom(onceFrom)
 	if err != nil {
 		klog.Warningf("Unable to decipher onceFrom config type: %s", err)
@@ -1047,6 +1170,13 @@ func (dn *Daemon) RunFirstbootCompleteMachineconfig() error {
 	if err != nil {
 		return fmt.Errorf("failed to parse MachineConfig: %w", err)
 	}
+	return dn.completeFirstboot(&mc, constants.MachineConfigEncapsulatedPath, constants.MachineConfigEncapsulatedBakPath)
+}
+
+// completeFirstboot completes the initial boot into mc, read from path. path
+// is removed, or renamed to bakPath if the host was updated, to signal
+// completion.
+func (dn *Daemon) completeFirstboot(mc *mcfgv1.MachineConfig, path, bakPath string) error {
 	newEnough, err := dn.NodeUpdaterClient.IsNewEnoughForLayering()
 	if err != nil {
 		return err
@@ -1056,6 +1186,9 @@ func (dn *Daemon) RunFirstbootCompleteMachineconfig() error {
 	// See https://github.com/coreos/rpm-ostree/pull/3961 and https://issues.redhat.com/browse/MCO-356
 	// This currently will incur a double reboot; see https://github.com/coreos/rpm-ostree/issues/4018
 	if !newEnough {
+		if isLocalOSImage(mc.Spec.OSImageURL) {
+			return fmt.Errorf("rpm-ostree is not new enough to import local OS image %s", mc.Spec.OSImageURL)
+		}
 		logSystem("rpm-ostree is not new enough for new-format image; forcing an update via container and queuing immediate reboot")
 		if err := dn.InplaceUpdateViaNewContainer(mc.Spec.OSImageURL); err != nil {
 			return err
@@ -1095,14 +1228,14 @@ func (dn *Daemon) RunFirstbootCompleteMachineconfig() error {
 	// Currently, we generally expect the bootimage to be older, but in the special
 	// case of having bootimage == machine-os-content, and no kernel arguments
 	// specified, then we don't need to do anything here.
-	mcDiffNotEmpty, err := dn.compareMachineConfig(oldConfig, &mc)
+	mcDiffNotEmpty, err := dn.compareMachineConfig(oldConfig, mc)
 	if err != nil {
 		return fmt.Errorf("failed to compare MachineConfig: %w", err)
 	}
 	if !mcDiffNotEmpty {
 		// Removing this file signals completion of the initial MC processing.
-		if err := os.Remove(constants.MachineConfigEncapsulatedPath); err != nil {
-			return fmt.Errorf("failed to remove %s: %w", constants.MachineConfigEncapsulatedPath, err)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
 		}
 		logSystem("skipping reboot since no changes were detected from %s to %s", oldConfig.GetName(), mc.GetName())
 		return nil
@@ -1112,14 +1245,14 @@ func (dn *Daemon) RunFirstbootCompleteMachineconfig() error {
 	// This "false" is a compatibility for IBM's use case, where they are using the MCD to write the full configuration instead of just
 	// the encapsulated config. This shouldn't affect normal OCP operations, but will allow anyone using this code to write configs to
 	// still get the kubelet cert
-	err = dn.update(nil, &mc, false)
+	err = dn.update(nil, mc, false)
 	if err != nil {
 		return err
 	}
 
 	// Removing this file signals completion of the initial MC processing.
-	if err := os.Rename(constants.MachineConfigEncapsulatedPath, constants.MachineConfigEncapsulatedBakPath); err != nil {
-		return fmt.Errorf("failed to rename encapsulated MachineConfig after processing on firstboot: %w", err)
+	if err := os.Rename(path, bakPath); err != nil {
+		return fmt.Errorf("failed to rename %s after processing on firstboot: %w", path, err)
 	}
 
 	dn.skipReboot = false
@@ -1134,20 +1267,27 @@ func (dn *Daemon) InstallSignalHandler(signaled chan struct{}) {
 	// Catch SIGTERM - if we're actively updating, we should avoid
 	// having the process be killed.
 	// https://github.com/openshift/machine-config-operator/issues/407
+	// An update outside of its protected steps is canceled instead, and
+	// rolled back before we exit.
 	go func() {
 		for sig := range termChan {
 			//nolint:gocritic
 			switch sig {
 			case syscall.SIGTERM:
 				dn.updateActiveLock.Lock()
-				updateActive := dn.updateActive
+				updateActive, cancelUpdate, updateDone := dn.updateActive, dn.cancelUpdate, dn.updateDone
 				dn.updateActiveLock.Unlock()
 				if updateActive {
 					klog.Info("Got SIGTERM, but actively updating")
-				} else {
-					close(signaled)
-					return
+					continue
 				}
+				if cancelUpdate != nil {
+					klog.Info("Got SIGTERM, canceling update")
+					cancelUpdate()
+					<-updateDone
+				}
+				close(signaled)
+				return
 			}
 		}
 	}()
@@ -1204,6 +1344,11 @@ func (dn *Daemon) onConfigDrift(err error) {
 	}
 }
 
+func (dn *Daemon) onConfigDriftRemediated(paths []string) {
+	logSystem("Restored drifted files %v", paths)
+	dn.nodeWriter.Eventf(corev1.EventTypeNormal, "ConfigDriftRemediated", "Restored drifted files %v", paths)
+}
+
 // getCurrentConfigFromNode fetch the current config through node annotations to respond to getCurrentConfigDisk
 // calls where the ODC is missing due to manual deletion and other reasons.
 func (dn *Daemon) getCurrentConfigFromNode() (*onDiskConfig, error) {
@@ -1247,6 +1392,17 @@ func (dn *Daemon) startConfigDriftMonitor() {
 		SystemdPath:   pathSystemd,
 		ErrChan:       dn.exitCh,
 		MachineConfig: odc.currentConfig,
+		Remediation:   dn.driftRemediation,
+		OnRemediated:  dn.onConfigDriftRemediated,
+		EventSink:     dn.driftEventSink,
+		FullScan:      dn.driftFullScan,
+	}
+	if dn.driftRemediation != nil {
+		opts.ApplyRemediated = applyRemediatedPaths
+	}
+	if dn.os.IsCoreOSVariant() && dn.NodeUpdaterClient != nil {
+		opts.KernelArguments = nextBootKernelArguments
+		opts.OSDeployment = dn.nextBootOSDeployment
 	}
 
 	if err := dn.configDriftMonitor.Start(opts); err != nil {
@@ -1596,7 +1752,7 @@ func (dn *Daemon) getCurrentConfigOnDisk() (*onDiskConfig, error) {
 
 // storeCurrentConfigOnDisk serializes a machine config into a file in /etc,
 // which we use to denote that we are expecting the system has transitioned
-// into this state.
+// into this state. Its digest is recorded along with it.
 func (dn *Daemon) storeCurrentConfigOnDisk(odc *onDiskConfig) error {
 	mcJSON, err := json.Marshal(odc.currentConfig)
 	if err != nil {
@@ -1606,6 +1762,9 @@ func (dn *Daemon) storeCurrentConfigOnDisk(odc *onDiskConfig) error {
 	if err := writeFileAtomicallyWithDefaults(dn.currentConfigPath, mcJSON); err != nil {
 		return err
 	}
+	if err := dn.writeCurrentConfigDigest(); err != nil {
+		return err
+	}
 
 	return writeFileAtomicallyWithDefaults(dn.currentImagePath, []byte(odc.currentImage))
 }
@@ -1828,7 +1987,7 @@ func (dn *Daemon) checkStateOnFirstRun() error {
 		if !osMatch {
 			logSystem("Bootstrap pivot required to: %s", targetOSImageURL)
 
-			if err := dn.updateLayeredOS(state.currentConfig); err != nil {
+			if err := dn.updateLayeredOS(context.TODO(), state.currentConfig); err != nil {
 				return err
 			}
 
@@ -2030,7 +2189,7 @@ func (dn *Daemon) runOnceFromMachineConfig(machineConfig mcfgv1.MachineConfig, c
 // runOnceFromIgnition executes MCD's subset of Ignition functionality in onceFrom mode
 func (dn *Daemon) runOnceFromIgnition(ignConfig ign3types.Config) error {
 	// Execute update without hitting the cluster
-	if err := dn.writeFiles(ignConfig.Storage.Files, false); err != nil {
+	if err := dn.writeFiles(context.TODO(), ignConfig.Storage.Files, nil, false); err != nil {
 		return err
 	}
 	if err := dn.writeUnits(ignConfig.Systemd.Units); err != nil {
@@ -2243,10 +2402,23 @@ func (dn *Daemon) triggerUpdateWithMachineConfig(currentConfig, desiredConfig *m
 // validateKernelArguments checks that the current boot has all arguments specified
 // in the target machineconfig.
 func (dn *CoreOSDaemon) validateKernelArguments(currentConfig *mcfgv1.MachineConfig) error {
-	rpmostreeKargsBytes, err := runGetOut("rpm-ostree", "kargs")
+	missing, err := dn.missingKernelArguments(currentConfig)
 	if err != nil {
 		return err
 	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing expected kernel arguments: %v", missing)
+	}
+	return nil
+}
+
+// missingKernelArguments returns the kernel arguments specified in the target
+// machineconfig that the current boot doesn't have.
+func (dn *CoreOSDaemon) missingKernelArguments(currentConfig *mcfgv1.MachineConfig) ([]string, error) {
+	rpmostreeKargsBytes, err := runGetOut("rpm-ostree", "kargs")
+	if err != nil {
+		return nil, err
+	}
 	rpmostreeKargs := strings.TrimSpace(string(rpmostreeKargsBytes))
 	foundArgsArray := strings.Split(rpmostreeKargs, " ")
 	foundArgs := make(map[string]bool)
@@ -2269,9 +2441,8 @@ func (dn *CoreOSDaemon) validateKernelArguments(currentConfig *mcfgv1.MachineCon
 		}
 		klog.Infof("Current ostree kargs: %s", rpmostreeKargs)
 		klog.Infof("Expected MachineConfig kargs: %v", expected)
-		return fmt.Errorf("missing expected kernel arguments: %v", missing)
 	}
-	return nil
+	return missing, nil
 }
 
 // Implementation of validateOnDiskState which checks a few conditions
@@ -2359,6 +2530,9 @@ func (dn *Daemon) checkOS(osImageURL string) bool {
 
 	// TODO(jkyros): the header for this functions says "if the digests match"
 	// so I'm wondering if at one point this used to work this way....
+	if isLocalOSImage(osImageURL) {
+		return dn.bootedOSImageURL == osImageURL
+	}
 	inspection, _, err := imageInspect(osImageURL)
 	if err != nil {
 		klog.Warningf("Unable to check manifest for matching hash: %s", err)
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
@@ -340,24 +341,22 @@ func TestSetRunningKargs(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, diff.isEmpty())
 
+	// Neither reordered nor repeated kernel arguments are a change
 	newConfig.Spec.KernelArguments = []string{"systemd.legacy_systemd_cgroup_controller=1", "systemd.unified_cgroup_hierarchy=0"}
 	diff, err = newMachineConfigDiff(oldConfig, newConfig)
 	assert.Nil(t, err)
-	assert.False(t, diff.isEmpty())
-	assert.True(t, diff.kargs)
+	assert.True(t, diff.isEmpty())
 
 	newConfig.Spec.KernelArguments = []string{"systemd.unified_cgroup_hierarchy=0", "systemd.legacy_systemd_cgroup_controller=1", "systemd.unified_cgroup_hierarchy=0"}
 	diff, err = newMachineConfigDiff(oldConfig, newConfig)
 	assert.Nil(t, err)
-	assert.False(t, diff.isEmpty())
-	assert.True(t, diff.kargs)
+	assert.True(t, diff.isEmpty())
 
 	cmdline = "BOOT_IMAGE=(hd0,gpt3)/ostree/rhcos-c3b004db4/vmlinuz-5.14.0-284.23.1.el9_2.x86_64 systemd.unified_cgroup_hierarchy=0 systemd.unified_cgroup_hierarchy=0 systemd.legacy_systemd_cgroup_controller=1"
 	_ = setRunningKargsWithCmdline(oldConfig, newConfig.Spec.KernelArguments, []byte(cmdline))
 	diff, err = newMachineConfigDiff(oldConfig, newConfig)
 	assert.Nil(t, err)
-	assert.False(t, diff.isEmpty())
-	assert.True(t, diff.kargs)
+	assert.True(t, diff.isEmpty())
 
 	cmdline = "BOOT_IMAGE=(hd0,gpt3)/ostree/rhcos-c3b004db4/vmlinuz-5.14.0-284.23.1.el9_2.x86_64 systemd.unified_cgroup_hierarchy=0 systemd.legacy_systemd_cgroup_controller=1 systemd.unified_cgroup_hierarchy=0"
 	_ = setRunningKargsWithCmdline(oldConfig, newConfig.Spec.KernelArguments, []byte(cmdline))
@@ -531,3 +530,30 @@ func TestPrepUpdateFromClusterOnDiskDrift(t *testing.T) {
 		})
 	}
 }
+
+func TestSIGTERMCancelsInterruptibleUpdate(t *testing.T) {
+	dn := &Daemon{}
+	signaled := make(chan struct{})
+	dn.InstallSignalHandler(signaled)
+
+	ctx, endUpdate := dn.startInterruptibleUpdate()
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("update not canceled")
+	}
+
+	// The daemon only exits once the update returned
+	select {
+	case <-signaled:
+		t.Fatal("signaled before the update returned")
+	case <-time.After(100 * time.Millisecond):
+	}
+	endUpdate()
+	select {
+	case <-signaled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not signaled after the update returned")
+	}
+}
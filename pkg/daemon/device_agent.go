@@ -0,0 +1,1548 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeErrs "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+)
+
+// UpdateResult describes what an update in device agent mode did to the
+// system. Device agents embedding the daemon use it to decide which services
+// need restarting and what to report to their management plane.
+type UpdateResult struct {
+	// OldConfigName is the name of the MachineConfig that was updated from.
+	OldConfigName string `json:"oldConfigName,omitempty"`
+	// NewConfigName is the name of the MachineConfig that was applied.
+	NewConfigName string `json:"newConfigName,omitempty"`
+	// FilesWritten lists the paths of files, directories and links that were
+	// created or updated.
+	FilesWritten []string `json:"filesWritten,omitempty"`
+	// FilesRemoved lists the paths of files, directories and links that were
+	// removed because they were no longer part of the new config. Files are
+	// backed up or kept in place instead, if the UpdatePolicy says so.
+	FilesRemoved []string `json:"filesRemoved,omitempty"`
+	// UsrHotfixes lists the files of the new config written below /usr as
+	// hotfixes, to a transient overlay that is discarded on reboot; see
+	// MachineConfigUsrHotfixesAnnotationKey. Only set on CoreOS and bootc
+	// hosts.
+	UsrHotfixes []string `json:"usrHotfixes,omitempty"`
+	// UsrHotfixesObsolete lists the hotfixes whose contents are shipped by the
+	// OS image the update staged, so they can be dropped from the config.
+	UsrHotfixesObsolete []string `json:"usrHotfixesObsolete,omitempty"`
+	// UnitsChanged lists the names of systemd units that were added, removed
+	// or modified between the two configs.
+	UnitsChanged []string `json:"unitsChanged,omitempty"`
+	// UnitsStopped lists the removed, disabled and masked units that were
+	// stopped. Only set if the daemon manages systemd units.
+	UnitsStopped []string `json:"unitsStopped,omitempty"`
+	// UnitsRestarted lists the changed units that were restarted. Only set if
+	// the daemon manages systemd units.
+	UnitsRestarted []string `json:"unitsRestarted,omitempty"`
+	// UnitsStarted lists the newly enabled units that were started. Only set
+	// if the daemon manages systemd units.
+	UnitsStarted []string `json:"unitsStarted,omitempty"`
+	// UnitsReloaded lists the units that were reloaded for changes to their
+	// config files; see MachineConfigUnitReloadPolicyAnnotationKey. Only set
+	// if the daemon manages systemd units.
+	UnitsReloaded []string `json:"unitsReloaded,omitempty"`
+	// UnitsMasked and UnitsUnmasked list the units that were masked, and
+	// stopped, or unmasked, and restarted if enabled. Only set if the daemon
+	// manages systemd units.
+	UnitsMasked   []string `json:"unitsMasked,omitempty"`
+	UnitsUnmasked []string `json:"unitsUnmasked,omitempty"`
+	// Units is what the update does to systemd units in detail. If the daemon
+	// doesn't manage systemd units, it is only reported, for the embedding
+	// agent to act on.
+	Units *UnitPlan `json:"units,omitempty"`
+	// UnitJournals are bounded journal excerpts of the units that were
+	// stopped, started or restarted, from before they were stopped to after
+	// they were started, by unit. Only set if the daemon manages systemd
+	// units; ErrUnitUnhealthy has the ones of units that failed.
+	UnitJournals map[string]string `json:"unitJournals,omitempty"`
+	// UnitVerdicts is the impact of Units on each unit, by name.
+	UnitVerdicts []UnitVerdict `json:"unitVerdicts,omitempty"`
+	// OSChanges lists the OS level changes (OS image, kernel arguments,
+	// kernel type, extensions) that were applied.
+	OSChanges []string `json:"osChanges,omitempty"`
+	// OSImageOverride is set if the osImageURL of the new config was
+	// remapped to a mirror by the override file of the device.
+	OSImageOverride *OSImageOverride `json:"osImageOverride,omitempty"`
+	// OSDeltaBundle is set if the OS is updated from the delta bundle the new
+	// config has for the image of the old one, rather than by pulling the
+	// image; see MachineConfigOSDeltaBundlesAnnotationKey.
+	OSDeltaBundle *OSDeltaBundle `json:"osDeltaBundle,omitempty"`
+	// OSImagePrefetched is true if the OS image was pulled while the files
+	// and units were applied; see WithOSImagePrefetch.
+	OSImagePrefetched bool `json:"osImagePrefetched,omitempty"`
+	// OSImageManifest is set if the osImageURL of the new config names a
+	// manifest list, to the image of the list for the architecture of the
+	// host, which the OS is rebased to by digest.
+	OSImageManifest *OSImageManifest `json:"osImageManifest,omitempty"`
+	// KernelArgumentsRestored lists the kernel arguments of the old config
+	// that were removed from the host out of band and appended again; see
+	// WithKernelArgumentReconciliation.
+	KernelArgumentsRestored []string `json:"kernelArgumentsRestored,omitempty"`
+	// InitramfsRegenerated is true if the update regenerates the initramfs;
+	// see MachineConfigInitramfsArgsAnnotationKey.
+	InitramfsRegenerated bool `json:"initramfsRegenerated,omitempty"`
+	// ReconcileOverrides lists the unreconcilable changes the update makes
+	// as the ReconcilePolicy accepts them; see WithReconcilePolicy.
+	ReconcileOverrides []UnreconcilableChange `json:"reconcileOverrides,omitempty"`
+	// FilesDrifted lists the files the configs have alike that were changed
+	// or removed on disk, and that the update restores or preserves; see
+	// WithDriftReconciliation.
+	FilesDrifted []string `json:"filesDrifted,omitempty"`
+	// PinnedDeployment is the ostree deployment booted before OS changes were
+	// staged, as checksum.serial. It stays pinned as rollback target until
+	// UnpinPreviousDeployment is called, or another update staging OS
+	// changes pins the deployment it is applied on.
+	PinnedDeployment string `json:"pinnedDeployment,omitempty"`
+	// DeploymentsRemoved lists the previous ostree deployments removed by the
+	// retention policy after the update, as checksum.serial.
+	DeploymentsRemoved []string `json:"deploymentsRemoved,omitempty"`
+	// LayeredPackages lists the packages layered on the OS for the extensions
+	// of the new config, as staged by the update or already booted. Only set
+	// on rpm-ostree hosts if either config has extensions.
+	LayeredPackages []string `json:"layeredPackages,omitempty"`
+	// PostConfigChangeActions are the actions ("none", "reload crio",
+	// "reload NetworkManager", "restart sssd", "restart chronyd",
+	// "run systemd-sysusers", "run systemd-tmpfiles", "restart kubelet",
+	// "restart crio", "refresh sysext", "restart quadlets" or "reboot") the
+	// changes call for in device agent mode. They are not performed, except
+	// for reloading NetworkManager, restarting sssd, chronyd, kubelet, crio
+	// and quadlet services, running systemd-sysusers and systemd-tmpfiles and
+	// refreshing system extensions if the daemon manages systemd units; it is
+	// up to the caller to e.g. reload crio.
+	PostConfigChangeActions []string `json:"postConfigChangeActions,omitempty"`
+	// PostConfigChangeActionFiles maps each post config change action to the
+	// changed files that call for it. A reboot can also be required by
+	// non-file changes; see RebootReason.
+	PostConfigChangeActionFiles map[string][]string `json:"postConfigChangeActionFiles,omitempty"`
+	// DrainRequired is true if the changes would require draining the node.
+	DrainRequired bool `json:"drainRequired"`
+	// Drained is true if the node was actually drained as part of the update.
+	Drained bool `json:"drained"`
+	// RebootRequired is true if the system must be rebooted for the new
+	// config to take effect.
+	RebootRequired bool `json:"rebootRequired"`
+	// RebootReason is a human-readable rationale for RebootRequired.
+	RebootReason string `json:"rebootReason,omitempty"`
+	// DryRun is true if the result was computed by PlanInDeviceAgentMode and
+	// nothing was changed on disk.
+	DryRun bool `json:"dryRun,omitempty"`
+	// FinalizationDeferred is true if the OS changes were staged outside of
+	// the reboot window or with UpdatePolicy.StageOSUpdate, and only take
+	// effect on a reboot after FinalizeStagedUpdate or FinalizeOSUpdate.
+	FinalizationDeferred bool `json:"finalizationDeferred,omitempty"`
+	// AwaitingBootConfirmation is true if a boot health check was installed
+	// and the update needs committing with ConfirmBootInAgentMode after the
+	// reboot.
+	AwaitingBootConfirmation bool `json:"awaitingBootConfirmation,omitempty"`
+	// Recovered describes how a previously interrupted update was dealt with
+	// before this update was applied, if there was one.
+	Recovered *UpdateRecovery `json:"recovered,omitempty"`
+	// NoOp is true if the two configs were content-identical and nothing was
+	// done.
+	NoOp bool `json:"noOp,omitempty"`
+	// Forced is true if the update was forced; see UpdatePolicy.ForceApply.
+	Forced bool `json:"forced,omitempty"`
+	// FileModesFixed lists the managed files and directories whose drifted
+	// mode or ownership was corrected, if the UpdatePolicy asked for it.
+	FileModesFixed []FileModeFix `json:"fileModesFixed,omitempty"`
+	// FilesBackedUp lists the locally modified files that were backed up
+	// before the update overwrote or removed them; see ListBackups.
+	FilesBackedUp []string `json:"filesBackedUp,omitempty"`
+	// FilesystemsChanged is true if the filesystems section changed and was
+	// applied, mounting the new filesystems and unmounting dropped ones.
+	FilesystemsChanged bool `json:"filesystemsChanged,omitempty"`
+	// FilesystemsFormatted lists the blank devices that were formatted.
+	FilesystemsFormatted []string `json:"filesystemsFormatted,omitempty"`
+	// LUKSChanged lists the LUKS volumes whose key file, Clevis binding or
+	// open options changed. Changed open options require a reboot.
+	LUKSChanged []string `json:"luksChanged,omitempty"`
+	// NameResolutionChanged lists /etc/hosts and /etc/resolv.conf if the
+	// entries of MachineConfigNameResolutionAnnotationKey were written to
+	// them.
+	NameResolutionChanged []string `json:"nameResolutionChanged,omitempty"`
+	// PhasesApplied lists the phases of MachineConfigApplyPhasesAnnotationKey
+	// that were applied, in order.
+	PhasesApplied []string `json:"phasesApplied,omitempty"`
+	// UserUnitsChanged lists the user units of
+	// MachineConfigUserUnitsAnnotationKey that were written, restarted or
+	// removed, as user/unit.
+	UserUnitsChanged []string `json:"userUnitsChanged,omitempty"`
+	// QuadletServicesRestarted lists the services of added and changed podman
+	// quadlet files that were restarted and the ones of removed files that
+	// were stopped. Rolling back an update regenerates the services, but
+	// doesn't restart them.
+	QuadletServicesRestarted []string `json:"quadletServicesRestarted,omitempty"`
+	// TrustAnchorsChanged is true if the certificates of the CA bundles were
+	// added to or removed from the system trust store, which is extracted
+	// again then. Rolling back an update doesn't extract it again.
+	TrustAnchorsChanged bool `json:"trustAnchorsChanged,omitempty"`
+	// ImmutableFiles lists the files whose immutable attribute was cleared
+	// for the update and set again afterwards.
+	ImmutableFiles []string `json:"immutableFiles,omitempty"`
+	// NetworkManagerReloaded is true if NetworkManager reloaded its keyfiles
+	// and reactivated the connections whose keyfiles changed. Only set if the
+	// daemon manages systemd units.
+	NetworkManagerReloaded bool `json:"networkManagerReloaded,omitempty"`
+	// SSSDRestarted is true if sssd was restarted for changes to the SSSD or
+	// authselect configuration. Only set if the daemon manages systemd units.
+	SSSDRestarted bool `json:"sssdRestarted,omitempty"`
+	// ChronydRestarted is true if chronyd was restarted for changes to its
+	// configuration. Only set if the daemon manages systemd units.
+	ChronydRestarted bool `json:"chronydRestarted,omitempty"`
+	// TimeSynchronized is true if chronyd synchronized the clock after it
+	// was restarted.
+	TimeSynchronized bool `json:"timeSynchronized,omitempty"`
+	// SystemdConfigApplied lists the "run systemd-sysusers" and
+	// "run systemd-tmpfiles" actions that were performed.
+	SystemdConfigApplied []string `json:"systemdConfigApplied,omitempty"`
+	// ServicesRestartedForEnv lists kubelet.service and crio.service if they
+	// were restarted for changes to their environment files.
+	ServicesRestartedForEnv []string `json:"servicesRestartedForEnv,omitempty"`
+	// SysextRefreshed is true if the system extension images were merged
+	// again for changes to them.
+	SysextRefreshed bool `json:"sysextRefreshed,omitempty"`
+}
+
+// UpdatePolicy controls what happens to the on-disk state when an update in
+// device agent mode fails.
+type UpdatePolicy struct {
+	// RollbackOnFailure restores the state from before the update if the
+	// update fails. Otherwise the partially applied update is kept.
+	RollbackOnFailure bool
+	// LeavePartialForDebug keeps the partially applied update, along with its
+	// snapshot and journal, for inspection. It takes precedence over
+	// RollbackOnFailure. The update is then rolled back by the next
+	// RunOnceInDeviceAgentMode or RecoverInterruptedUpdate call.
+	LeavePartialForDebug bool
+	// OrphanedFiles decides what happens to files of the old config that are
+	// not part of the new one. The zero value deletes them.
+	OrphanedFiles OrphanedFilePolicy
+	// VerifyFileModes corrects the mode and ownership of all managed files
+	// and directories as the last phase of the update, also of those the
+	// update didn't write, as VerifyFileModes does.
+	VerifyFileModes bool
+	// ImmutableFiles decides what happens to files with the immutable
+	// attribute set that the update writes or removes. The zero value fails
+	// the update like ImmutableFilesFail.
+	ImmutableFiles ImmutableFilePolicy
+	// UnitHealth decides how the units the update starts and restarts are
+	// checked. The zero value doesn't wait for them.
+	UnitHealth UnitHealthPolicy
+	// StageOSUpdate stages OS changes for the next boot but locks their
+	// finalization, also inside of the reboot window, so that reboots keep
+	// booting the current deployment until FinalizeOSUpdate reboots into the
+	// new one. Downloading the update is thereby decoupled from the
+	// disruption of applying it.
+	StageOSUpdate bool
+	// ForceApply applies the new config as if the old one had none of its
+	// files, directories, links and units, writing all of them again and
+	// starting the enabled units, and sets the kernel arguments on
+	// rpm-ostree hosts against the running ones, for recovering hosts with
+	// unknown local changes. The update isn't skipped for content-identical
+	// configs. Updates are also forced while the force file
+	// /run/machine-config-daemon-force exists, which additionally makes them
+	// require a reboot.
+	ForceApply bool
+}
+
+// OrphanedFilePolicy decides what happens to files that are no longer part of
+// the config being applied.
+type OrphanedFilePolicy string
+
+const (
+	// OrphanedFilesDelete deletes orphaned files, or restores the original
+	// file if the MachineConfig replaced one.
+	OrphanedFilesDelete OrphanedFilePolicy = "Delete"
+	// OrphanedFilesBackup copies orphaned files below
+	// /etc/machine-config-daemon/orphaned, mirroring their paths, before
+	// deleting them like OrphanedFilesDelete.
+	OrphanedFilesBackup OrphanedFilePolicy = "Backup"
+	// OrphanedFilesKeep leaves orphaned files on disk as they are, for devices
+	// keeping state in formerly managed paths.
+	OrphanedFilesKeep OrphanedFilePolicy = "Keep"
+)
+
+// validate returns an error for a policy that isn't one of the above, or the
+// zero value.
+func (p OrphanedFilePolicy) validate() error {
+	switch p {
+	case "", OrphanedFilesDelete, OrphanedFilesBackup, OrphanedFilesKeep:
+		return nil
+	}
+	return fmt.Errorf("unknown orphaned file policy %q", p)
+}
+
+// DefaultUpdatePolicy rolls back failed updates and deletes orphaned files.
+func DefaultUpdatePolicy() UpdatePolicy {
+	return UpdatePolicy{RollbackOnFailure: true, OrphanedFiles: OrphanedFilesDelete}
+}
+
+// RunOnceInDeviceAgentMode applies newConfig on top of oldConfig without
+// talking to a cluster, and returns a summary of the changes it made. It does
+// not reboot the system or restart services; it is up to the caller to act
+// on the returned UpdateResult. A nil oldConfig is treated as an empty config.
+// Only the sections chosen by selector are applied. The policy decides what to
+// do with the on-disk state should the update fail. If the daemon was created
+// WithSignatureVerifier, newConfig must be signed. Canceling ctx stops the
+// update and rolls it back as if it had failed.
+func (dn *Daemon) RunOnceInDeviceAgentMode(ctx context.Context, oldConfig, newConfig *mcfgv1.MachineConfig, selector ApplySelector, policy UpdatePolicy) (*UpdateResult, error) {
+	if newConfig == nil {
+		return nil, fmt.Errorf("no new MachineConfig provided")
+	}
+	if err := dn.verifyMachineConfigSignature(newConfig); err != nil {
+		return nil, err
+	}
+	return dn.runOnceInDeviceAgentMode(ctx, oldConfig, newConfig, selector, policy)
+}
+
+func (dn *Daemon) runOnceInDeviceAgentMode(ctx context.Context, oldConfig, newConfig *mcfgv1.MachineConfig, selector ApplySelector, policy UpdatePolicy) (*UpdateResult, error) {
+	release, err := acquireUpdateLock()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	recovery, err := dn.RecoverInterruptedUpdate()
+	if err != nil {
+		return nil, fmt.Errorf("error recovering interrupted update: %w", err)
+	}
+
+	result, err := dn.updateInDeviceAgentMode(ctx, oldConfig, newConfig, selector, policy)
+	if result != nil {
+		result.Recovered = recovery
+	}
+	return result, err
+}
+
+// CurrentConfigInAgentMode returns the config last applied in device agent
+// mode, as stored on disk, or nil if no config has been applied yet.
+func (dn *Daemon) CurrentConfigInAgentMode() (*mcfgv1.MachineConfig, error) {
+	odc, err := dn.getCurrentConfigOnDisk()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading current config: %w", err)
+	}
+	return odc.currentConfig, nil
+}
+
+// PlanInDeviceAgentMode computes what RunOnceInDeviceAgentMode would do when
+// updating from oldConfig to newConfig, without touching the disk. The
+// returned UpdateResult has DryRun set. A nil oldConfig is treated as an
+// empty config.
+func (dn *Daemon) PlanInDeviceAgentMode(oldConfig, newConfig *mcfgv1.MachineConfig, selector ApplySelector) (*UpdateResult, error) {
+	if newConfig == nil {
+		return nil, fmt.Errorf("no new MachineConfig provided")
+	}
+	plan, err := dn.planInDeviceAgentMode(oldConfig, newConfig, selector, forceFileExists())
+	if err != nil {
+		return nil, err
+	}
+	plan.result.DryRun = true
+	return plan.result, nil
+}
+
+// deviceAgentPlan holds everything computed ahead of an update in device agent
+// mode, so the update itself and a dry-run share the exact same logic.
+type deviceAgentPlan struct {
+	oldConfig *mcfgv1.MachineConfig
+	newConfig *mcfgv1.MachineConfig
+	// osConfig is newConfig with the unselected OS level sections carried
+	// over from oldConfig
+	osConfig *mcfgv1.MachineConfig
+	// osOldConfig is oldConfig with the running kernel arguments, if they
+	// are reconciled
+	osOldConfig *mcfgv1.MachineConfig
+	// osImageChanged is set if the OS is updated to another image than the
+	// one of oldConfig, diff.osUpdate only covers the configs' osImageURLs
+	osImageChanged bool
+	oldIgnConfig   ign3types.Config
+	newIgnConfig   ign3types.Config
+	diff           *machineConfigDiff
+	// diffFileSet are the changed paths that call for actions
+	diffFileSet []string
+	// xattrs are the extended attributes to set on newConfig's files
+	xattrs fileXattrs
+	// hooks are the commands to run around writing newConfig's files
+	hooks       fileHooks
+	actions     []string
+	selector    ApplySelector
+	manageUnits bool
+	result      *UpdateResult
+	// oldFilesystems and newFilesystems are the filesystems sections to
+	// update, if they changed and were selected
+	oldFilesystems []ign3types.Filesystem
+	newFilesystems []ign3types.Filesystem
+	luksChanges    []luksChange
+	// nameResolution are the managed /etc/hosts and /etc/resolv.conf entries
+	// to write, if either config has some
+	nameResolution *nameResolution
+	// userUnits are the user units to apply, if the daemon manages units and
+	// either config has some
+	userUnits *userUnitsChange
+	// applyPhases are the configs the phases of
+	// MachineConfigApplyPhasesAnnotationKey take the system to, before the
+	// new config, if the daemon manages units
+	applyPhases []applyPhaseStep
+	// deferredUnits are the units whose starts and restarts are deferred
+	deferredUnits map[string]string
+	// unitReloads are the units reloaded or restarted for changes to their
+	// config files, by MachineConfigUnitReloadPolicyAnnotationKey
+	unitReloads map[string]string
+	// trustAnchors are the anchors split from the CA bundles, if certificates
+	// are applied
+	trustAnchors map[string][]byte
+	// initramfs is the regeneration of the initramfs, if the update
+	// regenerates it
+	initramfs *initramfsChange
+	// preservedFiles are the drifted files the update leaves alone
+	preservedFiles []string
+	// inventoryIgnConfig is newIgnConfig with all of its sections, as the
+	// managed files inventory lists what the new config manages
+	inventoryIgnConfig ign3types.Config
+}
+
+// planInDeviceAgentMode parses and diffs the two configs and computes the post
+// config change actions, drain and reboot requirements. It does not modify
+// anything on disk. Sections not chosen by selector are left out of the diff.
+// If force is set, the update is planned as UpdatePolicy.ForceApply says.
+func (dn *Daemon) planInDeviceAgentMode(oldConfig, newConfig *mcfgv1.MachineConfig, selector ApplySelector, force bool) (*deviceAgentPlan, error) {
+	oldConfig = canonicalizeEmptyMC(oldConfig)
+	oldConfigName := oldConfig.GetName()
+	newConfigName := newConfig.GetName()
+
+	// The changes the reconcile policy accepts are reconciled and made as
+	// those of policyConfig, newConfig is still what gets stored
+	policyConfig, overrides, err := dn.applyReconcilePolicy(oldConfig, newConfig, selector)
+	if err != nil {
+		return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+	}
+	osConfig := selector.selectOSChanges(oldConfig, policyConfig)
+
+	oldIgnConfig, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing old Ignition config failed: %w", err)
+	}
+	newIgnConfig, err := ctrlcommon.ParseAndConvertConfig(newConfig.Spec.Config.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing new Ignition config failed: %w", err)
+	}
+	// Templates are diffed and written rendered. The old ones are diffed as
+	// they were written, so files that render differently since, e.g. as the
+	// node's facts changed, are rewritten. Drift is told from what they
+	// render to now though, or they could never have drifted.
+	if dn.driftPolicy != "" && selector.Has(ApplyFiles) {
+		if err := dn.renderFileTemplates(oldConfig, &oldIgnConfig); err != nil {
+			klog.Warningf("Failed to render templated files of old config %s, diffing them as written: %v", oldConfigName, err)
+			err = writtenFileTemplates(oldConfig, &oldIgnConfig)
+			if err != nil {
+				klog.Warningf("Failed to read templated files of old config %s: %v", oldConfigName, err)
+			}
+		}
+	} else if err := writtenFileTemplates(oldConfig, &oldIgnConfig); err != nil {
+		klog.Warningf("Failed to read templated files of old config %s: %v", oldConfigName, err)
+	}
+	if err := dn.renderFileTemplates(newConfig, &newIgnConfig); err != nil {
+		return nil, err
+	}
+	// Only whole sections get dropped from newIgnConfig below
+	inventoryIgnConfig := newIgnConfig
+
+	klog.Infof("Checking Reconcilable for config %v to %v", oldConfigName, newConfigName)
+
+	// Filesystems that are applied are checked by checkFilesystems instead,
+	// others are unreconcilable as in cluster mode
+	reconcileOldConfig, reconcileNewConfig := oldConfig, osConfig
+	if selector.Has(ApplyFilesystems) {
+		if reconcileOldConfig, err = withoutFilesystems(oldConfig); err != nil {
+			return nil, err
+		}
+		if reconcileNewConfig, err = withoutFilesystems(osConfig); err != nil {
+			return nil, err
+		}
+	}
+	diff, reconcilableError := reconcilable(reconcileOldConfig, reconcileNewConfig)
+	if reconcilableError == nil && selector.Has(ApplyFilesystems) {
+		reconcilableError = checkFilesystems(oldIgnConfig.Storage.Filesystems, newIgnConfig.Storage.Filesystems)
+	}
+	if reconcilableError == nil {
+		reconcilableError = dn.getOSUpdater().CheckOSChanges(diff.osChangeSet())
+	}
+	if reconcilableError == nil {
+		switch dn.getOSUpdater().(type) {
+		case bootcOSUpdater:
+			// The kernel type of bootc hosts selects their image
+			osConfig, reconcilableError = withKernelTypeOSImage(osConfig)
+		case rpmOstreeOSUpdater:
+			// Rather than failing once the packages are layered
+			if diff.extensions && dn.os.IsEL() {
+				reconcilableError = validateExtensions(osConfig.Spec.Extensions)
+			}
+		}
+	}
+	if reconcilableError != nil {
+		wrappedErr := fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, reconcilableError)
+		return nil, &ErrUnreconcilable{Err: wrappedErr}
+	}
+
+	// The units are diffed against unitsOldIgnConfig, which lacks the units
+	// of newIgnConfig if forced
+	unitsOldIgnConfig := oldIgnConfig
+	if force {
+		klog.Infof("Forcing update from %s to %s, writing all files and units again", oldConfigName, newConfigName)
+		unitsOldIgnConfig = withoutManagedPaths(oldIgnConfig, newIgnConfig)
+	}
+	result := &UpdateResult{
+		OldConfigName:      oldConfigName,
+		NewConfigName:      newConfigName,
+		UnitsChanged:       calculateUnitDiffs(&unitsOldIgnConfig, &newIgnConfig),
+		ReconcileOverrides: overrides,
+		Forced:             force,
+	}
+	osOldConfig := oldConfig
+	_, rpmOstree := dn.getOSUpdater().(rpmOstreeOSUpdater)
+	if dn.reconcilesKernelArguments(selector) || force && rpmOstree && selector.Has(ApplyKernelArguments) {
+		if osOldConfig, diff.kargs, err = dn.reconcileRunningKernelArguments(oldConfig, osConfig, result); err != nil {
+			return nil, err
+		}
+	}
+	if dn.updatesOS() {
+		result.OSChanges = diff.osChanges()
+	}
+	// The diff is of the osImageURLs of the configs, the OS is updated to
+	// the image they are remapped to
+	if osConfig, result.OSImageOverride, err = applyOSImageOverride(osConfig); err != nil {
+		return nil, err
+	}
+	osImageChanged := false
+	if dn.updatesOS() {
+		if osImageChanged, err = dn.osImageChanged(oldConfig, osConfig); err != nil {
+			return nil, err
+		}
+	}
+	// Delta bundles are only downloaded once the update starts
+	if diff.osUpdate && dn.updatesOS() {
+		if result.OSDeltaBundle, err = machineConfigOSDeltaBundle(newConfig, oldConfig.Spec.OSImageURL); err != nil {
+			return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+		}
+	}
+
+	deferred, err := machineConfigDeferredUnits(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	reloadPolicies, err := machineConfigUnitReloadPolicies(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Finished once the changed files are known
+	var units *UnitPlan
+	oldUnitsConfig, newUnitsConfig := unitsOldIgnConfig, newIgnConfig
+	if selector.Has(ApplyUnits) {
+		plan := NewUnitManager().Plan(&unitsOldIgnConfig, &newIgnConfig)
+		units = &plan
+	} else {
+		reloadPolicies = nil
+	}
+
+	// Changed units get restarted rather than requiring a reboot if we manage
+	// them, and are owned by the embedding agent otherwise. Either way they
+	// don't count towards the post config change actions.
+	diff.units = false
+	manageUnits := dn.manageUnits && selector.Has(ApplyUnits)
+	if !manageUnits {
+		oldIgnConfig.Systemd = ign3types.Systemd{}
+		newIgnConfig.Systemd = ign3types.Systemd{}
+	}
+	if !selector.Has(ApplySSHKeys) {
+		diff.passwd = false
+	}
+	var oldFilesystems, newFilesystems []ign3types.Filesystem
+	if selector.Has(ApplyFilesystems) && !reflect.DeepEqual(oldIgnConfig.Storage.Filesystems, newIgnConfig.Storage.Filesystems) {
+		oldFilesystems, newFilesystems = oldIgnConfig.Storage.Filesystems, newIgnConfig.Storage.Filesystems
+		result.FilesystemsChanged = true
+	}
+	var luksChanges []luksChange
+	if selector.Has(ApplyLUKS) {
+		if luksChanges, err = planLUKS(oldIgnConfig.Storage.Luks, newIgnConfig.Storage.Luks); err != nil {
+			return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+		}
+		for _, change := range luksChanges {
+			result.LUKSChanged = append(result.LUKSChanged, change.new.Name)
+		}
+	}
+	xattrs, err := machineConfigFileXattrs(newConfig, newIgnConfig.Storage.Files)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := machineConfigFileHooks(newConfig, newIgnConfig.Storage.Files)
+	if err != nil {
+		return nil, err
+	}
+	var names *nameResolution
+	if selector.Has(ApplyFiles) {
+		oldNames, err := machineConfigNameResolution(oldConfig)
+		if err != nil {
+			klog.Warningf("Failed to parse name resolution entries of old config %s: %v", oldConfigName, err)
+		}
+		newNames, err := machineConfigNameResolution(newConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkNameResolutionFiles(newNames, newIgnConfig.Storage.Files); err != nil {
+			return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+		}
+		if !oldNames.empty() || !newNames.empty() {
+			names = &newNames
+		}
+	} else {
+		oldIgnConfig.Storage = ign3types.Storage{}
+		newIgnConfig.Storage = ign3types.Storage{}
+		xattrs = nil
+		hooks = nil
+	}
+	var userUnitsPlan *userUnitsChange
+	if manageUnits {
+		if err := lintUnits(&oldIgnConfig, &newIgnConfig); err != nil {
+			return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+		}
+		oldUserUnits, err := machineConfigUserUnits(oldConfig)
+		if err != nil {
+			klog.Warningf("Failed to parse user units of old config %s: %v", oldConfigName, err)
+		}
+		newUserUnits, err := machineConfigUserUnits(newConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkUserUnits(newUserUnits, newIgnConfig.Passwd.Users); err != nil {
+			return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+		}
+		if len(oldUserUnits) > 0 || len(newUserUnits) > 0 {
+			userUnitsPlan = &userUnitsChange{old: oldUserUnits, new: newUserUnits}
+		}
+	}
+	var trustAnchors map[string][]byte
+	if selector.Has(ApplyFiles | ApplyCertificates) {
+		if trustAnchors, err = planTrustAnchors(newIgnConfig.Storage.Files); err != nil {
+			return nil, err
+		}
+	}
+	hotfixes, err := machineConfigUsrHotfixes(newConfig)
+	if err != nil {
+		return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+	}
+	if dn.os.IsCoreOSVariant() || dn.bootc != nil {
+		if err := checkReadOnlyPaths(newIgnConfig, hotfixes); err != nil {
+			return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+		}
+		result.UsrHotfixes = usrHotfixFiles(newIgnConfig, hotfixes)
+	}
+
+	diffFileSet := ctrlcommon.CalculateConfigFileDiffs(&oldIgnConfig, &newIgnConfig)
+	if force {
+		forcedOldIgnConfig := withoutManagedPaths(oldIgnConfig, newIgnConfig)
+		diffFileSet = ctrlcommon.CalculateConfigFileDiffs(&forcedOldIgnConfig, &newIgnConfig)
+	}
+	if !selector.Has(ApplyCertificates) {
+		// updateFiles doesn't touch the CA bundle in this case
+		filtered := diffFileSet[:0]
+		for _, path := range diffFileSet {
+			if path != caBundleFilePath {
+				filtered = append(filtered, path)
+			}
+		}
+		diffFileSet = filtered
+	}
+	var preservedFiles []string
+	if dn.driftPolicy != "" && selector.Has(ApplyFiles) {
+		if result.FilesDrifted, err = driftedFiles(oldIgnConfig, newIgnConfig, diffFileSet, !selector.Has(ApplyCertificates)); err != nil {
+			return nil, fmt.Errorf("checking for drifted files: %w", err)
+		}
+		if dn.driftPolicy == DriftRestore {
+			diffFileSet = append(diffFileSet, result.FilesDrifted...)
+		} else {
+			preservedFiles = result.FilesDrifted
+		}
+	}
+	// Unchanged hotfixes are written again once the overlay is gone
+	if selector.Has(ApplyFiles) {
+		for _, path := range discardedUsrHotfixes(newIgnConfig, hotfixes) {
+			if !ctrlcommon.InSlice(path, diffFileSet) {
+				diffFileSet = append(diffFileSet, path)
+			}
+		}
+	}
+	result.FilesWritten, result.FilesRemoved = splitFileDiffs(diffFileSet, &newIgnConfig)
+	// Files whose contents are equivalent are written, but call for no
+	// actions
+	changedFileSet := ctrlcommon.WithoutEquivalentFiles(&oldIgnConfig, &newIgnConfig, diffFileSet)
+
+	var initramfs *initramfsChange
+	if selector&(ApplyOSImage|ApplyKernelArguments) != 0 {
+		if initramfs, err = dn.planInitramfs(oldConfig, newConfig, changedFileSet); err != nil {
+			return nil, &ErrUnreconcilable{Err: fmt.Errorf("can't reconcile config %s with %s: %w", oldConfigName, newConfigName, err)}
+		}
+	}
+	if initramfs != nil {
+		result.InitramfsRegenerated = true
+		if dn.updatesOS() {
+			result.OSChanges = append(result.OSChanges, "Regenerating initramfs")
+		}
+	}
+
+	// The config files of units with a reload policy call for reloading them
+	// instead of any post config change action
+	reloads, actionFileSet := unitReloads(reloadPolicies, changedFileSet)
+	if units != nil {
+		units.reloadForConfigFiles(reloads)
+		units.deferActivation(deferred)
+		if !units.Empty() {
+			result.Units = units
+			result.UnitVerdicts = unitVerdicts(*units, &oldUnitsConfig, &newUnitsConfig)
+		}
+	}
+
+	// Unlike calculatePostConfigChangeAction, only check for the force file
+	// here; it gets removed once the update actually runs.
+	actions := calculatePostConfigChangeActionFromDiff(diff, actionFileSet, true)
+	if forceFileExists() {
+		klog.Infof("Setting post config change action to postConfigChangeActionReboot; %s present", constants.MachineConfigDaemonForceFile)
+		actions = []string{postConfigChangeActionReboot}
+	}
+	result.PostConfigChangeActions = actions
+	if len(actionFileSet) > 0 {
+		result.PostConfigChangeActionFiles = postConfigChangeActionFiles(actionFileSet, true)
+	}
+	if ctrlcommon.InSlice(postConfigChangeActionReboot, actions) {
+		result.RebootRequired = true
+		result.RebootReason = rebootReason(diff)
+	}
+
+	if reopened := luksReopened(luksChanges); len(reopened) > 0 && !result.RebootRequired {
+		result.RebootRequired = true
+		result.RebootReason = fmt.Sprintf("Changed open options of LUKS volumes %s", strings.Join(reopened, ", "))
+	}
+	if initramfs != nil && !result.RebootRequired {
+		result.RebootRequired = true
+		result.RebootReason = "Regenerating initramfs"
+	}
+
+	drain, err := isDrainRequired(actions, actionFileSet, oldIgnConfig, newIgnConfig)
+	if err != nil {
+		return nil, err
+	}
+	result.DrainRequired = drain
+
+	var applyPhases []applyPhaseStep
+	if phases, err := machineConfigApplyPhases(newConfig); err != nil {
+		return nil, err
+	} else if len(phases) > 0 && manageUnits {
+		applyPhases = planApplyPhases(phases, oldIgnConfig, newIgnConfig)
+	} else if len(phases) > 0 {
+		klog.Warningf("Not applying config %s in phases, the daemon doesn't manage systemd units", newConfigName)
+	}
+
+	return &deviceAgentPlan{
+		oldConfig:      oldConfig,
+		newConfig:      newConfig,
+		osConfig:       osConfig,
+		osOldConfig:    osOldConfig,
+		osImageChanged: osImageChanged,
+		oldIgnConfig:   oldIgnConfig,
+		newIgnConfig:   newIgnConfig,
+		diff:           diff,
+		diffFileSet:    changedFileSet,
+		xattrs:         xattrs,
+		hooks:          hooks,
+		actions:        actions,
+		selector:       selector,
+		manageUnits:    manageUnits,
+		result:         result,
+
+		oldFilesystems: oldFilesystems,
+		newFilesystems: newFilesystems,
+		luksChanges:    luksChanges,
+		nameResolution: names,
+		userUnits:      userUnitsPlan,
+		applyPhases:    applyPhases,
+		deferredUnits:  deferred,
+		unitReloads:    reloads,
+		trustAnchors:   trustAnchors,
+		initramfs:      initramfs,
+		preservedFiles: preservedFiles,
+
+		inventoryIgnConfig: inventoryIgnConfig,
+	}, nil
+}
+
+// updateInDeviceAgentMode is the device agent counterpart of update(). It
+// applies files, SSH keys, password hashes and OS changes, but leaves systemd
+// units and post config change actions (service reloads, reboot) to the
+// embedding agent, unless the daemon was asked to manage units. Instead of a
+// chain of best-effort rollbacks, the state touched by the update is
+// snapshotted up front and restored on failure. Once ctx is done, the update
+// stops at the next phase, file or OS command and is restored the same way.
+// SIGTERM is only ignored during the phases of sigtermProtectedPhases and the
+// rollback, as published in updateStatusPath.
+//
+//nolint:gocyclo
+func (dn *Daemon) updateInDeviceAgentMode(ctx context.Context, oldConfig, newConfig *mcfgv1.MachineConfig, selector ApplySelector, policy UpdatePolicy) (result *UpdateResult, retErr error) {
+	if err := policy.OrphanedFiles.validate(); err != nil {
+		return nil, err
+	}
+	force := policy.ForceApply || forceFileExists()
+	if result, ok := dn.noOpUpdateInDeviceAgentMode(oldConfig, newConfig); ok && !force && !dn.kernelArgumentsDrifted(newConfig, selector) && !dn.filesDrifted(newConfig, selector) && !dn.usrHotfixesDiscarded(newConfig, selector) {
+		if policy.VerifyFileModes && selector.Has(ApplyFiles) {
+			fixes, err := dn.VerifyFileModes(newConfig)
+			result.FileModesFixed = fixes
+			if err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	}
+
+	reporter := dn.getStatusReporter()
+	if err := reporter.SetWorking(newConfig.GetName()); err != nil {
+		return nil, fmt.Errorf("error setting state to Working: %w", err)
+	}
+
+	phase := UpdatePhasePlan
+	defer func() {
+		if retErr != nil {
+			dn.notifyError(phase, retErr)
+			reportUpdateError(reporter, retErr)
+		}
+	}()
+
+	// status is what is published about the update; the old config is only
+	// known once planned if none was given
+	status := func(rollingBack bool) updateStatus {
+		s := updateStatus{NewConfigName: newConfig.GetName(), Phase: phase, RollingBack: rollingBack}
+		if oldConfig != nil {
+			s.OldConfigName = oldConfig.GetName()
+		}
+		return s
+	}
+	// startPhase moves on to the next phase, unless the update was canceled
+	startPhase := func(next UpdatePhase) error {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("update canceled before %s phase: %w", next, err)
+		}
+		phase = next
+		dn.enterUpdatePhase(status(false))
+		dn.notifyPhaseStart(phase)
+		return nil
+	}
+
+	// SIGTERM is only ignored during the phases that can't be interrupted
+	dn.enterUpdatePhase(status(false))
+	defer dn.leaveUpdate()
+
+	dn.notifyPhaseStart(phase)
+	plan, err := dn.planInDeviceAgentMode(oldConfig, newConfig, selector, force)
+	if err != nil {
+		return nil, err
+	}
+	oldConfig, newConfig = plan.oldConfig, plan.newConfig
+	oldIgnConfig, newIgnConfig := plan.oldIgnConfig, plan.newIgnConfig
+	diff := plan.diff
+	result = plan.result
+	newConfigName := newConfig.GetName()
+
+	logSystem("Starting update in device agent mode from %s to %s (applying %s): %+v", oldConfig.GetName(), newConfigName, selector, diff)
+
+	if forceFileExists() {
+		if err := os.Remove(constants.MachineConfigDaemonForceFile); err != nil {
+			return nil, fmt.Errorf("failed to remove force validation file: %w", err)
+		}
+	}
+
+	immutable, err := immutableFiles(dn.immutableFilePaths(plan, !selector.Has(ApplyCertificates)))
+	if err != nil {
+		return nil, err
+	}
+	if len(immutable) > 0 && policy.ImmutableFiles != ImmutableFilesReapply {
+		return nil, &ErrImmutableFile{Path: immutable[0]}
+	}
+	if result.OSDeltaBundle != nil {
+		imgURL, err := dn.fetchOSDeltaBundle(ctx, *result.OSDeltaBundle)
+		if err != nil {
+			return nil, &ErrOSUpdateFailed{Err: err}
+		}
+		plan.osConfig = plan.osConfig.DeepCopy()
+		plan.osConfig.Spec.OSImageURL = imgURL
+	}
+	if plan.osImageChanged {
+		if err := checkLocalOSImage(plan.osConfig.Spec.OSImageURL); err != nil {
+			return nil, &ErrOSUpdateFailed{Err: err}
+		}
+		if result.OSImageManifest, err = resolveOSImageManifest(ctx, plan.osConfig.Spec.OSImageURL); err != nil {
+			return nil, &ErrOSUpdateFailed{Err: err}
+		}
+		if result.OSImageManifest != nil {
+			plan.osConfig = plan.osConfig.DeepCopy()
+			plan.osConfig.Spec.OSImageURL = result.OSImageManifest.PinnedImage
+		}
+	}
+	if dn.imageSignaturePolicy != nil && plan.osImageChanged {
+		identity, err := signatureIdentity(plan.osConfig.Spec.OSImageURL, result)
+		if err != nil {
+			return nil, &ErrOSUpdateFailed{Err: err}
+		}
+		if err := verifyImageSignature(ctx, plan.osConfig.Spec.OSImageURL, identity, *dn.imageSignaturePolicy); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.DrainRequired && dn.kubeClient != nil {
+		if err := startPhase(UpdatePhaseDrain); err != nil {
+			return nil, err
+		}
+		if err := dn.performDrain(); err != nil {
+			return nil, err
+		}
+		result.Drained = true
+	}
+
+	// Deferred before the rollback, so it runs after it
+	defer reapplyImmutable(immutable)
+	if result.ImmutableFiles, err = clearImmutable(immutable); err != nil {
+		return nil, err
+	}
+
+	// Capture everything we are about to touch, so a failure at any point
+	// below can be undone in one step.
+	reloadSystemd := len(result.UnitsChanged) > 0 || len(serviceEnvDropinPaths(result.PostConfigChangeActions)) > 0 ||
+		ctrlcommon.InSlice(postConfigChangeActionRestartQuadlets, result.PostConfigChangeActions)
+	snap, err := dn.takeUpdateSnapshot(dn.snapshotPaths(plan), plan.manageUnits && reloadSystemd)
+	if err != nil {
+		return nil, fmt.Errorf("error taking snapshot before update: %w", err)
+	}
+	if plan.manageUnits && ctrlcommon.InSlice(postConfigChangeActionRefreshSysext, result.PostConfigChangeActions) {
+		snap.RefreshSysext = true
+		if err := snap.save(); err != nil {
+			return nil, fmt.Errorf("error taking snapshot before update: %w", err)
+		}
+	}
+	// The journal lets us roll back deterministically from the snapshot
+	// should we get interrupted before we're done.
+	journal, err := startUpdateJournal(oldConfig.GetName(), newConfigName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		switch {
+		case retErr != nil && policy.LeavePartialForDebug:
+			logSystem("Leaving partially applied update from %s to %s in place for debugging; snapshot kept in %s", oldConfig.GetName(), newConfigName, snapshotParentDirPath)
+			return
+		case retErr != nil && !policy.RollbackOnFailure:
+			logSystem("Keeping partially applied update from %s to %s", oldConfig.GetName(), newConfigName)
+			if err := dn.discardUpdateSnapshot(snap); err != nil {
+				klog.Warningf("Failed to discard snapshot after update: %v", err)
+			}
+		case retErr != nil:
+			dn.enterUpdatePhase(status(true))
+			if err := dn.restoreUpdateSnapshot(snap); err != nil {
+				// Leave the journal in place so the rollback is retried
+				errs := kubeErrs.NewAggregate([]error{err, retErr})
+				retErr = fmt.Errorf("error rolling back to snapshot: %w", errs)
+				return
+			}
+		default:
+			if err := dn.discardUpdateSnapshot(snap); err != nil {
+				klog.Warningf("Failed to discard snapshot after update: %v", err)
+			}
+		}
+		if err := removeUpdateJournal(); err != nil {
+			klog.Warningf("Failed to remove update journal: %v", err)
+		}
+	}()
+
+	// The OS image is pulled while the phases before the OS one run
+	var prefetch *osImagePrefetch
+	if dn.osImagePrefetch != nil && plan.osImageChanged && dn.updatesOSWithOstree() {
+		prefetch = dn.startOSImagePrefetch(ctx, plan.osConfig.Spec.OSImageURL)
+		defer prefetch.stop()
+	}
+
+	// LUKS volumes and filesystems go first, as files can be written to them
+	if len(plan.luksChanges) > 0 {
+		if err := startPhase(UpdatePhaseLUKS); err != nil {
+			return nil, err
+		}
+		if err := updateLUKS(plan.luksChanges); err != nil {
+			return nil, err
+		}
+		if err := journal.markCompleted(phase); err != nil {
+			return nil, err
+		}
+	}
+	if result.FilesystemsChanged {
+		if err := startPhase(UpdatePhaseFilesystems); err != nil {
+			return nil, err
+		}
+		if result.FilesystemsFormatted, err = updateFilesystems(plan.oldFilesystems, plan.newFilesystems); err != nil {
+			return nil, err
+		}
+		if err := journal.markCompleted(phase); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := startPhase(UpdatePhaseFiles); err != nil {
+		return nil, err
+	}
+	if dn.os.IsCoreOSVariant() || dn.bootc != nil {
+		if err := prepareStateOverlays(newIgnConfig); err != nil {
+			return nil, err
+		}
+		if len(result.UsrHotfixes) > 0 {
+			if err := dn.mountUsrOverlay(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Preserved files are neither written nor removed
+	filesOldConfig, filesNewConfig := withoutFiles(oldIgnConfig, plan.preservedFiles), withoutFiles(newIgnConfig, plan.preservedFiles)
+	backupTime := time.Now()
+	if result.FilesBackedUp, err = backupDriftedFiles(filesOldConfig, filesNewConfig, policy.OrphanedFiles, !selector.Has(ApplyCertificates), backupTime); err != nil {
+		return nil, err
+	}
+	if dn.backupRetention != nil {
+		pruneBackups(*dn.backupRetention, backupTime)
+	}
+	if err := plan.hooks.run(ctx, result.FilesWritten, false); err != nil {
+		return nil, err
+	}
+	// The units of the phases are applied along with their files, the
+	// remaining ones in the units phase
+	unitsFrom := filesOldConfig
+	for _, step := range plan.applyPhases {
+		step.ignConfig = withoutFiles(step.ignConfig, plan.preservedFiles)
+		if err := dn.updateFiles(ctx, unitsFrom, step.ignConfig, plan.xattrs, policy.OrphanedFiles, !selector.Has(ApplyCertificates)); err != nil {
+			return nil, err
+		}
+		units := NewUnitManager()
+		units.health = policy.UnitHealth
+		stepUnits := units.Plan(&unitsFrom, &step.ignConfig)
+		stepUnits.deferActivation(plan.deferredUnits)
+		if err := units.Apply(ctx, stepUnits); err != nil {
+			return nil, fmt.Errorf("applying phase %s: %w", step.phase.Name, err)
+		}
+		result.UnitJournals = mergeUnitJournals(result.UnitJournals, units.journals)
+		if step.phase.Target != "" {
+			if err := waitForTarget(ctx, step.phase.Target, step.timeout); err != nil {
+				return nil, fmt.Errorf("applying phase %s: %w", step.phase.Name, err)
+			}
+		}
+		logSystem("Applied phase %s of config %s", step.phase.Name, newConfigName)
+		result.PhasesApplied = append(result.PhasesApplied, step.phase.Name)
+		unitsFrom = step.ignConfig
+	}
+	if err := dn.updateFiles(ctx, unitsFrom, filesNewConfig, plan.xattrs, policy.OrphanedFiles, !selector.Has(ApplyCertificates)); err != nil {
+		return nil, err
+	}
+	if (dn.os.IsCoreOSVariant() || dn.bootc != nil) && selector.Has(ApplyFiles) {
+		if err := trackUsrHotfixes(newConfigName, result.UsrHotfixes); err != nil {
+			return nil, err
+		}
+		if len(result.UsrHotfixes) > 0 {
+			reporter.Eventf(corev1.EventTypeWarning, "UsrHotfix", "Hotfixes %v of config %s were written to a transient overlay on %s, they are lost on reboot", result.UsrHotfixes, newConfigName, usrPath)
+		}
+	}
+	if plan.nameResolution != nil {
+		if result.NameResolutionChanged, err = updateNameResolution(*plan.nameResolution); err != nil {
+			return nil, err
+		}
+	}
+	if plan.trustAnchors != nil {
+		if result.TrustAnchorsChanged, err = updateTrustAnchors(plan.trustAnchors); err != nil {
+			return nil, err
+		}
+	}
+	if err := plan.hooks.run(ctx, result.FilesWritten, true); err != nil {
+		return nil, err
+	}
+	if plan.manageUnits && ctrlcommon.InSlice(postConfigChangeActionReloadNetworkManager, result.PostConfigChangeActions) {
+		if err := reloadNetworkManager(plan.diffFileSet); err != nil {
+			return nil, fmt.Errorf("reloading NetworkManager: %w", err)
+		}
+		result.NetworkManagerReloaded = true
+	}
+	if plan.manageUnits && ctrlcommon.InSlice(postConfigChangeActionRestartSSSD, result.PostConfigChangeActions) {
+		if err := restartSSSD(plan.diffFileSet); err != nil {
+			return nil, fmt.Errorf("restarting sssd: %w", err)
+		}
+		result.SSSDRestarted = true
+	}
+	if plan.manageUnits && ctrlcommon.InSlice(postConfigChangeActionRestartChronyd, result.PostConfigChangeActions) {
+		if result.TimeSynchronized, err = restartChronyd(); err != nil {
+			return nil, err
+		}
+		result.ChronydRestarted = true
+	}
+	if plan.manageUnits {
+		if err := runSystemdConfigActions(result.PostConfigChangeActions, plan.diffFileSet); err != nil {
+			return nil, err
+		}
+		for _, action := range []string{postConfigChangeActionRunSysusers, postConfigChangeActionRunTmpfiles} {
+			if ctrlcommon.InSlice(action, result.PostConfigChangeActions) {
+				result.SystemdConfigApplied = append(result.SystemdConfigApplied, action)
+			}
+		}
+		if result.ServicesRestartedForEnv, err = restartServicesForEnvChanges(result.PostConfigChangeActions); err != nil {
+			return nil, err
+		}
+		if ctrlcommon.InSlice(postConfigChangeActionRefreshSysext, result.PostConfigChangeActions) {
+			if err := refreshSysext(); err != nil {
+				return nil, err
+			}
+			result.SysextRefreshed = true
+		}
+		if ctrlcommon.InSlice(postConfigChangeActionRestartQuadlets, result.PostConfigChangeActions) {
+			if result.QuadletServicesRestarted, err = restartQuadlets(plan.diffFileSet, plan.oldIgnConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := journal.markCompleted(phase); err != nil {
+		return nil, err
+	}
+
+	if plan.manageUnits && (len(result.UnitsChanged) > 0 || result.Units != nil) {
+		if err := startPhase(UpdatePhaseUnits); err != nil {
+			return nil, err
+		}
+		if result.Units != nil {
+			units := NewUnitManager()
+			units.health = policy.UnitHealth
+			remaining := *result.Units
+			if len(plan.applyPhases) > 0 {
+				remaining = units.Plan(&unitsFrom, &newIgnConfig)
+				remaining.reloadForConfigFiles(plan.unitReloads)
+				remaining.deferActivation(plan.deferredUnits)
+			}
+			if err := units.Apply(ctx, remaining); err != nil {
+				return nil, err
+			}
+			result.UnitJournals = mergeUnitJournals(result.UnitJournals, units.journals)
+			result.UnitsStopped, result.UnitsStarted = result.Units.Stop, result.Units.Start
+			result.UnitsMasked, result.UnitsUnmasked = result.Units.Masked, result.Units.Unmasked
+			result.UnitsRestarted = append(append([]string{}, result.Units.Restart...), result.Units.TryRestart...)
+			result.UnitsReloaded = result.Units.Reload
+		}
+		if err := journal.markCompleted(phase); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := startPhase(UpdatePhasePasswd); err != nil {
+		return nil, err
+	}
+	if diff.passwd {
+		if err := dn.updateSSHKeys(newIgnConfig.Passwd.Users, oldIgnConfig.Passwd.Users); err != nil {
+			return nil, err
+		}
+	}
+
+	if selector.Has(ApplyPasswd) {
+		if err := dn.SetPasswordHash(newIgnConfig.Passwd.Users, oldIgnConfig.Passwd.Users); err != nil {
+			return nil, err
+		}
+	}
+	if plan.userUnits != nil {
+		if result.UserUnitsChanged, err = updateUserUnits(plan.userUnits); err != nil {
+			return nil, err
+		}
+	}
+	if err := journal.markCompleted(phase); err != nil {
+		return nil, err
+	}
+
+	if dn.updatesOS() && selector&(ApplyOSImage|ApplyKernelArguments) != 0 {
+		if err := startPhase(UpdatePhaseOS); err != nil {
+			return nil, err
+		}
+		for _, change := range result.OSChanges {
+			dn.notifyOSChange(change)
+		}
+		if prefetch != nil {
+			if err := prefetch.wait(); err != nil {
+				if ctx.Err() != nil {
+					return nil, kubeErrs.NewAggregate([]error{ctx.Err(), err})
+				}
+				klog.Warningf("Failed to prefetch OS image, pulling it now: %v", err)
+			} else {
+				result.OSImagePrefetched = true
+			}
+		}
+		osCtx, stopPull := ctx, func() {}
+		if plan.osImageChanged {
+			if osCtx, stopPull, err = dn.startOSPull(ctx, plan.osConfig.Spec.OSImageURL); err != nil {
+				return nil, &ErrOSUpdateFailed{Err: err}
+			}
+		}
+		err = dn.getOSUpdater().ApplyOSChanges(osCtx, diff.osChangeSet(), plan.osOldConfig, plan.osConfig)
+		stopPull()
+		if err == nil && plan.initramfs != nil {
+			// On top of the deployment just staged
+			err = dn.regenerateInitramfs(ctx, *plan.initramfs)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// The OS commands were killed because we got canceled
+				return nil, kubeErrs.NewAggregate([]error{ctx.Err(), err})
+			}
+			return nil, &ErrOSUpdateFailed{Err: err}
+		}
+		if u, ok := dn.getOSUpdater().(rpmOstreeOSUpdater); ok && (diff.extensions || len(plan.osConfig.Spec.Extensions) > 0) {
+			if result.LayeredPackages, err = u.layeredPackages(); err != nil {
+				return nil, &ErrOSUpdateFailed{Err: err}
+			}
+		}
+		if dn.stagedDeploymentProbe != nil && len(result.OSChanges) > 0 && dn.updatesOSWithOstree() {
+			if err := dn.probeStagedDeployment(ctx, *dn.stagedDeploymentProbe, plan.osConfig); err != nil {
+				return nil, &ErrOSUpdateFailed{Err: fmt.Errorf("staged deployment failed its health probe: %w", err)}
+			}
+		}
+		if len(result.OSChanges) > 0 && dn.updatesOSWithOstree() {
+			if result.FinalizationDeferred, err = dn.deferFinalization(newConfigName, time.Now(), policy.StageOSUpdate); err != nil {
+				return nil, &ErrOSUpdateFailed{Err: err}
+			}
+			if snap.PinnedDeployment {
+				snap.KeepPinned = true
+				if err := snap.save(); err != nil {
+					return nil, err
+				}
+				result.PinnedDeployment = snap.PinnedDeploymentID
+				if err := dn.recordDeploymentConfig(snap.PinnedDeploymentID, oldConfig); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if diff.osUpdate && dn.updatesOSWithOstree() {
+			// The hotfixes only need to be checked, the update succeeded
+			if result.UsrHotfixesObsolete, err = dn.reevaluateUsrHotfixes(); err != nil {
+				klog.Warningf("Failed to check hotfixes against the staged deployment: %v", err)
+			}
+			if len(result.UsrHotfixesObsolete) > 0 {
+				reporter.Eventf(corev1.EventTypeNormal, "UsrHotfixObsolete", "Hotfixes %v are shipped by the OS image of config %s and can be dropped", result.UsrHotfixesObsolete, newConfigName)
+			}
+		}
+		if err := journal.markCompleted(phase); err != nil {
+			return nil, err
+		}
+	} else if !dn.updatesOS() {
+		klog.Info("updating the OS on non-CoreOS nodes is not supported")
+	}
+	if plan.initramfs != nil && !dn.updatesOS() {
+		if err := dn.regenerateInitramfs(ctx, *plan.initramfs); err != nil {
+			return nil, &ErrOSUpdateFailed{Err: err}
+		}
+	}
+
+	if policy.VerifyFileModes {
+		if err := startPhase(UpdatePhaseFileModes); err != nil {
+			return nil, err
+		}
+		if result.FileModesFixed, err = fixFileModes(newIgnConfig, plan.xattrs); err != nil {
+			return nil, err
+		}
+		if err := journal.markCompleted(phase); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := startPhase(UpdatePhaseFinalize); err != nil {
+		return nil, err
+	}
+	odc := &onDiskConfig{
+		currentConfig: newConfig,
+	}
+
+	if err := writeManagedFileInventory(newConfigName, plan.inventoryIgnConfig, pathSystemd); err != nil {
+		return nil, fmt.Errorf("writing managed files inventory: %w", err)
+	}
+	if selector.Has(ApplyFiles) {
+		if err := writePreservedFiles(newConfigName, plan.preservedFiles); err != nil {
+			return nil, fmt.Errorf("recording preserved files: %w", err)
+		}
+	}
+	// Archived once the update is done
+	replacedConfig, err := os.ReadFile(dn.currentConfigPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := dn.storeCurrentConfigOnDisk(odc); err != nil {
+		return nil, err
+	}
+	if plan.osImageChanged {
+		if err := saveOSImageManifest(result.OSImageManifest); err != nil {
+			return nil, fmt.Errorf("writing OS image manifest: %w", err)
+		}
+	}
+	if dn.bootHealthCheck && result.RebootRequired {
+		if err := dn.writeBootHealthCheck(newConfigName); err != nil {
+			return nil, err
+		}
+		result.AwaitingBootConfirmation = true
+	}
+	if err := journal.markCompleted(phase); err != nil {
+		return nil, err
+	}
+	if replacedConfig != nil {
+		// The history is for diagnosis only
+		if err := archiveCurrentConfig(replacedConfig, oldConfig.GetName()); err != nil {
+			klog.Warningf("Failed to archive replaced config: %v", err)
+		}
+	}
+
+	if err := reporter.SetDone(newConfigName); err != nil {
+		return nil, fmt.Errorf("error setting state to Done: %w", err)
+	}
+
+	if result.FinalizationDeferred {
+		if staged, ok := reporter.(StagedUpdateReporter); ok {
+			if err := staged.SetStaged(newConfigName); err != nil {
+				return nil, fmt.Errorf("error setting staged config: %w", err)
+			}
+		}
+		reporter.Eventf(corev1.EventTypeNormal, "OSUpdateStaged", "Config %s has been applied, OS update staged until it is finalized", newConfigName)
+	}
+	if result.RebootRequired {
+		reporter.Eventf(corev1.EventTypeNormal, "RebootRequired", "Config %s has been applied, reboot required: %s", newConfigName, result.RebootReason)
+		logSystem("Config %s has been applied, reboot required: %s", newConfigName, result.RebootReason)
+	} else {
+		reporter.Eventf(corev1.EventTypeNormal, "SkipReboot", "Config %s has been applied, no reboot required", newConfigName)
+		logSystem("Config %s has been applied, no reboot required", newConfigName)
+	}
+
+	if dn.deploymentRetention != nil && dn.updatesOSWithOstree() {
+		// The update succeeded even if the old deployments can't be removed
+		if result.DeploymentsRemoved, err = dn.enforceDeploymentRetention(*dn.deploymentRetention); err != nil {
+			klog.Warningf("Failed to enforce deployment retention: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// noOpUpdateInDeviceAgentMode returns a NoOp result and true if the effective
+// contents of the two configs are identical, so that periodic reconcile loops
+// don't snapshot, journal and rewrite everything. Nothing is written to disk,
+// so if only the names differ the current config on disk keeps the old name.
+// The fast path is not taken for a nil oldConfig or if the force file exists.
+func (dn *Daemon) noOpUpdateInDeviceAgentMode(oldConfig, newConfig *mcfgv1.MachineConfig) (*UpdateResult, bool) {
+	// Without an old config this is the first update, which stores the
+	// current config on disk.
+	if oldConfig == nil || forceFileExists() {
+		return nil, false
+	}
+	oldHash, err := dn.effectiveConfigHash(oldConfig, true)
+	if err != nil {
+		return nil, false
+	}
+	newHash, err := dn.effectiveConfigHash(newConfig, false)
+	if err != nil || oldHash != newHash {
+		return nil, false
+	}
+
+	logSystem("Config %s is content-identical to %s, nothing to do", newConfig.GetName(), oldConfig.GetName())
+	return &UpdateResult{
+		OldConfigName: oldConfig.GetName(),
+		NewConfigName: newConfig.GetName(),
+		NoOp:          true,
+	}, true
+}
+
+// effectiveConfigHash hashes what an update in device agent mode applies from
+// config: the parsed Ignition config, so that formatting and spec version
+// don't matter, with its templated files rendered, and the OS level fields.
+// The templated files of an applied config are hashed as they were written.
+func (dn *Daemon) effectiveConfigHash(config *mcfgv1.MachineConfig, applied bool) (string, error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	if err != nil {
+		return "", err
+	}
+	if applied {
+		err = writtenFileTemplates(config, &ignConfig)
+	} else {
+		err = dn.renderFileTemplates(config, &ignConfig)
+	}
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(struct {
+		Ignition        ign3types.Config
+		OSImageURL      string
+		KernelArguments []string
+		KernelType      string
+		Extensions      []string
+		FIPS            bool
+		Xattrs          string
+		Capabilities    string
+		Hooks           string
+		Templates       string
+		NameResolution  string
+		UserUnits       string
+		KernelImages    string
+		UsrHotfixes     string
+		OSDeltaBundles  string
+		InitramfsArgs   string
+		ApplyPhases     string
+		DeferredUnits   string
+		UnitReload      string
+	}{
+		Ignition:        ignConfig,
+		OSImageURL:      config.Spec.OSImageURL,
+		KernelArguments: config.Spec.KernelArguments,
+		KernelType:      canonicalizeKernelType(config.Spec.KernelType),
+		Extensions:      config.Spec.Extensions,
+		FIPS:            config.Spec.FIPS,
+		Xattrs:          config.GetAnnotations()[MachineConfigFileXattrsAnnotationKey],
+		Capabilities:    config.GetAnnotations()[MachineConfigFileCapabilitiesAnnotationKey],
+		Hooks:           config.GetAnnotations()[MachineConfigFileHooksAnnotationKey],
+		Templates:       config.GetAnnotations()[MachineConfigFileTemplatesAnnotationKey],
+		NameResolution:  config.GetAnnotations()[MachineConfigNameResolutionAnnotationKey],
+		UserUnits:       config.GetAnnotations()[MachineConfigUserUnitsAnnotationKey],
+		KernelImages:    config.GetAnnotations()[MachineConfigKernelTypeImagesAnnotationKey],
+		UsrHotfixes:     config.GetAnnotations()[MachineConfigUsrHotfixesAnnotationKey],
+		OSDeltaBundles:  config.GetAnnotations()[MachineConfigOSDeltaBundlesAnnotationKey],
+		InitramfsArgs:   config.GetAnnotations()[MachineConfigInitramfsArgsAnnotationKey],
+		ApplyPhases:     config.GetAnnotations()[MachineConfigApplyPhasesAnnotationKey],
+		DeferredUnits:   config.GetAnnotations()[MachineConfigDeferredUnitsAnnotationKey],
+		UnitReload:      config.GetAnnotations()[MachineConfigUnitReloadPolicyAnnotationKey],
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// reportUpdateError records a failed update in device agent mode with the
+// StatusReporter, marking unreconcilable configs as such.
+func reportUpdateError(reporter StatusReporter, updateErr error) {
+	if ErrorCodeOf(updateErr) == ErrorCodeUnreconcilable {
+		reporter.Eventf(corev1.EventTypeWarning, "FailedToReconcile", "%v", updateErr)
+		if err := reporter.SetUnreconcilable(updateErr); err != nil {
+			klog.Errorf("Error setting state to Unreconcilable: %v", err)
+		}
+		return
+	}
+	if err := reporter.SetDegraded(updateErr); err != nil {
+		klog.Errorf("Error setting state to Degraded: %v", err)
+	}
+}
+
+// splitFileDiffs splits the set of changed file, directory and link paths into
+// the ones that are part of the new config (written) and the ones that are not
+// (removed).
+func splitFileDiffs(diffFileSet []string, newIgnConfig *ign3types.Config) (written, removed []string) {
+	newFiles := managedStoragePaths(*newIgnConfig)
+	for _, path := range diffFileSet {
+		if _, ok := newFiles[path]; ok {
+			written = append(written, path)
+		} else {
+			removed = append(removed, path)
+		}
+	}
+	return written, removed
+}
+
+// withoutManagedPaths returns oldIgnConfig without the files, directories,
+// links and units newIgnConfig has, so that diffing them has everything of
+// newIgnConfig added while what only oldIgnConfig has is still removed.
+func withoutManagedPaths(oldIgnConfig, newIgnConfig ign3types.Config) ign3types.Config {
+	newPaths := managedStoragePaths(newIgnConfig)
+	forced := oldIgnConfig
+	forced.Storage.Files = nil
+	for _, f := range oldIgnConfig.Storage.Files {
+		if _, ok := newPaths[f.Path]; !ok {
+			forced.Storage.Files = append(forced.Storage.Files, f)
+		}
+	}
+	forced.Storage.Directories = nil
+	for _, d := range oldIgnConfig.Storage.Directories {
+		if _, ok := newPaths[d.Path]; !ok {
+			forced.Storage.Directories = append(forced.Storage.Directories, d)
+		}
+	}
+	forced.Storage.Links = nil
+	for _, l := range oldIgnConfig.Storage.Links {
+		if _, ok := newPaths[l.Path]; !ok {
+			forced.Storage.Links = append(forced.Storage.Links, l)
+		}
+	}
+	newUnits := map[string]struct{}{}
+	for _, u := range newIgnConfig.Systemd.Units {
+		newUnits[u.Name] = struct{}{}
+	}
+	forced.Systemd.Units = nil
+	for _, u := range oldIgnConfig.Systemd.Units {
+		if _, ok := newUnits[u.Name]; !ok {
+			forced.Systemd.Units = append(forced.Systemd.Units, u)
+		}
+	}
+	return forced
+}
+
+// calculateUnitDiffs returns the sorted names of the units that were added,
+// removed or modified (including their dropins) between two Ignition configs.
+func calculateUnitDiffs(oldIgnConfig, newIgnConfig *ign3types.Config) []string {
+	oldUnits := make(map[string]ign3types.Unit, len(oldIgnConfig.Systemd.Units))
+	for _, u := range oldIgnConfig.Systemd.Units {
+		oldUnits[u.Name] = u
+	}
+
+	var changed []string
+	for _, u := range newIgnConfig.Systemd.Units {
+		oldUnit, ok := oldUnits[u.Name]
+		if !ok || !reflect.DeepEqual(oldUnit, u) {
+			changed = append(changed, u.Name)
+		}
+		delete(oldUnits, u.Name)
+	}
+	for name := range oldUnits {
+		changed = append(changed, name)
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// rebootReason generates a human-readable rationale for why a diff requires
+// a reboot.
+func rebootReason(diff *machineConfigDiff) string {
+	if changes := diff.osChangesString(); changes != "" {
+		return changes
+	}
+	if diff.fips {
+		return "Changing FIPS mode"
+	}
+	return "Changed files require a reboot"
+}
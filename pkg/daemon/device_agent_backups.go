@@ -0,0 +1,248 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"k8s.io/klog/v2"
+)
+
+// driftBackupDirPath is where device agent mode keeps copies of locally
+// modified files before overwriting or removing them, in a directory per
+// update named after its time.
+var driftBackupDirPath = filepath.Join("/etc", "machine-config-daemon", "backups")
+
+// driftBackupTimeLayout names the backup directory of an update.
+const driftBackupTimeLayout = "20060102T150405.000000000Z"
+
+// BackupRetentionPolicy bounds the backups of locally modified files kept
+// after updates in device agent mode, so they don't fill up the disk of
+// long-lived devices. The backups of the running update are never removed.
+type BackupRetentionPolicy struct {
+	// KeepUpdates is how many of the newest updates with backups have them
+	// kept. Zero keeps the backups of all updates.
+	KeepUpdates int
+	// MaxAge is how long backups are kept. Zero keeps them regardless of
+	// their age.
+	MaxAge time.Duration
+}
+
+// DefaultBackupRetentionPolicy is the backup retention of a daemon created by
+// NewClusterlessDaemon: the backups of the last 10 updates, for 90 days.
+func DefaultBackupRetentionPolicy() BackupRetentionPolicy {
+	return BackupRetentionPolicy{KeepUpdates: 10, MaxAge: 90 * 24 * time.Hour}
+}
+
+// WithBackupRetention makes updates in device agent mode remove the backups
+// of locally modified files policy doesn't keep.
+func WithBackupRetention(policy BackupRetentionPolicy) Option {
+	return func(dn *Daemon) {
+		dn.backupRetention = &policy
+	}
+}
+
+// Backup is a copy of a locally modified file taken before an update in
+// device agent mode overwrote or removed it.
+type Backup struct {
+	// Path is where the file was.
+	Path string `json:"path"`
+	// BackupPath is where the copy is, to be passed to RestoreBackup.
+	BackupPath string `json:"backupPath"`
+	// Time is when the update that took the backup started writing files.
+	Time time.Time `json:"time"`
+}
+
+// ListBackups returns the backups of locally modified files, newest first.
+func (dn *Daemon) ListBackups() ([]Backup, error) {
+	entries, err := os.ReadDir(driftBackupDirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading backups: %w", err)
+	}
+	var backups []Backup
+	for _, entry := range entries {
+		t, err := time.Parse(driftBackupTimeLayout, entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(driftBackupDirPath, entry.Name())
+		if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			backups = append(backups, Backup{Path: strings.TrimPrefix(path, dir), BackupPath: path, Time: t})
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("reading backups: %w", err)
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if !backups[i].Time.Equal(backups[j].Time) {
+			return backups[i].Time.After(backups[j].Time)
+		}
+		return backups[i].Path < backups[j].Path
+	})
+	return backups, nil
+}
+
+// RestoreBackup puts the backup at backupPath, as listed by ListBackups, back
+// in place of the file it was taken of. The backup is kept. The next update
+// overwrites the restored file again if it is still part of the config.
+func (dn *Daemon) RestoreBackup(backupPath string) error {
+	rel, err := filepath.Rel(driftBackupDirPath, filepath.Clean(backupPath))
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%q is not a backup", backupPath)
+	}
+	stamp, path, ok := strings.Cut(rel, string(filepath.Separator))
+	if _, err := time.Parse(driftBackupTimeLayout, stamp); err != nil || !ok {
+		return fmt.Errorf("%q is not a backup", backupPath)
+	}
+	path = string(filepath.Separator) + path
+	if info, err := os.Lstat(backupPath); err != nil {
+		return fmt.Errorf("reading backup %q: %w", backupPath, err)
+	} else if info.IsDir() {
+		return fmt.Errorf("%q is not a backup", backupPath)
+	}
+
+	// Copy next to the file first, so it is replaced in one step
+	tmpPath := path + ".mcdrestore"
+	os.Remove(tmpPath)
+	if err := copyPreservingAttributes(backupPath, tmpPath); err != nil {
+		return fmt.Errorf("restoring backup of %q: %w", path, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("restoring backup of %q: %w", path, err)
+	}
+	logSystem("Restored %q from backup %q", path, backupPath)
+	return nil
+}
+
+// backupDriftedFiles copies the files of the old config that were modified
+// locally, and that the update overwrites or removes, below a new backup
+// directory for the update. Files whose contents can't be told, i.e. remote
+// ones without a verification hash, aren't backed up, and neither are files
+// that were changed to what the new config has anyway. It returns the paths
+// of the files that were backed up.
+func backupDriftedFiles(oldIgnConfig, newIgnConfig ign3types.Config, orphans OrphanedFilePolicy, skipCertificateWrite bool, now time.Time) ([]string, error) {
+	newFiles := map[string]ign3types.File{}
+	for _, f := range newIgnConfig.Storage.Files {
+		newFiles[f.Path] = f
+	}
+
+	dir := filepath.Join(driftBackupDirPath, now.UTC().Format(driftBackupTimeLayout))
+	var backedUp []string
+	for _, f := range oldIgnConfig.Storage.Files {
+		if f.Path == caBundleFilePath && skipCertificateWrite {
+			continue
+		}
+		newFile, written := newFiles[f.Path]
+		if !written && orphans != OrphanedFilesDelete {
+			continue
+		}
+		if info, err := os.Lstat(f.Path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		matches, known, err := fileMatchesContents(f)
+		if err != nil {
+			return backedUp, err
+		}
+		if !known || matches {
+			continue
+		}
+		if written {
+			if matches, known, err := fileMatchesContents(newFile); err == nil && known && matches {
+				continue
+			}
+		}
+		backupPath := filepath.Join(dir, f.Path)
+		if err := copyPreservingAttributes(f.Path, backupPath); err != nil {
+			return backedUp, fmt.Errorf("backing up locally modified file %q: %w", f.Path, err)
+		}
+		klog.Infof("Backed up locally modified file %q to %q", f.Path, backupPath)
+		backedUp = append(backedUp, f.Path)
+	}
+	return backedUp, nil
+}
+
+// pruneBackups removes the backup directories of updates policy doesn't keep,
+// counting from the update started at now, and returns their times. Failures
+// are only logged, as they just keep the backups for longer.
+func pruneBackups(policy BackupRetentionPolicy, now time.Time) []time.Time {
+	entries, err := os.ReadDir(driftBackupDirPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Failed to read backups: %v", err)
+		}
+		return nil
+	}
+	var times []time.Time
+	for _, entry := range entries {
+		if t, err := time.Parse(driftBackupTimeLayout, entry.Name()); err == nil && entry.IsDir() {
+			times = append(times, t)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+
+	var removed []time.Time
+	for i, t := range times {
+		if !t.Before(now) {
+			continue
+		}
+		if (policy.KeepUpdates <= 0 || i < policy.KeepUpdates) && (policy.MaxAge <= 0 || now.Sub(t) <= policy.MaxAge) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(driftBackupDirPath, t.Format(driftBackupTimeLayout))); err != nil {
+			klog.Warningf("Failed to remove backups of %v: %v", t, err)
+			continue
+		}
+		removed = append(removed, t)
+	}
+	if len(removed) > 0 {
+		logSystem("Removed the backups of %d updates", len(removed))
+	}
+	return removed
+}
+
+// fileMatchesContents returns whether the contents of file on disk are what
+// the config has for it, and whether that could be told at all.
+func fileMatchesContents(file ign3types.File) (bool, bool, error) {
+	hash := file.Contents.Verification.Hash
+	if isRemoteSource(file.Contents.Source) {
+		if hash == nil {
+			return false, false, nil
+		}
+	} else {
+		h := sha256.New()
+		if err := writeFileContents(file, h); err != nil {
+			return false, false, nil
+		}
+		sum := "sha256-" + hex.EncodeToString(h.Sum(nil))
+		hash = &sum
+	}
+	verifier, err := newContentVerifier(file.Path, hash)
+	if err != nil {
+		return false, false, nil
+	}
+
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return false, false, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return false, false, fmt.Errorf("reading %q: %w", file.Path, err)
+	}
+	return verifier.verify() == nil, true, nil
+}
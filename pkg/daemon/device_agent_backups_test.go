@@ -0,0 +1,109 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriftBackups(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+
+	path := filepath.Join(testDir, "etc", "agent.conf")
+	untouchedPath := filepath.Join(testDir, "etc", "untouched")
+	removedPath := filepath.Join(testDir, "etc", "removed")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		newDeviceAgentTestFile(t, path, "old"),
+		newDeviceAgentTestFile(t, untouchedPath, "untouched"),
+		newDeviceAgentTestFile(t, removedPath, "removed"),
+	}, nil)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	backups, err := d.ListBackups()
+	require.Nil(t, err)
+	assert.Empty(t, backups)
+
+	// Local modifications are backed up, unless they match the new config
+	require.Nil(t, os.WriteFile(path, []byte("local"), 0o644))
+	require.Nil(t, os.WriteFile(removedPath, []byte("local removed"), 0o644))
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, path, "new"),
+		newDeviceAgentTestFile(t, untouchedPath, "untouched"),
+	}, nil)
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{path, removedPath}, result.FilesBackedUp)
+
+	backups, err = d.ListBackups()
+	require.Nil(t, err)
+	require.Len(t, backups, 2)
+	assert.Equal(t, path, backups[0].Path)
+	assert.Equal(t, removedPath, backups[1].Path)
+	contents, err := os.ReadFile(backups[0].BackupPath)
+	require.Nil(t, err)
+	assert.Equal(t, "local", string(contents))
+
+	// Restoring puts the local modifications back
+	require.Nil(t, d.RestoreBackup(backups[1].BackupPath))
+	contents, err = os.ReadFile(removedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "local removed", string(contents))
+	assert.NotNil(t, d.RestoreBackup(path))
+	assert.NotNil(t, d.RestoreBackup(filepath.Join(driftBackupDirPath, "..", "orig")))
+}
+
+func TestBackupRetention(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	backup := func(t *testing.T, age time.Duration) string {
+		dir := filepath.Join(driftBackupDirPath, now.Add(-age).Format(driftBackupTimeLayout))
+		require.Nil(t, os.MkdirAll(filepath.Join(dir, "etc"), 0o755))
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "etc", "agent.conf"), []byte("local"), 0o644))
+		return dir
+	}
+	current := backup(t, 0)
+	recent := backup(t, time.Hour)
+	older := backup(t, 48*time.Hour)
+	oldest := backup(t, 30*24*time.Hour)
+	other := filepath.Join(driftBackupDirPath, "not-a-backup")
+	require.Nil(t, os.MkdirAll(other, 0o755))
+
+	// The backups of the running update are kept regardless
+	assert.Len(t, pruneBackups(BackupRetentionPolicy{KeepUpdates: 3, MaxAge: 7 * 24 * time.Hour}, now), 1)
+	assert.NoDirExists(t, oldest)
+	assert.Len(t, pruneBackups(BackupRetentionPolicy{KeepUpdates: 1}, now), 2)
+	assert.DirExists(t, current)
+	assert.NoDirExists(t, recent)
+	assert.NoDirExists(t, older)
+	assert.DirExists(t, other)
+	assert.Empty(t, pruneBackups(BackupRetentionPolicy{MaxAge: time.Nanosecond}, now))
+	assert.DirExists(t, current)
+
+	// Updates prune the backups of earlier ones
+	d := newMockDeviceAgentDaemon(testDir)
+	WithBackupRetention(BackupRetentionPolicy{KeepUpdates: 1})(d)
+	path := filepath.Join(testDir, "etc", "agent.conf")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, path, "old")}, nil)
+	require.Nil(t, d.writeFiles(context.TODO(), []ign3types.File{newDeviceAgentTestFile(t, path, "local")}, nil, true))
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, path, "new")}, nil)
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{path}, result.FilesBackedUp)
+	assert.NoDirExists(t, current)
+	backups, err := d.ListBackups()
+	require.Nil(t, err)
+	require.Len(t, backups, 1)
+	contents, err := os.ReadFile(backups[0].BackupPath)
+	require.Nil(t, err)
+	assert.Equal(t, "local", string(contents))
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	fcctbase "github.com/coreos/fcct/base/v0_1"
+	translate3_1 "github.com/coreos/ignition/v2/config/v3_1/translate"
+	translate3_2 "github.com/coreos/ignition/v2/config/v3_2/translate"
+	translate3_3 "github.com/coreos/ignition/v2/config/v3_3/translate"
+	translate3 "github.com/coreos/ignition/v2/config/v3_4/translate"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// Butane variants accepted by MachineConfigFromButane
+const (
+	butaneVariantFCOS      = "fcos"
+	butaneVariantOpenShift = "openshift"
+)
+
+// butaneConfig is a Butane config restricted to the base fields we can
+// translate: the storage, systemd, passwd and ignition sections, plus the
+// metadata and openshift sections of the openshift variant.
+type butaneConfig struct {
+	Variant   string          `yaml:"variant"`
+	Version   string          `yaml:"version"`
+	Metadata  butaneMetadata  `yaml:"metadata"`
+	OpenShift butaneOpenShift `yaml:"openshift"`
+
+	fcctbase.Config `yaml:",inline"`
+}
+
+type butaneMetadata struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+type butaneOpenShift struct {
+	KernelArguments []string `yaml:"kernel_arguments"`
+	Extensions      []string `yaml:"extensions"`
+	FIPS            *bool    `yaml:"fips"`
+	KernelType      *string  `yaml:"kernel_type"`
+}
+
+// MachineConfigFromButane translates a Butane config of the fcos or openshift
+// variant into a MachineConfig, so human-authored configs can be passed to
+// RunOnceInDeviceAgentMode directly. The name is taken from metadata.name for
+// the openshift variant unless name is set. Only the base Butane fields are
+// supported; variant specific sugar such as storage.trees or boot_device is
+// rejected as unknown.
+func MachineConfigFromButane(name string, butane []byte) (*mcfgv1.MachineConfig, error) {
+	cfg := butaneConfig{}
+	if err := yaml.UnmarshalStrict(butane, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse Butane config: %w", err)
+	}
+
+	switch cfg.Variant {
+	case butaneVariantFCOS:
+		if !strings.HasPrefix(cfg.Version, "1.") {
+			return nil, fmt.Errorf("unsupported Butane %s version %q", cfg.Variant, cfg.Version)
+		}
+		if cfg.Metadata.Name != "" || len(cfg.Metadata.Labels) > 0 {
+			return nil, fmt.Errorf("metadata is only supported by the %s Butane variant", butaneVariantOpenShift)
+		}
+		if cfg.OpenShift.FIPS != nil || cfg.OpenShift.KernelType != nil || len(cfg.OpenShift.KernelArguments) > 0 || len(cfg.OpenShift.Extensions) > 0 {
+			return nil, fmt.Errorf("the openshift section is only supported by the %s Butane variant", butaneVariantOpenShift)
+		}
+	case butaneVariantOpenShift:
+		if !strings.HasPrefix(cfg.Version, "4.") {
+			return nil, fmt.Errorf("unsupported Butane %s version %q", cfg.Variant, cfg.Version)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Butane variant %q", cfg.Variant)
+	}
+
+	if name == "" {
+		name = cfg.Metadata.Name
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no name given for MachineConfig")
+	}
+
+	ign3_0config, tSet, err := cfg.Config.ToIgn3_0()
+	if err != nil {
+		return nil, fmt.Errorf("failed to transpile Butane config to Ignition config: %w\nTranslation set: %v", err, tSet)
+	}
+	ignConfig := translate3.Translate(translate3_3.Translate(translate3_2.Translate(translate3_1.Translate(ign3_0config))))
+	rawIgnConfig, err := json.Marshal(ignConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling Ignition config: %w", err)
+	}
+	// Have Ignition validate the result
+	if _, err := ctrlcommon.ParseAndConvertConfig(rawIgnConfig); err != nil {
+		return nil, fmt.Errorf("invalid Butane config: %w", err)
+	}
+
+	mc := &mcfgv1.MachineConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: cfg.Metadata.Labels,
+		},
+		Spec: mcfgv1.MachineConfigSpec{
+			Config: runtime.RawExtension{
+				Raw: rawIgnConfig,
+			},
+			KernelArguments: cfg.OpenShift.KernelArguments,
+			Extensions:      cfg.OpenShift.Extensions,
+		},
+	}
+	if cfg.OpenShift.FIPS != nil {
+		mc.Spec.FIPS = *cfg.OpenShift.FIPS
+	}
+	if cfg.OpenShift.KernelType != nil {
+		mc.Spec.KernelType = *cfg.OpenShift.KernelType
+	}
+	return mc, nil
+}
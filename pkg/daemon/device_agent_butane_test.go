@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineConfigFromButane(t *testing.T) {
+	openshiftButane := `variant: openshift
+version: 4.14.0
+metadata:
+  name: 99-appliance
+  labels:
+    machineconfiguration.openshift.io/role: worker
+openshift:
+  kernel_arguments:
+    - loglevel=7
+  kernel_type: realtime
+storage:
+  files:
+    - path: /etc/motd
+      mode: 0644
+      contents:
+        inline: hello
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys:
+        - ssh-ed25519 AAAA
+systemd:
+  units:
+    - name: hello.service
+      enabled: true
+      contents: "[Unit]"
+`
+	mc, err := MachineConfigFromButane("", []byte(openshiftButane))
+	require.Nil(t, err)
+	assert.Equal(t, "99-appliance", mc.Name)
+	assert.Equal(t, "worker", mc.Labels[mcfgv1.MachineConfigRoleLabelKey])
+	assert.Equal(t, []string{"loglevel=7"}, mc.Spec.KernelArguments)
+	assert.Equal(t, ctrlcommon.KernelTypeRealtime, mc.Spec.KernelType)
+
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(mc.Spec.Config.Raw)
+	require.Nil(t, err)
+	require.Len(t, ignConfig.Storage.Files, 1)
+	assert.Equal(t, "/etc/motd", ignConfig.Storage.Files[0].Path)
+	assert.Equal(t, 0o644, *ignConfig.Storage.Files[0].Mode)
+	contents, err := ctrlcommon.DecodeIgnitionFileContents(ignConfig.Storage.Files[0].Contents.Source, ignConfig.Storage.Files[0].Contents.Compression)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(contents))
+	require.Len(t, ignConfig.Passwd.Users, 1)
+	assert.Equal(t, []ign3types.SSHAuthorizedKey{"ssh-ed25519 AAAA"}, ignConfig.Passwd.Users[0].SSHAuthorizedKeys)
+	require.Len(t, ignConfig.Systemd.Units, 1)
+	assert.Equal(t, "hello.service", ignConfig.Systemd.Units[0].Name)
+
+	mc, err = MachineConfigFromButane("fcos", []byte("variant: fcos\nversion: 1.4.0\n"))
+	require.Nil(t, err)
+	assert.Equal(t, "fcos", mc.Name)
+
+	for _, butane := range []string{
+		// Missing variant
+		"version: 1.4.0\n",
+		// Unsupported variant
+		"variant: flatcar\nversion: 1.0.0\n",
+		// Sugar not supported by the base translation
+		"variant: fcos\nversion: 1.4.0\nstorage:\n  trees:\n    - local: foo\n",
+		// openshift section in the fcos variant
+		"variant: fcos\nversion: 1.4.0\nopenshift:\n  fips: true\n",
+	} {
+		_, err := MachineConfigFromButane("test", []byte(butane))
+		assert.NotNil(t, err, butane)
+	}
+
+	// The openshift variant needs a name
+	_, err = MachineConfigFromButane("", []byte("variant: openshift\nversion: 4.14.0\n"))
+	assert.NotNil(t, err)
+}
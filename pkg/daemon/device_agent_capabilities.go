@@ -0,0 +1,152 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"golang.org/x/sys/unix"
+)
+
+// MachineConfigFileCapabilitiesAnnotationKey holds the Linux capabilities to
+// set on files of a MachineConfig in device agent mode, so non-root binaries
+// can e.g. bind to privileged ports. It is a JSON object mapping file paths to
+// capabilities in the textual form setcap(8) takes, limited to a single
+// clause:
+//
+//	{"/usr/local/bin/agent": "cap_net_bind_service,cap_net_raw=ep"}
+//
+// The flags are any of "e" (effective), "i" (inheritable) and "p"
+// (permitted), and "+" may be used in place of "=". The capabilities are
+// written as the "security.capability" extended attribute, so a file can't
+// have both capabilities and that attribute in
+// MachineConfigFileXattrsAnnotationKey.
+const MachineConfigFileCapabilitiesAnnotationKey = "machineconfiguration.openshift.io/file-capabilities"
+
+// xattrCapability is the extended attribute holding a file's capabilities.
+const xattrCapability = "security.capability"
+
+// Revision 2 of the on-disk capability format, see capability.h
+const (
+	vfsCapRevision2      = 0x02000000
+	vfsCapFlagsEffective = 0x000001
+)
+
+var capabilityNames = map[string]int{
+	"cap_chown":              unix.CAP_CHOWN,
+	"cap_dac_override":       unix.CAP_DAC_OVERRIDE,
+	"cap_dac_read_search":    unix.CAP_DAC_READ_SEARCH,
+	"cap_fowner":             unix.CAP_FOWNER,
+	"cap_fsetid":             unix.CAP_FSETID,
+	"cap_kill":               unix.CAP_KILL,
+	"cap_setgid":             unix.CAP_SETGID,
+	"cap_setuid":             unix.CAP_SETUID,
+	"cap_setpcap":            unix.CAP_SETPCAP,
+	"cap_linux_immutable":    unix.CAP_LINUX_IMMUTABLE,
+	"cap_net_bind_service":   unix.CAP_NET_BIND_SERVICE,
+	"cap_net_broadcast":      unix.CAP_NET_BROADCAST,
+	"cap_net_admin":          unix.CAP_NET_ADMIN,
+	"cap_net_raw":            unix.CAP_NET_RAW,
+	"cap_ipc_lock":           unix.CAP_IPC_LOCK,
+	"cap_ipc_owner":          unix.CAP_IPC_OWNER,
+	"cap_sys_module":         unix.CAP_SYS_MODULE,
+	"cap_sys_rawio":          unix.CAP_SYS_RAWIO,
+	"cap_sys_chroot":         unix.CAP_SYS_CHROOT,
+	"cap_sys_ptrace":         unix.CAP_SYS_PTRACE,
+	"cap_sys_pacct":          unix.CAP_SYS_PACCT,
+	"cap_sys_admin":          unix.CAP_SYS_ADMIN,
+	"cap_sys_boot":           unix.CAP_SYS_BOOT,
+	"cap_sys_nice":           unix.CAP_SYS_NICE,
+	"cap_sys_resource":       unix.CAP_SYS_RESOURCE,
+	"cap_sys_time":           unix.CAP_SYS_TIME,
+	"cap_sys_tty_config":     unix.CAP_SYS_TTY_CONFIG,
+	"cap_mknod":              unix.CAP_MKNOD,
+	"cap_lease":              unix.CAP_LEASE,
+	"cap_audit_write":        unix.CAP_AUDIT_WRITE,
+	"cap_audit_control":      unix.CAP_AUDIT_CONTROL,
+	"cap_setfcap":            unix.CAP_SETFCAP,
+	"cap_mac_override":       unix.CAP_MAC_OVERRIDE,
+	"cap_mac_admin":          unix.CAP_MAC_ADMIN,
+	"cap_syslog":             unix.CAP_SYSLOG,
+	"cap_wake_alarm":         unix.CAP_WAKE_ALARM,
+	"cap_block_suspend":      unix.CAP_BLOCK_SUSPEND,
+	"cap_audit_read":         unix.CAP_AUDIT_READ,
+	"cap_perfmon":            unix.CAP_PERFMON,
+	"cap_bpf":                unix.CAP_BPF,
+	"cap_checkpoint_restore": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// addFileCapabilities adds the capabilities mc's annotation asks for to
+// xattrs, which must already hold the extended attributes of mc.
+func addFileCapabilities(mc *mcfgv1.MachineConfig, xattrs fileXattrs) (fileXattrs, error) {
+	encoded, ok := mc.GetAnnotations()[MachineConfigFileCapabilitiesAnnotationKey]
+	if !ok {
+		return xattrs, nil
+	}
+	raw := map[string]string{}
+	if err := json.Unmarshal([]byte(encoded), &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s annotation: %w", MachineConfigFileCapabilitiesAnnotationKey, err)
+	}
+	if xattrs == nil {
+		xattrs = fileXattrs{}
+	}
+	for path, text := range raw {
+		if _, ok := xattrs[path][xattrCapability]; ok {
+			return nil, fmt.Errorf("both capabilities and the %s extended attribute given for %q", xattrCapability, path)
+		}
+		value, err := encodeFileCapabilities(text)
+		if err != nil {
+			return nil, fmt.Errorf("capabilities of %q: %w", path, err)
+		}
+		if xattrs[path] == nil {
+			xattrs[path] = map[string][]byte{}
+		}
+		xattrs[path][xattrCapability] = value
+	}
+	return xattrs, nil
+}
+
+// encodeFileCapabilities encodes capabilities in setcap's textual form, e.g.
+// "cap_net_bind_service=ep", as a revision 2 security.capability value.
+func encodeFileCapabilities(text string) ([]byte, error) {
+	sep := strings.IndexAny(text, "=+")
+	if sep < 0 {
+		return nil, fmt.Errorf("invalid capabilities %q: no flags given", text)
+	}
+	names, flags := text[:sep], text[sep+1:]
+
+	var caps uint64
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		c, ok := capabilityNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps |= 1 << uint(c)
+	}
+
+	var permitted, inheritable uint64
+	magic := uint32(vfsCapRevision2)
+	for _, flag := range flags {
+		switch flag {
+		case 'e':
+			magic |= vfsCapFlagsEffective
+		case 'i':
+			inheritable = caps
+		case 'p':
+			permitted = caps
+		default:
+			return nil, fmt.Errorf("invalid capability flag %q in %q", flag, text)
+		}
+	}
+
+	b := make([]byte, 20)
+	binary.LittleEndian.PutUint32(b[0:], magic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(permitted))
+	binary.LittleEndian.PutUint32(b[8:], uint32(inheritable))
+	binary.LittleEndian.PutUint32(b[12:], uint32(permitted>>32))
+	binary.LittleEndian.PutUint32(b[16:], uint32(inheritable>>32))
+	return b, nil
+}
@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineConfigFileCapabilities(t *testing.T) {
+	agentPath := "/usr/local/bin/agent"
+	files := []ign3types.File{ctrlcommon.NewIgnFile(agentPath, "agent")}
+	newConfig := func(annotations map[string]string) *mcfgv1.MachineConfig {
+		mc := newDeviceAgentTestConfig(t, "new", files, nil)
+		mc.Annotations = annotations
+		return mc
+	}
+
+	xattrs, err := machineConfigFileXattrs(newConfig(map[string]string{
+		MachineConfigFileCapabilitiesAnnotationKey: `{"/usr/local/bin/agent": "cap_net_bind_service,CAP_NET_RAW+ep"}`,
+		MachineConfigFileXattrsAnnotationKey:       `{"/usr/local/bin/agent": {"user.origin": "fleet"}}`,
+	}), files)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("fleet"), xattrs[agentPath]["user.origin"])
+	// Revision 2 with the effective flag, and bits 10 and 13 permitted
+	assert.Equal(t, []byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x24, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}, xattrs[agentPath][xattrCapability])
+
+	// Capabilities beyond the first 32 go into the upper words
+	value, err := encodeFileCapabilities("cap_bpf=i")
+	require.Nil(t, err)
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x02}, value[0:4])
+	assert.Equal(t, []byte{0x80, 0x00, 0x00, 0x00}, value[16:20])
+
+	for _, annotations := range []map[string]string{
+		{MachineConfigFileCapabilitiesAnnotationKey: `{"/usr/local/bin/agent": "cap_no_such_thing=ep"}`},
+		{MachineConfigFileCapabilitiesAnnotationKey: `{"/usr/local/bin/agent": "cap_net_raw"}`},
+		{MachineConfigFileCapabilitiesAnnotationKey: `{"/usr/local/bin/agent": "cap_net_raw=x"}`},
+		{MachineConfigFileCapabilitiesAnnotationKey: `{"/usr/local/bin/other": "cap_net_raw=ep"}`},
+		{
+			MachineConfigFileCapabilitiesAnnotationKey: `{"/usr/local/bin/agent": "cap_net_raw=ep"}`,
+			MachineConfigFileXattrsAnnotationKey:       `{"/usr/local/bin/agent": {"security.capability": "0sAAAAAg=="}}`,
+		},
+	} {
+		_, err := machineConfigFileXattrs(newConfig(annotations), files)
+		assert.NotNil(t, err, annotations)
+	}
+}
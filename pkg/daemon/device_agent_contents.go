@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// mediaTypeZstd marks zstd compressed file contents. Ignition only knows
+// about gzip, so zstd compressed contents are given as data URLs of this media
+// type, or served with this content type, and no compression.
+const mediaTypeZstd = "application/zstd"
+
+// decodeFileContents returns the decompressed inline contents of file. The
+// contents are checked against the file's verification hash, and an
+// ErrHashMismatch is returned if they don't match.
+func decodeFileContents(file ign3types.File) ([]byte, error) {
+	var contents bytes.Buffer
+	if err := writeFileContents(file, &contents); err != nil {
+		return nil, err
+	}
+	return contents.Bytes(), nil
+}
+
+// writeFileContents streams the decompressed inline contents of file to w,
+// checking them against the file's verification hash on the way. Only the
+// compressed contents are held in memory, as part of the config.
+func writeFileContents(file ign3types.File, w io.Writer) error {
+	verifier, err := newContentVerifier(file.Path, file.Contents.Verification.Hash)
+	if err != nil {
+		return err
+	}
+	if file.Contents.Source == nil {
+		// To allow writing of "empty" files we'll allow source to be nil
+		return verifier.verify()
+	}
+
+	decoded, err := dataurl.DecodeString(*file.Contents.Source)
+	if err != nil {
+		return fmt.Errorf("could not decode file content string: %w", err)
+	}
+	return copyFileContents(w, bytes.NewReader(decoded.Data), file.Contents.Compression, decoded.ContentType(), verifier)
+}
+
+// copyFileContents decompresses r to w and has verifier check what it wrote.
+func copyFileContents(w io.Writer, r io.Reader, compression *string, contentType string, verifier *contentVerifier) error {
+	decompressed, err := decompressReader(r, compression, contentType)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+	if _, err := io.Copy(io.MultiWriter(w, verifier), decompressed); err != nil {
+		return fmt.Errorf("failed decompressing: %w", err)
+	}
+	return verifier.verify()
+}
+
+// decompressReader returns a reader decompressing r as given by the
+// compression of a file, or by its content type for zstd.
+func decompressReader(r io.Reader, compression *string, contentType string) (io.ReadCloser, error) {
+	if contentType == mediaTypeZstd {
+		if compression != nil && *compression != "" {
+			return nil, fmt.Errorf("%s contents can't have %s compression", mediaTypeZstd, *compression)
+		}
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not create zstd reader: %w", err)
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	if compression == nil {
+		return io.NopCloser(r), nil
+	}
+	switch *compression {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not create gzip reader: %w", err)
+		}
+		return reader, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression type %q", *compression)
+	}
+}
+
+// contentVerifier hashes the decompressed contents of a file as they are
+// written to it, to check them against an Ignition verification hash of the
+// form "<function>-<hex digest>". A verifier without a hash always matches.
+type contentVerifier struct {
+	path         string
+	verification string
+	function     string
+	digest       string
+	h            hash.Hash
+}
+
+func newContentVerifier(path string, verification *string) (*contentVerifier, error) {
+	if verification == nil {
+		return &contentVerifier{path: path}, nil
+	}
+	function, digest, ok := strings.Cut(*verification, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid verification hash %q", *verification)
+	}
+	v := &contentVerifier{path: path, verification: *verification, function: function, digest: strings.ToLower(digest)}
+	switch function {
+	case "sha512":
+		v.h = sha512.New()
+	case "sha256":
+		v.h = sha256.New()
+	default:
+		return nil, fmt.Errorf("unsupported hash function %q", function)
+	}
+	return v, nil
+}
+
+func (v *contentVerifier) Write(p []byte) (int, error) {
+	if v.h != nil {
+		v.h.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify returns an ErrHashMismatch if what was written doesn't match the
+// verification hash.
+func (v *contentVerifier) verify() error {
+	if v.h == nil {
+		return nil
+	}
+	if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.digest {
+		return &ErrHashMismatch{Path: v.path, Expected: v.verification, Actual: v.function + "-" + sum}
+	}
+	return nil
+}
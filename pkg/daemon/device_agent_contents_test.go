@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vincent-petithory/dataurl"
+)
+
+func TestDecodeFileContents(t *testing.T) {
+	contents := []byte("hello world\n")
+	sum := sha256.Sum256(contents)
+	contentsHash := "sha256-" + hex.EncodeToString(sum[:])
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err := gzipWriter.Write(contents)
+	require.Nil(t, err)
+	require.Nil(t, gzipWriter.Close())
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.Nil(t, err)
+	zstdData := (&dataurl.DataURL{
+		MediaType: dataurl.MediaType{Type: "application", Subtype: "zstd"},
+		Encoding:  dataurl.EncodingBase64,
+		Data:      zstdEncoder.EncodeAll(contents, nil),
+	}).String()
+
+	tests := []struct {
+		name        string
+		source      string
+		compression string
+		hash        string
+		expectedErr bool
+	}{
+		{
+			name:   "plain",
+			source: dataurl.EncodeBytes(contents),
+			hash:   contentsHash,
+		},
+		{
+			name:        "gzip, hash of the decompressed contents",
+			source:      dataurl.EncodeBytes(gzipped.Bytes()),
+			compression: "gzip",
+			hash:        contentsHash,
+		},
+		{
+			name:   "zstd",
+			source: zstdData,
+			hash:   contentsHash,
+		},
+		{
+			name:        "zstd can't be compressed again",
+			source:      zstdData,
+			compression: "gzip",
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := ign3types.File{Node: ign3types.Node{Path: "/etc/test"}}
+			file.Contents.Source = &test.source
+			if test.compression != "" {
+				file.Contents.Compression = &test.compression
+			}
+			if test.hash != "" {
+				file.Contents.Verification.Hash = &test.hash
+			}
+			decoded, err := decodeFileContents(file)
+			if test.expectedErr {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, contents, decoded)
+		})
+	}
+
+	// Mismatching contents fail the update with a typed error and leave the
+	// file alone
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+	path := filepath.Join(testDir, "etc", "verified")
+	file := newDeviceAgentTestFile(t, path, "tampered")
+	file.Contents.Verification.Hash = &contentsHash
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newDeviceAgentTestConfig(t, "new", []ign3types.File{file}, nil), deviceAgentTestSelector, DefaultUpdatePolicy())
+	var hashErr *ErrHashMismatch
+	require.ErrorAs(t, err, &hashErr)
+	assert.Equal(t, path, hashErr.Path)
+	assert.Equal(t, contentsHash, hashErr.Expected)
+	assert.Equal(t, ErrorCodeHashMismatch, ErrorCodeOf(err))
+	assert.NoFileExists(t, path)
+
+	// Files are validated on disk as they are decoded, remote ones by their
+	// verification hash
+	zstdPath := filepath.Join(testDir, "etc", "zstd")
+	require.Nil(t, os.WriteFile(zstdPath, contents, 0o644))
+	zstdFile := ign3types.File{Node: ign3types.Node{Path: zstdPath}}
+	zstdFile.Contents.Source = &zstdData
+	assert.Nil(t, checkV3File(zstdFile))
+	remoteFile := ign3types.File{Node: ign3types.Node{Path: zstdPath}}
+	remoteFile.Contents.Source = helpers.StrToPtr("https://example.com/zstd")
+	assert.Nil(t, checkV3File(remoteFile))
+	remoteFile.Contents.Verification.Hash = &contentsHash
+	assert.Nil(t, checkV3File(remoteFile))
+	require.Nil(t, os.WriteFile(zstdPath, []byte("drifted"), 0o644))
+	assert.Error(t, checkV3File(zstdFile))
+	assert.Error(t, checkV3File(remoteFile))
+}
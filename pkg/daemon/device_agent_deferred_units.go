@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+)
+
+// MachineConfigDeferredUnitsAnnotationKey defers starting and restarting units
+// of a MachineConfig in device agent mode, as a JSON object mapping unit names
+// to when to start them:
+//
+//	{"analytics.service": "boot", "reindex.service": "Mon..Fri 22:00"}
+//
+// Units deferred to "boot" are enabled and written as the config says, but
+// only started by the next boot. Otherwise the value is an OnCalendar
+// expression of systemd.time(7): a transient timer starts or restarts the
+// unit then, unless the system reboots first, which starts it anyway if it is
+// enabled. Heavy services added by a config thus don't start during business
+// hours. Stops aren't deferred. MergeMachineConfigsInAgentMode merges the
+// units of all configs, later configs winning.
+const MachineConfigDeferredUnitsAnnotationKey = "machineconfiguration.openshift.io/deferred-units"
+
+// deferredUntilBoot defers a unit to the next boot.
+const deferredUntilBoot = "boot"
+
+// DeferredUnit is a start or restart of a unit that was deferred.
+type DeferredUnit struct {
+	// Name is the unit.
+	Name string `json:"name"`
+	// Action is "start", "restart" or "try-restart".
+	Action string `json:"action"`
+	// When is "boot" or the OnCalendar expression of the timer taking the
+	// action.
+	When string `json:"when"`
+}
+
+// machineConfigDeferredUnits returns the units of mc's annotation.
+func machineConfigDeferredUnits(mc *mcfgv1.MachineConfig) (map[string]string, error) {
+	deferred := map[string]string{}
+	encoded, ok := mc.GetAnnotations()[MachineConfigDeferredUnitsAnnotationKey]
+	if !ok {
+		return deferred, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &deferred); err != nil {
+		return deferred, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigDeferredUnitsAnnotationKey, mc.GetName(), err)
+	}
+	for name, when := range deferred {
+		if strings.TrimSpace(when) == "" || strings.ContainsRune(when, '\n') {
+			return deferred, fmt.Errorf("invalid time %q for unit %s in %s annotation of MachineConfig %s", when, name, MachineConfigDeferredUnitsAnnotationKey, mc.GetName())
+		}
+	}
+	return deferred, nil
+}
+
+// mergeDeferredUnitsAnnotations sets the deferred units annotation of merged
+// to the units of configs, in order of their names, later ones winning.
+func mergeDeferredUnitsAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	deferred := map[string]string{}
+	for _, config := range sorted {
+		fragment, err := machineConfigDeferredUnits(config)
+		if err != nil {
+			return err
+		}
+		for name, when := range fragment {
+			deferred[name] = when
+		}
+	}
+	if len(deferred) == 0 {
+		return nil
+	}
+	return setJSONAnnotation(merged, MachineConfigDeferredUnitsAnnotationKey, deferred)
+}
+
+// deferActivation moves the starts and restarts of the deferred units out of
+// the plan into Deferred.
+func (p *UnitPlan) deferActivation(deferred map[string]string) {
+	for _, op := range []struct {
+		action string
+		units  *[]string
+	}{
+		{"start", &p.Start},
+		{"restart", &p.Restart},
+		{"try-restart", &p.TryRestart},
+	} {
+		var kept []string
+		for _, name := range *op.units {
+			if when, ok := deferred[name]; ok {
+				p.Deferred = append(p.Deferred, DeferredUnit{Name: name, Action: op.action, When: when})
+				continue
+			}
+			kept = append(kept, name)
+		}
+		*op.units = kept
+	}
+	sort.Slice(p.Deferred, func(i, j int) bool { return p.Deferred[i].Name < p.Deferred[j].Name })
+}
+
+// deferredTimerName returns the name of the transient timer taking the
+// deferred action on the unit.
+func deferredTimerName(name string) string {
+	return "mcd-deferred-" + unit.UnitNameEscape(name)
+}
+
+// scheduleDeferred sets up the timers of the units that aren't deferred to
+// the next boot, replacing the ones of an earlier update.
+func (m *UnitManager) scheduleDeferred(deferred []DeferredUnit) error {
+	for _, d := range deferred {
+		if d.When == deferredUntilBoot {
+			continue
+		}
+		timer := deferredTimerName(d.Name)
+		// There is none unless an earlier update deferred the unit as well
+		_ = m.systemctl("stop", timer+".timer")
+		if err := m.systemdRun("--unit="+timer, "--on-calendar="+d.When, "--timer-property=AccuracySec=1s", "--", "systemctl", d.Action, d.Name); err != nil {
+			return fmt.Errorf("deferring %s of %s to %s: %w", d.Action, d.Name, d.When, err)
+		}
+	}
+	return nil
+}
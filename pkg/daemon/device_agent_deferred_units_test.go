@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitManagerDeferredUnits(t *testing.T) {
+	base := newDeviceAgentTestConfig(t, "00-base", nil, nil)
+	base.Annotations = map[string]string{MachineConfigDeferredUnitsAnnotationKey: `{"analytics.service": "Sat 02:00", "reindex.service": "boot"}`}
+	site := newDeviceAgentTestConfig(t, "10-site", nil, nil)
+	site.Annotations = map[string]string{MachineConfigDeferredUnitsAnnotationKey: `{"analytics.service": "Mon..Fri 22:00"}`}
+	merged, err := MergeMachineConfigsInAgentMode("merged", []*mcfgv1.MachineConfig{site, base})
+	require.Nil(t, err)
+	deferred, err := machineConfigDeferredUnits(merged)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"analytics.service": "Mon..Fri 22:00", "reindex.service": "boot"}, deferred)
+
+	plan := UnitPlan{
+		Created: []string{"analytics.service", "app.service", "reindex.service"},
+		Start:   []string{"analytics.service"},
+		Restart: []string{"app.service", "reindex.service"},
+	}
+	plan.deferActivation(deferred)
+	assert.Equal(t, UnitPlan{
+		Created: []string{"analytics.service", "app.service", "reindex.service"},
+		Restart: []string{"app.service"},
+		Deferred: []DeferredUnit{
+			{Name: "analytics.service", Action: "start", When: "Mon..Fri 22:00"},
+			{Name: "reindex.service", Action: "restart", When: "boot"},
+		},
+	}, plan)
+	assert.Equal(t, []UnitVerdict{
+		{Name: "analytics.service", Change: UnitCreated, Action: "start", DeferredUntil: "Mon..Fri 22:00"},
+		{Name: "app.service", Change: UnitCreated, Action: "restart"},
+		{Name: "reindex.service", Change: UnitCreated, Action: "restart", DeferredUntil: "boot"},
+	}, unitVerdicts(plan, &ign3types.Config{}, &ign3types.Config{}))
+
+	var calls, runs [][]string
+	m := &UnitManager{
+		systemctl: func(args ...string) error {
+			calls = append(calls, args)
+			return nil
+		},
+		systemdRun: func(args ...string) error {
+			runs = append(runs, args)
+			return nil
+		},
+	}
+	require.Nil(t, m.Apply(context.TODO(), plan))
+	assert.Equal(t, [][]string{
+		{"daemon-reload"},
+		{"restart", "app.service"},
+		{"stop", "mcd-deferred-analytics.service.timer"},
+	}, calls)
+	assert.Equal(t, [][]string{
+		{"--unit=mcd-deferred-analytics.service", "--on-calendar=Mon..Fri 22:00", "--timer-property=AccuracySec=1s", "--", "systemctl", "start", "analytics.service"},
+	}, runs)
+}
@@ -0,0 +1,330 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"k8s.io/klog/v2"
+)
+
+// deltaWriteMinSize is the size from which files are updated in place.
+const deltaWriteMinSize = 1 << 20
+
+// deltaFetchBlockSize is the size of the blocks deltaFetchSuffix lists.
+const deltaFetchBlockSize = 64 << 10
+
+// deltaFetchSuffix is appended to the URL of remote contents for their block
+// sums: the hex encoded sha256 of every deltaFetchBlockSize block of the
+// contents, one per line.
+const deltaFetchSuffix = ".blocksums"
+
+// WithDeltaWrites sets whether device agent mode updates large files in place,
+// writing only the blocks that changed, rather than rewriting them, and
+// downloads only the blocks that changed of large remote contents. Remote
+// contents qualify if they are uncompressed, have a verification hash and
+// have their block sums published at their URL with deltaFetchSuffix; the
+// changed blocks are fetched with range requests, and the rest is copied from
+// the file on disk. A crash while updating a file in place is recovered from
+// the snapshot of the update.
+func WithDeltaWrites(enabled bool) Option {
+	return func(dn *Daemon) {
+		dn.deltaWrites = enabled
+	}
+}
+
+// deltaWrite is a file staged to be updated in place.
+type deltaWrite struct {
+	file ign3types.File
+	// sum is the sha256 of the new contents, checked after writing them
+	sum []byte
+}
+
+// planDeltaWrite returns the delta write for file, or nil if it is better off
+// rewritten: it must have inline contents and replace a large regular file
+// that isn't hard linked, e.g. to the content store, as changing it in place
+// would change the other links as well.
+func planDeltaWrite(file ign3types.File) (*deltaWrite, error) {
+	if isRemoteSource(file.Contents.Source) {
+		return nil, nil
+	}
+	info, err := os.Lstat(file.Path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < deltaWriteMinSize {
+		return nil, nil
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Nlink != 1 {
+		return nil, nil
+	}
+
+	// Decode the contents once up front, so they are known to be good
+	// before the file is touched
+	h := sha256.New()
+	counter := &countingWriter{w: h}
+	if err := writeFileContents(file, counter); err != nil {
+		return nil, err
+	}
+	if counter.n < deltaWriteMinSize {
+		return nil, nil
+	}
+	return &deltaWrite{file: file, sum: h.Sum(nil)}, nil
+}
+
+// fetchDelta writes the contents of file, which must reference an http(s) URL,
+// to dest with the given mode and ownership, downloading only the blocks that
+// differ from the file on disk. It returns false if the contents don't qualify
+// for that, or the download failed, in which case they are to be fetched
+// whole.
+func (f *remoteFetcher) fetchDelta(ctx context.Context, file ign3types.File, dest string, mode os.FileMode, uid, gid int) bool {
+	if f.err != nil || file.Contents.Verification.Hash == nil || (file.Contents.Compression != nil && *file.Contents.Compression != "") {
+		return false
+	}
+	info, err := os.Lstat(file.Path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < deltaWriteMinSize {
+		return false
+	}
+	if f.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.opts.Timeout)
+		defer cancel()
+	}
+	sums, err := f.blockSums(ctx, *file.Contents.Source+deltaFetchSuffix)
+	if err != nil {
+		klog.V(2).Infof("Fetching %s for %q whole, no block sums: %v", *file.Contents.Source, file.Path, err)
+		return false
+	}
+	fetched, size, err := f.downloadDelta(ctx, file, sums, dest, mode, uid, gid)
+	if err != nil {
+		klog.Warningf("Failed to fetch the changes of %s for %q, fetching it whole: %v", *file.Contents.Source, file.Path, err)
+		return false
+	}
+	klog.Infof("Fetched %d of %d bytes of %s for %q", fetched, size, *file.Contents.Source, file.Path)
+	return true
+}
+
+// blockSums downloads and parses the block sums at url.
+func (f *remoteFetcher) blockSums(ctx context.Context, url string) ([][]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var sums [][]byte
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		sum, err := hex.DecodeString(strings.TrimSpace(scanner.Text()))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid block sum %q", scanner.Text())
+		}
+		sums = append(sums, sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sums) == 0 {
+		return nil, fmt.Errorf("no block sums")
+	}
+	return sums, nil
+}
+
+// downloadDelta writes the blocks of file.Path matching sums to dest, along
+// with the ranges of the other blocks downloaded from file's source, checking
+// every block against its sum and the result against file's verification
+// hash. It returns how much it downloaded of how much there is.
+func (f *remoteFetcher) downloadDelta(ctx context.Context, file ign3types.File, sums [][]byte, dest string, mode os.FileMode, uid, gid int) (int64, int64, error) {
+	local, err := os.Open(file.Path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer local.Close()
+
+	verifier, err := newContentVerifier(file.Path, file.Contents.Verification.Hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	var fetched, size int64
+	buf := make([]byte, deltaFetchBlockSize)
+	err = writeFileStreaming(dest, defaultDirectoryPermissions, mode, uid, gid, func(w io.Writer) error {
+		w = io.MultiWriter(w, verifier)
+		for i := 0; i < len(sums); {
+			n, err := local.ReadAt(buf, int64(i)*deltaFetchBlockSize)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if sum := sha256.Sum256(buf[:n]); n > 0 && bytes.Equal(sum[:], sums[i]) {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+				size += int64(n)
+				i++
+				continue
+			}
+			// Fetch the run of changed blocks starting here in one go
+			end := i + 1
+			for ; end < len(sums); end++ {
+				n, err := local.ReadAt(buf, int64(end)*deltaFetchBlockSize)
+				if err != nil && err != io.EOF {
+					return err
+				}
+				if sum := sha256.Sum256(buf[:n]); n > 0 && bytes.Equal(sum[:], sums[end]) {
+					break
+				}
+			}
+			n64, err := f.downloadBlocks(ctx, *file.Contents.Source, sums[i:end], int64(i)*deltaFetchBlockSize, w)
+			if err != nil {
+				return err
+			}
+			fetched += n64
+			size += n64
+			i = end
+		}
+		return verifier.verify()
+	})
+	return fetched, size, err
+}
+
+// downloadBlocks writes the blocks matching sums, starting at offset, of the
+// contents at url to w.
+func (f *remoteFetcher) downloadBlocks(ctx context.Context, url string, sums [][]byte, offset int64, w io.Writer) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(sums))*deltaFetchBlockSize-1))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status %s for range request", resp.Status)
+	}
+	var written int64
+	buf := make([]byte, deltaFetchBlockSize)
+	for i, sum := range sums {
+		n, err := io.ReadFull(resp.Body, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return written, err
+		}
+		// Only the last block of the contents may be short
+		if got := sha256.Sum256(buf[:n]); !bytes.Equal(got[:], sum) || (n < deltaFetchBlockSize && i != len(sums)-1) {
+			return written, fmt.Errorf("block at %d doesn't match its sum", offset+int64(i)*deltaFetchBlockSize)
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return written, err
+		}
+		written += int64(n)
+	}
+	return written, nil
+}
+
+// applyDeltaWrite writes the blocks of sf's file that changed in place, and
+// rewrites the file if it doesn't have the new contents after that.
+func applyDeltaWrite(sf stagedFile) error {
+	written, size, err := writeFileDelta(sf)
+	if err != nil {
+		klog.Warningf("Failed to update %q in place, rewriting it: %v", sf.path, err)
+		if err := writeFileStreaming(sf.path, defaultDirectoryPermissions, sf.mode, sf.uid, sf.gid, func(w io.Writer) error {
+			return writeFileContents(sf.delta.file, w)
+		}); err != nil {
+			return err
+		}
+	} else {
+		klog.Infof("Updated %q in place, writing %d of %d bytes", sf.path, written, size)
+	}
+	return setXattrs(sf.path, sf.xattrs)
+}
+
+// writeFileDelta writes the blocks of sf's file that changed in place and
+// checks the result, returning how much it wrote of how much there is.
+func writeFileDelta(sf stagedFile) (int64, int64, error) {
+	f, err := os.OpenFile(sf.path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	delta := &deltaWriter{f: f, buf: make([]byte, sparseBlockSize)}
+	w := bufio.NewWriterSize(delta, 16*sparseBlockSize)
+	if err := writeFileContents(sf.delta.file, w); err != nil {
+		return 0, 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if err := f.Truncate(delta.offset); err != nil {
+		return 0, 0, err
+	}
+	if err := f.Chmod(sf.mode); err != nil {
+		return 0, 0, err
+	}
+	if sf.uid != -1 && sf.gid != -1 {
+		if err := f.Chown(sf.uid, sf.gid); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(h.Sum(nil), sf.delta.sum) {
+		return 0, 0, fmt.Errorf("contents don't match after writing changes")
+	}
+	return delta.written, delta.offset, nil
+}
+
+// deltaWriter writes to a file in place, skipping the blocks that already
+// have the contents written.
+type deltaWriter struct {
+	f       *os.File
+	buf     []byte
+	offset  int64
+	written int64
+}
+
+func (w *deltaWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		block := p
+		if len(block) > sparseBlockSize {
+			block = block[:sparseBlockSize]
+		}
+		old := w.buf[:len(block)]
+		m, err := w.f.ReadAt(old, w.offset)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if m != len(block) || !bytes.Equal(old, block) {
+			if _, err := w.f.WriteAt(block, w.offset); err != nil {
+				return n, err
+			}
+			w.written += int64(len(block))
+		}
+		n += len(block)
+		w.offset += int64(len(block))
+		p = p[len(block):]
+	}
+	return n, nil
+}
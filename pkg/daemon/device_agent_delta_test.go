@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunOnceInDeviceAgentModeDeltaWrites(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+	d.deltaWrites = true
+
+	oldContents := []byte(strings.Repeat("0123456789abcdef", deltaWriteMinSize/16*2))
+	newContents := append([]byte{}, oldContents...)
+	copy(newContents[deltaWriteMinSize:], "changed")
+	newContents = append(newContents, "appended"...)
+
+	path := filepath.Join(testDir, "etc", "model.bin")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, path, string(oldContents))}, nil)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	before, err := os.Stat(path)
+	require.Nil(t, err)
+
+	// The file is updated in place, not replaced
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, path, string(newContents))}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	after, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.True(t, os.SameFile(before, after))
+	written, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(newContents, written))
+
+	// Shrinking works the same
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	written, err = os.ReadFile(path)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(oldContents, written))
+}
+
+func TestRunOnceInDeviceAgentModeDeltaFetch(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	oldContents := []byte(strings.Repeat("0123456789abcdef", deltaWriteMinSize/16*2))
+	newContents := append([]byte{}, oldContents...)
+	copy(newContents[deltaWriteMinSize:], "changed")
+	newContents = append(newContents, "appended"...)
+	var blockSums bytes.Buffer
+	for offset := 0; offset < len(newContents); offset += deltaFetchBlockSize {
+		end := offset + deltaFetchBlockSize
+		if end > len(newContents) {
+			end = len(newContents)
+		}
+		sum := sha256.Sum256(newContents[offset:end])
+		fmt.Fprintln(&blockSums, hex.EncodeToString(sum[:]))
+	}
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/model.bin"+deltaFetchSuffix {
+			w.Write(blockSums.Bytes())
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "model.bin", time.Time{}, bytes.NewReader(newContents))
+	}))
+	defer server.Close()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	d.deltaWrites = true
+	WithRemoteContentOptions(RemoteContentOptions{Retries: 1, RetryInterval: time.Millisecond})(d)
+
+	path := filepath.Join(testDir, "etc", "model.bin")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, path, string(oldContents))}, nil)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	// Only the changed blocks are downloaded
+	sum := sha256.Sum256(newContents)
+	remoteFile := newDeviceAgentTestFile(t, path, "")
+	remoteFile.Contents.Source = helpers.StrToPtr(server.URL + "/model.bin")
+	remoteFile.Contents.Verification.Hash = helpers.StrToPtr("sha256-" + hex.EncodeToString(sum[:]))
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{remoteFile}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	written, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(newContents, written))
+	assert.Equal(t, []string{
+		fmt.Sprintf("bytes=%d-%d", deltaWriteMinSize, deltaWriteMinSize+deltaFetchBlockSize-1),
+		fmt.Sprintf("bytes=%d-%d", 2*deltaWriteMinSize, 2*deltaWriteMinSize+deltaFetchBlockSize-1),
+	}, ranges)
+
+	// Contents not matching their block sums are fetched whole
+	blockSums.Reset()
+	blockSums.WriteString(strings.Repeat("0", 2*sha256.Size) + "\n")
+	ranges = nil
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	written, err = os.ReadFile(path)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(newContents, written))
+	assert.Equal(t, []string{"bytes=0-65535", ""}, ranges)
+}
+
+func TestDeltaWriter(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	require.Nil(t, err)
+	defer f.Close()
+	old := bytes.Repeat([]byte{'a'}, 3*sparseBlockSize)
+	_, err = f.Write(old)
+	require.Nil(t, err)
+
+	w := &deltaWriter{f: f, buf: make([]byte, sparseBlockSize)}
+	updated := append([]byte{}, old...)
+	updated[sparseBlockSize+1] = 'b'
+	_, err = w.Write(updated)
+	require.Nil(t, err)
+	assert.Equal(t, int64(sparseBlockSize), w.written)
+	assert.Equal(t, int64(len(updated)), w.offset)
+}
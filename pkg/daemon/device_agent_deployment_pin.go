@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// pinnedDeploymentPath records the ostree deployment kept pinned as rollback
+// target after an update in device agent mode staged OS changes.
+var pinnedDeploymentPath = "/etc/machine-config-daemon/pinned-deployment.json"
+
+// pinnedDeployment is the contents of pinnedDeploymentPath.
+type pinnedDeployment struct {
+	// Deployment is the ID of the deployment, as checksum.serial.
+	Deployment string `json:"deployment"`
+}
+
+// loadPinnedDeployment returns the deployment kept pinned, or nil.
+func loadPinnedDeployment() (*pinnedDeployment, error) {
+	b, err := os.ReadFile(pinnedDeploymentPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading pinned deployment: %w", err)
+	}
+	pinned := &pinnedDeployment{}
+	if err := json.Unmarshal(b, pinned); err != nil {
+		return nil, fmt.Errorf("parsing pinned deployment: %w", err)
+	}
+	return pinned, nil
+}
+
+// userPinnedBootedDeployment returns the ID of the booted deployment if it is
+// pinned other than by an earlier update keeping it as rollback target, e.g.
+// with ostree admin pin by the user, or "".
+func userPinnedBootedDeployment() (string, error) {
+	out, err := runGetOut("ostree", "admin", "status")
+	if err != nil {
+		return "", fmt.Errorf("querying deployments: %w", err)
+	}
+	for _, d := range parseOstreeDeployments(string(out)) {
+		if !d.Booted || !d.Pinned {
+			continue
+		}
+		pinned, err := loadPinnedDeployment()
+		if err != nil {
+			return "", err
+		}
+		if pinned != nil && pinned.Deployment == d.ID {
+			return "", nil
+		}
+		return d.ID, nil
+	}
+	return "", nil
+}
+
+// releaseSnapshotPin unpins the deployment pinned by snap, unless the update
+// staged OS changes, which keeps it pinned in place of the one an earlier
+// update kept, or an earlier update keeps it pinned already. Deployments the
+// user pinned are left pinned, and not recorded as kept by the daemon.
+func (dn *Daemon) releaseSnapshotPin(snap *updateSnapshot) error {
+	pinned, err := loadPinnedDeployment()
+	if err != nil {
+		return err
+	}
+	switch {
+	case snap.PinnedByUser && snap.KeepPinned && pinned != nil:
+		// The user's pin keeps the rollback target, the earlier one is no
+		// longer needed
+		if err := dn.UnpinPreviousDeployment(); err != nil {
+			return err
+		}
+		logSystem("Deployment %s is kept as rollback target by its own pin", snap.PinnedDeploymentID)
+		return nil
+	case snap.PinnedByUser:
+		return nil
+	case snap.KeepPinned:
+		if pinned != nil && pinned.Deployment != snap.PinnedDeploymentID {
+			if err := dn.unpinOstreeDeployment(pinned.Deployment); err != nil {
+				return err
+			}
+		}
+		b, err := json.Marshal(pinnedDeployment{Deployment: snap.PinnedDeploymentID})
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(pinnedDeploymentPath), 0o755); err != nil {
+			return err
+		}
+		if err := writeFileAtomicallyWithDefaults(pinnedDeploymentPath, b); err != nil {
+			return fmt.Errorf("writing pinned deployment: %w", err)
+		}
+		logSystem("Keeping deployment %s pinned as rollback target", snap.PinnedDeploymentID)
+		return nil
+	case pinned != nil && pinned.Deployment == snap.PinnedDeploymentID:
+		return nil
+	case snap.PinnedDeploymentID == "":
+		// Snapshots taken before deployment IDs were recorded
+		_, err := dn.pinBootedDeployment(false)
+		return err
+	}
+	return dn.unpinOstreeDeployment(snap.PinnedDeploymentID)
+}
+
+// UnpinPreviousDeployment releases the deployment that was kept pinned as
+// rollback target when an update in device agent mode staged OS changes, e.g.
+// once the new deployment has booted and its health was confirmed. It does
+// nothing if no deployment is kept pinned.
+func (dn *Daemon) UnpinPreviousDeployment() error {
+	pinned, err := loadPinnedDeployment()
+	if err != nil || pinned == nil {
+		return err
+	}
+	if err := dn.unpinOstreeDeployment(pinned.Deployment); err != nil {
+		return err
+	}
+	if err := os.Remove(pinnedDeploymentPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing pinned deployment: %w", err)
+	}
+	logSystem("Unpinned previous deployment %s", pinned.Deployment)
+	return nil
+}
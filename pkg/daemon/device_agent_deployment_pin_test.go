@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOstree puts an ostree in PATH that prints the file at the returned path
+// as admin status and logs its other commands, which the returned function
+// returns and clears.
+func fakeOstree(t *testing.T, testDir string) (string, func() string) {
+	binDir := filepath.Join(testDir, "bin")
+	ostreeLog := filepath.Join(testDir, "ostree.log")
+	ostreeStatus := filepath.Join(testDir, "ostree-status")
+	require.Nil(t, os.MkdirAll(binDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(binDir, "ostree"), []byte("#!/bin/sh\nif [ \"$2\" = status ]; then cat "+ostreeStatus+"; else echo \"$@\" >> "+ostreeLog+"; fi\n"), 0o755))
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	return ostreeStatus, func() string {
+		b, _ := os.ReadFile(ostreeLog)
+		os.Remove(ostreeLog)
+		return string(b)
+	}
+}
+
+func TestUnpinPreviousDeployment(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	ostreeStatus, ostreeCalls := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 9f2b44.0\n  fedora 77aa01.0 (rollback)\n"), 0o644))
+
+	d := newMockDeviceAgentDaemon(testDir)
+	d.bootc = &BootcClient{
+		run: func(context.Context, ...string) error { return nil },
+		output: func(...string) ([]byte, error) {
+			return []byte(`{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}}}}}`), nil
+		},
+	}
+
+	// Updates without OS changes only pin for their duration
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	filesConfig := newDeviceAgentTestConfig(t, "files", []ign3types.File{newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "pin"), "files")}, nil)
+	filesConfig.Spec.OSImageURL = oldConfig.Spec.OSImageURL
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, filesConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Empty(t, result.PinnedDeployment)
+	assert.Equal(t, "admin pin 0\nadmin pin --unpin 0\n", ostreeCalls())
+
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), filesConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, "9f2b44.0", result.PinnedDeployment)
+	assert.NotContains(t, ostreeCalls(), "--unpin")
+
+	// After the reboot, the pinned deployment is the rollback one
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 3c1e5a.0\n  fedora 9f2b44.0 (rollback)\n"), 0o644))
+	require.Nil(t, d.UnpinPreviousDeployment())
+	assert.Equal(t, "admin pin --unpin 1\n", ostreeCalls())
+	assert.NoFileExists(t, pinnedDeploymentPath)
+	require.Nil(t, d.UnpinPreviousDeployment())
+	assert.Empty(t, ostreeCalls())
+
+	// Deployments the user pinned stay pinned, and aren't recorded as kept
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 3c1e5a.0\n    Pinned: yes\n  fedora 9f2b44.0 (rollback)\n"), 0o644))
+	newerConfig := newDeviceAgentTestConfig(t, "newer", []ign3types.File{newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "pin"), "newer")}, nil)
+	newerConfig.Spec.OSImageURL = newConfig.Spec.OSImageURL
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newerConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Empty(t, ostreeCalls())
+	newestConfig := newDeviceAgentTestConfig(t, "newest", nil, nil)
+	newestConfig.Spec.OSImageURL = "quay.io/example/os:3"
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), newerConfig, newestConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, "3c1e5a.0", result.PinnedDeployment)
+	assert.Empty(t, ostreeCalls())
+	assert.NoFileExists(t, pinnedDeploymentPath)
+	require.Nil(t, d.UnpinPreviousDeployment())
+	assert.Empty(t, ostreeCalls())
+}
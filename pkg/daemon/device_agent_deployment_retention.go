@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// DeploymentRetentionPolicy bounds the previous ostree deployments kept after
+// updates in device agent mode, so small disks don't fill up /sysroot. The
+// booted, staged and pinned deployments are never removed.
+type DeploymentRetentionPolicy struct {
+	// KeepPrevious is how many deployments booted before the booted one are
+	// kept. Pinned ones count towards it.
+	KeepPrevious int
+	// MinFreeBytes is the free space /sysroot should have. Kept previous
+	// deployments are removed, oldest first, until it has.
+	MinFreeBytes uint64
+}
+
+// WithDeploymentRetention makes successful updates in device agent mode remove
+// the previous deployments policy doesn't keep.
+func WithDeploymentRetention(policy DeploymentRetentionPolicy) Option {
+	return func(dn *Daemon) {
+		dn.deploymentRetention = &policy
+	}
+}
+
+// sysrootPath is the filesystem the deployments are on.
+var sysrootPath = "/sysroot"
+
+// sysrootFreeSpace is overridden by tests to report the free space of
+// /sysroot.
+var sysrootFreeSpace = func() (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(sysrootPath, &st); err != nil {
+		return 0, fmt.Errorf("checking free space of %s: %w", sysrootPath, err)
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// enforceDeploymentRetention removes the previous deployments policy doesn't
+// keep and returns their IDs.
+func (dn *Daemon) enforceDeploymentRetention(policy DeploymentRetentionPolicy) ([]string, error) {
+	out, err := runGetOut("ostree", "admin", "status")
+	if err != nil {
+		return nil, fmt.Errorf("querying deployments: %w", err)
+	}
+	deployments := parseOstreeDeployments(string(out))
+
+	// Previous deployments follow the booted one, oldest last
+	var previous []int
+	for i := len(deployments) - 1; i >= 0 && !deployments[i].Booted; i-- {
+		if !deployments[i].Staged {
+			previous = append(previous, i)
+		}
+	}
+	excess := len(previous) - policy.KeepPrevious
+
+	var removed []string
+	for _, idx := range previous {
+		if deployments[idx].Pinned {
+			continue
+		}
+		if excess <= 0 {
+			if policy.MinFreeBytes == 0 {
+				break
+			}
+			free, err := sysrootFreeSpace()
+			if err != nil {
+				return removed, err
+			}
+			if free >= policy.MinFreeBytes {
+				break
+			}
+			logSystem("Only %d bytes free on %s, removing kept deployment %s", free, sysrootPath, deployments[idx].ID)
+		}
+		// Removing the oldest first keeps the indexes of the others
+		if err := runCmdSync("ostree", "admin", "undeploy", strconv.Itoa(idx)); err != nil {
+			return removed, fmt.Errorf("removing deployment %s: %w", deployments[idx].ID, err)
+		}
+		removed = append(removed, deployments[idx].ID)
+		excess--
+	}
+	if len(removed) > 0 {
+		logSystem("Removed previous deployments %v", removed)
+	}
+	return removed, nil
+}
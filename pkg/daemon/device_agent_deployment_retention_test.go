@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeploymentRetention(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	ostreeStatus, ostreeCalls := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte(`  fedora 5d0c11.0 (staged)
+* fedora 3c1e5a.0
+    Version: 4
+  fedora 9f2b44.0 (rollback)
+    Version: 3
+  fedora 77aa01.0
+    Version: 2
+    Pinned: yes
+  fedora 1b2c3d.0
+    Version: 1
+`), 0o644))
+	free := uint64(0)
+	oldSysrootFreeSpace := sysrootFreeSpace
+	sysrootFreeSpace = func() (uint64, error) { return free, nil }
+	defer func() { sysrootFreeSpace = oldSysrootFreeSpace }()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	removed, err := d.enforceDeploymentRetention(DeploymentRetentionPolicy{KeepPrevious: 3})
+	require.Nil(t, err)
+	assert.Empty(t, removed)
+
+	// The pinned deployment counts towards the kept ones
+	removed, err = d.enforceDeploymentRetention(DeploymentRetentionPolicy{KeepPrevious: 2})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1b2c3d.0"}, removed)
+	assert.Equal(t, "admin undeploy 4\n", ostreeCalls())
+
+	// Kept deployments are removed for free space, but never pinned ones
+	free = 10
+	removed, err = d.enforceDeploymentRetention(DeploymentRetentionPolicy{KeepPrevious: 3, MinFreeBytes: 100})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1b2c3d.0", "9f2b44.0"}, removed)
+	assert.Equal(t, "admin undeploy 4\nadmin undeploy 2\n", ostreeCalls())
+	free = 100
+	removed, err = d.enforceDeploymentRetention(DeploymentRetentionPolicy{KeepPrevious: 3, MinFreeBytes: 100})
+	require.Nil(t, err)
+	assert.Empty(t, removed)
+}
@@ -0,0 +1,351 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"unicode/utf8"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/hexops/gotextdiff"
+	"github.com/hexops/gotextdiff/myers"
+	"github.com/hexops/gotextdiff/span"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// DiffReport returns a report of what an update from oldConfig to newConfig
+// changes, for display, e.g. in a fleet UI: the OS image, kernel arguments,
+// and unified diffs of the files, units and dropins that change, headed by
+// the changes to their modes, owners and states. Remote and binary contents
+// are reported as changed without a diff. The report is empty if nothing
+// changes.
+func DiffReport(oldConfig, newConfig *mcfgv1.MachineConfig) (string, error) {
+	oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+	if err != nil {
+		return "", fmt.Errorf("parsing old Ignition config failed with error: %w", err)
+	}
+	newIgn, err := ctrlcommon.ParseAndConvertConfig(newConfig.Spec.Config.Raw)
+	if err != nil {
+		return "", fmt.Errorf("parsing new Ignition config failed with error: %w", err)
+	}
+
+	r := &diffReport{}
+	if oldConfig.Spec.OSImageURL != newConfig.Spec.OSImageURL {
+		r.section("osImageURL")
+		r.lines("-", oldConfig.Spec.OSImageURL)
+		r.lines("+", newConfig.Spec.OSImageURL)
+	}
+	if canonicalizeKernelType(oldConfig.Spec.KernelType) != canonicalizeKernelType(newConfig.Spec.KernelType) {
+		r.section("kernelType")
+		r.lines("-", canonicalizeKernelType(oldConfig.Spec.KernelType))
+		r.lines("+", canonicalizeKernelType(newConfig.Spec.KernelType))
+	}
+	if !kernelArgumentsEqual(oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments) {
+		oldKargs := parseKernelArguments(dedupeKernelArguments(oldConfig.Spec.KernelArguments))
+		newKargs := parseKernelArguments(dedupeKernelArguments(newConfig.Spec.KernelArguments))
+		r.section("kernelArguments")
+		r.lines("-", subtractKernelArguments(oldKargs, newKargs)...)
+		r.lines("+", subtractKernelArguments(newKargs, oldKargs)...)
+	}
+	if added, removed := subtractStrings(newConfig.Spec.Extensions, oldConfig.Spec.Extensions), subtractStrings(oldConfig.Spec.Extensions, newConfig.Spec.Extensions); len(added)+len(removed) > 0 {
+		r.section("extensions")
+		r.lines("-", removed...)
+		r.lines("+", added...)
+	}
+
+	if err := r.files(oldIgn.Storage.Files, newIgn.Storage.Files); err != nil {
+		return "", err
+	}
+	r.directories(oldIgn.Storage.Directories, newIgn.Storage.Directories)
+	r.links(oldIgn.Storage.Links, newIgn.Storage.Links)
+	r.units(oldIgn.Systemd.Units, newIgn.Systemd.Units)
+	return r.String(), nil
+}
+
+type diffReport struct {
+	bytes.Buffer
+}
+
+func (r *diffReport) section(format string, args ...interface{}) {
+	if r.Len() > 0 {
+		r.WriteString("\n")
+	}
+	fmt.Fprintf(r, "# "+format+"\n", args...)
+}
+
+func (r *diffReport) lines(prefix string, lines ...string) {
+	for _, l := range lines {
+		r.WriteString(prefix + l + "\n")
+	}
+}
+
+// change reports a change of what, if old and new differ.
+func (r *diffReport) change(what, old, new string) {
+	if old != new {
+		fmt.Fprintf(r, "%s: %s -> %s\n", what, old, new)
+	}
+}
+
+// contents writes the unified diff of the contents of the file at path.
+// Missing contents are those of /dev/null.
+func (r *diffReport) contents(path string, old, new []byte, oldExists, newExists bool) {
+	from, to := "a"+path, "b"+path
+	if !oldExists {
+		from = "/dev/null"
+	}
+	if !newExists {
+		to = "/dev/null"
+	}
+	if bytes.Equal(old, new) {
+		return
+	}
+	if !isText(old) || !isText(new) {
+		fmt.Fprintf(r, "binary contents differ: %d -> %d bytes\n", len(old), len(new))
+		return
+	}
+	edits := myers.ComputeEdits(span.URIFromPath(path), string(old), string(new))
+	fmt.Fprint(r, gotextdiff.ToUnified(from, to, string(old), edits))
+}
+
+func (r *diffReport) files(oldFiles, newFiles []ign3types.File) error {
+	oldByPath := map[string]ign3types.File{}
+	for _, f := range oldFiles {
+		oldByPath[f.Path] = f
+	}
+	newByPath := map[string]ign3types.File{}
+	for _, f := range newFiles {
+		newByPath[f.Path] = f
+	}
+	for _, path := range sortedPaths(oldByPath, newByPath) {
+		oldFile, oldExists := oldByPath[path]
+		newFile, newExists := newByPath[path]
+		if reflect.DeepEqual(oldFile, newFile) {
+			continue
+		}
+		switch {
+		case !oldExists:
+			r.section("file %s added", path)
+		case !newExists:
+			r.section("file %s removed", path)
+		default:
+			r.section("file %s", path)
+			r.change("mode", describeMode(oldFile.Mode), describeMode(newFile.Mode))
+			r.change("owner", describeOwner(oldFile.User, oldFile.Group), describeOwner(newFile.User, newFile.Group))
+		}
+		if isRemoteSource(oldFile.Contents.Source) || isRemoteSource(newFile.Contents.Source) {
+			r.change("contents", describeSource(oldFile.Contents.Source), describeSource(newFile.Contents.Source))
+			continue
+		}
+		var oldContents, newContents []byte
+		var err error
+		if oldExists {
+			if oldContents, err = decodeFileContents(oldFile); err != nil {
+				return fmt.Errorf("decoding old contents of %q: %w", path, err)
+			}
+		}
+		if newExists {
+			if newContents, err = decodeFileContents(newFile); err != nil {
+				return fmt.Errorf("decoding new contents of %q: %w", path, err)
+			}
+		}
+		r.contents(path, oldContents, newContents, oldExists, newExists)
+	}
+	return nil
+}
+
+func (r *diffReport) directories(oldDirs, newDirs []ign3types.Directory) {
+	oldByPath := map[string]ign3types.Directory{}
+	for _, d := range oldDirs {
+		oldByPath[d.Path] = d
+	}
+	newByPath := map[string]ign3types.Directory{}
+	for _, d := range newDirs {
+		newByPath[d.Path] = d
+	}
+	for _, path := range sortedPaths(oldByPath, newByPath) {
+		oldDir, oldExists := oldByPath[path]
+		newDir, newExists := newByPath[path]
+		switch {
+		case reflect.DeepEqual(oldDir, newDir):
+		case !oldExists:
+			r.section("directory %s added", path)
+		case !newExists:
+			r.section("directory %s removed", path)
+		default:
+			r.section("directory %s", path)
+			r.change("mode", describeMode(oldDir.Mode), describeMode(newDir.Mode))
+			r.change("owner", describeOwner(oldDir.User, oldDir.Group), describeOwner(newDir.User, newDir.Group))
+		}
+	}
+}
+
+func (r *diffReport) links(oldLinks, newLinks []ign3types.Link) {
+	oldByPath := map[string]ign3types.Link{}
+	for _, l := range oldLinks {
+		oldByPath[l.Path] = l
+	}
+	newByPath := map[string]ign3types.Link{}
+	for _, l := range newLinks {
+		newByPath[l.Path] = l
+	}
+	for _, path := range sortedPaths(oldByPath, newByPath) {
+		oldLink, oldExists := oldByPath[path]
+		newLink, newExists := newByPath[path]
+		switch {
+		case reflect.DeepEqual(oldLink, newLink):
+		case !oldExists:
+			r.section("link %s added", path)
+			r.lines("target: ", describeString(newLink.Target))
+		case !newExists:
+			r.section("link %s removed", path)
+		default:
+			r.section("link %s", path)
+			r.change("target", describeString(oldLink.Target), describeString(newLink.Target))
+			r.change("hard", fmt.Sprint(isTrue(oldLink.Hard)), fmt.Sprint(isTrue(newLink.Hard)))
+			r.change("owner", describeOwner(oldLink.User, oldLink.Group), describeOwner(newLink.User, newLink.Group))
+		}
+	}
+}
+
+func (r *diffReport) units(oldUnits, newUnits []ign3types.Unit) {
+	oldByName := map[string]ign3types.Unit{}
+	for _, u := range oldUnits {
+		oldByName[u.Name] = u
+	}
+	newByName := map[string]ign3types.Unit{}
+	for _, u := range newUnits {
+		newByName[u.Name] = u
+	}
+	for _, name := range sortedPaths(oldByName, newByName) {
+		oldUnit, oldExists := oldByName[name]
+		newUnit, newExists := newByName[name]
+		if reflect.DeepEqual(oldUnit, newUnit) {
+			continue
+		}
+		switch {
+		case !oldExists:
+			r.section("unit %s added", name)
+		case !newExists:
+			r.section("unit %s removed", name)
+		default:
+			r.section("unit %s", name)
+		}
+		r.change("enabled", describeBool(oldUnit.Enabled), describeBool(newUnit.Enabled))
+		r.change("mask", fmt.Sprint(isTrue(oldUnit.Mask)), fmt.Sprint(isTrue(newUnit.Mask)))
+		r.contents(getIgn3SystemdUnitPath(pathSystemd, ign3types.Unit{Name: name}),
+			[]byte(describeString(oldUnit.Contents)), []byte(describeString(newUnit.Contents)),
+			oldUnit.Contents != nil, newUnit.Contents != nil)
+
+		oldDropins := map[string]ign3types.Dropin{}
+		for _, d := range oldUnit.Dropins {
+			oldDropins[d.Name] = d
+		}
+		newDropins := map[string]ign3types.Dropin{}
+		for _, d := range newUnit.Dropins {
+			newDropins[d.Name] = d
+		}
+		for _, dropin := range sortedPaths(oldDropins, newDropins) {
+			oldDropin, oldExists := oldDropins[dropin]
+			newDropin, newExists := newDropins[dropin]
+			r.contents(getIgn3SystemdDropinPath(pathSystemd, ign3types.Unit{Name: name}, ign3types.Dropin{Name: dropin}),
+				[]byte(describeString(oldDropin.Contents)), []byte(describeString(newDropin.Contents)),
+				oldExists && oldDropin.Contents != nil, newExists && newDropin.Contents != nil)
+		}
+	}
+}
+
+// sortedPaths returns the keys of old and new, sorted.
+func sortedPaths[T any](old, new map[string]T) []string {
+	paths := make([]string, 0, len(old)+len(new))
+	for p := range old {
+		paths = append(paths, p)
+	}
+	for p := range new {
+		if _, ok := old[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// subtractStrings returns the strings of a that aren't in b, in order.
+func subtractStrings(a, b []string) []string {
+	var out []string
+	for _, s := range a {
+		if !ctrlcommon.InSlice(s, b) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// subtractKernelArguments returns the arguments of a that aren't in b, in
+// order, as multisets: an argument twice in a and once in b is returned once.
+func subtractKernelArguments(a, b []string) []string {
+	counts := make(map[string]int, len(b))
+	for _, k := range b {
+		counts[k]++
+	}
+	var out []string
+	for _, k := range a {
+		if counts[k] > 0 {
+			counts[k]--
+			continue
+		}
+		out = append(out, k)
+	}
+	return out
+}
+
+// isText returns true if contents look like text rather than binary data.
+func isText(contents []byte) bool {
+	return utf8.Valid(contents) && !bytes.ContainsRune(contents, 0)
+}
+
+func describeMode(mode *int) string {
+	if mode == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%04o", *mode)
+}
+
+func describeOwner(user ign3types.NodeUser, group ign3types.NodeGroup) string {
+	describe := func(name *string, id *int) string {
+		switch {
+		case name != nil && *name != "":
+			return *name
+		case id != nil:
+			return fmt.Sprint(*id)
+		default:
+			return "root"
+		}
+	}
+	return describe(user.Name, user.ID) + ":" + describe(group.Name, group.ID)
+}
+
+func describeSource(source *string) string {
+	if isRemoteSource(source) {
+		return *source
+	}
+	if source == nil {
+		return "empty"
+	}
+	return "inline"
+}
+
+func describeBool(b *bool) string {
+	if b == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*b)
+}
+
+func describeString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
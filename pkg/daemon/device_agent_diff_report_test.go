@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffReport(t *testing.T) {
+	mode := 0600
+	changed := ctrlcommon.NewIgnFile("/etc/changed", "a\nb\nc\n")
+	newChanged := ctrlcommon.NewIgnFile("/etc/changed", "a\nB\nc\n")
+	newChanged.Mode = &mode
+	binary := ctrlcommon.NewIgnFile("/etc/binary", "\x00\x01")
+	newBinary := ctrlcommon.NewIgnFile("/etc/binary", "\x00\x02\x03")
+	unitContents, newUnitContents := "[Unit]\nDescription=old\n", "[Unit]\nDescription=new\n"
+	enabled := true
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		changed, binary, ctrlcommon.NewIgnFile("/etc/removed", "gone\n"), ctrlcommon.NewIgnFile("/etc/same", "same\n"),
+	}, []ign3types.Unit{{Name: "a.service", Contents: &unitContents}})
+	oldConfig.Spec.OSImageURL = "quay.io/os:old"
+	oldConfig.Spec.KernelArguments = []string{"quiet", "nosmt"}
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newChanged, newBinary, ctrlcommon.NewIgnFile("/etc/added", "new\n"), ctrlcommon.NewIgnFile("/etc/same", "same\n"),
+	}, []ign3types.Unit{{Name: "a.service", Contents: &newUnitContents, Enabled: &enabled}})
+	newConfig.Spec.OSImageURL = "quay.io/os:new"
+	newConfig.Spec.KernelArguments = []string{"nosmt", "quiet", "nosmt", "debug"}
+
+	report, err := DiffReport(oldConfig, newConfig)
+	require.NoError(t, err)
+	assert.Equal(t, `# osImageURL
+-quay.io/os:old
++quay.io/os:new
+
+# kernelArguments
++debug
+
+# file /etc/added added
+--- /dev/null
++++ b/etc/added
+@@ -1 +1 @@
++new
+
+# file /etc/binary
+binary contents differ: 2 -> 3 bytes
+
+# file /etc/changed
+mode: 0644 -> 0600
+--- a/etc/changed
++++ b/etc/changed
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+
+# file /etc/removed removed
+--- a/etc/removed
++++ /dev/null
+@@ -1 +1 @@
+-gone
+
+# unit a.service
+enabled: unset -> true
+--- a/etc/systemd/system/a.service
++++ b/etc/systemd/system/a.service
+@@ -1,2 +1,2 @@
+ [Unit]
+-Description=old
++Description=new
+`, report)
+
+	report, err = DiffReport(oldConfig, oldConfig)
+	require.NoError(t, err)
+	assert.Empty(t, report)
+}
@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCode classifies why an update in device agent mode failed, so device
+// agents can decide per class whether to retry, roll back or report.
+type ErrorCode string
+
+const (
+	// ErrorCodeUnreconcilable means the new config can't be applied on top of
+	// the old one; retrying won't help.
+	ErrorCodeUnreconcilable ErrorCode = "Unreconcilable"
+	// ErrorCodeOSUpdateFailed means the OS image, kernel argument, kernel type
+	// or extension changes could not be applied.
+	ErrorCodeOSUpdateFailed ErrorCode = "OSUpdateFailed"
+	// ErrorCodeImageSignature means the OS image isn't signed as the image
+	// signature policy requires.
+	ErrorCodeImageSignature ErrorCode = "ImageSignatureRejected"
+	// ErrorCodeFileWrite means a file could not be written.
+	ErrorCodeFileWrite ErrorCode = "FileWriteFailed"
+	// ErrorCodeImmutableFile means a file to be written or removed has the
+	// immutable attribute set.
+	ErrorCodeImmutableFile ErrorCode = "ImmutableFile"
+	// ErrorCodeHashMismatch means the contents of a file didn't match its
+	// verification hash.
+	ErrorCodeHashMismatch ErrorCode = "HashMismatch"
+	// ErrorCodeUnitUnhealthy means a critical unit failed or didn't settle
+	// after the update restarted it.
+	ErrorCodeUnitUnhealthy ErrorCode = "UnitUnhealthy"
+	// ErrorCodeDrainTimeout means the node was not drained in time.
+	ErrorCodeDrainTimeout ErrorCode = "DrainTimeout"
+	// ErrorCodeCanceled means the update's context was canceled or timed out.
+	ErrorCodeCanceled ErrorCode = "Canceled"
+	// ErrorCodeUnknown is any other failure.
+	ErrorCodeUnknown ErrorCode = "Unknown"
+)
+
+// codedError is implemented by the typed errors of device agent mode.
+type codedError interface {
+	error
+	Code() ErrorCode
+}
+
+// ErrorCodeOf returns the ErrorCode of the first typed error in err's chain,
+// ErrorCodeCanceled for context errors, and ErrorCodeUnknown otherwise. It
+// returns "" for a nil err.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var coded codedError
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCodeCanceled
+	}
+	return ErrorCodeUnknown
+}
+
+// ErrUnreconcilable is returned if the new config can't be reconciled with
+// the old one.
+type ErrUnreconcilable struct {
+	Err error
+}
+
+func (e *ErrUnreconcilable) Error() string { return e.Err.Error() }
+
+func (e *ErrUnreconcilable) Unwrap() error { return e.Err }
+
+// Code implements codedError.
+func (e *ErrUnreconcilable) Code() ErrorCode { return ErrorCodeUnreconcilable }
+
+// ErrOSUpdateFailed is returned if the OS level changes could not be applied.
+type ErrOSUpdateFailed struct {
+	Err error
+}
+
+func (e *ErrOSUpdateFailed) Error() string { return e.Err.Error() }
+
+func (e *ErrOSUpdateFailed) Unwrap() error { return e.Err }
+
+// Code implements codedError.
+func (e *ErrOSUpdateFailed) Code() ErrorCode { return ErrorCodeOSUpdateFailed }
+
+// ErrImageSignature is returned if the OS Image isn't signed as the image
+// signature policy requires.
+type ErrImageSignature struct {
+	Image string
+	Err   error
+}
+
+func (e *ErrImageSignature) Error() string {
+	return fmt.Sprintf("signature of OS image %s not accepted: %v", e.Image, e.Err)
+}
+
+func (e *ErrImageSignature) Unwrap() error { return e.Err }
+
+// Code implements codedError.
+func (e *ErrImageSignature) Code() ErrorCode { return ErrorCodeImageSignature }
+
+// ErrFileWrite is returned if the file at Path could not be written.
+type ErrFileWrite struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrFileWrite) Error() string { return e.Err.Error() }
+
+func (e *ErrFileWrite) Unwrap() error { return e.Err }
+
+// Code implements codedError.
+func (e *ErrFileWrite) Code() ErrorCode { return ErrorCodeFileWrite }
+
+// ErrImmutableFile is returned if the file at Path has the immutable
+// attribute set and the UpdatePolicy doesn't allow clearing it.
+type ErrImmutableFile struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrImmutableFile) Error() string {
+	msg := fmt.Sprintf("%q has the immutable attribute set (chattr +i)", e.Path)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ErrImmutableFile) Unwrap() error { return e.Err }
+
+// Code implements codedError.
+func (e *ErrImmutableFile) Code() ErrorCode { return ErrorCodeImmutableFile }
+
+// ErrHashMismatch is returned if the contents of the file at Path don't match
+// its verification hash.
+type ErrHashMismatch struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrHashMismatch) Error() string {
+	return fmt.Sprintf("contents of %q don't match verification hash: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// Code implements codedError.
+func (e *ErrHashMismatch) Code() ErrorCode { return ErrorCodeHashMismatch }
+
+// ErrUnitUnhealthy is returned if critical Units failed or didn't settle
+// after being started or restarted, with the States they were last seen in
+// and the Journals excerpts of their restart, by unit.
+type ErrUnitUnhealthy struct {
+	Units    []string
+	States   map[string]string
+	Journals map[string]string
+}
+
+func (e *ErrUnitUnhealthy) Error() string {
+	var units []string
+	for _, name := range e.Units {
+		units = append(units, fmt.Sprintf("%s (%s)", name, unitStateDescription(e.States[name])))
+	}
+	return fmt.Sprintf("units not healthy after the update: %s", strings.Join(units, ", "))
+}
+
+// Code implements codedError.
+func (e *ErrUnitUnhealthy) Code() ErrorCode { return ErrorCodeUnitUnhealthy }
+
+// ErrDrainTimeout is returned if the node was not drained in time.
+type ErrDrainTimeout struct {
+	Err error
+}
+
+func (e *ErrDrainTimeout) Error() string { return e.Err.Error() }
+
+func (e *ErrDrainTimeout) Unwrap() error { return e.Err }
+
+// Code implements codedError.
+func (e *ErrDrainTimeout) Code() ErrorCode { return ErrorCodeDrainTimeout }
@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+
+	badIgn := ctrlcommon.NewIgnConfig()
+	badIgn.Storage.Disks = []ign3types.Disk{{Device: "/dev/sda"}}
+	unreconcilable := helpers.CreateMachineConfigFromIgnition(badIgn)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, unreconcilable, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.Equal(t, ErrorCodeUnreconcilable, ErrorCodeOf(err))
+
+	// The owner of badPath doesn't exist, so it can't be written
+	badPath := filepath.Join(testDir, "etc", "bad")
+	badFile := newDeviceAgentTestFile(t, badPath, "bad")
+	badFile.User = ign3types.NodeUser{Name: helpers.StrToPtr("no-such-user")}
+	badConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{badFile}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, badConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.Equal(t, ErrorCodeFileWrite, ErrorCodeOf(err))
+	var fileErr *ErrFileWrite
+	require.ErrorAs(t, err, &fileErr)
+	assert.Equal(t, badPath, fileErr.Path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	goodConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "good"), "good")}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(ctx, oldConfig, goodConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.Equal(t, ErrorCodeCanceled, ErrorCodeOf(err))
+
+	assert.Equal(t, ErrorCodeDrainTimeout, ErrorCodeOf(fmt.Errorf("draining: %w", &ErrDrainTimeout{Err: fmt.Errorf("timeout")})))
+	assert.Equal(t, ErrorCodeUnknown, ErrorCodeOf(fmt.Errorf("boom")))
+	assert.Equal(t, ErrorCode(""), ErrorCodeOf(nil))
+}
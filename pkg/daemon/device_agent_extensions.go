@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// WithExtensionsRepo makes updates in device agent mode on rpm-ostree hosts
+// resolve the extensions, and the packages of kernel types, against dir when
+// the config has no BaseOSExtensionsContainerImage, e.g. on devices without a
+// registry the extensions container could be pulled from. dir is either a
+// local rpm-md repository or the extracted content of an extensions
+// container.
+func WithExtensionsRepo(dir string) Option {
+	return func(dn *Daemon) {
+		dn.extensionsRepoDir = dir
+	}
+}
+
+// extensionsRepoConfig returns the yum repository configuration of the
+// extensions repository at baseurl.
+func extensionsRepoConfig(baseurl string) string {
+	return "[coreos-extensions]\nenabled=1\nmetadata_expire=1m\nbaseurl=" + baseurl + "\ngpgcheck=0\nskip_if_unavailable=False\n"
+}
+
+// localExtensionsRepoBaseURL returns the baseurl of the extensions repository
+// in dir.
+func localExtensionsRepoBaseURL(dir string) (string, error) {
+	// The content of an extensions container has the repository in there
+	containerRepo := filepath.Join(dir, "usr/share/rpm-ostree/extensions")
+	if info, err := os.Stat(containerRepo); err == nil && info.IsDir() {
+		dir = containerRepo
+	}
+	if _, err := os.Stat(filepath.Join(dir, "repodata", "repomd.xml")); err != nil {
+		return "", fmt.Errorf("no extensions repository found in %s: %w", dir, err)
+	}
+	return dir, nil
+}
+
+// addLocalExtensionsRepo adds the extensions repository in dir and returns a
+// function removing it again.
+func addLocalExtensionsRepo(dir string) (func(), error) {
+	baseurl, err := localExtensionsRepoBaseURL(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomicallyWithDefaults(extensionsRepo, []byte(extensionsRepoConfig(baseurl))); err != nil {
+		return nil, fmt.Errorf("adding extensions repository: %w", err)
+	}
+	return func() { os.Remove(extensionsRepo) }, nil
+}
+
+// layeredPackages returns the packages layered on the staged deployment, or
+// the booted one if none is staged.
+func (u rpmOstreeOSUpdater) layeredPackages() ([]string, error) {
+	booted, staged, err := u.dn.NodeUpdaterClient.GetBootedAndStagedDeployment()
+	if err != nil {
+		return nil, fmt.Errorf("querying deployments: %w", err)
+	}
+	deployment := booted
+	if staged != nil {
+		deployment = staged
+	}
+	packages := append([]string{}, deployment.RequestedPackages...)
+	sort.Strings(packages)
+	return packages, nil
+}
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/osrelease"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtensionsInAgentMode(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	// Extensions are resolved against a repository or extensions container
+	repo := filepath.Join(testDir, "repo")
+	require.Nil(t, os.MkdirAll(filepath.Join(repo, "repodata"), 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(repo, "repodata", "repomd.xml"), nil, 0o644))
+	baseurl, err := localExtensionsRepoBaseURL(repo)
+	require.Nil(t, err)
+	assert.Equal(t, repo, baseurl)
+	container := filepath.Join(testDir, "extensions")
+	require.Nil(t, os.MkdirAll(filepath.Join(container, "usr/share/rpm-ostree"), 0o755))
+	require.Nil(t, os.Rename(repo, filepath.Join(container, "usr/share/rpm-ostree/extensions")))
+	baseurl, err = localExtensionsRepoBaseURL(container)
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join(container, "usr/share/rpm-ostree/extensions"), baseurl)
+	_, err = localExtensionsRepoBaseURL(repo)
+	assert.Error(t, err)
+
+	d := newMockDeviceAgentDaemon(testDir)
+	d.os, err = osrelease.LoadOSRelease("ID=rhcos\nVERSION_ID=9.4\n", "")
+	require.Nil(t, err)
+	client := NewNodeUpdaterClient()
+	d.NodeUpdaterClient = &client
+
+	// Unsupported extensions are unreconcilable
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	newConfig.Spec.Extensions = []string{"usbguard", "games"}
+	_, err = d.PlanInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector)
+	var unreconcilable *ErrUnreconcilable
+	require.ErrorAs(t, err, &unreconcilable)
+	newConfig.Spec.Extensions = []string{"usbguard"}
+	result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"Installing extensions"}, result.OSChanges)
+
+	// The layered packages are those of the staged deployment
+	binDir := filepath.Join(testDir, "bin")
+	require.Nil(t, os.MkdirAll(binDir, 0o755))
+	status := filepath.Join(testDir, "rpm-ostree-status.json")
+	require.Nil(t, os.WriteFile(filepath.Join(binDir, "rpm-ostree"), []byte("#!/bin/sh\ncat "+status+"\n"), 0o755))
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	require.Nil(t, os.WriteFile(status, []byte(`{"deployments": [
+		{"staged": true, "requested-packages": ["usbguard", "krb5-workstation"]},
+		{"booted": true, "requested-packages": ["usbguard"]}
+	]}`), 0o644))
+	packages, err := rpmOstreeOSUpdater{d}.layeredPackages()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"krb5-workstation", "usbguard"}, packages)
+}
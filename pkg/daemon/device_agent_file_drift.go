@@ -0,0 +1,180 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// preservedFilesPath is where updates in device agent mode that apply files
+// record the drifted files they preserved.
+var preservedFilesPath = "/etc/machine-config-daemon/preserved-files.json"
+
+// DriftPolicy decides what updates in device agent mode do with files that
+// both configs have alike, but that were changed or removed on disk since the
+// old config was applied.
+type DriftPolicy string
+
+const (
+	// DriftRestore writes drifted files again, and runs the post config
+	// change actions as if the new config changed them. They are captured by
+	// the snapshot of the update, so rolling it back puts the drifted files
+	// back as they were rather than as the old config has them. Updates
+	// between content-identical configs aren't skipped while files drifted.
+	DriftRestore DriftPolicy = "Restore"
+	// DriftPreserve leaves drifted files as they are on disk, neither
+	// writing nor removing them. They are recorded at preservedFilesPath,
+	// and ValidateOnDiskStateInAgentMode doesn't report them as mismatches
+	// of the config that preserved them.
+	DriftPreserve DriftPolicy = "Preserve"
+)
+
+// WithDriftReconciliation makes updates in device agent mode diff the files
+// on disk against the old config first, and treat those that drifted as
+// policy says before applying the new config. Drifted files the new config
+// changes are written either way, after being backed up. Only the contents of
+// files are compared; see VerifyFileModes for their modes. Templated files
+// are compared with what the old config renders to now, so those rendered
+// with values that changed since have drifted too.
+func WithDriftReconciliation(policy DriftPolicy) Option {
+	return func(dn *Daemon) {
+		dn.driftPolicy = policy
+	}
+}
+
+// driftedFiles returns the files of oldIgnConfig that newIgnConfig has alike,
+// i.e. that aren't in diffFileSet, and whose contents on disk aren't those of
+// the configs, sorted. Files whose contents can't be told, i.e. remote ones
+// without a verification hash, haven't drifted, and neither have files whose
+// contents are still the same once normalized.
+func driftedFiles(oldIgnConfig, newIgnConfig ign3types.Config, diffFileSet []string, skipCertificateWrite bool) ([]string, error) {
+	newPaths := managedStoragePaths(newIgnConfig)
+	drifted := []string{}
+	for _, f := range oldIgnConfig.Storage.Files {
+		if _, ok := newPaths[f.Path]; !ok || ctrlcommon.InSlice(f.Path, diffFileSet) {
+			continue
+		}
+		if f.Path == caBundleFilePath && skipCertificateWrite {
+			continue
+		}
+		if _, err := os.Lstat(f.Path); errors.Is(err, fs.ErrNotExist) {
+			drifted = append(drifted, f.Path)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		matches, known, err := fileMatchesContents(f)
+		if err != nil {
+			return nil, err
+		}
+		if known && !matches && !fileContentsEquivalent(f) {
+			drifted = append(drifted, f.Path)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted, nil
+}
+
+// fileContentsEquivalent returns true if the contents of file on disk are
+// those of its inline contents once normalized; see
+// ctrlcommon.RegisterContentNormalizer.
+func fileContentsEquivalent(file ign3types.File) bool {
+	contents, err := decodeFileContents(file)
+	if err != nil {
+		return false
+	}
+	onDisk, err := os.ReadFile(file.Path)
+	if err != nil {
+		return false
+	}
+	return ctrlcommon.FileContentsEquivalent(file.Path, contents, onDisk)
+}
+
+// filesDrifted returns true if updates with selector restore drifted files
+// of config.
+func (dn *Daemon) filesDrifted(config *mcfgv1.MachineConfig, selector ApplySelector) bool {
+	if dn.driftPolicy != DriftRestore || !selector.Has(ApplyFiles) {
+		return false
+	}
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	if err != nil {
+		return false
+	}
+	if err := dn.renderFileTemplates(config, &ignConfig); err != nil {
+		klog.Warningf("Not reconciling drifted files: %v", err)
+		return false
+	}
+	drifted, err := driftedFiles(ignConfig, ignConfig, nil, !selector.Has(ApplyCertificates))
+	if err != nil {
+		klog.Warningf("Not reconciling drifted files: %v", err)
+		return false
+	}
+	return len(drifted) > 0
+}
+
+// preservedFiles are the drifted files an update preserved.
+type preservedFiles struct {
+	// ConfigName is the name of the MachineConfig the update applied.
+	ConfigName string   `json:"configName"`
+	Paths      []string `json:"paths"`
+}
+
+// writePreservedFiles records the files the update to configName preserved,
+// removing the record if there are none.
+func writePreservedFiles(configName string, paths []string) error {
+	if len(paths) == 0 {
+		if err := os.Remove(preservedFilesPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(preservedFiles{ConfigName: configName, Paths: paths}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(preservedFilesPath, b)
+}
+
+// preservedFilePaths returns the files the update to configName preserved, if
+// it is the last update that applied files.
+func preservedFilePaths(configName string) (sets.Set[string], error) {
+	b, err := os.ReadFile(preservedFilesPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return sets.New[string](), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading preserved files: %w", err)
+	}
+	record := preservedFiles{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, fmt.Errorf("parsing preserved files: %w", err)
+	}
+	if record.ConfigName != configName {
+		return sets.New[string](), nil
+	}
+	return sets.New(record.Paths...), nil
+}
+
+// withoutFiles returns ignConfig without the files at paths.
+func withoutFiles(ignConfig ign3types.Config, paths []string) ign3types.Config {
+	if len(paths) == 0 {
+		return ignConfig
+	}
+	files := make([]ign3types.File, 0, len(ignConfig.Storage.Files))
+	for _, f := range ignConfig.Storage.Files {
+		if !ctrlcommon.InSlice(f.Path, paths) {
+			files = append(files, f)
+		}
+	}
+	ignConfig.Storage.Files = files
+	return ignConfig
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestDriftReconciliation(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	editedPath := filepath.Join(testDir, "etc", "edited")
+	deletedPath := filepath.Join(testDir, "etc", "deleted")
+	addedPath := filepath.Join(testDir, "etc", "added")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		newDeviceAgentTestFile(t, editedPath, "edited"),
+		newDeviceAgentTestFile(t, deletedPath, "deleted"),
+	}, nil)
+	oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+	require.Nil(t, err)
+	newConfig := newDeviceAgentTestConfig(t, "new", append(oldIgn.Storage.Files, newDeviceAgentTestFile(t, addedPath, "added")), nil)
+	drift := func() {
+		require.Nil(t, d.writeFiles(context.TODO(), oldIgn.Storage.Files, nil, true))
+		require.Nil(t, os.WriteFile(editedPath, []byte("local"), 0o644))
+		require.Nil(t, os.Remove(deletedPath))
+	}
+
+	// By default, drift goes unnoticed
+	drift()
+	result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.Empty(t, result.FilesDrifted)
+	assert.Equal(t, []string{addedPath}, result.FilesWritten)
+
+	// Preserved files are left alone
+	WithDriftReconciliation(DriftPreserve)(d)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{deletedPath, editedPath}, result.FilesDrifted)
+	assert.Equal(t, []string{addedPath}, result.FilesWritten)
+	assert.Empty(t, result.FilesBackedUp)
+	contents, err := os.ReadFile(editedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "local", string(contents))
+	assert.NoFileExists(t, deletedPath)
+	assert.FileExists(t, addedPath)
+	// and aren't mismatches of the config that preserved them
+	validation, err := d.ValidateOnDiskStateInAgentMode(newConfig)
+	require.Nil(t, err)
+	assert.True(t, validation.Converged(), "%v", validation.Mismatches)
+	stateCheck, err := d.CheckStateInAgentMode()
+	require.Nil(t, err)
+	assert.Contains(t, stateCheck.Checked, preservedFilesPath)
+	assert.Empty(t, stateCheck.Quarantined)
+	preserved, err := preservedFilePaths("new")
+	require.Nil(t, err)
+	assert.Equal(t, []string{deletedPath, editedPath}, sets.List(preserved))
+
+	// Restored ones are written again, also by updates between
+	// content-identical configs
+	WithDriftReconciliation(DriftRestore)(d)
+	sameConfig := newConfig.DeepCopy()
+	sameConfig.Name = "same"
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, sameConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	assert.Equal(t, []string{deletedPath, editedPath}, result.FilesDrifted)
+	assert.ElementsMatch(t, []string{deletedPath, editedPath}, result.FilesWritten)
+	contents, err = os.ReadFile(editedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "edited", string(contents))
+	assert.FileExists(t, deletedPath)
+	assert.NoFileExists(t, preservedFilesPath)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), sameConfig, sameConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.NoOp)
+
+	// A failed update puts drifted files back as they were on disk
+	require.Nil(t, os.WriteFile(editedPath, []byte("local"), 0o644))
+	failingConfig := newDeviceAgentTestConfig(t, "failing", append(oldIgn.Storage.Files, newDeviceAgentTestFile(t, addedPath, "failing")), nil)
+	failingConfig.Annotations = map[string]string{MachineConfigFileHooksAnnotationKey: fmt.Sprintf(`{%q: {"postWrite": ["false"]}}`, addedPath)}
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), sameConfig, failingConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.NotNil(t, err)
+	contents, err = os.ReadFile(editedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "local", string(contents))
+}
+
+func TestDriftReconciliationTemplates(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	d.templateValuesPath = filepath.Join(testDir, "template-values")
+	require.Nil(t, os.WriteFile(d.templateValuesPath, []byte("site = berlin-1\n"), 0o644))
+
+	templatedPath := filepath.Join(testDir, "etc", "agent.conf")
+	config := newDeviceAgentTestConfig(t, "templated", []ign3types.File{
+		newDeviceAgentTestFile(t, templatedPath, "site={{ .Values.site }}"),
+	}, nil)
+	config.Annotations = map[string]string{MachineConfigFileTemplatesAnnotationKey: fmt.Sprintf("[%q]", templatedPath)}
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, config, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	// Templated files as rendered haven't drifted
+	WithDriftReconciliation(DriftRestore)(d)
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), config, config, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.NoOp)
+
+	// Edited ones have
+	require.Nil(t, os.WriteFile(templatedPath, []byte("local"), 0o644))
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), config, config, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	assert.Equal(t, []string{templatedPath}, result.FilesDrifted)
+	contents, err := os.ReadFile(templatedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "site=berlin-1", string(contents))
+
+	WithDriftReconciliation(DriftPreserve)(d)
+	require.Nil(t, os.WriteFile(templatedPath, []byte("local"), 0o644))
+	otherConfig := config.DeepCopy()
+	otherConfig.Name = "other"
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), config, otherConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{templatedPath}, result.FilesDrifted)
+	assert.Empty(t, result.FilesWritten)
+	contents, err = os.ReadFile(templatedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "local", string(contents))
+}
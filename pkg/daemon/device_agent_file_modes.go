@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"golang.org/x/sys/unix"
+	kubeErrs "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// FileModeFix is a correction of the mode or ownership of a managed file or
+// directory that had drifted from its MachineConfig.
+type FileModeFix struct {
+	Path string `json:"path"`
+	// Mode is the change of mode, e.g. "0600 -> 0644", if it had drifted.
+	Mode string `json:"mode,omitempty"`
+	// Owner is the change of ownership, e.g. "1000:1000 -> 0:0", if it had
+	// drifted.
+	Owner string `json:"owner,omitempty"`
+}
+
+// VerifyFileModes walks the files and directories of config and corrects
+// their mode and ownership where they drifted, without rewriting contents. A
+// nil config verifies the config last applied in device agent mode. Paths
+// that are missing or were replaced by another kind of node are left to the
+// next update. The fixes made are returned even if others failed.
+func (dn *Daemon) VerifyFileModes(config *mcfgv1.MachineConfig) ([]FileModeFix, error) {
+	if config == nil {
+		current, err := dn.CurrentConfigInAgentMode()
+		if err != nil || current == nil {
+			return nil, err
+		}
+		config = current
+	}
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Ignition for verifying file modes: %w", err)
+	}
+	xattrs, err := machineConfigFileXattrs(config, ignConfig.Storage.Files)
+	if err != nil {
+		return nil, err
+	}
+	return fixFileModes(ignConfig, xattrs)
+}
+
+// fixFileModes corrects the mode and ownership of the files and directories
+// of ignConfig. File capabilities and other xattrs are set again on files
+// whose ownership is corrected, as changing the owner drops some of them.
+func fixFileModes(ignConfig ign3types.Config, xattrs fileXattrs) ([]FileModeFix, error) {
+	owners := newOwnershipResolver(ignConfig.Storage.Files)
+	var fixes []FileModeFix
+	var errs []error
+	fix := func(node ign3types.Node, mode *int, defaultMode os.FileMode, fileType uint32, attrs map[string][]byte) {
+		expected := uint32(defaultMode)
+		if mode != nil {
+			expected = uint32(*mode)
+		}
+		f, err := fixNodeMode(owners, node, expected&0o7777, fileType, attrs)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if f != nil {
+			klog.Infof("Fixed drifted mode or ownership of %q: %+v", f.Path, *f)
+			fixes = append(fixes, *f)
+		}
+	}
+
+	for _, d := range ignConfig.Storage.Directories {
+		fix(d.Node, d.Mode, defaultDirectoryPermissions, unix.S_IFDIR, nil)
+	}
+	for _, f := range ignConfig.Storage.Files {
+		if f.Path == caBundleFilePath {
+			continue
+		}
+		fix(f.Node, f.Mode, defaultFilePermissions, unix.S_IFREG, xattrs[f.Path])
+	}
+	return fixes, kubeErrs.NewAggregate(errs)
+}
+
+// fixNodeMode gives the node at node.Path the raw mode and the ownership it
+// should have, if it is of fileType, and returns what it fixed.
+func fixNodeMode(owners *ownershipResolver, node ign3types.Node, mode, fileType uint32, xattrs map[string][]byte) (*FileModeFix, error) {
+	var stat unix.Stat_t
+	if err := unix.Lstat(node.Path, &stat); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("checking mode of %q: %w", node.Path, err)
+	}
+	if stat.Mode&unix.S_IFMT != fileType {
+		return nil, nil
+	}
+	uid, gid, err := owners.nodeOwnership(node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve ownership for %q: %w", node.Path, err)
+	}
+
+	fix := &FileModeFix{Path: node.Path}
+	if int(stat.Uid) != uid || int(stat.Gid) != gid {
+		if err := os.Lchown(node.Path, uid, gid); err != nil {
+			return nil, fmt.Errorf("failed to set ownership of %q: %w", node.Path, err)
+		}
+		fix.Owner = fmt.Sprintf("%d:%d -> %d:%d", stat.Uid, stat.Gid, uid, gid)
+		if err := setXattrs(node.Path, xattrs); err != nil {
+			return fix, err
+		}
+		// Changing the owner clears the setuid and setgid bits
+		if err := unix.Lstat(node.Path, &stat); err != nil {
+			return fix, fmt.Errorf("checking mode of %q: %w", node.Path, err)
+		}
+	}
+	if current := stat.Mode & 0o7777; current != mode {
+		if err := unix.Chmod(node.Path, mode); err != nil {
+			return fix, fmt.Errorf("failed to set mode of %q: %w", node.Path, err)
+		}
+		fix.Mode = fmt.Sprintf("%04o -> %04o", current, mode)
+	}
+	if fix.Mode == "" && fix.Owner == "" {
+		return nil, nil
+	}
+	return fix, nil
+}
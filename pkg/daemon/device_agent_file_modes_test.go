@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyFileModes(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+
+	path := filepath.Join(testDir, "etc", "agent.conf")
+	untouchedPath := filepath.Join(testDir, "etc", "untouched")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		newDeviceAgentTestFile(t, path, "old"),
+		newDeviceAgentTestFile(t, untouchedPath, "untouched"),
+	}, nil)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	// Standalone, against the current config
+	require.Nil(t, os.Chmod(path, 0o600))
+	fixes, err := d.VerifyFileModes(nil)
+	require.Nil(t, err)
+	assert.Equal(t, []FileModeFix{{Path: path, Mode: "0600 -> 0644"}}, fixes)
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+
+	// Nothing drifted, nothing fixed
+	fixes, err = d.VerifyFileModes(nil)
+	require.Nil(t, err)
+	assert.Empty(t, fixes)
+
+	// As the last phase of an update, after e.g. hooks that changed modes
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, path, "new"),
+		newDeviceAgentTestFile(t, untouchedPath, "untouched"),
+	}, nil)
+	newConfig.Annotations = map[string]string{
+		MachineConfigFileHooksAnnotationKey: fmt.Sprintf(`{%q: {"postWrite": ["chmod", "0600", %q]}}`, path, path),
+	}
+	policy := DefaultUpdatePolicy()
+	policy.VerifyFileModes = true
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, policy)
+	require.Nil(t, err)
+	assert.Equal(t, []FileModeFix{{Path: path, Mode: "0600 -> 0644"}}, result.FileModesFixed)
+
+	// Reapplying the same config only verifies modes
+	require.Nil(t, os.Chmod(untouchedPath, 0o640))
+	if os.Geteuid() == 0 {
+		require.Nil(t, os.Chown(untouchedPath, 1000, 1000))
+	}
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newConfig, deviceAgentTestSelector, policy)
+	require.Nil(t, err)
+	assert.True(t, result.NoOp)
+	require.Len(t, result.FileModesFixed, 1)
+	assert.Equal(t, untouchedPath, result.FileModesFixed[0].Path)
+	assert.Equal(t, "0640 -> 0644", result.FileModesFixed[0].Mode)
+	if os.Geteuid() == 0 {
+		assert.Equal(t, "1000:1000 -> 0:0", result.FileModesFixed[0].Owner)
+	}
+	info, err = os.Stat(untouchedPath)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+}
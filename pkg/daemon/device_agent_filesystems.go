@@ -0,0 +1,266 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// withoutFilesystems returns config without its filesystems section, which
+// device agent mode applies itself rather than treating it as unreconcilable.
+func withoutFilesystems(config *mcfgv1.MachineConfig) (*mcfgv1.MachineConfig, error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Ignition config failed: %w", err)
+	}
+	if len(ignConfig.Storage.Filesystems) == 0 {
+		return config, nil
+	}
+	ignConfig.Storage.Filesystems = nil
+	raw, err := json.Marshal(ignConfig)
+	if err != nil {
+		return nil, err
+	}
+	stripped := config.DeepCopy()
+	stripped.Spec.Config = runtime.RawExtension{Raw: raw}
+	return stripped, nil
+}
+
+// checkFilesystems returns an error for filesystems that device agent mode
+// won't create. Devices are only ever formatted if they are blank, so wiping
+// existing filesystems isn't supported, and neither is changing or dropping
+// the format of a filesystem that was already created.
+func checkFilesystems(oldFilesystems, newFilesystems []ign3types.Filesystem) error {
+	old := map[string]ign3types.Filesystem{}
+	for _, fs := range oldFilesystems {
+		old[fs.Device] = fs
+	}
+	for _, fs := range newFilesystems {
+		if fs.WipeFilesystem != nil && *fs.WipeFilesystem {
+			return fmt.Errorf("filesystem on %s sets wipeFilesystem, only blank devices are formatted", fs.Device)
+		}
+		if fs.Format == nil || *fs.Format == "" || *fs.Format == "none" {
+			return fmt.Errorf("filesystem on %s has no format", fs.Device)
+		}
+		if _, ok := mkfsArgs(fs); !ok {
+			return fmt.Errorf("filesystem on %s has unsupported format %q", fs.Device, *fs.Format)
+		}
+		if prev, ok := old[fs.Device]; ok && (!reflect.DeepEqual(prev.Format, fs.Format) || !reflect.DeepEqual(prev.Label, fs.Label) ||
+			!reflect.DeepEqual(prev.UUID, fs.UUID) || !reflect.DeepEqual(prev.Options, fs.Options)) {
+			return fmt.Errorf("filesystem on %s was changed, only where it is mounted can change", fs.Device)
+		}
+	}
+	return nil
+}
+
+// filesystemUnitPaths returns the paths of the mount units of filesystems.
+func filesystemUnitPaths(filesystems []ign3types.Filesystem) []string {
+	var paths []string
+	for _, fs := range filesystems {
+		if name, ok := filesystemMountUnit(fs); ok {
+			paths = append(paths, filepath.Join(pathSystemd, name))
+		}
+	}
+	return paths
+}
+
+// filesystemMountUnit returns the name of the mount unit for fs, if it is
+// mounted.
+func filesystemMountUnit(fs ign3types.Filesystem) (string, bool) {
+	if fs.Path == nil || *fs.Path == "" || fs.Format == nil || *fs.Format == "swap" {
+		return "", false
+	}
+	return unit.UnitNamePathEscape(filepath.Clean(*fs.Path)) + ".mount", true
+}
+
+// updateFilesystems formats the blank devices of the new filesystems and
+// writes and starts mount units for them, and stops and removes the mount
+// units of the filesystems that were dropped. Dropped filesystems aren't
+// wiped. Formatting a device can't be rolled back; a device found to have the
+// filesystem already is taken as formatted by an earlier attempt. It returns
+// the devices that were formatted.
+func updateFilesystems(oldFilesystems, newFilesystems []ign3types.Filesystem) ([]string, error) {
+	mounts := map[string]struct{}{}
+	for _, fs := range newFilesystems {
+		if name, ok := filesystemMountUnit(fs); ok {
+			mounts[name] = struct{}{}
+		}
+	}
+	for _, fs := range oldFilesystems {
+		name, ok := filesystemMountUnit(fs)
+		if _, kept := mounts[name]; !ok || kept {
+			continue
+		}
+		if err := runCmdSync("systemctl", "disable", "--now", name); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(filepath.Join(pathSystemd, name)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("removing mount unit %s: %w", name, err)
+		}
+		logSystem("Unmounted %s from %s, leaving its data in place", fs.Device, *fs.Path)
+	}
+
+	var formatted []string
+	for _, fs := range newFilesystems {
+		probe, err := probeDevice(fs.Device)
+		if err != nil {
+			return formatted, err
+		}
+		needsFormat, err := filesystemNeedsFormat(fs, probe)
+		if err != nil {
+			return formatted, err
+		}
+		if needsFormat {
+			args, _ := mkfsArgs(fs)
+			if err := runCmdSync(args[0], args[1:]...); err != nil {
+				return formatted, fmt.Errorf("formatting %s: %w", fs.Device, err)
+			}
+			logSystem("Formatted %s as %s", fs.Device, *fs.Format)
+			formatted = append(formatted, fs.Device)
+		}
+
+		name, ok := filesystemMountUnit(fs)
+		if !ok {
+			continue
+		}
+		if err := writeFileAtomicallyWithDefaults(filepath.Join(pathSystemd, name), []byte(filesystemMountUnitContents(fs))); err != nil {
+			return formatted, fmt.Errorf("writing mount unit %s: %w", name, err)
+		}
+		if err := runCmdSync("systemctl", "daemon-reload"); err != nil {
+			return formatted, err
+		}
+		if err := runCmdSync("systemctl", "enable", "--now", name); err != nil {
+			return formatted, fmt.Errorf("mounting %s on %s: %w", fs.Device, *fs.Path, err)
+		}
+	}
+	return formatted, nil
+}
+
+// probeDevice returns the signatures blkid finds on device, which are none if
+// it is blank.
+func probeDevice(device string) (map[string]string, error) {
+	out, err := exec.Command("blkid", "-p", "-o", "export", device).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("probing %s: %w", device, err)
+	}
+	return parseBlkidExport(out), nil
+}
+
+// parseBlkidExport parses the KEY=value lines of blkid -o export.
+func parseBlkidExport(out []byte) map[string]string {
+	probe := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), "="); ok {
+			probe[key] = value
+		}
+	}
+	return probe
+}
+
+// filesystemNeedsFormat returns true if the device of fs is blank, false if
+// it already has the filesystem, and an error if it has anything else.
+func filesystemNeedsFormat(fs ign3types.Filesystem, probe map[string]string) (bool, error) {
+	if len(probe) == 0 {
+		return true, nil
+	}
+	matches := probe["TYPE"] == *fs.Format &&
+		(fs.Label == nil || probe["LABEL"] == *fs.Label) &&
+		(fs.UUID == nil || strings.EqualFold(probe["UUID"], *fs.UUID))
+	if matches {
+		return false, nil
+	}
+	found := probe["TYPE"]
+	switch {
+	case found != "":
+	case probe["PTTYPE"] != "":
+		found = probe["PTTYPE"] + " partition table"
+	default:
+		found = "existing signatures"
+	}
+	return false, fmt.Errorf("refusing to format %s as %s: it is not blank, found %s", fs.Device, *fs.Format, found)
+}
+
+// mkfsArgs returns the command formatting the device of fs.
+func mkfsArgs(fs ign3types.Filesystem) ([]string, bool) {
+	var args []string
+	switch *fs.Format {
+	case "ext4", "xfs", "btrfs":
+		args = []string{"mkfs." + *fs.Format}
+		if fs.Label != nil {
+			args = append(args, "-L", *fs.Label)
+		}
+		if fs.UUID != nil {
+			if *fs.Format == "xfs" {
+				args = append(args, "-m", "uuid="+*fs.UUID)
+			} else {
+				args = append(args, "-U", *fs.UUID)
+			}
+		}
+	case "vfat":
+		args = []string{"mkfs.vfat"}
+		if fs.Label != nil {
+			args = append(args, "-n", *fs.Label)
+		}
+		if fs.UUID != nil {
+			args = append(args, "-i", strings.ReplaceAll(*fs.UUID, "-", ""))
+		}
+	case "swap":
+		args = []string{"mkswap"}
+		if fs.Label != nil {
+			args = append(args, "-L", *fs.Label)
+		}
+		if fs.UUID != nil {
+			args = append(args, "-U", *fs.UUID)
+		}
+	default:
+		return nil, false
+	}
+	for _, opt := range fs.Options {
+		args = append(args, string(opt))
+	}
+	return append(args, fs.Device), true
+}
+
+// filesystemMountUnitContents returns the mount unit mounting fs at its path
+// on every boot.
+func filesystemMountUnitContents(fs ign3types.Filesystem) string {
+	var options []string
+	for _, opt := range fs.MountOptions {
+		options = append(options, string(opt))
+	}
+	contents := fmt.Sprintf(`# Written by machine-config-daemon for the filesystems section of the config
+[Unit]
+Before=local-fs.target
+
+[Mount]
+What=%s
+Where=%s
+Type=%s
+`, fs.Device, filepath.Clean(*fs.Path), *fs.Format)
+	if len(options) > 0 {
+		contents += "Options=" + strings.Join(options, ",") + "\n"
+	}
+	return contents + `
+[Install]
+RequiredBy=local-fs.target
+`
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesystems(t *testing.T) {
+	data := ign3types.Filesystem{
+		Device:       "/dev/disk/by-id/data",
+		Format:       helpers.StrToPtr("xfs"),
+		Label:        helpers.StrToPtr("data"),
+		Path:         helpers.StrToPtr("/var/lib/data"),
+		MountOptions: []ign3types.MountOption{"noatime", "nodev"},
+	}
+	assert.Nil(t, checkFilesystems(nil, []ign3types.Filesystem{data}))
+	wipe := data
+	wipe.WipeFilesystem = helpers.BoolToPtr(true)
+	assert.NotNil(t, checkFilesystems(nil, []ign3types.Filesystem{wipe}))
+	reformat := data
+	reformat.Format = helpers.StrToPtr("ext4")
+	assert.NotNil(t, checkFilesystems([]ign3types.Filesystem{data}, []ign3types.Filesystem{reformat}))
+	remount := data
+	remount.Path = helpers.StrToPtr("/var/mnt/data")
+	assert.Nil(t, checkFilesystems([]ign3types.Filesystem{data}, []ign3types.Filesystem{remount}))
+
+	// Only blank devices get formatted
+	needsFormat, err := filesystemNeedsFormat(data, parseBlkidExport(nil))
+	require.Nil(t, err)
+	assert.True(t, needsFormat)
+	needsFormat, err = filesystemNeedsFormat(data, parseBlkidExport([]byte("DEVNAME=/dev/sdb\nLABEL=data\nTYPE=xfs\n")))
+	require.Nil(t, err)
+	assert.False(t, needsFormat)
+	_, err = filesystemNeedsFormat(data, parseBlkidExport([]byte("DEVNAME=/dev/sdb\nLABEL=other\nTYPE=xfs\n")))
+	assert.NotNil(t, err)
+	_, err = filesystemNeedsFormat(data, parseBlkidExport([]byte("DEVNAME=/dev/sdb\nPTTYPE=gpt\n")))
+	assert.ErrorContains(t, err, "gpt partition table")
+
+	args, ok := mkfsArgs(data)
+	require.True(t, ok)
+	assert.Equal(t, []string{"mkfs.xfs", "-L", "data", "/dev/disk/by-id/data"}, args)
+	name, ok := filesystemMountUnit(data)
+	require.True(t, ok)
+	assert.Equal(t, "var-lib-data.mount", name)
+	contents := filesystemMountUnitContents(data)
+	assert.Contains(t, contents, "What=/dev/disk/by-id/data\nWhere=/var/lib/data\nType=xfs\nOptions=noatime,nodev\n")
+
+	// The filesystems section doesn't make configs unreconcilable in device
+	// agent mode if it is applied
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(newConfig.Spec.Config.Raw)
+	require.Nil(t, err)
+	ignConfig.Storage.Filesystems = []ign3types.Filesystem{data}
+	newConfig.Spec.Config.Raw = helpers.MarshalOrDie(ignConfig)
+	result, err := d.PlanInDeviceAgentMode(nil, newConfig, deviceAgentTestSelector|ApplyFilesystems)
+	require.Nil(t, err)
+	assert.True(t, result.FilesystemsChanged)
+	var unreconcilable *ErrUnreconcilable
+	_, err = d.PlanInDeviceAgentMode(nil, newConfig, deviceAgentTestSelector)
+	assert.ErrorAs(t, err, &unreconcilable)
+	ignConfig.Storage.Filesystems = []ign3types.Filesystem{wipe}
+	newConfig.Spec.Config.Raw = helpers.MarshalOrDie(ignConfig)
+	_, err = d.PlanInDeviceAgentMode(nil, newConfig, deviceAgentTestSelector|ApplyFilesystems)
+	assert.ErrorAs(t, err, &unreconcilable)
+}
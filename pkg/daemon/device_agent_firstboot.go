@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// RunFirstbootCompleteMachineconfigFromFile is like
+// RunFirstbootCompleteMachineconfig, but completes the initial boot into the
+// MachineConfig at path, in JSON or YAML, rather than the one the MCS
+// encapsulated into the Ignition config. This lets device agents provide the
+// config of appliance images, which pivot fully offline if its osImageURL is a
+// local image, e.g. oci-archive:/usr/share/appliance/os.ociarchive. path is
+// removed, or renamed to path.bak if the host was updated, to signal
+// completion.
+func (dn *Daemon) RunFirstbootCompleteMachineconfigFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var mc mcfgv1.MachineConfig
+	if err := yaml.Unmarshal(data, &mc); err != nil {
+		return fmt.Errorf("failed to parse MachineConfig %s: %w", path, err)
+	}
+	if err := checkLocalOSImage(mc.Spec.OSImageURL); err != nil {
+		return err
+	}
+	return dn.completeFirstboot(&mc, path, path+".bak")
+}
@@ -0,0 +1,37 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirstbootFromFile(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+
+	path := filepath.Join(testDir, "appliance.yaml")
+	assert.Error(t, d.RunFirstbootCompleteMachineconfigFromFile(path))
+
+	// The local OS image is checked before the host is touched
+	require.Nil(t, os.WriteFile(path, []byte(`apiVersion: machineconfiguration.openshift.io/v1
+kind: MachineConfig
+metadata:
+  name: appliance
+spec:
+  osImageURL: oci-archive:`+filepath.Join(testDir, "os.ociarchive")+`
+`), 0o644))
+	err := d.RunFirstbootCompleteMachineconfigFromFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "os.ociarchive")
+	assert.FileExists(t, path)
+
+	require.Nil(t, os.WriteFile(path, []byte("spec: [}"), 0o644))
+	err = d.RunFirstbootCompleteMachineconfigFromFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse MachineConfig")
+}
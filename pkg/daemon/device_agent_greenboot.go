@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+var (
+	// greenbootCheckPath is the required greenboot health check written for
+	// updates that need a reboot. If it fails on the next boot, greenboot
+	// reboots and eventually rolls back to the previous deployment.
+	greenbootCheckPath = "/etc/greenboot/check/required.d/40-machine-config-daemon.sh"
+	// bootHealthPath records what the health check expects until the device
+	// agent confirms the boot.
+	bootHealthPath = "/etc/machine-config-daemon/boot-health.json"
+)
+
+// bootHealth is what a boot into an updated config is expected to look like.
+type bootHealth struct {
+	ConfigName    string   `json:"configName"`
+	ConfigHash    string   `json:"configHash"`
+	RequiredUnits []string `json:"requiredUnits,omitempty"`
+}
+
+// WithBootHealthCheck makes updates in device agent mode that require a reboot
+// install a greenboot health check. The check fails unless the updated config
+// is the current config on disk and all of requiredUnits are active. The
+// device agent commits the update with ConfirmBootInAgentMode once it is
+// satisfied with the boot.
+func WithBootHealthCheck(requiredUnits ...string) Option {
+	return func(dn *Daemon) {
+		dn.bootHealthCheck = true
+		dn.bootHealthRequiredUnits = requiredUnits
+	}
+}
+
+// bootHealthPaths returns the paths written by writeBootHealthCheck.
+func (dn *Daemon) bootHealthPaths() []string {
+	if !dn.bootHealthCheck {
+		return nil
+	}
+	return []string{greenbootCheckPath, bootHealthPath}
+}
+
+// writeBootHealthCheck installs the greenboot health check for the config
+// just stored on disk.
+func (dn *Daemon) writeBootHealthCheck(configName string) error {
+	hash, err := fileSHA256(dn.currentConfigPath)
+	if err != nil {
+		return err
+	}
+	health := bootHealth{
+		ConfigName:    configName,
+		ConfigHash:    hash,
+		RequiredUnits: dn.bootHealthRequiredUnits,
+	}
+
+	b, err := json.Marshal(health)
+	if err != nil {
+		return fmt.Errorf("marshalling boot health: %w", err)
+	}
+	if err := writeFileAtomicallyWithDefaults(bootHealthPath, b); err != nil {
+		return fmt.Errorf("writing boot health: %w", err)
+	}
+	if err := writeFileAtomically(greenbootCheckPath, []byte(greenbootCheckScript(dn.currentConfigPath, &health)), defaultDirectoryPermissions, 0o755, -1, -1); err != nil {
+		return fmt.Errorf("writing greenboot health check: %w", err)
+	}
+	logSystem("Installed boot health check for config %s", configName)
+	return nil
+}
+
+// greenbootCheckScript returns the health check script for health. Everything
+// interpolated into it is shell quoted, as unit names and paths come from the
+// device agent.
+func greenbootCheckScript(currentConfigPath string, health *bootHealth) string {
+	var sb strings.Builder
+	sb.WriteString("#!/bin/bash\n")
+	fmt.Fprintf(&sb, "# Written by machine-config-daemon, checks the boot into config %q.\n", health.ConfigName)
+	sb.WriteString("set -euo pipefail\n")
+	fmt.Fprintf(&sb, "echo %s | sha256sum --check --status\n", shellQuote(health.ConfigHash+"  "+currentConfigPath))
+	if len(health.RequiredUnits) > 0 {
+		units := make([]string, 0, len(health.RequiredUnits))
+		for _, unit := range health.RequiredUnits {
+			units = append(units, shellQuote(unit))
+		}
+		fmt.Fprintf(&sb, "systemctl is-active --quiet -- %s\n", strings.Join(units, " "))
+	}
+	return sb.String()
+}
+
+// shellQuote quotes s as a single word for bash.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ConfirmBootInAgentMode commits an update in device agent mode that required
+// a reboot, once the device agent is satisfied the system booted into it
+// healthy. It removes the greenboot health check so later boots aren't subject
+// to it. It returns an error without committing if the current config on disk
+// isn't the updated config, e.g. because greenboot rolled back. It is a no-op
+// if there is no update awaiting confirmation.
+func (dn *Daemon) ConfirmBootInAgentMode() error {
+	release, err := acquireUpdateLock()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	b, err := os.ReadFile(bootHealthPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading boot health: %w", err)
+	}
+	health := bootHealth{}
+	if err := json.Unmarshal(b, &health); err != nil {
+		return fmt.Errorf("parsing boot health: %w", err)
+	}
+
+	hash, err := fileSHA256(dn.currentConfigPath)
+	if err != nil {
+		return err
+	}
+	if hash != health.ConfigHash {
+		return fmt.Errorf("current config on disk does not match config %s awaiting confirmation", health.ConfigName)
+	}
+
+	for _, path := range []string{greenbootCheckPath, bootHealthPath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing %q: %w", path, err)
+		}
+	}
+	logSystem("Confirmed boot into config %s", health.ConfigName)
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %q: %w", path, err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
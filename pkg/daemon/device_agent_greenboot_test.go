@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootHealthCheck(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	WithBootHealthCheck("foo.service")(d)
+
+	// Nothing to confirm yet
+	require.Nil(t, d.ConfirmBootInAgentMode())
+
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "added"), "added"),
+	}, nil)
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.RebootRequired)
+	assert.True(t, result.AwaitingBootConfirmation)
+
+	hash, err := fileSHA256(d.currentConfigPath)
+	require.Nil(t, err)
+	script, err := os.ReadFile(greenbootCheckPath)
+	require.Nil(t, err)
+	assert.Contains(t, string(script), fmt.Sprintf("echo '%s  %s' | sha256sum --check --status", hash, d.currentConfigPath))
+	assert.Contains(t, string(script), "systemctl is-active --quiet -- 'foo.service'")
+
+	// Refuse to commit if we're not running the updated config
+	require.Nil(t, os.WriteFile(d.currentConfigPath, []byte("{}"), defaultFilePermissions))
+	assert.NotNil(t, d.ConfirmBootInAgentMode())
+	assert.FileExists(t, greenbootCheckPath)
+
+	require.Nil(t, d.storeCurrentConfigOnDisk(&onDiskConfig{currentConfig: newConfig}))
+	require.Nil(t, d.ConfirmBootInAgentMode())
+	assert.NoFileExists(t, greenbootCheckPath)
+	assert.NoFileExists(t, bootHealthPath)
+}
+
+func TestGreenbootCheckScriptQuoting(t *testing.T) {
+	units := []string{"foo'; touch /tmp/pwned; '.service", "$(reboot).service", "-bar.service"}
+	script := greenbootCheckScript("/etc/it's current", &bootHealth{
+		ConfigName:    "new\nreboot",
+		ConfigHash:    "abc",
+		RequiredUnits: units,
+	})
+	assert.Contains(t, script, `echo 'abc  /etc/it'\''s current' | sha256sum --check --status`)
+	assert.Contains(t, script, `# Written by machine-config-daemon, checks the boot into config "new\nreboot".`)
+
+	// The units reach systemctl as they are
+	line := script[strings.Index(script, "systemctl is-active --quiet -- "):]
+	out, err := exec.Command("bash", "-c", strings.Replace(line, "systemctl is-active --quiet --", `printf '%s\n'`, 1)).Output()
+	require.Nil(t, err)
+	assert.Equal(t, strings.Join(units, "\n")+"\n", string(out))
+}
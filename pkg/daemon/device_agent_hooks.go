@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+)
+
+// MachineConfigFileHooksAnnotationKey holds commands to run around writing
+// files of a MachineConfig in device agent mode, so changes can be applied
+// live, e.g. by reloading NetworkManager after writing a keyfile. It is a JSON
+// object mapping file paths to the commands to run before and after the file
+// is written, each given as its arguments:
+//
+//	{"/etc/NetworkManager/system-connections/eth0.nmconnection": {"postWrite": ["nmcli", "connection", "reload"]}}
+//
+// Hooks only run for files that change in an update. Commands shared by
+// several changed files run once. A failing hook fails the update.
+const MachineConfigFileHooksAnnotationKey = "machineconfiguration.openshift.io/file-hooks"
+
+// fileHook holds the commands to run around writing a file.
+type fileHook struct {
+	PreWrite  []string `json:"preWrite,omitempty"`
+	PostWrite []string `json:"postWrite,omitempty"`
+}
+
+// fileHooks maps file paths to their hooks.
+type fileHooks map[string]fileHook
+
+// machineConfigFileHooks returns the hooks mc's annotation asks for, checking
+// that each of them is for one of files.
+func machineConfigFileHooks(mc *mcfgv1.MachineConfig, files []ign3types.File) (fileHooks, error) {
+	encoded, ok := mc.GetAnnotations()[MachineConfigFileHooksAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	hooks := fileHooks{}
+	if err := json.Unmarshal([]byte(encoded), &hooks); err != nil {
+		return nil, fmt.Errorf("parsing %s annotation: %w", MachineConfigFileHooksAnnotationKey, err)
+	}
+
+	paths := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		paths[file.Path] = struct{}{}
+	}
+	for path, hook := range hooks {
+		if _, ok := paths[path]; !ok {
+			return nil, fmt.Errorf("hooks given for %q, which is not a file of MachineConfig %s", path, mc.GetName())
+		}
+		for _, cmd := range [][]string{hook.PreWrite, hook.PostWrite} {
+			if cmd != nil && (len(cmd) == 0 || cmd[0] == "") {
+				return nil, fmt.Errorf("empty hook command given for %q", path)
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// run runs the pre- or post-write hooks of the given written paths, in order
+// of the paths, running each distinct command only once.
+func (hooks fileHooks) run(ctx context.Context, written []string, post bool) error {
+	sorted := append([]string{}, written...)
+	sort.Strings(sorted)
+
+	seen := map[string]struct{}{}
+	for _, path := range sorted {
+		hook, ok := hooks[path]
+		if !ok {
+			continue
+		}
+		name, cmd := "pre-write", hook.PreWrite
+		if post {
+			name, cmd = "post-write", hook.PostWrite
+		}
+		if len(cmd) == 0 {
+			continue
+		}
+		key := strings.Join(cmd, "\x00")
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		if err := runCmdSyncContext(ctx, cmd[0], cmd[1:]...); err != nil {
+			return fmt.Errorf("%s hook of %q: %w", name, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunOnceInDeviceAgentModeFileHooks(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	logPath := filepath.Join(testDir, "hooks.log")
+	eth0Path := filepath.Join(testDir, "etc", "eth0.nmconnection")
+	eth1Path := filepath.Join(testDir, "etc", "eth1.nmconnection")
+	unchangedPath := filepath.Join(testDir, "etc", "unchanged")
+	logCmd := func(line string) []string {
+		return []string{"sh", "-c", fmt.Sprintf("echo %s >> %s", line, logPath)}
+	}
+	hooks := fileHooks{
+		// The pre-write hook still sees the old contents
+		eth0Path:      {PreWrite: []string{"sh", "-c", fmt.Sprintf("cat %s >> %s", eth0Path, logPath)}, PostWrite: logCmd("reload")},
+		eth1Path:      {PostWrite: logCmd("reload")},
+		unchangedPath: {PostWrite: logCmd("unchanged")},
+	}
+	b, err := json.Marshal(hooks)
+	require.Nil(t, err)
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		newDeviceAgentTestFile(t, eth0Path, "old"),
+		newDeviceAgentTestFile(t, unchangedPath, "unchanged"),
+	}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, eth0Path, "new"),
+		newDeviceAgentTestFile(t, eth1Path, "new"),
+		newDeviceAgentTestFile(t, unchangedPath, "unchanged"),
+	}, nil)
+	newConfig.Annotations = map[string]string{MachineConfigFileHooksAnnotationKey: string(b)}
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	// The shared reload runs once, and not at all for the unchanged file
+	contents, err := os.ReadFile(logPath)
+	require.Nil(t, err)
+	assert.Equal(t, "oldreload\n", string(contents))
+
+	// A failing hook fails the update, which is rolled back
+	failingConfig := newDeviceAgentTestConfig(t, "failing", []ign3types.File{newDeviceAgentTestFile(t, eth0Path, "failing")}, nil)
+	failingConfig.Annotations = map[string]string{MachineConfigFileHooksAnnotationKey: fmt.Sprintf(`{%q: {"postWrite": ["false"]}}`, eth0Path)}
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, failingConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.NotNil(t, err)
+	contents, err = os.ReadFile(eth0Path)
+	require.Nil(t, err)
+	assert.Equal(t, "new", string(contents))
+
+	// Hooks for paths that aren't files of the config are rejected
+	badConfig := newConfig.DeepCopy()
+	badConfig.Annotations[MachineConfigFileHooksAnnotationKey] = `{"/etc/other": {"postWrite": ["true"]}}`
+	_, err = d.PlanInDeviceAgentMode(newConfig, badConfig, deviceAgentTestSelector)
+	assert.NotNil(t, err)
+}
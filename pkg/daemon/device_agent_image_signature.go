@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ImageSignaturePolicy decides which signatures OS images must carry to be
+// rebased to in device agent mode.
+type ImageSignaturePolicy struct {
+	// PolicyPath is a containers-policy.json(5) file the images are checked
+	// against. Sigstore signatures are only found if the registries.d
+	// configuration of the host enables use-sigstore-attachments.
+	PolicyPath string
+	// CosignPublicKeyPath is a cosign public key the images must be signed
+	// with, as sigstore attachments in their registry. It is used if
+	// PolicyPath is empty.
+	CosignPublicKeyPath string
+}
+
+// WithImageSignaturePolicy makes updates in device agent mode verify the
+// signature of a changed OS image before anything is changed, and refuse the
+// update with ErrImageSignature if it isn't signed as policy requires.
+func WithImageSignaturePolicy(policy ImageSignaturePolicy) Option {
+	return func(dn *Daemon) {
+		dn.imageSignaturePolicy = &policy
+	}
+}
+
+// signaturePolicy returns the policy images are checked against.
+func (p ImageSignaturePolicy) signaturePolicy() (*signature.Policy, error) {
+	if p.PolicyPath != "" {
+		return signature.NewPolicyFromFile(p.PolicyPath)
+	}
+	if p.CosignPublicKeyPath == "" {
+		return nil, fmt.Errorf("neither a policy nor a cosign public key is configured")
+	}
+	req, err := signature.NewPRSigstoreSignedKeyPath(p.CosignPublicKeyPath, signature.NewPRMMatchRepoDigestOrExact())
+	if err != nil {
+		return nil, err
+	}
+	return &signature.Policy{Default: signature.PolicyRequirements{req}}, nil
+}
+
+// newOSImageSource is overridden by tests to check images without a
+// registry.
+var newOSImageSource = newDockerImageSource
+
+// signatureIdentity returns the image the signatures of imgURL, the OS image
+// the update of result pulls, are made out for: the image of the config rather
+// than the mirror of the OS image override file it is pulled from.
+func signatureIdentity(imgURL string, result *UpdateResult) (string, error) {
+	if result.OSImageOverride == nil {
+		return imgURL, nil
+	}
+	identity := result.OSImageOverride.ConfigOSImageURL
+	if result.OSImageManifest != nil {
+		return pinOSImage(identity, digest.Digest(result.OSImageManifest.Digest))
+	}
+	return identity, nil
+}
+
+// mirroredImageSource is the image source of a mirror, whose images are
+// checked against the policy as those of the image they mirror.
+type mirroredImageSource struct {
+	types.ImageSource
+	identity types.ImageReference
+}
+
+func (s *mirroredImageSource) Reference() types.ImageReference {
+	return s.identity
+}
+
+// verifyImageSignature returns ErrImageSignature if imgURL isn't signed as p
+// requires for identity, the image imgURL is or mirrors.
+func verifyImageSignature(ctx context.Context, imgURL, identity string, p ImageSignaturePolicy) error {
+	if isLocalOSImage(imgURL) {
+		return &ErrImageSignature{Image: imgURL, Err: fmt.Errorf("signatures of OS images not pulled from a registry can't be verified")}
+	}
+	policy, err := p.signaturePolicy()
+	if err != nil {
+		return fmt.Errorf("loading image signature policy: %w", err)
+	}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return fmt.Errorf("loading image signature policy: %w", err)
+	}
+	defer policyContext.Destroy()
+
+	sys := &types.SystemContext{AuthFilePath: ostreeAuthFile}
+	if p.PolicyPath == "" {
+		// The signatures of the key are looked up as sigstore attachments
+		dir, err := os.MkdirTemp("", "mcd-registries.d")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := os.WriteFile(filepath.Join(dir, "default.yaml"), []byte("default-docker:\n  use-sigstore-attachments: true\n"), 0o644); err != nil {
+			return err
+		}
+		sys.RegistriesDirPath = dir
+	}
+
+	src, err := newOSImageSource(ctx, sys, strings.TrimPrefix(imgURL, "docker://"))
+	if err != nil {
+		return fmt.Errorf("error parsing image name %q: %w", imgURL, err)
+	}
+	defer src.Close()
+	if identity != imgURL {
+		ref, err := docker.ParseReference("//" + strings.TrimPrefix(identity, "docker://"))
+		if err != nil {
+			return fmt.Errorf("error parsing image name %q: %w", identity, err)
+		}
+		src = &mirroredImageSource{ImageSource: src, identity: ref}
+	}
+	allowed, err := policyContext.IsRunningImageAllowed(ctx, image.UnparsedInstance(src, nil))
+	if !allowed {
+		if err == nil {
+			err = fmt.Errorf("rejected by policy")
+		}
+		return &ErrImageSignature{Image: imgURL, Err: err}
+	}
+	if identity != imgURL {
+		logSystem("Verified signature of OS image %s as %s", imgURL, identity)
+		return nil
+	}
+	logSystem("Verified signature of OS image %s", imgURL)
+	return nil
+}
@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeImageSource is an image without signatures.
+type fakeImageSource struct {
+	types.ImageSource
+	ref types.ImageReference
+}
+
+func (s *fakeImageSource) Reference() types.ImageReference { return s.ref }
+
+func (s *fakeImageSource) Close() error { return nil }
+
+func (s *fakeImageSource) GetManifest(context.Context, *digest.Digest) ([]byte, string, error) {
+	return []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", "size": 2}, "layers": []}`), "application/vnd.oci.image.manifest.v1+json", nil
+}
+
+func (s *fakeImageSource) GetSignatures(context.Context, *digest.Digest) ([][]byte, error) {
+	return nil, nil
+}
+
+func TestImageSignaturePolicy(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	origNewOSImageSource := newOSImageSource
+	defer func() { newOSImageSource = origNewOSImageSource }()
+	var opened []string
+	newOSImageSource = func(_ context.Context, _ *types.SystemContext, name string) (types.ImageSource, error) {
+		opened = append(opened, name)
+		ref, err := docker.ParseReference("//" + name)
+		if err != nil {
+			return nil, err
+		}
+		return &fakeImageSource{ref: ref}, nil
+	}
+
+	policyPath := filepath.Join(testDir, "policy.json")
+	writePolicy := func(requirement string) {
+		require.Nil(t, os.WriteFile(policyPath, []byte(`{"default": [{"type": "`+requirement+`"}]}`), 0o644))
+	}
+	writePolicy("insecureAcceptAnything")
+	require.Nil(t, verifyImageSignature(context.TODO(), "docker://quay.io/example/os:1", "docker://quay.io/example/os:1", ImageSignaturePolicy{PolicyPath: policyPath}))
+	assert.Equal(t, []string{"quay.io/example/os:1"}, opened)
+
+	writePolicy("reject")
+	err := verifyImageSignature(context.TODO(), "quay.io/example/os:1", "quay.io/example/os:1", ImageSignaturePolicy{PolicyPath: policyPath})
+	var sigErr *ErrImageSignature
+	require.ErrorAs(t, err, &sigErr)
+	assert.Equal(t, "quay.io/example/os:1", sigErr.Image)
+	assert.Equal(t, ErrorCodeImageSignature, ErrorCodeOf(err))
+
+	// Mirrored images are checked as the images they mirror
+	require.Nil(t, os.WriteFile(policyPath, []byte(`{"default": [{"type": "reject"}], "transports": {"docker": {"quay.io/example": [{"type": "insecureAcceptAnything"}]}}}`), 0o644))
+	opened = nil
+	require.Nil(t, verifyImageSignature(context.TODO(), "registry.local/example/os:1", "quay.io/example/os:1", ImageSignaturePolicy{PolicyPath: policyPath}))
+	assert.Equal(t, []string{"registry.local/example/os:1"}, opened)
+	require.ErrorAs(t, verifyImageSignature(context.TODO(), "registry.local/example/os:1", "registry.local/example/os:1", ImageSignaturePolicy{PolicyPath: policyPath}), &sigErr)
+	identity, err := signatureIdentity("registry.local/example/os@sha256:"+strings.Repeat("1", 64), &UpdateResult{
+		OSImageOverride: &OSImageOverride{ConfigOSImageURL: "quay.io/example/os:2", OSImageURL: "registry.local/example/os:2"},
+		OSImageManifest: &OSImageManifest{Digest: "sha256:" + strings.Repeat("1", 64)},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "quay.io/example/os@sha256:"+strings.Repeat("1", 64), identity)
+	writePolicy("reject")
+
+	// Unsigned images are refused if they must be signed with a cosign key
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	keyPath := filepath.Join(testDir, "cosign.pub")
+	require.Nil(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644))
+	err = verifyImageSignature(context.TODO(), "quay.io/example/os:1", "quay.io/example/os:1", ImageSignaturePolicy{CosignPublicKeyPath: keyPath})
+	require.ErrorAs(t, err, &sigErr)
+
+	// A refused image fails the update before anything is changed
+	d := newMockDeviceAgentDaemon(testDir)
+	WithImageSignaturePolicy(ImageSignaturePolicy{PolicyPath: policyPath})(d)
+	updater := &recordingOSUpdater{}
+	d.SetOSUpdater(updater)
+	filePath := filepath.Join(testDir, "etc", "signed")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, filePath, "old")}, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, filePath, "new")}, nil)
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.ErrorAs(t, err, &sigErr)
+	assert.Empty(t, updater.applied)
+	assert.NoFileExists(t, filePath)
+}
@@ -0,0 +1,137 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// ImmutableFilePolicy decides what happens to files the update writes or
+// removes that have the immutable attribute (chattr +i) set, which makes
+// writing them fail even for root.
+type ImmutableFilePolicy string
+
+const (
+	// ImmutableFilesFail fails the update with ErrImmutableFile before
+	// anything is changed.
+	ImmutableFilesFail ImmutableFilePolicy = "Fail"
+	// ImmutableFilesReapply clears the attribute for the update and sets it
+	// again afterwards, also if the update was rolled back. Files the update
+	// removed stay removed. Should the update be interrupted, the files are
+	// left without the attribute.
+	ImmutableFilesReapply ImmutableFilePolicy = "Reapply"
+)
+
+// fsImmutableFlag is FS_IMMUTABLE_FL of linux/fs.h.
+const fsImmutableFlag = 0x00000010
+
+// immutableFilePaths returns the paths the update may write or remove: those
+// of the snapshot and all files and units of the new config, which are
+// written again even if unchanged.
+func (dn *Daemon) immutableFilePaths(plan *deviceAgentPlan, skipCertificateWrite bool) []string {
+	paths := getFilePathsFromIgn3Config(plan.newIgnConfig, pathSystemd)
+	paths.Insert(dn.snapshotPaths(plan)...)
+	if skipCertificateWrite {
+		paths.Delete(caBundleFilePath)
+	}
+	return sets.List(paths)
+}
+
+// immutableFiles returns the regular files among paths that have the
+// immutable attribute set. Files on filesystems without attributes have none.
+func immutableFiles(paths []string) ([]string, error) {
+	var immutable []string
+	for _, path := range paths {
+		flags, err := fileAttributes(path)
+		if err != nil {
+			return immutable, err
+		}
+		if flags&fsImmutableFlag != 0 {
+			immutable = append(immutable, path)
+		}
+	}
+	return immutable, nil
+}
+
+// fileAttributes returns the inode flags of the regular file at path, or none
+// if it doesn't exist or isn't a regular file.
+func fileAttributes(path string) (uint32, error) {
+	if info, err := os.Lstat(path); os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return 0, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading attributes of %q: %w", path, err)
+	}
+	return flags, nil
+}
+
+// setImmutable sets or clears the immutable attribute of the file at path.
+func setImmutable(path string, immutable bool) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return fmt.Errorf("reading attributes of %q: %w", path, err)
+	}
+	if immutable {
+		flags |= fsImmutableFlag
+	} else {
+		flags &^= fsImmutableFlag
+	}
+	if err := unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags)); err != nil {
+		return fmt.Errorf("setting attributes of %q: %w", path, err)
+	}
+	return nil
+}
+
+// clearImmutable clears the immutable attribute of the files, returning the
+// ones it was cleared from.
+func clearImmutable(paths []string) ([]string, error) {
+	var cleared []string
+	for _, path := range paths {
+		if err := setImmutable(path, false); err != nil {
+			return cleared, err
+		}
+		klog.Infof("Cleared immutable attribute of %q for the update", path)
+		cleared = append(cleared, path)
+	}
+	return cleared, nil
+}
+
+// reapplyImmutable sets the immutable attribute of the files that still exist
+// again.
+func reapplyImmutable(paths []string) {
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err != nil {
+			continue
+		}
+		if err := setImmutable(path, true); err != nil {
+			klog.Warningf("Failed to set immutable attribute of %q again: %v", path, err)
+		}
+	}
+}
+
+// fileWriteError returns err of writing the file at path as ErrImmutableFile
+// if the file has the immutable attribute set, and as ErrFileWrite otherwise.
+func fileWriteError(path string, err error) error {
+	if flags, ferr := fileAttributes(path); ferr == nil && flags&fsImmutableFlag != 0 {
+		return &ErrImmutableFile{Path: path, Err: err}
+	}
+	return &ErrFileWrite{Path: path, Err: err}
+}
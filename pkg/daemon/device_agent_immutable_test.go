@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunOnceInDeviceAgentModeImmutableFiles(t *testing.T) {
+	for _, policy := range []ImmutableFilePolicy{"", ImmutableFilesFail, ImmutableFilesReapply} {
+		policy := policy
+		t.Run(string(policy), func(t *testing.T) {
+			testDir, cleanup := setupTempDirWithEtc(t)
+			defer cleanup()
+
+			d := newMockDeviceAgentDaemon(testDir)
+
+			path := filepath.Join(testDir, "etc", "locked")
+			oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, path, "old")}, nil)
+			_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+			require.Nil(t, err)
+			if err := setImmutable(path, true); err != nil {
+				t.Skipf("immutable attribute not supported: %v", err)
+			}
+			defer setImmutable(path, false)
+
+			newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, path, "new")}, nil)
+			updatePolicy := DefaultUpdatePolicy()
+			updatePolicy.ImmutableFiles = policy
+			result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, updatePolicy)
+
+			contents, rerr := os.ReadFile(path)
+			require.Nil(t, rerr)
+			immutable, ierr := immutableFiles([]string{path})
+			require.Nil(t, ierr)
+			assert.Equal(t, []string{path}, immutable)
+
+			if policy != ImmutableFilesReapply {
+				var immutableErr *ErrImmutableFile
+				require.ErrorAs(t, err, &immutableErr)
+				assert.Equal(t, path, immutableErr.Path)
+				assert.Equal(t, ErrorCodeImmutableFile, ErrorCodeOf(err))
+				assert.Equal(t, "old", string(contents))
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, []string{path}, result.ImmutableFiles)
+			assert.Equal(t, "new", string(contents))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// MachineConfigInitramfsArgsAnnotationKey makes updates in device agent mode
+// regenerate the initramfs on the host, with the dracut configuration of
+// /etc/dracut.conf.d and the dracut arguments of the annotation, as a JSON
+// array:
+//
+//	["--add-drivers=nvme_tcp"]
+//
+// e.g. for storage drivers needed at boot that the OS image doesn't include.
+// rpm-ostree hosts regenerate it with rpm-ostree initramfs, which keeps doing
+// so for later deployments. Hosts whose OS the daemon doesn't update run
+// dracut --force for the running kernel. The initramfs of bootc hosts is part
+// of their image. It is regenerated whenever the arguments or the dracut
+// configuration files of the config change, requiring a reboot, and updates to
+// a config without the annotation stop regenerating it.
+// MergeMachineConfigsInAgentMode concatenates the arguments of all configs in
+// order of their names.
+const MachineConfigInitramfsArgsAnnotationKey = "machineconfiguration.openshift.io/initramfs-args"
+
+// dracutConfigPaths are where dracut reads its configuration from.
+var dracutConfigPaths = []string{"/etc/dracut.conf", "/etc/dracut.conf.d/"}
+
+// machineConfigInitramfsArgs returns the arguments of mc's annotation, or nil
+// if mc doesn't have one.
+func machineConfigInitramfsArgs(mc *mcfgv1.MachineConfig) ([]string, error) {
+	encoded, ok := mc.GetAnnotations()[MachineConfigInitramfsArgsAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	args := []string{}
+	if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+		return nil, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigInitramfsArgsAnnotationKey, mc.GetName(), err)
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("invalid dracut argument %q in %s annotation of MachineConfig %s: must be an option", arg, MachineConfigInitramfsArgsAnnotationKey, mc.GetName())
+		}
+	}
+	return args, nil
+}
+
+// mergeInitramfsArgsAnnotations sets the initramfs arguments annotation of
+// merged to the arguments of configs, in order of their names.
+func mergeInitramfsArgsAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	var args []string
+	for _, config := range sorted {
+		fragment, err := machineConfigInitramfsArgs(config)
+		if err != nil {
+			return err
+		}
+		if fragment == nil {
+			continue
+		}
+		if args == nil {
+			args = []string{}
+		}
+		for _, arg := range fragment {
+			if !ctrlcommon.InSlice(arg, args) {
+				args = append(args, arg)
+			}
+		}
+	}
+	if args == nil {
+		return nil
+	}
+	return setJSONAnnotation(merged, MachineConfigInitramfsArgsAnnotationKey, args)
+}
+
+// isDracutConfig returns true if dracut reads its configuration from path.
+func isDracutConfig(path string) bool {
+	for _, p := range dracutConfigPaths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// initramfsChange is a regeneration of the initramfs.
+type initramfsChange struct {
+	// args are the dracut arguments, or nil to stop regenerating.
+	args []string
+}
+
+// planInitramfs returns how the initramfs is regenerated updating from
+// oldConfig to newConfig, which change diffFileSet, or nil if it isn't.
+func (dn *Daemon) planInitramfs(oldConfig, newConfig *mcfgv1.MachineConfig, diffFileSet []string) (*initramfsChange, error) {
+	oldArgs, err := machineConfigInitramfsArgs(oldConfig)
+	if err != nil {
+		return nil, err
+	}
+	newArgs, err := machineConfigInitramfsArgs(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	changed := !reflect.DeepEqual(oldArgs, newArgs)
+	if newArgs != nil {
+		for _, path := range diffFileSet {
+			changed = changed || isDracutConfig(path)
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	switch dn.getOSUpdater().(type) {
+	case rpmOstreeOSUpdater, noopOSUpdater:
+	case bootcOSUpdater:
+		return nil, fmt.Errorf("the initramfs of bootc hosts can't be regenerated, build it into the OS image instead")
+	default:
+		return nil, fmt.Errorf("the initramfs can't be regenerated on hosts whose OS is updated by %T", dn.getOSUpdater())
+	}
+	return &initramfsChange{args: newArgs}, nil
+}
+
+// regenerateInitramfs regenerates the initramfs as change says, for the next
+// boot.
+func (dn *Daemon) regenerateInitramfs(ctx context.Context, change initramfsChange) error {
+	if _, ok := dn.getOSUpdater().(rpmOstreeOSUpdater); ok {
+		args := []string{"initramfs", "--enable"}
+		if change.args == nil {
+			args = []string{"initramfs", "--disable"}
+		}
+		for _, arg := range change.args {
+			args = append(args, "--arg="+arg)
+		}
+		logSystem("Running rpm-ostree %v", args)
+		return runRpmOstreeContext(ctx, args...)
+	}
+	if change.args == nil {
+		// The initramfs of the next kernel update is generated without us
+		return nil
+	}
+	logSystem("Regenerating initramfs with dracut %v", change.args)
+	return runCmdSyncContext(ctx, "dracut", append([]string{"--force"}, change.args...)...)
+}
@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitramfsRegeneration(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	binDir := filepath.Join(testDir, "bin")
+	dracutLog := filepath.Join(testDir, "dracut.log")
+	require.Nil(t, os.MkdirAll(binDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(binDir, "dracut"), []byte("#!/bin/sh\necho \"$@\" >> "+dracutLog+"\n"), 0o755))
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	withArgs := func(mc *mcfgv1.MachineConfig, args string) *mcfgv1.MachineConfig {
+		mc.Annotations = map[string]string{MachineConfigInitramfsArgsAnnotationKey: args}
+		return mc
+	}
+	base := withArgs(newDeviceAgentTestConfig(t, "00-base", nil, nil), `["--add-drivers=nvme_tcp"]`)
+	site := withArgs(newDeviceAgentTestConfig(t, "10-site", nil, nil), `["--add-drivers=nvme_tcp", "--omit=plymouth"]`)
+	merged, err := MergeMachineConfigsInAgentMode("merged", []*mcfgv1.MachineConfig{site, base})
+	require.Nil(t, err)
+	assert.Equal(t, `["--add-drivers=nvme_tcp","--omit=plymouth"]`, merged.Annotations[MachineConfigInitramfsArgsAnnotationKey])
+
+	d := newMockDeviceAgentDaemon(testDir)
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	_, err = d.PlanInDeviceAgentMode(oldConfig, withArgs(newDeviceAgentTestConfig(t, "bad", nil, nil), `["nvme_tcp"]`), deviceAgentTestSelector)
+	assert.Equal(t, ErrorCodeUnreconcilable, ErrorCodeOf(err))
+
+	// Changed arguments regenerate the initramfs and require a reboot
+	result, err := d.PlanInDeviceAgentMode(oldConfig, base, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.True(t, result.InitramfsRegenerated)
+	assert.True(t, result.RebootRequired)
+	assert.Equal(t, "Regenerating initramfs", result.RebootReason)
+
+	// So do changed dracut configuration files, but nothing else does
+	dracutConfig := withArgs(newDeviceAgentTestConfig(t, "dracut", []ign3types.File{newDeviceAgentTestFile(t, "/etc/dracut.conf.d/50-nvme.conf", "hostonly=no\n")}, nil), `["--add-drivers=nvme_tcp"]`)
+	result, err = d.PlanInDeviceAgentMode(base, dracutConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.True(t, result.InitramfsRegenerated)
+	otherConfig := withArgs(newDeviceAgentTestConfig(t, "other", []ign3types.File{newDeviceAgentTestFile(t, "/etc/other.conf", "other\n")}, nil), `["--add-drivers=nvme_tcp"]`)
+	result, err = d.PlanInDeviceAgentMode(base, otherConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.False(t, result.InitramfsRegenerated)
+
+	// Hosts whose OS isn't updated run dracut
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, base, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.InitramfsRegenerated)
+	b, err := os.ReadFile(dracutLog)
+	require.Nil(t, err)
+	assert.Equal(t, "--force --add-drivers=nvme_tcp\n", string(b))
+
+	// bootc hosts get it from their image
+	d.bootc = &BootcClient{
+		run: func(context.Context, ...string) error { return nil },
+		output: func(...string) ([]byte, error) {
+			return []byte(`{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}}}}}`), nil
+		},
+	}
+	_, err = d.PlanInDeviceAgentMode(oldConfig, base, deviceAgentTestSelector)
+	assert.Equal(t, ErrorCodeUnreconcilable, ErrorCodeOf(err))
+}
@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+)
+
+// managedFilesPath is where the inventory of the files the daemon owns is
+// written after every update in device agent mode that applies files.
+var managedFilesPath = "/etc/machine-config-daemon/managed-files.json"
+
+// Types of ManagedFile
+const (
+	ManagedFileTypeFile      = "file"
+	ManagedFileTypeDirectory = "directory"
+	ManagedFileTypeLink      = "link"
+)
+
+// ManagedFileInventory lists the files, directories and links the daemon owns
+// as of the update that wrote it, so external tooling can tell managed from
+// unmanaged files without parsing Ignition.
+type ManagedFileInventory struct {
+	// ConfigName is the name of the MachineConfig the files belong to.
+	ConfigName string        `json:"configName"`
+	Files      []ManagedFile `json:"files"`
+}
+
+// ManagedFile is a file, directory or link owned by the daemon, as written by
+// the update. Systemd units and their dropins are listed as files.
+type ManagedFile struct {
+	Path string `json:"path"`
+	// Type is one of the ManagedFileType* constants.
+	Type string `json:"type"`
+	// Mode is the octal permission mode; links have none.
+	Mode string `json:"mode,omitempty"`
+	// Hash is the sha256 of the contents of files, as "sha256-<hex>".
+	Hash string `json:"hash,omitempty"`
+	// Target is what links point to.
+	Target string `json:"target,omitempty"`
+}
+
+// ManagedFilesInAgentMode returns the inventory written by the last update in
+// device agent mode that applied files, or nil if there is none.
+func (dn *Daemon) ManagedFilesInAgentMode() (*ManagedFileInventory, error) {
+	b, err := os.ReadFile(managedFilesPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading managed files inventory: %w", err)
+	}
+	inventory := &ManagedFileInventory{}
+	if err := json.Unmarshal(b, inventory); err != nil {
+		return nil, fmt.Errorf("parsing managed files inventory: %w", err)
+	}
+	return inventory, nil
+}
+
+// writeManagedFileInventory writes the inventory of what ignConfig put on
+// disk, as found there. Paths that don't exist, e.g. the CA bundle when it is
+// left alone, are left out.
+func writeManagedFileInventory(configName string, ignConfig ign3types.Config, systemdPath string) error {
+	inventory := ManagedFileInventory{ConfigName: configName, Files: []ManagedFile{}}
+	for path := range getFilePathsFromIgn3Config(ignConfig, systemdPath) {
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		inventory.Files = append(inventory.Files, ManagedFile{Path: path, Type: ManagedFileTypeFile, Mode: fmt.Sprintf("%04o", info.Mode().Perm()), Hash: hash})
+	}
+	for _, d := range ignConfig.Storage.Directories {
+		info, err := os.Lstat(d.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		inventory.Files = append(inventory.Files, ManagedFile{Path: d.Path, Type: ManagedFileTypeDirectory, Mode: fmt.Sprintf("%04o", info.Mode().Perm())})
+	}
+	for _, l := range ignConfig.Storage.Links {
+		if _, err := os.Lstat(l.Path); os.IsNotExist(err) {
+			continue
+		}
+		link := ManagedFile{Path: l.Path, Type: ManagedFileTypeLink}
+		if l.Target != nil {
+			link.Target = *l.Target
+		}
+		inventory.Files = append(inventory.Files, link)
+	}
+	sort.Slice(inventory.Files, func(i, j int) bool {
+		return inventory.Files[i].Path < inventory.Files[j].Path
+	})
+
+	b, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(managedFilesPath, b)
+}
+
+// hashFile returns the sha256 of the contents of the file at path, as
+// "sha256-<hex>".
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing %q: %w", path, err)
+	}
+	return "sha256-" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagedFileInventory(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+
+	inventory, err := d.ManagedFilesInAgentMode()
+	require.Nil(t, err)
+	assert.Nil(t, inventory)
+
+	path := filepath.Join(testDir, "etc", "agent.conf")
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, path, "agent"),
+	}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	inventory, err = d.ManagedFilesInAgentMode()
+	require.Nil(t, err)
+	require.NotNil(t, inventory)
+	assert.Equal(t, "new", inventory.ConfigName)
+	sum := sha256.Sum256([]byte("agent"))
+	assert.Equal(t, []ManagedFile{{Path: path, Type: ManagedFileTypeFile, Mode: "0644", Hash: "sha256-" + hex.EncodeToString(sum[:])}}, inventory.Files)
+
+	// Files left alone by the selector stay in the inventory
+	newerConfig := newDeviceAgentTestConfig(t, "newer", []ign3types.File{
+		newDeviceAgentTestFile(t, path, "agent2"),
+	}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newerConfig, deviceAgentTestSelector&^ApplyFiles, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	inventory, err = d.ManagedFilesInAgentMode()
+	require.Nil(t, err)
+	assert.Equal(t, "newer", inventory.ConfigName)
+	assert.Equal(t, []ManagedFile{{Path: path, Type: ManagedFileTypeFile, Mode: "0644", Hash: "sha256-" + hex.EncodeToString(sum[:])}}, inventory.Files)
+
+	// Directories and links are listed as well, sorted by path
+	dirPath := filepath.Join(testDir, "etc", "agent.d")
+	linkPath := filepath.Join(testDir, "etc", "agent.link")
+	require.Nil(t, os.Mkdir(dirPath, 0o750))
+	require.Nil(t, os.Symlink(path, linkPath))
+	require.Nil(t, writeManagedFileInventory("links", ign3types.Config{Storage: ign3types.Storage{
+		Directories: []ign3types.Directory{{Node: ign3types.Node{Path: dirPath}}},
+		Links: []ign3types.Link{
+			{Node: ign3types.Node{Path: linkPath}, LinkEmbedded1: ign3types.LinkEmbedded1{Target: helpers.StrToPtr(path)}},
+			{Node: ign3types.Node{Path: filepath.Join(testDir, "etc", "missing")}},
+		},
+	}}, pathSystemd))
+	inventory, err = d.ManagedFilesInAgentMode()
+	require.Nil(t, err)
+	assert.Equal(t, []ManagedFile{
+		{Path: dirPath, Type: ManagedFileTypeDirectory, Mode: "0750"},
+		{Path: linkPath, Type: ManagedFileTypeLink, Target: path},
+	}, inventory.Files)
+}
@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"k8s.io/klog/v2"
+)
+
+// WithKernelArgumentReconciliation makes updates in device agent mode on
+// rpm-ostree hosts diff the kernel arguments of the new config against those
+// the host runs, rather than those of the old config. Arguments of the configs
+// that were deleted out of band, e.g. with rpm-ostree kargs, are appended
+// again, and those the new config drops are only deleted if the host still has
+// them. Arguments neither config has are left alone. Updates between
+// content-identical configs are only skipped if the host has all arguments of
+// the config.
+func WithKernelArgumentReconciliation() Option {
+	return func(dn *Daemon) {
+		dn.reconcileKernelArguments = true
+	}
+}
+
+// reconcilesKernelArguments returns true if the kernel arguments of updates
+// with selector are diffed against the running ones.
+func (dn *Daemon) reconcilesKernelArguments(selector ApplySelector) bool {
+	_, ok := dn.getOSUpdater().(rpmOstreeOSUpdater)
+	return ok && dn.reconcileKernelArguments && selector.Has(ApplyKernelArguments)
+}
+
+// runningKernelArguments returns the kernel arguments of oldConfig and
+// newConfig that the host runs, and those of both configs it is missing.
+func (dn *Daemon) runningKernelArguments(oldConfig, newConfig *mcfgv1.MachineConfig) ([]string, []string, error) {
+	// As setRunningKargs, this includes changes staged for the next boot
+	out, err := runGetOut("rpm-ostree", "kargs")
+	if err != nil {
+		return nil, nil, fmt.Errorf("querying kernel arguments: %w", err)
+	}
+	cmdline := splitKernelArguments(strings.TrimSpace(string(out)))
+	oldKargs := parseKernelArguments(oldConfig.Spec.KernelArguments)
+	newKargs := parseKernelArguments(newConfig.Spec.KernelArguments)
+
+	var running, missing []string
+	for _, karg := range append(oldKargs, newKargs...) {
+		if ctrlcommon.InSlice(karg, running) || ctrlcommon.InSlice(karg, missing) {
+			continue
+		}
+		switch {
+		case ctrlcommon.InSlice(karg, cmdline):
+			running = append(running, karg)
+		case ctrlcommon.InSlice(karg, oldKargs) && ctrlcommon.InSlice(karg, newKargs):
+			missing = append(missing, karg)
+		}
+	}
+	return running, missing, nil
+}
+
+// reconcileRunningKernelArguments returns oldConfig with the running kernel
+// arguments, and whether they differ from those of newConfig. The arguments
+// the host is missing are set in result.KernelArgumentsRestored.
+func (dn *Daemon) reconcileRunningKernelArguments(oldConfig, newConfig *mcfgv1.MachineConfig, result *UpdateResult) (*mcfgv1.MachineConfig, bool, error) {
+	running, missing, err := dn.runningKernelArguments(oldConfig, newConfig)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(missing) > 0 {
+		logSystem("Kernel arguments %v of config %s were removed out of band, appending them again", missing, oldConfig.GetName())
+	}
+	result.KernelArgumentsRestored = missing
+	runningConfig := oldConfig.DeepCopy()
+	runningConfig.Spec.KernelArguments = running
+
+	wanted := parseKernelArguments(dedupeKernelArguments(newConfig.Spec.KernelArguments))
+	sort.Strings(wanted)
+	sorted := append([]string{}, running...)
+	sort.Strings(sorted)
+	return runningConfig, strings.Join(sorted, " ") != strings.Join(wanted, " "), nil
+}
+
+// kernelArgumentsDrifted returns true if the host is missing kernel arguments
+// of config that updates with selector reconcile.
+func (dn *Daemon) kernelArgumentsDrifted(config *mcfgv1.MachineConfig, selector ApplySelector) bool {
+	if !dn.reconcilesKernelArguments(selector) {
+		return false
+	}
+	_, missing, err := dn.runningKernelArguments(config, config)
+	if err != nil {
+		klog.Warningf("Not reconciling kernel arguments: %v", err)
+		return false
+	}
+	return len(missing) > 0
+}
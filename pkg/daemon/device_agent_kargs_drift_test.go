@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/osrelease"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelArgumentReconciliation(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	// b was deleted out of band
+	binDir := filepath.Join(testDir, "bin")
+	require.Nil(t, os.MkdirAll(binDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(binDir, "rpm-ostree"), []byte("#!/bin/sh\necho root=/dev/vda4 a=1 c\n"), 0o755))
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	d := newMockDeviceAgentDaemon(testDir)
+	var err error
+	d.os, err = osrelease.LoadOSRelease("ID=rhcos\nVERSION_ID=9.4\n", "")
+	require.Nil(t, err)
+	client := NewNodeUpdaterClient()
+	d.NodeUpdaterClient = &client
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.KernelArguments = []string{"a=1", "b c"}
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	newConfig.Spec.KernelArguments = []string{"a=1", "b", "d"}
+	sameConfig := newConfig.DeepCopy()
+	sameConfig.Name = "same"
+
+	// By default, only the configs are diffed
+	assert.False(t, d.kernelArgumentsDrifted(newConfig, deviceAgentTestSelector))
+	result, err := d.PlanInDeviceAgentMode(newConfig, sameConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.Empty(t, result.OSChanges)
+
+	WithKernelArgumentReconciliation()(d)
+	plan, err := d.planInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector, false)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"b"}, plan.result.KernelArgumentsRestored)
+	assert.Equal(t, []string{"Changing kernel arguments"}, plan.result.OSChanges)
+	assert.True(t, plan.result.RebootRequired)
+	assert.Equal(t, []string{"a=1", "c"}, plan.osOldConfig.Spec.KernelArguments)
+	assert.Equal(t, []string{"a=1", "b c"}, oldConfig.Spec.KernelArguments)
+	// Only the running arguments of the old config are deleted
+	assert.Equal(t, []string{"--delete=a=1", "--delete=c", "--append=a=1", "--append=b", "--append=d"}, generateKargs(plan.osOldConfig.Spec.KernelArguments, plan.osConfig.Spec.KernelArguments))
+
+	// Content-identical configs are applied again if arguments are missing
+	assert.True(t, d.kernelArgumentsDrifted(newConfig, deviceAgentTestSelector))
+	result, err = d.PlanInDeviceAgentMode(newConfig, sameConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"b", "d"}, result.KernelArgumentsRestored)
+	assert.Equal(t, []string{"Changing kernel arguments"}, result.OSChanges)
+
+	// Nothing to do if the host runs the arguments
+	runningConfig := newDeviceAgentTestConfig(t, "running", nil, nil)
+	runningConfig.Spec.KernelArguments = []string{"c", "a=1"}
+	assert.False(t, d.kernelArgumentsDrifted(runningConfig, deviceAgentTestSelector))
+	result, err = d.PlanInDeviceAgentMode(runningConfig, runningConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.Empty(t, result.KernelArgumentsRestored)
+	assert.Empty(t, result.OSChanges)
+}
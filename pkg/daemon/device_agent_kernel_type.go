@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// MachineConfigKernelTypeImagesAnnotationKey selects the OS image of bootc
+// hosts by the kernelType of a MachineConfig in device agent mode, as a JSON
+// object mapping kernel types to images:
+//
+//	{"realtime": "quay.io/example/os-rt:2", "64k-pages": "quay.io/example/os-64k:2"}
+//
+// bootc hosts get their kernel from the image, so changing the kernel type
+// switches to the image of the new type. The osImageURL is the image of the
+// default kernel, unless "default" is mapped too; other kernel types need an
+// image. MergeMachineConfigsInAgentMode merges the images of all configs,
+// later configs winning.
+const MachineConfigKernelTypeImagesAnnotationKey = "machineconfiguration.openshift.io/kernel-type-images"
+
+// machineConfigKernelTypeImages returns the images of mc's annotation.
+func machineConfigKernelTypeImages(mc *mcfgv1.MachineConfig) (map[string]string, error) {
+	images := map[string]string{}
+	encoded, ok := mc.GetAnnotations()[MachineConfigKernelTypeImagesAnnotationKey]
+	if !ok {
+		return images, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &images); err != nil {
+		return images, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigKernelTypeImagesAnnotationKey, mc.GetName(), err)
+	}
+	for kernelType, image := range images {
+		if canonicalizeKernelType(kernelType) != kernelType || image == "" {
+			return images, fmt.Errorf("invalid image %q for kernel type %q in %s annotation of MachineConfig %s", image, kernelType, MachineConfigKernelTypeImagesAnnotationKey, mc.GetName())
+		}
+	}
+	return images, nil
+}
+
+// withKernelTypeOSImage returns mc with the OS image of its kernel type on
+// bootc hosts.
+func withKernelTypeOSImage(mc *mcfgv1.MachineConfig) (*mcfgv1.MachineConfig, error) {
+	images, err := machineConfigKernelTypeImages(mc)
+	if err != nil {
+		return nil, err
+	}
+	kernelType := canonicalizeKernelType(mc.Spec.KernelType)
+	image, ok := images[kernelType]
+	switch {
+	case !ok && kernelType == ctrlcommon.KernelTypeDefault:
+		return mc, nil
+	case !ok:
+		return nil, fmt.Errorf("kernel type %s needs an OS image in the %s annotation on bootc hosts", kernelType, MachineConfigKernelTypeImagesAnnotationKey)
+	}
+	mc = mc.DeepCopy()
+	mc.Spec.OSImageURL = image
+	return mc, nil
+}
+
+// mergeKernelTypeImagesAnnotations sets the kernel type images annotation of
+// merged to the images of configs, in order of their names, later ones
+// winning.
+func mergeKernelTypeImagesAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	images := map[string]string{}
+	for _, config := range sorted {
+		fragment, err := machineConfigKernelTypeImages(config)
+		if err != nil {
+			return err
+		}
+		for kernelType, image := range fragment {
+			images[kernelType] = image
+		}
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	return setJSONAnnotation(merged, MachineConfigKernelTypeImagesAnnotationKey, images)
+}
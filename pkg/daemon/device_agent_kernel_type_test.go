@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelTypeInAgentMode(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	// Kernel types are swapped by rpm-ostree on EL hosts only
+	d := newMockDeviceAgentDaemon(testDir)
+	assert.Error(t, rpmOstreeOSUpdater{d}.CheckOSChanges(OSChangeSet{KernelType: true}))
+	assert.Nil(t, rpmOstreeOSUpdater{d}.CheckOSChanges(OSChangeSet{OSImageURL: true}))
+
+	// bootc hosts switch to the image of the kernel type
+	ostreeStatus, _ := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 9f2b44.0\n"), 0o644))
+	var runs [][]string
+	d.bootc = &BootcClient{
+		run: func(_ context.Context, args ...string) error {
+			runs = append(runs, args)
+			return nil
+		},
+		output: func(...string) ([]byte, error) {
+			return []byte(`{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:2", "transport": "registry"}}}}}`), nil
+		},
+	}
+	images := map[string]string{ctrlcommon.KernelTypeRealtime: "quay.io/example/os-rt:2"}
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	require.Nil(t, setJSONAnnotation(oldConfig, MachineConfigKernelTypeImagesAnnotationKey, images))
+	newConfig := oldConfig.DeepCopy()
+	newConfig.SetName("new")
+	newConfig.Spec.KernelType = ctrlcommon.KernelTypeRealtime
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"Changing kernel type"}, result.OSChanges)
+	assert.True(t, result.RebootRequired)
+	assert.Equal(t, "Changing kernel type", result.RebootReason)
+	assert.Contains(t, runs, []string{"switch", "--transport", "registry", "quay.io/example/os-rt:2"})
+
+	// The image is checked, verified and pulled as an OS update would be
+	rtConfig, err := withKernelTypeOSImage(newConfig)
+	require.Nil(t, err)
+	changed, err := d.osImageChanged(oldConfig, rtConfig)
+	require.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = d.osImageChanged(newConfig, rtConfig)
+	require.Nil(t, err)
+	assert.False(t, changed)
+
+	// Kernel types without an image are unreconcilable
+	newerConfig := oldConfig.DeepCopy()
+	newerConfig.SetName("newer")
+	newerConfig.Spec.KernelType = ctrlcommon.KernelType64kPages
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newerConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	var unreconcilable *ErrUnreconcilable
+	require.ErrorAs(t, err, &unreconcilable)
+
+	// Merged configs get the images of all fragments
+	fragment := newDeviceAgentTestConfig(t, "99-64k", nil, nil)
+	require.Nil(t, setJSONAnnotation(fragment, MachineConfigKernelTypeImagesAnnotationKey, map[string]string{ctrlcommon.KernelType64kPages: "quay.io/example/os-64k:2"}))
+	merged, err := MergeMachineConfigsInAgentMode("merged", []*mcfgv1.MachineConfig{oldConfig, fragment})
+	require.Nil(t, err)
+	mergedImages, err := machineConfigKernelTypeImages(merged)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{ctrlcommon.KernelTypeRealtime: "quay.io/example/os-rt:2", ctrlcommon.KernelType64kPages: "quay.io/example/os-64k:2"}, mergedImages)
+}
@@ -0,0 +1,323 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"k8s.io/klog/v2"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// luksKeyFileDirPath is where Ignition keeps the key files of the LUKS
+// volumes it creates, named after the volumes.
+var luksKeyFileDirPath = filepath.Join("/etc", "luks")
+
+// luksChange is a change to a LUKS volume that is applied to its header
+// while it is open.
+type luksChange struct {
+	old, new ign3types.Luks
+	// keyFile is true if the key file is rotated
+	keyFile bool
+	// clevis is true if the Clevis binding changed
+	clevis bool
+	// openOptions is true if how the volume is opened changed, which takes
+	// effect on the next boot
+	openOptions bool
+}
+
+// planLUKS returns the changes to apply to the LUKS volumes, which must all
+// exist already, or an error for changes that can't be made to them: volumes
+// can't be created, removed, moved or reformatted, key files must be inline
+// and a volume must keep a key file or a Clevis binding to be unlocked with.
+func planLUKS(oldLuks, newLuks []ign3types.Luks) ([]luksChange, error) {
+	old := map[string]ign3types.Luks{}
+	for _, l := range oldLuks {
+		old[l.Name] = l
+	}
+	kept := map[string]struct{}{}
+	var changes []luksChange
+	for _, l := range newLuks {
+		prev, ok := old[l.Name]
+		if !ok || l.Device == nil {
+			return nil, fmt.Errorf("LUKS volume %s can't be created on a provisioned system", l.Name)
+		}
+		kept[l.Name] = struct{}{}
+		if !reflect.DeepEqual(prev.Device, l.Device) || !reflect.DeepEqual(prev.UUID, l.UUID) || !reflect.DeepEqual(prev.Label, l.Label) ||
+			!reflect.DeepEqual(prev.Options, l.Options) || !reflect.DeepEqual(prev.WipeVolume, l.WipeVolume) {
+			return nil, fmt.Errorf("LUKS volume %s was changed, only its key file, Clevis binding and open options can change", l.Name)
+		}
+		if isRemoteSource(l.KeyFile.Source) {
+			return nil, fmt.Errorf("LUKS volume %s has a remote key file, only inline ones can be rotated to", l.Name)
+		}
+		if l.KeyFile.Source == nil && luksClevisEmpty(l.Clevis) {
+			return nil, fmt.Errorf("LUKS volume %s has neither a key file nor a Clevis binding", l.Name)
+		}
+		change := luksChange{
+			old:         prev,
+			new:         l,
+			keyFile:     l.KeyFile.Source != nil && !reflect.DeepEqual(prev.KeyFile, l.KeyFile),
+			clevis:      !reflect.DeepEqual(prev.Clevis, l.Clevis),
+			openOptions: !reflect.DeepEqual(prev.OpenOptions, l.OpenOptions) || !reflect.DeepEqual(prev.Discard, l.Discard),
+		}
+		if change.keyFile || change.clevis || change.openOptions {
+			changes = append(changes, change)
+		}
+	}
+	for _, l := range oldLuks {
+		if _, ok := kept[l.Name]; !ok {
+			return nil, fmt.Errorf("LUKS volume %s can't be removed from a provisioned system", l.Name)
+		}
+	}
+	return changes, nil
+}
+
+func luksClevisEmpty(c ign3types.Clevis) bool {
+	return (c.Tpm2 == nil || !*c.Tpm2) && len(c.Tang) == 0 && c.Custom.Pin == nil
+}
+
+// clevisPinConfig returns the Clevis pin and its configuration binding to c,
+// combining TPM2 and Tang pins with Shamir secret sharing like Ignition does.
+func clevisPinConfig(c ign3types.Clevis) (string, string, error) {
+	if c.Custom.Pin != nil {
+		config := "{}"
+		if c.Custom.Config != nil {
+			config = *c.Custom.Config
+		}
+		return *c.Custom.Pin, config, nil
+	}
+
+	pins := map[string][]map[string]string{}
+	if c.Tpm2 != nil && *c.Tpm2 {
+		pins["tpm2"] = []map[string]string{{}}
+	}
+	for _, tang := range c.Tang {
+		config := map[string]string{"url": tang.URL}
+		if tang.Thumbprint != nil {
+			config["thp"] = *tang.Thumbprint
+		}
+		if tang.Advertisement != nil {
+			config["adv"] = *tang.Advertisement
+		}
+		pins["tang"] = append(pins["tang"], config)
+	}
+	if len(pins) == 0 {
+		return "", "", fmt.Errorf("no Clevis pins")
+	}
+	threshold := 1
+	if c.Threshold != nil {
+		threshold = *c.Threshold
+	}
+	if len(pins["tpm2"])+len(pins["tang"]) == 1 {
+		for pin, configs := range pins {
+			b, err := json.Marshal(configs[0])
+			return pin, string(b), err
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{"t": threshold, "pins": pins})
+	return "sss", string(b), err
+}
+
+// updateLUKS applies the changes to the headers of the LUKS volumes while
+// they are open. A new key file is added before the old one is removed, and a
+// new Clevis binding is bound before the old one is unbound, so there is
+// always a way to unlock a volume. Changes to LUKS headers aren't rolled back,
+// as the snapshot of the update can't track them.
+func updateLUKS(changes []luksChange) error {
+	for _, change := range changes {
+		if !change.keyFile && !change.clevis {
+			continue
+		}
+		if err := updateLUKSHeader(change); err != nil {
+			return fmt.Errorf("updating LUKS volume %s: %w", change.new.Name, err)
+		}
+	}
+	return nil
+}
+
+// luksReopened returns the names of the volumes whose open options changed.
+func luksReopened(changes []luksChange) []string {
+	var names []string
+	for _, change := range changes {
+		if change.openOptions {
+			names = append(names, change.new.Name)
+		}
+	}
+	return names
+}
+
+func updateLUKSHeader(change luksChange) error {
+	device := *change.new.Device
+	dir, err := os.MkdirTemp("/run", "mcd-luks-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	unlockKey, fromKeyFile, err := luksUnlockKey(change.old, dir)
+	if err != nil {
+		return err
+	}
+	if change.keyFile {
+		newKey := filepath.Join(dir, "new")
+		if err := writeLUKSKeyFile(change.new, newKey); err != nil {
+			return err
+		}
+		if err := runCmdSync("cryptsetup", "luksAddKey", "--batch-mode", "--key-file", unlockKey, device, newKey); err != nil {
+			return err
+		}
+		stored := filepath.Join(luksKeyFileDirPath, change.new.Name)
+		if _, err := os.Stat(stored); err == nil {
+			if err := writeLUKSKeyFile(change.new, stored); err != nil {
+				return err
+			}
+		}
+		if fromKeyFile {
+			if err := runCmdSync("cryptsetup", "luksRemoveKey", "--batch-mode", device, unlockKey); err != nil {
+				return err
+			}
+		}
+		logSystem("Rotated the key file of LUKS volume %s", change.new.Name)
+		unlockKey = newKey
+	}
+
+	if change.clevis {
+		oldSlots, err := clevisSlots(device)
+		if err != nil {
+			return err
+		}
+		if !luksClevisEmpty(change.new.Clevis) {
+			pin, config, err := clevisPinConfig(change.new.Clevis)
+			if err != nil {
+				return err
+			}
+			if err := runCmdSync("clevis", "luks", "bind", "-y", "-k", unlockKey, "-d", device, pin, config); err != nil {
+				return err
+			}
+		}
+		for _, slot := range oldSlots {
+			if err := runCmdSync("clevis", "luks", "unbind", "-f", "-d", device, "-s", slot); err != nil {
+				return err
+			}
+		}
+		logSystem("Changed the Clevis binding of LUKS volume %s", change.new.Name)
+	}
+	return nil
+}
+
+// luksUnlockKey writes a key unlocking the volume to dir and returns its path,
+// and whether it is the volume's key file rather than a passphrase of its
+// Clevis binding.
+func luksUnlockKey(l ign3types.Luks, dir string) (string, bool, error) {
+	key := filepath.Join(dir, "old")
+	if l.KeyFile.Source != nil {
+		if err := writeLUKSKeyFile(l, key); err != nil {
+			return "", false, err
+		}
+		return key, true, nil
+	}
+	// Copied, as the stored key file is replaced when rotating it
+	stored := filepath.Join(luksKeyFileDirPath, l.Name)
+	if b, err := os.ReadFile(stored); err == nil {
+		if err := os.WriteFile(key, b, 0o600); err != nil {
+			return "", false, err
+		}
+		return key, true, nil
+	}
+	slots, err := clevisSlots(*l.Device)
+	if err != nil {
+		return "", false, err
+	}
+	if len(slots) == 0 {
+		return "", false, fmt.Errorf("no key file or Clevis binding to unlock %s with", *l.Device)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("clevis", "luks", "pass", "-d", *l.Device, "-s", slots[0])
+	cmd.Stderr = &stderr
+	pass, err := cmd.Output()
+	if err != nil {
+		return "", false, fmt.Errorf("getting passphrase of %s from Clevis: %s: %w", *l.Device, stderr.String(), err)
+	}
+	if err := os.WriteFile(key, pass, 0o600); err != nil {
+		return "", false, err
+	}
+	return key, false, nil
+}
+
+// writeLUKSKeyFile writes the decoded key file of l to path.
+func writeLUKSKeyFile(l ign3types.Luks, path string) error {
+	file := ign3types.File{Node: ign3types.Node{Path: path}, FileEmbedded1: ign3types.FileEmbedded1{Contents: l.KeyFile}}
+	key, err := decodeFileContents(file)
+	if err != nil {
+		return fmt.Errorf("decoding key file of LUKS volume %s: %w", l.Name, err)
+	}
+	return writeFileAtomically(path, key, 0o700, 0o600, -1, -1)
+}
+
+// clevisSlots returns the key slots of device that are bound with Clevis.
+func clevisSlots(device string) ([]string, error) {
+	out, err := exec.Command("clevis", "luks", "list", "-d", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing Clevis bindings of %s: %w", device, err)
+	}
+	return parseClevisList(out), nil
+}
+
+// parseClevisList returns the slots of clevis luks list output, which has a
+// line per binding such as 1: tpm2 '{"hash":"sha256","key":"ecc"}'.
+func parseClevisList(out []byte) []string {
+	var slots []string
+	for _, line := range strings.Split(string(out), "\n") {
+		slot, _, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if _, err := strconv.Atoi(slot); ok && err == nil {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// RebindLUKSInAgentMode seals the TPM2 Clevis bindings of the LUKS volumes of
+// the config last applied in device agent mode to the current state of the
+// TPM again, e.g. after a firmware update changed the measured PCRs. It is
+// to be called before rebooting into the new state, while the volumes can
+// still be unlocked; rebooting confirms they unlock with the new binding. It
+// returns the names of the volumes that were rebound.
+func (dn *Daemon) RebindLUKSInAgentMode() ([]string, error) {
+	current, err := dn.CurrentConfigInAgentMode()
+	if err != nil || current == nil {
+		return nil, err
+	}
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(current.Spec.Config.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Ignition for rebinding LUKS volumes: %w", err)
+	}
+	var rebound []string
+	for _, l := range ignConfig.Storage.Luks {
+		if l.Device == nil || l.Clevis.Tpm2 == nil || !*l.Clevis.Tpm2 {
+			continue
+		}
+		slots, err := clevisSlots(*l.Device)
+		if err != nil {
+			return rebound, err
+		}
+		for _, slot := range slots {
+			if err := runCmdSync("clevis", "luks", "regen", "-q", "-d", *l.Device, "-s", slot); err != nil {
+				return rebound, fmt.Errorf("rebinding LUKS volume %s: %w", l.Name, err)
+			}
+		}
+		klog.Infof("Rebound LUKS volume %s to the TPM", l.Name)
+		rebound = append(rebound, l.Name)
+	}
+	if len(rebound) > 0 {
+		logSystem("Rebound LUKS volumes %s to the TPM; reboot to confirm they unlock", strings.Join(rebound, ", "))
+	}
+	return rebound, nil
+}
@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanLUKS(t *testing.T) {
+	root := ign3types.Luks{
+		Name:    "data",
+		Device:  helpers.StrToPtr("/dev/disk/by-partlabel/data"),
+		KeyFile: ign3types.Resource{Source: helpers.StrToPtr("data:,old")},
+		Clevis:  ign3types.Clevis{Tpm2: helpers.BoolToPtr(true)},
+	}
+	changes, err := planLUKS([]ign3types.Luks{root}, []ign3types.Luks{root})
+	require.Nil(t, err)
+	assert.Empty(t, changes)
+
+	rotated := root
+	rotated.KeyFile = ign3types.Resource{Source: helpers.StrToPtr("data:,new")}
+	rotated.Clevis = ign3types.Clevis{Tpm2: helpers.BoolToPtr(true), Tang: []ign3types.Tang{{URL: "http://tang", Thumbprint: helpers.StrToPtr("abc")}}, Threshold: helpers.IntToPtr(2)}
+	rotated.OpenOptions = []ign3types.OpenOption{"--perf-no_read_workqueue"}
+	changes, err = planLUKS([]ign3types.Luks{root}, []ign3types.Luks{rotated})
+	require.Nil(t, err)
+	require.Len(t, changes, 1)
+	assert.True(t, changes[0].keyFile)
+	assert.True(t, changes[0].clevis)
+	assert.Equal(t, []string{"data"}, luksReopened(changes))
+
+	// Volumes can't be created, removed or moved, and must stay unlockable
+	_, err = planLUKS(nil, []ign3types.Luks{root})
+	assert.NotNil(t, err)
+	_, err = planLUKS([]ign3types.Luks{root}, nil)
+	assert.NotNil(t, err)
+	moved := root
+	moved.Device = helpers.StrToPtr("/dev/sdb")
+	_, err = planLUKS([]ign3types.Luks{root}, []ign3types.Luks{moved})
+	assert.NotNil(t, err)
+	locked := root
+	locked.KeyFile = ign3types.Resource{}
+	locked.Clevis = ign3types.Clevis{}
+	_, err = planLUKS([]ign3types.Luks{root}, []ign3types.Luks{locked})
+	assert.NotNil(t, err)
+
+	pin, config, err := clevisPinConfig(root.Clevis)
+	require.Nil(t, err)
+	assert.Equal(t, "tpm2", pin)
+	assert.Equal(t, "{}", config)
+	pin, config, err = clevisPinConfig(rotated.Clevis)
+	require.Nil(t, err)
+	assert.Equal(t, "sss", pin)
+	assert.JSONEq(t, `{"t": 2, "pins": {"tpm2": [{}], "tang": [{"url": "http://tang", "thp": "abc"}]}}`, config)
+
+	assert.Equal(t, []string{"1", "3"}, parseClevisList([]byte("1: tpm2 '{\"hash\":\"sha256\",\"key\":\"ecc\"}'\n3: tang '{\"url\":\"http://tang\"}'\n")))
+}
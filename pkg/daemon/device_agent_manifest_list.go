@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/klog/v2"
+)
+
+// osImageManifestPath records which image of a manifest list the OS was last
+// updated to in device agent mode.
+var osImageManifestPath = "/etc/machine-config-daemon/os-image-manifest.json"
+
+// OSImageManifest is the image of a manifest list an OS update resolved to.
+type OSImageManifest struct {
+	// Image is the osImageURL, which names the manifest list.
+	Image string `json:"image"`
+	// ListDigest is the digest of the manifest list.
+	ListDigest string `json:"listDigest"`
+	// Digest is the digest of the image for the architecture of the host.
+	Digest string `json:"digest"`
+	// Platform is the architecture, and variant if any, of the image, as in
+	// arm64/v8.
+	Platform string `json:"platform"`
+	// PinnedImage is the image by digest, as repo@digest, which the OS is
+	// rebased to, so it runs the image that was resolved even if the list
+	// changes in the meantime.
+	PinnedImage string `json:"pinnedImage,omitempty"`
+}
+
+// getOSImageManifest returns the manifest of the image in the registry, and
+// its MIME type. Tests override it to fake the registry.
+var getOSImageManifest = func(ctx context.Context, image string) ([]byte, string, error) {
+	src, err := newDockerImageSource(ctx, &types.SystemContext{AuthFilePath: ostreeAuthFile}, image)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+	return src.GetManifest(ctx, nil)
+}
+
+// resolveOSImageManifest returns the image of the manifest list imgURL names
+// that the host runs, or nil if imgURL isn't pulled from a registry or names
+// a single image. It fails if the list has no image for the architecture of
+// the host, which rpm-ostree would only fail to pull. If the manifest can't be
+// fetched, e.g. because only rpm-ostree has the pull secret, the image is left
+// to rpm-ostree to resolve.
+func resolveOSImageManifest(ctx context.Context, imgURL string) (*OSImageManifest, error) {
+	if isLocalOSImage(imgURL) {
+		return nil, nil
+	}
+	_, image := splitOSImageTransport(imgURL)
+	raw, mimeType, err := getOSImageManifest(ctx, image)
+	if err != nil {
+		klog.Warningf("Not resolving OS image %s, failed to fetch its manifest: %v", imgURL, err)
+		return nil, nil
+	}
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return nil, nil
+	}
+	list, err := manifest.ListFromBlob(raw, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest list %s: %w", imgURL, err)
+	}
+	listDigest, err := manifest.Digest(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// The platforms of the images, by digest
+	platforms := map[string]string{}
+	supported := false
+	for _, d := range list.Instances() {
+		instance, err := list.Instance(d)
+		if err != nil {
+			return nil, err
+		}
+		platform := instance.ReadOnly.Platform
+		if platform == nil || platform.OS != "linux" {
+			continue
+		}
+		platforms[d.String()] = platform.Architecture
+		if platform.Variant != "" {
+			platforms[d.String()] += "/" + platform.Variant
+		}
+		supported = supported || platform.Architecture == goruntime.GOARCH
+	}
+	if !supported {
+		available := make([]string, 0, len(platforms))
+		for _, platform := range platforms {
+			available = append(available, platform)
+		}
+		sort.Strings(available)
+		return nil, fmt.Errorf("manifest list %s has no image for the %s architecture of this host, only for %v", imgURL, goruntime.GOARCH, available)
+	}
+	instance, err := list.ChooseInstance(&types.SystemContext{})
+	if err != nil {
+		return nil, fmt.Errorf("choosing image of manifest list %s: %w", imgURL, err)
+	}
+	pinned, err := pinOSImage(image, instance)
+	if err != nil {
+		return nil, err
+	}
+	return &OSImageManifest{
+		Image:       imgURL,
+		ListDigest:  listDigest.String(),
+		Digest:      instance.String(),
+		Platform:    platforms[instance.String()],
+		PinnedImage: pinned,
+	}, nil
+}
+
+// pinOSImage returns the registry image of its repository with digest d, as
+// repo@digest.
+func pinOSImage(image string, d digest.Digest) (string, error) {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(image, "docker://"))
+	if err != nil {
+		return "", fmt.Errorf("parsing OS image %s: %w", image, err)
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), d)
+	if err != nil {
+		return "", fmt.Errorf("pinning OS image %s: %w", image, err)
+	}
+	return pinned.String(), nil
+}
+
+// withAppliedOSImageManifest returns config with the osImageURL the OS was
+// rebased to, if it names the manifest list the last update resolved.
+func withAppliedOSImageManifest(config *mcfgv1.MachineConfig) (*mcfgv1.MachineConfig, error) {
+	applied, err := AppliedOSImageManifest()
+	if err != nil {
+		return nil, err
+	}
+	if applied == nil || applied.PinnedImage == "" || applied.Image != config.Spec.OSImageURL {
+		return config, nil
+	}
+	config = config.DeepCopy()
+	config.Spec.OSImageURL = applied.PinnedImage
+	return config, nil
+}
+
+// saveOSImageManifest records manifest as the image the OS was updated to, or
+// removes the record if manifest is nil.
+func saveOSImageManifest(manifest *OSImageManifest) error {
+	if manifest == nil {
+		if err := os.Remove(osImageManifestPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(osImageManifestPath), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(osImageManifestPath, b)
+}
+
+// AppliedOSImageManifest returns the image of a manifest list the OS was last
+// updated to in device agent mode, or nil if the osImageURL of that update
+// named a single image.
+func AppliedOSImageManifest() (*OSImageManifest, error) {
+	b, err := os.ReadFile(osImageManifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading OS image manifest: %w", err)
+	}
+	manifest := &OSImageManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, fmt.Errorf("parsing OS image manifest: %w", err)
+	}
+	return manifest, nil
+}
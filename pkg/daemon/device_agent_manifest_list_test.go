@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	goruntime "runtime"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOSImageManifestList(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	index := func(archs ...string) []byte {
+		var manifests []string
+		for i, arch := range archs {
+			manifests = append(manifests, fmt.Sprintf(`{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:%064d", "size": 1, "platform": {"architecture": %q, "os": "linux"}}`, i, arch))
+		}
+		return []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [` + strings.Join(manifests, ",") + `]}`)
+	}
+	raw, mimeType := index("s390x", goruntime.GOARCH), imgspecv1.MediaTypeImageIndex
+	oldGetOSImageManifest := getOSImageManifest
+	defer func() { getOSImageManifest = oldGetOSImageManifest }()
+	var fetched []string
+	getOSImageManifest = func(_ context.Context, image string) ([]byte, string, error) {
+		fetched = append(fetched, image)
+		return raw, mimeType, nil
+	}
+
+	resolved, err := resolveOSImageManifest(context.Background(), "quay.io/example/os:2")
+	require.Nil(t, err)
+	require.NotNil(t, resolved)
+	assert.Equal(t, "quay.io/example/os:2", resolved.Image)
+	assert.Equal(t, fmt.Sprintf("sha256:%064d", 1), resolved.Digest)
+	assert.Equal(t, goruntime.GOARCH, resolved.Platform)
+	assert.Equal(t, digest.FromBytes(raw).String(), resolved.ListDigest)
+	assert.Equal(t, fmt.Sprintf("quay.io/example/os@sha256:%064d", 1), resolved.PinnedImage)
+
+	// The record follows the last update
+	applied, err := AppliedOSImageManifest()
+	require.Nil(t, err)
+	assert.Nil(t, applied)
+	require.Nil(t, saveOSImageManifest(resolved))
+	applied, err = AppliedOSImageManifest()
+	require.Nil(t, err)
+	assert.Equal(t, resolved, applied)
+	// and validation expects the OS to run the image it was rebased to
+	config := newDeviceAgentTestConfig(t, "list", nil, nil)
+	config.Spec.OSImageURL = "quay.io/example/os:2"
+	pinned, err := withAppliedOSImageManifest(config)
+	require.Nil(t, err)
+	assert.Equal(t, resolved.PinnedImage, pinned.Spec.OSImageURL)
+	assert.Equal(t, "quay.io/example/os:2", config.Spec.OSImageURL)
+	require.Nil(t, saveOSImageManifest(nil))
+	assert.NoFileExists(t, osImageManifestPath)
+
+	// Lists without the architecture of the host fail clearly
+	raw = index("s390x", "ppc64le")
+	_, err = resolveOSImageManifest(context.Background(), "quay.io/example/os:2")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no image for the "+goruntime.GOARCH+" architecture of this host, only for [ppc64le s390x]")
+
+	// Single images and local images aren't resolved
+	raw, mimeType = []byte(`{"schemaVersion": 2}`), imgspecv1.MediaTypeImageManifest
+	resolved, err = resolveOSImageManifest(context.Background(), "quay.io/example/os:2")
+	require.Nil(t, err)
+	assert.Nil(t, resolved)
+	fetched = nil
+	resolved, err = resolveOSImageManifest(context.Background(), "oci:"+testDir)
+	require.Nil(t, err)
+	assert.Nil(t, resolved)
+	assert.Empty(t, fetched)
+
+	// Nor are images whose manifest can't be fetched
+	getOSImageManifest = func(context.Context, string) ([]byte, string, error) {
+		return nil, "", fmt.Errorf("unauthorized")
+	}
+	resolved, err = resolveOSImageManifest(context.Background(), "quay.io/example/os:2")
+	require.Nil(t, err)
+	assert.Nil(t, resolved)
+}
@@ -0,0 +1,213 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// MergeMachineConfigsInAgentMode merges configs into a single MachineConfig
+// named name, the same way the render controller merges the configs of a
+// pool: in order of their names, with configs of the worker role first. This
+// lets device agents compose base, role and device specific fragments
+// locally. Fragments don't need a role label. Without a controller config,
+// the OS image is only set if one of the fragments sets it. The extended
+// attributes of MachineConfigFileXattrsAnnotationKey, the capabilities of
+// MachineConfigFileCapabilitiesAnnotationKey and the hooks of
+// MachineConfigFileHooksAnnotationKey are merged per file, in order of the
+// configs' names. Files are templates if any of the configs lists them in
+// MachineConfigFileTemplatesAnnotationKey. The entries of
+// MachineConfigNameResolutionAnnotationKey of all configs are kept, and so are
+// the units of MachineConfigUserUnitsAnnotationKey, merged per user, and the
+// phases of MachineConfigApplyPhasesAnnotationKey. Later configs win for the
+// units of MachineConfigDeferredUnitsAnnotationKey and
+// MachineConfigUnitReloadPolicyAnnotationKey.
+func MergeMachineConfigsInAgentMode(name string, configs []*mcfgv1.MachineConfig) (*mcfgv1.MachineConfig, error) {
+	if name == "" {
+		return nil, fmt.Errorf("no name given for merged MachineConfig")
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no MachineConfigs to merge")
+	}
+
+	fragments := make([]*mcfgv1.MachineConfig, 0, len(configs))
+	for _, config := range configs {
+		if config == nil {
+			return nil, fmt.Errorf("nil MachineConfig in configs to merge")
+		}
+		if err := ctrlcommon.ValidateMachineConfig(config.Spec); err != nil {
+			return nil, fmt.Errorf("invalid MachineConfig %s: %w", config.GetName(), err)
+		}
+		if config.Labels == nil {
+			// MergeMachineConfigs insists on labels to find the role
+			config = config.DeepCopy()
+			config.Labels = map[string]string{}
+		}
+		fragments = append(fragments, config)
+	}
+
+	merged, err := ctrlcommon.MergeMachineConfigs(fragments, &mcfgv1.ControllerConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("merging MachineConfigs: %w", err)
+	}
+	merged.SetName(name)
+	if err := mergeFileXattrsAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeFileTemplatesAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeNameResolutionAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeUserUnitsAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeApplyPhasesAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeDeferredUnitsAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeUnitReloadPolicyAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeKernelTypeImagesAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeUsrHotfixesAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeOSDeltaBundlesAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	if err := mergeInitramfsArgsAnnotations(merged, fragments); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// mergeFileXattrsAnnotations sets the extended attributes, capabilities and
+// hooks annotations of merged to the union of the ones of configs, later
+// configs winning.
+func mergeFileXattrsAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	xattrs := map[string]map[string]string{}
+	capabilities := map[string]string{}
+	hooks := fileHooks{}
+	for _, config := range sorted {
+		if encoded, ok := config.GetAnnotations()[MachineConfigFileXattrsAnnotationKey]; ok {
+			fragment := map[string]map[string]string{}
+			if err := json.Unmarshal([]byte(encoded), &fragment); err != nil {
+				return fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigFileXattrsAnnotationKey, config.GetName(), err)
+			}
+			for path, attrs := range fragment {
+				if xattrs[path] == nil {
+					xattrs[path] = map[string]string{}
+				}
+				for name, value := range attrs {
+					xattrs[path][name] = value
+				}
+			}
+		}
+		if encoded, ok := config.GetAnnotations()[MachineConfigFileCapabilitiesAnnotationKey]; ok {
+			fragment := map[string]string{}
+			if err := json.Unmarshal([]byte(encoded), &fragment); err != nil {
+				return fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigFileCapabilitiesAnnotationKey, config.GetName(), err)
+			}
+			for path, caps := range fragment {
+				capabilities[path] = caps
+			}
+		}
+		if encoded, ok := config.GetAnnotations()[MachineConfigFileHooksAnnotationKey]; ok {
+			fragment := fileHooks{}
+			if err := json.Unmarshal([]byte(encoded), &fragment); err != nil {
+				return fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigFileHooksAnnotationKey, config.GetName(), err)
+			}
+			for path, hook := range fragment {
+				hooks[path] = hook
+			}
+		}
+	}
+
+	if len(xattrs) > 0 {
+		if err := setJSONAnnotation(merged, MachineConfigFileXattrsAnnotationKey, xattrs); err != nil {
+			return err
+		}
+	}
+	if len(capabilities) > 0 {
+		if err := setJSONAnnotation(merged, MachineConfigFileCapabilitiesAnnotationKey, capabilities); err != nil {
+			return err
+		}
+	}
+	if len(hooks) > 0 {
+		return setJSONAnnotation(merged, MachineConfigFileHooksAnnotationKey, hooks)
+	}
+	return nil
+}
+
+// mergeFileTemplatesAnnotations sets the templates annotation of merged to the
+// sorted union of the templated paths of configs.
+func mergeFileTemplatesAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	templated := map[string]struct{}{}
+	for _, config := range configs {
+		encoded, ok := config.GetAnnotations()[MachineConfigFileTemplatesAnnotationKey]
+		if !ok {
+			continue
+		}
+		var paths []string
+		if err := json.Unmarshal([]byte(encoded), &paths); err != nil {
+			return fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigFileTemplatesAnnotationKey, config.GetName(), err)
+		}
+		for _, path := range paths {
+			templated[path] = struct{}{}
+		}
+	}
+	if len(templated) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(templated))
+	for path := range templated {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return setJSONAnnotation(merged, MachineConfigFileTemplatesAnnotationKey, paths)
+}
+
+func setJSONAnnotation(mc *mcfgv1.MachineConfig, key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshalling merged %s annotation: %w", key, err)
+	}
+	if mc.Annotations == nil {
+		mc.Annotations = map[string]string{}
+	}
+	mc.Annotations[key] = string(b)
+	return nil
+}
+
+// RunLayeredInDeviceAgentMode is like RunOnceInDeviceAgentMode, but applies the
+// MachineConfig merged from configs by MergeMachineConfigsInAgentMode. If the
+// daemon was created WithSignatureVerifier, each of configs must be signed.
+func (dn *Daemon) RunLayeredInDeviceAgentMode(ctx context.Context, oldConfig *mcfgv1.MachineConfig, name string, configs []*mcfgv1.MachineConfig, selector ApplySelector, policy UpdatePolicy) (*UpdateResult, error) {
+	for _, config := range configs {
+		if config == nil {
+			continue
+		}
+		if err := dn.verifyMachineConfigSignature(config); err != nil {
+			return nil, err
+		}
+	}
+	merged, err := MergeMachineConfigsInAgentMode(name, configs)
+	if err != nil {
+		return nil, err
+	}
+	return dn.runOnceInDeviceAgentMode(ctx, oldConfig, merged, selector, policy)
+}
@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunLayeredInDeviceAgentMode(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	basePath := filepath.Join(testDir, "etc", "base")
+	overriddenPath := filepath.Join(testDir, "etc", "overridden")
+
+	base := newDeviceAgentTestConfig(t, "00-base", []ign3types.File{
+		newDeviceAgentTestFile(t, basePath, "base"),
+		newDeviceAgentTestFile(t, overriddenPath, "base"),
+	}, nil)
+	base.Spec.KernelArguments = []string{"quiet"}
+	device := newDeviceAgentTestConfig(t, "50-device", []ign3types.File{
+		newDeviceAgentTestFile(t, overriddenPath, "device"),
+	}, nil)
+	device.Spec.KernelArguments = []string{"console=ttyS0"}
+
+	// The order configs are passed in doesn't matter
+	merged, err := MergeMachineConfigsInAgentMode("layered", []*mcfgv1.MachineConfig{device, base})
+	require.Nil(t, err)
+	assert.Equal(t, "layered", merged.Name)
+	assert.Equal(t, []string{"quiet", "console=ttyS0"}, merged.Spec.KernelArguments)
+
+	result, err := d.RunLayeredInDeviceAgentMode(context.TODO(), nil, "layered", []*mcfgv1.MachineConfig{device, base}, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, "layered", result.NewConfigName)
+	assert.ElementsMatch(t, []string{basePath, overriddenPath}, result.FilesWritten)
+	for path, expected := range map[string]string{basePath: "base", overriddenPath: "device"} {
+		contents, err := os.ReadFile(path)
+		require.Nil(t, err)
+		assert.Equal(t, expected, string(contents))
+	}
+
+	_, err = MergeMachineConfigsInAgentMode("", []*mcfgv1.MachineConfig{base})
+	assert.NotNil(t, err)
+	_, err = MergeMachineConfigsInAgentMode("layered", nil)
+	assert.NotNil(t, err)
+}
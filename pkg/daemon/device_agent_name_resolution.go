@@ -0,0 +1,234 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/klog/v2"
+)
+
+// MachineConfigNameResolutionAnnotationKey holds /etc/hosts and
+// /etc/resolv.conf entries a MachineConfig contributes in device agent mode,
+// as a JSON object:
+//
+//	{"hosts": ["10.0.0.5 registry.local"], "nameservers": ["10.0.0.53"], "search": ["site.local"], "options": ["ndots:2"]}
+//
+// Rather than owning the files, the daemon keeps the entries in a marked
+// block of each file, leaving the lines outside of it to local management.
+// The block of resolv.conf searches the local domains too, and nameservers past
+// the resolver's limit of three are dropped with a warning.
+// MergeMachineConfigsInAgentMode merges the entries of all configs, so each
+// can add its own.
+const MachineConfigNameResolutionAnnotationKey = "machineconfiguration.openshift.io/name-resolution"
+
+var (
+	hostsFilePath  = "/etc/hosts"
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+const (
+	managedBlockBegin = "# BEGIN machine-config-daemon managed entries, do not edit"
+	managedBlockEnd   = "# END machine-config-daemon managed entries"
+)
+
+// maxNameservers is how many nameservers the resolver uses, MAXNS of glibc.
+const maxNameservers = 3
+
+// nameResolution holds the entries of the name resolution annotation.
+type nameResolution struct {
+	Hosts       []string `json:"hosts,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// machineConfigNameResolution returns the entries of mc's annotation.
+func machineConfigNameResolution(mc *mcfgv1.MachineConfig) (nameResolution, error) {
+	var entries nameResolution
+	encoded, ok := mc.GetAnnotations()[MachineConfigNameResolutionAnnotationKey]
+	if !ok {
+		return entries, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &entries); err != nil {
+		return entries, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigNameResolutionAnnotationKey, mc.GetName(), err)
+	}
+	for _, line := range append(append(append(append([]string{}, entries.Hosts...), entries.Nameservers...), entries.Search...), entries.Options...) {
+		if strings.TrimSpace(line) == "" || strings.ContainsAny(line, "\n#") {
+			return entries, fmt.Errorf("invalid entry %q in %s annotation of MachineConfig %s", line, MachineConfigNameResolutionAnnotationKey, mc.GetName())
+		}
+	}
+	return entries, nil
+}
+
+// checkNameResolutionFiles returns an error if entries are to be added to a
+// file that files write as a whole, as the two would keep overwriting each
+// other.
+func checkNameResolutionFiles(entries nameResolution, files []ign3types.File) error {
+	for _, file := range files {
+		if (file.Path == hostsFilePath && len(entries.Hosts) > 0) ||
+			(file.Path == resolvConfPath && (len(entries.Nameservers) > 0 || len(entries.Search) > 0 || len(entries.Options) > 0)) {
+			return fmt.Errorf("entries of %s annotation can't be added to %q, which the config writes as a whole", MachineConfigNameResolutionAnnotationKey, file.Path)
+		}
+	}
+	return nil
+}
+
+// merge adds the entries of other that e doesn't have yet.
+func (e *nameResolution) merge(other nameResolution) {
+	e.Hosts = appendMissing(e.Hosts, other.Hosts)
+	e.Nameservers = appendMissing(e.Nameservers, other.Nameservers)
+	e.Search = appendMissing(e.Search, other.Search)
+	e.Options = appendMissing(e.Options, other.Options)
+}
+
+func (e nameResolution) empty() bool {
+	return len(e.Hosts) == 0 && len(e.Nameservers) == 0 && len(e.Search) == 0 && len(e.Options) == 0
+}
+
+func appendMissing(entries, more []string) []string {
+	for _, entry := range more {
+		found := false
+		for _, existing := range entries {
+			if strings.Join(strings.Fields(existing), " ") == strings.Join(strings.Fields(entry), " ") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// mergeNameResolutionAnnotations sets the name resolution annotation of merged
+// to the entries of configs, in order of their names, without duplicates.
+func mergeNameResolutionAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	var entries nameResolution
+	for _, config := range sorted {
+		fragment, err := machineConfigNameResolution(config)
+		if err != nil {
+			return err
+		}
+		entries.merge(fragment)
+	}
+	if entries.empty() {
+		return nil
+	}
+	return setJSONAnnotation(merged, MachineConfigNameResolutionAnnotationKey, entries)
+}
+
+// resolvConfLines returns the lines of the managed block of resolv.conf, whose
+// lines outside of the block are local. The resolver only uses the last search
+// line, so the block, which is put last, searches the local domains as well,
+// and only the first maxNameservers nameservers, so those past the local ones
+// are dropped.
+func resolvConfLines(entries nameResolution, local string) []string {
+	var search, options []string
+	localNameservers := 0
+	for _, line := range strings.Split(local, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			localNameservers++
+		case "search", "domain":
+			search = fields[1:]
+		case "options":
+			options = append(options, fields[1:]...)
+		}
+	}
+
+	var lines []string
+	if len(entries.Options) > 0 {
+		lines = append(lines, "options "+strings.Join(appendMissing(options, entries.Options), " "))
+	}
+	if len(entries.Search) > 0 {
+		lines = append(lines, "search "+strings.Join(appendMissing(search, entries.Search), " "))
+	}
+	for i, ns := range entries.Nameservers {
+		if localNameservers+i >= maxNameservers {
+			klog.Warningf("Not adding nameservers %v to %q, the resolver only uses the first %d of them", entries.Nameservers[i:], resolvConfPath, maxNameservers)
+			break
+		}
+		lines = append(lines, "nameserver "+ns)
+	}
+	return lines
+}
+
+// updateNameResolution writes the managed blocks of /etc/hosts and
+// /etc/resolv.conf, returning the files that changed. A resolv.conf that is a
+// symlink is managed by e.g. systemd-resolved or NetworkManager and is left
+// alone.
+func updateNameResolution(entries nameResolution) ([]string, error) {
+	var changed []string
+	for _, f := range []struct {
+		path       string
+		hasEntries bool
+		lines      func(local string) []string
+	}{
+		{hostsFilePath, len(entries.Hosts) > 0, func(string) []string { return entries.Hosts }},
+		{resolvConfPath, len(entries.Nameservers)+len(entries.Search)+len(entries.Options) > 0, func(local string) []string { return resolvConfLines(entries, local) }},
+	} {
+		info, err := os.Lstat(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return changed, err
+		}
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if f.hasEntries {
+				klog.Warningf("Not adding entries to %q, it is a symlink managed by another service", f.path)
+			}
+			continue
+		}
+		current, err := os.ReadFile(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return changed, err
+		}
+		// The block is moved last, for its lines to take precedence
+		local := replaceManagedBlock(string(current), nil)
+		updated := replaceManagedBlock(local, f.lines(local))
+		if updated == string(current) {
+			continue
+		}
+		mode := defaultFilePermissions
+		if info != nil {
+			mode = info.Mode().Perm()
+		}
+		if err := writeFileAtomically(f.path, []byte(updated), defaultDirectoryPermissions, mode, -1, -1); err != nil {
+			return changed, fmt.Errorf("writing entries to %q: %w", f.path, err)
+		}
+		changed = append(changed, f.path)
+	}
+	return changed, nil
+}
+
+// replaceManagedBlock returns contents with its managed block replaced by
+// lines, or removed if there are none. A new block is added at the end.
+func replaceManagedBlock(contents string, lines []string) string {
+	var block string
+	if len(lines) > 0 {
+		block = managedBlockBegin + "\n" + strings.Join(lines, "\n") + "\n" + managedBlockEnd + "\n"
+	}
+	begin := strings.Index(contents, managedBlockBegin+"\n")
+	end := strings.Index(contents, managedBlockEnd+"\n")
+	if begin != -1 && end > begin {
+		return contents[:begin] + block + contents[end+len(managedBlockEnd)+1:]
+	}
+	if block == "" {
+		return contents
+	}
+	if contents != "" && !strings.HasSuffix(contents, "\n") {
+		contents += "\n"
+	}
+	return contents + block
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameResolution(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+	require.Nil(t, os.WriteFile(hostsFilePath, []byte("127.0.0.1 localhost\n10.0.0.9 local.lan"), 0o644))
+
+	// Entries of all fragments are kept, without duplicates
+	base := newDeviceAgentTestConfig(t, "00-base", nil, nil)
+	base.Annotations = map[string]string{MachineConfigNameResolutionAnnotationKey: `{"hosts": ["10.0.0.5 registry.local"], "nameservers": ["10.0.0.53"]}`}
+	site := newDeviceAgentTestConfig(t, "10-site", nil, nil)
+	site.Annotations = map[string]string{MachineConfigNameResolutionAnnotationKey: `{"hosts": ["10.0.0.5  registry.local", "10.0.0.6 mqtt.local"], "search": ["site.local"]}`}
+	result, err := d.RunLayeredInDeviceAgentMode(context.TODO(), nil, "merged", []*mcfgv1.MachineConfig{site, base}, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{hostsFilePath, resolvConfPath}, result.NameResolutionChanged)
+
+	contents, err := os.ReadFile(hostsFilePath)
+	require.Nil(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n10.0.0.9 local.lan\n"+managedBlockBegin+"\n10.0.0.5 registry.local\n10.0.0.6 mqtt.local\n"+managedBlockEnd+"\n", string(contents))
+	contents, err = os.ReadFile(resolvConfPath)
+	require.Nil(t, err)
+	assert.Equal(t, managedBlockBegin+"\nsearch site.local\nnameserver 10.0.0.53\n"+managedBlockEnd+"\n", string(contents))
+
+	// Local lines are kept when the entries go away
+	current, err := d.CurrentConfigInAgentMode()
+	require.Nil(t, err)
+	contents, err = os.ReadFile(hostsFilePath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(hostsFilePath, append([]byte("192.168.1.1 gateway\n"), contents...), 0o644))
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), current, newDeviceAgentTestConfig(t, "new", nil, nil), deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	contents, err = os.ReadFile(hostsFilePath)
+	require.Nil(t, err)
+	assert.Equal(t, "192.168.1.1 gateway\n127.0.0.1 localhost\n10.0.0.9 local.lan\n", string(contents))
+
+	// The resolver only uses the last search line and the first nameservers,
+	// so local domains are searched along and nameservers past them dropped
+	local := "search lan\noptions rotate\nnameserver 192.168.1.1\nnameserver 192.168.1.2\n"
+	require.Nil(t, os.WriteFile(resolvConfPath, []byte(managedBlockBegin+"\nsearch old.local\n"+managedBlockEnd+"\n"+local), 0o644))
+	changed, err := updateNameResolution(nameResolution{Nameservers: []string{"10.0.0.53", "10.0.0.54"}, Search: []string{"site.local", "lan"}, Options: []string{"ndots:2"}})
+	require.Nil(t, err)
+	assert.Equal(t, []string{resolvConfPath}, changed)
+	contents, err = os.ReadFile(resolvConfPath)
+	require.Nil(t, err)
+	assert.Equal(t, local+managedBlockBegin+"\noptions rotate ndots:2\nsearch lan site.local\nnameserver 10.0.0.53\n"+managedBlockEnd+"\n", string(contents))
+
+	// Configs writing the files as a whole can't add entries to them
+	owner := newDeviceAgentTestConfig(t, "owner", []ign3types.File{newDeviceAgentTestFile(t, hostsFilePath, "127.0.0.1 localhost\n")}, nil)
+	owner.Annotations = base.Annotations
+	_, err = d.PlanInDeviceAgentMode(nil, owner, deviceAgentTestSelector)
+	var unreconcilable *ErrUnreconcilable
+	assert.ErrorAs(t, err, &unreconcilable)
+}
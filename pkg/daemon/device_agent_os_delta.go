@@ -0,0 +1,269 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// MachineConfigOSDeltaBundlesAnnotationKey lists delta bundles a fleet server
+// built for the osImageURL of a MachineConfig, as a JSON array of
+// OSDeltaBundles:
+//
+//	[{"from": "quay.io/example/os:1", "url": "https://fleet.example.com/deltas/1-2.ociarchive", "digest": "sha256:..."}]
+//
+// A delta bundle is an OCI archive of the image with only the layers that
+// changed since the image it is built from, which chunked images keep small.
+// Updates in device agent mode from a config with that osImageURL download the
+// bundle rather than pulling the image, and rebase to the archive, reusing the
+// layers already on the host. Downloads are kept in osDeltaBundlesDirPath and
+// resumed where they were interrupted, also across reboots.
+// MergeMachineConfigsInAgentMode merges the bundles of all configs, later
+// configs winning.
+const MachineConfigOSDeltaBundlesAnnotationKey = "machineconfiguration.openshift.io/os-delta-bundles"
+
+// osDeltaBundlesDirPath is where delta bundles are downloaded to. It is on
+// /var, so partial downloads survive reboots.
+var osDeltaBundlesDirPath = "/var/lib/machine-config-daemon/os-deltas"
+
+// OSDeltaBundle is a delta bundle of an OS image.
+type OSDeltaBundle struct {
+	// From is the osImageURL of the old config the bundle applies to.
+	From string `json:"from"`
+	// URL is the http(s) URL the bundle is downloaded from.
+	URL string `json:"url"`
+	// Digest is the sha256 of the bundle, as sha256:<hex>.
+	Digest string `json:"digest"`
+}
+
+var sha256DigestRegexp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// machineConfigOSDeltaBundles returns the bundles of mc's annotation.
+func machineConfigOSDeltaBundles(mc *mcfgv1.MachineConfig) ([]OSDeltaBundle, error) {
+	encoded, ok := mc.GetAnnotations()[MachineConfigOSDeltaBundlesAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var bundles []OSDeltaBundle
+	if err := json.Unmarshal([]byte(encoded), &bundles); err != nil {
+		return nil, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigOSDeltaBundlesAnnotationKey, mc.GetName(), err)
+	}
+	for _, b := range bundles {
+		if b.From == "" || !isRemoteSource(&b.URL) || !sha256DigestRegexp.MatchString(b.Digest) {
+			return nil, fmt.Errorf("invalid delta bundle %+v in %s annotation of MachineConfig %s: needs the image it applies to, an http(s) URL and a sha256 digest", b, MachineConfigOSDeltaBundlesAnnotationKey, mc.GetName())
+		}
+	}
+	return bundles, nil
+}
+
+// machineConfigOSDeltaBundle returns the bundle of mc from the image from, if
+// there is one.
+func machineConfigOSDeltaBundle(mc *mcfgv1.MachineConfig, from string) (*OSDeltaBundle, error) {
+	bundles, err := machineConfigOSDeltaBundles(mc)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bundles {
+		if bundles[i].From == from {
+			return &bundles[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// mergeOSDeltaBundlesAnnotations sets the delta bundles annotation of merged
+// to the bundles of configs, in order of their names, later ones winning.
+func mergeOSDeltaBundlesAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	byFrom := map[string]OSDeltaBundle{}
+	for _, config := range sorted {
+		fragment, err := machineConfigOSDeltaBundles(config)
+		if err != nil {
+			return err
+		}
+		for _, b := range fragment {
+			byFrom[b.From] = b
+		}
+	}
+	if len(byFrom) == 0 {
+		return nil
+	}
+	bundles := make([]OSDeltaBundle, 0, len(byFrom))
+	for _, b := range byFrom {
+		bundles = append(bundles, b)
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].From < bundles[j].From })
+	return setJSONAnnotation(merged, MachineConfigOSDeltaBundlesAnnotationKey, bundles)
+}
+
+// osDeltaBundleImage returns the osImageURL of the downloaded bundle.
+func osDeltaBundleImage(bundle OSDeltaBundle) string {
+	return "oci-archive:" + filepath.Join(osDeltaBundlesDirPath, strings.TrimPrefix(bundle.Digest, "sha256:")+".ociarchive")
+}
+
+// withBootedOSDeltaBundle returns config with its osImageURL replaced by the
+// bundle booted, if the OS was updated to it from one of config's bundles.
+func withBootedOSDeltaBundle(config *mcfgv1.MachineConfig, booted string) (*mcfgv1.MachineConfig, error) {
+	bundles, err := machineConfigOSDeltaBundles(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bundles {
+		if osDeltaBundleImage(b) == booted {
+			config = config.DeepCopy()
+			config.Spec.OSImageURL = booted
+			break
+		}
+	}
+	return config, nil
+}
+
+// fetchOSDeltaBundle downloads bundle, unless it already was, and returns the
+// osImageURL to rebase to. Other bundles are removed, except the booted one.
+func (dn *Daemon) fetchOSDeltaBundle(ctx context.Context, bundle OSDeltaBundle) (string, error) {
+	imgURL := osDeltaBundleImage(bundle)
+	_, path := splitOSImageTransport(imgURL)
+	if err := os.MkdirAll(osDeltaBundlesDirPath, 0o755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		klog.Infof("Using downloaded delta bundle %s", path)
+	} else {
+		fetcher := dn.remoteFetcher
+		if fetcher == nil {
+			var err error
+			if fetcher, err = newRemoteFetcher(DefaultRemoteContentOptions()); err != nil {
+				return "", err
+			}
+		}
+		logSystem("Downloading delta bundle %s to update from %s", bundle.URL, bundle.From)
+		if err := fetcher.fetchResumable(ctx, bundle.URL, path, bundle.Digest); err != nil {
+			return "", fmt.Errorf("downloading delta bundle: %w", err)
+		}
+	}
+
+	entries, err := os.ReadDir(osDeltaBundlesDirPath)
+	if err != nil {
+		return "", err
+	}
+	_, booted := splitOSImageTransport(dn.bootedOSImageURL)
+	for _, e := range entries {
+		stale := filepath.Join(osDeltaBundlesDirPath, e.Name())
+		if stale == path || stale == booted {
+			continue
+		}
+		klog.Infof("Removing stale delta bundle %s", stale)
+		if err := os.Remove(stale); err != nil {
+			klog.Warningf("Failed to remove stale delta bundle: %v", err)
+		}
+	}
+	return imgURL, nil
+}
+
+// fetchResumable downloads source to dest, which must hash to digest. The
+// download goes to dest.partial first, and continues from there with a range
+// request if it was interrupted.
+func (f *remoteFetcher) fetchResumable(ctx context.Context, source, dest, digest string) error {
+	if f.err != nil {
+		return f.err
+	}
+	partial := dest + ".partial"
+	backoff := wait.Backoff{
+		Duration: f.opts.RetryInterval,
+		Factor:   2,
+		Steps:    f.opts.Retries + 1,
+	}
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		if err := f.downloadRange(ctx, source, partial); err != nil {
+			klog.Warningf("Failed to fetch %s: %v", source, err)
+			lastErr = err
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if lastErr == nil || ctx.Err() != nil {
+			lastErr = err
+		}
+		return fmt.Errorf("fetching %s: %w", source, lastErr)
+	}
+
+	got, err := hashFile(partial)
+	if err != nil {
+		return err
+	}
+	if want := "sha256-" + strings.TrimPrefix(digest, "sha256:"); got != want {
+		// Start over next time
+		if err := os.Remove(partial); err != nil {
+			klog.Warningf("Failed to remove corrupt download: %v", err)
+		}
+		return fmt.Errorf("fetching %s: expected %s, got %s", source, want, got)
+	}
+	return os.Rename(partial, dest)
+}
+
+// downloadRange appends what partial is missing of source to it.
+func (f *remoteFetcher) downloadRange(ctx context.Context, source, partial string) error {
+	if f.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.opts.Timeout)
+		defer cancel()
+	}
+	file, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		klog.Infof("Resuming download of %s at %d bytes", source, offset)
+	case http.StatusOK:
+		if offset > 0 {
+			klog.Infof("Server doesn't support resuming the download of %s, starting over", source)
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing left to download
+		return nil
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOSDeltaBundles(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	bundle := []byte("layers changed between os:1 and os:2")
+	sum := sha256.Sum256(bundle)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(bundle))
+	}))
+	defer server.Close()
+
+	ostreeStatus, _ := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 9f2b44.0\n"), 0o644))
+	var runs [][]string
+	d := newMockDeviceAgentDaemon(testDir)
+	d.bootc = &BootcClient{
+		run: func(_ context.Context, args ...string) error {
+			runs = append(runs, args)
+			return nil
+		},
+		output: func(...string) ([]byte, error) {
+			return []byte(`{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}}}}}`), nil
+		},
+	}
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	newConfig.Annotations = map[string]string{MachineConfigOSDeltaBundlesAnnotationKey: `[{"from": "quay.io/example/os:1", "url": "` + server.URL + `/1-2", "digest": "sha256:0000"}]`}
+	_, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector)
+	var unreconcilable *ErrUnreconcilable
+	require.ErrorAs(t, err, &unreconcilable)
+	newConfig.Annotations[MachineConfigOSDeltaBundlesAnnotationKey] = `[{"from": "quay.io/example/os:1", "url": "` + server.URL + `/1-2", "digest": "sha256:` + hex.EncodeToString(sum[:]) + `"}]`
+	result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	require.NotNil(t, result.OSDeltaBundle)
+	assert.Equal(t, server.URL+"/1-2", result.OSDeltaBundle.URL)
+
+	// An interrupted download is resumed
+	imgURL := osDeltaBundleImage(*result.OSDeltaBundle)
+	_, path := splitOSImageTransport(imgURL)
+	require.Nil(t, os.MkdirAll(osDeltaBundlesDirPath, 0o755))
+	require.Nil(t, os.WriteFile(path+".partial", bundle[:6], 0o600))
+	require.Nil(t, os.WriteFile(filepath.Join(osDeltaBundlesDirPath, "stale.ociarchive"), nil, 0o600))
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"bytes=6-"}, ranges)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, bundle, b)
+	assert.NoFileExists(t, path+".partial")
+	assert.NoFileExists(t, filepath.Join(osDeltaBundlesDirPath, "stale.ociarchive"))
+	assert.Contains(t, runs, []string{"switch", "--transport", "oci-archive", path})
+
+	// The booted bundle is the image of the config
+	osConfig, err := withBootedOSDeltaBundle(newConfig, imgURL)
+	require.Nil(t, err)
+	assert.Equal(t, imgURL, osConfig.Spec.OSImageURL)
+
+	// Corrupt downloads start over
+	fetcher, err := newRemoteFetcher(RemoteContentOptions{})
+	require.Nil(t, err)
+	corrupt := filepath.Join(testDir, "corrupt")
+	require.Nil(t, os.WriteFile(corrupt+".partial", []byte("garbage"), 0o600))
+	assert.ErrorContains(t, fetcher.fetchResumable(context.TODO(), server.URL, corrupt, "sha256:"+hex.EncodeToString(sum[:])), "expected sha256-")
+	assert.NoFileExists(t, corrupt+".partial")
+}
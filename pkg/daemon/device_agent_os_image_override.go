@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+)
+
+// osImageOverridePath is where a device can remap the osImageURLs of its
+// configs to the mirror it pulls them from, so a single fleet config serves
+// devices behind different mirrors.
+var osImageOverridePath = "/etc/machine-config-daemon/os-image-override.json"
+
+// osImageOverrides is the contents of osImageOverridePath, e.g.
+//
+//	{"mirrors": [{"source": "quay.io/example", "mirror": "registry.site-a.local:5000/example"}]}
+type osImageOverrides struct {
+	Mirrors []osImageMirror `json:"mirrors"`
+}
+
+// osImageMirror maps the images of Source to Mirror. Source is a repository
+// or prefix of one, matched up to a path, tag or digest separator, or a full
+// image reference; the longest matching source wins. Mirror may also be a
+// local image, e.g. oci:/run/media/update/os.
+type osImageMirror struct {
+	Source string `json:"source"`
+	Mirror string `json:"mirror"`
+}
+
+// OSImageOverride is a remapping of the osImageURL of a config by the
+// override file of the device.
+type OSImageOverride struct {
+	// ConfigOSImageURL is the osImageURL of the config.
+	ConfigOSImageURL string `json:"configOSImageURL"`
+	// OSImageURL is the image used instead.
+	OSImageURL string `json:"osImageURL"`
+}
+
+// loadOSImageOverrides returns the mirrors of osImageOverridePath, or none if
+// there is no such file.
+func loadOSImageOverrides() ([]osImageMirror, error) {
+	b, err := os.ReadFile(osImageOverridePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading OS image overrides: %w", err)
+	}
+	overrides := &osImageOverrides{}
+	if err := json.Unmarshal(b, overrides); err != nil {
+		return nil, fmt.Errorf("parsing OS image overrides %s: %w", osImageOverridePath, err)
+	}
+	for _, m := range overrides.Mirrors {
+		if m.Source == "" || m.Mirror == "" {
+			return nil, fmt.Errorf("parsing OS image overrides %s: mirrors need a source and a mirror", osImageOverridePath)
+		}
+	}
+	return overrides.Mirrors, nil
+}
+
+// overrideOSImageURL returns imgURL remapped by the longest matching source
+// of mirrors, and whether one matched.
+func overrideOSImageURL(imgURL string, mirrors []osImageMirror) (string, bool) {
+	image := strings.TrimPrefix(imgURL, "docker://")
+	var source, mirror string
+	for _, m := range mirrors {
+		src := strings.TrimPrefix(m.Source, "docker://")
+		rest, ok := strings.CutPrefix(image, src)
+		if !ok || (rest != "" && !strings.ContainsAny(rest[:1], "/:@")) {
+			continue
+		}
+		if len(src) > len(source) {
+			source, mirror = src, m.Mirror
+		}
+	}
+	if source == "" {
+		return imgURL, false
+	}
+	return mirror + strings.TrimPrefix(image, source), true
+}
+
+// applyOSImageOverride returns config with its osImageURL remapped by the
+// override file of the device, and the override, if there is one.
+func applyOSImageOverride(config *mcfgv1.MachineConfig) (*mcfgv1.MachineConfig, *OSImageOverride, error) {
+	if config.Spec.OSImageURL == "" {
+		return config, nil, nil
+	}
+	mirrors, err := loadOSImageOverrides()
+	if err != nil {
+		return nil, nil, err
+	}
+	imgURL, ok := overrideOSImageURL(config.Spec.OSImageURL, mirrors)
+	if !ok {
+		return config, nil, nil
+	}
+	override := &OSImageOverride{ConfigOSImageURL: config.Spec.OSImageURL, OSImageURL: imgURL}
+	config = config.DeepCopy()
+	config.Spec.OSImageURL = imgURL
+	return config, override, nil
+}
+
+// osImageChanged returns whether the OS image osConfig updates the OS to
+// differs from the one oldConfig did, both with the kernel type images of bootc
+// hosts and the OS image overrides applied. An old kernel type without an
+// image left the OS on the osImageURL of oldConfig.
+func (dn *Daemon) osImageChanged(oldConfig, osConfig *mcfgv1.MachineConfig) (bool, error) {
+	if _, ok := dn.getOSUpdater().(bootcOSUpdater); ok {
+		if c, err := withKernelTypeOSImage(oldConfig); err == nil {
+			oldConfig = c
+		}
+	}
+	oldConfig, _, err := applyOSImageOverride(oldConfig)
+	if err != nil {
+		return false, err
+	}
+	return oldConfig.Spec.OSImageURL != osConfig.Spec.OSImageURL, nil
+}
@@ -0,0 +1,55 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOSImageOverride(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	mirrors := []osImageMirror{
+		{Source: "quay.io/example", Mirror: "registry.local:5000/example"},
+		{Source: "quay.io/example/os:2", Mirror: "oci:/run/media/update/os"},
+	}
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{url: "quay.io/example/os:1", expected: "registry.local:5000/example/os:1"},
+		{url: "docker://quay.io/example/os@sha256:2f8b", expected: "registry.local:5000/example/os@sha256:2f8b"},
+		{url: "quay.io/example/os:2", expected: "oci:/run/media/update/os"},
+		{url: "quay.io/example-other/os:1", expected: "quay.io/example-other/os:1"},
+	}
+	for _, test := range tests {
+		imgURL, _ := overrideOSImageURL(test.url, mirrors)
+		assert.Equal(t, test.expected, imgURL, test.url)
+	}
+
+	d := newMockDeviceAgentDaemon(testDir)
+	updater := &recordingOSUpdater{}
+	d.SetOSUpdater(updater)
+	require.Nil(t, os.MkdirAll(filepath.Dir(osImageOverridePath), 0o755))
+	require.Nil(t, os.WriteFile(osImageOverridePath, []byte(`{"mirrors": [{"source": "quay.io/example", "mirror": "registry.local:5000/example"}]}`), 0o644))
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, "registry.local:5000/example/os:2", updater.image)
+	assert.Equal(t, &OSImageOverride{ConfigOSImageURL: "quay.io/example/os:2", OSImageURL: "registry.local:5000/example/os:2"}, result.OSImageOverride)
+	assert.Equal(t, "quay.io/example/os:2", newConfig.Spec.OSImageURL)
+
+	// A broken override file fails the update before anything is changed
+	require.Nil(t, os.WriteFile(osImageOverridePath, []byte(`{"mirrors": [{"source": "quay.io/example"}]}`), 0o644))
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.ErrorContains(t, err, "mirrors need a source and a mirror")
+}
@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// OSImagePrefetchPolicy decides how OS images are prefetched in device agent
+// mode.
+type OSImagePrefetchPolicy struct {
+	// Bandwidth caps the prefetch in bytes per second, leaving the services
+	// restarted meanwhile some of the link. If 0, the cap of
+	// WithOSImagePullBandwidth applies.
+	Bandwidth int64
+	// MinAvailableMemory is the memory that needs to be available for the
+	// prefetch to run alongside the update, in bytes. With less, the image is
+	// pulled after the files and units have been applied, as without
+	// prefetching. If 0, defaultPrefetchMinAvailableMemory applies.
+	MinAvailableMemory uint64
+}
+
+// defaultPrefetchMinAvailableMemory is the memory a prefetch needs available
+// by default, enough for the pull to decompress layers without pushing the
+// services restarted meanwhile into reclaim.
+const defaultPrefetchMinAvailableMemory = 512 << 20
+
+// WithOSImagePrefetch makes updates in device agent mode start pulling a
+// changed OS image into the ostree repository while the files and units are
+// applied, so slow links delay the update less. The OS phase then only pulls
+// what the prefetch didn't get to. A failed prefetch doesn't fail the update.
+func WithOSImagePrefetch(policy OSImagePrefetchPolicy) Option {
+	return func(dn *Daemon) {
+		dn.osImagePrefetch = &policy
+	}
+}
+
+// meminfoPath is overridden by tests to fake the available memory.
+var meminfoPath = "/proc/meminfo"
+
+// availableMemory returns MemAvailable of meminfoPath, in bytes.
+func availableMemory() (uint64, error) {
+	f, err := os.Open(meminfoPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "MemAvailable:    3311420 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parsing %s: %w", meminfoPath, err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemAvailable in %s", meminfoPath)
+}
+
+// osImagePrefetch is a prefetch in progress.
+type osImagePrefetch struct {
+	cancel func()
+	done   chan struct{}
+	err    error
+}
+
+// wait returns once the prefetch is done, with its error.
+func (p *osImagePrefetch) wait() error {
+	<-p.done
+	return p.err
+}
+
+// stop cancels the prefetch, if there is one, and waits for it.
+func (p *osImagePrefetch) stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.wait()
+}
+
+// startOSImagePrefetch starts pulling imgURL, or returns nil if it isn't
+// pulled from a registry or too little memory is available.
+func (dn *Daemon) startOSImagePrefetch(ctx context.Context, imgURL string) *osImagePrefetch {
+	if isLocalOSImage(imgURL) {
+		return nil
+	}
+	required := dn.osImagePrefetch.MinAvailableMemory
+	if required == 0 {
+		required = defaultPrefetchMinAvailableMemory
+	}
+	available, err := availableMemory()
+	if err != nil {
+		klog.Warningf("Not prefetching OS image %s: %v", imgURL, err)
+		return nil
+	}
+	if available < required {
+		logSystem("Not prefetching OS image %s, only %d bytes of memory are available", imgURL, available)
+		return nil
+	}
+	bandwidth := dn.osImagePrefetch.Bandwidth
+	if bandwidth == 0 {
+		bandwidth = dn.osImagePullBandwidth
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := &osImagePrefetch{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.err = dn.prefetchOSImage(ctx, imgURL, bandwidth)
+	}()
+	logSystem("Prefetching OS image %s", imgURL)
+	return p
+}
+
+// prefetchOSImage pulls imgURL into the ostree repository, where rpm-ostree
+// and bootc find its layers, capped at bandwidth if it is set. The pull
+// authenticates with the pull secret rpm-ostree uses, if there is one.
+func (dn *Daemon) prefetchOSImage(ctx context.Context, imgURL string, bandwidth int64) error {
+	pull := dn.newOSPull(imgURL)
+	if bandwidth > 0 {
+		proxy, err := startThrottledProxy(bandwidth)
+		if err != nil {
+			return fmt.Errorf("starting OS image pull proxy: %w", err)
+		}
+		defer proxy.Close()
+		pull.proxy = proxy.URL()
+	}
+	ctx = context.WithValue(ctx, osPullContextKey{}, pull)
+	_, image := splitOSImageTransport(imgURL)
+	args := []string{"container", "image", "pull"}
+	if _, err := os.Stat(ostreeAuthFile); err == nil {
+		args = append(args, "--authfile", ostreeAuthFile)
+	}
+	args = append(args, filepath.Join(sysrootPath, "ostree", "repo"), "ostree-unverified-registry:"+image)
+	return runCmdSyncContext(ctx, "ostree", args...)
+}
@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOSImagePrefetch(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	oldMeminfoPath := meminfoPath
+	meminfoPath = filepath.Join(testDir, "meminfo")
+	defer func() { meminfoPath = oldMeminfoPath }()
+	require.Nil(t, os.WriteFile(meminfoPath, []byte("MemTotal:        3990000 kB\nMemAvailable:    1048576 kB\n"), 0o644))
+	available, err := availableMemory()
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1<<30), available)
+
+	ostreeStatus, ostreeCalls := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 9f2b44.0\n"), 0o644))
+	d := newMockDeviceAgentDaemon(testDir)
+	d.bootc = &BootcClient{
+		run: func(context.Context, ...string) error { return nil },
+		output: func(...string) ([]byte, error) {
+			return []byte(`{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}}}}}`), nil
+		},
+	}
+	// The 1 GiB available are enough by default
+	WithOSImagePrefetch(OSImagePrefetchPolicy{})(d)
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "prefetch"), "new")}, nil)
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.OSImagePrefetched)
+	assert.Contains(t, ostreeCalls(), "container image pull "+filepath.Join(sysrootPath, "ostree", "repo")+" ostree-unverified-registry:quay.io/example/os:2\n")
+
+	// Low memory hosts pull the image in the OS phase only
+	WithOSImagePrefetch(OSImagePrefetchPolicy{MinAvailableMemory: 1 << 31})(d)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.OSImagePrefetched)
+	assert.NotContains(t, ostreeCalls(), "container image pull")
+	require.Nil(t, os.WriteFile(meminfoPath, []byte("MemAvailable:    262144 kB\n"), 0o644))
+	WithOSImagePrefetch(OSImagePrefetchPolicy{})(d)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.OSImagePrefetched)
+}
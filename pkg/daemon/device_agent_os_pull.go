@@ -0,0 +1,317 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+// OSImagePullProgress is the progress of the pull of an OS image, as reported
+// by rpm-ostree or bootc. The totals are known once the manifest has been
+// fetched; layers already present on the host aren't counted.
+type OSImagePullProgress struct {
+	Image       string
+	LayersTotal int
+	LayersDone  int
+	BytesTotal  int64
+	BytesDone   int64
+	// ETA is the estimated time until the pull completes, based on the
+	// average rate so far, or 0 if not known yet.
+	ETA time.Duration
+}
+
+// OSImagePullObserver is implemented by UpdateObservers that also want the
+// progress of OS image pulls. OnOSImagePullProgress is called whenever a layer
+// has been fetched.
+type OSImagePullObserver interface {
+	OnOSImagePullProgress(progress OSImagePullProgress)
+}
+
+func (dn *Daemon) notifyOSImagePullProgress(progress OSImagePullProgress) {
+	for _, o := range dn.updateObservers {
+		if po, ok := o.(OSImagePullObserver); ok {
+			po.OnOSImagePullProgress(progress)
+		}
+	}
+}
+
+// WithOSImagePullBandwidth caps the bandwidth of OS image pulls in device
+// agent mode at bytesPerSecond, so they don't starve workload traffic on
+// constrained uplinks. The registry connections of rpm-ostree and bootc are
+// tunneled through a local proxy throttling them, which connects to the
+// registries directly.
+func WithOSImagePullBandwidth(bytesPerSecond int64) Option {
+	return func(dn *Daemon) {
+		dn.osImagePullBandwidth = bytesPerSecond
+	}
+}
+
+var (
+	// e.g. "layers needed: 14 (251.2 MB)", also for ostree chunk and
+	// custom layers
+	layersNeededRegexp = regexp.MustCompile(`layers needed: (\d+) \(([0-9.]+) ([kMGT]?B)\)`)
+	// e.g. "Fetching ostree chunk sha256:2f8b6c (50.1 MB)...done"
+	fetchingLayerRegexp = regexp.MustCompile(`Fetching (?:ostree chunk|layer) sha256:[0-9a-f]+ \(([0-9.]+) ([kMGT]?B)\)`)
+)
+
+// osPullProgress follows the pull of an OS image through the output of
+// rpm-ostree or bootc.
+type osPullProgress struct {
+	progress OSImagePullProgress
+	start    time.Time
+	now      func() time.Time
+}
+
+func newOSPullProgress(image string) *osPullProgress {
+	return &osPullProgress{progress: OSImagePullProgress{Image: image}, start: time.Now(), now: time.Now}
+}
+
+// parseLine updates the progress from a line of output. It returns true if
+// the progress changed.
+func (p *osPullProgress) parseLine(line string) bool {
+	if m := layersNeededRegexp.FindStringSubmatch(line); m != nil {
+		layers, _ := strconv.Atoi(m[1])
+		p.progress.LayersTotal += layers
+		p.progress.BytesTotal += parseSize(m[2], m[3])
+		return true
+	}
+	if m := fetchingLayerRegexp.FindStringSubmatch(line); m != nil {
+		p.progress.LayersDone++
+		p.progress.BytesDone += parseSize(m[1], m[2])
+		p.progress.ETA = 0
+		if remaining := p.progress.BytesTotal - p.progress.BytesDone; remaining > 0 && p.progress.BytesDone > 0 {
+			elapsed := p.now().Sub(p.start)
+			p.progress.ETA = time.Duration(float64(elapsed) / float64(p.progress.BytesDone) * float64(remaining))
+		}
+		return true
+	}
+	return false
+}
+
+// parseSize parses sizes as formatted by glib and ostree, in SI units.
+func parseSize(value, unit string) int64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	multiplier := map[string]float64{"B": 1, "kB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12}[unit]
+	return int64(f * multiplier)
+}
+
+// osPull is attached to the context of the OS phase, so the OS commands
+// report their output and use the throttling proxy.
+type osPull struct {
+	onLine func(line string)
+	proxy  string
+}
+
+type osPullContextKey struct{}
+
+// osPullFrom returns the osPull of ctx, or nil.
+func osPullFrom(ctx context.Context) *osPull {
+	pull, _ := ctx.Value(osPullContextKey{}).(*osPull)
+	return pull
+}
+
+// lineWriter calls onLine for every complete line written to it.
+type lineWriter struct {
+	onLine func(line string)
+	buf    bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.onLine(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// rpmOstreedProxyDropin passes the throttling proxy to rpm-ostreed, which
+// pulls the images rpm-ostree rebases to.
+const rpmOstreedProxyDropin = "/run/systemd/system/rpm-ostreed.service.d/20-mcd-pull-bandwidth.conf"
+
+// setRpmOstreedProxy restarts rpm-ostreed with proxy as its HTTPS proxy, or
+// without one if proxy is empty.
+func setRpmOstreedProxy(proxy string) error {
+	if proxy == "" {
+		if err := os.Remove(rpmOstreedProxyDropin); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(rpmOstreedProxyDropin), 0o755); err != nil {
+			return err
+		}
+		dropin := fmt.Sprintf("[Service]\nEnvironment=HTTPS_PROXY=%s https_proxy=%s\n", proxy, proxy)
+		if err := writeFileAtomicallyWithDefaults(rpmOstreedProxyDropin, []byte(dropin)); err != nil {
+			return err
+		}
+	}
+	if err := runCmdSync("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runCmdSync("systemctl", "restart", "rpm-ostreed")
+}
+
+// newOSPull returns an osPull reporting the progress of the pull of image.
+func (dn *Daemon) newOSPull(image string) *osPull {
+	progress := newOSPullProgress(image)
+	return &osPull{onLine: func(line string) {
+		if progress.parseLine(line) {
+			dn.notifyOSImagePullProgress(progress.progress)
+		}
+	}}
+}
+
+// startOSPull returns the context for the OS commands pulling image, which
+// reports the progress of the pull and throttles it if a bandwidth cap is
+// set. The returned function stops throttling.
+func (dn *Daemon) startOSPull(ctx context.Context, image string) (context.Context, func(), error) {
+	pull := dn.newOSPull(image)
+	stop := func() {}
+	if dn.osImagePullBandwidth > 0 {
+		proxy, err := startThrottledProxy(dn.osImagePullBandwidth)
+		if err != nil {
+			return nil, nil, fmt.Errorf("starting OS image pull proxy: %w", err)
+		}
+		pull.proxy = proxy.URL()
+		stop = func() { proxy.Close() }
+		if _, ok := dn.getOSUpdater().(rpmOstreeOSUpdater); ok {
+			if err := setRpmOstreedProxy(pull.proxy); err != nil {
+				proxy.Close()
+				return nil, nil, fmt.Errorf("passing OS image pull proxy to rpm-ostreed: %w", err)
+			}
+			stop = func() {
+				if err := setRpmOstreedProxy(""); err != nil {
+					klog.Warningf("Failed to remove OS image pull proxy from rpm-ostreed: %v", err)
+				}
+				proxy.Close()
+			}
+		}
+		logSystem("Capping OS image pull bandwidth at %d bytes/s", dn.osImagePullBandwidth)
+	}
+	return context.WithValue(ctx, osPullContextKey{}, pull), stop, nil
+}
+
+// throttledProxy is an HTTP CONNECT proxy on localhost capping the combined
+// bandwidth of the connections through it.
+type throttledProxy struct {
+	listener net.Listener
+	server   *http.Server
+	limiter  *rate.Limiter
+	burst    int
+}
+
+func startThrottledProxy(bytesPerSecond int64) (*throttledProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	burst := 32 * 1024
+	p := &throttledProxy{listener: listener, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst), burst: burst}
+	p.server = &http.Server{Handler: p, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := p.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Warningf("OS image pull proxy failed: %v", err)
+		}
+	}()
+	return p, nil
+}
+
+// URL returns the URL of the proxy.
+func (p *throttledProxy) URL() string {
+	return "http://" + p.listener.Addr().String()
+}
+
+// Close stops the proxy from accepting connections.
+func (p *throttledProxy) Close() error {
+	return p.server.Close()
+}
+
+func (p *throttledProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// What the client sent along with the request comes first
+		io.Copy(upstream, io.MultiReader(io.LimitReader(buffered, int64(buffered.Reader.Buffered())), client))
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, &throttledReader{ctx: r.Context(), r: upstream, proxy: p})
+		client.Close()
+	}()
+	wg.Wait()
+	upstream.Close()
+}
+
+// throttledReader reads from r no faster than the limiter of proxy allows,
+// until ctx is done.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	proxy *throttledProxy
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > t.proxy.burst {
+		b = b[:t.proxy.burst]
+	}
+	n, err := t.r.Read(b)
+	if n > 0 {
+		if werr := t.proxy.limiter.WaitN(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
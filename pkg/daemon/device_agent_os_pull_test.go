@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOSImagePullProgress(t *testing.T) {
+	clock := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	progress := newOSPullProgress("quay.io/example/os:2")
+	progress.start = clock
+	progress.now = func() time.Time { return clock }
+
+	var reported []OSImagePullProgress
+	pull := &osPull{onLine: func(line string) {
+		if progress.parseLine(line) {
+			reported = append(reported, progress.progress)
+		}
+	}}
+	ctx := context.WithValue(context.Background(), osPullContextKey{}, pull)
+	output := `Pulling manifest: ostree-unverified-registry:quay.io/example/os:2
+ostree chunk layers already present: 51
+ostree chunk layers needed: 2 (300.0 MB)
+custom layers needed: 1 (100 MB)
+`
+	require.Nil(t, runCmdSyncContext(ctx, "printf", "%s", output))
+	require.Len(t, reported, 2)
+	assert.Equal(t, OSImagePullProgress{Image: "quay.io/example/os:2", LayersTotal: 3, BytesTotal: 400e6}, reported[1])
+
+	clock = clock.Add(10 * time.Second)
+	require.Nil(t, runCmdSyncContext(ctx, "printf", "%s", "Fetching ostree chunk sha256:2f8b6c (100.0 MB)...done\n"))
+	require.Len(t, reported, 3)
+	assert.Equal(t, 1, reported[2].LayersDone)
+	assert.Equal(t, int64(100e6), reported[2].BytesDone)
+	assert.Equal(t, 30*time.Second, reported[2].ETA)
+
+	// The proxy caps the bandwidth and is passed to the OS commands
+	proxy, err := startThrottledProxy(64 * 1024)
+	require.Nil(t, err)
+	defer proxy.Close()
+	pull.proxy = proxy.URL()
+	var lines []string
+	pull.onLine = func(line string) { lines = append(lines, line) }
+	require.Nil(t, runCmdSyncContext(ctx, "sh", "-c", "echo $HTTPS_PROXY"))
+	assert.Equal(t, []string{proxy.URL()}, lines)
+
+	body := bytes.Repeat([]byte("x"), 96*1024)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+	client := server.Client()
+	proxyURL, err := url.Parse(proxy.URL())
+	require.Nil(t, err)
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	received, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, body, received)
+	// The first 32 KiB pass right away, the rest at 64 KiB/s
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
@@ -0,0 +1,261 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// deploymentConfigsDirPath has the config each ostree deployment ran when an
+// update in device agent mode staged OS changes on it, by deployment ID. It is
+// in /var, which the deployments share.
+var deploymentConfigsDirPath = "/var/lib/machine-config-daemon/deployment-configs"
+
+// ostreeDeployDir has the deployments of each stateroot, as
+// <stateroot>/deploy/<checksum>.<serial>.
+var ostreeDeployDir = "/sysroot/ostree/deploy"
+
+// recordDeploymentConfig records config as the config of the deployment with
+// id, and drops the records of deployments that no longer exist.
+func (dn *Daemon) recordDeploymentConfig(id string, config *mcfgv1.MachineConfig) error {
+	ids, _, err := dn.ostreeDeployments()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(deploymentConfigsDirPath, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(deploymentConfigsDirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !ctrlcommon.InSlice(strings.TrimSuffix(entry.Name(), ".json"), ids) {
+			if err := os.Remove(filepath.Join(deploymentConfigsDirPath, entry.Name())); err != nil {
+				klog.Warningf("Failed to remove config of removed deployment: %v", err)
+			}
+		}
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomicallyWithDefaults(filepath.Join(deploymentConfigsDirPath, id+".json"), b); err != nil {
+		return fmt.Errorf("recording config of deployment %s: %w", id, err)
+	}
+	return nil
+}
+
+// loadDeploymentConfig returns the config recorded for the deployment with
+// id, or nil.
+func loadDeploymentConfig(id string) (*mcfgv1.MachineConfig, error) {
+	b, err := os.ReadFile(filepath.Join(deploymentConfigsDirPath, id+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config of deployment %s: %w", id, err)
+	}
+	config := &mcfgv1.MachineConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("parsing config of deployment %s: %w", id, err)
+	}
+	return config, nil
+}
+
+// ostreeDeploymentRoot returns the root directory of the deployment with id.
+func ostreeDeploymentRoot(id string) (string, error) {
+	roots, err := filepath.Glob(filepath.Join(ostreeDeployDir, "*", "deploy", id))
+	if err != nil {
+		return "", err
+	}
+	if len(roots) == 0 {
+		return "", fmt.Errorf("deployment %s not found in %s", id, ostreeDeployDir)
+	}
+	return roots[0], nil
+}
+
+// restoreDeploymentConfig stores config as the current config of the
+// deployment below root, with its digest, and drops the boot health check of
+// the current config, which would fail there.
+func (dn *Daemon) restoreDeploymentConfig(root string, config *mcfgv1.MachineConfig) error {
+	mcJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(root, dn.currentConfigPath)
+	if err := os.MkdirAll(filepath.Dir(configPath), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomicallyWithDefaults(configPath, mcJSON); err != nil {
+		return fmt.Errorf("restoring current config: %w", err)
+	}
+	if err := dn.writeCurrentConfigDigestAt(root); err != nil {
+		return fmt.Errorf("restoring current config digest: %w", err)
+	}
+	for _, path := range []string{greenbootCheckPath, bootHealthPath} {
+		if err := os.Remove(filepath.Join(root, path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// withWritableSysroot runs fn in a private mount namespace in which sysroot,
+// which ostree mounts read-only, is remounted writable, as ostree does to
+// write deployments. The rest of the host never sees it writable. It is a
+// variable for tests.
+var withWritableSysroot = func(fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		// The thread stays locked and in the namespace, so the runtime
+		// discards it when the goroutine returns
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+			errCh <- fmt.Errorf("creating mount namespace: %w", err)
+			return
+		}
+		if err := unix.Mount("none", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+			errCh <- fmt.Errorf("making mounts private: %w", err)
+			return
+		}
+		if err := unix.Mount("none", sysrootPath, "", unix.MS_REMOUNT|unix.MS_RELATIME, ""); err != nil {
+			errCh <- fmt.Errorf("remounting %s writable: %w", sysrootPath, err)
+			return
+		}
+		errCh <- fn()
+	}()
+	return <-errCh
+}
+
+// RollbackOS rolls back the OS in device agent mode and keeps the config
+// stored on disk in sync with it, so the daemon doesn't take the rolled back
+// config for the current one. A staged OS update is discarded, and the config
+// the booted deployment ran is stored as current config again. Otherwise the
+// previous deployment is queued for the next boot, with the config it ran as
+// its current config. Only the current config is restored: the files the
+// rolled back update wrote to /etc are kept until a config is applied again.
+// It returns the name of the config rolled back to; reason is logged and
+// reported.
+func (dn *Daemon) RollbackOS(reason string) (string, error) {
+	name, _, err := dn.rollbackOS(reason)
+	return name, err
+}
+
+// RollbackOSAndReboot is like RollbackOS, but also reboots into the previous
+// deployment, unless only a staged OS update was discarded.
+func (dn *Daemon) RollbackOSAndReboot(reason string) (string, error) {
+	name, reboot, err := dn.rollbackOS(reason)
+	if err != nil || !reboot {
+		return name, err
+	}
+	rationale := fmt.Sprintf("Rolling back OS to config %s: %s", name, reason)
+	dn.getStatusReporter().Eventf(corev1.EventTypeNormal, "Reboot", rationale)
+	logSystem("initiating reboot: %s", rationale)
+	if err := runRebootCommand(rationale); err != nil {
+		return name, fmt.Errorf("reboot command failed: %w", err)
+	}
+	return name, nil
+}
+
+// rollbackOS implements RollbackOS. It returns true if the system needs a
+// reboot into the previous deployment.
+func (dn *Daemon) rollbackOS(reason string) (string, bool, error) {
+	if !dn.updatesOSWithOstree() {
+		return "", false, fmt.Errorf("rolling back the OS is only supported on hosts updated with rpm-ostree or bootc")
+	}
+	release, err := acquireUpdateLock()
+	if err != nil {
+		return "", false, err
+	}
+	defer release()
+
+	ids, booted, err := dn.ostreeDeployments()
+	if err != nil {
+		return "", false, err
+	}
+	if booted < 0 {
+		return "", false, fmt.Errorf("no booted deployment found")
+	}
+	staged, err := dn.getOSUpdater().HasStagedUpdate()
+	if err != nil {
+		return "", false, err
+	}
+	target := booted
+	if !staged {
+		target = -1
+		for i := range ids {
+			if i != booted {
+				target = i
+				break
+			}
+		}
+		if target < 0 {
+			return "", false, fmt.Errorf("no previous deployment to roll back to")
+		}
+	}
+	config, err := loadDeploymentConfig(ids[target])
+	if err != nil {
+		return "", false, err
+	}
+	if config == nil {
+		return "", false, fmt.Errorf("no config recorded for deployment %s", ids[target])
+	}
+
+	// The config is stored in the /etc the deployment boots with
+	etcRoot := ""
+	if staged {
+		if err := dn.getOSUpdater().DiscardStagedUpdate(); err != nil {
+			return "", false, fmt.Errorf("removing staged deployment: %w", err)
+		}
+		if err := os.Remove(stagedUpdatePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", false, fmt.Errorf("removing staged update: %w", err)
+		}
+		if reporter, ok := dn.getStatusReporter().(StagedUpdateReporter); ok {
+			if err := reporter.SetStaged(""); err != nil {
+				klog.Errorf("Error reporting discarded staged update: %v", err)
+			}
+		}
+	} else {
+		if etcRoot, err = ostreeDeploymentRoot(ids[target]); err != nil {
+			return "", false, err
+		}
+		switch u := dn.getOSUpdater().(type) {
+		case rpmOstreeOSUpdater:
+			err = runCmdSync("rpm-ostree", "rollback")
+		case bootcOSUpdater:
+			err = u.bootc.Rollback()
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("rolling back to deployment %s: %w", ids[target], err)
+		}
+	}
+
+	restore := func() error {
+		return dn.restoreDeploymentConfig(etcRoot, config)
+	}
+	if etcRoot != "" {
+		// The /etc of other deployments is below the read-only /sysroot
+		err = withWritableSysroot(restore)
+	} else {
+		err = restore()
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	dn.getStatusReporter().Eventf(corev1.EventTypeWarning, "OSRollback", "Rolled back OS to config %s: %s", config.GetName(), reason)
+	logSystem("Rolled back OS to deployment %s and config %s: %s", ids[target], config.GetName(), reason)
+	return config.GetName(), !staged, nil
+}
@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollbackOS(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	ostreeStatus, ostreeCalls := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 3c1e5a.0\n  fedora 9f2b44.0 (rollback)\n"), 0o644))
+	bootcStatus := `{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:2", "transport": "registry"}}}}}`
+	var runs [][]string
+	d := newMockDeviceAgentDaemon(testDir)
+	d.bootc = &BootcClient{
+		run: func(_ context.Context, args ...string) error {
+			runs = append(runs, args)
+			return nil
+		},
+		output: func(...string) ([]byte, error) { return []byte(bootcStatus), nil },
+	}
+
+	_, err := d.RollbackOS("broken")
+	assert.ErrorContains(t, err, "no config recorded for deployment 9f2b44.0")
+	assert.Empty(t, runs)
+
+	// The previous deployment boots with the config it ran
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	require.Nil(t, d.recordDeploymentConfig("9f2b44.0", oldConfig))
+	root := filepath.Join(ostreeDeployDir, "fedora", "deploy", "9f2b44.0")
+	require.Nil(t, os.MkdirAll(root, 0o755))
+	currentConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	require.Nil(t, d.storeCurrentConfigOnDisk(&onDiskConfig{currentConfig: currentConfig}))
+	name, err := d.RollbackOS("broken")
+	require.Nil(t, err)
+	assert.Equal(t, "old", name)
+	assert.Equal(t, [][]string{{"rollback"}}, runs)
+	assert.Empty(t, ostreeCalls())
+	b, err := os.ReadFile(filepath.Join(root, d.currentConfigPath))
+	require.Nil(t, err)
+	assert.Contains(t, string(b), `"name":"old"`)
+	digest, err := os.ReadFile(filepath.Join(root, d.currentConfigDigestPath()))
+	require.Nil(t, err)
+	hash, err := fileSHA256(filepath.Join(root, d.currentConfigPath))
+	require.Nil(t, err)
+	assert.Equal(t, hash+"\n", string(digest))
+	current, err := d.CurrentConfigInAgentMode()
+	require.Nil(t, err)
+	assert.Equal(t, "new", current.GetName())
+
+	// A staged update is discarded, going back to the config of the booted
+	// deployment
+	runs = nil
+	bootcStatus = `{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:2", "transport": "registry"}}}, "staged": {"image": {"image": {"image": "quay.io/example/os:3", "transport": "registry"}}}}}`
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("  fedora 77bb02.0 (staged)\n* fedora 3c1e5a.0\n  fedora 9f2b44.0 (rollback)\n"), 0o644))
+	require.Nil(t, d.recordDeploymentConfig("3c1e5a.0", currentConfig))
+	assert.FileExists(t, filepath.Join(deploymentConfigsDirPath, "9f2b44.0.json"))
+	require.Nil(t, d.storeCurrentConfigOnDisk(&onDiskConfig{currentConfig: newDeviceAgentTestConfig(t, "newer", nil, nil)}))
+	name, err = d.RollbackOSAndReboot("broken")
+	require.Nil(t, err)
+	assert.Equal(t, "new", name)
+	assert.Empty(t, runs)
+	assert.Equal(t, "admin undeploy 0\n", ostreeCalls())
+	current, err = d.CurrentConfigInAgentMode()
+	require.Nil(t, err)
+	assert.Equal(t, "new", current.GetName())
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+)
+
+// OSChangeSet are the OS level changes of an update.
+type OSChangeSet struct {
+	OSImageURL      bool
+	KernelArguments bool
+	KernelType      bool
+	Extensions      bool
+}
+
+// osChangeSet returns the OS level changes of the diff.
+func (mcDiff *machineConfigDiff) osChangeSet() OSChangeSet {
+	return OSChangeSet{
+		OSImageURL:      mcDiff.osUpdate,
+		KernelArguments: mcDiff.kargs,
+		KernelType:      mcDiff.kernelType,
+		Extensions:      mcDiff.extensions,
+	}
+}
+
+// OSUpdater stages OS updates in device agent mode. The daemon picks
+// rpm-ostree on CoreOS hosts, bootc on image mode hosts without rpm-ostree and
+// leaves the OS alone elsewhere. Embedders can set their own with
+// SetOSUpdater to update the OS by other means, e.g. RAUC or swupdate, and
+// still have the daemon update files, units and SSH keys.
+type OSUpdater interface {
+	// CheckOSChanges returns an error if the changes can't be made, which
+	// makes the update unreconcilable.
+	CheckOSChanges(changes OSChangeSet) error
+	// ApplyOSChanges stages the OS of newConfig for the next boot. It is
+	// called for all updates selecting the OS image or kernel arguments, also
+	// those without OS changes, and must stop once ctx is done.
+	ApplyOSChanges(ctx context.Context, changes OSChangeSet, oldConfig, newConfig *mcfgv1.MachineConfig) error
+	// HasStagedUpdate returns true if an OS update is staged for the next
+	// boot.
+	HasStagedUpdate() (bool, error)
+	// DiscardStagedUpdate removes the staged OS update, if any, when an
+	// update is rolled back.
+	DiscardStagedUpdate() error
+}
+
+// SetOSUpdater sets the OSUpdater used by updates in device agent mode,
+// replacing the one picked for the host.
+func (dn *Daemon) SetOSUpdater(updater OSUpdater) {
+	dn.osUpdater = updater
+}
+
+// getOSUpdater returns the configured OSUpdater, defaulting to the one of the
+// host.
+func (dn *Daemon) getOSUpdater() OSUpdater {
+	switch {
+	case dn.osUpdater != nil:
+		return dn.osUpdater
+	case dn.bootc != nil:
+		return bootcOSUpdater{dn.bootc}
+	case dn.os.IsCoreOSVariant() && dn.NodeUpdaterClient != nil:
+		return rpmOstreeOSUpdater{dn}
+	}
+	return noopOSUpdater{}
+}
+
+// updatesOS returns false if the OS isn't updated at all.
+func (dn *Daemon) updatesOS() bool {
+	_, noop := dn.getOSUpdater().(noopOSUpdater)
+	return !noop
+}
+
+// updatesOSWithOstree returns true if the OS is updated with ostree
+// deployments, which can be pinned and have their finalization locked.
+func (dn *Daemon) updatesOSWithOstree() bool {
+	switch dn.getOSUpdater().(type) {
+	case rpmOstreeOSUpdater, bootcOSUpdater:
+		return true
+	}
+	return false
+}
+
+// rpmOstreeOSUpdater updates the OS of CoreOS hosts with rpm-ostree.
+type rpmOstreeOSUpdater struct {
+	dn *Daemon
+}
+
+func (u rpmOstreeOSUpdater) CheckOSChanges(changes OSChangeSet) error {
+	// switchKernel leaves the kernel alone elsewhere
+	if changes.KernelType && !u.dn.os.IsEL() {
+		return fmt.Errorf("the kernel type can only be changed on RHEL CoreOS and CentOS Stream CoreOS hosts")
+	}
+	return nil
+}
+
+func (u rpmOstreeOSUpdater) ApplyOSChanges(ctx context.Context, changes OSChangeSet, oldConfig, newConfig *mcfgv1.MachineConfig) error {
+	if u.dn.extensionsRepoDir != "" && newConfig.Spec.BaseOSExtensionsContainerImage == "" && (changes.OSImageURL || changes.Extensions || changes.KernelType) {
+		remove, err := addLocalExtensionsRepo(u.dn.extensionsRepoDir)
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+	diff := machineConfigDiff{
+		osUpdate:   changes.OSImageURL,
+		kargs:      changes.KernelArguments,
+		kernelType: changes.KernelType,
+		extensions: changes.Extensions,
+	}
+	coreOSDaemon := CoreOSDaemon{u.dn}
+	return coreOSDaemon.applyOSChanges(ctx, diff, oldConfig, newConfig)
+}
+
+func (u rpmOstreeOSUpdater) HasStagedUpdate() (bool, error) {
+	_, staged, err := u.dn.NodeUpdaterClient.GetBootedAndStagedDeployment()
+	if err != nil {
+		return false, fmt.Errorf("querying deployments: %w", err)
+	}
+	return staged != nil, nil
+}
+
+func (rpmOstreeOSUpdater) DiscardStagedUpdate() error {
+	return removePendingDeployment()
+}
+
+// bootcOSUpdater updates the OS of image mode hosts with bootc.
+type bootcOSUpdater struct {
+	bootc *BootcClient
+}
+
+func (u bootcOSUpdater) CheckOSChanges(changes OSChangeSet) error {
+	return checkBootcOSChanges(changes)
+}
+
+func (u bootcOSUpdater) ApplyOSChanges(ctx context.Context, changes OSChangeSet, _, newConfig *mcfgv1.MachineConfig) error {
+	if !changes.OSImageURL && !changes.KernelType {
+		return nil
+	}
+	return u.bootc.Switch(ctx, newConfig.Spec.OSImageURL)
+}
+
+func (u bootcOSUpdater) HasStagedUpdate() (bool, error) {
+	staged, err := u.bootc.HasStagedDeployment()
+	if err != nil {
+		return false, fmt.Errorf("querying deployments: %w", err)
+	}
+	return staged, nil
+}
+
+func (u bootcOSUpdater) DiscardStagedUpdate() error {
+	return u.bootc.discardStaged()
+}
+
+// noopOSUpdater leaves the OS alone, on hosts whose OS the daemon can't
+// update.
+type noopOSUpdater struct{}
+
+func (noopOSUpdater) CheckOSChanges(OSChangeSet) error { return nil }
+
+func (noopOSUpdater) ApplyOSChanges(context.Context, OSChangeSet, *mcfgv1.MachineConfig, *mcfgv1.MachineConfig) error {
+	return nil
+}
+
+func (noopOSUpdater) HasStagedUpdate() (bool, error) { return false, nil }
+
+func (noopOSUpdater) DiscardStagedUpdate() error { return nil }
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingOSUpdater records the OS changes it is asked to make.
+type recordingOSUpdater struct {
+	check     error
+	apply     error
+	applied   []OSChangeSet
+	image     string
+	discarded int
+}
+
+func (u *recordingOSUpdater) CheckOSChanges(OSChangeSet) error { return u.check }
+
+func (u *recordingOSUpdater) ApplyOSChanges(_ context.Context, changes OSChangeSet, _, newConfig *mcfgv1.MachineConfig) error {
+	u.applied = append(u.applied, changes)
+	u.image = newConfig.Spec.OSImageURL
+	return u.apply
+}
+
+func (u *recordingOSUpdater) HasStagedUpdate() (bool, error) { return false, nil }
+
+func (u *recordingOSUpdater) DiscardStagedUpdate() error {
+	u.discarded++
+	return nil
+}
+
+func TestOSUpdater(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	updater := &recordingOSUpdater{}
+	d.SetOSUpdater(updater)
+
+	filePath := filepath.Join(testDir, "etc", "os-updater")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, filePath, "old")}, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, filePath, "new")}, nil)
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"Upgrading OS"}, result.OSChanges)
+	assert.Equal(t, OSChangeSet{OSImageURL: true}, updater.applied[len(updater.applied)-1])
+	assert.Equal(t, "quay.io/example/os:2", updater.image)
+	assert.Zero(t, updater.discarded)
+
+	// A failed OS update is rolled back with the files
+	updater.apply = errors.New("no space left")
+	newerConfig := newDeviceAgentTestConfig(t, "newer", []ign3types.File{newDeviceAgentTestFile(t, filePath, "newer")}, nil)
+	newerConfig.Spec.OSImageURL = "quay.io/example/os:3"
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newerConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	var osErr *ErrOSUpdateFailed
+	require.ErrorAs(t, err, &osErr)
+	assert.Equal(t, 1, updater.discarded)
+	contents, err := os.ReadFile(filePath)
+	require.Nil(t, err)
+	assert.Equal(t, "new", string(contents))
+
+	// OS changes the updater can't make are unreconcilable
+	updater.apply = nil
+	updater.check = errors.New("kernel arguments are fixed")
+	newerConfig.Spec.OSImageURL = newConfig.Spec.OSImageURL
+	newerConfig.Spec.KernelArguments = []string{"quiet"}
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newerConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	var unreconcilable *ErrUnreconcilable
+	require.ErrorAs(t, err, &unreconcilable)
+}
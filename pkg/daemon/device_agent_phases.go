@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/klog/v2"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// MachineConfigApplyPhasesAnnotationKey orders how device agent mode applies a
+// MachineConfig, as a JSON list of phases:
+//
+//	[{"name": "network", "files": ["/etc/NetworkManager"], "units": ["NetworkManager.service"], "target": "network-online.target", "timeout": "5m"}]
+//
+// The files, given as paths or directories they are under, and units of each
+// phase are written and their units restarted before those of the next
+// phase, and the phase's target is started and waited for, up to its timeout
+// (5 minutes by default), so e.g. the network is up before workloads relying
+// on it are restarted. Changes that aren't part of a phase are applied
+// last. Phases are only applied if the daemon manages systemd units.
+// MergeMachineConfigsInAgentMode keeps the phases of all configs, in order of
+// the configs' names, merging phases of the same name.
+const MachineConfigApplyPhasesAnnotationKey = "machineconfiguration.openshift.io/apply-phases"
+
+// defaultApplyPhaseTimeout is how long the target of a phase is waited for by
+// default.
+const defaultApplyPhaseTimeout = 5 * time.Minute
+
+// applyPhase is a phase of the apply phases annotation.
+type applyPhase struct {
+	Name    string   `json:"name"`
+	Files   []string `json:"files,omitempty"`
+	Units   []string `json:"units,omitempty"`
+	Target  string   `json:"target,omitempty"`
+	Timeout string   `json:"timeout,omitempty"`
+}
+
+// applyPhaseStep is the config a phase takes the system to: the old config
+// with the changes of the phase and the ones before it.
+type applyPhaseStep struct {
+	phase     applyPhase
+	timeout   time.Duration
+	ignConfig ign3types.Config
+}
+
+// machineConfigApplyPhases returns the phases of mc's annotation.
+func machineConfigApplyPhases(mc *mcfgv1.MachineConfig) ([]applyPhase, error) {
+	var phases []applyPhase
+	encoded, ok := mc.GetAnnotations()[MachineConfigApplyPhasesAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &phases); err != nil {
+		return nil, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigApplyPhasesAnnotationKey, mc.GetName(), err)
+	}
+	seen := map[string]struct{}{}
+	for _, phase := range phases {
+		if phase.Name == "" {
+			return nil, fmt.Errorf("phase without a name in %s annotation of MachineConfig %s", MachineConfigApplyPhasesAnnotationKey, mc.GetName())
+		}
+		if _, ok := seen[phase.Name]; ok {
+			return nil, fmt.Errorf("duplicate phase %s in %s annotation of MachineConfig %s", phase.Name, MachineConfigApplyPhasesAnnotationKey, mc.GetName())
+		}
+		seen[phase.Name] = struct{}{}
+		if phase.Target != "" && !strings.HasSuffix(phase.Target, ".target") {
+			return nil, fmt.Errorf("phase %s in %s annotation of MachineConfig %s waits for %q, which isn't a target", phase.Name, MachineConfigApplyPhasesAnnotationKey, mc.GetName(), phase.Target)
+		}
+		if _, err := applyPhaseTimeout(phase); err != nil {
+			return nil, fmt.Errorf("phase %s in %s annotation of MachineConfig %s: %w", phase.Name, MachineConfigApplyPhasesAnnotationKey, mc.GetName(), err)
+		}
+	}
+	return phases, nil
+}
+
+func applyPhaseTimeout(phase applyPhase) (time.Duration, error) {
+	if phase.Timeout == "" {
+		return defaultApplyPhaseTimeout, nil
+	}
+	timeout, err := time.ParseDuration(phase.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %w", err)
+	}
+	return timeout, nil
+}
+
+// mergeApplyPhasesAnnotations sets the apply phases annotation of merged to
+// the phases of configs, in order of their names. Phases of the same name
+// are merged where they first appear, later configs adding files and units
+// and replacing the target and timeout.
+func mergeApplyPhasesAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	var phases []applyPhase
+	for _, config := range sorted {
+		fragment, err := machineConfigApplyPhases(config)
+		if err != nil {
+			return err
+		}
+		for _, phase := range fragment {
+			i := 0
+			for i < len(phases) && phases[i].Name != phase.Name {
+				i++
+			}
+			if i == len(phases) {
+				phases = append(phases, phase)
+				continue
+			}
+			phases[i].Files = appendMissing(phases[i].Files, phase.Files)
+			phases[i].Units = appendMissing(phases[i].Units, phase.Units)
+			if phase.Target != "" {
+				phases[i].Target = phase.Target
+			}
+			if phase.Timeout != "" {
+				phases[i].Timeout = phase.Timeout
+			}
+		}
+	}
+	if len(phases) == 0 {
+		return nil
+	}
+	return setJSONAnnotation(merged, MachineConfigApplyPhasesAnnotationKey, phases)
+}
+
+// inApplyPhase returns true if path is one of the files of phase or under one
+// of its directories.
+func inApplyPhase(phase applyPhase, path string) bool {
+	for _, p := range phase.Files {
+		p = strings.TrimSuffix(p, "/")
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// planApplyPhases returns the configs the phases take the system to, one
+// after the other, on the way from oldIgnConfig to newIgnConfig. Files,
+// links and units belong to the first phase listing them.
+func planApplyPhases(phases []applyPhase, oldIgnConfig, newIgnConfig ign3types.Config) []applyPhaseStep {
+	var steps []applyPhaseStep
+	var done []applyPhase
+	for _, phase := range phases {
+		done = append(done, phase)
+		inPhases := func(path string) bool {
+			for _, p := range done {
+				if inApplyPhase(p, path) {
+					return true
+				}
+			}
+			return false
+		}
+		unitInPhases := func(name string) bool {
+			for _, p := range done {
+				if ctrlcommon.InSlice(name, p.Units) {
+					return true
+				}
+			}
+			return false
+		}
+
+		step := oldIgnConfig
+		step.Storage.Directories = newIgnConfig.Storage.Directories
+		step.Storage.Files = nil
+		for _, f := range oldIgnConfig.Storage.Files {
+			if !inPhases(f.Path) {
+				step.Storage.Files = append(step.Storage.Files, f)
+			}
+		}
+		for _, f := range newIgnConfig.Storage.Files {
+			if inPhases(f.Path) {
+				step.Storage.Files = append(step.Storage.Files, f)
+			}
+		}
+		step.Storage.Links = nil
+		for _, l := range oldIgnConfig.Storage.Links {
+			if !inPhases(l.Path) {
+				step.Storage.Links = append(step.Storage.Links, l)
+			}
+		}
+		for _, l := range newIgnConfig.Storage.Links {
+			if inPhases(l.Path) {
+				step.Storage.Links = append(step.Storage.Links, l)
+			}
+		}
+		step.Systemd.Units = nil
+		for _, u := range oldIgnConfig.Systemd.Units {
+			if !unitInPhases(u.Name) {
+				step.Systemd.Units = append(step.Systemd.Units, u)
+			}
+		}
+		for _, u := range newIgnConfig.Systemd.Units {
+			if unitInPhases(u.Name) {
+				step.Systemd.Units = append(step.Systemd.Units, u)
+			}
+		}
+		timeout, _ := applyPhaseTimeout(phase)
+		steps = append(steps, applyPhaseStep{phase: phase, timeout: timeout, ignConfig: step})
+	}
+	return steps
+}
+
+// waitForTarget starts target and waits for it to be reached, which is when
+// the units it pulls in have started.
+func waitForTarget(ctx context.Context, target string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	klog.Infof("Waiting up to %v for %s to be reached", timeout, target)
+	out, err := exec.CommandContext(ctx, "systemctl", "start", target).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s not reached within %v", target, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("starting %s: %s: %w", target, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyPhases(t *testing.T) {
+	// Phases of the same name are merged, in order of the configs' names
+	base := newDeviceAgentTestConfig(t, "00-base", nil, nil)
+	base.Annotations = map[string]string{MachineConfigApplyPhasesAnnotationKey: `[{"name": "network", "files": ["/etc/NetworkManager"], "target": "network-online.target"}, {"name": "workloads", "units": ["app.service"]}]`}
+	site := newDeviceAgentTestConfig(t, "10-site", nil, nil)
+	site.Annotations = map[string]string{MachineConfigApplyPhasesAnnotationKey: `[{"name": "network", "units": ["NetworkManager.service"], "timeout": "1m"}]`}
+	merged, err := MergeMachineConfigsInAgentMode("merged", []*mcfgv1.MachineConfig{site, base})
+	require.Nil(t, err)
+	phases, err := machineConfigApplyPhases(merged)
+	require.Nil(t, err)
+	assert.Equal(t, []applyPhase{
+		{Name: "network", Files: []string{"/etc/NetworkManager"}, Units: []string{"NetworkManager.service"}, Target: "network-online.target", Timeout: "1m"},
+		{Name: "workloads", Units: []string{"app.service"}},
+	}, phases)
+
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Storage.Files = []ign3types.File{
+		newDeviceAgentTestFile(t, "/etc/NetworkManager/conf.d/dns.conf", "old"),
+		newDeviceAgentTestFile(t, "/etc/app.conf", "old"),
+	}
+	oldIgn.Systemd.Units = []ign3types.Unit{{Name: "app.service", Contents: helpers.StrToPtr("[Service]")}}
+	newIgn := ctrlcommon.NewIgnConfig()
+	newIgn.Storage.Files = []ign3types.File{
+		newDeviceAgentTestFile(t, "/etc/NetworkManager/conf.d/dns.conf", "new"),
+		newDeviceAgentTestFile(t, "/etc/app.conf", "new"),
+	}
+	newIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "NetworkManager.service", Dropins: []ign3types.Dropin{{Name: "10-mcd.conf", Contents: helpers.StrToPtr("[Service]")}}},
+		{Name: "app.service", Contents: helpers.StrToPtr("[Service]\nRestart=always")},
+	}
+
+	steps := planApplyPhases(phases, oldIgn, newIgn)
+	require.Len(t, steps, 2)
+	assert.Equal(t, time.Minute, steps[0].timeout)
+	assert.Equal(t, defaultApplyPhaseTimeout, steps[1].timeout)
+	// The network phase changes the NetworkManager files and units only
+	assert.Equal(t, []string{"/etc/NetworkManager/conf.d/dns.conf"}, ctrlcommon.CalculateConfigFileDiffs(&oldIgn, &steps[0].ignConfig))
+	assert.Equal(t, []string{"NetworkManager.service"}, calculateUnitDiffs(&oldIgn, &steps[0].ignConfig))
+	assert.Equal(t, []string{"app.service"}, calculateUnitDiffs(&steps[0].ignConfig, &steps[1].ignConfig))
+	// Files of no phase are left to the end
+	assert.Equal(t, []string{"/etc/app.conf"}, ctrlcommon.CalculateConfigFileDiffs(&steps[1].ignConfig, &newIgn))
+
+	invalid := newDeviceAgentTestConfig(t, "invalid", nil, nil)
+	for _, annotation := range []string{
+		`[{"files": ["/etc"]}]`,
+		`[{"name": "a"}, {"name": "a"}]`,
+		`[{"name": "a", "target": "network-online.service"}]`,
+		`[{"name": "a", "timeout": "soon"}]`,
+	} {
+		invalid.Annotations = map[string]string{MachineConfigApplyPhasesAnnotationKey: annotation}
+		_, err := machineConfigApplyPhases(invalid)
+		assert.NotNil(t, err, annotation)
+	}
+}
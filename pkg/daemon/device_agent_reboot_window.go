@@ -0,0 +1,178 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// stagedUpdatePath records an OS update whose finalization has been deferred
+// until it is released by FinalizeStagedUpdate.
+var stagedUpdatePath = "/etc/machine-config-daemon/staged-update.json"
+
+// RebootWindow is a daily maintenance window during which reboot-required
+// changes may take effect.
+type RebootWindow struct {
+	// Start is the time of day, as an offset from local midnight, at which
+	// the window opens.
+	Start time.Duration
+	// Duration is how long the window stays open. Windows may span midnight.
+	Duration time.Duration
+}
+
+// Contains returns true if t falls within the window.
+func (w RebootWindow) Contains(t time.Time) bool {
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	// Also check yesterday's window in case it spans midnight
+	for _, day := range []time.Time{midnight.AddDate(0, 0, -1), midnight} {
+		start := day.Add(w.Start)
+		if !t.Before(start) && t.Before(start.Add(w.Duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// stagedUpdate is the on-disk record of a deferred OS update.
+type stagedUpdate struct {
+	ConfigName string    `json:"configName"`
+	StagedAt   time.Time `json:"stagedAt"`
+}
+
+// WithRebootWindow makes updates in device agent mode outside of the window
+// apply rebootless changes right away, but lock the finalization of the staged
+// OS deployment, so that a reboot outside of the window keeps booting the
+// current deployment. The update takes effect on the first reboot after
+// FinalizeStagedUpdate or FinalizeStagedUpdateInWindow released it.
+func WithRebootWindow(window RebootWindow) Option {
+	return func(dn *Daemon) {
+		dn.rebootWindow = &window
+	}
+}
+
+// stagedUpdatePaths returns the paths written by deferFinalization.
+func (dn *Daemon) stagedUpdatePaths(plan *deviceAgentPlan) []string {
+	if dn.rebootWindow == nil && len(plan.result.OSChanges) == 0 {
+		return nil
+	}
+	return []string{stagedUpdatePath}
+}
+
+// deferFinalization locks the finalization of the staged deployment if stage
+// is set or we're outside of the reboot window. It returns true if it did.
+func (dn *Daemon) deferFinalization(configName string, now time.Time, stage bool) (bool, error) {
+	if !stage && (dn.rebootWindow == nil || dn.rebootWindow.Contains(now)) {
+		return false, nil
+	}
+	if err := runCmdSync("ostree", "admin", "lock-finalization"); err != nil {
+		return false, fmt.Errorf("locking finalization of staged deployment: %w", err)
+	}
+
+	b, err := json.Marshal(stagedUpdate{ConfigName: configName, StagedAt: now.UTC()})
+	if err != nil {
+		return false, fmt.Errorf("marshalling staged update: %w", err)
+	}
+	if err := writeFileAtomicallyWithDefaults(stagedUpdatePath, b); err != nil {
+		return false, fmt.Errorf("writing staged update: %w", err)
+	}
+	if stage {
+		logSystem("Staged OS update to config %s until it is finalized", configName)
+	} else {
+		logSystem("Deferred finalization of config %s until the next reboot window", configName)
+	}
+	return true, nil
+}
+
+// FinalizeStagedUpdate releases an OS update deferred because of the reboot
+// window or staged with UpdatePolicy.StageOSUpdate, so it takes effect on the
+// next reboot. It returns the name of the
+// released config, or "" if there was no deferred update.
+func (dn *Daemon) FinalizeStagedUpdate() (string, error) {
+	release, err := acquireUpdateLock()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	// Releasing the deployment can't be interrupted
+	dn.catchIgnoreSIGTERM()
+	defer dn.cancelSIGTERM()
+	return dn.finalizeStagedUpdate()
+}
+
+// FinalizeStagedUpdateInWindow is like FinalizeStagedUpdate, but only
+// releases the update if the reboot window is open. Device agents can call it
+// periodically.
+func (dn *Daemon) FinalizeStagedUpdateInWindow() (string, error) {
+	if dn.rebootWindow == nil || !dn.rebootWindow.Contains(time.Now()) {
+		return "", nil
+	}
+	return dn.FinalizeStagedUpdate()
+}
+
+// runRebootCommand is overridden by tests to not reboot.
+var runRebootCommand = func(rationale string) error {
+	return rebootCommand(rationale).Run()
+}
+
+// FinalizeOSUpdate releases the staged OS update like FinalizeStagedUpdate and
+// reboots into it, so device agents decide when the disruption of an update
+// staged with UpdatePolicy.StageOSUpdate happens. It returns the name of the
+// released config, or "" without rebooting if there was no staged update.
+func (dn *Daemon) FinalizeOSUpdate() (string, error) {
+	name, err := dn.FinalizeStagedUpdate()
+	if err != nil || name == "" {
+		return name, err
+	}
+	rationale := fmt.Sprintf("Finalizing OS update to config %s", name)
+	dn.getStatusReporter().Eventf(corev1.EventTypeNormal, "Reboot", rationale)
+	logSystem("initiating reboot: %s", rationale)
+	if err := runRebootCommand(rationale); err != nil {
+		return name, fmt.Errorf("reboot command failed: %w", err)
+	}
+	return name, nil
+}
+
+// FinalizeOSUpdateInWindow is like FinalizeOSUpdate, but only finalizes the
+// update if the reboot window is open.
+func (dn *Daemon) FinalizeOSUpdateInWindow() (string, error) {
+	if dn.rebootWindow == nil || !dn.rebootWindow.Contains(time.Now()) {
+		return "", nil
+	}
+	return dn.FinalizeOSUpdate()
+}
+
+func (dn *Daemon) finalizeStagedUpdate() (string, error) {
+	b, err := os.ReadFile(stagedUpdatePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading staged update: %w", err)
+	}
+	staged := stagedUpdate{}
+	if err := json.Unmarshal(b, &staged); err != nil {
+		return "", fmt.Errorf("parsing staged update: %w", err)
+	}
+
+	if err := runCmdSync("ostree", "admin", "lock-finalization", "--unlock"); err != nil {
+		return "", fmt.Errorf("unlocking finalization of staged deployment: %w", err)
+	}
+	if err := os.Remove(stagedUpdatePath); err != nil {
+		return "", fmt.Errorf("removing staged update: %w", err)
+	}
+	logSystem("Released staged update to config %s, it takes effect on the next reboot", staged.ConfigName)
+	if reporter, ok := dn.getStatusReporter().(StagedUpdateReporter); ok {
+		if err := reporter.SetStaged(""); err != nil {
+			klog.Errorf("Error reporting released staged update: %v", err)
+		}
+	}
+	return staged.ConfigName, nil
+}
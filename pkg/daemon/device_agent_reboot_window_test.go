@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebootWindow(t *testing.T) {
+	// 22:00 to 02:00
+	window := RebootWindow{Start: 22 * time.Hour, Duration: 4 * time.Hour}
+	day := time.Date(2023, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		offset   time.Duration
+		contains bool
+	}{
+		{offset: 21*time.Hour + 59*time.Minute, contains: false},
+		{offset: 22 * time.Hour, contains: true},
+		{offset: 23 * time.Hour, contains: true},
+		{offset: 1 * time.Hour, contains: true},
+		{offset: 2 * time.Hour, contains: false},
+		{offset: 12 * time.Hour, contains: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.contains, window.Contains(day.Add(test.offset)), "offset %v", test.offset)
+	}
+}
+
+func TestDeferFinalization(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	now := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	// Without a reboot window, OS updates are never deferred
+	deferred, err := d.deferFinalization("new", now, false)
+	require.Nil(t, err)
+	assert.False(t, deferred)
+
+	// Nor are they inside of the window
+	WithRebootWindow(RebootWindow{Start: 11 * time.Hour, Duration: 2 * time.Hour})(d)
+	deferred, err = d.deferFinalization("new", now, false)
+	require.Nil(t, err)
+	assert.False(t, deferred)
+
+	// Nothing to finalize
+	name, err := d.FinalizeStagedUpdate()
+	require.Nil(t, err)
+	assert.Equal(t, "", name)
+
+	origRunRebootCommand := runRebootCommand
+	defer func() { runRebootCommand = origRunRebootCommand }()
+	var reboots []string
+	runRebootCommand = func(rationale string) error {
+		reboots = append(reboots, rationale)
+		return nil
+	}
+	name, err = d.FinalizeOSUpdate()
+	require.Nil(t, err)
+	assert.Equal(t, "", name)
+	assert.Empty(t, reboots)
+
+	// Staged updates are deferred inside of the window too, until
+	// FinalizeOSUpdate reboots into them
+	binDir := filepath.Join(testDir, "bin")
+	ostreeLog := filepath.Join(testDir, "ostree.log")
+	require.Nil(t, os.MkdirAll(binDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(binDir, "ostree"), []byte("#!/bin/sh\necho \"$@\" >> "+ostreeLog+"\n"), 0o755))
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	reporter := NewFileStatusReporter(filepath.Join(testDir, "status.json"))
+	d.SetStatusReporter(reporter)
+	require.Nil(t, reporter.(StagedUpdateReporter).SetStaged("new"))
+
+	deferred, err = d.deferFinalization("new", now, true)
+	require.Nil(t, err)
+	assert.True(t, deferred)
+	assert.FileExists(t, stagedUpdatePath)
+
+	name, err = d.FinalizeOSUpdate()
+	require.Nil(t, err)
+	assert.Equal(t, "new", name)
+	assert.Equal(t, []string{"Finalizing OS update to config new"}, reboots)
+	assert.NoFileExists(t, stagedUpdatePath)
+	calls, err := os.ReadFile(ostreeLog)
+	require.Nil(t, err)
+	assert.Equal(t, "admin lock-finalization\nadmin lock-finalization --unlock\n", string(calls))
+	b, err := os.ReadFile(filepath.Join(testDir, "status.json"))
+	require.Nil(t, err)
+	status := DeviceStatus{}
+	require.Nil(t, json.Unmarshal(b, &status))
+	assert.Equal(t, "", status.StagedConfig)
+}
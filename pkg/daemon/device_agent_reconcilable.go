@@ -0,0 +1,197 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"k8s.io/klog/v2"
+)
+
+// ReconcilableField is a part of a MachineConfig that updates can't change in
+// place.
+type ReconcilableField string
+
+const (
+	// ReconcilableFieldIgnitionVersion is an Ignition config that doesn't
+	// parse or has a version that can't be converted to the supported one.
+	ReconcilableFieldIgnitionVersion ReconcilableField = "ignition.version"
+	// ReconcilableFieldIgnition is an Ignition config that doesn't validate.
+	ReconcilableFieldIgnition ReconcilableField = "ignition"
+	// ReconcilableFieldPasswdGroups is a change to passwd.groups.
+	ReconcilableFieldPasswdGroups ReconcilableField = "passwd.groups"
+	// ReconcilableFieldPasswdUsers is a change to passwd.users other than to
+	// the SSH keys and password hash of the core user.
+	ReconcilableFieldPasswdUsers ReconcilableField = "passwd.users"
+	// ReconcilableFieldKernelArguments is a change to the kernelArguments of
+	// the Ignition config, rather than of the MachineConfig.
+	ReconcilableFieldKernelArguments ReconcilableField = "kernelArguments"
+	// ReconcilableFieldStorageDisks is a change to storage.disks.
+	ReconcilableFieldStorageDisks ReconcilableField = "storage.disks"
+	// ReconcilableFieldStorageFilesystems is a change to storage.filesystems.
+	ReconcilableFieldStorageFilesystems ReconcilableField = "storage.filesystems"
+	// ReconcilableFieldStorageRaid is a change to storage.raid.
+	ReconcilableFieldStorageRaid ReconcilableField = "storage.raid"
+	// ReconcilableFieldStorageFiles is a file that appends or may not be
+	// written via Ignition.
+	ReconcilableFieldStorageFiles ReconcilableField = "storage.files"
+	// ReconcilableFieldFIPS is a change to spec.fips.
+	ReconcilableFieldFIPS ReconcilableField = "fips"
+	// ReconcilableFieldKernelType is an unknown spec.kernelType.
+	ReconcilableFieldKernelType ReconcilableField = "kernelType"
+)
+
+// UnreconcilableChange is a change an update can't make in place.
+type UnreconcilableChange struct {
+	Field ReconcilableField `json:"field"`
+	// Path is the file of storage.files, or the user of passwd.users, the
+	// change is about, if any.
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason"`
+	// err is the error Reason is the message of.
+	err error
+}
+
+// ReconcilableReport lists the changes between two configs that can't be
+// reconciled.
+type ReconcilableReport struct {
+	Unreconcilable []UnreconcilableChange `json:"unreconcilable,omitempty"`
+	// Accepted lists the changes that are unreconcilable, but accepted by a
+	// ReconcilePolicy.
+	Accepted []UnreconcilableChange `json:"accepted,omitempty"`
+}
+
+// Reconcilable returns true if all changes can be reconciled.
+func (r *ReconcilableReport) Reconcilable() bool {
+	return len(r.Unreconcilable) == 0
+}
+
+// Err returns an ErrUnreconcilable listing the changes that can't be
+// reconciled, or nil if there are none.
+func (r *ReconcilableReport) Err() error {
+	if r.Reconcilable() {
+		return nil
+	}
+	errs := make([]interface{}, 0, len(r.Unreconcilable))
+	for _, c := range r.Unreconcilable {
+		err := c.err
+		if err == nil {
+			err = errors.New(c.Reason)
+		}
+		errs = append(errs, err)
+	}
+	return &ErrUnreconcilable{Err: fmt.Errorf(strings.TrimSuffix(strings.Repeat("%w; ", len(errs)), "; "), errs...)}
+}
+
+// Reconcilable checks whether an update from oldConfig to newConfig can be
+// made in place, so device agents and pre-flight tools can reject configs
+// before shipping them to a node. It doesn't look at the host: a change of
+// spec.fips is reported even if the node already runs in the new FIPS mode,
+// and the filesystem checks of device agent mode aren't made.
+func Reconcilable(oldConfig, newConfig *mcfgv1.MachineConfig) *ReconcilableReport {
+	report := &ReconcilableReport{}
+	oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+	if err != nil {
+		report.add(ReconcilableFieldIgnitionVersion, "", "parsing old Ignition config failed with error: %w", err)
+	}
+	newIgn, err := ctrlcommon.ParseAndConvertConfig(newConfig.Spec.Config.Raw)
+	if err != nil {
+		report.add(ReconcilableFieldIgnitionVersion, "", "parsing new Ignition config failed with error: %w", err)
+	}
+	if !report.Reconcilable() {
+		return report
+	}
+	report.checkIgnition(oldIgn, newIgn)
+
+	if oldConfig.Spec.FIPS != newConfig.Spec.FIPS {
+		report.add(ReconcilableFieldFIPS, "", "detected change to FIPS flag; refusing to modify FIPS on a running cluster")
+	}
+	switch newConfig.Spec.KernelType {
+	case "", ctrlcommon.KernelTypeDefault, ctrlcommon.KernelTypeRealtime, ctrlcommon.KernelType64kPages:
+	default:
+		report.add(ReconcilableFieldKernelType, "", "unhandled kernel type %s", newConfig.Spec.KernelType)
+	}
+	return report
+}
+
+func (r *ReconcilableReport) add(field ReconcilableField, path, format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	r.Unreconcilable = append(r.Unreconcilable, UnreconcilableChange{Field: field, Path: path, Reason: err.Error(), err: err})
+}
+
+// checkIgnition adds the changes between the Ignition configs that can't be
+// reconciled, in the order reconcilable checks them.
+func (r *ReconcilableReport) checkIgnition(oldIgn, newIgn ign3types.Config) {
+	// Check if this is a generally valid Ignition Config
+	if err := ctrlcommon.ValidateIgnition(newIgn); err != nil {
+		r.add(ReconcilableFieldIgnition, "", "%w", err)
+	}
+
+	// Passwd section
+
+	// we don't currently configure Groups in place. we don't configure Users except
+	// for setting/updating SSHAuthorizedKeys for the only allowed user "core".
+	// otherwise we can't fix it if something changed here.
+	if !reflect.DeepEqual(oldIgn.Passwd, newIgn.Passwd) {
+		if !reflect.DeepEqual(oldIgn.Passwd.Groups, newIgn.Passwd.Groups) {
+			r.add(ReconcilableFieldPasswdGroups, "", "ignition Passwd Groups section contains changes")
+		}
+		if !reflect.DeepEqual(oldIgn.Passwd.Users, newIgn.Passwd.Users) {
+			// there is an update to Users, we must verify that it is ONLY making an acceptable
+			// change to the SSHAuthorizedKeys for the user "core"
+			nonCore := false
+			for _, user := range newIgn.Passwd.Users {
+				if user.Name != constants.CoreUserName {
+					r.add(ReconcilableFieldPasswdUsers, user.Name, "ignition passwd user section contains unsupported changes: non-core user")
+					nonCore = true
+					break
+				}
+			}
+			// We don't want to panic if the "new" users is empty, and it's still reconcilable because the absence of a user here does not mean "remove the user from the system"
+			if !nonCore && len(newIgn.Passwd.Users) != 0 {
+				user := newIgn.Passwd.Users[len(newIgn.Passwd.Users)-1]
+				klog.Infof("user data to be verified before ssh update: %v", user)
+				if err := verifyUserFields(user); err != nil {
+					r.add(ReconcilableFieldPasswdUsers, user.Name, "%w", err)
+				}
+			}
+		}
+	}
+
+	// Kernel args
+
+	// ignition now supports kernel args, but the MCO doesn't implement them yet
+	if !reflect.DeepEqual(oldIgn.KernelArguments, newIgn.KernelArguments) {
+		r.add(ReconcilableFieldKernelArguments, "", "ignition kargs section contains changes")
+	}
+
+	// Storage section
+
+	// we can only reconcile files right now. make sure the sections we can't
+	// fix aren't changed.
+	if !reflect.DeepEqual(oldIgn.Storage.Disks, newIgn.Storage.Disks) {
+		r.add(ReconcilableFieldStorageDisks, "", "ignition disks section contains changes")
+	}
+	if !reflect.DeepEqual(oldIgn.Storage.Filesystems, newIgn.Storage.Filesystems) {
+		r.add(ReconcilableFieldStorageFilesystems, "", "ignition filesystems section contains changes")
+	}
+	if !reflect.DeepEqual(oldIgn.Storage.Raid, newIgn.Storage.Raid) {
+		r.add(ReconcilableFieldStorageRaid, "", "ignition raid section contains changes")
+	}
+	// Special case files append: if the new config wants us to append, then we
+	// have to force a reprovision since it's not idempotent
+	for _, f := range newIgn.Storage.Files {
+		if len(f.Append) > 0 {
+			r.add(ReconcilableFieldStorageFiles, f.Path, "ignition file %v includes append", f.Path)
+		}
+		// We also disallow writing some special files
+		if f.Path == constants.MachineConfigDaemonForceFile {
+			r.add(ReconcilableFieldStorageFiles, f.Path, "cannot create %s via Ignition", f.Path)
+		}
+	}
+}
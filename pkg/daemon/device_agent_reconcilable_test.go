@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcilableReport(t *testing.T) {
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, "/etc/foo", "foo")}, nil)
+	report := Reconcilable(oldConfig, newConfig)
+	assert.True(t, report.Reconcilable())
+	assert.Nil(t, report.Err())
+
+	// All unreconcilable changes are listed, not only the first
+	ignCfg := ctrlcommon.NewIgnConfig()
+	ignCfg.Storage.Disks = []ign3types.Disk{{Device: "/dev/sdb"}}
+	ignCfg.Storage.Files = []ign3types.File{newDeviceAgentTestFile(t, "/etc/foo", "foo")}
+	ignCfg.Storage.Files[0].Append = []ign3types.Resource{{Source: helpers.StrToPtr("data:,bar")}}
+	newConfig = helpers.CreateMachineConfigFromIgnition(ignCfg)
+	newConfig.Spec.FIPS = true
+	newConfig.Spec.KernelType = "lowlatency"
+	report = Reconcilable(oldConfig, newConfig)
+	assert.False(t, report.Reconcilable())
+	err := report.Err()
+	assert.Equal(t, ErrorCodeUnreconcilable, ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "ignition disks section contains changes; ignition file /etc/foo includes append")
+	// Err wraps the errors of all the changes
+	changes := []UnreconcilableChange{}
+	for _, change := range report.Unreconcilable {
+		assert.ErrorIs(t, err, change.err)
+		change.err = nil
+		changes = append(changes, change)
+	}
+	assert.Equal(t, []UnreconcilableChange{
+		{Field: ReconcilableFieldStorageDisks, Reason: "ignition disks section contains changes"},
+		{Field: ReconcilableFieldStorageFiles, Path: "/etc/foo", Reason: "ignition file /etc/foo includes append"},
+		{Field: ReconcilableFieldFIPS, Reason: "detected change to FIPS flag; refusing to modify FIPS on a running cluster"},
+		{Field: ReconcilableFieldKernelType, Reason: "unhandled kernel type lowlatency"},
+	}, changes)
+
+	// Configs that don't parse are reported by their Ignition version
+	ignCfg = ctrlcommon.NewIgnConfig()
+	ignCfg.Ignition.Version = "4.0.0"
+	report = Reconcilable(oldConfig, helpers.CreateMachineConfigFromIgnition(ignCfg))
+	require.Len(t, report.Unreconcilable, 1)
+	assert.Equal(t, ReconcilableFieldIgnitionVersion, report.Unreconcilable[0].Field)
+	// The parse error is kept, not only its message
+	assert.NotNil(t, errors.Unwrap(report.Unreconcilable[0].err))
+}
@@ -0,0 +1,171 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// fipsKernelArgument boots the kernel in FIPS mode.
+const fipsKernelArgument = "fips=1"
+
+// ReconcilePolicy accepts changes that updates otherwise refuse as
+// unreconcilable. Each change is only accepted if the policy says so, and the
+// accepted changes are reported in ReconcilableReport.Accepted and
+// UpdateResult.ReconcileOverrides.
+type ReconcilePolicy struct {
+	// EnableFIPS accepts configs turning spec.fips on. The host boots into
+	// FIPS mode with the fips=1 kernel argument on the next reboot, so this
+	// needs an rpm-ostree host applying kernel arguments. Until then, configs
+	// keeping FIPS on are reconciled against the FIPS mode the host runs in.
+	// Turning FIPS off stays unreconcilable.
+	EnableFIPS bool
+	// AddIgnitionKernelArguments accepts kernel arguments added to
+	// kernelArguments.shouldExist of the Ignition config, which are then
+	// applied as those of spec.kernelArguments. Other changes to the section
+	// stay unreconcilable.
+	AddIgnitionKernelArguments bool
+}
+
+// WithReconcilePolicy makes updates in device agent mode accept the changes
+// policy accepts.
+func WithReconcilePolicy(policy ReconcilePolicy) Option {
+	return func(dn *Daemon) {
+		dn.reconcilePolicy = &policy
+	}
+}
+
+// Reconcilable is Reconcilable, with the changes p accepts moved to the
+// report's Accepted.
+func (p ReconcilePolicy) Reconcilable(oldConfig, newConfig *mcfgv1.MachineConfig) *ReconcilableReport {
+	report := Reconcilable(oldConfig, newConfig)
+	if report.Reconcilable() {
+		return report
+	}
+	// The configs parsed, or there'd be nothing to accept
+	oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+	if err != nil {
+		return report
+	}
+	newIgn, err := ctrlcommon.ParseAndConvertConfig(newConfig.Spec.Config.Raw)
+	if err != nil {
+		return report
+	}
+	unreconcilable := report.Unreconcilable[:0]
+	for _, change := range report.Unreconcilable {
+		switch {
+		case change.Field == ReconcilableFieldFIPS && p.EnableFIPS && newConfig.Spec.FIPS:
+		case change.Field == ReconcilableFieldKernelArguments && p.AddIgnitionKernelArguments && addedIgnitionKernelArguments(oldIgn, newIgn) != nil:
+		default:
+			unreconcilable = append(unreconcilable, change)
+			continue
+		}
+		report.Accepted = append(report.Accepted, change)
+	}
+	report.Unreconcilable = unreconcilable
+	return report
+}
+
+// addedIgnitionKernelArguments returns the kernel arguments newIgn adds to
+// shouldExist, or nil if it changes the section otherwise.
+func addedIgnitionKernelArguments(oldIgn, newIgn ign3types.Config) []string {
+	if !kernelArgumentSetsEqual(oldIgn.KernelArguments.ShouldNotExist, newIgn.KernelArguments.ShouldNotExist) {
+		return nil
+	}
+	old := map[ign3types.KernelArgument]struct{}{}
+	for _, karg := range oldIgn.KernelArguments.ShouldExist {
+		old[karg] = struct{}{}
+	}
+	added := []string{}
+	for _, karg := range newIgn.KernelArguments.ShouldExist {
+		if _, ok := old[karg]; ok {
+			delete(old, karg)
+			continue
+		}
+		added = append(added, string(karg))
+	}
+	if len(old) > 0 || len(added) == 0 {
+		return nil
+	}
+	return added
+}
+
+func kernelArgumentSetsEqual(a, b []ign3types.KernelArgument) bool {
+	set := map[ign3types.KernelArgument]struct{}{}
+	for _, karg := range a {
+		set[karg] = struct{}{}
+	}
+	for _, karg := range b {
+		if _, ok := set[karg]; !ok {
+			return false
+		}
+	}
+	return len(set) == len(b)
+}
+
+// applyReconcilePolicy returns newConfig with the changes the reconcile policy
+// accepts turned into ones updates make, and the accepted changes. newConfig
+// is returned as is without a policy.
+func (dn *Daemon) applyReconcilePolicy(oldConfig, newConfig *mcfgv1.MachineConfig, selector ApplySelector) (*mcfgv1.MachineConfig, []UnreconcilableChange, error) {
+	if dn.reconcilePolicy == nil {
+		return newConfig, nil, nil
+	}
+	config := newConfig
+	if dn.reconcilePolicy.EnableFIPS && oldConfig.Spec.FIPS && newConfig.Spec.FIPS {
+		// FIPS was turned on by an earlier update, but the host may not
+		// have rebooted into FIPS mode yet
+		if err := processFips(func(nodeFIPS bool) error {
+			if !nodeFIPS {
+				config = newConfig.DeepCopy()
+				config.Spec.FIPS = false
+			}
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+	report := dn.reconcilePolicy.Reconcilable(oldConfig, newConfig)
+	if len(report.Accepted) == 0 {
+		return config, nil, nil
+	}
+
+	config = config.DeepCopy()
+	for _, change := range report.Accepted {
+		if !selector.Has(ApplyKernelArguments) {
+			return nil, nil, fmt.Errorf("accepting %s change requires applying kernel arguments", change.Field)
+		}
+		switch change.Field {
+		case ReconcilableFieldFIPS:
+			if _, ok := dn.getOSUpdater().(rpmOstreeOSUpdater); !ok {
+				return nil, nil, fmt.Errorf("FIPS can only be enabled on rpm-ostree hosts")
+			}
+			config.Spec.FIPS = oldConfig.Spec.FIPS
+			config.Spec.KernelArguments = append(config.Spec.KernelArguments, fipsKernelArgument)
+		case ReconcilableFieldKernelArguments:
+			if !dn.updatesOS() {
+				return nil, nil, fmt.Errorf("kernel arguments are not applied on this host")
+			}
+			oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+			if err != nil {
+				return nil, nil, err
+			}
+			newIgn, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+			if err != nil {
+				return nil, nil, err
+			}
+			config.Spec.KernelArguments = append(config.Spec.KernelArguments, addedIgnitionKernelArguments(oldIgn, newIgn)...)
+			newIgn.KernelArguments = oldIgn.KernelArguments
+			raw, err := json.Marshal(newIgn)
+			if err != nil {
+				return nil, nil, err
+			}
+			config.Spec.Config = runtime.RawExtension{Raw: raw}
+		}
+		logSystem("Accepting unreconcilable %s change of config %s by the reconcile policy: %s", change.Field, newConfig.GetName(), change.Reason)
+	}
+	return config, report.Accepted, nil
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/pkg/daemon/osrelease"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcilePolicy(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	oldIgnCfg := ctrlcommon.NewIgnConfig()
+	oldIgnCfg.KernelArguments.ShouldExist = []ign3types.KernelArgument{"a"}
+	oldConfig := helpers.CreateMachineConfigFromIgnition(oldIgnCfg)
+	oldConfig.Name = "old"
+	newIgnCfg := ctrlcommon.NewIgnConfig()
+	newIgnCfg.KernelArguments.ShouldExist = []ign3types.KernelArgument{"a", "b"}
+	newConfig := helpers.CreateMachineConfigFromIgnition(newIgnCfg)
+	newConfig.Name = "new"
+	newConfig.Spec.FIPS = true
+
+	// Without a policy, both changes are unreconcilable
+	report := ReconcilePolicy{}.Reconcilable(oldConfig, newConfig)
+	assert.Len(t, report.Unreconcilable, 2)
+	assert.Empty(t, report.Accepted)
+
+	policy := ReconcilePolicy{EnableFIPS: true, AddIgnitionKernelArguments: true}
+	report = policy.Reconcilable(oldConfig, newConfig)
+	assert.True(t, report.Reconcilable())
+	require.Len(t, report.Accepted, 2)
+	assert.Equal(t, ReconcilableFieldKernelArguments, report.Accepted[0].Field)
+	assert.Equal(t, ReconcilableFieldFIPS, report.Accepted[1].Field)
+
+	// Only additions to shouldExist are accepted, and FIPS is never turned
+	// off
+	newIgnCfg.KernelArguments.ShouldExist = []ign3types.KernelArgument{"b"}
+	report = policy.Reconcilable(newConfig, helpers.CreateMachineConfigFromIgnition(newIgnCfg))
+	require.Len(t, report.Unreconcilable, 2)
+	assert.Equal(t, ReconcilableFieldKernelArguments, report.Unreconcilable[0].Field)
+	assert.Equal(t, ReconcilableFieldFIPS, report.Unreconcilable[1].Field)
+
+	// Updates make the accepted changes as kernel arguments, which other
+	// hosts than rpm-ostree ones can't
+	d := newMockDeviceAgentDaemon(testDir)
+	WithReconcilePolicy(policy)(d)
+	_, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector)
+	var unreconcilable *ErrUnreconcilable
+	require.ErrorAs(t, err, &unreconcilable)
+	assert.Contains(t, err.Error(), "kernel arguments are not applied on this host")
+
+	d.os, err = osrelease.LoadOSRelease("ID=rhcos\nVERSION_ID=9.4\n", "")
+	require.Nil(t, err)
+	client := NewNodeUpdaterClient()
+	d.NodeUpdaterClient = &client
+	plan, err := d.planInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector, false)
+	require.Nil(t, err)
+	require.Len(t, plan.result.ReconcileOverrides, 2)
+	assert.Equal(t, []string{"b", fipsKernelArgument}, plan.osConfig.Spec.KernelArguments)
+	assert.Equal(t, []string{"Changing kernel arguments"}, plan.result.OSChanges)
+	assert.True(t, plan.result.RebootRequired)
+	// The config is stored as it is
+	assert.Equal(t, newConfig, plan.newConfig)
+	assert.Empty(t, newConfig.Spec.KernelArguments)
+}
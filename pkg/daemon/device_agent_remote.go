@@ -0,0 +1,211 @@
+package daemon
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// RemoteContentOptions configures how file contents referencing http(s) URLs
+// are fetched in device agent mode.
+type RemoteContentOptions struct {
+	// Retries is how many times a failed download is retried.
+	Retries int
+	// RetryInterval is the wait before the first retry, doubled for each
+	// retry after that.
+	RetryInterval time.Duration
+	// Timeout bounds each download attempt.
+	Timeout time.Duration
+	// CacheDir, if set, keeps downloaded contents by their verification hash,
+	// so files with a verification hash are only downloaded once.
+	CacheDir string
+	// Proxy is the URL of the proxy to use. If empty, the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used.
+	Proxy string
+	// CACertificates are PEM encoded certificates trusted in addition to the
+	// system ones.
+	CACertificates [][]byte
+}
+
+// DefaultRemoteContentOptions returns the options a daemon created by
+// NewClusterlessDaemon fetches remote file contents with.
+func DefaultRemoteContentOptions() RemoteContentOptions {
+	return RemoteContentOptions{
+		Retries:       5,
+		RetryInterval: 2 * time.Second,
+		Timeout:       10 * time.Minute,
+	}
+}
+
+// WithRemoteContentOptions overrides how file contents referencing http(s)
+// URLs are fetched in device agent mode.
+func WithRemoteContentOptions(opts RemoteContentOptions) Option {
+	return func(dn *Daemon) {
+		fetcher, err := newRemoteFetcher(opts)
+		if err != nil {
+			// Options can't fail; fail the fetches instead
+			klog.Errorf("Invalid remote content options: %v", err)
+			dn.remoteFetcher = &remoteFetcher{err: err}
+			return
+		}
+		dn.remoteFetcher = fetcher
+	}
+}
+
+// remoteFetcher downloads file contents referencing http(s) URLs.
+type remoteFetcher struct {
+	opts   RemoteContentOptions
+	client *http.Client
+	// err is returned by every fetch if the options were invalid
+	err error
+}
+
+func newRemoteFetcher(opts RemoteContentOptions) (*remoteFetcher, error) {
+	proxy := http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy URL: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	if len(opts.CACertificates) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			klog.Warningf("Failed to load system certificates, only trusting the given CA certificates: %v", err)
+			pool = x509.NewCertPool()
+		}
+		for _, pem := range opts.CACertificates {
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA certificate")
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &remoteFetcher{
+		opts:   opts,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// isRemoteSource returns true if source references an http(s) URL.
+func isRemoteSource(source *string) bool {
+	return source != nil && (strings.HasPrefix(*source, "http://") || strings.HasPrefix(*source, "https://"))
+}
+
+// fetch writes the decompressed contents of file, which must reference an
+// http(s) URL, to dest with the given mode and ownership, from the cache or by
+// downloading them. Contents are streamed to disk as they are downloaded and
+// checked against the file's verification hash, if it has one; a download is
+// retried if they don't match.
+func (f *remoteFetcher) fetch(ctx context.Context, file ign3types.File, dest string, mode os.FileMode, uid, gid int) error {
+	if f.err != nil {
+		return f.err
+	}
+	source := *file.Contents.Source
+	verification := file.Contents.Verification.Hash
+
+	// The cache is keyed by the hash of the decompressed contents
+	var cachePath string
+	if f.opts.CacheDir != "" && verification != nil && !strings.ContainsRune(*verification, filepath.Separator) {
+		cachePath = filepath.Join(f.opts.CacheDir, *verification)
+		if err := copyVerified(cachePath, file.Path, dest, mode, uid, gid, verification); err == nil {
+			klog.Infof("Using cached contents of %s for %q", source, file.Path)
+			return nil
+		} else if !os.IsNotExist(err) {
+			klog.Warningf("Cached contents of %s for %q are corrupt, downloading them again: %v", source, file.Path, err)
+		}
+	}
+
+	backoff := wait.Backoff{
+		Duration: f.opts.RetryInterval,
+		Factor:   2,
+		Steps:    f.opts.Retries + 1,
+	}
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		if err := f.download(ctx, file, dest, mode, uid, gid); err != nil {
+			klog.Warningf("Failed to fetch %s for %q: %v", source, file.Path, err)
+			lastErr = err
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if lastErr == nil || ctx.Err() != nil {
+			lastErr = err
+		}
+		return fmt.Errorf("fetching %s: %w", source, lastErr)
+	}
+
+	if cachePath != "" {
+		if err := copyVerified(dest, file.Path, cachePath, defaultFilePermissions, -1, -1, nil); err != nil {
+			klog.Warningf("Failed to cache contents of %s: %v", source, err)
+		}
+	}
+	return nil
+}
+
+// download streams the decompressed contents of file's source to dest.
+func (f *remoteFetcher) download(ctx context.Context, file ign3types.File, dest string, mode os.FileMode, uid, gid int) error {
+	if f.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.opts.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *file.Contents.Source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	verifier, err := newContentVerifier(file.Path, file.Contents.Verification.Hash)
+	if err != nil {
+		return err
+	}
+	return writeFileStreaming(dest, defaultDirectoryPermissions, mode, uid, gid, func(w io.Writer) error {
+		return copyFileContents(w, resp.Body, file.Contents.Compression, contentType, verifier)
+	})
+}
+
+// copyVerified streams the file at src to dest, checking it against
+// verification on the way.
+func copyVerified(src, path, dest string, mode os.FileMode, uid, gid int, verification *string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	verifier, err := newContentVerifier(path, verification)
+	if err != nil {
+		return err
+	}
+	return writeFileStreaming(dest, defaultDirectoryPermissions, mode, uid, gid, func(w io.Writer) error {
+		return copyFileContents(w, r, nil, "", verifier)
+	})
+}
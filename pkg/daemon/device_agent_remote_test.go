@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunOnceInDeviceAgentModeRemoteContents(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	contents := "remote contents"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// The link is flaky
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, contents)
+	}))
+	defer server.Close()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	WithRemoteContentOptions(RemoteContentOptions{
+		Retries:       2,
+		RetryInterval: time.Millisecond,
+		CacheDir:      filepath.Join(testDir, "cache"),
+	})(d)
+
+	sum := sha512.Sum512([]byte(contents))
+	remotePath := filepath.Join(testDir, "etc", "remote")
+	remoteFile := newDeviceAgentTestFile(t, remotePath, "")
+	remoteFile.Contents.Source = helpers.StrToPtr(server.URL + "/payload")
+	remoteFile.Contents.Verification.Hash = helpers.StrToPtr("sha512-" + hex.EncodeToString(sum[:]))
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{remoteFile}, nil)
+
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	b, err := os.ReadFile(remotePath)
+	require.Nil(t, err)
+	assert.Equal(t, contents, string(b))
+	assert.Equal(t, 2, requests)
+
+	// Reapplying the config uses the cached contents
+	require.Nil(t, os.Remove(remotePath))
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	b, err = os.ReadFile(remotePath)
+	require.Nil(t, err)
+	assert.Equal(t, contents, string(b))
+	assert.Equal(t, 2, requests)
+
+	// Contents not matching the hash are rejected
+	badFile := remoteFile
+	badFile.Contents.Verification.Hash = helpers.StrToPtr("sha512-" + strings.Repeat("0", 128))
+	badConfig := newDeviceAgentTestConfig(t, "bad", []ign3types.File{badFile}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, badConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorCodeHashMismatch, ErrorCodeOf(err))
+}
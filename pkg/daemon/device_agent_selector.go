@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+)
+
+// ApplySelector selects the sections of a MachineConfig an update in device
+// agent mode applies, so an embedding agent can leave specific sections to a
+// different component.
+type ApplySelector uint
+
+const (
+	// ApplyFiles writes and removes files.
+	ApplyFiles ApplySelector = 1 << iota
+	// ApplyUnits writes and restarts systemd units. Units are only managed
+	// if the daemon was created WithSystemdUnitManagement.
+	ApplyUnits
+	// ApplySSHKeys writes the core user's SSH authorized keys.
+	ApplySSHKeys
+	// ApplyPasswd updates password hashes.
+	ApplyPasswd
+	// ApplyOSImage updates the OS image, kernel type and extensions.
+	ApplyOSImage
+	// ApplyKernelArguments updates the kernel arguments.
+	ApplyKernelArguments
+	// ApplyCertificates writes the CA bundle.
+	ApplyCertificates
+	// ApplyFilesystems formats blank data disks and mounts them as the
+	// filesystems section asks. Without it, changes to the section are
+	// unreconcilable.
+	ApplyFilesystems
+	// ApplyLUKS rotates the key files and changes the Clevis bindings of
+	// LUKS volumes.
+	ApplyLUKS
+
+	// ApplyAll applies every section but filesystems, as formatting disks
+	// is opted in to with ApplyFilesystems.
+	ApplyAll = ApplyFiles | ApplyUnits | ApplySSHKeys | ApplyPasswd | ApplyOSImage | ApplyKernelArguments | ApplyCertificates | ApplyLUKS
+)
+
+var applySelectorNames = []struct {
+	section ApplySelector
+	name    string
+}{
+	{ApplyFiles, "files"},
+	{ApplyUnits, "units"},
+	{ApplySSHKeys, "ssh"},
+	{ApplyPasswd, "passwd"},
+	{ApplyOSImage, "osimage"},
+	{ApplyKernelArguments, "kargs"},
+	{ApplyCertificates, "certificates"},
+	{ApplyFilesystems, "filesystems"},
+	{ApplyLUKS, "luks"},
+}
+
+// Has returns true if all of the given sections are selected.
+func (s ApplySelector) Has(sections ApplySelector) bool {
+	return s&sections == sections
+}
+
+func (s ApplySelector) String() string {
+	var names []string
+	for _, n := range applySelectorNames {
+		if s.Has(n.section) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// selectOSChanges returns a copy of newConfig in which the OS level sections
+// that are not selected are carried over from oldConfig, so they don't show
+// up as changes.
+func (s ApplySelector) selectOSChanges(oldConfig, newConfig *mcfgv1.MachineConfig) *mcfgv1.MachineConfig {
+	if s.Has(ApplyOSImage | ApplyKernelArguments) {
+		return newConfig
+	}
+	selected := newConfig.DeepCopy()
+	if !s.Has(ApplyOSImage) {
+		selected.Spec.OSImageURL = oldConfig.Spec.OSImageURL
+		selected.Spec.KernelType = oldConfig.Spec.KernelType
+		selected.Spec.Extensions = oldConfig.Spec.Extensions
+	}
+	if !s.Has(ApplyKernelArguments) {
+		selected.Spec.KernelArguments = oldConfig.Spec.KernelArguments
+	}
+	return selected
+}
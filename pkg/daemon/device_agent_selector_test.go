@@ -0,0 +1,60 @@
+package daemon
+
+import (
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySelector(t *testing.T) {
+	assert.Equal(t, "files,units,ssh,passwd,osimage,kargs,certificates,luks", ApplyAll.String())
+	assert.Equal(t, "none", ApplySelector(0).String())
+	assert.True(t, deviceAgentTestSelector.Has(ApplyFiles|ApplyUnits))
+	assert.False(t, deviceAgentTestSelector.Has(ApplyFiles|ApplyCertificates))
+
+	oldConfig := helpers.NewMachineConfig("old", nil, "old-image", nil)
+	oldConfig.Spec.KernelArguments = []string{"old"}
+	newConfig := helpers.NewMachineConfig("new", nil, "new-image", nil)
+	newConfig.Spec.KernelArguments = []string{"new"}
+
+	selected := (ApplyAll &^ ApplyOSImage).selectOSChanges(oldConfig, newConfig)
+	assert.Equal(t, "old-image", selected.Spec.OSImageURL)
+	assert.Equal(t, []string{"new"}, selected.Spec.KernelArguments)
+	selected = (ApplyAll &^ ApplyKernelArguments).selectOSChanges(oldConfig, newConfig)
+	assert.Equal(t, "new-image", selected.Spec.OSImageURL)
+	assert.Equal(t, []string{"old"}, selected.Spec.KernelArguments)
+	// newConfig itself is left alone
+	assert.Equal(t, "new-image", newConfig.Spec.OSImageURL)
+}
+
+func TestPlanInDeviceAgentModeWithSelector(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	addedPath := filepath.Join(testDir, "etc", "added")
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, addedPath, "added"),
+		newDeviceAgentTestFile(t, caBundleFilePath, "ca"),
+	}, nil)
+
+	result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, ApplyAll)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{addedPath, caBundleFilePath}, result.FilesWritten)
+	assert.True(t, result.RebootRequired)
+
+	result, err = d.PlanInDeviceAgentMode(oldConfig, newConfig, ApplyAll&^ApplyCertificates)
+	require.Nil(t, err)
+	assert.Equal(t, []string{addedPath}, result.FilesWritten)
+
+	// Another component owns the files
+	result, err = d.PlanInDeviceAgentMode(oldConfig, newConfig, ApplyAll&^ApplyFiles)
+	require.Nil(t, err)
+	assert.Empty(t, result.FilesWritten)
+	assert.False(t, result.RebootRequired)
+}
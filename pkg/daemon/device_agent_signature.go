@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// MachineConfigSignatureAnnotationKey holds the base64 encoded signature of a
+// MachineConfig's MachineConfigSignaturePayload.
+const MachineConfigSignatureAnnotationKey = "machineconfiguration.openshift.io/signature"
+
+// WithSignatureVerifier makes RunOnceInDeviceAgentMode reject configs that are
+// not signed by the verifier's key, so configs pulled over untrusted transports
+// can't be tampered with.
+func WithSignatureVerifier(verifier signature.Verifier) Option {
+	return func(dn *Daemon) {
+		dn.signatureVerifier = verifier
+	}
+}
+
+// LoadSignatureVerifier returns a verifier for signatures made with the
+// private key of the PEM encoded ECDSA, Ed25519 or RSA public key, using
+// SHA-256 as the hash function, e.g. as made by "cosign sign-blob".
+func LoadSignatureVerifier(pemPublicKey []byte) (signature.Verifier, error) {
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(pemPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("loading verifier: %w", err)
+	}
+	return verifier, nil
+}
+
+// MachineConfigSignaturePayload returns the bytes signed by the signature in
+// MachineConfigSignatureAnnotationKey: the JSON encoded spec of mc. The
+// metadata isn't covered, so the signature can be added to it.
+func MachineConfigSignaturePayload(mc *mcfgv1.MachineConfig) ([]byte, error) {
+	payload, err := json.Marshal(mc.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling MachineConfig spec: %w", err)
+	}
+	return payload, nil
+}
+
+// verifyMachineConfigSignature checks the signature of mc if the daemon has a
+// signature verifier.
+func (dn *Daemon) verifyMachineConfigSignature(mc *mcfgv1.MachineConfig) error {
+	if dn.signatureVerifier == nil {
+		return nil
+	}
+	encoded, ok := mc.GetAnnotations()[MachineConfigSignatureAnnotationKey]
+	if !ok {
+		return fmt.Errorf("MachineConfig %s is not signed", mc.GetName())
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("decoding signature of MachineConfig %s: %w", mc.GetName(), err)
+	}
+	payload, err := MachineConfigSignaturePayload(mc)
+	if err != nil {
+		return err
+	}
+	if err := dn.signatureVerifier.VerifySignature(bytes.NewReader(sig), bytes.NewReader(payload)); err != nil {
+		return fmt.Errorf("verifying signature of MachineConfig %s: %w", mc.GetName(), err)
+	}
+	return nil
+}
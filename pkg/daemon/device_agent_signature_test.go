@@ -0,0 +1,50 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyMachineConfigSignature(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	signer, err := signature.LoadECDSASignerVerifier(priv, crypto.SHA256)
+	require.Nil(t, err)
+	pemPublicKey, err := cryptoutils.MarshalPublicKeyToPEM(priv.Public())
+	require.Nil(t, err)
+	verifier, err := LoadSignatureVerifier(pemPublicKey)
+	require.Nil(t, err)
+
+	d := newMockDeviceAgentDaemon(t.TempDir())
+	mc := newDeviceAgentTestConfig(t, "signed", nil, nil)
+
+	// Without a verifier, nothing is checked
+	require.Nil(t, d.verifyMachineConfigSignature(mc))
+
+	WithSignatureVerifier(verifier)(d)
+	assert.EqualError(t, d.verifyMachineConfigSignature(mc), "MachineConfig signed is not signed")
+
+	payload, err := MachineConfigSignaturePayload(mc)
+	require.Nil(t, err)
+	sig, err := signer.SignMessage(bytes.NewReader(payload))
+	require.Nil(t, err)
+	mc.Annotations = map[string]string{MachineConfigSignatureAnnotationKey: base64.StdEncoding.EncodeToString(sig)}
+	assert.Nil(t, d.verifyMachineConfigSignature(mc))
+
+	// Tampering with the spec invalidates the signature
+	mc.Spec.KernelArguments = []string{"init=/bin/sh"}
+	assert.NotNil(t, d.verifyMachineConfigSignature(mc))
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, mc, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.ErrorContains(t, err, "verifying signature of MachineConfig signed")
+}
@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// StagedDeploymentProbe decides how the deployment staged by an update in
+// device agent mode is checked before the reboot into it.
+type StagedDeploymentProbe struct {
+	// Status checks that the host reports a staged deployment of the OS
+	// image of the config, and that its root is in place.
+	Status bool
+	// KernelArguments checks that the staged deployment boots with the
+	// kernel arguments of the config. bootc hosts get their kernel arguments
+	// from the image, so this is only checked on rpm-ostree hosts.
+	KernelArguments bool
+	// Check, if set, is called with the staged deployment after the other
+	// checks, e.g. to look for files in its root.
+	Check func(ctx context.Context, deployment StagedDeployment) error
+}
+
+// StagedDeployment is the ostree deployment staged by an update.
+type StagedDeployment struct {
+	// ID is checksum.serial.
+	ID string
+	// Root is the directory the deployment is checked out to.
+	Root string
+	// OSImageURL is the image the deployment is expected to run.
+	OSImageURL string
+	// KernelArguments are the arguments the deployment boots with, if the
+	// probe checked them.
+	KernelArguments []string
+}
+
+// WithStagedDeploymentProbe makes updates in device agent mode that stage OS
+// changes check the staged deployment as probe says, and fail with
+// ErrOSUpdateFailed rather than leave a malformed deployment to be found by
+// the reboot. The update is rolled back as for other failures, which discards
+// the staged deployment.
+func WithStagedDeploymentProbe(probe StagedDeploymentProbe) Option {
+	return func(dn *Daemon) {
+		dn.stagedDeploymentProbe = &probe
+	}
+}
+
+// probeStagedDeployment checks the deployment staged for osConfig as probe
+// says.
+func (dn *Daemon) probeStagedDeployment(ctx context.Context, probe StagedDeploymentProbe, osConfig *mcfgv1.MachineConfig) error {
+	out, err := runGetOut("ostree", "admin", "status")
+	if err != nil {
+		return fmt.Errorf("querying deployments: %w", err)
+	}
+	index := -1
+	var deployment StagedDeployment
+	for i, d := range parseOstreeDeployments(string(out)) {
+		if d.Staged {
+			index, deployment.ID = i, d.ID
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("no deployment staged")
+	}
+	if deployment.Root, err = ostreeDeploymentRoot(deployment.ID); err != nil {
+		return err
+	}
+	deployment.OSImageURL = osConfig.Spec.OSImageURL
+
+	if probe.Status {
+		if _, err := os.Stat(filepath.Join(deployment.Root, "usr", "lib", "os-release")); err != nil {
+			return fmt.Errorf("deployment %s is incomplete: %w", deployment.ID, err)
+		}
+		staged, err := dn.stagedOSImageURL()
+		if err != nil {
+			return err
+		}
+		if deployment.OSImageURL != "" && staged != deployment.OSImageURL {
+			return fmt.Errorf("staged deployment %s runs %q, expected %q", deployment.ID, staged, deployment.OSImageURL)
+		}
+	}
+
+	if _, ok := dn.getOSUpdater().(rpmOstreeOSUpdater); ok && probe.KernelArguments {
+		// rpm-ostree indexes deployments as ostree does
+		kargs, err := runGetOut("rpm-ostree", "kargs", "--deploy-index="+strconv.Itoa(index))
+		if err != nil {
+			return err
+		}
+		deployment.KernelArguments = strings.Fields(string(kargs))
+		var missing []string
+		for _, karg := range parseKernelArguments(osConfig.Spec.KernelArguments) {
+			if !ctrlcommon.InSlice(karg, deployment.KernelArguments) {
+				missing = append(missing, karg)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("staged deployment %s is missing kernel arguments %v", deployment.ID, missing)
+		}
+	}
+
+	if probe.Check != nil {
+		if err := probe.Check(ctx, deployment); err != nil {
+			return err
+		}
+	}
+	logSystem("Staged deployment %s passed its health probe", deployment.ID)
+	return nil
+}
+
+// stagedOSImageURL returns the image of the staged deployment, as the host
+// reports it.
+func (dn *Daemon) stagedOSImageURL() (string, error) {
+	if dn.bootc != nil {
+		host, err := dn.bootc.QueryStatus()
+		if err != nil {
+			return "", err
+		}
+		staged := host.Status.Staged
+		if staged == nil || staged.Image == nil {
+			return "", fmt.Errorf("bootc reports no staged image")
+		}
+		return joinOSImageTransport(staged.Image.Image.Transport, staged.Image.Image.Image), nil
+	}
+	_, staged, err := dn.NodeUpdaterClient.GetBootedAndStagedDeployment()
+	if err != nil {
+		return "", err
+	}
+	if staged == nil {
+		return "", fmt.Errorf("rpm-ostree reports no staged deployment")
+	}
+	if staged.ContainerImageReference == "" {
+		return "", nil
+	}
+	ref, err := staged.RequireContainerImage()
+	if err != nil {
+		return "", err
+	}
+	return joinOSImageTransport(ref.Imgref.Transport, ref.Imgref.Image), nil
+}
@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagedDeploymentProbe(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	ostreeStatus, ostreeCalls := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("  fedora 3c1e5a.0 (staged)\n* fedora 9f2b44.0\n"), 0o644))
+	root := filepath.Join(ostreeDeployDir, "fedora", "deploy", "3c1e5a.0")
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "usr", "lib"), 0o755))
+	// Switching to os:2 stages stagedImage, until the test sees it undeployed
+	stagedImage := "quay.io/example/os:3"
+	staged := false
+	d := newMockDeviceAgentDaemon(testDir)
+	d.bootc = &BootcClient{
+		run: func(_ context.Context, args ...string) error {
+			staged = args[0] == "switch"
+			return nil
+		},
+		output: func(...string) ([]byte, error) {
+			status := `"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}}}`
+			if staged {
+				status += `, "staged": {"image": {"image": {"image": "` + stagedImage + `", "transport": "registry"}}}`
+			}
+			return []byte(`{"status": {` + status + `}}`), nil
+		},
+	}
+	var probed []StagedDeployment
+	WithStagedDeploymentProbe(StagedDeploymentProbe{
+		Status: true,
+		Check: func(_ context.Context, deployment StagedDeployment) error {
+			probed = append(probed, deployment)
+			return nil
+		},
+	})(d)
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+
+	// Incomplete deployments and ones of another image fail the update,
+	// which discards them
+	var osErr *ErrOSUpdateFailed
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.ErrorAs(t, err, &osErr)
+	assert.ErrorContains(t, err, "deployment 3c1e5a.0 is incomplete")
+	assert.Contains(t, ostreeCalls(), "admin undeploy 0\n")
+	staged = false
+	require.Nil(t, os.WriteFile(filepath.Join(root, "usr", "lib", "os-release"), []byte("ID=fedora\n"), 0o644))
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.ErrorAs(t, err, &osErr)
+	assert.ErrorContains(t, err, `runs "quay.io/example/os:3", expected "quay.io/example/os:2"`)
+	assert.Contains(t, ostreeCalls(), "admin undeploy 0\n")
+	staged = false
+	assert.Empty(t, probed)
+
+	stagedImage = "quay.io/example/os:2"
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []StagedDeployment{{ID: "3c1e5a.0", Root: root, OSImageURL: "quay.io/example/os:2"}}, probed)
+}
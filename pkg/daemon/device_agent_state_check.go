@@ -0,0 +1,304 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"k8s.io/klog/v2"
+)
+
+var (
+	// currentConfigHistoryDirPath keeps the current configs replaced by
+	// updates in device agent mode, for diagnosis.
+	currentConfigHistoryDirPath = "/var/lib/machine-config-daemon/currentconfig-history"
+	// stateQuarantineDirPath is where CheckStateInAgentMode moves corrupt
+	// state files.
+	stateQuarantineDirPath = "/var/lib/machine-config-daemon/quarantine"
+)
+
+const (
+	// currentConfigHistoryLimit is how many replaced current configs are
+	// kept.
+	currentConfigHistoryLimit = 10
+	// stateTimestampFormat prefixes the files of the history and the
+	// quarantine, sorting them by time.
+	stateTimestampFormat = "20060102T150405.000000000Z"
+)
+
+// StateCheckReport is what CheckStateInAgentMode found.
+type StateCheckReport struct {
+	// Checked lists the state files that were found.
+	Checked []string `json:"checked,omitempty"`
+	// Repaired lists the state files that were rewritten from the current
+	// config.
+	Repaired []string `json:"repaired,omitempty"`
+	// Quarantined lists the corrupt state files that were moved aside.
+	Quarantined []QuarantinedStateFile `json:"quarantined,omitempty"`
+}
+
+// QuarantinedStateFile is a corrupt state file moved aside.
+type QuarantinedStateFile struct {
+	Path string `json:"path"`
+	// QuarantinePath is where the file was moved to.
+	QuarantinePath string `json:"quarantinePath"`
+	Reason         string `json:"reason"`
+}
+
+// currentConfigDigestPath is where the sha256 of the current config on disk
+// is kept, to detect corruption.
+func (dn *Daemon) currentConfigDigestPath() string {
+	return dn.currentConfigPath + ".sha256"
+}
+
+// writeCurrentConfigDigest records the sha256 of the current config on disk.
+func (dn *Daemon) writeCurrentConfigDigest() error {
+	return dn.writeCurrentConfigDigestAt("")
+}
+
+// writeCurrentConfigDigestAt records the sha256 of the current config stored
+// below root, e.g. the root of another deployment.
+func (dn *Daemon) writeCurrentConfigDigestAt(root string) error {
+	hash, err := fileSHA256(filepath.Join(root, dn.currentConfigPath))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(filepath.Join(root, dn.currentConfigDigestPath()), []byte(hash+"\n"))
+}
+
+// agentStateFile is a JSON state file of device agent mode.
+type agentStateFile struct {
+	path string
+	// check returns an error if the contents don't parse or lack required
+	// fields.
+	check func(b []byte) error
+}
+
+// decodeState unmarshals b into v, which is valid if valid returns true.
+func decodeState(b []byte, v interface{}, valid func() bool) error {
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
+	if !valid() {
+		return fmt.Errorf("required fields are missing")
+	}
+	return nil
+}
+
+// agentStateFiles returns the state files checked by CheckStateInAgentMode
+// besides the current config. The update journal and snapshot are left to
+// RecoverInterruptedUpdate.
+func agentStateFiles() []agentStateFile {
+	return []agentStateFile{
+		{managedFilesPath, func(b []byte) error {
+			var v ManagedFileInventory
+			return decodeState(b, &v, func() bool { return v.ConfigName != "" })
+		}},
+		{preservedFilesPath, func(b []byte) error {
+			var v preservedFiles
+			return decodeState(b, &v, func() bool { return v.ConfigName != "" && len(v.Paths) > 0 })
+		}},
+		{pinnedDeploymentPath, func(b []byte) error {
+			var v pinnedDeployment
+			return decodeState(b, &v, func() bool { return v.Deployment != "" })
+		}},
+		{bootHealthPath, func(b []byte) error {
+			var v bootHealth
+			return decodeState(b, &v, func() bool { return v.ConfigName != "" && v.ConfigHash != "" })
+		}},
+		{stagedUpdatePath, func(b []byte) error {
+			var v stagedUpdate
+			return decodeState(b, &v, func() bool { return v.ConfigName != "" })
+		}},
+		{usrHotfixesPath, func(b []byte) error {
+			var v []usrHotfix
+			return decodeState(b, &v, func() bool {
+				for _, hotfix := range v {
+					if hotfix.Path == "" || hotfix.Digest == "" {
+						return false
+					}
+				}
+				return true
+			})
+		}},
+		{osImageManifestPath, func(b []byte) error {
+			var v OSImageManifest
+			return decodeState(b, &v, func() bool { return v.Image != "" && v.Digest != "" })
+		}},
+	}
+}
+
+// CheckStateInAgentMode validates the state files device agent mode keeps
+// below /etc/machine-config-daemon, for device agents to call on startup
+// before the first update. The current config has to parse, as has its
+// Ignition config, and match the digest recorded when it was stored. Corrupt
+// files are moved to stateQuarantineDirPath and reported. Without a valid
+// current config, the next update applies its config in full, as the first
+// update does. The managed files inventory is rewritten from the current
+// config if it is corrupt or of another config, and the digest of the current
+// config if it predates digests.
+func (dn *Daemon) CheckStateInAgentMode() (*StateCheckReport, error) {
+	release, err := acquireUpdateLock()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	c := &stateChecker{report: &StateCheckReport{}}
+	current, err := dn.checkCurrentConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range agentStateFiles() {
+		b, err := c.read(file.path)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			continue
+		}
+		if err := file.check(b); err != nil {
+			if err := c.quarantine(file.path, b, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if current != nil {
+		inventory, err := dn.ManagedFilesInAgentMode()
+		if err != nil {
+			return nil, err
+		}
+		if inventory == nil || inventory.ConfigName != current.GetName() {
+			ignConfig, err := ctrlcommon.ParseAndConvertConfig(current.Spec.Config.Raw)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeManagedFileInventory(current.GetName(), ignConfig, pathSystemd); err != nil {
+				return nil, fmt.Errorf("writing managed files inventory: %w", err)
+			}
+			logSystem("Rewrote managed files inventory of config %s", current.GetName())
+			c.report.Repaired = append(c.report.Repaired, managedFilesPath)
+		}
+	}
+	return c.report, nil
+}
+
+// stateChecker checks state files for CheckStateInAgentMode.
+type stateChecker struct {
+	report *StateCheckReport
+}
+
+// read returns the contents of path, or nil if it doesn't exist.
+func (c *stateChecker) read(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.report.Checked = append(c.report.Checked, path)
+	return b, nil
+}
+
+// quarantine moves path, which contains b, to stateQuarantineDirPath.
+func (c *stateChecker) quarantine(path string, b []byte, reason error) error {
+	dest := filepath.Join(stateQuarantineDirPath, time.Now().UTC().Format(stateTimestampFormat)+"-"+filepath.Base(path))
+	if err := os.MkdirAll(stateQuarantineDirPath, 0o755); err != nil {
+		return err
+	}
+	// Copied as /etc and /var may be different filesystems
+	if err := writeFileAtomicallyWithDefaults(dest, b); err != nil {
+		return fmt.Errorf("quarantining %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("quarantining %s: %w", path, err)
+	}
+	logSystem("Quarantined corrupt state file %s to %s: %v", path, dest, reason)
+	c.report.Quarantined = append(c.report.Quarantined, QuarantinedStateFile{Path: path, QuarantinePath: dest, Reason: reason.Error()})
+	return nil
+}
+
+// checkCurrentConfig checks the current config on disk and its digest, and
+// returns the config if it is valid.
+func (dn *Daemon) checkCurrentConfig(c *stateChecker) (*mcfgv1.MachineConfig, error) {
+	b, err := c.read(dn.currentConfigPath)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	digest, err := c.read(dn.currentConfigDigestPath())
+	if err != nil {
+		return nil, err
+	}
+
+	config := &mcfgv1.MachineConfig{}
+	reason := json.Unmarshal(b, config)
+	if reason == nil {
+		_, reason = ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	}
+	if hash, _ := fileSHA256(dn.currentConfigPath); reason == nil && digest != nil && strings.TrimSpace(string(digest)) != hash {
+		reason = fmt.Errorf("contents don't match the digest recorded in %s", dn.currentConfigDigestPath())
+	}
+	if reason == nil {
+		if digest == nil {
+			if err := dn.writeCurrentConfigDigest(); err != nil {
+				return nil, err
+			}
+			klog.Infof("Recorded digest of current config in %s", dn.currentConfigDigestPath())
+			c.report.Repaired = append(c.report.Repaired, dn.currentConfigDigestPath())
+		}
+		return config, nil
+	}
+
+	if err := c.quarantine(dn.currentConfigPath, b, reason); err != nil {
+		return nil, err
+	}
+	if digest != nil {
+		if err := c.quarantine(dn.currentConfigDigestPath(), digest, reason); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// archiveCurrentConfig adds b, the current config named name before it was
+// replaced, to the history, removing the oldest entries beyond
+// currentConfigHistoryLimit.
+func archiveCurrentConfig(b []byte, name string) error {
+	if err := os.MkdirAll(currentConfigHistoryDirPath, 0o755); err != nil {
+		return err
+	}
+	entry := time.Now().UTC().Format(stateTimestampFormat)
+	if name != "" {
+		entry += "-" + name
+	}
+	entry = filepath.Join(currentConfigHistoryDirPath, entry+".json")
+	if err := writeFileAtomicallyWithDefaults(entry, b); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(currentConfigHistoryDirPath)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	for len(names) > currentConfigHistoryLimit {
+		if err := os.Remove(filepath.Join(currentConfigHistoryDirPath, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
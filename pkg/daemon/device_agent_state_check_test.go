@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckStateInAgentMode(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+
+	first := newDeviceAgentTestConfig(t, "first", []ign3types.File{newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "state"), "first")}, nil)
+	second := newDeviceAgentTestConfig(t, "second", []ign3types.File{newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "state"), "second")}, nil)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, first, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	firstJSON, err := os.ReadFile(d.currentConfigPath)
+	require.Nil(t, err)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), first, second, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	// Replaced configs are kept for diagnosis
+	history, err := os.ReadDir(currentConfigHistoryDirPath)
+	require.Nil(t, err)
+	require.Len(t, history, 1)
+	assert.True(t, strings.HasSuffix(history[0].Name(), "-first.json"))
+	archived, err := os.ReadFile(filepath.Join(currentConfigHistoryDirPath, history[0].Name()))
+	require.Nil(t, err)
+	assert.Equal(t, firstJSON, archived)
+
+	report, err := d.CheckStateInAgentMode()
+	require.Nil(t, err)
+	assert.Equal(t, []string{d.currentConfigPath, d.currentConfigDigestPath(), managedFilesPath}, report.Checked)
+	assert.Empty(t, report.Repaired)
+	assert.Empty(t, report.Quarantined)
+
+	// Missing digests and stale inventories are rewritten
+	require.Nil(t, os.Remove(d.currentConfigDigestPath()))
+	require.Nil(t, os.WriteFile(managedFilesPath, []byte(`{"configName": "first", "files": []}`), 0o644))
+	report, err = d.CheckStateInAgentMode()
+	require.Nil(t, err)
+	assert.Equal(t, []string{d.currentConfigDigestPath(), managedFilesPath}, report.Repaired)
+	inventory, err := d.ManagedFilesInAgentMode()
+	require.Nil(t, err)
+	assert.Equal(t, "second", inventory.ConfigName)
+
+	// Corrupt state files are moved aside
+	require.Nil(t, os.WriteFile(pinnedDeploymentPath, []byte(`{"deployment": "9f2b44`), 0o644))
+	require.Nil(t, os.WriteFile(bootHealthPath, []byte(`{}`), 0o644))
+	report, err = d.CheckStateInAgentMode()
+	require.Nil(t, err)
+	require.Len(t, report.Quarantined, 2)
+	assert.Equal(t, pinnedDeploymentPath, report.Quarantined[0].Path)
+	assert.Equal(t, bootHealthPath, report.Quarantined[1].Path)
+	assert.Equal(t, "required fields are missing", report.Quarantined[1].Reason)
+	assert.NoFileExists(t, pinnedDeploymentPath)
+	quarantined, err := os.ReadFile(report.Quarantined[0].QuarantinePath)
+	require.Nil(t, err)
+	assert.Equal(t, `{"deployment": "9f2b44`, string(quarantined))
+
+	// As is a current config that doesn't match its digest, which makes the
+	// next update apply its config in full
+	current, err := os.ReadFile(d.currentConfigPath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(d.currentConfigPath, bytes.Replace(current, []byte("second"), []byte("sec0nd"), 1), 0o644))
+	report, err = d.CheckStateInAgentMode()
+	require.Nil(t, err)
+	require.Len(t, report.Quarantined, 2)
+	assert.Equal(t, d.currentConfigPath, report.Quarantined[0].Path)
+	assert.Contains(t, report.Quarantined[0].Reason, "don't match the digest")
+	assert.Equal(t, d.currentConfigDigestPath(), report.Quarantined[1].Path)
+	config, err := d.CurrentConfigInAgentMode()
+	require.Nil(t, err)
+	assert.Nil(t, config)
+
+	// Every writer of the current config records its digest along with it
+	require.Nil(t, d.storeCurrentConfigOnDisk(&onDiskConfig{currentConfig: second}))
+	report, err = d.CheckStateInAgentMode()
+	require.Nil(t, err)
+	assert.Empty(t, report.Quarantined)
+	assert.NotContains(t, report.Repaired, d.currentConfigDigestPath())
+
+	// The history is bounded
+	for i := 0; i < currentConfigHistoryLimit+2; i++ {
+		require.Nil(t, archiveCurrentConfig(firstJSON, fmt.Sprintf("config-%d", i)))
+	}
+	history, err = os.ReadDir(currentConfigHistoryDirPath)
+	require.Nil(t, err)
+	require.Len(t, history, currentConfigHistoryLimit)
+	assert.True(t, strings.HasSuffix(history[len(history)-1].Name(), fmt.Sprintf("-config-%d.json", currentConfigHistoryLimit+1)))
+}
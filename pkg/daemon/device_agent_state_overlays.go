@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// stateOverlayDirs are the directories of the read-only /usr tree of ostree
+// systems that third-party software installs into, mapped to the instance of
+// ostree-state-overlay@.service that makes them writable. On older systems
+// they are symlinks into /var instead.
+var stateOverlayDirs = map[string]string{
+	"/opt":       "opt",
+	"/usr/local": "usr-local",
+}
+
+// stateOverlayDirOf returns the state overlay directory path is in, if any.
+func stateOverlayDirOf(path string) (string, bool) {
+	for dir := range stateOverlayDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// checkReadOnlyPaths returns an error for the files, directories and links of
+// ignConfig that are below /usr, which is read-only on CoreOS, other than in
+// the state overlay directories and the files that are hotfixes.
+func checkReadOnlyPaths(ignConfig ign3types.Config, hotfixes []string) error {
+	allowed := map[string]struct{}{}
+	for _, path := range usrHotfixFiles(ignConfig, hotfixes) {
+		allowed[path] = struct{}{}
+	}
+	for path := range managedStoragePaths(ignConfig) {
+		if _, ok := stateOverlayDirOf(path); ok {
+			continue
+		}
+		if _, ok := allowed[path]; ok {
+			continue
+		}
+		if path == usrPath || strings.HasPrefix(path, usrPath+"/") {
+			return fmt.Errorf("cannot write %q: %s is read-only, only %s and /opt can be written to, and files listed in the %s annotation", path, usrPath, filepath.Join(usrPath, "local"), MachineConfigUsrHotfixesAnnotationKey)
+		}
+	}
+	return nil
+}
+
+// prepareStateOverlays makes the state overlay directories ignConfig writes
+// to writable. For symlinks into /var, the target is created, as it is only
+// populated on first boot. Read-only directories get their state overlay
+// enabled, which keeps what is written to them across OS updates.
+func prepareStateOverlays(ignConfig ign3types.Config) error {
+	used := map[string]struct{}{}
+	for path := range managedStoragePaths(ignConfig) {
+		if dir, ok := stateOverlayDirOf(path); ok {
+			used[dir] = struct{}{}
+		}
+	}
+	dirs := make([]string, 0, len(used))
+	for dir := range used {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(dir)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(dir), target)
+			}
+			if err := os.MkdirAll(target, defaultDirectoryPermissions); err != nil {
+				return fmt.Errorf("creating %q for %q: %w", target, dir, err)
+			}
+			continue
+		}
+
+		readOnly, err := isReadOnlyDir(dir)
+		if err != nil {
+			return err
+		}
+		if !readOnly {
+			continue
+		}
+		unit := "ostree-state-overlay@" + stateOverlayDirs[dir] + ".service"
+		klog.Infof("Enabling %s to make %s writable", unit, dir)
+		if err := runCmdSync("systemctl", "enable", "--now", unit); err != nil {
+			return fmt.Errorf("enabling state overlay for %s: %w", dir, err)
+		}
+		readOnly, err = isReadOnlyDir(dir)
+		if err != nil {
+			return err
+		}
+		if readOnly {
+			return fmt.Errorf("%s is still read-only after enabling %s", dir, unit)
+		}
+	}
+	return nil
+}
+
+// isReadOnlyDir returns true if dir is on a read-only mount.
+func isReadOnlyDir(dir string) (bool, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(dir, &statfs); err != nil {
+		return false, fmt.Errorf("checking whether %s is writable: %w", dir, err)
+	}
+	return statfs.Flags&unix.ST_RDONLY != 0, nil
+}
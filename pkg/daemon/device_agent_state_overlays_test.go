@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateOverlays(t *testing.T) {
+	assert.Nil(t, checkReadOnlyPaths(ign3types.Config{Storage: ign3types.Storage{Files: []ign3types.File{
+		ctrlcommon.NewIgnFile("/opt/vendor/agent.conf", ""),
+		ctrlcommon.NewIgnFile("/usr/local/bin/agent", ""),
+		ctrlcommon.NewIgnFile("/etc/agent.conf", ""),
+	}}}, nil))
+	assert.NotNil(t, checkReadOnlyPaths(ign3types.Config{Storage: ign3types.Storage{Files: []ign3types.File{
+		ctrlcommon.NewIgnFile("/usr/bin/agent", ""),
+	}}}, nil))
+	assert.NotNil(t, checkReadOnlyPaths(ign3types.Config{Storage: ign3types.Storage{Directories: []ign3types.Directory{
+		{Node: ign3types.Node{Path: "/usr/localized"}},
+	}}}, nil))
+
+	// Symlinks into a not yet populated /var get their target created
+	testDir := t.TempDir()
+	optPath := filepath.Join(testDir, "opt")
+	require.Nil(t, os.Symlink("var/opt", optPath))
+	oldStateOverlayDirs := stateOverlayDirs
+	defer func() {
+		stateOverlayDirs = oldStateOverlayDirs
+	}()
+	stateOverlayDirs = map[string]string{optPath: "opt", filepath.Join(testDir, "missing"): "missing"}
+
+	ignConfig := ign3types.Config{Storage: ign3types.Storage{Files: []ign3types.File{
+		ctrlcommon.NewIgnFile(filepath.Join(optPath, "vendor", "agent.conf"), ""),
+		ctrlcommon.NewIgnFile(filepath.Join(testDir, "missing", "file"), ""),
+	}}}
+	require.Nil(t, prepareStateOverlays(ignConfig))
+	assert.DirExists(t, filepath.Join(testDir, "var", "opt"))
+}
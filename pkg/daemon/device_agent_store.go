@@ -0,0 +1,235 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// defaultContentStoreDirPath is the content store of a daemon created by
+// NewClusterlessDaemon.
+const defaultContentStoreDirPath = "/var/lib/machine-config-daemon/content-store"
+
+// contentStoreMinSize is the size from which files are deduplicated by the
+// content store; smaller ones are cheaper to write than to look up.
+const contentStoreMinSize = 1 << 20
+
+// contentStoreManifest lists the objects the last update used, so prune keeps
+// them for one more update.
+const contentStoreManifest = ".last-used"
+
+// WithContentStoreDir overrides where device agent mode keeps the contents of
+// large files, so updates shipping the same contents again copy them from the
+// store instead of fetching or decoding them. An empty dir disables the content
+// store.
+func WithContentStoreDir(dir string) Option {
+	return func(dn *Daemon) {
+		dn.contentStore = nil
+		if dir != "" {
+			dn.contentStore = &contentStore{dir: dir}
+		}
+	}
+}
+
+// reflinkFile makes dst share the extents of src, as FICLONE does.
+var reflinkFile = func(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// contentStore keeps large file contents by their hash. Files get their own
+// copy of an object, sharing its extents by reflink, so that each has its own
+// mode, ownership, extended attributes and SELinux label; hard links would
+// share them, and fail between the mounts of /var and /etc. Objects are only
+// added on filesystems supporting reflinks, where they cost no space, and are
+// verified before they are reused.
+type contentStore struct {
+	dir string
+}
+
+// key returns the name of the store object for file, or "" if the file isn't
+// deduplicated. Inline contents are hashed, and remote contents must have a
+// verification hash.
+func (s *contentStore) key(file ign3types.File) (string, error) {
+	if isRemoteSource(file.Contents.Source) {
+		hash := file.Contents.Verification.Hash
+		if hash == nil || strings.ContainsRune(*hash, filepath.Separator) || strings.HasPrefix(*hash, ".") {
+			return "", nil
+		}
+		return *hash, nil
+	}
+	h := sha256.New()
+	counter := &countingWriter{w: h}
+	if err := writeFileContents(file, counter); err != nil {
+		return "", err
+	}
+	if counter.n < contentStoreMinSize {
+		return "", nil
+	}
+	return "sha256-" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyTo writes the object key to dest, with mode and ownership, returning
+// false if there is no intact object to copy.
+func (s *contentStore) copyTo(key, dest string, mode os.FileMode, uid, gid int) (bool, error) {
+	obj := filepath.Join(s.dir, key)
+	if err := s.verify(key); err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Dropping corrupt content store object %s: %v", key, err)
+			os.Remove(obj)
+		}
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), defaultDirectoryPermissions); err != nil {
+		return false, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(dest), err)
+	}
+	if err := cloneFile(obj, dest, mode, true); err != nil {
+		return false, fmt.Errorf("copying content store object %s: %w", key, err)
+	}
+	if uid != -1 && gid != -1 {
+		if err := os.Chown(dest, uid, gid); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// verify checks that the object key still has the contents it is named after.
+func (s *contentStore) verify(key string) error {
+	obj := filepath.Join(s.dir, key)
+	info, err := os.Lstat(obj)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+
+	f, err := os.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	verifier, err := newContentVerifier(obj, &key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	return verifier.verify()
+}
+
+// add reflinks the file written at path into the store as the object key, if
+// it is large enough. Failures are only logged, as they just lose the
+// deduplication.
+func (s *contentStore) add(key, path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() < contentStoreMinSize {
+		return
+	}
+	obj := filepath.Join(s.dir, key)
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		klog.Warningf("Failed to create content store: %v", err)
+		return
+	}
+	tmp := obj + ".tmp"
+	if err := cloneFile(path, tmp, 0o600, false); err != nil {
+		os.Remove(tmp)
+		if errors.Is(err, errReflinkUnsupported) {
+			klog.V(2).Infof("Not adding %q to the content store: %v", path, err)
+		} else {
+			klog.Warningf("Failed to add %q to the content store: %v", path, err)
+		}
+		return
+	}
+	if err := os.Rename(tmp, obj); err != nil {
+		os.Remove(tmp)
+		klog.Warningf("Failed to add %q to the content store: %v", path, err)
+	}
+}
+
+var errReflinkUnsupported = errors.New("reflinks are not supported between the files")
+
+// cloneFile creates dest with mode, sharing the extents of src by reflink, or
+// as a copy of src if copyFallback is set and reflinks aren't supported.
+func cloneFile(src, dest string, mode os.FileMode, copyFallback bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := out.Chmod(mode); err != nil {
+		return err
+	}
+
+	err = reflinkFile(out, in)
+	switch {
+	case err == nil:
+	case errors.Is(err, unix.EXDEV), errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOTTY):
+		if !copyFallback {
+			return fmt.Errorf("%w: %v", errReflinkUnsupported, err)
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return out.Sync()
+}
+
+// prune removes the objects neither this update nor the previous one used, so
+// reverting an update still finds its contents, and records used for the next
+// update.
+func (s *contentStore) prune(used sets.Set[string]) {
+	keep := used.Clone()
+	if b, err := os.ReadFile(filepath.Join(s.dir, contentStoreManifest)); err == nil {
+		keep.Insert(strings.Fields(string(b))...)
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Failed to read content store: %v", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() == contentStoreManifest || keep.Has(entry.Name()) {
+			continue
+		}
+		klog.V(2).Infof("Pruning content store object %s", entry.Name())
+		if err := os.Remove(filepath.Join(s.dir, entry.Name())); err != nil {
+			klog.Warningf("Failed to prune content store object %s: %v", entry.Name(), err)
+		}
+	}
+	if err := writeFileAtomicallyWithDefaults(filepath.Join(s.dir, contentStoreManifest), []byte(strings.Join(sets.List(used), "\n"))); err != nil {
+		klog.Warningf("Failed to record used content store objects: %v", err)
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestRunOnceInDeviceAgentModeContentStore(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+	d.contentStore = &contentStore{dir: filepath.Join(testDir, "content-store")}
+
+	// Without reflinks, nothing is stored
+	large := strings.Repeat("model weights\n", contentStoreMinSize/10)
+	firstPath := filepath.Join(testDir, "etc", "first.bin")
+	unsupportedConfig := newDeviceAgentTestConfig(t, "unsupported", []ign3types.File{newDeviceAgentTestFile(t, firstPath, large)}, nil)
+	oldReflinkFile := reflinkFile
+	defer func() { reflinkFile = oldReflinkFile }()
+	reflinkFile = func(_, _ *os.File) error { return unix.EOPNOTSUPP }
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, unsupportedConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	objects, err := os.ReadDir(d.contentStore.dir)
+	require.Nil(t, err)
+	assert.Len(t, objects, 1, "only the manifest")
+
+	// Reflinks are simulated by copies
+	reflinked := 0
+	reflinkFile = func(dst, src *os.File) error {
+		reflinked++
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	secondPath := filepath.Join(testDir, "etc", "second.bin")
+	smallPath := filepath.Join(testDir, "etc", "small")
+	oldFiles := []ign3types.File{
+		newDeviceAgentTestFile(t, firstPath, large),
+		newDeviceAgentTestFile(t, secondPath, large),
+		newDeviceAgentTestFile(t, smallPath, "small"),
+	}
+	oldFiles[1].Mode = helpers.IntToPtr(0o600)
+	oldConfig := newDeviceAgentTestConfig(t, "old", oldFiles, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), unsupportedConfig, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	// Identical large contents are stored once and copied to each file,
+	// which keeps its own inode and mode; small ones aren't stored
+	assert.Equal(t, 2, reflinked, "stored once, copied once")
+	first, err := os.Stat(firstPath)
+	require.Nil(t, err)
+	second, err := os.Stat(secondPath)
+	require.Nil(t, err)
+	assert.False(t, os.SameFile(first, second))
+	assert.Equal(t, os.FileMode(0o600), second.Mode().Perm())
+	assert.Equal(t, defaultFilePermissions, first.Mode().Perm())
+	contents, err := os.ReadFile(secondPath)
+	require.Nil(t, err)
+	assert.Equal(t, large, string(contents))
+	objects, err = os.ReadDir(d.contentStore.dir)
+	require.Nil(t, err)
+	require.Len(t, objects, 2)
+	var object string
+	for _, o := range objects {
+		if o.Name() != contentStoreManifest {
+			object = filepath.Join(d.contentStore.dir, o.Name())
+		}
+	}
+
+	// Files modified in place don't affect the object
+	f, err := os.OpenFile(firstPath, os.O_APPEND|os.O_WRONLY, 0)
+	require.Nil(t, err)
+	_, err = f.WriteString("drift")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	require.Nil(t, d.contentStore.verify(filepath.Base(object)))
+
+	// A corrupt object is dropped instead of reused
+	require.Nil(t, os.WriteFile(object, []byte("corrupt"), 0o600))
+	thirdPath := filepath.Join(testDir, "etc", "third.bin")
+	newConfig := newDeviceAgentTestConfig(t, "new", append(oldFiles, newDeviceAgentTestFile(t, thirdPath, large)), nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	contents, err = os.ReadFile(thirdPath)
+	require.Nil(t, err)
+	assert.Equal(t, large, string(contents))
+	require.Nil(t, d.contentStore.verify(filepath.Base(object)))
+
+	// Objects are kept for one more update after they were last used
+	emptyConfig := newDeviceAgentTestConfig(t, "empty", nil, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, emptyConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.FileExists(t, object)
+	d.contentStore.prune(sets.New[string]())
+	assert.NoFileExists(t, object)
+}
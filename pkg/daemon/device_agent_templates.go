@@ -0,0 +1,285 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/vincent-petithory/dataurl"
+	"k8s.io/klog/v2"
+)
+
+// MachineConfigFileTemplatesAnnotationKey opts files of a MachineConfig into
+// templating in device agent mode, so a single config can serve a fleet of
+// individually addressed devices. It is a JSON array of file paths:
+//
+//	["/etc/agent/agent.conf"]
+//
+// The contents of these files are Go templates, rendered before they are
+// written, with:
+//
+//	{{ .Hostname }}       the hostname
+//	{{ .PrimaryIP }}      the address of the interface with the default route
+//	{{ .SerialNumber }}   the serial number of the device
+//	{{ .Values.key }}     a value of the daemon's template values file
+//
+// The template values file holds "key=value" lines, see
+// WithTemplateValuesFile. Templated files must have inline contents, and
+// their verification hash, if any, is checked against the template.
+const MachineConfigFileTemplatesAnnotationKey = "machineconfiguration.openshift.io/file-templates"
+
+// defaultTemplateValuesPath is the template values file of a daemon created
+// by NewClusterlessDaemon.
+const defaultTemplateValuesPath = "/etc/machine-config-daemon/template-values"
+
+var (
+	// serialNumberPaths are tried in order for the serial number of the
+	// device, for x86 and device tree based systems respectively.
+	serialNumberPaths = []string{"/sys/class/dmi/id/product_serial", "/proc/device-tree/serial-number"}
+	// procNetRoutePath is the kernel's IPv4 routing table.
+	procNetRoutePath = "/proc/net/route"
+)
+
+// WithTemplateValuesFile overrides where the values for {{ .Values.key }} in
+// templated files are read from.
+func WithTemplateValuesFile(path string) Option {
+	return func(dn *Daemon) {
+		dn.templateValuesPath = path
+	}
+}
+
+// templateData is what templated files are rendered with. Node-local values
+// are only looked up once a template uses them, so a device lacking e.g. a
+// serial number can still render templates that don't need one.
+type templateData struct {
+	// Values are read from the template values file
+	Values map[string]string
+}
+
+// Hostname returns the hostname of the device.
+func (templateData) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+// PrimaryIP returns the address of the interface with the default route,
+// preferring IPv4 addresses.
+func (templateData) PrimaryIP() (string, error) {
+	iface, err := defaultRouteInterface()
+	if err != nil {
+		return "", err
+	}
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", fmt.Errorf("looking up default route interface %s: %w", iface, err)
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("listing addresses of %s: %w", iface, err)
+	}
+	var ipv6 string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if ipv6 == "" {
+			ipv6 = ipNet.IP.String()
+		}
+	}
+	if ipv6 == "" {
+		return "", fmt.Errorf("no address on default route interface %s", iface)
+	}
+	return ipv6, nil
+}
+
+// SerialNumber returns the serial number of the device.
+func (templateData) SerialNumber() (string, error) {
+	for _, path := range serialNumberPaths {
+		b, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading serial number: %w", err)
+		}
+		// The device tree's strings are NUL terminated
+		if serial := strings.TrimSpace(strings.TrimRight(string(b), "\x00")); serial != "" {
+			return serial, nil
+		}
+	}
+	return "", fmt.Errorf("no serial number found")
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route with
+// the lowest metric.
+func defaultRouteInterface() (string, error) {
+	f, err := os.Open(procNetRoutePath)
+	if err != nil {
+		return "", fmt.Errorf("reading routing table: %w", err)
+	}
+	defer f.Close()
+
+	iface, bestMetric := "", -1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 || fields[1] != "00000000" {
+			continue
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+		if bestMetric < 0 || metric < bestMetric {
+			iface, bestMetric = fields[0], metric
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading routing table: %w", err)
+	}
+	if iface == "" {
+		return "", fmt.Errorf("no default route")
+	}
+	return iface, nil
+}
+
+// readTemplateValues parses a template values file of "key=value" lines.
+// Empty lines and lines starting with "#" are skipped. A missing file has no
+// values.
+func readTemplateValues(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading template values: %w", err)
+	}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid template value on line %d of %s", i+1, path)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values, nil
+}
+
+// machineConfigFileTemplates returns the paths of the files mc's annotation
+// marks as templates.
+func machineConfigFileTemplates(mc *mcfgv1.MachineConfig) (map[string]struct{}, error) {
+	encoded, ok := mc.GetAnnotations()[MachineConfigFileTemplatesAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var paths []string
+	if err := json.Unmarshal([]byte(encoded), &paths); err != nil {
+		return nil, fmt.Errorf("parsing %s annotation: %w", MachineConfigFileTemplatesAnnotationKey, err)
+	}
+	templated := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		templated[path] = struct{}{}
+	}
+	return templated, nil
+}
+
+// renderedContents are the contents of a file rendered to b.
+func renderedContents(b []byte) ign3types.Resource {
+	source := dataurl.EncodeBytes(b)
+	compression := ""
+	return ign3types.Resource{Source: &source, Compression: &compression}
+}
+
+// writtenFileTemplates replaces the contents of the files of ignConfig that
+// mc's annotation marks as templates with their contents on disk, which is
+// what they rendered to when mc was applied. Templates whose files are
+// missing are kept as they are.
+func writtenFileTemplates(mc *mcfgv1.MachineConfig, ignConfig *ign3types.Config) error {
+	templated, err := machineConfigFileTemplates(mc)
+	if err != nil {
+		return err
+	}
+	for i := range ignConfig.Storage.Files {
+		file := &ignConfig.Storage.Files[i]
+		if _, ok := templated[file.Path]; !ok {
+			continue
+		}
+		b, err := os.ReadFile(file.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading templated file %q: %w", file.Path, err)
+		}
+		file.Contents = renderedContents(b)
+	}
+	return nil
+}
+
+// renderFileTemplates replaces the contents of the files of ignConfig that
+// mc's annotation marks as templates with their rendered contents.
+func (dn *Daemon) renderFileTemplates(mc *mcfgv1.MachineConfig, ignConfig *ign3types.Config) error {
+	templated, err := machineConfigFileTemplates(mc)
+	if err != nil || templated == nil {
+		return err
+	}
+	count := len(templated)
+
+	values, err := readTemplateValues(dn.templateValuesPath)
+	if err != nil {
+		return err
+	}
+	data := templateData{Values: values}
+
+	for i := range ignConfig.Storage.Files {
+		file := &ignConfig.Storage.Files[i]
+		if _, ok := templated[file.Path]; !ok {
+			continue
+		}
+		delete(templated, file.Path)
+
+		if isRemoteSource(file.Contents.Source) {
+			return fmt.Errorf("templated file %q must have inline contents", file.Path)
+		}
+		contents, err := decodeFileContents(*file)
+		if err != nil {
+			return fmt.Errorf("decoding template %q: %w", file.Path, err)
+		}
+		tmpl, err := template.New(file.Path).Option("missingkey=error").Parse(string(contents))
+		if err != nil {
+			return fmt.Errorf("parsing template %q: %w", file.Path, err)
+		}
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return fmt.Errorf("rendering template %q: %w", file.Path, err)
+		}
+
+		file.Contents = renderedContents(rendered.Bytes())
+	}
+	for path := range templated {
+		return fmt.Errorf("template given for %q, which is not a file of MachineConfig %s", path, mc.GetName())
+	}
+	klog.V(2).Infof("Rendered %d templated files of MachineConfig %s", count, mc.GetName())
+	return nil
+}
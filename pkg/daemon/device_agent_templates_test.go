@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunOnceInDeviceAgentModeTemplates(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	oldSerialNumberPaths, oldProcNetRoutePath := serialNumberPaths, procNetRoutePath
+	defer func() {
+		serialNumberPaths, procNetRoutePath = oldSerialNumberPaths, oldProcNetRoutePath
+	}()
+	serialPath := filepath.Join(testDir, "serial-number")
+	require.Nil(t, os.WriteFile(serialPath, []byte("SN1234\x00"), 0o644))
+	serialNumberPaths = []string{filepath.Join(testDir, "product_serial"), serialPath}
+	procNetRoutePath = filepath.Join(testDir, "route")
+	require.Nil(t, os.WriteFile(procNetRoutePath, []byte(
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\n"+
+			"lo\t00000000\t00000000\t0001\t0\t0\t100\t00000000\n"), 0o644))
+
+	d := newMockDeviceAgentDaemon(testDir)
+	d.templateValuesPath = filepath.Join(testDir, "template-values")
+	require.Nil(t, os.WriteFile(d.templateValuesPath, []byte("# Site of the device\nsite = berlin-1\n"), 0o644))
+
+	hostname, err := os.Hostname()
+	require.Nil(t, err)
+
+	templatedPath := filepath.Join(testDir, "etc", "agent.conf")
+	plainPath := filepath.Join(testDir, "etc", "plain")
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, templatedPath, "host={{ .Hostname }} ip={{ .PrimaryIP }} serial={{ .SerialNumber }} site={{ .Values.site }}"),
+		newDeviceAgentTestFile(t, plainPath, "{{ .Hostname }}"),
+	}, nil)
+	newConfig.Annotations = map[string]string{MachineConfigFileTemplatesAnnotationKey: fmt.Sprintf("[%q]", templatedPath)}
+
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	contents, err := os.ReadFile(templatedPath)
+	require.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("host=%s ip=127.0.0.1 serial=SN1234 site=berlin-1", hostname), string(contents))
+	contents, err = os.ReadFile(plainPath)
+	require.Nil(t, err)
+	assert.Equal(t, "{{ .Hostname }}", string(contents))
+
+	// Reapplying renders the same contents, so nothing is written
+	result, err := d.PlanInDeviceAgentMode(newConfig, newConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.Empty(t, result.FilesWritten)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.NoOp)
+
+	// Changed facts render differently, so reapplying rewrites the file
+	require.Nil(t, os.WriteFile(d.templateValuesPath, []byte("site = paris-2\n"), 0o644))
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	assert.Equal(t, []string{templatedPath}, result.FilesWritten)
+	contents, err = os.ReadFile(templatedPath)
+	require.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("host=%s ip=127.0.0.1 serial=SN1234 site=paris-2", hostname), string(contents))
+
+	// Missing values fail the update
+	missingConfig := newDeviceAgentTestConfig(t, "missing", []ign3types.File{
+		newDeviceAgentTestFile(t, templatedPath, "{{ .Values.unknown }}"),
+	}, nil)
+	missingConfig.Annotations = newConfig.Annotations
+	_, err = d.PlanInDeviceAgentMode(newConfig, missingConfig, deviceAgentTestSelector)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,576 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deviceAgentTestSelector applies everything but the CA bundle.
+const deviceAgentTestSelector = ApplyAll &^ ApplyCertificates
+
+// newMockDeviceAgentDaemon returns a mock Daemon without a cluster connection
+// that stores its on-disk state below testDir.
+func newMockDeviceAgentDaemon(testDir string) *Daemon {
+	d := newMockDaemon()
+	d.kubeClient = nil
+	d.currentConfigPath = filepath.Join(testDir, "currentconfig")
+	d.currentImagePath = filepath.Join(testDir, "currentimage")
+	return &d
+}
+
+// newDeviceAgentTestFile returns an Ignition file owned by the current user so
+// the test doesn't try to chown to root.
+func newDeviceAgentTestFile(t *testing.T, path, contents string) ign3types.File {
+	t.Helper()
+
+	currentUser, err := user.Current()
+	require.Nil(t, err)
+	uid, err := strconv.Atoi(currentUser.Uid)
+	require.Nil(t, err)
+	gid, err := strconv.Atoi(currentUser.Gid)
+	require.Nil(t, err)
+
+	f := ctrlcommon.NewIgnFile(path, contents)
+	f.User = ign3types.NodeUser{ID: &uid}
+	f.Group = ign3types.NodeGroup{ID: &gid}
+	return f
+}
+
+func newDeviceAgentTestConfig(t *testing.T, name string, files []ign3types.File, units []ign3types.Unit) *mcfgv1.MachineConfig {
+	t.Helper()
+
+	ignCfg := ctrlcommon.NewIgnConfig()
+	ignCfg.Storage.Files = files
+	ignCfg.Systemd.Units = units
+	mc := helpers.CreateMachineConfigFromIgnition(ignCfg)
+	mc.Name = name
+	return mc
+}
+
+func TestRunOnceInDeviceAgentMode(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	keptPath := filepath.Join(testDir, "etc", "kept")
+	changedPath := filepath.Join(testDir, "etc", "changed")
+	removedPath := filepath.Join(testDir, "etc", "removed")
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		newDeviceAgentTestFile(t, keptPath, "kept"),
+		newDeviceAgentTestFile(t, changedPath, "old"),
+		newDeviceAgentTestFile(t, removedPath, "removed"),
+	}, nil)
+	oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+	require.Nil(t, err)
+	require.Nil(t, d.writeFiles(context.TODO(), oldIgn.Storage.Files, nil, true))
+
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, keptPath, "kept"),
+		newDeviceAgentTestFile(t, changedPath, "new"),
+	}, []ign3types.Unit{{Name: "foo.service", Contents: helpers.StrToPtr("[Unit]")}})
+
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	assert.Equal(t, "old", result.OldConfigName)
+	assert.Equal(t, "new", result.NewConfigName)
+	assert.Equal(t, []string{changedPath}, result.FilesWritten)
+	assert.Equal(t, []string{removedPath}, result.FilesRemoved)
+	assert.Equal(t, []string{"foo.service"}, result.UnitsChanged)
+	assert.True(t, result.RebootRequired)
+	assert.True(t, result.DrainRequired)
+	assert.False(t, result.Drained)
+	// Reboots are left to the caller without changing the daemon
+	assert.False(t, d.skipReboot)
+
+	contents, err := os.ReadFile(changedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "new", string(contents))
+	assert.NoFileExists(t, removedPath)
+
+	odc, err := d.getCurrentConfigOnDisk()
+	require.Nil(t, err)
+	assert.Equal(t, "new", odc.currentConfig.GetName())
+}
+
+func TestCalculateUnitDiffs(t *testing.T) {
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "same.service", Contents: helpers.StrToPtr("same")},
+		{Name: "changed.service", Contents: helpers.StrToPtr("old")},
+		{Name: "removed.service", Contents: helpers.StrToPtr("removed")},
+	}
+	newIgn := ctrlcommon.NewIgnConfig()
+	newIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "same.service", Contents: helpers.StrToPtr("same")},
+		{Name: "changed.service", Contents: helpers.StrToPtr("new")},
+		{Name: "added.service", Contents: helpers.StrToPtr("added")},
+	}
+
+	assert.Equal(t, []string{"added.service", "changed.service", "removed.service"}, calculateUnitDiffs(&oldIgn, &newIgn))
+	assert.Empty(t, calculateUnitDiffs(&oldIgn, &oldIgn))
+}
+
+func TestPlanInDeviceAgentMode(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	keptFile := newDeviceAgentTestFile(t, filepath.Join(testDir, "etc", "kept"), "kept")
+	addedPath := filepath.Join(testDir, "etc", "added")
+
+	gpgFile := newDeviceAgentTestFile(t, GPGNoRebootPath, "key")
+
+	tests := []struct {
+		name           string
+		newFiles       []ign3types.File
+		rebootRequired bool
+		drainRequired  bool
+		filesWritten   []string
+		actions        []string
+		actionFiles    map[string][]string
+	}{
+		{
+			name:     "no changes",
+			newFiles: []ign3types.File{keptFile},
+			actions:  []string{postConfigChangeActionNone},
+		},
+		{
+			name:           "new file requires reboot",
+			newFiles:       []ign3types.File{keptFile, newDeviceAgentTestFile(t, addedPath, "added")},
+			rebootRequired: true,
+			drainRequired:  true,
+			filesWritten:   []string{addedPath},
+			actions:        []string{postConfigChangeActionReboot},
+			actionFiles:    map[string][]string{postConfigChangeActionReboot: {addedPath}},
+		},
+		{
+			name:         "gpg key requires crio reload",
+			newFiles:     []ign3types.File{keptFile, gpgFile},
+			filesWritten: []string{GPGNoRebootPath},
+			actions:      []string{postConfigChangeActionReloadCrio},
+			actionFiles:  map[string][]string{postConfigChangeActionReloadCrio: {GPGNoRebootPath}},
+		},
+		{
+			name:           "files trigger different actions",
+			newFiles:       []ign3types.File{keptFile, gpgFile, newDeviceAgentTestFile(t, addedPath, "added")},
+			rebootRequired: true,
+			drainRequired:  true,
+			filesWritten:   []string{addedPath, GPGNoRebootPath},
+			actions:        []string{postConfigChangeActionReboot},
+			actionFiles: map[string][]string{
+				postConfigChangeActionReboot:     {addedPath},
+				postConfigChangeActionReloadCrio: {GPGNoRebootPath},
+			},
+		},
+	}
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{keptFile}, nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newConfig := newDeviceAgentTestConfig(t, "new", test.newFiles, nil)
+
+			result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, ApplyAll)
+			require.Nil(t, err)
+			assert.True(t, result.DryRun)
+			assert.Equal(t, test.rebootRequired, result.RebootRequired)
+			assert.Equal(t, test.drainRequired, result.DrainRequired)
+			assert.ElementsMatch(t, test.filesWritten, result.FilesWritten)
+			assert.Equal(t, test.actions, result.PostConfigChangeActions)
+			assert.Equal(t, test.actionFiles, result.PostConfigChangeActionFiles)
+
+			assert.NoFileExists(t, addedPath)
+			assert.NoFileExists(t, d.currentConfigPath)
+		})
+	}
+}
+
+// sigtermObserver records whether SIGTERM is ignored and the published update
+// status as each phase starts.
+type sigtermObserver struct {
+	recordingUpdateObserver
+	dn        *Daemon
+	protected map[UpdatePhase]bool
+	statuses  []updateStatus
+}
+
+func (o *sigtermObserver) OnPhaseStart(phase UpdatePhase) {
+	o.dn.updateActiveLock.Lock()
+	o.protected[phase] = o.dn.updateActive
+	o.dn.updateActiveLock.Unlock()
+	status := updateStatus{}
+	if b, err := os.ReadFile(updateStatusPath); err == nil && json.Unmarshal(b, &status) == nil {
+		o.statuses = append(o.statuses, status)
+	}
+}
+
+func TestSIGTERMProtectionByPhase(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	observer := &sigtermObserver{dn: d, protected: map[UpdatePhase]bool{}}
+	d.RegisterUpdateObserver(observer)
+
+	filePath := filepath.Join(testDir, "etc", "protected")
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, filePath, "protected")}, nil)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	// Planning stays interruptible, writing files and the config doesn't
+	assert.Equal(t, map[UpdatePhase]bool{UpdatePhasePlan: false, UpdatePhaseFiles: true, UpdatePhasePasswd: true, UpdatePhaseFinalize: true}, observer.protected)
+	require.Len(t, observer.statuses, 4)
+	assert.Equal(t, UpdatePhasePlan, observer.statuses[0].Phase)
+	assert.Equal(t, "new", observer.statuses[0].NewConfigName)
+	assert.False(t, observer.statuses[0].SIGTERMProtected)
+	assert.Equal(t, UpdatePhaseFiles, observer.statuses[1].Phase)
+	assert.True(t, observer.statuses[1].SIGTERMProtected)
+
+	// Both are gone once the update is done
+	assert.False(t, d.updateActive)
+	assert.NoFileExists(t, updateStatusPath)
+}
+
+func TestUpdatePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       UpdatePolicy
+		contents     string
+		keepSnapshot bool
+	}{
+		{
+			name:     "rollback",
+			policy:   DefaultUpdatePolicy(),
+			contents: "old",
+		},
+		{
+			name:     "keep partial update",
+			policy:   UpdatePolicy{},
+			contents: "new",
+		},
+		{
+			name:         "leave partial update for debugging",
+			policy:       UpdatePolicy{RollbackOnFailure: true, LeavePartialForDebug: true},
+			contents:     "new",
+			keepSnapshot: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDir, cleanup := setupTempDirWithEtc(t)
+			defer cleanup()
+
+			d := newMockDeviceAgentDaemon(testDir)
+
+			changedPath := filepath.Join(testDir, "etc", "changed")
+			oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, changedPath, "old")}, nil)
+			oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+			require.Nil(t, err)
+			require.Nil(t, d.writeFiles(context.TODO(), oldIgn.Storage.Files, nil, true))
+
+			// Writing the second file fails half way through the files phase,
+			// as a directory is in its way
+			badPath := filepath.Join(testDir, "etc", "bad")
+			require.Nil(t, os.MkdirAll(badPath, 0o755))
+			badFile := newDeviceAgentTestFile(t, badPath, "bad")
+			newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, changedPath, "new"), badFile}, nil)
+
+			_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, test.policy)
+			require.NotNil(t, err)
+
+			contents, err := os.ReadFile(changedPath)
+			require.Nil(t, err)
+			assert.Equal(t, test.contents, string(contents))
+
+			if test.keepSnapshot {
+				assert.DirExists(t, snapshotParentDirPath)
+				assert.FileExists(t, updateJournalPath)
+
+				// The next update attempt rolls the partial update back first
+				recovery, err := d.RecoverInterruptedUpdate()
+				require.Nil(t, err)
+				require.NotNil(t, recovery)
+				assert.Equal(t, RecoveryActionRolledBack, recovery.Action)
+				contents, err := os.ReadFile(changedPath)
+				require.Nil(t, err)
+				assert.Equal(t, "old", string(contents))
+			} else {
+				assert.NoDirExists(t, snapshotParentDirPath)
+				assert.NoFileExists(t, updateJournalPath)
+			}
+		})
+	}
+}
+
+func TestPlanInDeviceAgentModeIgnition35(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	addedPath := filepath.Join(testDir, "etc", "added")
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, addedPath, "added")}, nil)
+	newConfig.Spec.Config.Raw = []byte(strings.Replace(string(newConfig.Spec.Config.Raw), `"version":"3.4.0"`, `"version":"3.5.0"`, 1))
+	require.Contains(t, string(newConfig.Spec.Config.Raw), `"version":"3.5.0"`)
+
+	result, err := d.PlanInDeviceAgentMode(nil, newConfig, ApplyAll)
+	require.Nil(t, err)
+	assert.Equal(t, []string{addedPath}, result.FilesWritten)
+}
+
+func TestRunOnceInDeviceAgentModeNoOp(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	observer := &recordingUpdateObserver{}
+	d.RegisterUpdateObserver(observer)
+
+	filePath := filepath.Join(testDir, "etc", "noop")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, filePath, "noop")}, nil)
+	oldConfig.Spec.KernelArguments = []string{"quiet"}
+	// Same contents, but in a different spec version and under another name
+	newConfig := oldConfig.DeepCopy()
+	newConfig.Name = "new"
+	newConfig.Spec.Config.Raw = []byte(strings.Replace(string(oldConfig.Spec.Config.Raw), `"version":"3.4.0"`, `"version":"3.2.0"`, 1))
+	require.NotEqual(t, oldConfig.Spec.Config.Raw, newConfig.Spec.Config.Raw)
+
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.NoOp)
+	assert.Equal(t, "old", result.OldConfigName)
+	assert.Equal(t, "new", result.NewConfigName)
+	assert.Empty(t, observer.phases)
+	assert.NoFileExists(t, filePath)
+	assert.NoFileExists(t, d.currentConfigPath)
+
+	// Any change in content goes through the full update
+	newConfig.Spec.KernelArguments = nil
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	assert.Contains(t, observer.phases, UpdatePhaseFinalize)
+}
+
+func TestEffectiveConfigHashAnnotations(t *testing.T) {
+	config := newDeviceAgentTestConfig(t, "config", nil, nil)
+	d := &Daemon{}
+	hash, err := d.effectiveConfigHash(config, false)
+	require.Nil(t, err)
+
+	// Annotations changing what is applied change the hash
+	for _, key := range []string{
+		MachineConfigApplyPhasesAnnotationKey,
+		MachineConfigDeferredUnitsAnnotationKey,
+		MachineConfigUnitReloadPolicyAnnotationKey,
+	} {
+		annotated := config.DeepCopy()
+		annotated.Annotations = map[string]string{key: "[]"}
+		annotatedHash, err := d.effectiveConfigHash(annotated, false)
+		require.Nil(t, err)
+		assert.NotEqual(t, hash, annotatedHash, key)
+	}
+}
+
+// cancelingUpdateObserver cancels the update once the first file is written.
+type cancelingUpdateObserver struct {
+	recordingUpdateObserver
+	cancel context.CancelFunc
+}
+
+func (o *cancelingUpdateObserver) OnFileWritten(path string) {
+	o.recordingUpdateObserver.OnFileWritten(path)
+	o.cancel()
+}
+
+func TestRunOnceInDeviceAgentModeCanceled(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	observer := &cancelingUpdateObserver{cancel: cancel}
+	d.RegisterUpdateObserver(observer)
+
+	firstPath := filepath.Join(testDir, "etc", "first")
+	secondPath := filepath.Join(testDir, "etc", "second")
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, firstPath, "first"),
+		newDeviceAgentTestFile(t, secondPath, "second"),
+	}, nil)
+
+	_, err := d.RunOnceInDeviceAgentMode(ctx, nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []string{firstPath}, observer.filesWritten)
+	assert.Equal(t, UpdatePhaseFiles, observer.errPhase)
+
+	// The file written before the cancellation was rolled back
+	assert.NoFileExists(t, firstPath)
+	assert.NoFileExists(t, secondPath)
+	assert.NoFileExists(t, d.currentConfigPath)
+
+	// An already canceled update doesn't start
+	_, err = d.RunOnceInDeviceAgentMode(ctx, nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, firstPath)
+}
+
+func TestRunOnceInDeviceAgentModeOrphanedFiles(t *testing.T) {
+	tests := []struct {
+		policy   OrphanedFilePolicy
+		kept     bool
+		backedUp bool
+		invalid  bool
+	}{
+		{policy: "", kept: false},
+		{policy: OrphanedFilesDelete, kept: false},
+		{policy: OrphanedFilesBackup, kept: false, backedUp: true},
+		{policy: OrphanedFilesKeep, kept: true},
+		// Unknown policies fail the update before anything is deleted
+		{policy: "Remove", kept: true, invalid: true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(string(test.policy), func(t *testing.T) {
+			testDir, cleanup := setupTempDirWithEtc(t)
+			defer cleanup()
+
+			d := newMockDeviceAgentDaemon(testDir)
+
+			keptPath := filepath.Join(testDir, "etc", "kept")
+			orphanedPath := filepath.Join(testDir, "etc", "state")
+			oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+				newDeviceAgentTestFile(t, keptPath, "kept"),
+				newDeviceAgentTestFile(t, orphanedPath, "managed"),
+			}, nil)
+			_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+			require.Nil(t, err)
+			// The device stores its own state in the managed path
+			require.Nil(t, os.WriteFile(orphanedPath, []byte("state"), 0o644))
+
+			newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, keptPath, "kept")}, nil)
+			policy := DefaultUpdatePolicy()
+			policy.OrphanedFiles = test.policy
+			result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, policy)
+			if test.invalid {
+				assert.ErrorContains(t, err, `unknown orphaned file policy "Remove"`)
+			} else {
+				require.Nil(t, err)
+				assert.Equal(t, []string{orphanedPath}, result.FilesRemoved)
+			}
+
+			if test.kept {
+				contents, err := os.ReadFile(orphanedPath)
+				require.Nil(t, err)
+				assert.Equal(t, "state", string(contents))
+			} else {
+				assert.NoFileExists(t, orphanedPath)
+			}
+
+			backupPath := filepath.Join(orphanedDirPath, orphanedPath)
+			if test.backedUp {
+				contents, err := os.ReadFile(backupPath)
+				require.Nil(t, err)
+				assert.Equal(t, "state", string(contents))
+			} else {
+				assert.NoFileExists(t, backupPath)
+			}
+		})
+	}
+}
+
+func TestEquivalentFileChanges(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	path := filepath.Join(testDir, "etc", "app.conf")
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{newDeviceAgentTestFile(t, path, "key=value\n")}, nil)
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, path, "# managed\nkey=value\n")}, nil)
+
+	result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.True(t, result.RebootRequired)
+
+	// Files whose contents are equivalent are written without actions
+	unregister, err := ctrlcommon.RegisterContentNormalizer(path, ctrlcommon.StripLineComments("#"))
+	require.Nil(t, err)
+	defer unregister()
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{path}, result.FilesWritten)
+	assert.False(t, result.RebootRequired)
+	assert.Empty(t, result.PostConfigChangeActionFiles)
+	contents, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "# managed\nkey=value\n", string(contents))
+}
+
+func TestForceApply(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	keptPath := filepath.Join(testDir, "etc", "kept")
+	removedPath := filepath.Join(testDir, "etc", "removed")
+	contents := "[Unit]\nDescription=test\n"
+	units := []ign3types.Unit{{Name: "test.service", Contents: &contents}}
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		newDeviceAgentTestFile(t, keptPath, "kept"),
+		newDeviceAgentTestFile(t, removedPath, "removed"),
+	}, units)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(keptPath, []byte("tampered"), 0o644))
+
+	// Content-identical configs are skipped unless forced
+	sameConfig := oldConfig.DeepCopy()
+	sameConfig.Name = "same"
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, sameConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.True(t, result.NoOp)
+	assert.False(t, result.Forced)
+
+	policy := DefaultUpdatePolicy()
+	policy.ForceApply = true
+	result, err = d.PlanInDeviceAgentMode(oldConfig, sameConfig, deviceAgentTestSelector)
+	require.Nil(t, err)
+	assert.Empty(t, result.FilesWritten)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, sameConfig, deviceAgentTestSelector, policy)
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	assert.True(t, result.Forced)
+	assert.ElementsMatch(t, []string{keptPath, removedPath}, result.FilesWritten)
+	assert.Equal(t, []string{"test.service"}, result.UnitsChanged)
+	assert.Equal(t, []string{keptPath}, result.FilesBackedUp)
+	written, err := os.ReadFile(keptPath)
+	require.Nil(t, err)
+	assert.Equal(t, "kept", string(written))
+
+	// What only the old config has is still removed
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, keptPath, "kept")}, nil)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), sameConfig, newConfig, deviceAgentTestSelector, policy)
+	require.Nil(t, err)
+	assert.Equal(t, []string{keptPath}, result.FilesWritten)
+	assert.Equal(t, []string{removedPath}, result.FilesRemoved)
+	assert.Equal(t, []string{"test.service"}, result.UnitsChanged)
+	assert.NoFileExists(t, removedPath)
+}
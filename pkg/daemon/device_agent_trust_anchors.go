@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"k8s.io/klog/v2"
+)
+
+// trustAnchorsDirPath is where device agent mode adds the certificates of the
+// CA bundles of the config to the system trust store.
+var trustAnchorsDirPath = filepath.Join("/etc", "pki", "ca-trust", "source", "anchors")
+
+// trustAnchorPrefix marks the anchors the daemon owns, so it can remove them
+// once their certificates are dropped.
+const trustAnchorPrefix = "mcd-"
+
+// planTrustAnchors splits the cloud CA bundle of files into anchors holding
+// the certificates of one issuer each, named after it. Certificates are only
+// added once, and not at all if they are in the user CA bundle, which already
+// is an anchor. The kubelet CA bundle is left out, so TLS clients on the host
+// don't trust what the kubelet CA signs, and so is a bundle with remote
+// contents.
+func planTrustAnchors(files []ign3types.File) (map[string][]byte, error) {
+	bundles := map[string]ign3types.File{}
+	for _, f := range files {
+		bundles[f.Path] = f
+	}
+
+	seen := map[string]struct{}{}
+	if f, ok := bundles[userCABundleFilePath]; ok && !isRemoteSource(f.Contents.Source) {
+		contents, err := decodeFileContents(f)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseCertificates(contents)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", f.Path, err)
+		}
+		for _, cert := range certs {
+			seen[certificateFingerprint(cert)] = struct{}{}
+		}
+	}
+
+	anchors := map[string][]byte{}
+	f, ok := bundles[cloudCABundleFilePath]
+	if !ok {
+		return anchors, nil
+	}
+	if isRemoteSource(f.Contents.Source) {
+		klog.Warningf("Not adding %q to the trust store, its contents are remote", f.Path)
+		return anchors, nil
+	}
+	contents, err := decodeFileContents(f)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(contents)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", f.Path, err)
+	}
+	for _, cert := range certs {
+		fingerprint := certificateFingerprint(cert)
+		if _, ok := seen[fingerprint]; ok {
+			continue
+		}
+		seen[fingerprint] = struct{}{}
+		name := trustAnchorName(cert)
+		anchors[name] = append(anchors[name], pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return anchors, nil
+}
+
+// parseCertificates returns the certificates of a PEM bundle.
+func parseCertificates(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// trustAnchorName returns the name of the anchor for the issuer of cert.
+func trustAnchorName(cert *x509.Certificate) string {
+	name := cert.Issuer.CommonName
+	if name == "" && len(cert.Issuer.Organization) > 0 {
+		name = cert.Issuer.Organization[0]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, name)
+	sum := sha256.Sum256(cert.RawIssuer)
+	return fmt.Sprintf("%s%s-%s.pem", trustAnchorPrefix, name, hex.EncodeToString(sum[:4]))
+}
+
+// trustAnchorPaths returns the paths of the anchors the daemon owns now and of
+// the given ones, for the snapshot of an update.
+func trustAnchorPaths(anchors map[string][]byte) []string {
+	var paths []string
+	for name := range anchors {
+		paths = append(paths, filepath.Join(trustAnchorsDirPath, name))
+	}
+	entries, _ := os.ReadDir(trustAnchorsDirPath)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), trustAnchorPrefix) {
+			paths = append(paths, filepath.Join(trustAnchorsDirPath, entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// syncTrustAnchors writes the anchors and removes the ones the daemon owns
+// that aren't among them, returning true if anything changed.
+func syncTrustAnchors(anchors map[string][]byte) (bool, error) {
+	changed := false
+	entries, err := os.ReadDir(trustAnchorsDirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, entry := range entries {
+		if _, ok := anchors[entry.Name()]; ok || !strings.HasPrefix(entry.Name(), trustAnchorPrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(trustAnchorsDirPath, entry.Name())); err != nil {
+			return changed, fmt.Errorf("removing trust anchor: %w", err)
+		}
+		klog.Infof("Removed trust anchor %s", entry.Name())
+		changed = true
+	}
+	for name, contents := range anchors {
+		path := filepath.Join(trustAnchorsDirPath, name)
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, contents) {
+			continue
+		}
+		if err := writeFileAtomicallyWithDefaults(path, contents); err != nil {
+			return changed, fmt.Errorf("writing trust anchor: %w", err)
+		}
+		klog.Infof("Wrote trust anchor %s", name)
+		changed = true
+	}
+	return changed, nil
+}
+
+// updateTrustAnchors syncs the anchors and extracts the trust store again if
+// they changed, returning whether they did.
+func updateTrustAnchors(anchors map[string][]byte) (bool, error) {
+	changed, err := syncTrustAnchors(anchors)
+	if err != nil || !changed {
+		return changed, err
+	}
+	if err := runCmdSync("update-ca-trust", "extract"); err != nil {
+		return changed, err
+	}
+	logSystem("Updated the system trust store from the CA bundles of the config")
+	return changed, nil
+}
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCACertificate(t *testing.T, name string, serial int64) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestTrustAnchors(t *testing.T) {
+	_, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	kubeCA := newTestCACertificate(t, "Kube API Server CA", 1)
+	cloudCA := newTestCACertificate(t, "Cloud CA", 2)
+	userCA := newTestCACertificate(t, "User CA", 3)
+	proxyCA := newTestCACertificate(t, "Proxy CA", 4)
+	bundle := func(certs ...[]byte) string {
+		return string(bytes.Join(certs, nil))
+	}
+
+	// Certificates are split per issuer and deduplicated, also against the
+	// user CA bundle, and the kubelet CA bundle is no anchor
+	anchors, err := planTrustAnchors([]ign3types.File{
+		ctrlcommon.NewIgnFile(caBundleFilePath, bundle(kubeCA)),
+		ctrlcommon.NewIgnFile(cloudCABundleFilePath, bundle(cloudCA, proxyCA, cloudCA, userCA)),
+		ctrlcommon.NewIgnFile(userCABundleFilePath, bundle(userCA)),
+	})
+	require.Nil(t, err)
+	require.Len(t, anchors, 2)
+	names := make([]string, 0, len(anchors))
+	for name, contents := range anchors {
+		names = append(names, name)
+		certs, err := parseCertificates(contents)
+		require.Nil(t, err)
+		assert.Len(t, certs, 1)
+	}
+	sort.Strings(names)
+	assert.Regexp(t, `^mcd-cloud_ca-[0-9a-f]{8}\.pem$`, names[0])
+	assert.Regexp(t, `^mcd-proxy_ca-[0-9a-f]{8}\.pem$`, names[1])
+
+	// Only changes to the set of anchors count
+	localAnchor := filepath.Join(trustAnchorsDirPath, "local.pem")
+	require.Nil(t, os.MkdirAll(trustAnchorsDirPath, 0o755))
+	require.Nil(t, os.WriteFile(localAnchor, userCA, 0o644))
+	changed, err := syncTrustAnchors(anchors)
+	require.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = syncTrustAnchors(anchors)
+	require.Nil(t, err)
+	assert.False(t, changed)
+	assert.Len(t, trustAnchorPaths(anchors), 4)
+
+	delete(anchors, names[0])
+	changed, err = syncTrustAnchors(anchors)
+	require.Nil(t, err)
+	assert.True(t, changed)
+	assert.NoFileExists(t, filepath.Join(trustAnchorsDirPath, names[0]))
+	assert.FileExists(t, filepath.Join(trustAnchorsDirPath, names[1]))
+	assert.FileExists(t, localAnchor)
+}
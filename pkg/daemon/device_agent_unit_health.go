@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// UnitHealthPolicy decides how the units an update starts and restarts are
+// checked before the update is declared successful.
+type UnitHealthPolicy struct {
+	// Timeout is how long to wait for the units of each batch of the
+	// dependency order to settle, i.e. to become active or inactive, before
+	// the next batch is restarted. The zero value doesn't wait.
+	Timeout time.Duration
+	// CriticalUnits fail the update with ErrUnitUnhealthy, rolling it back
+	// if the UpdatePolicy says so, if they enter the failed state or don't
+	// settle within Timeout. Other units only log a warning. If empty, all
+	// units are critical.
+	CriticalUnits []string
+	// BatchInterval is waited between restarting the batches of units, to
+	// limit the rate of restarts of dependent units.
+	BatchInterval time.Duration
+}
+
+const (
+	// unitHealthInterval is the first interval between checks of the units,
+	// doubling up to maxUnitHealthInterval.
+	unitHealthInterval    = 500 * time.Millisecond
+	maxUnitHealthInterval = 5 * time.Second
+)
+
+func (p UnitHealthPolicy) isCritical(name string) bool {
+	return len(p.CriticalUnits) == 0 || ctrlcommon.InSlice(name, p.CriticalUnits)
+}
+
+// waitHealthy waits for the units to settle, checking with backoff, and
+// returns ErrUnitUnhealthy for the critical ones that failed or didn't. It
+// returns the error of ctx if ctx is done first.
+func (m *UnitManager) waitHealthy(ctx context.Context, units []string) error {
+	if m.health.Timeout <= 0 || len(units) == 0 || m.systemctlOutput == nil {
+		return nil
+	}
+	interval := m.healthInterval
+	if interval <= 0 {
+		interval = unitHealthInterval
+	}
+	deadline := time.Now().Add(m.health.Timeout)
+	var states map[string]string
+	for {
+		out, err := m.systemctlOutput(append([]string{"show", "--property=Id,ActiveState", "--"}, units...)...)
+		if err != nil {
+			klog.Warningf("Failed to get the state of units %v: %v", units, err)
+		}
+		states = parseUnitStates(out)
+		if unitsSettled(units, states) || !time.Now().Add(interval).Before(deadline) {
+			break
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+		if interval *= 2; interval > maxUnitHealthInterval {
+			interval = maxUnitHealthInterval
+		}
+	}
+
+	var unhealthy []string
+	for _, name := range units {
+		state := states[name]
+		if state == "active" || state == "inactive" {
+			continue
+		}
+		if !m.health.isCritical(name) {
+			logSystem("Unit %s is %s after the update, continuing as it is not critical", name, unitStateDescription(state))
+			continue
+		}
+		unhealthy = append(unhealthy, name)
+	}
+	if len(unhealthy) > 0 {
+		return &ErrUnitUnhealthy{Units: unhealthy, States: states}
+	}
+	return nil
+}
+
+// sleepContext waits for d, returning the error of ctx if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// unitsSettled returns true if none of the units is still changing state.
+// Failed units are settled, as they don't recover without a restart.
+func unitsSettled(units []string, states map[string]string) bool {
+	for _, name := range units {
+		switch states[name] {
+		case "active", "inactive", "failed":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func unitStateDescription(state string) string {
+	if state == "" {
+		return "in an unknown state"
+	}
+	return state
+}
+
+// parseUnitStates returns the ActiveState of each unit of systemctl show
+// --property=Id,ActiveState output.
+func parseUnitStates(out []byte) map[string]string {
+	states := map[string]string{}
+	for _, block := range strings.Split(string(out), "\n\n") {
+		var id, state string
+		for _, line := range strings.Split(block, "\n") {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "Id":
+				id = value
+			case "ActiveState":
+				state = value
+			}
+		}
+		if id != "" {
+			states[id] = state
+		}
+	}
+	return states
+}
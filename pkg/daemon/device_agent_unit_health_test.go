@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitManagerHealth(t *testing.T) {
+	plan := UnitPlan{Restart: []string{"app.service", "sidecar.service"}}
+	// Each call returns the next states, the last ones repeating
+	unitManager := func(health UnitHealthPolicy, states ...string) *UnitManager {
+		return &UnitManager{
+			systemctl: func(args ...string) error { return nil },
+			systemctlOutput: func(args ...string) ([]byte, error) {
+				if args[1] != "--property=Id,ActiveState" {
+					return nil, fmt.Errorf("no dependencies")
+				}
+				out := states[0]
+				if len(states) > 1 {
+					states = states[1:]
+				}
+				return []byte(out), nil
+			},
+			health:         health,
+			healthInterval: time.Millisecond,
+		}
+	}
+
+	t.Run("waits for units to settle", func(t *testing.T) {
+		m := unitManager(UnitHealthPolicy{Timeout: time.Second, CriticalUnits: []string{"app.service"}},
+			"Id=app.service\nActiveState=activating\n\nId=sidecar.service\nActiveState=failed\n",
+			"Id=app.service\nActiveState=active\n\nId=sidecar.service\nActiveState=failed\n")
+		// sidecar.service is not critical
+		assert.Nil(t, m.Apply(context.TODO(), plan))
+	})
+
+	t.Run("fails for failed critical units", func(t *testing.T) {
+		m := unitManager(UnitHealthPolicy{Timeout: time.Second},
+			"Id=app.service\nActiveState=failed\n\nId=sidecar.service\nActiveState=active\n")
+		err := m.Apply(context.TODO(), plan)
+		var unhealthy *ErrUnitUnhealthy
+		require.ErrorAs(t, err, &unhealthy)
+		assert.Equal(t, []string{"app.service"}, unhealthy.Units)
+		assert.Equal(t, ErrorCodeUnitUnhealthy, ErrorCodeOf(err))
+		assert.EqualError(t, err, "units not healthy after the update: app.service (failed)")
+	})
+
+	t.Run("fails for critical units not settling in time", func(t *testing.T) {
+		m := unitManager(UnitHealthPolicy{Timeout: 20 * time.Millisecond},
+			"Id=app.service\nActiveState=activating\n\nId=sidecar.service\nActiveState=active\n")
+		assert.EqualError(t, m.Apply(context.TODO(), plan), "units not healthy after the update: app.service (activating)")
+	})
+
+	t.Run("stops waiting when canceled", func(t *testing.T) {
+		m := unitManager(UnitHealthPolicy{Timeout: time.Minute},
+			"Id=app.service\nActiveState=activating\n\nId=sidecar.service\nActiveState=active\n")
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		assert.ErrorIs(t, m.Apply(ctx, plan), context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 10*time.Second)
+	})
+
+	t.Run("doesn't wait without a timeout", func(t *testing.T) {
+		m := unitManager(UnitHealthPolicy{}, "Id=app.service\nActiveState=failed\n")
+		assert.Nil(t, m.Apply(context.TODO(), plan))
+	})
+}
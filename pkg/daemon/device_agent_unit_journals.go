@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// unitJournalLines and unitJournalBytes bound the journal excerpt kept
+	// per unit, keeping its last lines.
+	unitJournalLines = 50
+	unitJournalBytes = 8 * 1024
+)
+
+// captureJournals returns the journal excerpts of the units since the time
+// Apply started acting on them, covering how they stopped and started again.
+// Units without entries have none.
+func (m *UnitManager) captureJournals(units []string, since time.Time) map[string]string {
+	if m.journalctl == nil || len(units) == 0 {
+		return nil
+	}
+	journals := map[string]string{}
+	for _, name := range units {
+		out, err := m.journalctl("--unit="+name, fmt.Sprintf("--since=@%d", since.Unix()), fmt.Sprintf("--lines=%d", unitJournalLines), "--output=short-iso", "--no-pager", "--quiet")
+		if err != nil {
+			klog.Warningf("Failed to get the journal of unit %s: %v", name, err)
+			continue
+		}
+		if excerpt := boundJournal(string(out)); excerpt != "" {
+			journals[name] = excerpt
+		}
+	}
+	if len(journals) == 0 {
+		return nil
+	}
+	return journals
+}
+
+// boundJournal returns the last lines of out fitting in unitJournalBytes.
+func boundJournal(out string) string {
+	out = strings.TrimSpace(out)
+	if len(out) <= unitJournalBytes {
+		return out
+	}
+	out = out[len(out)-unitJournalBytes:]
+	if i := strings.IndexByte(out, '\n'); i >= 0 {
+		out = out[i+1:]
+	}
+	return out
+}
+
+// recordJournals keeps the journals of the units Apply acted on, attaching
+// those of unhealthy units to err and logging the ones of all units if the
+// update of the units failed.
+func (m *UnitManager) recordJournals(acted map[string]struct{}, since time.Time, err error) {
+	var units []string
+	for name := range acted {
+		units = append(units, name)
+	}
+	sort.Strings(units)
+	journals := m.captureJournals(units, since)
+	for name, excerpt := range journals {
+		if m.journals == nil {
+			m.journals = map[string]string{}
+		}
+		m.journals[name] = excerpt
+	}
+	if err == nil {
+		return
+	}
+	if unhealthy, ok := err.(*ErrUnitUnhealthy); ok {
+		unhealthy.Journals = map[string]string{}
+		for _, name := range unhealthy.Units {
+			if excerpt, ok := journals[name]; ok {
+				unhealthy.Journals[name] = excerpt
+			}
+		}
+	}
+	for _, name := range units {
+		if excerpt, ok := journals[name]; ok {
+			klog.Warningf("Journal of unit %s during the failed update:\n%s", name, excerpt)
+		}
+	}
+}
+
+// mergeUnitJournals adds the journals of more to journals, the excerpts of
+// more replacing those of the same units.
+func mergeUnitJournals(journals, more map[string]string) map[string]string {
+	for name, excerpt := range more {
+		if journals == nil {
+			journals = map[string]string{}
+		}
+		journals[name] = excerpt
+	}
+	return journals
+}
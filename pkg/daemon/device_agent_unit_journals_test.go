@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitManagerJournals(t *testing.T) {
+	plan := UnitPlan{Stop: []string{"old.service"}, Restart: []string{"app.service", "sidecar.service"}}
+	var queried []string
+	m := &UnitManager{
+		systemctl: func(args ...string) error { return nil },
+		systemctlOutput: func(args ...string) ([]byte, error) {
+			if args[1] != "--property=Id,ActiveState" {
+				return nil, fmt.Errorf("no dependencies")
+			}
+			return []byte("Id=app.service\nActiveState=failed\n\nId=sidecar.service\nActiveState=active\n"), nil
+		},
+		journalctl: func(args ...string) ([]byte, error) {
+			name := strings.TrimPrefix(args[0], "--unit=")
+			queried = append(queried, name)
+			if name == "sidecar.service" {
+				return nil, nil
+			}
+			return []byte(name + ": Stopped.\n" + name + ": Started.\n"), nil
+		},
+		health:         UnitHealthPolicy{Timeout: time.Second},
+		healthInterval: time.Millisecond,
+	}
+
+	err := m.Apply(context.TODO(), plan)
+	var unhealthy *ErrUnitUnhealthy
+	require.ErrorAs(t, err, &unhealthy)
+	assert.Equal(t, []string{"app.service", "old.service", "sidecar.service"}, queried)
+	assert.Equal(t, map[string]string{"app.service": "app.service: Stopped.\napp.service: Started."}, unhealthy.Journals)
+	// Units without entries have no excerpt
+	assert.Equal(t, map[string]string{
+		"app.service": "app.service: Stopped.\napp.service: Started.",
+		"old.service": "old.service: Stopped.\nold.service: Started.",
+	}, m.journals)
+
+	long := strings.Repeat("0123456789abcdef\n", unitJournalBytes/16)
+	bounded := boundJournal(long + "last\n")
+	assert.LessOrEqual(t, len(bounded), unitJournalBytes)
+	assert.True(t, strings.HasPrefix(bounded, "0123456789abcdef\n"))
+	assert.True(t, strings.HasSuffix(bounded, "\nlast"))
+}
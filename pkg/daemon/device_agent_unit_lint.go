@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+)
+
+// unitTypeSections are the sections each type of unit has besides [Unit] and
+// [Install], as in systemd-analyze verify.
+var unitTypeSections = map[string]string{
+	".service":   "Service",
+	".socket":    "Socket",
+	".target":    "",
+	".timer":     "Timer",
+	".path":      "Path",
+	".mount":     "Mount",
+	".automount": "Automount",
+	".swap":      "Swap",
+	".slice":     "Slice",
+	".scope":     "Scope",
+	".device":    "",
+}
+
+// lintUnits checks the units of newIgnConfig that are added or changed from
+// oldIgnConfig, so that units systemd would refuse to load fail the update
+// before anything is written rather than when they are started.
+func lintUnits(oldIgnConfig, newIgnConfig *ign3types.Config) error {
+	oldUnits := unitsByName(oldIgnConfig)
+	for _, u := range newIgnConfig.Systemd.Units {
+		if isTrue(u.Mask) {
+			continue
+		}
+		if old, ok := oldUnits[u.Name]; ok && reflect.DeepEqual(old.Contents, u.Contents) && reflect.DeepEqual(old.Dropins, u.Dropins) {
+			continue
+		}
+		if err := lintUnit(u); err != nil {
+			return fmt.Errorf("invalid unit %s: %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+func lintUnit(u ign3types.Unit) error {
+	ext := filepath.Ext(u.Name)
+	typeSection, ok := unitTypeSections[ext]
+	if !ok {
+		return fmt.Errorf("unknown unit type %q", ext)
+	}
+	// In the order systemd reads them
+	names, sources := []string{u.Name}, []*string{u.Contents}
+	dropins := append([]ign3types.Dropin{}, u.Dropins...)
+	sort.Slice(dropins, func(i, j int) bool { return dropins[i].Name < dropins[j].Name })
+	for _, d := range dropins {
+		if filepath.Ext(d.Name) != ".conf" {
+			return fmt.Errorf("dropin %s doesn't end in .conf and would be ignored", d.Name)
+		}
+		names, sources = append(names, u.Name+".d/"+d.Name), append(sources, d.Contents)
+	}
+
+	set := map[string]bool{}
+	for i, contents := range sources {
+		if contents == nil {
+			continue
+		}
+		name := names[i]
+		opts, err := unit.DeserializeOptions(strings.NewReader(*contents))
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", name, err)
+		}
+		for _, opt := range opts {
+			switch {
+			case opt.Section == "Unit", opt.Section == "Install", opt.Section == typeSection && typeSection != "",
+				strings.HasPrefix(opt.Section, "X-"):
+			default:
+				return fmt.Errorf("%s has section [%s], which %s units don't have", name, opt.Section, strings.TrimPrefix(ext, "."))
+			}
+			// Empty values reset list options
+			set[opt.Section+"."+opt.Name] = opt.Value != ""
+		}
+	}
+
+	// Units only extended by dropins are checked along with the unit on disk
+	// by systemd, which we don't see
+	if u.Contents == nil {
+		return nil
+	}
+	hasAny := func(section string, names ...string) bool {
+		for _, name := range names {
+			if set[section+"."+name] {
+				return true
+			}
+		}
+		return false
+	}
+	switch ext {
+	case ".service":
+		if !hasAny("Service", "ExecStart", "ExecStop", "SuccessAction") {
+			return fmt.Errorf("service has no ExecStart=, ExecStop= or SuccessAction=")
+		}
+	case ".timer":
+		if !hasAny("Timer", "OnActiveSec", "OnBootSec", "OnStartupSec", "OnUnitActiveSec", "OnUnitInactiveSec", "OnCalendar", "OnClockChange", "OnTimezoneChange") {
+			return fmt.Errorf("timer has no trigger")
+		}
+	case ".socket":
+		if !hasAny("Socket", "ListenStream", "ListenDatagram", "ListenSequentialPacket", "ListenFIFO", "ListenSpecial", "ListenNetlink", "ListenMessageQueue", "ListenUSBFunction") {
+			return fmt.Errorf("socket has no Listen*= option")
+		}
+	case ".mount":
+		if !hasAny("Mount", "What") {
+			return fmt.Errorf("mount has no What=")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintUnits(t *testing.T) {
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Systemd.Units = []ign3types.Unit{
+		// Unchanged units aren't checked
+		{Name: "legacy.service", Contents: helpers.StrToPtr("[Unit]")},
+	}
+	for _, tc := range []struct {
+		unit ign3types.Unit
+		err  string
+	}{
+		{unit: ign3types.Unit{Name: "app.service", Contents: helpers.StrToPtr("[Service]\nExecStart=/usr/bin/app\n[Install]\nWantedBy=multi-user.target")}},
+		{unit: ign3types.Unit{Name: "app.service", Contents: helpers.StrToPtr("[Unit]")}, err: "invalid unit app.service: service has no ExecStart=, ExecStop= or SuccessAction="},
+		{unit: ign3types.Unit{Name: "app.service", Contents: helpers.StrToPtr("[Service]\nExecStart=/usr/bin/app"), Dropins: []ign3types.Dropin{
+			{Name: "10-reset.conf", Contents: helpers.StrToPtr("[Service]\nExecStart=")},
+		}}, err: "invalid unit app.service: service has no ExecStart=, ExecStop= or SuccessAction="},
+		{unit: ign3types.Unit{Name: "app.service", Contents: helpers.StrToPtr("[Service\nExecStart=/usr/bin/app")}, err: "invalid unit app.service: parsing app.service: "},
+		{unit: ign3types.Unit{Name: "app.service", Contents: helpers.StrToPtr("[Timer]\nOnCalendar=daily")}, err: "invalid unit app.service: app.service has section [Timer], which service units don't have"},
+		{unit: ign3types.Unit{Name: "app.service", Dropins: []ign3types.Dropin{{Name: "10-mcd", Contents: helpers.StrToPtr("[Service]")}}}, err: "invalid unit app.service: dropin 10-mcd doesn't end in .conf and would be ignored"},
+		{unit: ign3types.Unit{Name: "app.service", Dropins: []ign3types.Dropin{{Name: "10-mcd.conf", Contents: helpers.StrToPtr("[Service]\nX-Custom=1\n[X-Vendor]\nKey=value")}}}},
+		{unit: ign3types.Unit{Name: "app.timer", Contents: helpers.StrToPtr("[Timer]\nPersistent=true")}, err: "invalid unit app.timer: timer has no trigger"},
+		{unit: ign3types.Unit{Name: "app.socket", Contents: helpers.StrToPtr("[Socket]\nListenStream=8080")}},
+		{unit: ign3types.Unit{Name: "app.conf", Contents: helpers.StrToPtr("[Unit]")}, err: `invalid unit app.conf: unknown unit type ".conf"`},
+		{unit: ign3types.Unit{Name: "app.service", Contents: helpers.StrToPtr("[Unit]"), Mask: helpers.BoolToPtr(true)}},
+	} {
+		newIgn := ctrlcommon.NewIgnConfig()
+		newIgn.Systemd.Units = append([]ign3types.Unit{oldIgn.Systemd.Units[0]}, tc.unit)
+		err := lintUnits(&oldIgn, &newIgn)
+		if tc.err == "" {
+			assert.Nil(t, err, tc.unit.Name)
+			continue
+		}
+		require.NotNil(t, err, tc.err)
+		assert.Contains(t, err.Error(), tc.err)
+	}
+
+	// Invalid units fail the update before anything is written
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+	d.manageUnits = true
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, []ign3types.Unit{{Name: "foo.service", Contents: helpers.StrToPtr("[Unit]")}})
+	_, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, ApplyAll)
+	assert.Equal(t, ErrorCodeUnreconcilable, ErrorCodeOf(err))
+	assert.EqualError(t, err, "can't reconcile config old with new: invalid unit foo.service: service has no ExecStart=, ExecStop= or SuccessAction=")
+}
@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// MachineConfigUnitReloadPolicyAnnotationKey declares the config files of
+// units in device agent mode, and whether the units are reloaded or restarted
+// when they change, as a JSON object mapping unit names to policies:
+//
+//	{"haproxy.service": {"paths": ["/etc/haproxy"], "action": "reload"}}
+//
+// The paths are files or directories the files are under. Changes to them
+// don't call for post config change actions or a reboot; instead the units
+// are reloaded, or restarted if the action is "restart", if they are running.
+// Units that can't be reloaded are restarted. Units whose own definition
+// changes are restarted anyway. MergeMachineConfigsInAgentMode merges the
+// policies of all configs, later configs replacing those of the same unit.
+const MachineConfigUnitReloadPolicyAnnotationKey = "machineconfiguration.openshift.io/unit-reload-policy"
+
+// unitReloadPolicy is the policy of a unit of the unit reload policy
+// annotation.
+type unitReloadPolicy struct {
+	Paths  []string `json:"paths"`
+	Action string   `json:"action,omitempty"`
+}
+
+// machineConfigUnitReloadPolicies returns the policies of mc's annotation.
+func machineConfigUnitReloadPolicies(mc *mcfgv1.MachineConfig) (map[string]unitReloadPolicy, error) {
+	policies := map[string]unitReloadPolicy{}
+	encoded, ok := mc.GetAnnotations()[MachineConfigUnitReloadPolicyAnnotationKey]
+	if !ok {
+		return policies, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &policies); err != nil {
+		return policies, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigUnitReloadPolicyAnnotationKey, mc.GetName(), err)
+	}
+	for name, policy := range policies {
+		switch policy.Action {
+		case "", "reload", "restart":
+		default:
+			return policies, fmt.Errorf("invalid action %q for unit %s in %s annotation of MachineConfig %s", policy.Action, name, MachineConfigUnitReloadPolicyAnnotationKey, mc.GetName())
+		}
+		for _, path := range policy.Paths {
+			if !strings.HasPrefix(path, "/") {
+				return policies, fmt.Errorf("path %q of unit %s in %s annotation of MachineConfig %s isn't absolute", path, name, MachineConfigUnitReloadPolicyAnnotationKey, mc.GetName())
+			}
+		}
+	}
+	return policies, nil
+}
+
+// mergeUnitReloadPolicyAnnotations sets the unit reload policy annotation of
+// merged to the policies of configs, in order of their names, later ones
+// winning.
+func mergeUnitReloadPolicyAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	policies := map[string]unitReloadPolicy{}
+	for _, config := range sorted {
+		fragment, err := machineConfigUnitReloadPolicies(config)
+		if err != nil {
+			return err
+		}
+		for name, policy := range fragment {
+			policies[name] = policy
+		}
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	return setJSONAnnotation(merged, MachineConfigUnitReloadPolicyAnnotationKey, policies)
+}
+
+// unitReloads returns the units whose config files are among the changed
+// files, mapped to "reload" or "restart", and the changed files that aren't
+// config files of any unit.
+func unitReloads(policies map[string]unitReloadPolicy, diffFileSet []string) (map[string]string, []string) {
+	reloads := map[string]string{}
+	var others []string
+	for _, path := range diffFileSet {
+		covered := false
+		for name, policy := range policies {
+			if !inApplyPhase(applyPhase{Files: policy.Paths}, path) {
+				continue
+			}
+			covered = true
+			if policy.Action == "restart" || reloads[name] == "restart" {
+				reloads[name] = "restart"
+			} else {
+				reloads[name] = "reload"
+			}
+		}
+		if !covered {
+			others = append(others, path)
+		}
+	}
+	return reloads, others
+}
+
+// reloadForConfigFiles adds the units of reloads to the plan, unless they are
+// restarted or started anyway.
+func (p *UnitPlan) reloadForConfigFiles(reloads map[string]string) {
+	for name, action := range reloads {
+		if ctrlcommon.InSlice(name, p.Start) || ctrlcommon.InSlice(name, p.Restart) || ctrlcommon.InSlice(name, p.TryRestart) {
+			continue
+		}
+		if action == "restart" {
+			p.TryRestart = append(p.TryRestart, name)
+		} else {
+			p.Reload = append(p.Reload, name)
+		}
+	}
+	sort.Strings(p.Reload)
+	sort.Strings(p.TryRestart)
+}
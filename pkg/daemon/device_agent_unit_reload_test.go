@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitReloadPolicy(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		ctrlcommon.NewIgnFile("/etc/haproxy/haproxy.cfg", "old"),
+		ctrlcommon.NewIgnFile("/etc/app/app.conf", "old"),
+	}, nil)
+	base := newDeviceAgentTestConfig(t, "00-base", []ign3types.File{
+		ctrlcommon.NewIgnFile("/etc/haproxy/haproxy.cfg", "new"),
+		ctrlcommon.NewIgnFile("/etc/app/app.conf", "new"),
+	}, nil)
+	base.Annotations = map[string]string{MachineConfigUnitReloadPolicyAnnotationKey: `{"haproxy.service": {"paths": ["/etc/haproxy/"]}, "app.service": {"paths": ["/etc/app"]}}`}
+	site := newDeviceAgentTestConfig(t, "10-site", nil, nil)
+	site.Annotations = map[string]string{MachineConfigUnitReloadPolicyAnnotationKey: `{"app.service": {"paths": ["/etc/app/app.conf"], "action": "restart"}}`}
+	newConfig, err := MergeMachineConfigsInAgentMode("new", []*mcfgv1.MachineConfig{site, base})
+	require.Nil(t, err)
+
+	// The config files call for no reboot, whether or not units are managed
+	for _, manageUnits := range []bool{false, true} {
+		d.manageUnits = manageUnits
+		result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, ApplyAll)
+		require.Nil(t, err)
+		assert.Equal(t, &UnitPlan{Reload: []string{"haproxy.service"}, TryRestart: []string{"app.service"}}, result.Units)
+		assert.Equal(t, []UnitVerdict{{Name: "app.service", Action: "try-restart"}, {Name: "haproxy.service", Action: "reload"}}, result.UnitVerdicts)
+		assert.Equal(t, []string{postConfigChangeActionNone}, result.PostConfigChangeActions)
+		assert.False(t, result.RebootRequired)
+	}
+
+	// Units whose definition changes are restarted anyway
+	plan := UnitPlan{Restart: []string{"haproxy.service"}}
+	plan.reloadForConfigFiles(map[string]string{"haproxy.service": "reload"})
+	assert.Equal(t, UnitPlan{Restart: []string{"haproxy.service"}}, plan)
+
+	var calls [][]string
+	m := &UnitManager{systemctl: func(args ...string) error {
+		calls = append(calls, args)
+		return nil
+	}}
+	require.Nil(t, m.Apply(context.TODO(), UnitPlan{Reload: []string{"haproxy.service"}}))
+	assert.Equal(t, [][]string{{"daemon-reload"}, {"try-reload-or-restart", "haproxy.service"}}, calls)
+
+	invalid := newDeviceAgentTestConfig(t, "invalid", nil, nil)
+	invalid.Annotations = map[string]string{MachineConfigUnitReloadPolicyAnnotationKey: `{"haproxy.service": {"paths": ["/etc/haproxy"], "action": "kill"}}`}
+	_, err = machineConfigUnitReloadPolicies(invalid)
+	assert.EqualError(t, err, `invalid action "kill" for unit haproxy.service in machineconfiguration.openshift.io/unit-reload-policy annotation of MachineConfig invalid`)
+}
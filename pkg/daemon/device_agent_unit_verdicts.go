@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"sort"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+)
+
+// UnitChange is how an update changes the unit file and dropins of a unit.
+type UnitChange string
+
+const (
+	// UnitCreated means the unit file is added.
+	UnitCreated UnitChange = "Create"
+	// UnitModified means the unit file or its dropins change.
+	UnitModified UnitChange = "Modify"
+	// UnitDeleted means the unit file is removed.
+	UnitDeleted UnitChange = "Delete"
+)
+
+// UnitVerdict is the impact of an update on one unit, for auditing the
+// service impact of a config before rolling it out.
+type UnitVerdict struct {
+	// Name is the unit, or a pattern such as foo@*.service for the running
+	// instances of a template.
+	Name string `json:"name"`
+	// Change is how the unit file and dropins change, if they do.
+	Change UnitChange `json:"change,omitempty"`
+	// MetadataOnly is true if the change doesn't affect how the unit runs.
+	MetadataOnly bool `json:"metadataOnly,omitempty"`
+	// State is "enable", "disable", "mask" or "unmask" if the unit's state
+	// changes.
+	State string `json:"state,omitempty"`
+	// Action is what is done to the running unit: "stop", "reload", "start",
+	// "restart" or "try-restart", which only restarts it if it runs. Units
+	// are only acted on if the daemon manages systemd units.
+	Action string `json:"action,omitempty"`
+	// DeferredUntil is "boot" or the OnCalendar expression of the timer if
+	// Action is deferred by MachineConfigDeferredUnitsAnnotationKey.
+	DeferredUntil string `json:"deferredUntil,omitempty"`
+	// RebootRequired is true if the change only takes effect on a reboot, as
+	// the unit refuses to be started or stopped manually.
+	RebootRequired bool `json:"rebootRequired,omitempty"`
+}
+
+// unitVerdicts returns the verdicts of the units of plan, by name.
+func unitVerdicts(plan UnitPlan, oldIgnConfig, newIgnConfig *ign3types.Config) []UnitVerdict {
+	verdicts := map[string]*UnitVerdict{}
+	verdict := func(name string) *UnitVerdict {
+		if _, ok := verdicts[name]; !ok {
+			verdicts[name] = &UnitVerdict{Name: name}
+		}
+		return verdicts[name]
+	}
+	set := func(names []string, apply func(v *UnitVerdict)) {
+		for _, name := range names {
+			apply(verdict(name))
+		}
+	}
+	dropinUnits := func(dropins []string) []string {
+		var names []string
+		for _, dropin := range dropins {
+			name, _, _ := strings.Cut(dropin, ".d/")
+			names = append(names, name)
+		}
+		return names
+	}
+
+	modified := func(v *UnitVerdict) {
+		if v.Change == "" {
+			v.Change = UnitModified
+		}
+	}
+	set(plan.Updated, modified)
+	set(dropinUnits(plan.DropinsCreated), modified)
+	set(dropinUnits(plan.DropinsUpdated), modified)
+	set(dropinUnits(plan.DropinsDeleted), modified)
+	set(plan.Created, func(v *UnitVerdict) { v.Change = UnitCreated })
+	set(plan.Deleted, func(v *UnitVerdict) { v.Change = UnitDeleted })
+	set(plan.MetadataOnly, func(v *UnitVerdict) { modified(v); v.MetadataOnly = true })
+	set(plan.Enabled, func(v *UnitVerdict) { v.State = "enable" })
+	set(plan.Disabled, func(v *UnitVerdict) { v.State = "disable" })
+	set(plan.Unmasked, func(v *UnitVerdict) { v.State = "unmask" })
+	set(plan.Masked, func(v *UnitVerdict) { v.State = "mask" })
+	// In the order Apply acts on them, the last action winning
+	set(plan.Stop, func(v *UnitVerdict) { v.Action = "stop" })
+	set(plan.Reload, func(v *UnitVerdict) { v.Action = "reload" })
+	set(plan.Start, func(v *UnitVerdict) { v.Action = "start" })
+	set(plan.Restart, func(v *UnitVerdict) { v.Action = "restart" })
+	set(plan.TryRestart, func(v *UnitVerdict) { v.Action = "try-restart" })
+	for _, d := range plan.Deferred {
+		v := verdict(d.Name)
+		v.Action, v.DeferredUntil = d.Action, d.When
+	}
+
+	oldUnits, newUnits := unitsByName(oldIgnConfig), unitsByName(newIgnConfig)
+	var sorted []UnitVerdict
+	for _, v := range verdicts {
+		refuseStart := refusesManual(newUnits[v.Name], "RefuseManualStart")
+		refuseStop := refusesManual(oldUnits[v.Name], "RefuseManualStop") || refusesManual(newUnits[v.Name], "RefuseManualStop")
+		switch v.Action {
+		case "stop":
+			v.RebootRequired = refuseStop
+		case "start":
+			v.RebootRequired = refuseStart
+		case "restart", "try-restart":
+			v.RebootRequired = refuseStart || refuseStop
+		}
+		sorted = append(sorted, *v)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+func unitsByName(ignConfig *ign3types.Config) map[string]ign3types.Unit {
+	units := map[string]ign3types.Unit{}
+	for _, u := range ignConfig.Systemd.Units {
+		units[u.Name] = u
+	}
+	return units
+}
+
+// refusesManual returns true if the [Unit] option name of u, such as
+// RefuseManualStart, is set to true by its unit file or dropins.
+func refusesManual(u ign3types.Unit, name string) bool {
+	options, err := runtimeUnitOptions(u)
+	if err != nil {
+		return false
+	}
+	refuses := false
+	for _, opt := range options {
+		if opt.Section == "Unit" && opt.Name == name {
+			switch strings.ToLower(opt.Value) {
+			case "yes", "true", "on", "1":
+				refuses = true
+			default:
+				refuses = false
+			}
+		}
+	}
+	return refuses
+}
@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitVerdicts(t *testing.T) {
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "app.service", Contents: helpers.StrToPtr("[Service]"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "docs.service", Contents: helpers.StrToPtr("[Unit]\nDescription=Old")},
+		{Name: "early.service", Contents: helpers.StrToPtr("[Unit]\nRefuseManualStop=yes")},
+		{Name: "gone.service", Contents: helpers.StrToPtr("[Service]")},
+		{Name: "tuned.service", Dropins: []ign3types.Dropin{{Name: "10-mcd.conf", Contents: helpers.StrToPtr("[Service]")}}},
+	}
+	newIgn := ctrlcommon.NewIgnConfig()
+	newIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "app.service", Contents: helpers.StrToPtr("[Service]\nRestart=always"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "docs.service", Contents: helpers.StrToPtr("[Unit]\nDescription=New")},
+		{Name: "early.service", Contents: helpers.StrToPtr("[Unit]\nRefuseManualStop=yes\nAfter=network.target")},
+		{Name: "new.service", Contents: helpers.StrToPtr("[Service]"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "tuned.service", Dropins: []ign3types.Dropin{{Name: "10-mcd.conf", Contents: helpers.StrToPtr("[Service]\nNice=5")}}},
+	}
+
+	plan := (&UnitManager{}).Plan(&oldIgn, &newIgn)
+	assert.Equal(t, []UnitVerdict{
+		{Name: "app.service", Change: UnitModified, Action: "restart"},
+		{Name: "docs.service", Change: UnitModified, MetadataOnly: true},
+		{Name: "early.service", Change: UnitModified, Action: "try-restart", RebootRequired: true},
+		{Name: "gone.service", Change: UnitDeleted, Action: "stop"},
+		{Name: "new.service", Change: UnitCreated, State: "enable", Action: "restart"},
+		{Name: "tuned.service", Change: UnitModified, Action: "try-restart"},
+	}, unitVerdicts(plan, &oldIgn, &newIgn))
+}
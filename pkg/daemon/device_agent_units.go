@@ -0,0 +1,666 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// WithSystemdUnitManagement makes updates in device agent mode write systemd
+// units and (re)start the ones that changed, instead of leaving units to the
+// embedding agent.
+func WithSystemdUnitManagement() Option {
+	return func(dn *Daemon) {
+		dn.manageUnits = true
+	}
+}
+
+// unitPaths returns the paths of the unit files and dropins on disk for the
+// named units of an Ignition config.
+func unitPaths(ignConfig *ign3types.Config, names []string) []string {
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[name] = struct{}{}
+	}
+
+	var paths []string
+	for _, u := range ignConfig.Systemd.Units {
+		if _, ok := wanted[u.Name]; !ok {
+			continue
+		}
+		paths = append(paths, filepath.Join(pathSystemd, u.Name))
+		for _, d := range u.Dropins {
+			paths = append(paths, filepath.Join(pathSystemd, u.Name+".d", d.Name))
+		}
+	}
+	return paths
+}
+
+// UnitPlan is what an update in device agent mode does to systemd units. The
+// unit files are written, and units enabled, disabled, masked and unmasked, along
+// with the files of the config; the units are then stopped, started and
+// restarted as listed, around reloading systemd.
+type UnitPlan struct {
+	// Created, Updated and Deleted list the units whose unit files are added,
+	// changed or removed.
+	Created []string `json:"created,omitempty"`
+	Updated []string `json:"updated,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+	// DropinsCreated, DropinsUpdated and DropinsDeleted list the dropins that
+	// are added, changed or removed, as unit.d/dropin.
+	DropinsCreated []string `json:"dropinsCreated,omitempty"`
+	DropinsUpdated []string `json:"dropinsUpdated,omitempty"`
+	DropinsDeleted []string `json:"dropinsDeleted,omitempty"`
+	// MetadataOnly lists the changed units whose runtime definition is the
+	// same, as only e.g. their Description, Documentation or [Install]
+	// section changed. They aren't restarted.
+	MetadataOnly []string `json:"metadataOnly,omitempty"`
+	// Enabled, Disabled, Masked and Unmasked list the units whose state
+	// changes.
+	Enabled  []string `json:"enabled,omitempty"`
+	Disabled []string `json:"disabled,omitempty"`
+	Masked   []string `json:"masked,omitempty"`
+	Unmasked []string `json:"unmasked,omitempty"`
+	// Stop lists the removed, disabled and masked units, the instances of
+	// removed and masked templates by patterns such as foo@*.service, and the
+	// services of changed sockets, as systemd refuses to restart a socket
+	// while its service runs. They are stopped before systemd is reloaded.
+	Stop []string `json:"stop,omitempty"`
+	// Start lists the newly enabled units whose definition didn't change.
+	Start []string `json:"start,omitempty"`
+	// Restart lists the changed enabled units, and TryRestart the other
+	// changed units, which are only restarted if they are running. Changed
+	// templates restart their instances, the ones of the config as listed
+	// and the running ones by patterns in TryRestart.
+	Restart    []string `json:"restart,omitempty"`
+	TryRestart []string `json:"tryRestart,omitempty"`
+	// Reload lists the units whose config files changed and that are
+	// reloaded rather than restarted, if they are running; see
+	// MachineConfigUnitReloadPolicyAnnotationKey. Units that can't be reloaded
+	// are restarted.
+	Reload []string `json:"reload,omitempty"`
+	// Deferred lists the starts and restarts deferred by
+	// MachineConfigDeferredUnitsAnnotationKey, which aren't in Start,
+	// Restart and TryRestart.
+	Deferred []DeferredUnit `json:"deferred,omitempty"`
+}
+
+// Empty returns true if the plan changes nothing.
+func (p *UnitPlan) Empty() bool {
+	return reflect.DeepEqual(*p, UnitPlan{})
+}
+
+// UnitManager plans and applies the changes to systemd units between two
+// Ignition configs.
+type UnitManager struct {
+	systemdPath     string
+	systemctl       func(args ...string) error
+	systemctlOutput func(args ...string) ([]byte, error)
+	systemdRun      func(args ...string) error
+	journalctl      func(args ...string) ([]byte, error)
+	// journals are the journal excerpts of the units Apply acted on, by name
+	journals map[string]string
+	// health decides how Apply checks the units it starts and restarts
+	health         UnitHealthPolicy
+	healthInterval time.Duration
+}
+
+// NewUnitManager returns a UnitManager acting on the running systemd.
+func NewUnitManager() *UnitManager {
+	return &UnitManager{
+		systemdPath: pathSystemd,
+		systemctl: func(args ...string) error {
+			return runCmdSync("systemctl", args...)
+		},
+		systemctlOutput: func(args ...string) ([]byte, error) {
+			return runGetOut("systemctl", args...)
+		},
+		systemdRun: func(args ...string) error {
+			return runCmdSync("systemd-run", args...)
+		},
+		journalctl: func(args ...string) ([]byte, error) {
+			return runGetOut("journalctl", args...)
+		},
+	}
+}
+
+// Plan returns the changes to the units of oldIgnConfig to get to the ones of
+// newIgnConfig.
+func (m *UnitManager) Plan(oldIgnConfig, newIgnConfig *ign3types.Config) UnitPlan {
+	oldUnits := make(map[string]ign3types.Unit, len(oldIgnConfig.Systemd.Units))
+	for _, u := range oldIgnConfig.Systemd.Units {
+		oldUnits[u.Name] = u
+	}
+
+	var plan UnitPlan
+	var changedTemplates, stoppedTemplates []string
+	var changedSockets []ign3types.Unit
+	for _, u := range newIgnConfig.Systemd.Units {
+		old, existed := oldUnits[u.Name]
+		delete(oldUnits, u.Name)
+
+		masked, wasMasked := isTrue(u.Mask), existed && isTrue(old.Mask)
+		changed, definitionChanged := false, false
+		switch {
+		case masked && !wasMasked:
+			plan.Masked = append(plan.Masked, u.Name)
+		case !masked && wasMasked:
+			plan.Unmasked = append(plan.Unmasked, u.Name)
+			changed = true
+		}
+		hasContents, hadContents := u.Contents != nil && *u.Contents != "", existed && old.Contents != nil && *old.Contents != ""
+		switch {
+		case masked:
+		case hasContents && !hadContents:
+			plan.Created = append(plan.Created, u.Name)
+			definitionChanged = true
+		case hasContents && *u.Contents != *old.Contents:
+			plan.Updated = append(plan.Updated, u.Name)
+			definitionChanged = true
+		}
+		if plan.planDropins(old, u) {
+			definitionChanged = true
+		}
+		if definitionChanged && !masked && !changed && existed && sameRuntimeDefinition(old, u) {
+			plan.MetadataOnly = append(plan.MetadataOnly, u.Name)
+			definitionChanged = false
+		}
+		changed = changed || definitionChanged
+
+		enabled, wasEnabled := isTrue(u.Enabled), existed && isTrue(old.Enabled)
+		switch {
+		case enabled && !wasEnabled:
+			plan.Enabled = append(plan.Enabled, u.Name)
+		case u.Enabled != nil && !*u.Enabled && wasEnabled:
+			plan.Disabled = append(plan.Disabled, u.Name)
+		}
+
+		// Templates can't be started themselves, only their instances
+		if isUnitTemplate(u.Name) {
+			switch {
+			case masked && !wasMasked:
+				stoppedTemplates = append(stoppedTemplates, u.Name)
+			case changed && !masked:
+				changedTemplates = append(changedTemplates, u.Name)
+			}
+			continue
+		}
+		if changed && existed && !masked && strings.HasSuffix(u.Name, ".socket") {
+			changedSockets = append(changedSockets, u)
+		}
+
+		switch {
+		case masked:
+			if !wasMasked {
+				plan.Stop = append(plan.Stop, u.Name)
+			}
+		case u.Enabled != nil && !*u.Enabled && wasEnabled:
+			plan.Stop = append(plan.Stop, u.Name)
+		case changed && enabled:
+			plan.Restart = append(plan.Restart, u.Name)
+		case changed:
+			plan.TryRestart = append(plan.TryRestart, u.Name)
+		case enabled && !wasEnabled:
+			plan.Start = append(plan.Start, u.Name)
+		}
+	}
+
+	// Units whose unit file is deleted are stopped, those that only lose
+	// their dropins keep their vendor unit file and are restarted with it
+	for _, old := range oldUnits {
+		deleted := old.Contents != nil && *old.Contents != ""
+		dropinsDeleted := plan.planDropins(old, ign3types.Unit{Name: old.Name})
+		switch {
+		case deleted && isUnitTemplate(old.Name):
+			plan.Deleted = append(plan.Deleted, old.Name)
+			stoppedTemplates = append(stoppedTemplates, old.Name)
+		case deleted:
+			plan.Deleted = append(plan.Deleted, old.Name)
+			plan.Stop = append(plan.Stop, old.Name)
+		case dropinsDeleted && isUnitTemplate(old.Name):
+			changedTemplates = append(changedTemplates, old.Name)
+		case dropinsDeleted:
+			plan.TryRestart = append(plan.TryRestart, old.Name)
+		}
+	}
+	plan.planInstances(newIgnConfig, changedTemplates, stoppedTemplates)
+	plan.planSockets(changedSockets)
+
+	for _, names := range []*[]string{&plan.Created, &plan.Updated, &plan.Deleted, &plan.DropinsCreated, &plan.DropinsUpdated, &plan.DropinsDeleted,
+		&plan.MetadataOnly, &plan.Enabled, &plan.Disabled, &plan.Masked, &plan.Unmasked, &plan.Stop, &plan.Start, &plan.Restart, &plan.TryRestart} {
+		if len(*names) > 0 {
+			*names = sets.List(sets.New(*names...))
+		}
+	}
+	return plan
+}
+
+// sameRuntimeDefinition returns true if the unit files and dropins of old and
+// u only differ in directives that don't affect how the unit runs, and in
+// comments and formatting. Units that can't be parsed are taken as changed.
+func sameRuntimeDefinition(old, u ign3types.Unit) bool {
+	oldOptions, err := runtimeUnitOptions(old)
+	if err != nil {
+		return false
+	}
+	newOptions, err := runtimeUnitOptions(u)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(oldOptions, newOptions)
+}
+
+// runtimeUnitOptions returns the options of the unit file and dropins of u,
+// in the order systemd reads them, without the ones that don't affect how the
+// unit runs: its description and documentation, the [Install] section used
+// when enabling it, and X- extensions, which systemd ignores.
+func runtimeUnitOptions(u ign3types.Unit) ([]unit.UnitOption, error) {
+	sources := []*string{u.Contents}
+	dropins := append([]ign3types.Dropin{}, u.Dropins...)
+	sort.Slice(dropins, func(i, j int) bool { return dropins[i].Name < dropins[j].Name })
+	for _, d := range dropins {
+		sources = append(sources, d.Contents)
+	}
+
+	var options []unit.UnitOption
+	for _, contents := range sources {
+		if contents == nil {
+			continue
+		}
+		opts, err := unit.DeserializeOptions(strings.NewReader(*contents))
+		if err != nil {
+			return nil, err
+		}
+		for _, opt := range opts {
+			switch {
+			case opt.Section == "Install",
+				opt.Section == "Unit" && (opt.Name == "Description" || opt.Name == "Documentation"),
+				strings.HasPrefix(opt.Section, "X-"), strings.HasPrefix(opt.Name, "X-"):
+				continue
+			}
+			options = append(options, *opt)
+		}
+	}
+	return options, nil
+}
+
+// isUnitTemplate returns true if name is that of a template, e.g.
+// foo@.service.
+func isUnitTemplate(name string) bool {
+	return strings.Contains(name, "@.")
+}
+
+// unitInstancePattern returns the pattern matching the instances of template,
+// e.g. foo@*.service for foo@.service.
+func unitInstancePattern(template string) string {
+	return strings.Replace(template, "@.", "@*.", 1)
+}
+
+// planInstances restarts the instances of the changed templates, as they keep
+// running the old definition otherwise, and stops those of removed and
+// masked templates. Instances in the config are restarted like changed units;
+// running instances are matched by the pattern of their template, which
+// Apply expands.
+func (p *UnitPlan) planInstances(newIgnConfig *ign3types.Config, changedTemplates, stoppedTemplates []string) {
+	for _, template := range stoppedTemplates {
+		p.Stop = append(p.Stop, unitInstancePattern(template))
+	}
+	for _, template := range changedTemplates {
+		prefix, suffix, _ := strings.Cut(template, "@.")
+		for _, u := range newIgnConfig.Systemd.Units {
+			instance, ok := strings.CutPrefix(u.Name, prefix+"@")
+			if instance, ok = strings.CutSuffix(instance, "."+suffix); !ok || instance == "" || isTrue(u.Mask) ||
+				(u.Enabled != nil && !*u.Enabled) || ctrlcommon.InSlice(u.Name, p.Stop) {
+				continue
+			}
+			p.Start = removeString(p.Start, u.Name)
+			if isTrue(u.Enabled) {
+				p.Restart = append(p.Restart, u.Name)
+			} else {
+				p.TryRestart = append(p.TryRestart, u.Name)
+			}
+		}
+		p.TryRestart = append(p.TryRestart, unitInstancePattern(template))
+	}
+}
+
+// planSockets stops the services activated by the changed sockets that
+// existed before, as
+// systemd refuses to restart a socket while its service is running. They are
+// activated again through the restarted socket.
+func (p *UnitPlan) planSockets(sockets []ign3types.Unit) {
+	for _, u := range sockets {
+		p.Stop = append(p.Stop, socketService(u))
+	}
+}
+
+// socketService returns the service activated by the socket u, which is set
+// by Service= or named after the socket, with Accept=yes sockets activating
+// an instance of the service per connection.
+func socketService(u ign3types.Unit) string {
+	name := strings.TrimSuffix(u.Name, ".socket")
+	service, accept := name+".service", false
+	sources := []*string{u.Contents}
+	for _, d := range u.Dropins {
+		sources = append(sources, d.Contents)
+	}
+	for _, contents := range sources {
+		if contents == nil {
+			continue
+		}
+		section := ""
+		for _, line := range strings.Split(*contents, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "[") {
+				section = line
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || section != "[Socket]" {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "Service":
+				service = strings.TrimSpace(value)
+			case "Accept":
+				accept = ctrlcommon.InSlice(strings.ToLower(strings.TrimSpace(value)), []string{"yes", "true", "on", "1"})
+			}
+		}
+	}
+	if accept {
+		return name + "@*.service"
+	}
+	return service
+}
+
+func removeString(names []string, name string) []string {
+	var kept []string
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// planDropins adds the changes to the dropins of a unit to the plan,
+// returning true if there are any.
+func (p *UnitPlan) planDropins(old, u ign3types.Unit) bool {
+	oldDropins := make(map[string]ign3types.Dropin, len(old.Dropins))
+	for _, d := range old.Dropins {
+		oldDropins[d.Name] = d
+	}
+	changed := false
+	for _, d := range u.Dropins {
+		name := u.Name + ".d/" + d.Name
+		oldDropin, ok := oldDropins[d.Name]
+		delete(oldDropins, d.Name)
+		switch {
+		case !ok:
+			p.DropinsCreated = append(p.DropinsCreated, name)
+		case !reflect.DeepEqual(oldDropin.Contents, d.Contents):
+			p.DropinsUpdated = append(p.DropinsUpdated, name)
+		default:
+			continue
+		}
+		changed = true
+	}
+	for name := range oldDropins {
+		p.DropinsDeleted = append(p.DropinsDeleted, u.Name+".d/"+name)
+		changed = true
+	}
+	return changed
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// Apply stops the units to stop while systemd still knows about them, removes
+// the masks of unmasked units, reloads systemd after the unit files have been
+// written and starts and restarts the units as planned, in the order of their
+// dependencies; see unitBatches. The journal excerpts of the units it acted
+// on are kept for the UpdateResult. Waiting between and for the batches stops
+// once ctx is done.
+func (m *UnitManager) Apply(ctx context.Context, plan UnitPlan) (err error) {
+	if plan.Empty() {
+		return nil
+	}
+	since := time.Now()
+	acted := map[string]struct{}{}
+	defer func() { m.recordJournals(acted, since, err) }()
+	for _, name := range plan.Stop {
+		acted[name] = struct{}{}
+	}
+	if len(plan.Stop) > 0 {
+		if err := m.systemctl(append([]string{"stop"}, plan.Stop...)...); err != nil {
+			return fmt.Errorf("stopping units: %w", err)
+		}
+	}
+	if err := m.unmask(plan.Unmasked); err != nil {
+		return err
+	}
+	if err := m.systemctl("daemon-reload"); err != nil {
+		return fmt.Errorf("reloading systemd: %w", err)
+	}
+
+	verbs := map[string]string{}
+	var patterns []string
+	for _, op := range []struct {
+		verb  string
+		units []string
+	}{
+		{"try-reload-or-restart", plan.Reload},
+		{"start", plan.Start},
+		{"restart", plan.Restart},
+		{"try-restart", plan.TryRestart},
+	} {
+		for _, name := range op.units {
+			if isUnitPattern(name) {
+				patterns = append(patterns, name)
+				continue
+			}
+			verbs[name] = op.verb
+		}
+	}
+	// Running instances of changed templates, unless restarted anyway
+	for _, name := range m.runningUnits(patterns) {
+		if _, ok := verbs[name]; !ok {
+			verbs[name] = "try-restart"
+		}
+	}
+	for name := range verbs {
+		acted[name] = struct{}{}
+	}
+	batches := unitBatches(verbs, m.unitDependencies(verbs))
+	for i, batch := range batches {
+		if i > 0 && m.health.BatchInterval > 0 {
+			if err := sleepContext(ctx, m.health.BatchInterval); err != nil {
+				return err
+			}
+		}
+		for _, verb := range []string{"start", "restart", "try-restart", "try-reload-or-restart"} {
+			var units []string
+			for _, name := range batch {
+				if verbs[name] == verb {
+					units = append(units, name)
+				}
+			}
+			if len(units) == 0 {
+				continue
+			}
+			if err := m.systemctl(append([]string{verb}, units...)...); err != nil {
+				return fmt.Errorf("running systemctl %s: %w", verb, err)
+			}
+		}
+		if err := m.waitHealthy(ctx, batch); err != nil {
+			return err
+		}
+	}
+	klog.Infof("Stopped units %v, started and restarted units in order %v", plan.Stop, batches)
+	return m.scheduleDeferred(plan.Deferred)
+}
+
+// unmask removes the /dev/null symlinks masking the units. Unmasked units
+// without contents are left with no unit file of their own, so writing them
+// doesn't remove the mask.
+func (m *UnitManager) unmask(names []string) error {
+	for _, name := range names {
+		path := filepath.Join(m.systemdPath, name)
+		if target, err := os.Readlink(path); err != nil || target != pathDevNull {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("unmasking unit %s: %w", name, err)
+		}
+		klog.Infof("Unmasked unit %s", name)
+	}
+	return nil
+}
+
+func isUnitPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// runningUnits returns the running units matching patterns.
+func (m *UnitManager) runningUnits(patterns []string) []string {
+	if len(patterns) == 0 || m.systemctlOutput == nil {
+		return nil
+	}
+	out, err := m.systemctlOutput(append([]string{"list-units", "--plain", "--no-legend", "--state=active", "--"}, patterns...)...)
+	if err != nil {
+		klog.Warningf("Failed to list running instances of changed templates, not restarting them: %v", err)
+		return nil
+	}
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+	}
+	return names
+}
+
+// unitDependencies returns how systemd relates the given units to others, or
+// nothing if it can't tell.
+func (m *UnitManager) unitDependencies(verbs map[string]string) map[string]unitDependencies {
+	if len(verbs) < 2 || m.systemctlOutput == nil {
+		return nil
+	}
+	names := make([]string, 0, len(verbs))
+	for name := range verbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out, err := m.systemctlOutput(append([]string{"show", "--property=Id,After,Requires,BindsTo,ConsistsOf", "--"}, names...)...)
+	if err != nil {
+		klog.Warningf("Failed to get unit dependencies, (re)starting units in one go: %v", err)
+		return nil
+	}
+	return parseUnitDependencies(out)
+}
+
+// unitDependencies is how systemd relates a unit to others.
+type unitDependencies struct {
+	// after are the units ordered before the unit, by After=, Requires= or
+	// BindsTo=
+	after map[string]struct{}
+	// consistsOf are the units restarted along with the unit, as they are
+	// PartOf= it
+	consistsOf map[string]struct{}
+}
+
+// parseUnitDependencies parses the output of systemctl show for the Id,
+// After, Requires, BindsTo and ConsistsOf properties of units, which has a
+// block of Key=value lines per unit.
+func parseUnitDependencies(out []byte) map[string]unitDependencies {
+	deps := map[string]unitDependencies{}
+	for _, block := range strings.Split(string(out), "\n\n") {
+		var id string
+		dep := unitDependencies{after: map[string]struct{}{}, consistsOf: map[string]struct{}{}}
+		for _, line := range strings.Split(block, "\n") {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "Id":
+				id = value
+			case "After", "Requires", "BindsTo":
+				for _, name := range strings.Fields(value) {
+					dep.after[name] = struct{}{}
+				}
+			case "ConsistsOf":
+				for _, name := range strings.Fields(value) {
+					dep.consistsOf[name] = struct{}{}
+				}
+			}
+		}
+		if id != "" {
+			deps[id] = dep
+		}
+	}
+	return deps
+}
+
+// unitBatches orders the units to start or restart into batches, each coming
+// after the units it depends on, so dependents aren't bounced again by their
+// dependencies being restarted after them. Units that are part of a
+// restarted unit are left out, as systemd restarts them along with it. Units
+// in a dependency cycle go into the last batch together.
+func unitBatches(verbs map[string]string, deps map[string]unitDependencies) [][]string {
+	pending := map[string]struct{}{}
+	for name := range verbs {
+		pending[name] = struct{}{}
+	}
+	for name, verb := range verbs {
+		if verb != "restart" {
+			continue
+		}
+		for part := range deps[name].consistsOf {
+			if part != name && verbs[part] != "start" {
+				delete(pending, part)
+			}
+		}
+	}
+
+	var batches [][]string
+	for len(pending) > 0 {
+		var batch []string
+		for name := range pending {
+			ready := true
+			for dep := range deps[name].after {
+				if _, ok := pending[dep]; ok && dep != name {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				batch = append(batch, name)
+			}
+		}
+		if len(batch) == 0 {
+			for name := range pending {
+				batch = append(batch, name)
+			}
+		}
+		sort.Strings(batch)
+		for _, name := range batch {
+			delete(pending, name)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
@@ -0,0 +1,261 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitManager(t *testing.T) {
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "changed.service", Contents: helpers.StrToPtr("[Unit]"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "default.service", Contents: helpers.StrToPtr("[Unit]")},
+		{Name: "disabled.service", Enabled: helpers.BoolToPtr(true)},
+		{Name: "enabled.service", Contents: helpers.StrToPtr("[Unit]")},
+		{Name: "masked.service", Contents: helpers.StrToPtr("[Unit]")},
+		{Name: "removed.service", Contents: helpers.StrToPtr("[Unit]"), Dropins: []ign3types.Dropin{{Name: "10-removed.conf"}}},
+		{Name: "unchanged.service", Contents: helpers.StrToPtr("[Unit]"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "dropins.service", Dropins: []ign3types.Dropin{
+			{Name: "10-changed.conf", Contents: helpers.StrToPtr("[Service]")},
+			{Name: "20-removed.conf", Contents: helpers.StrToPtr("[Service]")},
+		}},
+		// Keeps its vendor unit file once its dropin is removed
+		{Name: "vendor.service", Dropins: []ign3types.Dropin{{Name: "10-vendor.conf", Contents: helpers.StrToPtr("[Service]")}}},
+	}
+	newIgn := ctrlcommon.NewIgnConfig()
+	newIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "added.service", Contents: helpers.StrToPtr("[Unit]"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "changed.service", Contents: helpers.StrToPtr("[Unit]\nAfter=network.target"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "default.service", Contents: helpers.StrToPtr("[Unit]\nAfter=network.target")},
+		{Name: "disabled.service", Enabled: helpers.BoolToPtr(false)},
+		{Name: "enabled.service", Contents: helpers.StrToPtr("[Unit]"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "masked.service", Mask: helpers.BoolToPtr(true)},
+		{Name: "unchanged.service", Contents: helpers.StrToPtr("[Unit]"), Enabled: helpers.BoolToPtr(true)},
+		{Name: "dropins.service", Dropins: []ign3types.Dropin{
+			{Name: "10-changed.conf", Contents: helpers.StrToPtr("[Service]\nRestart=always")},
+			{Name: "30-added.conf", Contents: helpers.StrToPtr("[Service]")},
+		}},
+	}
+
+	var calls [][]string
+	m := &UnitManager{systemctl: func(args ...string) error {
+		calls = append(calls, args)
+		return nil
+	}}
+	plan := m.Plan(&oldIgn, &newIgn)
+	assert.Equal(t, UnitPlan{
+		Created:        []string{"added.service"},
+		Updated:        []string{"changed.service", "default.service"},
+		Deleted:        []string{"removed.service"},
+		DropinsCreated: []string{"dropins.service.d/30-added.conf"},
+		DropinsUpdated: []string{"dropins.service.d/10-changed.conf"},
+		DropinsDeleted: []string{"dropins.service.d/20-removed.conf", "removed.service.d/10-removed.conf", "vendor.service.d/10-vendor.conf"},
+		Enabled:        []string{"added.service", "enabled.service"},
+		Disabled:       []string{"disabled.service"},
+		Masked:         []string{"masked.service"},
+		Stop:           []string{"disabled.service", "masked.service", "removed.service"},
+		Start:          []string{"enabled.service"},
+		Restart:        []string{"added.service", "changed.service"},
+		TryRestart:     []string{"default.service", "dropins.service", "vendor.service"},
+	}, plan)
+
+	require.Nil(t, m.Apply(context.TODO(), plan))
+	assert.Equal(t, [][]string{
+		{"stop", "disabled.service", "masked.service", "removed.service"},
+		{"daemon-reload"},
+		{"start", "enabled.service"},
+		{"restart", "added.service", "changed.service"},
+		{"try-restart", "default.service", "dropins.service", "vendor.service"},
+	}, calls)
+
+	// Restarts follow the dependencies of the units, and units that are part
+	// of a restarted unit aren't restarted again
+	calls = nil
+	m.systemctlOutput = func(args ...string) ([]byte, error) {
+		assert.Equal(t, []string{"show", "--property=Id,After,Requires,BindsTo,ConsistsOf", "--",
+			"added.service", "changed.service", "default.service", "dropins.service", "enabled.service", "vendor.service"}, args)
+		return []byte(`Id=added.service
+Requires=changed.service
+After=basic.target changed.service
+
+Id=changed.service
+ConsistsOf=dropins.service
+
+Id=default.service
+BindsTo=enabled.service
+
+Id=dropins.service
+After=changed.service
+
+Id=enabled.service
+After=network.target
+
+Id=vendor.service
+`), nil
+	}
+	require.Nil(t, m.Apply(context.TODO(), plan))
+	assert.Equal(t, [][]string{
+		{"stop", "disabled.service", "masked.service", "removed.service"},
+		{"daemon-reload"},
+		{"start", "enabled.service"},
+		{"restart", "changed.service"},
+		{"try-restart", "vendor.service"},
+		{"restart", "added.service"},
+		{"try-restart", "default.service"},
+	}, calls)
+
+	calls = nil
+	plan = m.Plan(&newIgn, &newIgn)
+	assert.True(t, plan.Empty())
+	require.Nil(t, m.Apply(context.TODO(), plan))
+	assert.Empty(t, calls)
+}
+
+func TestUnitManagerTemplatesAndSockets(t *testing.T) {
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "worker@.service", Contents: helpers.StrToPtr("[Service]")},
+		{Name: "worker@a.service", Enabled: helpers.BoolToPtr(true)},
+		{Name: "worker@b.service", Enabled: helpers.BoolToPtr(true)},
+		{Name: "old@.service", Contents: helpers.StrToPtr("[Service]")},
+		{Name: "api.socket", Contents: helpers.StrToPtr("[Socket]\nListenStream=8080")},
+		{Name: "conn.socket", Contents: helpers.StrToPtr("[Socket]\nAccept=yes")},
+	}
+	newIgn := ctrlcommon.NewIgnConfig()
+	newIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "worker@.service", Contents: helpers.StrToPtr("[Service]\nRestart=always")},
+		{Name: "worker@a.service", Enabled: helpers.BoolToPtr(true)},
+		{Name: "worker@b.service", Enabled: helpers.BoolToPtr(false)},
+		{Name: "worker@c.service", Enabled: helpers.BoolToPtr(true)},
+		{Name: "api.socket", Contents: helpers.StrToPtr("[Socket]\nListenStream=8081\nService=backend.service")},
+		{Name: "conn.socket", Contents: helpers.StrToPtr("[Socket]\nAccept=yes\nListenStream=22")},
+	}
+
+	var calls [][]string
+	m := &UnitManager{
+		systemctl: func(args ...string) error {
+			calls = append(calls, args)
+			return nil
+		},
+		systemctlOutput: func(args ...string) ([]byte, error) {
+			if args[0] == "list-units" {
+				assert.Equal(t, []string{"list-units", "--plain", "--no-legend", "--state=active", "--", "worker@*.service"}, args)
+				return []byte("worker@a.service loaded active running Worker a\nworker@manual.service loaded active running Worker manual\n"), nil
+			}
+			return nil, fmt.Errorf("no dependencies")
+		},
+	}
+	plan := m.Plan(&oldIgn, &newIgn)
+	assert.Equal(t, UnitPlan{
+		Updated:    []string{"api.socket", "conn.socket", "worker@.service"},
+		Deleted:    []string{"old@.service"},
+		Enabled:    []string{"worker@c.service"},
+		Disabled:   []string{"worker@b.service"},
+		Stop:       []string{"backend.service", "conn@*.service", "old@*.service", "worker@b.service"},
+		Restart:    []string{"worker@a.service", "worker@c.service"},
+		TryRestart: []string{"api.socket", "conn.socket", "worker@*.service"},
+	}, plan)
+
+	require.Nil(t, m.Apply(context.TODO(), plan))
+	assert.Equal(t, [][]string{
+		{"stop", "backend.service", "conn@*.service", "old@*.service", "worker@b.service"},
+		{"daemon-reload"},
+		{"restart", "worker@a.service", "worker@c.service"},
+		{"try-restart", "api.socket", "conn.socket", "worker@manual.service"},
+	}, calls)
+}
+
+func TestUnitManagerMetadataOnlyChanges(t *testing.T) {
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "docs.service", Enabled: helpers.BoolToPtr(true), Contents: helpers.StrToPtr("[Unit]\nDescription=Old\n\n[Service]\nExecStart=/usr/bin/app\n\n[Install]\nWantedBy=multi-user.target\n")},
+		{Name: "exec.service", Enabled: helpers.BoolToPtr(true), Contents: helpers.StrToPtr("[Service]\nExecStart=/usr/bin/app\n")},
+		{Name: "dropin.service", Dropins: []ign3types.Dropin{{Name: "10-env.conf", Contents: helpers.StrToPtr("[Service]\nEnvironment=A=1\n")}}},
+	}
+	newIgn := ctrlcommon.NewIgnConfig()
+	newIgn.Systemd.Units = []ign3types.Unit{
+		// Only metadata, comments and formatting changed
+		{Name: "docs.service", Enabled: helpers.BoolToPtr(true), Contents: helpers.StrToPtr("# Managed by the fleet\n[Unit]\nDescription=New\nDocumentation=man:app(1)\n\n[Service]\nExecStart=/usr/bin/app\nX-Owner=team\n\n[Install]\nWantedBy=default.target\n")},
+		{Name: "exec.service", Enabled: helpers.BoolToPtr(true), Contents: helpers.StrToPtr("[Service]\nExecStart=/usr/bin/app --verbose\n")},
+		{Name: "dropin.service", Dropins: []ign3types.Dropin{{Name: "10-env.conf", Contents: helpers.StrToPtr("[Service]\nEnvironment=A=2\n")}}},
+	}
+
+	plan := NewUnitManager().Plan(&oldIgn, &newIgn)
+	assert.Equal(t, []string{"docs.service", "exec.service"}, plan.Updated)
+	assert.Equal(t, []string{"dropin.service.d/10-env.conf"}, plan.DropinsUpdated)
+	assert.Equal(t, []string{"docs.service"}, plan.MetadataOnly)
+	assert.Equal(t, []string{"exec.service"}, plan.Restart)
+	assert.Equal(t, []string{"dropin.service"}, plan.TryRestart)
+}
+
+func TestUnitManagerMasks(t *testing.T) {
+	systemdPath := t.TempDir()
+	require.Nil(t, os.Symlink(pathDevNull, filepath.Join(systemdPath, "unmasked.service")))
+	require.Nil(t, os.Symlink(pathDevNull, filepath.Join(systemdPath, "local.service")))
+
+	oldIgn := ctrlcommon.NewIgnConfig()
+	oldIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "unmasked.service", Mask: helpers.BoolToPtr(true)},
+		{Name: "masked.service", Enabled: helpers.BoolToPtr(true)},
+	}
+	newIgn := ctrlcommon.NewIgnConfig()
+	newIgn.Systemd.Units = []ign3types.Unit{
+		{Name: "unmasked.service", Enabled: helpers.BoolToPtr(true)},
+		{Name: "masked.service", Mask: helpers.BoolToPtr(true)},
+	}
+
+	var calls [][]string
+	m := &UnitManager{systemdPath: systemdPath, systemctl: func(args ...string) error {
+		calls = append(calls, args)
+		return nil
+	}}
+	plan := m.Plan(&oldIgn, &newIgn)
+	assert.Equal(t, UnitPlan{
+		Enabled:  []string{"unmasked.service"},
+		Masked:   []string{"masked.service"},
+		Unmasked: []string{"unmasked.service"},
+		Stop:     []string{"masked.service"},
+		Restart:  []string{"unmasked.service"},
+	}, plan)
+
+	require.Nil(t, m.Apply(context.TODO(), plan))
+	assert.Equal(t, [][]string{
+		{"stop", "masked.service"},
+		{"daemon-reload"},
+		{"restart", "unmasked.service"},
+	}, calls)
+	assert.NoFileExists(t, filepath.Join(systemdPath, "unmasked.service"))
+	// Masks the config didn't make are left alone
+	target, err := os.Readlink(filepath.Join(systemdPath, "local.service"))
+	require.Nil(t, err)
+	assert.Equal(t, pathDevNull, target)
+}
+
+func TestPlanInDeviceAgentModeWithUnits(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, []ign3types.Unit{{Name: "foo.service", Contents: helpers.StrToPtr("[Service]\nExecStart=/usr/bin/foo")}})
+
+	// Unit changes never require a reboot in device agent mode
+	for _, manageUnits := range []bool{false, true} {
+		d.manageUnits = manageUnits
+		result, err := d.PlanInDeviceAgentMode(oldConfig, newConfig, ApplyAll)
+		require.Nil(t, err)
+		assert.Equal(t, []string{"foo.service"}, result.UnitsChanged)
+		assert.Equal(t, &UnitPlan{Created: []string{"foo.service"}, TryRestart: []string{"foo.service"}}, result.Units)
+		assert.Equal(t, []UnitVerdict{{Name: "foo.service", Change: UnitCreated, Action: "try-restart"}}, result.UnitVerdicts)
+		assert.False(t, result.RebootRequired)
+	}
+}
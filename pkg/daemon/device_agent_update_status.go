@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// updateStatusPath is where the phase of the running update in device agent
+// mode is published, so supervisors can tell whether the daemon currently
+// ignores SIGTERM before stopping it.
+var updateStatusPath = filepath.Join("/run", "machine-config-daemon", "update-status.json")
+
+// sigtermProtectedPhases leave LUKS volumes, filesystems, files, units, users
+// or the current config half applied if interrupted, so SIGTERM is ignored
+// while they run. Planning, draining and the OS phase, which pulls the OS
+// image, stay interruptible: the update journal rolls an interrupted update
+// back before the next one.
+var sigtermProtectedPhases = map[UpdatePhase]bool{
+	UpdatePhaseLUKS:        true,
+	UpdatePhaseFilesystems: true,
+	UpdatePhaseFiles:       true,
+	UpdatePhaseUnits:       true,
+	UpdatePhasePasswd:      true,
+	UpdatePhaseFileModes:   true,
+	UpdatePhaseFinalize:    true,
+}
+
+// updateStatus is the content of the update status file.
+type updateStatus struct {
+	OldConfigName string      `json:"oldConfigName"`
+	NewConfigName string      `json:"newConfigName"`
+	Phase         UpdatePhase `json:"phase"`
+	// RollingBack is true while a failed update is being rolled back, which
+	// ignores SIGTERM as well.
+	RollingBack      bool      `json:"rollingBack,omitempty"`
+	SIGTERMProtected bool      `json:"sigtermProtected"`
+	Since            time.Time `json:"since"`
+}
+
+// enterUpdatePhase ignores SIGTERM if the phase of status is protected, and
+// stops ignoring it otherwise, and publishes status.
+func (dn *Daemon) enterUpdatePhase(status updateStatus) {
+	status.SIGTERMProtected = status.RollingBack || sigtermProtectedPhases[status.Phase]
+	if status.SIGTERMProtected {
+		dn.catchIgnoreSIGTERM()
+	} else {
+		dn.cancelSIGTERM()
+	}
+	status.Since = time.Now().UTC()
+	b, err := json.Marshal(status)
+	if err == nil {
+		err = writeFileAtomicallyWithDefaults(updateStatusPath, b)
+	}
+	if err != nil {
+		klog.Warningf("Failed to write update status: %v", err)
+	}
+}
+
+// leaveUpdate stops ignoring SIGTERM and removes the update status.
+func (dn *Daemon) leaveUpdate() {
+	dn.cancelSIGTERM()
+	if err := os.Remove(updateStatusPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		klog.Warningf("Failed to remove update status: %v", err)
+	}
+}
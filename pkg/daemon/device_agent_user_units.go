@@ -0,0 +1,273 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/klog/v2"
+)
+
+// MachineConfigUserUnitsAnnotationKey holds systemd user units a MachineConfig
+// contributes in device agent mode, per user of its passwd section, as a JSON
+// object:
+//
+//	{"app": [{"name": "app.service", "contents": "[Service]\nExecStart=/usr/bin/app\n", "enabled": true}]}
+//
+// The units are written to ~/.config/systemd/user of the user and run by the
+// user's service manager, for unprivileged workloads. Lingering is enabled
+// for users with units, so their units start on boot rather than on login.
+// They are only applied if the daemon manages systemd units.
+// MergeMachineConfigsInAgentMode merges the units of all configs per user,
+// units of later configs replacing those of the same name.
+const MachineConfigUserUnitsAnnotationKey = "machineconfiguration.openshift.io/user-units"
+
+// userUnit is a systemd user unit of the user units annotation.
+type userUnit struct {
+	Name     string `json:"name"`
+	Contents string `json:"contents"`
+	Enabled  *bool  `json:"enabled,omitempty"`
+}
+
+// userUnits are the user units of each user.
+type userUnits map[string][]userUnit
+
+// userUnitsChange is the change of all user units an update applies.
+type userUnitsChange struct {
+	old, new userUnits
+}
+
+// machineConfigUserUnits returns the units of mc's annotation.
+func machineConfigUserUnits(mc *mcfgv1.MachineConfig) (userUnits, error) {
+	units := userUnits{}
+	encoded, ok := mc.GetAnnotations()[MachineConfigUserUnitsAnnotationKey]
+	if !ok {
+		return units, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &units); err != nil {
+		return units, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigUserUnitsAnnotationKey, mc.GetName(), err)
+	}
+	for name, list := range units {
+		for _, u := range list {
+			if u.Name == "" || strings.ContainsRune(u.Name, '/') || filepath.Ext(u.Name) == "" {
+				return units, fmt.Errorf("invalid unit name %q of user %s in %s annotation of MachineConfig %s", u.Name, name, MachineConfigUserUnitsAnnotationKey, mc.GetName())
+			}
+		}
+	}
+	return units, nil
+}
+
+// checkUserUnits returns an error if units are given for users that aren't
+// in the passwd section of the config, or for root, which has no user service
+// manager of its own to lend.
+func checkUserUnits(units userUnits, users []ign3types.PasswdUser) error {
+	for name := range units {
+		found := false
+		for _, u := range users {
+			found = found || u.Name == name
+		}
+		if !found || name == "root" {
+			return fmt.Errorf("user units of %s annotation are for user %s, which isn't a user of the passwd section", MachineConfigUserUnitsAnnotationKey, name)
+		}
+	}
+	return nil
+}
+
+// mergeUserUnitsAnnotations sets the user units annotation of merged to the
+// units of configs, in order of their names, later ones replacing units of
+// the same name and user.
+func mergeUserUnitsAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	sorted := append([]*mcfgv1.MachineConfig{}, configs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	units := userUnits{}
+	for _, config := range sorted {
+		fragment, err := machineConfigUserUnits(config)
+		if err != nil {
+			return err
+		}
+		for name, list := range fragment {
+			for _, u := range list {
+				units[name] = append(removeUserUnit(units[name], u.Name), u)
+			}
+		}
+	}
+	if len(units) == 0 {
+		return nil
+	}
+	return setJSONAnnotation(merged, MachineConfigUserUnitsAnnotationKey, units)
+}
+
+func removeUserUnit(units []userUnit, name string) []userUnit {
+	var kept []userUnit
+	for _, u := range units {
+		if u.Name != name {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// userUnitsDir returns the directory of the user units of u.
+func userUnitsDir(u *user.User) string {
+	return filepath.Join(u.HomeDir, ".config", "systemd", "user")
+}
+
+// userUnitPaths returns the paths of the user units of the change, for the
+// snapshot of the update. Users that don't exist yet have none.
+func userUnitPaths(change *userUnitsChange) []string {
+	var paths []string
+	for _, units := range []userUnits{change.old, change.new} {
+		for name, list := range units {
+			u, err := user.Lookup(name)
+			if err != nil {
+				continue
+			}
+			for _, unit := range list {
+				paths = append(paths, filepath.Join(userUnitsDir(u), unit.Name))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// updateUserUnits writes the user units of the change and removes dropped
+// ones, enabling lingering for users with units and disabling it for users
+// that no longer have any. Changed units that are running are restarted,
+// added enabled ones started and removed ones stopped. It returns the
+// changed units as user/unit.
+func updateUserUnits(change *userUnitsChange) ([]string, error) {
+	var changed []string
+	names := map[string]struct{}{}
+	for name := range change.old {
+		names[name] = struct{}{}
+	}
+	for name := range change.new {
+		names[name] = struct{}{}
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		userChanged, err := updateUnitsOfUser(name, change.old[name], change.new[name])
+		if err != nil {
+			return changed, fmt.Errorf("updating user units of %s: %w", name, err)
+		}
+		for _, unit := range userChanged {
+			changed = append(changed, name+"/"+unit)
+		}
+	}
+	return changed, nil
+}
+
+func updateUnitsOfUser(name string, oldUnits, newUnits []userUnit) ([]string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	dir := userUnitsDir(u)
+	systemctl := func(args ...string) error {
+		return runCmdSync("systemctl", append([]string{"--user", "--machine=" + name + "@"}, args...)...)
+	}
+
+	if len(newUnits) > 0 {
+		// The user's service manager is started by lingering, and must run
+		// before its units can be started
+		if err := runCmdSync("loginctl", "enable-linger", name); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			// Created as the user, so the directories are owned by them
+			if err := exec.Command("runuser", "-u", name, "--", "mkdir", "-p", dir).Run(); err != nil {
+				return nil, fmt.Errorf("creating %q: %w", dir, err)
+			}
+		}
+	}
+
+	kept := map[string]struct{}{}
+	for _, unit := range newUnits {
+		kept[unit.Name] = struct{}{}
+	}
+	var changed, removed []string
+	for _, unit := range oldUnits {
+		if _, ok := kept[unit.Name]; ok {
+			continue
+		}
+		if err := systemctl("disable", "--now", unit.Name); err != nil {
+			klog.Warningf("Failed to stop user unit %s of %s: %v", unit.Name, name, err)
+		}
+		if err := os.Remove(filepath.Join(dir, unit.Name)); err != nil && !os.IsNotExist(err) {
+			return changed, err
+		}
+		removed = append(removed, unit.Name)
+	}
+
+	var written []userUnit
+	for _, unit := range newUnits {
+		path := filepath.Join(dir, unit.Name)
+		if current, err := os.ReadFile(path); err == nil && string(current) == unit.Contents {
+			continue
+		}
+		if err := writeFileAtomically(path, []byte(unit.Contents), defaultDirectoryPermissions, defaultFilePermissions, uid, gid); err != nil {
+			return changed, err
+		}
+		written = append(written, unit)
+	}
+
+	if len(newUnits) > 0 {
+		if err := systemctl("daemon-reload"); err != nil {
+			return changed, err
+		}
+		for _, unit := range newUnits {
+			var err error
+			if isTrue(unit.Enabled) {
+				err = systemctl("enable", unit.Name)
+			} else if unit.Enabled != nil {
+				err = systemctl("disable", unit.Name)
+			}
+			if err != nil {
+				return changed, err
+			}
+		}
+		for _, unit := range written {
+			verb := "try-restart"
+			if isTrue(unit.Enabled) {
+				verb = "restart"
+			}
+			if err := systemctl(verb, unit.Name); err != nil {
+				return changed, err
+			}
+			changed = append(changed, unit.Name)
+		}
+	} else if len(oldUnits) > 0 {
+		if err := runCmdSync("loginctl", "disable-linger", name); err != nil {
+			return changed, err
+		}
+	}
+	changed = append(changed, removed...)
+	sort.Strings(changed)
+	if len(changed) > 0 {
+		logSystem("Updated user units %s of %s", strings.Join(changed, ", "), name)
+	}
+	return changed, nil
+}
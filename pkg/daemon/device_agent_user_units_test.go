@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserUnits(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+	d.manageUnits = true
+
+	// Units are merged per user, later configs replacing units of the same name
+	base := newDeviceAgentTestConfig(t, "00-base", nil, nil)
+	base.Annotations = map[string]string{MachineConfigUserUnitsAnnotationKey: `{"app": [{"name": "app.service", "contents": "[Service]\nExecStart=/usr/bin/app\n", "enabled": true}, {"name": "sync.timer", "contents": "[Timer]\n"}]}`}
+	site := newDeviceAgentTestConfig(t, "10-site", nil, nil)
+	site.Annotations = map[string]string{MachineConfigUserUnitsAnnotationKey: `{"app": [{"name": "app.service", "contents": "[Service]\nExecStart=/usr/bin/app --site\n", "enabled": true}]}`}
+	merged, err := MergeMachineConfigsInAgentMode("merged", []*mcfgv1.MachineConfig{site, base})
+	require.Nil(t, err)
+	units, err := machineConfigUserUnits(merged)
+	require.Nil(t, err)
+	assert.Equal(t, userUnits{"app": {
+		{Name: "sync.timer", Contents: "[Timer]\n"},
+		{Name: "app.service", Contents: "[Service]\nExecStart=/usr/bin/app --site\n", Enabled: helpers.BoolToPtr(true)},
+	}}, units)
+
+	// The users must be in the passwd section
+	_, err = d.PlanInDeviceAgentMode(nil, merged, deviceAgentTestSelector)
+	var unreconcilable *ErrUnreconcilable
+	assert.ErrorAs(t, err, &unreconcilable)
+	assert.Nil(t, checkUserUnits(units, []ign3types.PasswdUser{{Name: "app"}}))
+	assert.NotNil(t, checkUserUnits(userUnits{"root": nil}, []ign3types.PasswdUser{{Name: "root"}}))
+
+	// Unless units aren't managed
+	d.manageUnits = false
+	_, err = d.PlanInDeviceAgentMode(nil, merged, deviceAgentTestSelector)
+	assert.Nil(t, err)
+
+	invalid := newDeviceAgentTestConfig(t, "invalid", nil, nil)
+	invalid.Annotations = map[string]string{MachineConfigUserUnitsAnnotationKey: `{"app": [{"name": "../app.service"}]}`}
+	_, err = machineConfigUserUnits(invalid)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,269 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"k8s.io/klog/v2"
+)
+
+// MachineConfigUsrHotfixesAnnotationKey lets a MachineConfig write files below
+// the read-only /usr of CoreOS and bootc hosts in device agent mode, for
+// emergency hotfixes of the OS, as a JSON array of their paths:
+//
+//	["/usr/lib/udev/rules.d/60-fix.rules"]
+//
+// The files are written to a transient overlay mounted with rpm-ostree
+// usroverlay or bootc usr-overlay, which is discarded on reboot: hotfixes
+// don't persist, they are only written again by the next update applying the
+// config. The hotfixes applied are tracked in usrHotfixesPath, and updates
+// staging a new OS image check whether it ships their contents, in which case
+// they are reported in UpdateResult.UsrHotfixesObsolete. Lasting fixes belong
+// in the OS image. MergeMachineConfigsInAgentMode merges the paths of all
+// configs.
+const MachineConfigUsrHotfixesAnnotationKey = "machineconfiguration.openshift.io/usr-hotfixes"
+
+// usrHotfixesPath is where the hotfixes written to the /usr overlay are
+// tracked, so OS updates can tell whether they are still required.
+var usrHotfixesPath = "/etc/machine-config-daemon/usr-hotfixes.json"
+
+// usrHotfix is a hotfix written to the /usr overlay.
+type usrHotfix struct {
+	Path   string `json:"path"`
+	Config string `json:"config"`
+	// Digest is the hash of the contents written, as by hashFile.
+	Digest string `json:"digest"`
+}
+
+// machineConfigUsrHotfixes returns the paths of mc's annotation.
+func machineConfigUsrHotfixes(mc *mcfgv1.MachineConfig) ([]string, error) {
+	encoded, ok := mc.GetAnnotations()[MachineConfigUsrHotfixesAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var paths []string
+	if err := json.Unmarshal([]byte(encoded), &paths); err != nil {
+		return nil, fmt.Errorf("parsing %s annotation of MachineConfig %s: %w", MachineConfigUsrHotfixesAnnotationKey, mc.GetName(), err)
+	}
+	for _, path := range paths {
+		_, inStateOverlay := stateOverlayDirOf(path)
+		if filepath.Clean(path) != path || !strings.HasPrefix(path, usrPath+"/") || inStateOverlay {
+			return nil, fmt.Errorf("invalid hotfix path %q in %s annotation of MachineConfig %s: must be a file below %s outside of the state overlay directories", path, MachineConfigUsrHotfixesAnnotationKey, mc.GetName(), usrPath)
+		}
+	}
+	return paths, nil
+}
+
+// mergeUsrHotfixesAnnotations sets the hotfixes annotation of merged to the
+// paths of configs.
+func mergeUsrHotfixesAnnotations(merged *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) error {
+	set := map[string]struct{}{}
+	for _, config := range configs {
+		fragment, err := machineConfigUsrHotfixes(config)
+		if err != nil {
+			return err
+		}
+		for _, path := range fragment {
+			set[path] = struct{}{}
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(set))
+	for path := range set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return setJSONAnnotation(merged, MachineConfigUsrHotfixesAnnotationKey, paths)
+}
+
+// usrHotfixFiles returns the files of ignConfig that are hotfixes, sorted.
+func usrHotfixFiles(ignConfig ign3types.Config, hotfixes []string) []string {
+	if len(hotfixes) == 0 {
+		return nil
+	}
+	files := []string{}
+	for _, f := range ignConfig.Storage.Files {
+		if ctrlcommon.InSlice(f.Path, hotfixes) {
+			files = append(files, f.Path)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// discardedUsrHotfixes returns the hotfix files of ignConfig that went with
+// the overlay on reboot, sorted, so they are written again.
+func discardedUsrHotfixes(ignConfig ign3types.Config, hotfixes []string) []string {
+	var discarded []string
+	for _, path := range usrHotfixFiles(ignConfig, hotfixes) {
+		if usrHotfixDiscarded(path) {
+			discarded = append(discarded, path)
+		}
+	}
+	return discarded
+}
+
+// usrHotfixesDiscarded returns true if updates with selector write hotfixes
+// of config again, as the overlay they were written to is gone.
+func (dn *Daemon) usrHotfixesDiscarded(config *mcfgv1.MachineConfig, selector ApplySelector) bool {
+	if !(dn.os.IsCoreOSVariant() || dn.bootc != nil) || !selector.Has(ApplyFiles) {
+		return false
+	}
+	hotfixes, err := machineConfigUsrHotfixes(config)
+	if err != nil || len(hotfixes) == 0 {
+		return false
+	}
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	if err != nil {
+		return false
+	}
+	return len(discardedUsrHotfixes(ignConfig, hotfixes)) > 0
+}
+
+// usrReadOnly returns true if /usr is read-only, i.e. it has no overlay.
+var usrReadOnly = func() (bool, error) {
+	return isReadOnlyDir(usrPath)
+}
+
+// mountUsrOverlay makes /usr writable with a transient overlay, unless it
+// already is.
+func (dn *Daemon) mountUsrOverlay(ctx context.Context) error {
+	readOnly, err := usrReadOnly()
+	if err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+	if dn.bootc != nil {
+		err = dn.bootc.UsrOverlay(ctx)
+	} else {
+		err = runCmdSyncContext(ctx, "rpm-ostree", "usroverlay")
+	}
+	if err != nil {
+		return fmt.Errorf("mounting overlay on %s for hotfixes: %w", usrPath, err)
+	}
+	logSystem("Mounted transient overlay on %s for hotfixes, it is discarded on reboot", usrPath)
+	return nil
+}
+
+// usrHotfixDiscarded returns true if path is below /usr, outside of the state
+// overlay directories, and /usr is read-only, so a hotfix written there went
+// with the overlay on reboot.
+func usrHotfixDiscarded(path string) bool {
+	if _, ok := stateOverlayDirOf(path); ok || !strings.HasPrefix(path, usrPath+"/") {
+		return false
+	}
+	readOnly, err := usrReadOnly()
+	return err == nil && readOnly
+}
+
+// loadUsrHotfixes returns the tracked hotfixes, or none if there are none.
+func loadUsrHotfixes() ([]usrHotfix, error) {
+	b, err := os.ReadFile(usrHotfixesPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading hotfixes: %w", err)
+	}
+	var hotfixes []usrHotfix
+	if err := json.Unmarshal(b, &hotfixes); err != nil {
+		return nil, fmt.Errorf("parsing hotfixes %s: %w", usrHotfixesPath, err)
+	}
+	return hotfixes, nil
+}
+
+// saveUsrHotfixes replaces the tracked hotfixes.
+func saveUsrHotfixes(hotfixes []usrHotfix) error {
+	if len(hotfixes) == 0 {
+		if err := os.Remove(usrHotfixesPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(hotfixes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(usrHotfixesPath), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(usrHotfixesPath, b)
+}
+
+// trackUsrHotfixes records the hotfix files of configName as written.
+func trackUsrHotfixes(configName string, files []string) error {
+	hotfixes := make([]usrHotfix, 0, len(files))
+	for _, path := range files {
+		digest, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("tracking hotfix: %w", err)
+		}
+		hotfixes = append(hotfixes, usrHotfix{Path: path, Config: configName, Digest: digest})
+	}
+	return saveUsrHotfixes(hotfixes)
+}
+
+// reevaluateUsrHotfixes compares the tracked hotfixes with the files of the
+// staged deployment. It stops tracking the hotfixes the new OS ships and
+// returns their paths.
+func (dn *Daemon) reevaluateUsrHotfixes() ([]string, error) {
+	hotfixes, err := loadUsrHotfixes()
+	if err != nil || len(hotfixes) == 0 {
+		return nil, err
+	}
+	out, err := runGetOut("ostree", "admin", "status")
+	if err != nil {
+		return nil, fmt.Errorf("querying deployments: %w", err)
+	}
+	var staged string
+	for _, d := range parseOstreeDeployments(string(out)) {
+		if d.Staged {
+			staged = d.ID
+			break
+		}
+	}
+	if staged == "" {
+		return nil, fmt.Errorf("no staged deployment found")
+	}
+	root, err := ostreeDeploymentRoot(staged)
+	if err != nil {
+		return nil, err
+	}
+
+	var obsolete []string
+	required := hotfixes[:0]
+	for _, hotfix := range hotfixes {
+		digest, err := hashFile(filepath.Join(root, hotfix.Path))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if digest == hotfix.Digest {
+			obsolete = append(obsolete, hotfix.Path)
+			continue
+		}
+		klog.Infof("Hotfix %s of config %s is still required by deployment %s", hotfix.Path, hotfix.Config, staged)
+		required = append(required, hotfix)
+	}
+	if len(obsolete) == 0 {
+		return nil, nil
+	}
+	if err := saveUsrHotfixes(required); err != nil {
+		return nil, err
+	}
+	logSystem("Hotfixes %v are shipped by deployment %s and no longer required", obsolete, staged)
+	return obsolete, nil
+}
@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsrHotfixes(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	oldUsrPath := usrPath
+	usrPath = filepath.Join(testDir, "usr")
+	defer func() { usrPath = oldUsrPath }()
+	require.Nil(t, os.MkdirAll(usrPath, 0o755))
+	readOnly := false
+	oldUsrReadOnly := usrReadOnly
+	usrReadOnly = func() (bool, error) { return readOnly, nil }
+	defer func() { usrReadOnly = oldUsrReadOnly }()
+
+	ostreeStatus, _ := fakeOstree(t, testDir)
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 9f2b44.0\n"), 0o644))
+	bootcStatus := `{"status": {"booted": {"image": {"image": {"image": "quay.io/example/os:1", "transport": "registry"}}}}}`
+	d := newMockDeviceAgentDaemon(testDir)
+	d.bootc = &BootcClient{
+		run: func(_ context.Context, args ...string) error {
+			if args[0] == "usr-overlay" {
+				readOnly = false
+			}
+			return nil
+		},
+		output: func(...string) ([]byte, error) { return []byte(bootcStatus), nil },
+	}
+
+	// Files below /usr need to be listed as hotfixes
+	rules := filepath.Join(usrPath, "lib", "udev", "rules.d", "60-fix.rules")
+	oldConfig := newDeviceAgentTestConfig(t, "old", nil, nil)
+	oldConfig.Spec.OSImageURL = "quay.io/example/os:1"
+	hotfixConfig := newDeviceAgentTestConfig(t, "hotfix", []ign3types.File{newDeviceAgentTestFile(t, rules, "fixed")}, nil)
+	hotfixConfig.Spec.OSImageURL = oldConfig.Spec.OSImageURL
+	_, err := d.PlanInDeviceAgentMode(oldConfig, hotfixConfig, deviceAgentTestSelector)
+	var unreconcilable *ErrUnreconcilable
+	require.ErrorAs(t, err, &unreconcilable)
+	hotfixConfig.Annotations = map[string]string{MachineConfigUsrHotfixesAnnotationKey: `["` + usrPath + `/lib/../bin/x"]`}
+	_, err = d.PlanInDeviceAgentMode(oldConfig, hotfixConfig, deviceAgentTestSelector)
+	require.ErrorAs(t, err, &unreconcilable)
+
+	hotfixConfig.Annotations[MachineConfigUsrHotfixesAnnotationKey] = `["` + rules + `"]`
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, hotfixConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{rules}, result.UsrHotfixes)
+	hotfixes, err := loadUsrHotfixes()
+	require.Nil(t, err)
+	require.Len(t, hotfixes, 1)
+	assert.Equal(t, "hotfix", hotfixes[0].Config)
+
+	// The hotfix goes with the overlay on reboot: it isn't reported as a
+	// mismatch, and is written again by the same config
+	readOnly = true
+	require.Nil(t, os.Remove(rules))
+	report, err := d.ValidateOnDiskStateInAgentMode(hotfixConfig)
+	require.Nil(t, err)
+	for _, mismatch := range report.Mismatches {
+		assert.NotEqual(t, MismatchKindFile, mismatch.Kind, mismatch.Message)
+	}
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), hotfixConfig, hotfixConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	assert.Equal(t, []string{rules}, result.FilesWritten)
+	assert.False(t, readOnly)
+	assert.FileExists(t, rules)
+
+	// An OS update shipping the fix makes it obsolete
+	newConfig := hotfixConfig.DeepCopy()
+	newConfig.Name = "new"
+	newConfig.Spec.OSImageURL = "quay.io/example/os:2"
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("  fedora 3c1e5a.0 (staged)\n* fedora 9f2b44.0\n"), 0o644))
+	staged := filepath.Join(ostreeDeployDir, "fedora", "deploy", "3c1e5a.0")
+	require.Nil(t, os.MkdirAll(filepath.Join(staged, filepath.Dir(rules)), 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(staged, rules), []byte("fixed"), 0o644))
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), hotfixConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []string{rules}, result.UsrHotfixesObsolete)
+	assert.NoFileExists(t, usrHotfixesPath)
+
+	// Dropping the hotfix removes it while the overlay is still there
+	require.Nil(t, os.WriteFile(ostreeStatus, []byte("* fedora 9f2b44.0\n"), 0o644))
+	droppedConfig := newDeviceAgentTestConfig(t, "dropped", nil, nil)
+	droppedConfig.Spec.OSImageURL = newConfig.Spec.OSImageURL
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, droppedConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Empty(t, result.UsrHotfixes)
+	assert.NoFileExists(t, rules)
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/klog/v2"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+)
+
+// Kinds of on-disk state checked by ValidateOnDiskStateInAgentMode
+const (
+	MismatchKindFile            = "file"
+	MismatchKindUnit            = "unit"
+	MismatchKindSSHKeys         = "sshKeys"
+	MismatchKindKernelArguments = "kernelArguments"
+	MismatchKindOSImageURL      = "osImageURL"
+)
+
+// ValidationMismatch is a single difference between the on-disk state and a
+// MachineConfig.
+type ValidationMismatch struct {
+	// Kind is one of the MismatchKind* constants.
+	Kind string `json:"kind"`
+	// Name is the file path or unit name the mismatch is about, if any.
+	Name string `json:"name,omitempty"`
+	// Message describes the mismatch.
+	Message string `json:"message"`
+}
+
+// ValidationReport lists all the ways the on-disk state differs from a
+// MachineConfig.
+type ValidationReport struct {
+	ConfigName string               `json:"configName"`
+	Mismatches []ValidationMismatch `json:"mismatches,omitempty"`
+}
+
+// Converged returns true if the on-disk state matches the MachineConfig.
+func (r *ValidationReport) Converged() bool {
+	return len(r.Mismatches) == 0
+}
+
+func (r *ValidationReport) add(kind, name string, err error) {
+	r.Mismatches = append(r.Mismatches, ValidationMismatch{Kind: kind, Name: name, Message: err.Error()})
+}
+
+// ValidateOnDiskStateInAgentMode checks the on-disk state (files, units, SSH
+// keys and, on CoreOS, kernel arguments and OS image) against config without
+// changing anything. Unlike the validation done for cluster managed nodes, it
+// doesn't stop at the first mismatch but reports all of them, so a device
+// agent can e.g. confirm convergence after a reboot. An error is only returned
+// if the validation itself could not be performed.
+func (dn *Daemon) ValidateOnDiskStateInAgentMode(config *mcfgv1.MachineConfig) (*ValidationReport, error) {
+	if config == nil {
+		return nil, fmt.Errorf("no MachineConfig provided")
+	}
+	return dn.validateOnDiskStateReport(config, pathSystemd)
+}
+
+func (dn *Daemon) validateOnDiskStateReport(config *mcfgv1.MachineConfig, systemdPath string) (*ValidationReport, error) {
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Ignition for validation: %w", err)
+	}
+	// Templated files are written rendered
+	if err := dn.renderFileTemplates(config, &ignConfig); err != nil {
+		return nil, fmt.Errorf("failed to render templated files for validation: %w", err)
+	}
+
+	report := &ValidationReport{ConfigName: config.GetName()}
+
+	preserved, err := preservedFilePaths(config.GetName())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range ignConfig.Storage.Files {
+		// Discarded hotfixes are only written again by the next update
+		if f.Path == caBundleFilePath || usrHotfixDiscarded(f.Path) || preserved.Has(f.Path) {
+			continue
+		}
+		if err := checkV3File(f); err != nil {
+			report.add(MismatchKindFile, f.Path, err)
+		}
+	}
+
+	for _, u := range ignConfig.Systemd.Units {
+		if err := checkV3Unit(u, systemdPath); err != nil {
+			report.add(MismatchKindUnit, u.Name, err)
+		}
+	}
+
+	var sshKeys string
+	for _, u := range ignConfig.Passwd.Users {
+		for _, k := range u.SSHAuthorizedKeys {
+			sshKeys = sshKeys + string(k) + "\n"
+		}
+	}
+	if sshKeys != "" {
+		authKeyPath := constants.RHCOS8SSHKeyPath
+		if dn.useNewSSHKeyPath() {
+			authKeyPath = constants.RHCOS9SSHKeyPath
+		}
+		if err := checkSSHKeys(authKeyPath, sshKeys); err != nil {
+			report.add(MismatchKindSSHKeys, authKeyPath, err)
+		}
+	}
+
+	// The OS is expected to run the image of the kernel type of bootc hosts,
+	// as remapped by the override file, or the delta bundle it was updated
+	// from
+	osConfig := config
+	if dn.bootc != nil {
+		if osConfig, err = withKernelTypeOSImage(config); err != nil {
+			return nil, err
+		}
+	}
+	if osConfig, _, err = applyOSImageOverride(osConfig); err != nil {
+		return nil, err
+	}
+	if osConfig, err = withBootedOSDeltaBundle(osConfig, dn.bootedOSImageURL); err != nil {
+		return nil, err
+	}
+	if osConfig, err = withAppliedOSImageManifest(osConfig); err != nil {
+		return nil, err
+	}
+	if dn.os.IsCoreOSVariant() {
+		coreOSDaemon := CoreOSDaemon{dn}
+		missing, err := coreOSDaemon.missingKernelArguments(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check kernel arguments: %w", err)
+		}
+		if len(missing) > 0 {
+			report.add(MismatchKindKernelArguments, "", fmt.Errorf("missing expected kernel arguments: %v", missing))
+		}
+
+		if osConfig.Spec.OSImageURL != "" && !dn.checkOS(osConfig.Spec.OSImageURL) {
+			report.add(MismatchKindOSImageURL, "", fmt.Errorf("expected target osImageURL %q, have %q (%q)", osConfig.Spec.OSImageURL, dn.bootedOSImageURL, dn.bootedOSCommit))
+		}
+	} else if dn.bootc != nil && osConfig.Spec.OSImageURL != "" {
+		if transport, image := splitOSImageTransport(osConfig.Spec.OSImageURL); joinOSImageTransport(transport, image) != dn.bootedOSImageURL {
+			report.add(MismatchKindOSImageURL, "", fmt.Errorf("expected target osImageURL %q, have %q (%q)", osConfig.Spec.OSImageURL, dn.bootedOSImageURL, dn.bootedOSCommit))
+		}
+	}
+
+	if report.Converged() {
+		klog.Infof("On-disk state matches %s", report.ConfigName)
+	} else {
+		klog.Infof("On-disk state differs from %s in %d places", report.ConfigName, len(report.Mismatches))
+	}
+	return report, nil
+}
+
+// checkSSHKeys compares the authorized keys written for the core user with
+// the expected keys.
+func checkSSHKeys(authKeyPath, expected string) error {
+	contents, err := os.ReadFile(authKeyPath)
+	if err != nil {
+		return fmt.Errorf("could not read file %q: %w", authKeyPath, err)
+	}
+	if !bytes.Equal(contents, []byte(expected)) {
+		return fmt.Errorf("content mismatch for file %q", authKeyPath)
+	}
+	return nil
+}
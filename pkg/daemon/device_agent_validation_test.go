@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOnDiskStateInAgentMode(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	systemdPath := filepath.Join(testDir, "systemd")
+	require.Nil(t, os.MkdirAll(systemdPath, 0o755))
+
+	goodPath := filepath.Join(testDir, "etc", "good")
+	driftedPath := filepath.Join(testDir, "etc", "drifted")
+	config := newDeviceAgentTestConfig(t, "rendered", []ign3types.File{
+		newDeviceAgentTestFile(t, goodPath, "good"),
+		newDeviceAgentTestFile(t, driftedPath, "expected"),
+	}, []ign3types.Unit{
+		{Name: "good.service", Contents: helpers.StrToPtr("[Unit]")},
+		{Name: "missing.service", Contents: helpers.StrToPtr("[Unit]")},
+	})
+	ignConfig, err := ctrlcommon.ParseAndConvertConfig(config.Spec.Config.Raw)
+	require.Nil(t, err)
+	require.Nil(t, d.writeFiles(context.TODO(), ignConfig.Storage.Files, nil, true))
+	require.Nil(t, os.WriteFile(filepath.Join(systemdPath, "good.service"), []byte("[Unit]"), defaultFilePermissions))
+
+	report, err := d.validateOnDiskStateReport(config, systemdPath)
+	require.Nil(t, err)
+	assert.Equal(t, "rendered", report.ConfigName)
+	assert.Equal(t, []ValidationMismatch{{
+		Kind:    MismatchKindUnit,
+		Name:    "missing.service",
+		Message: fmt.Sprintf("could not stat file %q: lstat %[1]s: no such file or directory", filepath.Join(systemdPath, "missing.service")),
+	}}, report.Mismatches)
+
+	require.Nil(t, os.WriteFile(filepath.Join(systemdPath, "missing.service"), []byte("[Unit]"), defaultFilePermissions))
+	report, err = d.validateOnDiskStateReport(config, systemdPath)
+	require.Nil(t, err)
+	assert.True(t, report.Converged())
+
+	require.Nil(t, os.WriteFile(driftedPath, []byte("drifted"), defaultFilePermissions))
+	report, err = d.validateOnDiskStateReport(config, systemdPath)
+	require.Nil(t, err)
+	assert.False(t, report.Converged())
+	require.Len(t, report.Mismatches, 1)
+	assert.Equal(t, MismatchKindFile, report.Mismatches[0].Kind)
+	assert.Equal(t, driftedPath, report.Mismatches[0].Name)
+}
+
+func TestValidateOnDiskStateInAgentModeTemplates(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	d.templateValuesPath = filepath.Join(testDir, "template-values")
+	require.Nil(t, os.WriteFile(d.templateValuesPath, []byte("site = berlin-1\n"), 0o644))
+	systemdPath := filepath.Join(testDir, "systemd")
+	require.Nil(t, os.MkdirAll(systemdPath, 0o755))
+
+	templatedPath := filepath.Join(testDir, "etc", "agent.conf")
+	config := newDeviceAgentTestConfig(t, "rendered", []ign3types.File{
+		newDeviceAgentTestFile(t, templatedPath, "site={{ .Values.site }}"),
+	}, nil)
+	config.Annotations = map[string]string{MachineConfigFileTemplatesAnnotationKey: fmt.Sprintf("[%q]", templatedPath)}
+	require.Nil(t, os.WriteFile(templatedPath, []byte("site=berlin-1"), defaultFilePermissions))
+
+	report, err := d.validateOnDiskStateReport(config, systemdPath)
+	require.Nil(t, err)
+	assert.True(t, report.Converged())
+
+	require.Nil(t, os.WriteFile(d.templateValuesPath, []byte("site = paris-2\n"), 0o644))
+	report, err = d.validateOnDiskStateReport(config, systemdPath)
+	require.Nil(t, err)
+	require.Len(t, report.Mismatches, 1)
+	assert.Equal(t, MismatchKindFile, report.Mismatches[0].Kind)
+	assert.Equal(t, templatedPath, report.Mismatches[0].Name)
+}
@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+)
+
+// MachineConfigFileXattrsAnnotationKey holds the extended attributes to set on
+// files of a MachineConfig in device agent mode, which Ignition has no field
+// for. It is a JSON object mapping file paths to objects mapping attribute
+// names to values, e.g.
+//
+//	{"/usr/local/bin/agent": {"user.origin": "fleet"}}
+//
+// Like with setfattr(1), values prefixed with "0s" are base64 encoded and
+// values prefixed with "0x" are hex encoded. Setting "security.selinux" on a
+// file replaces the SELinux label it would otherwise get from the policy.
+const MachineConfigFileXattrsAnnotationKey = "machineconfiguration.openshift.io/file-xattrs"
+
+// xattrSELinux is the extended attribute holding a file's SELinux label.
+const xattrSELinux = "security.selinux"
+
+// fileXattrs maps file paths to the extended attributes to set on them.
+type fileXattrs map[string]map[string][]byte
+
+// machineConfigFileXattrs returns the extended attributes, including file
+// capabilities, mc's annotations ask for, checking that each of them is for
+// one of files.
+func machineConfigFileXattrs(mc *mcfgv1.MachineConfig, files []ign3types.File) (fileXattrs, error) {
+	var xattrs fileXattrs
+	if encoded, ok := mc.GetAnnotations()[MachineConfigFileXattrsAnnotationKey]; ok {
+		raw := map[string]map[string]string{}
+		if err := json.Unmarshal([]byte(encoded), &raw); err != nil {
+			return nil, fmt.Errorf("parsing %s annotation: %w", MachineConfigFileXattrsAnnotationKey, err)
+		}
+		xattrs = make(fileXattrs, len(raw))
+		for path, attrs := range raw {
+			decoded := make(map[string][]byte, len(attrs))
+			for name, value := range attrs {
+				if !strings.Contains(name, ".") {
+					return nil, fmt.Errorf("extended attribute %q of %q has no namespace", name, path)
+				}
+				v, err := decodeXattrValue(value)
+				if err != nil {
+					return nil, fmt.Errorf("extended attribute %q of %q: %w", name, path, err)
+				}
+				decoded[name] = v
+			}
+			xattrs[path] = decoded
+		}
+	}
+	xattrs, err := addFileCapabilities(mc, xattrs)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		paths[file.Path] = struct{}{}
+	}
+	for path := range xattrs {
+		if _, ok := paths[path]; !ok {
+			return nil, fmt.Errorf("extended attributes given for %q, which is not a file of MachineConfig %s", path, mc.GetName())
+		}
+	}
+	return xattrs, nil
+}
+
+// decodeXattrValue decodes an extended attribute value encoded like setfattr
+// accepts it.
+func decodeXattrValue(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "0s"), strings.HasPrefix(value, "0S"):
+		return base64.StdEncoding.DecodeString(value[2:])
+	case strings.HasPrefix(value, "0x"), strings.HasPrefix(value, "0X"):
+		return hex.DecodeString(value[2:])
+	default:
+		return []byte(value), nil
+	}
+}
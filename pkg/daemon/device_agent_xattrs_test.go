@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestRunOnceInDeviceAgentModeXattrs(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	agentPath := filepath.Join(testDir, "etc", "agent")
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, agentPath, "agent")}, nil)
+	newConfig.Annotations = map[string]string{
+		MachineConfigFileXattrsAnnotationKey: fmt.Sprintf(`{%q: {"user.origin": "fleet", "user.blob": "0sAAEC"}}`, agentPath),
+	}
+
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("filesystem doesn't support user extended attributes")
+	}
+	require.Nil(t, err)
+
+	getXattr := func(name string) []byte {
+		buf := make([]byte, 64)
+		n, err := unix.Lgetxattr(agentPath, name, buf)
+		require.Nil(t, err)
+		return buf[:n]
+	}
+	assert.Equal(t, []byte("fleet"), getXattr("user.origin"))
+	assert.Equal(t, []byte{0, 1, 2}, getXattr("user.blob"))
+
+	// Changing only the extended attributes isn't a no-op
+	changedConfig := newConfig.DeepCopy()
+	changedConfig.Annotations[MachineConfigFileXattrsAnnotationKey] = fmt.Sprintf(`{%q: {"user.origin": "local"}}`, agentPath)
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, changedConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.False(t, result.NoOp)
+	assert.Equal(t, []byte("local"), getXattr("user.origin"))
+
+	// Extended attributes for paths that aren't files of the config are rejected
+	badConfig := newConfig.DeepCopy()
+	badConfig.Annotations[MachineConfigFileXattrsAnnotationKey] = `{"/etc/other": {"user.origin": "fleet"}}`
+	_, err = d.PlanInDeviceAgentMode(newConfig, badConfig, deviceAgentTestSelector)
+	assert.NotNil(t, err)
+}
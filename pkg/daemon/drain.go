@@ -85,7 +85,7 @@ func (dn *Daemon) performDrain() error {
 		if wait.Interrupted(err) {
 			failMsg := fmt.Sprintf("failed to drain node: %s after 1 hour. Please see machine-config-controller logs for more information", dn.node.Name)
 			dn.nodeWriter.Eventf(corev1.EventTypeWarning, "FailedToDrain", failMsg)
-			return fmt.Errorf(failMsg)
+			return &ErrDrainTimeout{Err: fmt.Errorf(failMsg)}
 		}
 		return fmt.Errorf("Something went wrong while attempting to drain node: %v", err)
 	}
@@ -112,6 +112,17 @@ func isDrainRequired(actions, diffFileSet []string, oldIgnConfig, newIgnConfig i
 			return !isSafe, nil
 		}
 		return false, nil
+	} else if ctrlcommon.InSlice(postConfigChangeActionReloadNetworkManager, actions) {
+		// Only the connections of the changed keyfiles are reactivated
+		return false, nil
+	} else if ctrlcommon.InSlice(postConfigChangeActionRestartSSSD, actions) || ctrlcommon.InSlice(postConfigChangeActionRestartChronyd, actions) ||
+		ctrlcommon.InSlice(postConfigChangeActionRunSysusers, actions) || ctrlcommon.InSlice(postConfigChangeActionRunTmpfiles, actions) ||
+		ctrlcommon.InSlice(postConfigChangeActionRestartKubelet, actions) || ctrlcommon.InSlice(postConfigChangeActionRestartCrio, actions) ||
+		ctrlcommon.InSlice(postConfigChangeActionRefreshSysext, actions) || ctrlcommon.InSlice(postConfigChangeActionRestartQuadlets, actions) {
+		// Only sssd, chronyd, kubelet, crio or the changed quadlet services
+		// are restarted, users and files are created or system extensions
+		// merged; workloads keep running
+		return false, nil
 	} else if ctrlcommon.InSlice(postConfigChangeActionNone, actions) {
 		return false, nil
 	}
@@ -356,6 +356,55 @@ location = "mirror.com/repo/test-img-14"
 			newConfig:      machineConfigs["mc1"],
 			expectedAction: true,
 		},
+		{
+			// skip drain: only NetworkManager reload action is present
+			actions:        []string{postConfigChangeActionReloadNetworkManager},
+			oldConfig:      machineConfigs["mc1"],
+			newConfig:      machineConfigs["mc1"],
+			expectedAction: false,
+		},
+		{
+			// skip drain: only sssd restart action is present
+			actions:        []string{postConfigChangeActionRestartSSSD},
+			oldConfig:      machineConfigs["mc1"],
+			newConfig:      machineConfigs["mc1"],
+			expectedAction: false,
+		},
+		{
+			// skip drain: only chronyd restart action is present
+			actions:        []string{postConfigChangeActionRestartChronyd},
+			oldConfig:      machineConfigs["mc1"],
+			newConfig:      machineConfigs["mc1"],
+			expectedAction: false,
+		},
+		{
+			// skip drain: only sysext refresh action is present
+			actions:        []string{postConfigChangeActionRefreshSysext},
+			oldConfig:      machineConfigs["mc1"],
+			newConfig:      machineConfigs["mc1"],
+			expectedAction: false,
+		},
+		{
+			// skip drain: only quadlets restart action is present
+			actions:        []string{postConfigChangeActionRestartQuadlets},
+			oldConfig:      machineConfigs["mc1"],
+			newConfig:      machineConfigs["mc1"],
+			expectedAction: false,
+		},
+		{
+			// skip drain: only kubelet and crio restart actions are present
+			actions:        []string{postConfigChangeActionRestartKubelet, postConfigChangeActionRestartCrio},
+			oldConfig:      machineConfigs["mc1"],
+			newConfig:      machineConfigs["mc1"],
+			expectedAction: false,
+		},
+		{
+			// skip drain: only systemd-sysusers and systemd-tmpfiles runs are present
+			actions:        []string{postConfigChangeActionRunSysusers, postConfigChangeActionRunTmpfiles},
+			oldConfig:      machineConfigs["mc1"],
+			newConfig:      machineConfigs["mc1"],
+			expectedAction: false,
+		},
 		// below tests are run when only crio reload action is present
 		{
 			// skip drain: no changes in registry config
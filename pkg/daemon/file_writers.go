@@ -2,7 +2,10 @@ package daemon
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
@@ -12,15 +15,17 @@ import (
 
 	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
 	"github.com/google/renameio"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
-
-	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
 )
 
 var (
 	origParentDirPath   = filepath.Join("/etc", "machine-config-daemon", "orig")
 	noOrigParentDirPath = filepath.Join("/etc", "machine-config-daemon", "noorig")
+	orphanedDirPath     = filepath.Join("/etc", "machine-config-daemon", "orphaned")
 	usrPath             = "/usr"
+	passwdPath          = "/etc/passwd"
+	groupPath           = "/etc/group"
 )
 
 func origParentDir() string {
@@ -72,6 +77,25 @@ func isFileOwnedByRPMPkg(fpath string) (bool, bool, error) {
 	return false, false, fmt.Errorf("command %q returned with unexpected error: %s: %w", cmd, string(out), err)
 }
 
+// backupOrphanedFile copies a file that is no longer part of the config below
+// orphanedDirPath, replacing any earlier backup of it.
+func backupOrphanedFile(fpath string) error {
+	if _, err := os.Lstat(fpath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	backupPath := filepath.Join(orphanedDirPath, fpath)
+	if err := os.RemoveAll(backupPath); err != nil {
+		return fmt.Errorf("removing old backup of orphaned file %q: %w", fpath, err)
+	}
+	if err := copyPreservingAttributes(fpath, backupPath); err != nil {
+		return fmt.Errorf("backing up orphaned file %q: %w", fpath, err)
+	}
+	klog.Infof("Backed up orphaned file %q to %q", fpath, backupPath)
+	return nil
+}
+
 func createOrigFile(fromPath, fpath string) error {
 	orig := false
 
@@ -185,6 +209,131 @@ func writeFileAtomically(fpath string, b []byte, dirMode, fileMode os.FileMode,
 	return t.CloseAtomicallyReplace()
 }
 
+// sparseBlockSize is the granularity at which writeFileStreaming turns runs of
+// zeros into holes.
+const sparseBlockSize = 4096
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// procSelfFdPath is where the file descriptors of the process can be opened
+// by path, needed to link O_TMPFILE files into place.
+var procSelfFdPath = "/proc/self/fd"
+
+// writeFileStreaming is like writeFileAtomically, but streams the contents
+// fill writes instead of taking them in memory, so large files don't need to
+// fit into memory. The file is created with O_TMPFILE where supported, so it
+// never shows up half-written even after a crash, and runs of zeros are left
+// as holes. If fill fails, fpath is left untouched.
+func writeFileStreaming(fpath string, dirMode, fileMode os.FileMode, uid, gid int, fill func(io.Writer) error) error {
+	dir := filepath.Dir(fpath)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+	f, anonymous, err := createTempFile(dir, fpath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if !anonymous {
+			os.Remove(f.Name())
+		}
+	}()
+
+	// Set permissions before writing data, in case the data is sensitive.
+	if err := f.Chmod(fileMode); err != nil {
+		return err
+	}
+	sparse := &sparseWriter{f: f}
+	w := bufio.NewWriterSize(sparse, 16*sparseBlockSize)
+	if err := fill(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := sparse.finish(); err != nil {
+		return err
+	}
+	if uid != -1 && gid != -1 {
+		if err := f.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	tmpPath := f.Name()
+	if anonymous {
+		tmpPath = filepath.Join(dir, "."+filepath.Base(fpath)+".mcdtmp")
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fdPath := filepath.Join(procSelfFdPath, strconv.Itoa(int(f.Fd())))
+		if err := unix.Linkat(unix.AT_FDCWD, fdPath, unix.AT_FDCWD, tmpPath, unix.AT_SYMLINK_FOLLOW); err != nil {
+			return fmt.Errorf("linking %q into place: %w", fpath, err)
+		}
+	}
+	if err := os.Rename(tmpPath, fpath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// createTempFile creates an anonymous O_TMPFILE file in dir, or a named
+// temporary file if the filesystem doesn't support them.
+func createTempFile(dir, fpath string) (f *os.File, anonymous bool, err error) {
+	if _, err := os.Stat(procSelfFdPath); err == nil {
+		fd, err := unix.Open(dir, unix.O_TMPFILE|unix.O_WRONLY|unix.O_CLOEXEC, 0o600)
+		if err == nil {
+			return os.NewFile(uintptr(fd), fpath), true, nil
+		}
+		if !errors.Is(err, unix.EOPNOTSUPP) && !errors.Is(err, unix.EISDIR) && !errors.Is(err, unix.EINVAL) {
+			return nil, false, fmt.Errorf("creating temporary file for %q: %w", fpath, err)
+		}
+	}
+	f, err = os.CreateTemp(dir, "."+filepath.Base(fpath)+".*.mcdtmp")
+	if err != nil {
+		return nil, false, fmt.Errorf("creating temporary file for %q: %w", fpath, err)
+	}
+	return f, false, nil
+}
+
+// sparseWriter writes to a file, seeking over blocks of zeros rather than
+// writing them so they become holes.
+type sparseWriter struct {
+	f    *os.File
+	size int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		block := p
+		if len(block) > sparseBlockSize {
+			block = block[:sparseBlockSize]
+		}
+		if bytes.Equal(block, zeroBlock[:len(block)]) {
+			if _, err := w.f.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+				return n, err
+			}
+		} else if _, err := w.f.Write(block); err != nil {
+			return n, err
+		}
+		n += len(block)
+		w.size += int64(len(block))
+		p = p[len(block):]
+	}
+	return n, nil
+}
+
+// finish sets the size of the file, covering trailing holes.
+func (w *sparseWriter) finish() error {
+	return w.f.Truncate(w.size)
+}
+
 // write dropins to disk
 func writeDropins(u ign3types.Unit, systemdRoot string, isCoreOSVariant bool) error {
 	for i := range u.Dropins {
@@ -221,48 +370,168 @@ func writeDropins(u ign3types.Unit, systemdRoot string, isCoreOSVariant bool) er
 	return nil
 }
 
-// writeFiles writes the given files to disk.
-// it doesn't fetch remote files and expects a flattened config file.
-func writeFiles(files []ign3types.File, skipCertificateWrite bool) error {
-	for _, file := range files {
-		if skipCertificateWrite && file.Path == caBundleFilePath {
-			// TODO remove this special case once we have a better way to do this
-			klog.V(4).Infof("Skipping file %s during writeFiles", caBundleFilePath)
-			continue
+// writeDirectories creates the given directories, or updates their mode and
+// ownership if they exist. Nodes in the way of a directory are only removed
+// if they were managed by the old config, or if the directory asks for them
+// to be overwritten.
+func writeDirectories(oldIgnConfig, newIgnConfig ign3types.Config) error {
+	managed := managedStoragePaths(oldIgnConfig)
+	owners := newOwnershipResolver(newIgnConfig.Storage.Files)
+	for _, d := range newIgnConfig.Storage.Directories {
+		klog.Infof("Writing directory %q", d.Path)
+
+		info, err := os.Lstat(d.Path)
+		switch {
+		case err == nil && !info.IsDir():
+			if _, ok := managed[d.Path]; !ok && (d.Overwrite == nil || !*d.Overwrite) {
+				return fmt.Errorf("cannot create directory %q: path exists and overwrite is not set", d.Path)
+			}
+			if err := os.Remove(d.Path); err != nil {
+				return fmt.Errorf("removing %q to create a directory: %w", d.Path, err)
+			}
+		case err != nil && !os.IsNotExist(err):
+			return err
 		}
-		klog.Infof("Writing file %q", file.Path)
 
-		// We don't support appends in the file section, so instead of waiting to fail validation,
-		// let's explicitly fail here.
-		if len(file.Append) > 0 {
-			return fmt.Errorf("found an append section when writing files. Append is not supported")
+		mode := defaultDirectoryPermissions
+		if d.Mode != nil {
+			mode = os.FileMode(*d.Mode)
 		}
-
-		decodedContents, err := ctrlcommon.DecodeIgnitionFileContents(file.Contents.Source, file.Contents.Compression)
+		uid, gid, err := owners.nodeOwnership(d.Node)
 		if err != nil {
-			return fmt.Errorf("could not decode file %q: %w", file.Path, err)
+			return fmt.Errorf("failed to retrieve ownership for directory %q: %w", d.Path, err)
+		}
+		if err := os.MkdirAll(d.Path, mode); err != nil {
+			return fmt.Errorf("failed to create directory %q: %w", d.Path, err)
+		}
+		// Use the raw mode, so setgid and sticky bits survive and the umask
+		// doesn't apply
+		if err := unix.Chmod(d.Path, uint32(mode)); err != nil {
+			return fmt.Errorf("failed to set mode of directory %q: %w", d.Path, err)
+		}
+		if err := os.Lchown(d.Path, uid, gid); err != nil {
+			return fmt.Errorf("failed to set ownership of directory %q: %w", d.Path, err)
 		}
+	}
+	return nil
+}
 
-		mode := defaultFilePermissions
-		if file.Mode != nil {
-			mode = os.FileMode(*file.Mode)
+// writeLinks creates or replaces the given symbolic and hard links. Like with
+// writeDirectories, nodes in the way of a link are only replaced if they were
+// managed by the old config or the link asks for them to be overwritten.
+func writeLinks(oldIgnConfig, newIgnConfig ign3types.Config) error {
+	managed := managedStoragePaths(oldIgnConfig)
+	owners := newOwnershipResolver(newIgnConfig.Storage.Files)
+	for _, l := range newIgnConfig.Storage.Links {
+		if l.Target == nil {
+			return fmt.Errorf("link %q has no target", l.Path)
+		}
+		target := *l.Target
+		hard := l.Hard != nil && *l.Hard
+		klog.Infof("Writing link %q to %q", l.Path, target)
+
+		info, err := os.Lstat(l.Path)
+		switch {
+		case err == nil:
+			if upToDate, err := isLinkUpToDate(l.Path, info, target, hard); err != nil {
+				return err
+			} else if upToDate {
+				break
+			}
+			_, ok := managed[l.Path]
+			if info.Mode()&os.ModeSymlink == 0 && !ok && (l.Overwrite == nil || !*l.Overwrite) {
+				return fmt.Errorf("cannot create link %q: path exists and overwrite is not set", l.Path)
+			}
+			if info.IsDir() {
+				return fmt.Errorf("cannot create link %q: path is a directory", l.Path)
+			}
+			if err := replaceLink(l.Path, target, hard); err != nil {
+				return err
+			}
+		case os.IsNotExist(err):
+			if err := os.MkdirAll(filepath.Dir(l.Path), defaultDirectoryPermissions); err != nil {
+				return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(l.Path), err)
+			}
+			if err := replaceLink(l.Path, target, hard); err != nil {
+				return err
+			}
+		default:
+			return err
 		}
 
-		// set chown if file information is provided
-		uid, gid, err := getFileOwnership(file)
+		// The ownership of a hard link is the one of its target
+		if hard {
+			continue
+		}
+		uid, gid, err := owners.nodeOwnership(l.Node)
 		if err != nil {
-			return fmt.Errorf("failed to retrieve file ownership for file %q: %w", file.Path, err)
+			return fmt.Errorf("failed to retrieve ownership for link %q: %w", l.Path, err)
 		}
-		if err := createOrigFile(file.Path, file.Path); err != nil {
-			return err
+		if err := os.Lchown(l.Path, uid, gid); err != nil {
+			return fmt.Errorf("failed to set ownership of link %q: %w", l.Path, err)
 		}
-		if err := writeFileAtomically(file.Path, decodedContents, defaultDirectoryPermissions, mode, uid, gid); err != nil {
-			return err
+	}
+	return nil
+}
+
+// isLinkUpToDate returns true if the node at path with the given info already
+// is the wanted link to target.
+func isLinkUpToDate(path string, info os.FileInfo, target string, hard bool) (bool, error) {
+	if !hard {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false, nil
+		}
+		current, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+		return current == target, nil
+	}
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return false, fmt.Errorf("hard link %q: %w", path, err)
+	}
+	return os.SameFile(info, targetInfo), nil
+}
+
+// replaceLink atomically creates or replaces the link at path.
+func replaceLink(path, target string, hard bool) error {
+	if !hard {
+		if err := renameio.Symlink(target, path); err != nil {
+			return fmt.Errorf("failed to symlink %q to %q: %w", path, target, err)
 		}
+		return nil
+	}
+	tmp := path + ".mcdtmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(target, tmp); err != nil {
+		return fmt.Errorf("failed to hard link %q to %q: %w", path, target, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to hard link %q to %q: %w", path, target, err)
 	}
 	return nil
 }
 
+// managedStoragePaths returns the paths of the files, directories and links of
+// an Ignition config.
+func managedStoragePaths(ignConfig ign3types.Config) map[string]struct{} {
+	paths := make(map[string]struct{}, len(ignConfig.Storage.Files)+len(ignConfig.Storage.Directories)+len(ignConfig.Storage.Links))
+	for _, f := range ignConfig.Storage.Files {
+		paths[f.Path] = struct{}{}
+	}
+	for _, d := range ignConfig.Storage.Directories {
+		paths[d.Path] = struct{}{}
+	}
+	for _, l := range ignConfig.Storage.Links {
+		paths[l.Path] = struct{}{}
+	}
+	return paths
+}
+
 // writeUnit writes a systemd unit and its dropins to disk
 func writeUnit(u ign3types.Unit, systemdRoot string, isCoreOSVariant bool) error {
 	if err := writeDropins(u, systemdRoot, isCoreOSVariant); err != nil {
@@ -328,7 +597,14 @@ func writeUnits(units []ign3types.Unit, systemdRoot string, isCoreOSVariant bool
 	return nil
 }
 
+// lookupUID resolves a user name against /etc/passwd as it is at the time of
+// the call, which is the target root's in device agent mode, falling back to
+// NSS for users from e.g. LDAP.
 func lookupUID(username string) (int, error) {
+	if uid, ok := lookupIDInFile(passwdPath, username); ok {
+		klog.V(2).Infof("Retrieved UserId: %d for username: %s", uid, username)
+		return uid, nil
+	}
 	osUser, err := user.Lookup(username)
 	if err != nil {
 		return 0, fmt.Errorf("failed to retrieve UserID for username: %s", username)
@@ -338,7 +614,12 @@ func lookupUID(username string) (int, error) {
 	return uid, nil
 }
 
+// lookupGID resolves a group name like lookupUID, against /etc/group.
 func lookupGID(group string) (int, error) {
+	if gid, ok := lookupIDInFile(groupPath, group); ok {
+		klog.V(2).Infof("Retrieved GroupID: %d for group: %s", gid, group)
+		return gid, nil
+	}
 	osGroup, err := user.LookupGroup(group)
 	if err != nil {
 		return 0, fmt.Errorf("failed to retrieve GroupID for group: %v", group)
@@ -348,24 +629,96 @@ func lookupGID(group string) (int, error) {
 	return gid, nil
 }
 
+// lookupIDInFile returns the ID of name from a passwd or group file.
+func lookupIDInFile(path, name string) (int, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	id, ok := parseIDFile(b)[name]
+	return id, ok
+}
+
+// parseIDFile maps the names of a passwd or group file to their IDs, which
+// both keep in the third field.
+func parseIDFile(b []byte) map[string]int {
+	ids := map[string]int{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[2]); err == nil {
+			if _, ok := ids[fields[0]]; !ok {
+				ids[fields[0]] = id
+			}
+		}
+	}
+	return ids
+}
+
+// ownershipResolver resolves the user and group names of nodes, preferring
+// the /etc/passwd and /etc/group written along with them, so nodes can be
+// owned by users created by the same update.
+type ownershipResolver struct {
+	users, groups map[string]int
+}
+
+// newOwnershipResolver returns a resolver for nodes written along with files.
+func newOwnershipResolver(files []ign3types.File) *ownershipResolver {
+	r := &ownershipResolver{}
+	for _, file := range files {
+		if file.Path != passwdPath && file.Path != groupPath {
+			continue
+		}
+		contents, err := decodeFileContents(file)
+		if err != nil {
+			// Left to writing the file to report
+			continue
+		}
+		if file.Path == passwdPath {
+			r.users = parseIDFile(contents)
+		} else {
+			r.groups = parseIDFile(contents)
+		}
+	}
+	return r
+}
+
 // This is essentially ResolveNodeUidAndGid() from Ignition; XXX should dedupe
 func getFileOwnership(file ign3types.File) (int, int, error) {
+	return getNodeOwnership(file.Node)
+}
+
+func getNodeOwnership(node ign3types.Node) (int, int, error) {
+	return (*ownershipResolver)(nil).nodeOwnership(node)
+}
+
+// nodeOwnership returns the uid and gid node should have. A nil resolver only
+// resolves names against the files on disk.
+func (r *ownershipResolver) nodeOwnership(node ign3types.Node) (int, int, error) {
+	var users, groups map[string]int
+	if r != nil {
+		users, groups = r.users, r.groups
+	}
 	uid, gid := 0, 0 // default to root
 	var err error    // create default error var
-	if file.User.ID != nil {
-		uid = *file.User.ID
-	} else if file.User.Name != nil && *file.User.Name != "" {
-		uid, err = lookupUID(*file.User.Name)
-		if err != nil {
+	if node.User.ID != nil {
+		uid = *node.User.ID
+	} else if node.User.Name != nil && *node.User.Name != "" {
+		if id, ok := users[*node.User.Name]; ok {
+			uid = id
+		} else if uid, err = lookupUID(*node.User.Name); err != nil {
 			return uid, gid, err
 		}
 	}
 
-	if file.Group.ID != nil {
-		gid = *file.Group.ID
-	} else if file.Group.Name != nil && *file.Group.Name != "" {
-		gid, err = lookupGID(*file.Group.Name)
-		if err != nil {
+	if node.Group.ID != nil {
+		gid = *node.Group.ID
+	} else if node.Group.Name != nil && *node.Group.Name != "" {
+		if id, ok := groups[*node.Group.Name]; ok {
+			gid = id
+		} else if gid, err = lookupGID(*node.Group.Name); err != nil {
 			return uid, gid, err
 		}
 	}
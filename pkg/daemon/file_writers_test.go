@@ -0,0 +1,199 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vincent-petithory/dataurl"
+	"golang.org/x/sys/unix"
+)
+
+func TestRunOnceInDeviceAgentModeDirectoriesAndLinks(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	// Owned by the current user so the test doesn't try to chown to root
+	owner := newDeviceAgentTestFile(t, "", "")
+	node := func(path string) ign3types.Node {
+		return ign3types.Node{Path: path, User: owner.User, Group: owner.Group}
+	}
+	dirPath := filepath.Join(testDir, "etc", "agent.d")
+	nestedPath := filepath.Join(dirPath, "nested")
+	filePath := filepath.Join(dirPath, "config")
+	symlinkPath := filepath.Join(testDir, "etc", "agent.conf")
+	hardlinkPath := filepath.Join(testDir, "etc", "agent.hard")
+
+	configFile := newDeviceAgentTestFile(t, filePath, "config")
+	newConfig := func(name string, files []ign3types.File, dirs []ign3types.Directory, links []ign3types.Link) *mcfgv1.MachineConfig {
+		ignCfg := ctrlcommon.NewIgnConfig()
+		ignCfg.Storage.Files = files
+		ignCfg.Storage.Directories = dirs
+		ignCfg.Storage.Links = links
+		mc := helpers.CreateMachineConfigFromIgnition(ignCfg)
+		mc.Name = name
+		return mc
+	}
+	dir := func(path string, mode int) ign3types.Directory {
+		return ign3types.Directory{Node: node(path), DirectoryEmbedded1: ign3types.DirectoryEmbedded1{Mode: &mode}}
+	}
+	link := func(path, target string, hard bool) ign3types.Link {
+		return ign3types.Link{Node: node(path), LinkEmbedded1: ign3types.LinkEmbedded1{Target: &target, Hard: &hard}}
+	}
+
+	oldConfig := newConfig("old", []ign3types.File{configFile},
+		[]ign3types.Directory{dir(dirPath, 0o750), dir(nestedPath, 0o1777)},
+		[]ign3types.Link{link(symlinkPath, filePath, false), link(hardlinkPath, filePath, true)})
+	result, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, oldConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{dirPath, nestedPath, filePath, symlinkPath, hardlinkPath}, result.FilesWritten)
+
+	info, err := os.Stat(dirPath)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o750), info.Mode().Perm())
+	info, err = os.Stat(nestedPath)
+	require.Nil(t, err)
+	assert.Equal(t, os.ModeSticky, info.Mode()&os.ModeSticky)
+	target, err := os.Readlink(symlinkPath)
+	require.Nil(t, err)
+	assert.Equal(t, filePath, target)
+	contents, err := os.ReadFile(hardlinkPath)
+	require.Nil(t, err)
+	assert.Equal(t, "config", string(contents))
+
+	// Links and directories are updated in place
+	otherPath := filepath.Join(testDir, "etc", "other")
+	require.Nil(t, os.WriteFile(otherPath, []byte("other"), 0o644))
+	updatedConfig := newConfig("updated", []ign3types.File{configFile},
+		[]ign3types.Directory{dir(dirPath, 0o755), dir(nestedPath, 0o1777)},
+		[]ign3types.Link{link(symlinkPath, otherPath, false), link(hardlinkPath, filePath, true)})
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, updatedConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{dirPath, symlinkPath}, result.FilesWritten)
+	info, err = os.Stat(dirPath)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	target, err = os.Readlink(symlinkPath)
+	require.Nil(t, err)
+	assert.Equal(t, otherPath, target)
+
+	// Stale links and empty stale directories are pruned, directories that
+	// aren't empty are kept
+	require.Nil(t, os.WriteFile(filepath.Join(dirPath, "unmanaged"), nil, 0o644))
+	prunedConfig := newConfig("pruned", []ign3types.File{newDeviceAgentTestFile(t, otherPath, "other")}, nil, nil)
+	result, err = d.RunOnceInDeviceAgentMode(context.TODO(), updatedConfig, prunedConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{dirPath, nestedPath, filePath, symlinkPath, hardlinkPath}, result.FilesRemoved)
+	assert.NoFileExists(t, symlinkPath)
+	assert.NoFileExists(t, hardlinkPath)
+	assert.NoDirExists(t, nestedPath)
+	assert.DirExists(t, dirPath)
+	assert.FileExists(t, otherPath)
+
+	// Unmanaged paths aren't replaced unless asked to
+	unmanagedPath := filepath.Join(testDir, "etc", "unmanaged")
+	require.Nil(t, os.WriteFile(unmanagedPath, []byte("unmanaged"), 0o644))
+	clobberedConfig := newConfig("clobbered", nil, nil, []ign3types.Link{link(unmanagedPath, otherPath, false)})
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), prunedConfig, clobberedConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.NotNil(t, err)
+	contents, err = os.ReadFile(unmanagedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "unmanaged", string(contents))
+}
+
+func TestRunOnceInDeviceAgentModeSparseFiles(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	d := newMockDeviceAgentDaemon(testDir)
+
+	// An image with data at the start and in the middle, and holes around it
+	contents := make([]byte, 8<<20)
+	copy(contents, "header")
+	copy(contents[4<<20:], "middle")
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err := gzipWriter.Write(contents)
+	require.Nil(t, err)
+	require.Nil(t, gzipWriter.Close())
+
+	path := filepath.Join(testDir, "etc", "disk.img")
+	file := newDeviceAgentTestFile(t, path, "")
+	source := dataurl.EncodeBytes(gzipped.Bytes())
+	file.Contents.Source = &source
+	file.Contents.Compression = helpers.StrToPtr("gzip")
+	sum := sha256.Sum256(contents)
+	file.Contents.Verification.Hash = helpers.StrToPtr("sha256-" + hex.EncodeToString(sum[:]))
+
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newDeviceAgentTestConfig(t, "new", []ign3types.File{file}, nil), deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	written, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(contents, written))
+
+	var stat unix.Stat_t
+	require.Nil(t, unix.Stat(path, &stat))
+	assert.Equal(t, int64(len(contents)), stat.Size)
+	assert.Less(t, stat.Blocks*512, stat.Size, "zeros should be left as holes")
+}
+
+func TestOwnershipResolution(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+	oldPasswdPath, oldGroupPath := passwdPath, groupPath
+	defer func() {
+		passwdPath, groupPath = oldPasswdPath, oldGroupPath
+	}()
+	passwdPath = filepath.Join(testDir, "etc", "passwd")
+	groupPath = filepath.Join(testDir, "etc", "group")
+	require.Nil(t, os.WriteFile(passwdPath, []byte("root:x:0:0:root:/root:/bin/bash\nfleet:x:4001:4001::/var/lib/fleet:/sbin/nologin\n"), 0o644))
+	require.Nil(t, os.WriteFile(groupPath, []byte("root:x:0:\nfleet:x:4001:\n"), 0o644))
+
+	// Names resolve against the files on disk, read at the time of the lookup
+	node := ign3types.Node{User: ign3types.NodeUser{Name: helpers.StrToPtr("fleet")}, Group: ign3types.NodeGroup{Name: helpers.StrToPtr("fleet")}}
+	uid, gid, err := getNodeOwnership(node)
+	require.Nil(t, err)
+	assert.Equal(t, []int{4001, 4001}, []int{uid, gid})
+
+	// Users created by the same update take precedence
+	owners := newOwnershipResolver([]ign3types.File{
+		ctrlcommon.NewIgnFile(passwdPath, "root:x:0:0:root:/root:/bin/bash\nagent:x:4002:4002::/var/lib/agent:/sbin/nologin\n"),
+		ctrlcommon.NewIgnFile(groupPath, "root:x:0:\nagent:x:4003:\n"),
+	})
+	agent := ign3types.Node{User: ign3types.NodeUser{Name: helpers.StrToPtr("agent")}, Group: ign3types.NodeGroup{Name: helpers.StrToPtr("agent")}}
+	uid, gid, err = owners.nodeOwnership(agent)
+	require.Nil(t, err)
+	assert.Equal(t, []int{4002, 4003}, []int{uid, gid})
+	_, _, err = getNodeOwnership(agent)
+	assert.NotNil(t, err)
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	path := filepath.Join(testDir, "etc", "agent.conf")
+	file := ctrlcommon.NewIgnFile(path, "agent")
+	file.Node = ign3types.Node{Path: path, User: agent.User, Group: agent.Group}
+	d := newMockDeviceAgentDaemon(testDir)
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		ctrlcommon.NewIgnFile(passwdPath, "root:x:0:0:root:/root:/bin/bash\nagent:x:4002:4002::/var/lib/agent:/sbin/nologin\n"),
+		ctrlcommon.NewIgnFile(groupPath, "root:x:0:\nagent:x:4003:\n"),
+		file,
+	}, nil)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	var stat unix.Stat_t
+	require.Nil(t, unix.Stat(path, &stat))
+	assert.Equal(t, []uint32{4002, 4003}, []uint32{stat.Uid, stat.Gid})
+}
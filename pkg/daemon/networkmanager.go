@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// nmSystemConnectionsDir holds the NetworkManager keyfiles that can be applied
+// live by reloading NetworkManager.
+const nmSystemConnectionsDir = "/etc/NetworkManager/system-connections"
+
+// isNetworkManagerKeyfile returns true if path is a NetworkManager keyfile.
+func isNetworkManagerKeyfile(path string) bool {
+	return strings.HasPrefix(path, nmSystemConnectionsDir+"/")
+}
+
+// reloadNetworkManager makes NetworkManager reload its keyfiles and
+// reactivates the active connections whose keyfiles are among changedFiles,
+// leaving all other connections alone.
+func reloadNetworkManager(changedFiles []string) error {
+	if err := runCmdSync("nmcli", "connection", "reload"); err != nil {
+		return err
+	}
+
+	changed := make(map[string]struct{}, len(changedFiles))
+	for _, path := range changedFiles {
+		changed[path] = struct{}{}
+	}
+	out, err := runGetOut("nmcli", "--get-values", "UUID,FILENAME", "connection", "show", "--active")
+	if err != nil {
+		return fmt.Errorf("listing active connections: %w", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// UUIDs have no colons to escape, filenames might
+		uuid, filename, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		filename = strings.ReplaceAll(filename, `\:`, ":")
+		if _, ok := changed[filename]; !ok {
+			continue
+		}
+		klog.Infof("Reactivating connection %s from changed keyfile %q", uuid, filename)
+		if err := runCmdSync("nmcli", "connection", "up", uuid); err != nil {
+			return fmt.Errorf("reactivating connection from %q: %w", filename, err)
+		}
+	}
+	return nil
+}
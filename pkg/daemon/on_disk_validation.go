@@ -1,7 +1,6 @@
 package daemon
 
 import (
-	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -171,24 +170,58 @@ func checkV3Files(files []ign3types.File) error {
 			klog.V(4).Infof("Skipping file %s during checkV3Files", caBundleFilePath)
 			continue
 		}
-		if len(f.Append) > 0 {
-			return fmt.Errorf("found an append section when checking files. Append is not supported")
-		}
-		mode := defaultFilePermissions
-		if f.Mode != nil {
-			mode = os.FileMode(*f.Mode)
-		}
-		contents, err := ctrlcommon.DecodeIgnitionFileContents(f.Contents.Source, f.Contents.Compression)
-		if err != nil {
-			return fmt.Errorf("couldn't decode file %q: %w", f.Path, err)
+		if usrHotfixDiscarded(f.Path) {
+			klog.V(4).Infof("Skipping hotfix %s during checkV3Files, the overlay on %s it was written to is gone", f.Path, usrPath)
+			continue
 		}
-		if err := checkFileContentsAndMode(f.Path, contents, mode); err != nil {
+		if err := checkV3File(f); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// checkV3File validates the contents and mode of a single file in the target
+// config.
+func checkV3File(f ign3types.File) error {
+	if len(f.Append) > 0 {
+		return fmt.Errorf("found an append section when checking files. Append is not supported")
+	}
+	mode := defaultFilePermissions
+	if f.Mode != nil {
+		mode = os.FileMode(*f.Mode)
+	}
+	if isRemoteSource(f.Contents.Source) {
+		return checkRemoteFileContentsAndMode(f, mode)
+	}
+	contents, err := decodeFileContents(f)
+	if err != nil {
+		return fmt.Errorf("couldn't decode file %q: %w", f.Path, err)
+	}
+	return checkFileContentsAndMode(f.Path, contents, mode)
+}
+
+// checkRemoteFileContentsAndMode compares the mode of the file with remote
+// contents f on disk with mode, and its contents with the verification hash
+// of f, if it has one.
+func checkRemoteFileContentsAndMode(f ign3types.File, mode os.FileMode) error {
+	fi, err := os.Lstat(f.Path)
+	if err != nil {
+		return fmt.Errorf("could not stat file %q: %w", f.Path, err)
+	}
+	if fi.Mode() != mode {
+		return fmt.Errorf("mode mismatch for file: %q; expected: %[2]v/%[2]d/%#[2]o; received: %[3]v/%[3]d/%#[3]o", f.Path, mode, fi.Mode())
+	}
+	matches, known, err := fileMatchesContents(f)
+	if err != nil {
+		return err
+	}
+	if known && !matches {
+		return fmt.Errorf("content mismatch for file %q: does not match verification hash %s", f.Path, *f.Contents.Verification.Hash)
+	}
+	return nil
+}
+
 // checkV2Files validates the contents of all the files in the target config.
 func checkV2Files(files []ign2types.File) error {
 	checkedFiles := make(map[string]bool)
@@ -201,15 +234,19 @@ func checkV2Files(files []ign2types.File) error {
 		if f.Append {
 			return fmt.Errorf("found an append section when checking files. Append is not supported")
 		}
-		mode := defaultFilePermissions
-		if f.Mode != nil {
-			mode = os.FileMode(*f.Mode)
-		}
-		contents, err := ctrlcommon.DecodeIgnitionFileContents(&f.Contents.Source, &f.Contents.Compression)
-		if err != nil {
-			return fmt.Errorf("couldn't decode file %q: %w", f.Path, err)
+		// Checked as the Ignition 3 file it translates to
+		v3File := ign3types.File{
+			Node: ign3types.Node{Path: f.Path},
+			FileEmbedded1: ign3types.FileEmbedded1{
+				Contents: ign3types.Resource{
+					Source:       &f.Contents.Source,
+					Compression:  &f.Contents.Compression,
+					Verification: ign3types.Verification{Hash: f.Contents.Verification.Hash},
+				},
+				Mode: f.Mode,
+			},
 		}
-		if err := checkFileContentsAndMode(f.Path, contents, mode); err != nil {
+		if err := checkV3File(v3File); err != nil {
 			return err
 		}
 		checkedFiles[f.Path] = true
@@ -218,7 +255,8 @@ func checkV2Files(files []ign2types.File) error {
 }
 
 // checkFileContentsAndMode reads the file from the filepath and compares its
-// contents and mode with the expectedContent and mode parameters. It logs an
+// contents and mode with the expectedContent and mode parameters. Contents are
+// compared normalized, see ctrlcommon.RegisterContentNormalizer. It logs an
 // error in case of an error or mismatch and returns the status of the
 // evaluation.
 func checkFileContentsAndMode(filePath string, expectedContent []byte, mode os.FileMode) error {
@@ -233,7 +271,7 @@ func checkFileContentsAndMode(filePath string, expectedContent []byte, mode os.F
 	if err != nil {
 		return fmt.Errorf("could not read file %q: %w", filePath, err)
 	}
-	if !bytes.Equal(contents, expectedContent) {
+	if !ctrlcommon.FileContentsEquivalent(filePath, expectedContent, contents) {
 		klog.Errorf("content mismatch for file %q (-want +got):\n%s", filePath, cmp.Diff(expectedContent, contents))
 		return fmt.Errorf("content mismatch for file %q", filePath)
 	}
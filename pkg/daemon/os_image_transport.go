@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// osImageTransportRegistry is the transport of OS images pulled from a
+// registry, which osImageURLs without a transport use.
+const osImageTransportRegistry = "registry"
+
+// localOSImageTransports are the transports of OS images that are imported
+// from the host rather than pulled, e.g. on air-gapped devices updated from a
+// USB drive or a preloaded image. Their osImageURLs start with the transport,
+// like oci:/run/media/update/os or containers-storage:quay.io/example/os:2.
+var localOSImageTransports = []string{"oci", "oci-archive", "containers-storage"}
+
+// splitOSImageTransport returns the transport of imgURL and the image
+// reference of that transport.
+func splitOSImageTransport(imgURL string) (string, string) {
+	for _, transport := range localOSImageTransports {
+		if image, ok := strings.CutPrefix(imgURL, transport+":"); ok {
+			return transport, image
+		}
+	}
+	return osImageTransportRegistry, strings.TrimPrefix(imgURL, "docker://")
+}
+
+// isLocalOSImage returns true if imgURL is imported from the host.
+func isLocalOSImage(imgURL string) bool {
+	transport, _ := splitOSImageTransport(imgURL)
+	return transport != osImageTransportRegistry
+}
+
+// joinOSImageTransport is the inverse of splitOSImageTransport.
+func joinOSImageTransport(transport, image string) string {
+	if transport == "" || transport == osImageTransportRegistry {
+		return image
+	}
+	return transport + ":" + image
+}
+
+// checkLocalOSImage returns an error if imgURL is an OCI layout or archive
+// that doesn't exist, e.g. because the drive it is on isn't mounted.
+func checkLocalOSImage(imgURL string) error {
+	transport, image := splitOSImageTransport(imgURL)
+	if transport != "oci" && transport != "oci-archive" {
+		return nil
+	}
+	// The path may be followed by a reference, as in oci:/path:tag
+	paths := []string{image}
+	if i := strings.LastIndex(image, ":"); i > 0 {
+		paths = append(paths, image[:i])
+	}
+	var err error
+	for _, path := range paths {
+		if transport == "oci" {
+			path = filepath.Join(path, "index.json")
+		}
+		if _, err = os.Stat(path); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("OS image %s not found: %w", imgURL, err)
+}
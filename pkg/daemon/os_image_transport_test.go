@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalOSImages(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	tests := []struct {
+		url       string
+		transport string
+		image     string
+	}{
+		{url: "quay.io/example/os:2", transport: "registry", image: "quay.io/example/os:2"},
+		{url: "docker://quay.io/example/os:2", transport: "registry", image: "quay.io/example/os:2"},
+		{url: "oci:/run/media/update/os:2", transport: "oci", image: "/run/media/update/os:2"},
+		{url: "oci-archive:/var/tmp/os.tar", transport: "oci-archive", image: "/var/tmp/os.tar"},
+		{url: "containers-storage:quay.io/example/os:2", transport: "containers-storage", image: "quay.io/example/os:2"},
+	}
+	for _, test := range tests {
+		transport, image := splitOSImageTransport(test.url)
+		assert.Equal(t, test.transport, transport, test.url)
+		assert.Equal(t, test.image, image, test.url)
+		assert.Equal(t, strings.TrimPrefix(test.url, "docker://"), joinOSImageTransport(transport, image))
+	}
+
+	// OCI layouts must exist, with or without a reference
+	layout := filepath.Join(testDir, "os")
+	require.Nil(t, os.MkdirAll(layout, 0o755))
+	assert.Error(t, checkLocalOSImage("oci:"+layout))
+	require.Nil(t, os.WriteFile(filepath.Join(layout, "index.json"), []byte("{}"), 0o644))
+	assert.Nil(t, checkLocalOSImage("oci:"+layout))
+	assert.Nil(t, checkLocalOSImage("oci:"+layout+":2"))
+	assert.Error(t, checkLocalOSImage("oci-archive:"+filepath.Join(testDir, "os.tar")))
+	assert.Nil(t, checkLocalOSImage("containers-storage:quay.io/example/os:2"))
+
+	var runs [][]string
+	b := &BootcClient{run: func(_ context.Context, args ...string) error {
+		runs = append(runs, args)
+		return nil
+	}}
+	require.Nil(t, b.Switch(context.Background(), "oci:"+layout))
+	assert.Equal(t, [][]string{{"switch", "--transport", "oci", layout}}, runs)
+
+	// Local images have no signatures to verify
+	var sigErr *ErrImageSignature
+	require.ErrorAs(t, verifyImageSignature(context.TODO(), "oci:"+layout, "oci:"+layout, ImageSignaturePolicy{PolicyPath: "/nonexistent"}), &sigErr)
+}
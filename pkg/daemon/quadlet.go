@@ -0,0 +1,145 @@
+package daemon
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"k8s.io/klog/v2"
+)
+
+// quadletDir is where podman's systemd generator, quadlet, looks for the
+// container, volume, network, kube and pod files of rootful workloads, also
+// in subdirectories. The ones of rootless workloads under users/ are left to
+// the users' service managers.
+var quadletDir = filepath.Join("/etc", "containers", "systemd")
+
+// quadletServiceSuffixes are the suffixes quadlet gives the services it
+// generates for each type of file, e.g. db.volume becomes db-volume.service.
+var quadletServiceSuffixes = map[string]string{
+	".container": "",
+	".volume":    "-volume",
+	".network":   "-network",
+	".kube":      "",
+	".pod":       "-pod",
+}
+
+// isQuadletFile returns true if path is a quadlet file of a rootful workload.
+func isQuadletFile(path string) bool {
+	rel, err := filepath.Rel(quadletDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") || strings.HasPrefix(rel, "users/") {
+		return false
+	}
+	_, ok := quadletServiceSuffixes[filepath.Ext(path)]
+	return ok
+}
+
+// quadletService returns the service quadlet generates for the file at path
+// with contents: the one of its ServiceName= option if it has one. Files whose
+// contents are unknown, i.e. nil, get the default name.
+func quadletService(path string, contents io.Reader) string {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	if contents != nil {
+		opts, err := unit.DeserializeOptions(contents)
+		if err != nil {
+			klog.Warningf("Failed to parse quadlet file %s: %v", path, err)
+		}
+		section := strings.ToUpper(ext[1:2]) + ext[2:]
+		for _, opt := range opts {
+			if opt.Section == section && opt.Name == "ServiceName" && opt.Value != "" {
+				name = strings.TrimSuffix(opt.Value, ".service")
+				return name + ".service"
+			}
+		}
+	}
+	return name + quadletServiceSuffixes[ext] + ".service"
+}
+
+// removedQuadletService returns the service of the quadlet file at path that
+// was removed from disk, from its contents in oldIgnConfig.
+func removedQuadletService(path string, oldIgnConfig ign3types.Config) string {
+	for _, f := range oldIgnConfig.Storage.Files {
+		if f.Path != path {
+			continue
+		}
+		contents, err := decodeFileContents(f)
+		if err != nil {
+			klog.Warningf("Failed to decode removed quadlet file %s: %v", path, err)
+			break
+		}
+		return quadletService(path, bytes.NewReader(contents))
+	}
+	return quadletService(path, nil)
+}
+
+// restartQuadlets applies the changed quadlet files of diffFileSet: the
+// services of removed files, named as their contents in oldIgnConfig have
+// them, are stopped, quadlet regenerates the services by reloading systemd,
+// and the services of added and changed files are restarted, which starts the
+// workloads of added files. The volumes and networks are restarted first, as
+// containers use them. It returns the services that were restarted or stopped.
+func restartQuadlets(diffFileSet []string, oldIgnConfig ign3types.Config) ([]string, error) {
+	var paths []string
+	for _, path := range diffFileSet {
+		if isQuadletFile(path) {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	sort.Strings(paths)
+	sort.SliceStable(paths, func(i, j int) bool { return quadletFileOrder(paths[i]) < quadletFileOrder(paths[j]) })
+	var stop, restart []string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			stop = append(stop, removedQuadletService(path, oldIgnConfig))
+			continue
+		}
+		if err != nil {
+			restart = append(restart, quadletService(path, nil))
+			continue
+		}
+		restart = append(restart, quadletService(path, f))
+		f.Close()
+	}
+
+	if len(stop) > 0 {
+		// Before systemd forgets about the services of the removed files
+		if err := runCmdSync("systemctl", append([]string{"stop"}, stop...)...); err != nil {
+			return nil, err
+		}
+		logSystem("Stopped quadlet services %s of removed files", strings.Join(stop, ", "))
+	}
+	if err := runCmdSync("systemctl", "daemon-reload"); err != nil {
+		return stop, err
+	}
+	var done []string
+	for _, service := range restart {
+		if err := runCmdSync("systemctl", "restart", service); err != nil {
+			return append(stop, done...), err
+		}
+		done = append(done, service)
+	}
+	if len(done) > 0 {
+		logSystem("Restarted quadlet services %s", strings.Join(done, ", "))
+	}
+	return append(stop, done...), nil
+}
+
+// quadletFileOrder sorts the files of volumes and networks before the ones
+// of the pods and containers using them.
+func quadletFileOrder(path string) int {
+	switch filepath.Ext(path) {
+	case ".volume", ".network":
+		return 0
+	}
+	return 1
+}
@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -62,7 +63,13 @@ func NewNodeUpdaterClient() RpmOstreeClient {
 // and gathering stderr into a buffer which will be returned in err
 // in case of error.
 func runRpmOstree(args ...string) error {
-	return runCmdSync("rpm-ostree", args...)
+	return runRpmOstreeContext(context.Background(), args...)
+}
+
+// runRpmOstreeContext is like runRpmOstree, but kills rpm-ostree if ctx is
+// done before it exits.
+func runRpmOstreeContext(ctx context.Context, args ...string) error {
+	return runCmdSyncContext(ctx, "rpm-ostree", args...)
 }
 
 // See https://bugzilla.redhat.com/show_bug.cgi?id=2111817
@@ -156,7 +163,7 @@ func (r *RpmOstreeClient) GetBootedOSImageURL() (string, string, string, error)
 		if err != nil {
 			return "", "", "", err
 		}
-		osImageURL = ostreeImageReference.Imgref.Image
+		osImageURL = joinOSImageTransport(ostreeImageReference.Imgref.Transport, ostreeImageReference.Imgref.Image)
 	}
 
 	baseChecksum := bootedDeployment.GetBaseChecksum()
@@ -238,10 +245,19 @@ func (r *RpmOstreeClient) IsNewEnoughForLayering() (bool, error) {
 
 // RebaseLayered rebases system or errors if already rebased
 func (r *RpmOstreeClient) RebaseLayered(imgURL string) (err error) {
+	return r.RebaseLayeredContext(context.Background(), imgURL)
+}
+
+// RebaseLayeredContext is like RebaseLayered, but aborts the rebase if ctx is
+// done before it completes, e.g. because of a hung image pull.
+func (r *RpmOstreeClient) RebaseLayeredContext(ctx context.Context, imgURL string) (err error) {
 	// Try to re-link the merged pull secrets if they exist, since it could have been populated without a daemon reboot
 	useMergedPullSecrets()
 	klog.Infof("Executing rebase to %s", imgURL)
-	return runRpmOstree("rebase", "--experimental", "ostree-unverified-registry:"+imgURL)
+	if isLocalOSImage(imgURL) {
+		return runRpmOstreeContext(ctx, "rebase", "--experimental", "ostree-unverified-image:"+imgURL)
+	}
+	return runRpmOstreeContext(ctx, "rebase", "--experimental", "ostree-unverified-registry:"+imgURL)
 }
 
 // linkOstreeAuthFile gives the rpm-ostree client access to secrets in the file located at `path` by symlinking so that
@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+// serviceEnvDirs hold environment files of kubelet and crio, one variable
+// assignment per line. The daemon passes the *.env files in them to the
+// service with a drop-in it regenerates when they change.
+var serviceEnvDirs = map[string]string{
+	"kubelet.service": filepath.Join("/etc", "kubernetes", "kubelet.env.d"),
+	"crio.service":    filepath.Join("/etc", "crio", "crio.env.d"),
+}
+
+// serviceEnvFiles are the environment files the units of kubelet and crio
+// read already.
+var serviceEnvFiles = map[string]string{
+	"/etc/kubernetes/kubelet-env":        "kubelet.service",
+	"/etc/kubernetes/kubelet-workaround": "kubelet.service",
+	"/etc/node-sizing.env":               "kubelet.service",
+	"/etc/sysconfig/crio":                "crio.service",
+}
+
+// serviceEnvActions are the post config change actions restarting each
+// service for changes to its environment.
+var serviceEnvActions = map[string]string{
+	"kubelet.service": postConfigChangeActionRestartKubelet,
+	"crio.service":    postConfigChangeActionRestartCrio,
+}
+
+// serviceEnvDropinName is the name of the drop-in passing the files of the
+// environment directory of a service to it.
+const serviceEnvDropinName = "20-mcd-environment.conf"
+
+// envFileService returns the service whose environment path is part of.
+func envFileService(path string) (string, bool) {
+	if service, ok := serviceEnvFiles[path]; ok {
+		return service, true
+	}
+	for service, dir := range serviceEnvDirs {
+		if filepath.Dir(path) == dir && strings.HasSuffix(path, ".env") {
+			return service, true
+		}
+	}
+	return "", false
+}
+
+// serviceEnvDropinPath returns the path of the environment drop-in of service.
+func serviceEnvDropinPath(service string) string {
+	return filepath.Join(pathSystemd, service+".d", serviceEnvDropinName)
+}
+
+// serviceEnvDropinPaths returns the paths of the environment drop-ins of the
+// services actions restart.
+func serviceEnvDropinPaths(actions []string) []string {
+	var paths []string
+	for service, action := range serviceEnvActions {
+		if ctrlcommon.InSlice(action, actions) {
+			paths = append(paths, serviceEnvDropinPath(service))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// writeServiceEnvDropin writes the drop-in passing the environment files
+// found in the environment directory of service to it, or removes it if there
+// are none. It returns true if the drop-in changed.
+func writeServiceEnvDropin(service string) (bool, error) {
+	entries, err := os.ReadDir(serviceEnvDirs[service])
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	var envFiles []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".env") {
+			envFiles = append(envFiles, filepath.Join(serviceEnvDirs[service], entry.Name()))
+		}
+	}
+	path := serviceEnvDropinPath(service)
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(envFiles) == 0 {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err := os.Remove(path); err != nil {
+			return false, fmt.Errorf("removing environment drop-in of %s: %w", service, err)
+		}
+		return true, nil
+	}
+	contents := serviceEnvDropinContents(envFiles)
+	if string(current) == contents {
+		return false, nil
+	}
+	if err := writeFileAtomicallyWithDefaults(path, []byte(contents)); err != nil {
+		return false, fmt.Errorf("writing environment drop-in of %s: %w", service, err)
+	}
+	return true, nil
+}
+
+// serviceEnvDropinContents returns a drop-in reading envFiles, in order.
+func serviceEnvDropinContents(envFiles []string) string {
+	var b strings.Builder
+	b.WriteString("# Written by machine-config-daemon for the environment files of the config\n[Service]\n")
+	for _, path := range envFiles {
+		fmt.Fprintf(&b, "EnvironmentFile=-%s\n", path)
+	}
+	return b.String()
+}
+
+// restartServicesForEnvChanges regenerates the environment drop-ins of the
+// services actions restart, and restarts them. Reloading wouldn't do: a
+// changed environment only reaches the processes started after it. It
+// returns the services that were restarted.
+func restartServicesForEnvChanges(actions []string) ([]string, error) {
+	var services []string
+	for service, action := range serviceEnvActions {
+		if ctrlcommon.InSlice(action, actions) {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+	reload := false
+	for _, service := range services {
+		changed, err := writeServiceEnvDropin(service)
+		if err != nil {
+			return nil, err
+		}
+		reload = reload || changed
+	}
+	if reload {
+		if err := runCmdSync("systemctl", "daemon-reload"); err != nil {
+			return nil, err
+		}
+	}
+	var restarted []string
+	for _, service := range services {
+		if err := runCmdSync("systemctl", "restart", service); err != nil {
+			return restarted, fmt.Errorf("restarting %s for environment changes: %w", service, err)
+		}
+		logSystem("Restarted %s for changes to its environment", service)
+		restarted = append(restarted, service)
+	}
+	return restarted, nil
+}
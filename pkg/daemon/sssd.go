@@ -0,0 +1,35 @@
+package daemon
+
+import (
+	"strings"
+)
+
+const (
+	// sssdConfigDir holds the SSSD configuration, which is applied live by
+	// restarting sssd.
+	sssdConfigDir = "/etc/sssd"
+	// authselectConfigDir holds the authselect configuration and custom
+	// profiles, which are applied live by running authselect again.
+	authselectConfigDir = "/etc/authselect"
+)
+
+// isSSSDConfigFile returns true if path is part of the SSSD or authselect
+// configuration.
+func isSSSDConfigFile(path string) bool {
+	return strings.HasPrefix(path, sssdConfigDir+"/") || strings.HasPrefix(path, authselectConfigDir+"/")
+}
+
+// restartSSSD applies the authselect configuration again if any of
+// changedFiles is part of it, which regenerates the PAM and nsswitch files of
+// the selected profile, and restarts sssd.
+func restartSSSD(changedFiles []string) error {
+	for _, path := range changedFiles {
+		if strings.HasPrefix(path, authselectConfigDir+"/") {
+			if err := runCmdSync("authselect", "apply-changes"); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return runCmdSync("systemctl", "restart", "sssd")
+}
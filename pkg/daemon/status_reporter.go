@@ -0,0 +1,186 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+)
+
+const (
+	// maxDeviceStatusEvents is the number of most recent events kept in the status file
+	maxDeviceStatusEvents = 20
+)
+
+// StatusReporter is the clusterless counterpart of NodeWriter. It lets a
+// Daemon running in device agent mode report its state without a Kubernetes
+// node object to annotate.
+type StatusReporter interface {
+	SetWorking(desiredConfig string) error
+	SetDone(currentConfig string) error
+	SetUnreconcilable(err error) error
+	SetDegraded(err error) error
+	Eventf(eventtype, reason, messageFmt string, args ...interface{})
+}
+
+// StagedUpdateReporter is implemented by StatusReporters that also report
+// OS updates staged until they are finalized. SetStaged is called with the
+// name of the staged config, and with "" once it has been released.
+type StagedUpdateReporter interface {
+	SetStaged(stagedConfig string) error
+}
+
+// SetStatusReporter sets the StatusReporter used by updates in device agent mode.
+func (dn *Daemon) SetStatusReporter(reporter StatusReporter) {
+	dn.statusReporter = reporter
+}
+
+// getStatusReporter returns the configured StatusReporter, defaulting to one
+// that discards everything.
+func (dn *Daemon) getStatusReporter() StatusReporter {
+	if dn.statusReporter == nil {
+		return noopStatusReporter{}
+	}
+	return dn.statusReporter
+}
+
+// noopStatusReporter discards all status updates.
+type noopStatusReporter struct{}
+
+// NewNoopStatusReporter returns a StatusReporter that discards all status updates.
+func NewNoopStatusReporter() StatusReporter {
+	return noopStatusReporter{}
+}
+
+func (noopStatusReporter) SetWorking(string) error                       { return nil }
+func (noopStatusReporter) SetDone(string) error                          { return nil }
+func (noopStatusReporter) SetUnreconcilable(error) error                 { return nil }
+func (noopStatusReporter) SetDegraded(error) error                       { return nil }
+func (noopStatusReporter) Eventf(string, string, string, ...interface{}) {}
+
+// DeviceStatus is the state persisted by the file-backed StatusReporter.
+type DeviceStatus struct {
+	// State is one of the MachineConfigDaemonState* constants.
+	State string `json:"state"`
+	// CurrentConfig is the name of the last successfully applied config.
+	CurrentConfig string `json:"currentConfig,omitempty"`
+	// DesiredConfig is the name of the config being (or last attempted to be) applied.
+	DesiredConfig string `json:"desiredConfig,omitempty"`
+	// StagedConfig is the name of the config whose OS update is staged
+	// until it is finalized.
+	StagedConfig string `json:"stagedConfig,omitempty"`
+	// Reason holds the error message for the Degraded and Unreconcilable states.
+	Reason string `json:"reason,omitempty"`
+	// LastTransitionTime is the time State was last updated.
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+	// Events are the most recent events, oldest first.
+	Events []DeviceStatusEvent `json:"events,omitempty"`
+}
+
+// DeviceStatusEvent is an event recorded by the file-backed StatusReporter.
+type DeviceStatusEvent struct {
+	Type      string    `json:"type"`
+	Reason    string    `json:"reason"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// fileStatusReporter persists the status as JSON to a file, so local tooling
+// or a device agent can pick it up.
+type fileStatusReporter struct {
+	path   string
+	lock   sync.Mutex
+	status DeviceStatus
+}
+
+// NewFileStatusReporter returns a StatusReporter that writes the daemon's
+// status as JSON to path, replacing it atomically on every change.
+// Any status previously written to path is loaded so the current config
+// survives restarts.
+func NewFileStatusReporter(path string) StatusReporter {
+	fr := &fileStatusReporter{path: path}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &fr.status); err != nil {
+			klog.Warningf("Ignoring unparseable device status in %s: %v", path, err)
+			fr.status = DeviceStatus{}
+		}
+	}
+	return fr
+}
+
+func (fr *fileStatusReporter) setState(state string, mutate func(*DeviceStatus)) error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.status.State = state
+	fr.status.Reason = ""
+	fr.status.LastTransitionTime = time.Now().UTC()
+	mutate(&fr.status)
+	return fr.write()
+}
+
+// write must be called with the lock held
+func (fr *fileStatusReporter) write() error {
+	b, err := json.Marshal(fr.status)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device status: %w", err)
+	}
+	if err := writeFileAtomicallyWithDefaults(fr.path, b); err != nil {
+		return fmt.Errorf("failed to write device status to %s: %w", fr.path, err)
+	}
+	return nil
+}
+
+func (fr *fileStatusReporter) SetWorking(desiredConfig string) error {
+	return fr.setState(constants.MachineConfigDaemonStateWorking, func(s *DeviceStatus) {
+		s.DesiredConfig = desiredConfig
+	})
+}
+
+func (fr *fileStatusReporter) SetDone(currentConfig string) error {
+	return fr.setState(constants.MachineConfigDaemonStateDone, func(s *DeviceStatus) {
+		s.CurrentConfig = currentConfig
+		s.DesiredConfig = currentConfig
+	})
+}
+
+// SetStaged implements StagedUpdateReporter.
+func (fr *fileStatusReporter) SetStaged(stagedConfig string) error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.status.StagedConfig = stagedConfig
+	return fr.write()
+}
+
+func (fr *fileStatusReporter) SetUnreconcilable(err error) error {
+	return fr.setState(constants.MachineConfigDaemonStateUnreconcilable, func(s *DeviceStatus) {
+		s.Reason = err.Error()
+	})
+}
+
+func (fr *fileStatusReporter) SetDegraded(err error) error {
+	return fr.setState(constants.MachineConfigDaemonStateDegraded, func(s *DeviceStatus) {
+		s.Reason = err.Error()
+	})
+}
+
+func (fr *fileStatusReporter) Eventf(eventtype, reason, messageFmt string, args ...interface{}) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.status.Events = append(fr.status.Events, DeviceStatusEvent{
+		Type:      eventtype,
+		Reason:    reason,
+		Message:   fmt.Sprintf(messageFmt, args...),
+		Timestamp: time.Now().UTC(),
+	})
+	if len(fr.status.Events) > maxDeviceStatusEvents {
+		fr.status.Events = fr.status.Events[len(fr.status.Events)-maxDeviceStatusEvents:]
+	}
+	if err := fr.write(); err != nil {
+		klog.Errorf("Failed to record event %q: %v", reason, err)
+	}
+}
@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStatusReporter(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	statusPath := filepath.Join(testDir, "status.json")
+	d := newMockDeviceAgentDaemon(testDir)
+	d.SetStatusReporter(NewFileStatusReporter(statusPath))
+
+	readStatus := func() DeviceStatus {
+		b, err := os.ReadFile(statusPath)
+		require.Nil(t, err)
+		status := DeviceStatus{}
+		require.Nil(t, json.Unmarshal(b, &status))
+		return status
+	}
+
+	newConfig := newDeviceAgentTestConfig(t, "new", nil, nil)
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+
+	status := readStatus()
+	assert.Equal(t, constants.MachineConfigDaemonStateDone, status.State)
+	assert.Equal(t, "new", status.CurrentConfig)
+	assert.Len(t, status.Events, 1)
+
+	badIgn := ctrlcommon.NewIgnConfig()
+	badIgn.Storage.Disks = []ign3types.Disk{{Device: "/dev/sda"}}
+	badConfig := helpers.CreateMachineConfigFromIgnition(badIgn)
+	badConfig.Name = "bad"
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, badConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.NotNil(t, err)
+
+	status = readStatus()
+	assert.Equal(t, constants.MachineConfigDaemonStateUnreconcilable, status.State)
+	assert.Equal(t, "new", status.CurrentConfig)
+	assert.Equal(t, "bad", status.DesiredConfig)
+	assert.Equal(t, err.Error(), status.Reason)
+
+	// The status survives a restart
+	reloaded := NewFileStatusReporter(statusPath).(*fileStatusReporter)
+	assert.Equal(t, "new", reloaded.status.CurrentConfig)
+}
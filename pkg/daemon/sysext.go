@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysextDirs are where systemd-sysext looks for system extension images to
+// merge over /usr and /opt. Images of a MachineConfig are delivered as files,
+// inline or with a remote source so large images aren't embedded.
+var sysextDirs = []string{
+	filepath.Join("/etc", "extensions"),
+	filepath.Join("/var", "lib", "extensions"),
+}
+
+// sysextReleaseDirPath holds the extension-release files of the merged system
+// extension images, named after the images.
+var sysextReleaseDirPath = filepath.Join("/usr", "lib", "extension-release.d")
+
+// isSysextImage returns true if path is a system extension image.
+func isSysextImage(path string) bool {
+	for _, dir := range sysextDirs {
+		if filepath.Dir(path) == dir && strings.HasSuffix(path, ".raw") {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshSysext attaches the system extension images as they are now: it
+// merges added and changed images and detaches removed ones, checks that every
+// delivered image got merged, and enables systemd-sysext.service so the images
+// are attached again on boot.
+func refreshSysext() error {
+	if err := runCmdSync("systemd-sysext", "refresh"); err != nil {
+		return err
+	}
+	unmerged, err := unmergedSysextImages()
+	if err != nil {
+		return err
+	}
+	if len(unmerged) > 0 {
+		return fmt.Errorf("system extension images not merged: %s", strings.Join(unmerged, ", "))
+	}
+	if err := runCmdSync("systemctl", "enable", "systemd-sysext.service"); err != nil {
+		return err
+	}
+	logSystem("Refreshed the merged system extension images")
+	return nil
+}
+
+// unmergedSysextImages returns the system extension images in sysextDirs that
+// have no extension-release file in the merged /usr, e.g. because their release
+// doesn't match the OS.
+func unmergedSysextImages() ([]string, error) {
+	var unmerged []string
+	for _, dir := range sysextDirs {
+		images, err := filepath.Glob(filepath.Join(dir, "*.raw"))
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			name := strings.TrimSuffix(filepath.Base(image), ".raw")
+			_, err := os.Stat(filepath.Join(sysextReleaseDirPath, "extension-release."+name))
+			switch {
+			case os.IsNotExist(err):
+				unmerged = append(unmerged, image)
+			case err != nil:
+				return nil, err
+			}
+		}
+	}
+	return unmerged, nil
+}
@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSysextImages(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	origSysextDirs, origSysextReleaseDirPath := sysextDirs, sysextReleaseDirPath
+	sysextDirs = []string{filepath.Join(testDir, "etc", "extensions")}
+	sysextReleaseDirPath = filepath.Join(testDir, "usr", "lib", "extension-release.d")
+	defer func() {
+		sysextDirs, sysextReleaseDirPath = origSysextDirs, origSysextReleaseDirPath
+	}()
+
+	require.Nil(t, os.MkdirAll(sysextDirs[0], 0o755))
+	require.Nil(t, os.MkdirAll(sysextReleaseDirPath, 0o755))
+	merged := filepath.Join(sysextDirs[0], "merged.raw")
+	unmerged := filepath.Join(sysextDirs[0], "unmerged.raw")
+	require.Nil(t, os.WriteFile(merged, []byte("merged"), 0o644))
+	require.Nil(t, os.WriteFile(unmerged, []byte("unmerged"), 0o644))
+	require.Nil(t, os.WriteFile(filepath.Join(sysextReleaseDirPath, "extension-release.merged"), []byte("ID=_any\n"), 0o644))
+
+	images, err := unmergedSysextImages()
+	require.Nil(t, err)
+	assert.Equal(t, []string{unmerged}, images)
+
+	// Existing images aren't copied into snapshots, added ones are removed on
+	// restore
+	added := filepath.Join(sysextDirs[0], "added.raw")
+	d := newMockDeviceAgentDaemon(testDir)
+	snap, err := d.takeUpdateSnapshot([]string{merged, added}, false)
+	require.Nil(t, err)
+	assert.Equal(t, []snapshotEntry{{Path: added}}, snap.Entries)
+	assert.NoFileExists(t, snapshotFileName(merged))
+}
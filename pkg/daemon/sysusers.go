@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+)
+
+const (
+	// sysusersConfigDir holds the systemd-sysusers configuration, which is
+	// applied live by running systemd-sysusers on the changed files.
+	sysusersConfigDir = "/etc/sysusers.d"
+	// tmpfilesConfigDir holds the systemd-tmpfiles configuration, which is
+	// applied live by running systemd-tmpfiles --create on the changed files.
+	tmpfilesConfigDir = "/etc/tmpfiles.d"
+)
+
+// isSysusersConfigFile returns true if path is a systemd-sysusers
+// configuration file.
+func isSysusersConfigFile(path string) bool {
+	return filepath.Dir(path) == sysusersConfigDir && strings.HasSuffix(path, ".conf")
+}
+
+// isTmpfilesConfigFile returns true if path is a systemd-tmpfiles
+// configuration file.
+func isTmpfilesConfigFile(path string) bool {
+	return filepath.Dir(path) == tmpfilesConfigDir && strings.HasSuffix(path, ".conf")
+}
+
+// runSysusers creates the users and groups declared by the changed sysusers
+// files. Users of removed files are kept, as systemd-sysusers never removes
+// any.
+func runSysusers(changedFiles []string) error {
+	files := existingFiles(changedFiles, isSysusersConfigFile)
+	if len(files) == 0 {
+		return nil
+	}
+	if err := runCmdSync("systemd-sysusers", files...); err != nil {
+		return err
+	}
+	logSystem("Created the users and groups of %s", strings.Join(files, ", "))
+	return nil
+}
+
+// runTmpfiles creates the files and directories declared by the changed
+// tmpfiles files.
+func runTmpfiles(changedFiles []string) error {
+	files := existingFiles(changedFiles, isTmpfilesConfigFile)
+	if len(files) == 0 {
+		return nil
+	}
+	if err := runCmdSync("systemd-tmpfiles", append([]string{"--create"}, files...)...); err != nil {
+		return err
+	}
+	logSystem("Created the files and directories of %s", strings.Join(files, ", "))
+	return nil
+}
+
+// runSystemdConfigActions runs systemd-sysusers and then systemd-tmpfiles on
+// the changed files if actions ask for it.
+func runSystemdConfigActions(actions, changedFiles []string) error {
+	if ctrlcommon.InSlice(postConfigChangeActionRunSysusers, actions) {
+		if err := runSysusers(changedFiles); err != nil {
+			return err
+		}
+	}
+	if ctrlcommon.InSlice(postConfigChangeActionRunTmpfiles, actions) {
+		return runTmpfiles(changedFiles)
+	}
+	return nil
+}
+
+// existingFiles returns the paths matching that exist.
+func existingFiles(paths []string, matching func(string) bool) []string {
+	var existing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil && matching(path) {
+			existing = append(existing, path)
+		}
+	}
+	return existing
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
@@ -12,6 +13,7 @@ import (
 	"path/filepath"
 	"reflect"
 	goruntime "runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -49,6 +51,30 @@ const (
 	postConfigChangeActionNone = "none"
 	// The "reload crio" action will run "systemctl reload crio"
 	postConfigChangeActionReloadCrio = "reload crio"
+	// The "reload NetworkManager" action reloads the NetworkManager keyfiles and
+	// reactivates the connections whose keyfiles changed
+	postConfigChangeActionReloadNetworkManager = "reload NetworkManager"
+	// The "restart sssd" action applies the authselect configuration again
+	// and restarts sssd
+	postConfigChangeActionRestartSSSD = "restart sssd"
+	// The "restart chronyd" action restarts chronyd and waits for the clock
+	// to be synchronized
+	postConfigChangeActionRestartChronyd = "restart chronyd"
+	// The "run systemd-sysusers" and "run systemd-tmpfiles" actions apply
+	// the changed sysusers.d and tmpfiles.d files
+	postConfigChangeActionRunSysusers = "run systemd-sysusers"
+	postConfigChangeActionRunTmpfiles = "run systemd-tmpfiles"
+	// The "restart kubelet" and "restart crio" actions regenerate the
+	// environment drop-in of the service and restart only it, for changes
+	// to its environment files
+	postConfigChangeActionRestartKubelet = "restart kubelet"
+	postConfigChangeActionRestartCrio    = "restart crio"
+	// The "refresh sysext" action merges the system extension images again
+	// for added, changed and removed images
+	postConfigChangeActionRefreshSysext = "refresh sysext"
+	// The "restart quadlets" action regenerates the services of podman
+	// quadlet files and restarts those of added and changed files
+	postConfigChangeActionRestartQuadlets = "restart quadlets"
 	// Rebooting is still the default scenario for any other change
 	postConfigChangeActionReboot = "reboot"
 
@@ -193,7 +219,7 @@ func (dn *Daemon) compareMachineConfig(oldConfig, newConfig *mcfgv1.MachineConfi
 // addExtensionsRepo adds a repo into /etc/yum.repos.d/ which we use later to
 // install extensions (additional packages).
 func addExtensionsRepo(extensionsImageContentDir string) error {
-	repoContent := "[coreos-extensions]\nenabled=1\nmetadata_expire=1m\nbaseurl=" + extensionsImageContentDir + "/usr/share/rpm-ostree/extensions/\ngpgcheck=0\nskip_if_unavailable=False\n"
+	repoContent := extensionsRepoConfig(extensionsImageContentDir + "/usr/share/rpm-ostree/extensions/")
 	return writeFileAtomicallyWithDefaults(extensionsRepo, []byte(repoContent))
 }
 
@@ -272,7 +298,7 @@ func removePendingDeployment() error {
 }
 
 // applyOSChanges extracts the OS image and adds coreos-extensions repo if we have either OS update or package layering to perform
-func (dn *CoreOSDaemon) applyOSChanges(mcDiff machineConfigDiff, oldConfig, newConfig *mcfgv1.MachineConfig) (retErr error) {
+func (dn *CoreOSDaemon) applyOSChanges(ctx context.Context, mcDiff machineConfigDiff, oldConfig, newConfig *mcfgv1.MachineConfig) (retErr error) {
 	// We previously did not emit this event when kargs changed, so we still don't
 	if mcDiff.osUpdate || mcDiff.extensions || mcDiff.kernelType {
 		// We emitted this event before, so keep it
@@ -299,7 +325,7 @@ func (dn *CoreOSDaemon) applyOSChanges(mcDiff machineConfigDiff, oldConfig, newC
 			dn.nodeWriter.Eventf(corev1.EventTypeNormal, "OSUpdateStarted", mcDiff.osChangesString())
 		}
 
-		if err := dn.applyLayeredOSChanges(mcDiff, oldConfig, newConfig); err != nil {
+		if err := dn.applyLayeredOSChanges(ctx, mcDiff, oldConfig, newConfig); err != nil {
 			return err
 		}
 
@@ -342,7 +368,10 @@ func (dn *CoreOSDaemon) applyOSChanges(mcDiff machineConfigDiff, oldConfig, newC
 	return nil
 }
 
-func calculatePostConfigChangeActionFromFileDiffs(diffFileSet []string) (actions []string) {
+// postConfigChangeActionForFile returns the action required after the file at
+// path has changed. Some actions are only taken in device agent mode, cluster
+// managed nodes reboot for their files.
+func postConfigChangeActionForFile(path string, agentMode bool) string {
 	filesPostConfigChangeActionNone := []string{
 		caBundleFilePath,
 		imageRegistryAuthFile,
@@ -354,20 +383,74 @@ func calculatePostConfigChangeActionFromFileDiffs(diffFileSet []string) (actions
 		"/etc/containers/policy.json",
 	}
 
-	actions = []string{postConfigChangeActionNone}
+	if ctrlcommon.InSlice(path, filesPostConfigChangeActionNone) {
+		return postConfigChangeActionNone
+	} else if ctrlcommon.InSlice(path, filesPostConfigChangeActionReloadCrio) {
+		return postConfigChangeActionReloadCrio
+	} else if isNetworkManagerKeyfile(path) && agentMode {
+		return postConfigChangeActionReloadNetworkManager
+	} else if isSSSDConfigFile(path) && agentMode {
+		return postConfigChangeActionRestartSSSD
+	} else if isChronyConfigFile(path) && agentMode {
+		return postConfigChangeActionRestartChronyd
+	} else if isSysusersConfigFile(path) && agentMode {
+		return postConfigChangeActionRunSysusers
+	} else if isTmpfilesConfigFile(path) && agentMode {
+		return postConfigChangeActionRunTmpfiles
+	} else if service, ok := envFileService(path); ok && agentMode {
+		return serviceEnvActions[service]
+	} else if isSysextImage(path) && agentMode {
+		return postConfigChangeActionRefreshSysext
+	} else if isQuadletFile(path) && agentMode {
+		return postConfigChangeActionRestartQuadlets
+	}
+	return postConfigChangeActionReboot
+}
+
+func calculatePostConfigChangeActionFromFileDiffs(diffFileSet []string, agentMode bool) (actions []string) {
+	found := map[string]bool{}
 	for _, path := range diffFileSet {
-		if ctrlcommon.InSlice(path, filesPostConfigChangeActionNone) {
-			continue
-		} else if ctrlcommon.InSlice(path, filesPostConfigChangeActionReloadCrio) {
-			actions = []string{postConfigChangeActionReloadCrio}
-		} else {
-			actions = []string{postConfigChangeActionReboot}
-			return
-		}
+		action := postConfigChangeActionForFile(path, agentMode)
+		if action == postConfigChangeActionReboot {
+			return []string{postConfigChangeActionReboot}
+		}
+		found[action] = true
+	}
+	// Reloads don't exclude each other; users are created before the files
+	// they may own
+	for _, action := range []string{
+		postConfigChangeActionReloadCrio,
+		postConfigChangeActionReloadNetworkManager,
+		postConfigChangeActionRestartSSSD,
+		postConfigChangeActionRestartChronyd,
+		postConfigChangeActionRunSysusers,
+		postConfigChangeActionRunTmpfiles,
+		postConfigChangeActionRestartKubelet,
+		postConfigChangeActionRestartCrio,
+		postConfigChangeActionRefreshSysext,
+		postConfigChangeActionRestartQuadlets,
+	} {
+		if found[action] {
+			actions = append(actions, action)
+		}
+	}
+	if len(actions) == 0 {
+		actions = []string{postConfigChangeActionNone}
 	}
 	return
 }
 
+// postConfigChangeActionFiles maps each post config change action to the
+// changed files that require it.
+func postConfigChangeActionFiles(diffFileSet []string, agentMode bool) map[string][]string {
+	files := make(map[string][]string)
+	for _, path := range diffFileSet {
+		action := postConfigChangeActionForFile(path, agentMode)
+		files[action] = append(files[action], path)
+	}
+	return files
+}
+
 func calculatePostConfigChangeAction(diff *machineConfigDiff, diffFileSet []string) ([]string, error) {
 	// If a machine-config-daemon-force file is present, it means the user wants to
 	// move to desired state without additional validation. We will reboot the node in
@@ -380,13 +463,19 @@ func calculatePostConfigChangeAction(diff *machineConfigDiff, diffFileSet []stri
 		return []string{postConfigChangeActionReboot}, nil
 	}
 
+	return calculatePostConfigChangeActionFromDiff(diff, diffFileSet, false), nil
+}
+
+// calculatePostConfigChangeActionFromDiff computes the post config change actions
+// for a diff without taking the force file into account.
+func calculatePostConfigChangeActionFromDiff(diff *machineConfigDiff, diffFileSet []string, agentMode bool) []string {
 	if diff.osUpdate || diff.kargs || diff.fips || diff.units || diff.kernelType || diff.extensions {
 		// must reboot
-		return []string{postConfigChangeActionReboot}, nil
+		return []string{postConfigChangeActionReboot}
 	}
 
 	// We don't actually have to consider ssh keys changes, which is the only section of passwd that is allowed to change
-	return calculatePostConfigChangeActionFromFileDiffs(diffFileSet), nil
+	return calculatePostConfigChangeActionFromFileDiffs(diffFileSet, agentMode)
 }
 
 // This is another update function implementation for the special case of
@@ -412,7 +501,9 @@ func (dn *Daemon) updateOnClusterBuild(oldConfig, newConfig *mcfgv1.MachineConfi
 		}
 	}
 
-	dn.catchIgnoreSIGTERM()
+	// SIGTERM cancels the update until its protected steps start
+	ctx, endUpdate := dn.startInterruptibleUpdate()
+	defer endUpdate()
 	defer func() {
 		// now that we do rebootless updates, we need to turn off our SIGTERM protection
 		// regardless of how we leave the "update loop"
@@ -462,8 +553,18 @@ func (dn *Daemon) updateOnClusterBuild(oldConfig, newConfig *mcfgv1.MachineConfi
 	// If the new image pullspec is already on disk, do not attempt to re-apply
 	// it. rpm-ostree will throw an error as a result.
 	// See: https://issues.redhat.com/browse/OCPBUGS-18414.
-	if oldImage != newImage && newImage != "" {
-		if err := dn.updateLayeredOSToPullspec(newImage); err != nil {
+	rebase := oldImage != newImage && newImage != ""
+	if rebase {
+		if err := dn.pullOSImage(ctx, newImage); err != nil {
+			return err
+		}
+	}
+
+	// The rebase and the writes from here on can't be interrupted
+	dn.catchIgnoreSIGTERM()
+
+	if rebase {
+		if err := dn.updateLayeredOSToPullspec(ctx, newImage); err != nil {
 			return err
 		}
 	} else {
@@ -471,13 +572,14 @@ func (dn *Daemon) updateOnClusterBuild(oldConfig, newConfig *mcfgv1.MachineConfi
 	}
 
 	// update files on disk that need updating
-	if err := dn.updateFiles(oldIgnConfig, newIgnConfig, skipCertificateWrite); err != nil {
+	if err := dn.updateFiles(ctx, oldIgnConfig, newIgnConfig, nil, OrphanedFilesDelete, skipCertificateWrite); err != nil {
 		return err
 	}
 
 	defer func() {
 		if retErr != nil {
-			if err := dn.updateFiles(newIgnConfig, oldIgnConfig, skipCertificateWrite); err != nil {
+			// Rolling back isn't canceled
+			if err := dn.updateFiles(context.Background(), newIgnConfig, oldIgnConfig, nil, OrphanedFilesDelete, skipCertificateWrite); err != nil {
 				errs := kubeErrs.NewAggregate([]error{err, retErr})
 				retErr = fmt.Errorf("error rolling back files writes: %w", errs)
 				return
@@ -578,7 +680,9 @@ func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig, skipCertifi
 		}
 	}
 
-	dn.catchIgnoreSIGTERM()
+	// SIGTERM cancels the update until its protected steps start
+	ctx, endUpdate := dn.startInterruptibleUpdate()
+	defer endUpdate()
 	defer func() {
 		// now that we do rebootless updates, we need to turn off our SIGTERM protection
 		// regardless of how we leave the "update loop"
@@ -612,7 +716,9 @@ func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig, skipCertifi
 
 	logSystem("Starting update from %s to %s: %+v", oldConfigName, newConfigName, diff)
 
-	diffFileSet := ctrlcommon.CalculateConfigFileDiffs(&oldIgnConfig, &newIgnConfig)
+	// All files are written, those whose contents are equivalent call for no
+	// actions
+	diffFileSet := ctrlcommon.WithoutEquivalentFiles(&oldIgnConfig, &newIgnConfig, ctrlcommon.CalculateConfigFileDiffs(&oldIgnConfig, &newIgnConfig))
 	actions, err := calculatePostConfigChangeAction(diff, diffFileSet)
 	if err != nil {
 		return err
@@ -631,14 +737,24 @@ func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig, skipCertifi
 		klog.Info("Changes do not require drain, skipping.")
 	}
 
+	if dn.os.IsCoreOSVariant() && diff.osUpdate && dn.bootedOSImageURL != newConfig.Spec.OSImageURL {
+		if err := dn.pullOSImage(ctx, newConfig.Spec.OSImageURL); err != nil {
+			return err
+		}
+	}
+
+	// The writes and the OS changes from here on can't be interrupted
+	dn.catchIgnoreSIGTERM()
+
 	// update files on disk that need updating
-	if err := dn.updateFiles(oldIgnConfig, newIgnConfig, skipCertificateWrite); err != nil {
+	if err := dn.updateFiles(ctx, oldIgnConfig, newIgnConfig, nil, OrphanedFilesDelete, skipCertificateWrite); err != nil {
 		return err
 	}
 
 	defer func() {
 		if retErr != nil {
-			if err := dn.updateFiles(newIgnConfig, oldIgnConfig, skipCertificateWrite); err != nil {
+			// Rolling back isn't canceled
+			if err := dn.updateFiles(context.Background(), newIgnConfig, oldIgnConfig, nil, OrphanedFilesDelete, skipCertificateWrite); err != nil {
 				errs := kubeErrs.NewAggregate([]error{err, retErr})
 				retErr = fmt.Errorf("error rolling back files writes: %w", errs)
 				return
@@ -686,13 +802,13 @@ func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig, skipCertifi
 
 	if dn.os.IsCoreOSVariant() {
 		coreOSDaemon := CoreOSDaemon{dn}
-		if err := coreOSDaemon.applyOSChanges(*diff, oldConfig, newConfig); err != nil {
+		if err := coreOSDaemon.applyOSChanges(ctx, *diff, oldConfig, newConfig); err != nil {
 			return err
 		}
 
 		defer func() {
 			if retErr != nil {
-				if err := coreOSDaemon.applyOSChanges(*diff, newConfig, oldConfig); err != nil {
+				if err := coreOSDaemon.applyOSChanges(context.Background(), *diff, newConfig, oldConfig); err != nil {
 					errs := kubeErrs.NewAggregate([]error{err, retErr})
 					retErr = fmt.Errorf("error rolling back changes to OS: %w", errs)
 					return
@@ -748,13 +864,13 @@ func (dn *Daemon) updateHypershift(oldConfig, newConfig *mcfgv1.MachineConfig, d
 
 	// update files on disk that need updating
 	// We should't skip the certificate write in HyperShift since it does not run the extra daemon process
-	if err := dn.updateFiles(oldIgnConfig, newIgnConfig, false); err != nil {
+	if err := dn.updateFiles(context.TODO(), oldIgnConfig, newIgnConfig, nil, OrphanedFilesDelete, false); err != nil {
 		return err
 	}
 
 	defer func() {
 		if retErr != nil {
-			if err := dn.updateFiles(newIgnConfig, oldIgnConfig, false); err != nil {
+			if err := dn.updateFiles(context.TODO(), newIgnConfig, oldIgnConfig, nil, OrphanedFilesDelete, false); err != nil {
 				errs := kubeErrs.NewAggregate([]error{err, retErr})
 				retErr = fmt.Errorf("error rolling back files writes: %w", errs)
 				return
@@ -778,13 +894,13 @@ func (dn *Daemon) updateHypershift(oldConfig, newConfig *mcfgv1.MachineConfig, d
 
 	if dn.os.IsCoreOSVariant() {
 		coreOSDaemon := CoreOSDaemon{dn}
-		if err := coreOSDaemon.applyOSChanges(*diff, oldConfig, newConfig); err != nil {
+		if err := coreOSDaemon.applyOSChanges(context.TODO(), *diff, oldConfig, newConfig); err != nil {
 			return err
 		}
 
 		defer func() {
 			if retErr != nil {
-				if err := coreOSDaemon.applyOSChanges(*diff, newConfig, oldConfig); err != nil {
+				if err := coreOSDaemon.applyOSChanges(context.TODO(), *diff, newConfig, oldConfig); err != nil {
 					errs := kubeErrs.NewAggregate([]error{err, retErr})
 					retErr = fmt.Errorf("error rolling back changes to OS: %w", errs)
 					return
@@ -844,6 +960,11 @@ func (mcDiff *machineConfigDiff) isEmpty() bool {
 
 // osChangesString generates a human-readable set of changes from the diff
 func (mcDiff *machineConfigDiff) osChangesString() string {
+	return strings.Join(mcDiff.osChanges(), "; ")
+}
+
+// osChanges returns the list of human-readable OS changes contained in the diff
+func (mcDiff *machineConfigDiff) osChanges() []string {
 	changes := []string{}
 	if mcDiff.osUpdate {
 		changes = append(changes, "Upgrading OS")
@@ -858,7 +979,7 @@ func (mcDiff *machineConfigDiff) osChangesString() string {
 		changes = append(changes, "Changing kernel arguments")
 	}
 
-	return strings.Join(changes, "; ")
+	return changes
 }
 
 // canonicalizeKernelType returns a valid kernelType. We consider empty("") and default kernelType as same
@@ -882,18 +1003,19 @@ func newMachineConfigDiff(oldConfig, newConfig *mcfgv1.MachineConfig) (*machineC
 		return nil, fmt.Errorf("parsing new Ignition config failed with error: %w", err)
 	}
 
-	// Both nil and empty slices are of zero length,
-	// consider them as equal while comparing KernelArguments in both MachineConfigs
-	kargsEmpty := len(oldConfig.Spec.KernelArguments) == 0 && len(newConfig.Spec.KernelArguments) == 0
 	extensionsEmpty := len(oldConfig.Spec.Extensions) == 0 && len(newConfig.Spec.Extensions) == 0
 
+	filesChanged := !reflect.DeepEqual(oldIgn.Storage.Files, newIgn.Storage.Files) ||
+		!reflect.DeepEqual(oldIgn.Storage.Directories, newIgn.Storage.Directories) ||
+		!reflect.DeepEqual(oldIgn.Storage.Links, newIgn.Storage.Links)
+
 	force := forceFileExists()
 	return &machineConfigDiff{
 		osUpdate:   oldConfig.Spec.OSImageURL != newConfig.Spec.OSImageURL || force,
-		kargs:      !(kargsEmpty || reflect.DeepEqual(oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments)),
+		kargs:      !kernelArgumentsEqual(oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments),
 		fips:       oldConfig.Spec.FIPS != newConfig.Spec.FIPS,
 		passwd:     !reflect.DeepEqual(oldIgn.Passwd, newIgn.Passwd),
-		files:      !reflect.DeepEqual(oldIgn.Storage.Files, newIgn.Storage.Files),
+		files:      filesChanged,
 		units:      !reflect.DeepEqual(oldIgn.Systemd.Units, newIgn.Systemd.Units),
 		kernelType: canonicalizeKernelType(oldConfig.Spec.KernelType) != canonicalizeKernelType(newConfig.Spec.KernelType),
 		extensions: !(extensionsEmpty || reflect.DeepEqual(oldConfig.Spec.Extensions, newConfig.Spec.Extensions)),
@@ -920,82 +1042,11 @@ func reconcilable(oldConfig, newConfig *mcfgv1.MachineConfig) (*machineConfigDif
 		return nil, fmt.Errorf("parsing new Ignition config failed with error: %w", err)
 	}
 
-	// Check if this is a generally valid Ignition Config
-	if err := ctrlcommon.ValidateIgnition(newIgn); err != nil {
-		return nil, err
-	}
-
-	// Passwd section
-
-	// we don't currently configure Groups in place. we don't configure Users except
-	// for setting/updating SSHAuthorizedKeys for the only allowed user "core".
-	// otherwise we can't fix it if something changed here.
-	passwdChanged := !reflect.DeepEqual(oldIgn.Passwd, newIgn.Passwd)
-
-	if passwdChanged {
-		if !reflect.DeepEqual(oldIgn.Passwd.Groups, newIgn.Passwd.Groups) {
-			return nil, fmt.Errorf("ignition Passwd Groups section contains changes")
-		}
-		if !reflect.DeepEqual(oldIgn.Passwd.Users, newIgn.Passwd.Users) {
-			// there is an update to Users, we must verify that it is ONLY making an acceptable
-			// change to the SSHAuthorizedKeys for the user "core"
-			for _, user := range newIgn.Passwd.Users {
-				if user.Name != constants.CoreUserName {
-					return nil, fmt.Errorf("ignition passwd user section contains unsupported changes: non-core user")
-				}
-			}
-			// We don't want to panic if the "new" users is empty, and it's still reconcilable because the absence of a user here does not mean "remove the user from the system"
-			if len(newIgn.Passwd.Users) != 0 {
-				klog.Infof("user data to be verified before ssh update: %v", newIgn.Passwd.Users[len(newIgn.Passwd.Users)-1])
-				if err := verifyUserFields(newIgn.Passwd.Users[len(newIgn.Passwd.Users)-1]); err != nil {
-					return nil, err
-				}
-			}
-		}
-	}
-
-	// Kernel args
-
-	// ignition now supports kernel args, but the MCO doesn't implement them yet
-	if !reflect.DeepEqual(oldIgn.KernelArguments, newIgn.KernelArguments) {
-		return nil, fmt.Errorf("ignition kargs section contains changes")
-	}
-
-	// Storage section
-
-	// we can only reconcile files right now. make sure the sections we can't
-	// fix aren't changed.
-	if !reflect.DeepEqual(oldIgn.Storage.Disks, newIgn.Storage.Disks) {
-		return nil, fmt.Errorf("ignition disks section contains changes")
-	}
-	if !reflect.DeepEqual(oldIgn.Storage.Filesystems, newIgn.Storage.Filesystems) {
-		return nil, fmt.Errorf("ignition filesystems section contains changes")
-	}
-	if !reflect.DeepEqual(oldIgn.Storage.Raid, newIgn.Storage.Raid) {
-		return nil, fmt.Errorf("ignition raid section contains changes")
-	}
-	if !reflect.DeepEqual(oldIgn.Storage.Directories, newIgn.Storage.Directories) {
-		return nil, fmt.Errorf("ignition directories section contains changes")
-	}
-	if !reflect.DeepEqual(oldIgn.Storage.Links, newIgn.Storage.Links) {
-		// This means links have been added, as opposed as being removed as it happened with
-		// https://bugzilla.redhat.com/show_bug.cgi?id=1677198. This doesn't really change behavior
-		// since we still don't support links but we allow old MC to remove links when upgrading.
-		if len(newIgn.Storage.Links) != 0 {
-			return nil, fmt.Errorf("ignition links section contains changes")
-		}
-	}
-
-	// Special case files append: if the new config wants us to append, then we
-	// have to force a reprovision since it's not idempotent
-	for _, f := range newIgn.Storage.Files {
-		if len(f.Append) > 0 {
-			return nil, fmt.Errorf("ignition file %v includes append", f.Path)
-		}
-		// We also disallow writing some special files
-		if f.Path == constants.MachineConfigDaemonForceFile {
-			return nil, fmt.Errorf("cannot create %s via Ignition", f.Path)
-		}
+	// Check the sections that can't be changed in place
+	report := &ReconcilableReport{}
+	report.checkIgnition(oldIgn, newIgn)
+	if !report.Reconcilable() {
+		return nil, report.Unreconcilable[0].err
 	}
 
 	// Systemd section
@@ -1145,14 +1196,76 @@ func parseKernelArguments(kargs []string) []string {
 	return parsed
 }
 
+// positionalKernelArguments are the kernel arguments whose meaning depends on
+// their position: hugepages applies to the hugepagesz before it, so both may
+// repeat and their order matters.
+var positionalKernelArguments = []string{"hugepagesz", "hugepages"}
+
+func isPositionalKernelArgument(arg string) bool {
+	key, _, _ := strings.Cut(arg, "=")
+	return ctrlcommon.InSlice(key, positionalKernelArguments)
+}
+
+// dedupeKernelArguments returns the entries of kargs without those repeating
+// an earlier entry as a whole. Entries with positional arguments are kept, so
+// hugepagesz and hugepages pairs stay as they are.
+func dedupeKernelArguments(kargs []string) []string {
+	seen := make(map[string]struct{}, len(kargs))
+	deduped := make([]string, 0, len(kargs))
+	for _, k := range kargs {
+		k = strings.TrimSpace(k)
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		positional := false
+		for _, arg := range splitKernelArguments(k) {
+			positional = positional || isPositionalKernelArgument(arg)
+		}
+		if !positional {
+			seen[k] = struct{}{}
+		}
+		deduped = append(deduped, k)
+	}
+	return deduped
+}
+
+// kernelArgumentsEqual returns true if a and b apply the same kernel
+// arguments: without the entries repeated as a whole, the arguments are the
+// same multiset, i.e. in any order, and the positional ones are in the same
+// order.
+func kernelArgumentsEqual(a, b []string) bool {
+	a, b = parseKernelArguments(dedupeKernelArguments(a)), parseKernelArguments(dedupeKernelArguments(b))
+	if len(a) != len(b) {
+		return false
+	}
+	var positionalA, positionalB []string
+	counts := make(map[string]int, len(a))
+	for _, k := range a {
+		if isPositionalKernelArgument(k) {
+			positionalA = append(positionalA, k)
+		}
+		counts[k]++
+	}
+	for _, k := range b {
+		if isPositionalKernelArgument(k) {
+			positionalB = append(positionalB, k)
+		}
+		if counts[k] == 0 {
+			return false
+		}
+		counts[k]--
+	}
+	return reflect.DeepEqual(positionalA, positionalB)
+}
+
 // generateKargs performs a diff between the old/new MC kernelArguments,
 // and generates the command line arguments suitable for `rpm-ostree kargs`.
 // Note what we really should be doing though is also looking at the *current*
 // kernel arguments in case there was drift.  But doing that requires us knowing
 // what the "base" arguments are. See https://github.com/ostreedev/ostree/issues/479
 func generateKargs(oldKernelArguments, newKernelArguments []string) []string {
-	oldKargs := parseKernelArguments(oldKernelArguments)
-	newKargs := parseKernelArguments(newKernelArguments)
+	oldKargs := parseKernelArguments(dedupeKernelArguments(oldKernelArguments))
+	newKargs := parseKernelArguments(dedupeKernelArguments(newKernelArguments))
 	cmdArgs := []string{}
 
 	// To keep kernel argument processing simpler and bug free, we first delete all
@@ -1169,7 +1282,7 @@ func generateKargs(oldKernelArguments, newKernelArguments []string) []string {
 }
 
 // updateKernelArguments adjusts the kernel args
-func (dn *CoreOSDaemon) updateKernelArguments(oldKernelArguments, newKernelArguments []string) error {
+func (dn *CoreOSDaemon) updateKernelArguments(ctx context.Context, oldKernelArguments, newKernelArguments []string) error {
 	kargs := generateKargs(oldKernelArguments, newKernelArguments)
 	if len(kargs) == 0 {
 		return nil
@@ -1177,7 +1290,7 @@ func (dn *CoreOSDaemon) updateKernelArguments(oldKernelArguments, newKernelArgum
 
 	args := append([]string{"kargs"}, kargs...)
 	logSystem("Running rpm-ostree %v", args)
-	return runRpmOstree(args...)
+	return runRpmOstreeContext(ctx, args...)
 }
 
 func (dn *Daemon) generateExtensionsArgs(oldConfig, newConfig *mcfgv1.MachineConfig) []string {
@@ -1272,7 +1385,7 @@ func validateExtensions(exts []string) error {
 
 }
 
-func (dn *CoreOSDaemon) applyExtensions(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+func (dn *CoreOSDaemon) applyExtensions(ctx context.Context, oldConfig, newConfig *mcfgv1.MachineConfig) error {
 	extensionsEmpty := len(oldConfig.Spec.Extensions) == 0 && len(newConfig.Spec.Extensions) == 0
 	if (extensionsEmpty) ||
 		(reflect.DeepEqual(oldConfig.Spec.Extensions, newConfig.Spec.Extensions) && oldConfig.Spec.OSImageURL == newConfig.Spec.OSImageURL) {
@@ -1286,12 +1399,12 @@ func (dn *CoreOSDaemon) applyExtensions(oldConfig, newConfig *mcfgv1.MachineConf
 
 	args := dn.generateExtensionsArgs(oldConfig, newConfig)
 	klog.Infof("Applying extensions : %+q", args)
-	return runRpmOstree(args...)
+	return runRpmOstreeContext(ctx, args...)
 }
 
 // switchKernel updates kernel on host with the kernelType specified in MachineConfig.
 // Right now it supports default (traditional), realtime kernel and 64k pages kernel
-func (dn *CoreOSDaemon) switchKernel(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+func (dn *CoreOSDaemon) switchKernel(ctx context.Context, oldConfig, newConfig *mcfgv1.MachineConfig) error {
 	// We support Kernel update only on RHCOS and SCOS nodes
 	if !dn.os.IsEL() {
 		klog.Info("updating kernel on non-RHCOS nodes is not supported")
@@ -1333,7 +1446,7 @@ func (dn *CoreOSDaemon) switchKernel(oldConfig, newConfig *mcfgv1.MachineConfig)
 			args = append(args, "--install", pkg)
 		}
 
-		return runRpmOstree(args...)
+		return runRpmOstreeContext(ctx, args...)
 	} else if newKtype == ctrlcommon.KernelType64kPages {
 		// Switch to 64k pages kernel
 		args := []string{"override", "remove"}
@@ -1342,7 +1455,7 @@ func (dn *CoreOSDaemon) switchKernel(oldConfig, newConfig *mcfgv1.MachineConfig)
 			args = append(args, "--install", pkg)
 		}
 
-		return runRpmOstree(args...)
+		return runRpmOstreeContext(ctx, args...)
 	}
 	return fmt.Errorf("unhandled kernel type %s", newKtype)
 }
@@ -1364,15 +1477,97 @@ func (dn *CoreOSDaemon) switchKernel(oldConfig, newConfig *mcfgv1.MachineConfig)
 // whatever has been written is picked up by the appropriate daemons, if
 // required. in particular, a daemon-reload and restart for any unit files
 // touched.
-func (dn *Daemon) updateFiles(oldIgnConfig, newIgnConfig ign3types.Config, skipCertificateWrite bool) error {
+func (dn *Daemon) updateFiles(ctx context.Context, oldIgnConfig, newIgnConfig ign3types.Config, xattrs fileXattrs, orphans OrphanedFilePolicy, skipCertificateWrite bool) error {
 	klog.Info("Updating files")
-	if err := dn.writeFiles(newIgnConfig.Storage.Files, skipCertificateWrite); err != nil {
+	if err := writeDirectories(oldIgnConfig, newIgnConfig); err != nil {
+		return err
+	}
+	if err := dn.writeFiles(ctx, newIgnConfig.Storage.Files, xattrs, skipCertificateWrite); err != nil {
+		return err
+	}
+	if err := writeLinks(oldIgnConfig, newIgnConfig); err != nil {
 		return err
 	}
 	if err := dn.writeUnits(newIgnConfig.Systemd.Units); err != nil {
 		return err
 	}
-	return dn.deleteStaleData(oldIgnConfig, newIgnConfig)
+	// Before stale files, as those may be the targets of stale hard links
+	if err := deleteStaleLinks(oldIgnConfig, newIgnConfig); err != nil {
+		return err
+	}
+	if err := dn.deleteStaleData(oldIgnConfig, newIgnConfig, orphans); err != nil {
+		return err
+	}
+	return deleteStaleDirectories(oldIgnConfig, newIgnConfig)
+}
+
+// deleteStaleLinks removes the links of the old config that are not in the new
+// one. Hard links are only removed while they still link to their old target,
+// so nothing put there by someone else is lost.
+func deleteStaleLinks(oldIgnConfig, newIgnConfig ign3types.Config) error {
+	newPaths := managedStoragePaths(newIgnConfig)
+
+	for _, l := range oldIgnConfig.Storage.Links {
+		if _, ok := newPaths[l.Path]; ok {
+			continue
+		}
+		info, err := os.Lstat(l.Path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if l.Hard != nil && *l.Hard {
+			if l.Target == nil {
+				continue
+			}
+			if targetInfo, err := os.Lstat(*l.Target); err != nil || !os.SameFile(info, targetInfo) {
+				klog.Infof("Not removing hard link %q: it no longer links to %q", l.Path, *l.Target)
+				continue
+			}
+		} else if info.Mode()&os.ModeSymlink == 0 {
+			klog.Infof("Not removing link %q: it has been replaced", l.Path)
+			continue
+		}
+		klog.V(2).Infof("Removing link %q", l.Path)
+		if err := os.Remove(l.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("deleting link %q: %w", l.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteStaleDirectories removes the directories of the old config that are
+// not in the new one, as long as they are empty.
+func deleteStaleDirectories(oldIgnConfig, newIgnConfig ign3types.Config) error {
+	newPaths := managedStoragePaths(newIgnConfig)
+	var staleDirs []string
+	for _, d := range oldIgnConfig.Storage.Directories {
+		if _, ok := newPaths[d.Path]; !ok {
+			staleDirs = append(staleDirs, d.Path)
+		}
+	}
+	// Deepest first, so nested stale directories are empty by the time their
+	// parents are removed
+	sort.Slice(staleDirs, func(i, j int) bool {
+		return len(staleDirs[i]) > len(staleDirs[j])
+	})
+	for _, path := range staleDirs {
+		err := os.Remove(path)
+		switch {
+		case err == nil:
+			klog.V(2).Infof("Removed directory %q", path)
+		case os.IsNotExist(err):
+		case errors.Is(err, syscall.ENOTEMPTY), errors.Is(err, syscall.EEXIST):
+			klog.Infof("Not removing directory %q: it is not empty", path)
+		case errors.Is(err, syscall.ENOTDIR):
+			klog.Infof("Not removing %q: it is no longer a directory", path)
+		default:
+			return fmt.Errorf("deleting directory %q: %w", path, err)
+		}
+	}
+	return nil
 }
 
 func restorePath(path string) error {
@@ -1427,13 +1622,11 @@ func (dn *Daemon) isPathInDropins(path string, systemd *ign3types.Systemd) bool
 // of simply warning if the error is ENOENT since that's the desired state).
 //
 //nolint:gocyclo
-func (dn *Daemon) deleteStaleData(oldIgnConfig, newIgnConfig ign3types.Config) error {
+func (dn *Daemon) deleteStaleData(oldIgnConfig, newIgnConfig ign3types.Config, orphans OrphanedFilePolicy) error {
 	klog.Info("Deleting stale data")
 
-	newFileSet := make(map[string]struct{})
-	for _, f := range newIgnConfig.Storage.Files {
-		newFileSet[f.Path] = struct{}{}
-	}
+	// Files replaced with directories or links are not stale either
+	newFileSet := managedStoragePaths(newIgnConfig)
 
 	// need to skip these on upgrade if they are in a MC, or else we will remove all certs!
 	certsToSkip := []string{
@@ -1458,6 +1651,23 @@ func (dn *Daemon) deleteStaleData(oldIgnConfig, newIgnConfig ign3types.Config) e
 		if skipBecauseCert {
 			continue
 		}
+		if usrHotfixDiscarded(f.Path) {
+			klog.Infof("Not removing hotfix %q: the overlay on %s it was written to is gone", f.Path, usrPath)
+			continue
+		}
+		if !dn.isPathInDropins(f.Path, &newIgnConfig.Systemd) {
+			switch orphans {
+			case OrphanedFilesKeep:
+				// The orig file and noorig stamp stay too, so the original
+				// is still known should the path be managed again
+				klog.Infof("Keeping orphaned file %q", f.Path)
+				continue
+			case OrphanedFilesBackup:
+				if err := backupOrphanedFile(f.Path); err != nil {
+					return err
+				}
+			}
+		}
 		if _, err := os.Stat(noOrigFileStampName(f.Path)); err == nil {
 			if delErr := os.Remove(noOrigFileStampName(f.Path)); delErr != nil {
 				return fmt.Errorf("deleting noorig file stamp %q: %w", noOrigFileStampName(f.Path), delErr)
@@ -1716,8 +1926,37 @@ func (dn *Daemon) writeUnits(units []ign3types.Unit) error {
 
 // writeFiles writes the given files to disk.
 // it doesn't fetch remote files and expects a flattened config file.
-func (dn *Daemon) writeFiles(files []ign3types.File, skipCertificateWrite bool) error {
-	return writeFiles(files, skipCertificateWrite)
+// All files are written to a staging tree first and then swapped into place
+// one by one, so a failure to write any of them leaves the files on disk
+// untouched, and a crash while swapping leaves every file either old or new,
+// except for large files updated in place with delta writes, as device agent
+// mode does relying on its snapshot.
+// If ctx can be canceled, it stops between files once ctx is done. Failures
+// to write a file are returned as ErrFileWrite, or as ErrImmutableFile if the
+// file has the immutable attribute set.
+func (dn *Daemon) writeFiles(ctx context.Context, files []ign3types.File, xattrs fileXattrs, skipCertificateWrite bool) (retErr error) {
+	staged, err := stageFiles(ctx, files, xattrs, dn.remoteFetcher, dn.contentStore, dn.deltaWrites, skipCertificateWrite)
+	defer func() {
+		if err := removeStagedFiles(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, sf := range staged {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		klog.Infof("Writing file %q", sf.path)
+		if err := swapStagedFile(sf); err != nil {
+			return fileWriteError(sf.path, err)
+		}
+		// Let observers know as we go
+		dn.notifyFileWritten(sf.path)
+	}
+	return nil
 }
 
 // Ensures that both the SSH root directory (/home/core/.ssh) as well as any
@@ -2106,13 +2345,13 @@ func (dn *Daemon) queueRevertKernelSwap() error {
 }
 
 // updateLayeredOS updates the system OS to the one specified in newConfig
-func (dn *Daemon) updateLayeredOS(config *mcfgv1.MachineConfig) error {
+func (dn *Daemon) updateLayeredOS(ctx context.Context, config *mcfgv1.MachineConfig) error {
 	newURL := config.Spec.OSImageURL
 	klog.Infof("Updating OS to layered image %s", newURL)
-	return dn.updateLayeredOSToPullspec(newURL)
+	return dn.updateLayeredOSToPullspec(ctx, newURL)
 }
 
-func (dn *Daemon) updateLayeredOSToPullspec(newURL string) error {
+func (dn *Daemon) updateLayeredOSToPullspec(ctx context.Context, newURL string) error {
 	newEnough, err := dn.NodeUpdaterClient.IsNewEnoughForLayering()
 	if err != nil {
 		return err
@@ -2125,7 +2364,7 @@ func (dn *Daemon) updateLayeredOSToPullspec(newURL string) error {
 		if err := dn.InplaceUpdateViaNewContainer(newURL); err != nil {
 			return err
 		}
-	} else if err := dn.NodeUpdaterClient.RebaseLayered(newURL); err != nil {
+	} else if err := dn.NodeUpdaterClient.RebaseLayeredContext(ctx, newURL); err != nil {
 		return fmt.Errorf("failed to update OS to %s : %w", newURL, err)
 	}
 
@@ -2136,11 +2375,24 @@ func (dn *Daemon) updateLayeredOSToPullspec(newURL string) error {
 // and gathering stderr into a buffer which will be returned in err
 // in case of error.
 func runCmdSync(cmdName string, args ...string) error {
+	return runCmdSyncContext(context.Background(), cmdName, args...)
+}
+
+// runCmdSyncContext is like runCmdSync, but kills the command if ctx is done
+// before it exits.
+func runCmdSyncContext(ctx context.Context, cmdName string, args ...string) error {
 	klog.Infof("Running: %s %s", cmdName, strings.Join(args, " "))
-	cmd := exec.Command(cmdName, args...)
+	cmd := exec.CommandContext(ctx, cmdName, args...)
 	var stderr bytes.Buffer
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = &stderr
+	if pull := osPullFrom(ctx); pull != nil {
+		// The OS commands of device agent mode report pull progress
+		cmd.Stdout = io.MultiWriter(os.Stdout, &lineWriter{onLine: pull.onLine})
+		if pull.proxy != "" {
+			cmd.Env = append(os.Environ(), "HTTPS_PROXY="+pull.proxy, "https_proxy="+pull.proxy)
+		}
+	}
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("error running %s %s: %s: %w", cmdName, strings.Join(args, " "), string(stderr.Bytes()), err)
 	}
@@ -2186,6 +2438,43 @@ func (dn *Daemon) cancelSIGTERM() {
 	}
 }
 
+// startInterruptibleUpdate returns the context of a cluster update, which
+// SIGTERM cancels while the update isn't protected by catchIgnoreSIGTERM. The
+// signal handler then waits for the update to return, rolled back, before the
+// daemon exits. The returned function is called once the update returned.
+func (dn *Daemon) startInterruptibleUpdate() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	dn.updateActiveLock.Lock()
+	dn.cancelUpdate, dn.updateDone = cancel, done
+	dn.updateActiveLock.Unlock()
+	return ctx, func() {
+		dn.updateActiveLock.Lock()
+		dn.cancelUpdate, dn.updateDone = nil, nil
+		dn.updateActiveLock.Unlock()
+		cancel()
+		close(done)
+	}
+}
+
+// pullOSImage pulls imgURL into the ostree repository ahead of the rebase,
+// while SIGTERM still cancels the update, so the rebase only deploys the
+// pulled layers. Failing to pull only fails the update if it was canceled;
+// the rebase pulls what is missing.
+func (dn *Daemon) pullOSImage(ctx context.Context, imgURL string) error {
+	if isLocalOSImage(imgURL) {
+		return nil
+	}
+	logSystem("Pulling OS image %s", imgURL)
+	if err := dn.prefetchOSImage(ctx, imgURL, 0); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("pulling OS image %s: %w", imgURL, ctx.Err())
+		}
+		klog.Warningf("Failed to pull OS image %s ahead of the rebase: %v", imgURL, err)
+	}
+	return nil
+}
+
 // reboot is the final step. it tells systemd-logind to reboot the machine,
 // cleans up the agent's connections
 // on failure to reboot, it throws an error and waits for the operator to try again
@@ -2222,7 +2511,7 @@ func (dn *Daemon) reboot(rationale string) error {
 	return nil
 }
 
-func (dn *CoreOSDaemon) applyLayeredOSChanges(mcDiff machineConfigDiff, oldConfig, newConfig *mcfgv1.MachineConfig) (retErr error) {
+func (dn *CoreOSDaemon) applyLayeredOSChanges(ctx context.Context, mcDiff machineConfigDiff, oldConfig, newConfig *mcfgv1.MachineConfig) (retErr error) {
 	// Override the computed diff if the booted state differs from the oldConfig
 	// https://issues.redhat.com/browse/OCPBUGS-2757
 	if mcDiff.osUpdate && dn.bootedOSImageURL == newConfig.Spec.OSImageURL {
@@ -2274,6 +2563,9 @@ func (dn *CoreOSDaemon) applyLayeredOSChanges(mcDiff machineConfigDiff, oldConfi
 	// If we have an OS update *or* a kernel type change, then we must undo the kernel swap
 	// enablement.
 	if mcDiff.osUpdate || mcDiff.kernelType {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := dn.queueRevertKernelSwap(); err != nil {
 			mcdPivotErr.Inc()
 			return err
@@ -2282,7 +2574,7 @@ func (dn *CoreOSDaemon) applyLayeredOSChanges(mcDiff machineConfigDiff, oldConfi
 
 	// Update OS
 	if mcDiff.osUpdate {
-		if err := dn.updateLayeredOS(newConfig); err != nil {
+		if err := dn.updateLayeredOS(ctx, newConfig); err != nil {
 			mcdPivotErr.Inc()
 			return err
 		}
@@ -2300,18 +2592,18 @@ func (dn *CoreOSDaemon) applyLayeredOSChanges(mcDiff machineConfigDiff, oldConfi
 	mcdPivotErr.Set(0)
 
 	if mcDiff.kargs {
-		if err := dn.updateKernelArguments(oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments); err != nil {
+		if err := dn.updateKernelArguments(ctx, oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments); err != nil {
 			return err
 		}
 	}
 
 	// Switch to real time kernel
 	if mcDiff.osUpdate || mcDiff.kernelType {
-		if err := dn.switchKernel(oldConfig, newConfig); err != nil {
+		if err := dn.switchKernel(ctx, oldConfig, newConfig); err != nil {
 			return err
 		}
 	}
 
 	// Apply extensions
-	return dn.applyExtensions(oldConfig, newConfig)
+	return dn.applyExtensions(ctx, oldConfig, newConfig)
 }
@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// updateJournalPath records the progress of an update in device agent mode,
+// so an update interrupted by e.g. a power loss can be detected and dealt with
+// on the next invocation.
+var updateJournalPath = "/etc/machine-config-daemon/update-journal.json"
+
+// Recovery actions taken for an interrupted update
+const (
+	// RecoveryActionCompleted means all phases had completed and only the
+	// cleanup was left to do.
+	RecoveryActionCompleted = "completed"
+	// RecoveryActionRolledBack means the update was undone using its snapshot.
+	RecoveryActionRolledBack = "rolled back"
+)
+
+// updateJournal is the on-disk record of an update in progress.
+type updateJournal struct {
+	OldConfigName string `json:"oldConfigName"`
+	NewConfigName string `json:"newConfigName"`
+	// CompletedPhase is the last phase that completed successfully.
+	CompletedPhase UpdatePhase `json:"completedPhase"`
+	StartedAt      time.Time   `json:"startedAt"`
+}
+
+// UpdateRecovery describes how an interrupted update was dealt with.
+type UpdateRecovery struct {
+	OldConfigName  string      `json:"oldConfigName"`
+	NewConfigName  string      `json:"newConfigName"`
+	CompletedPhase UpdatePhase `json:"completedPhase"`
+	// Action is one of the RecoveryAction* constants.
+	Action string `json:"action"`
+}
+
+func startUpdateJournal(oldConfigName, newConfigName string) (*updateJournal, error) {
+	j := &updateJournal{
+		OldConfigName:  oldConfigName,
+		NewConfigName:  newConfigName,
+		CompletedPhase: UpdatePhasePlan,
+		StartedAt:      time.Now().UTC(),
+	}
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func loadUpdateJournal() (*updateJournal, error) {
+	b, err := os.ReadFile(updateJournalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading update journal: %w", err)
+	}
+	j := &updateJournal{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("parsing update journal: %w", err)
+	}
+	return j, nil
+}
+
+func (j *updateJournal) save() error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("marshalling update journal: %w", err)
+	}
+	if err := writeFileAtomicallyWithDefaults(updateJournalPath, b); err != nil {
+		return fmt.Errorf("writing update journal: %w", err)
+	}
+	return nil
+}
+
+// markCompleted records that phase has completed.
+func (j *updateJournal) markCompleted(phase UpdatePhase) error {
+	j.CompletedPhase = phase
+	return j.save()
+}
+
+func removeUpdateJournal() error {
+	if err := os.Remove(updateJournalPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing update journal: %w", err)
+	}
+	return nil
+}
+
+// RecoverInterruptedUpdate checks for an update in device agent mode that was
+// interrupted before it could finish, and brings the system back into a
+// consistent state: if every phase had completed, the update is kept and only
+// cleaned up; otherwise it is rolled back to its snapshot. It returns nil if
+// there was nothing to recover. RunOnceInDeviceAgentMode calls this before
+// applying a new update.
+func (dn *Daemon) RecoverInterruptedUpdate() (*UpdateRecovery, error) {
+	j, err := loadUpdateJournal()
+	if err != nil || j == nil {
+		return nil, err
+	}
+
+	recovery := &UpdateRecovery{
+		OldConfigName:  j.OldConfigName,
+		NewConfigName:  j.NewConfigName,
+		CompletedPhase: j.CompletedPhase,
+	}
+	logSystem("Found interrupted update from %s to %s (last completed phase: %s)", j.OldConfigName, j.NewConfigName, j.CompletedPhase)
+
+	snap, err := loadUpdateSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	if j.CompletedPhase == UpdatePhaseFinalize {
+		recovery.Action = RecoveryActionCompleted
+		if snap != nil {
+			if err := dn.discardUpdateSnapshot(snap); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		recovery.Action = RecoveryActionRolledBack
+		if snap != nil {
+			if err := dn.restoreUpdateSnapshot(snap); err != nil {
+				return nil, fmt.Errorf("rolling back interrupted update: %w", err)
+			}
+		} else {
+			// Without a snapshot, nothing was touched yet
+			klog.Warningf("No snapshot found for interrupted update, nothing to roll back")
+		}
+	}
+
+	if err := removeUpdateJournal(); err != nil {
+		return nil, err
+	}
+	logSystem("Interrupted update from %s to %s has been %s", j.OldConfigName, j.NewConfigName, recovery.Action)
+	return recovery, nil
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverInterruptedUpdate(t *testing.T) {
+	tests := []struct {
+		completedPhase   UpdatePhase
+		expectedAction   string
+		expectedContents string
+	}{
+		{
+			completedPhase:   UpdatePhaseFiles,
+			expectedAction:   RecoveryActionRolledBack,
+			expectedContents: "old",
+		},
+		{
+			completedPhase:   UpdatePhaseFinalize,
+			expectedAction:   RecoveryActionCompleted,
+			expectedContents: "new",
+		},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("case#%d", idx), func(t *testing.T) {
+			testDir, cleanup := setupTempDirWithEtc(t)
+			defer cleanup()
+
+			d := newMockDeviceAgentDaemon(testDir)
+
+			// Nothing to do without a journal
+			recovery, err := d.RecoverInterruptedUpdate()
+			require.Nil(t, err)
+			assert.Nil(t, recovery)
+
+			filePath := filepath.Join(testDir, "etc", "interrupted")
+			require.Nil(t, os.WriteFile(filePath, []byte("old"), 0o644))
+
+			// Simulate an update that got interrupted after completedPhase
+			_, err = d.takeUpdateSnapshot([]string{filePath}, false)
+			require.Nil(t, err)
+			journal, err := startUpdateJournal("old", "new")
+			require.Nil(t, err)
+			require.Nil(t, os.WriteFile(filePath, []byte("new"), 0o644))
+			require.Nil(t, journal.markCompleted(test.completedPhase))
+
+			recovery, err = d.RecoverInterruptedUpdate()
+			require.Nil(t, err)
+			assert.Equal(t, &UpdateRecovery{
+				OldConfigName:  "old",
+				NewConfigName:  "new",
+				CompletedPhase: test.completedPhase,
+				Action:         test.expectedAction,
+			}, recovery)
+
+			contents, err := os.ReadFile(filePath)
+			require.Nil(t, err)
+			assert.Equal(t, test.expectedContents, string(contents))
+			assert.NoFileExists(t, updateJournalPath)
+			assert.NoDirExists(t, snapshotParentDirPath)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// updateLockPath is locked for the duration of an update that runs outside of
+// the cluster driven sync loop, so e.g. a device agent and the firstboot
+// service can't apply configs concurrently.
+var updateLockPath = "/run/machine-config-daemon/update.lock"
+
+// ErrUpdateInProgress is returned when another process holds the update lock.
+var ErrUpdateInProgress = errors.New("another update is already in progress")
+
+// acquireUpdateLock takes an exclusive flock on updateLockPath without
+// blocking. The returned function releases the lock. The lock is tied to the
+// open file, so it is also released if the process dies.
+func acquireUpdateLock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(updateLockPath), 0o755); err != nil {
+		return nil, fmt.Errorf("creating update lock directory: %w", err)
+	}
+	f, err := os.OpenFile(updateLockPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening update lock %s: %w", updateLockPath, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%s is locked: %w", updateLockPath, ErrUpdateInProgress)
+		}
+		return nil, fmt.Errorf("locking %s: %w", updateLockPath, err)
+	}
+	klog.V(2).Infof("Acquired update lock %s", updateLockPath)
+
+	return func() {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			klog.Warningf("Failed to release update lock %s: %v", updateLockPath, err)
+		}
+		f.Close()
+	}, nil
+}
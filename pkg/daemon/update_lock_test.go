@@ -0,0 +1,30 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateLock(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+
+	release, err := acquireUpdateLock()
+	require.Nil(t, err)
+
+	_, err = acquireUpdateLock()
+	assert.ErrorIs(t, err, ErrUpdateInProgress)
+
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newDeviceAgentTestConfig(t, "new", nil, nil), deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.ErrorIs(t, err, ErrUpdateInProgress)
+
+	release()
+
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), nil, newDeviceAgentTestConfig(t, "new", nil, nil), deviceAgentTestSelector, DefaultUpdatePolicy())
+	assert.Nil(t, err)
+}
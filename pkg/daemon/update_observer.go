@@ -0,0 +1,74 @@
+package daemon
+
+// UpdatePhase identifies a step of an update in device agent mode.
+type UpdatePhase string
+
+const (
+	// UpdatePhasePlan parses and diffs the configs and computes the actions to take.
+	UpdatePhasePlan UpdatePhase = "plan"
+	// UpdatePhaseDrain drains the node, if required and connected to a cluster.
+	UpdatePhaseDrain UpdatePhase = "drain"
+	// UpdatePhaseLUKS updates the key files and Clevis bindings of LUKS
+	// volumes.
+	UpdatePhaseLUKS UpdatePhase = "luks"
+	// UpdatePhaseFilesystems formats and mounts data disks.
+	UpdatePhaseFilesystems UpdatePhase = "filesystems"
+	// UpdatePhaseFiles writes and removes files.
+	UpdatePhaseFiles UpdatePhase = "files"
+	// UpdatePhaseUnits reloads systemd and restarts changed units.
+	UpdatePhaseUnits UpdatePhase = "units"
+	// UpdatePhasePasswd updates SSH keys and password hashes.
+	UpdatePhasePasswd UpdatePhase = "passwd"
+	// UpdatePhaseOS applies OS image, kernel argument, kernel type and extension changes.
+	UpdatePhaseOS UpdatePhase = "os"
+	// UpdatePhaseFileModes corrects drifted modes and ownership of managed
+	// files, if the UpdatePolicy asks for it.
+	UpdatePhaseFileModes UpdatePhase = "fileModes"
+	// UpdatePhaseFinalize stores the new config as the current config on disk.
+	UpdatePhaseFinalize UpdatePhase = "finalize"
+)
+
+// UpdateObserver receives progress notifications while the daemon applies an
+// update, so an embedding device agent can stream live progress to its
+// management plane. Callbacks are invoked synchronously from the update and
+// should return quickly.
+type UpdateObserver interface {
+	// OnPhaseStart is called when the update enters a new phase.
+	OnPhaseStart(phase UpdatePhase)
+	// OnFileWritten is called after a file has been written to disk.
+	OnFileWritten(path string)
+	// OnOSChange is called before an OS level change is applied.
+	OnOSChange(change string)
+	// OnError is called once if the update fails, with the phase it failed in.
+	OnError(phase UpdatePhase, err error)
+}
+
+// RegisterUpdateObserver registers an observer to be notified of the progress
+// of subsequent updates. It must not be called while an update is running.
+func (dn *Daemon) RegisterUpdateObserver(observer UpdateObserver) {
+	dn.updateObservers = append(dn.updateObservers, observer)
+}
+
+func (dn *Daemon) notifyPhaseStart(phase UpdatePhase) {
+	for _, o := range dn.updateObservers {
+		o.OnPhaseStart(phase)
+	}
+}
+
+func (dn *Daemon) notifyFileWritten(path string) {
+	for _, o := range dn.updateObservers {
+		o.OnFileWritten(path)
+	}
+}
+
+func (dn *Daemon) notifyOSChange(change string) {
+	for _, o := range dn.updateObservers {
+		o.OnOSChange(change)
+	}
+}
+
+func (dn *Daemon) notifyError(phase UpdatePhase, err error) {
+	for _, o := range dn.updateObservers {
+		o.OnError(phase, err)
+	}
+}
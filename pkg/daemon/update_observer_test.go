@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingUpdateObserver struct {
+	phases       []UpdatePhase
+	filesWritten []string
+	osChanges    []string
+	errPhase     UpdatePhase
+	err          error
+}
+
+func (o *recordingUpdateObserver) OnPhaseStart(phase UpdatePhase) {
+	o.phases = append(o.phases, phase)
+}
+
+func (o *recordingUpdateObserver) OnFileWritten(path string) {
+	o.filesWritten = append(o.filesWritten, path)
+}
+
+func (o *recordingUpdateObserver) OnOSChange(change string) {
+	o.osChanges = append(o.osChanges, change)
+}
+
+func (o *recordingUpdateObserver) OnError(phase UpdatePhase, err error) {
+	o.errPhase = phase
+	o.err = err
+}
+
+func TestUpdateObserver(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	observer := &recordingUpdateObserver{}
+	d.RegisterUpdateObserver(observer)
+
+	filePath := filepath.Join(testDir, "etc", "observed")
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{newDeviceAgentTestFile(t, filePath, "observed")}, nil)
+
+	_, err := d.RunOnceInDeviceAgentMode(context.TODO(), nil, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.Nil(t, err)
+	assert.Equal(t, []UpdatePhase{UpdatePhasePlan, UpdatePhaseFiles, UpdatePhasePasswd, UpdatePhaseFinalize}, observer.phases)
+	assert.Equal(t, []string{filePath}, observer.filesWritten)
+	assert.Nil(t, observer.err)
+
+	// An unreconcilable config fails in the plan phase
+	badIgn := ctrlcommon.NewIgnConfig()
+	badIgn.Storage.Disks = []ign3types.Disk{{Device: "/dev/sda"}}
+	badConfig := helpers.CreateMachineConfigFromIgnition(badIgn)
+
+	observer = &recordingUpdateObserver{}
+	d.updateObservers = nil
+	d.RegisterUpdateObserver(observer)
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), newConfig, badConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.NotNil(t, err)
+	assert.Equal(t, UpdatePhasePlan, observer.errPhase)
+	assert.Equal(t, err, observer.err)
+}
@@ -0,0 +1,480 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	kubeErrs "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+)
+
+const (
+	// snapshotManifestName is the name of the file describing a snapshot
+	snapshotManifestName = "manifest.json"
+	// shadowFilePath holds the password hashes modified by SetPasswordHash
+	shadowFilePath = "/etc/shadow"
+)
+
+// snapshotParentDirPath is where the files captured before an update in device
+// agent mode are kept until the update either succeeds or is rolled back.
+var snapshotParentDirPath = "/etc/machine-config-daemon/snapshot"
+
+// snapshotEntry records the pre-update state of a single path.
+type snapshotEntry struct {
+	Path string `json:"path"`
+	// Exists is false if the path did not exist before the update, in which
+	// case restoring the snapshot removes it.
+	Exists bool `json:"exists"`
+	// Dir is true if the path was a directory. Only the mode and ownership of
+	// directories are captured, not their contents.
+	Dir  bool        `json:"dir,omitempty"`
+	Mode os.FileMode `json:"mode,omitempty"`
+	UID  int         `json:"uid,omitempty"`
+	GID  int         `json:"gid,omitempty"`
+}
+
+// updateSnapshot captures the on-disk state touched by an update, so a failed
+// update can be undone in one step rather than by replaying the update in
+// reverse.
+type updateSnapshot struct {
+	Entries []snapshotEntry `json:"entries"`
+	// PinnedDeployment is true if the booted ostree deployment was pinned
+	// for the duration of the update.
+	PinnedDeployment bool `json:"pinnedDeployment,omitempty"`
+	// PinnedDeploymentID is the ID of the pinned deployment, as
+	// checksum.serial.
+	PinnedDeploymentID string `json:"pinnedDeploymentID,omitempty"`
+	// PinnedByUser is true if the booted deployment was pinned already, not
+	// by the daemon, in which case the update leaves its pin alone.
+	PinnedByUser bool `json:"pinnedByUser,omitempty"`
+	// KeepPinned is true once the update staged OS changes, after which the
+	// pinned deployment is kept pinned as rollback target until
+	// UnpinPreviousDeployment.
+	KeepPinned bool `json:"keepPinned,omitempty"`
+	// PendingDeployment is true if a pending deployment already existed
+	// before the update, in which case it is not cleaned up on restore.
+	PendingDeployment bool `json:"pendingDeployment,omitempty"`
+	// ReloadSystemd is true if the snapshot contains units systemd needs to
+	// reload after a restore.
+	ReloadSystemd bool `json:"reloadSystemd,omitempty"`
+	// RefreshSysext is true if the update refreshes the system extensions,
+	// which are refreshed again after a restore.
+	RefreshSysext bool `json:"refreshSysext,omitempty"`
+}
+
+func snapshotFileName(fpath string) string {
+	return filepath.Join(snapshotParentDirPath, "files", fpath)
+}
+
+// snapshotPaths returns the paths that are touched when applying the given
+// plan: changed files along with their orig/noorig bookkeeping, SSH keys and
+// password hashes, filesystem mount units, /etc/hosts and /etc/resolv.conf,
+// trust anchors, the boot health check, the staged update record, the on-disk
+// current config and its digest and the managed files inventory.
+func (dn *Daemon) snapshotPaths(plan *deviceAgentPlan) []string {
+	var paths []string
+	for _, path := range plan.diffFileSet {
+		paths = append(paths, path, origFileName(path), noOrigFileStampName(path))
+	}
+	if plan.diff.passwd {
+		paths = append(paths, constants.RHCOS8SSHKeyPath, constants.RHCOS9SSHKeyPath)
+	}
+	if plan.manageUnits {
+		for _, path := range append(unitPaths(&plan.oldIgnConfig, plan.result.UnitsChanged), unitPaths(&plan.newIgnConfig, plan.result.UnitsChanged)...) {
+			paths = append(paths, path, origFileName(path), noOrigFileStampName(path))
+		}
+		paths = append(paths, serviceEnvDropinPaths(plan.result.PostConfigChangeActions)...)
+	}
+	if len(plan.oldIgnConfig.Passwd.Users) > 0 || len(plan.newIgnConfig.Passwd.Users) > 0 {
+		paths = append(paths, shadowFilePath)
+	}
+	paths = append(paths, filesystemUnitPaths(append(plan.oldFilesystems, plan.newFilesystems...))...)
+	if plan.userUnits != nil {
+		paths = append(paths, userUnitPaths(plan.userUnits)...)
+	}
+	if plan.nameResolution != nil {
+		paths = append(paths, hostsFilePath, resolvConfPath)
+	}
+	if plan.trustAnchors != nil {
+		paths = append(paths, trustAnchorPaths(plan.trustAnchors)...)
+	}
+	paths = append(paths, dn.bootHealthPaths()...)
+	paths = append(paths, dn.stagedUpdatePaths(plan)...)
+	return append(paths, dn.currentConfigPath, dn.currentConfigDigestPath(), dn.currentImagePath, managedFilesPath)
+}
+
+// takeUpdateSnapshot copies the given paths aside, except for existing system
+// extension images, and, on CoreOS, pins the booted deployment so it can't be
+// garbage collected while the update runs. Any previous snapshot is discarded.
+func (dn *Daemon) takeUpdateSnapshot(paths []string, reloadSystemd bool) (*updateSnapshot, error) {
+	if err := os.RemoveAll(snapshotParentDirPath); err != nil {
+		return nil, fmt.Errorf("removing stale snapshot: %w", err)
+	}
+	if err := os.MkdirAll(snapshotParentDirPath, defaultDirectoryPermissions); err != nil {
+		return nil, fmt.Errorf("creating snapshot directory: %w", err)
+	}
+
+	snap := &updateSnapshot{ReloadSystemd: reloadSystemd}
+	seen := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		seen[path] = struct{}{}
+
+		entry := snapshotEntry{Path: path}
+		if info, err := os.Lstat(path); err == nil {
+			entry.Exists = true
+			if isSysextImage(path) {
+				// Copying images would double the space they take, so
+				// only the images an update adds are undone
+				klog.Infof("Not taking snapshot of system extension image %q", path)
+				continue
+			}
+			if info.IsDir() {
+				stat := info.Sys().(*syscall.Stat_t)
+				entry.Dir = true
+				entry.Mode = info.Mode()
+				entry.UID, entry.GID = int(stat.Uid), int(stat.Gid)
+			} else if err := copyPreservingAttributes(path, snapshotFileName(path)); err != nil {
+				return nil, fmt.Errorf("taking snapshot of %q: %w", path, err)
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("taking snapshot of %q: %w", path, err)
+		}
+		snap.Entries = append(snap.Entries, entry)
+	}
+
+	if dn.updatesOS() {
+		staged, err := dn.getOSUpdater().HasStagedUpdate()
+		if err != nil {
+			return nil, err
+		}
+		snap.PendingDeployment = staged
+	}
+	if dn.updatesOSWithOstree() {
+		id, err := userPinnedBootedDeployment()
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			klog.Infof("Booted deployment %s is pinned already, leaving its pin alone", id)
+			snap.PinnedByUser = true
+		} else if id, err = dn.pinBootedDeployment(true); err != nil {
+			return nil, err
+		}
+		snap.PinnedDeployment = true
+		snap.PinnedDeploymentID = id
+	}
+
+	if err := snap.save(); err != nil {
+		return nil, err
+	}
+	klog.Infof("Took snapshot of %d paths before update", len(snap.Entries))
+	return snap, nil
+}
+
+// loadUpdateSnapshot reads back a snapshot left on disk, e.g. by an update
+// that was interrupted. It returns nil if there is no snapshot.
+func loadUpdateSnapshot() (*updateSnapshot, error) {
+	b, err := os.ReadFile(filepath.Join(snapshotParentDirPath, snapshotManifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot manifest: %w", err)
+	}
+	snap := &updateSnapshot{}
+	if err := json.Unmarshal(b, snap); err != nil {
+		return nil, fmt.Errorf("parsing snapshot manifest: %w", err)
+	}
+	return snap, nil
+}
+
+func (snap *updateSnapshot) save() error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("marshalling snapshot manifest: %w", err)
+	}
+	return writeFileAtomicallyWithDefaults(filepath.Join(snapshotParentDirPath, snapshotManifestName), b)
+}
+
+// restoreUpdateSnapshot puts every captured path back into its pre-update
+// state, removes any OS deployment staged by the update and releases the
+// snapshot. It attempts to restore as much as possible before reporting errors.
+func (dn *Daemon) restoreUpdateSnapshot(snap *updateSnapshot) error {
+	var errs []error
+	var removed []string
+	for _, entry := range snap.Entries {
+		switch {
+		case !entry.Exists:
+			removed = append(removed, entry.Path)
+		case entry.Dir:
+			if err := restoreSnapshotDir(entry); err != nil {
+				errs = append(errs, fmt.Errorf("restoring directory %q: %w", entry.Path, err))
+			}
+		default:
+			// Don't write the old contents through a link created by the update
+			if info, err := os.Lstat(entry.Path); err == nil && isLink(info) {
+				if err := os.Remove(entry.Path); err != nil {
+					errs = append(errs, fmt.Errorf("removing link %q: %w", entry.Path, err))
+					continue
+				}
+			}
+			if err := copyPreservingAttributes(snapshotFileName(entry.Path), entry.Path); err != nil {
+				errs = append(errs, fmt.Errorf("restoring %q: %w", entry.Path, err))
+			}
+		}
+	}
+	// Deepest first, so directories created by the update are emptied before
+	// they are removed themselves
+	sort.Slice(removed, func(i, j int) bool {
+		return len(removed[i]) > len(removed[j])
+	})
+	for _, path := range removed {
+		err := os.Remove(path)
+		switch {
+		case err == nil, errors.Is(err, fs.ErrNotExist):
+		case errors.Is(err, syscall.ENOTEMPTY), errors.Is(err, syscall.EEXIST):
+			klog.Warningf("Not removing directory %q created by the update: it is not empty", path)
+		default:
+			errs = append(errs, fmt.Errorf("removing %q: %w", path, err))
+		}
+	}
+
+	if snap.ReloadSystemd {
+		if err := runCmdSync("systemctl", "daemon-reload"); err != nil {
+			errs = append(errs, fmt.Errorf("reloading systemd: %w", err))
+		}
+	}
+	if snap.RefreshSysext {
+		if err := refreshSysext(); err != nil {
+			errs = append(errs, fmt.Errorf("refreshing system extensions: %w", err))
+		}
+	}
+
+	if !snap.PendingDeployment {
+		if err := dn.getOSUpdater().DiscardStagedUpdate(); err != nil {
+			errs = append(errs, fmt.Errorf("removing pending deployment: %w", err))
+		}
+	}
+
+	if len(errs) != 0 {
+		// Keep the snapshot around so the restore can be retried
+		return kubeErrs.NewAggregate(errs)
+	}
+	logSystem("Restored snapshot of %d paths", len(snap.Entries))
+	// Without the staged OS changes there is nothing to roll back from
+	snap.KeepPinned = false
+	return dn.discardUpdateSnapshot(snap)
+}
+
+// isLink returns true if info is of a symbolic link, or of a file with more
+// than one hard link.
+func isLink(info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return true
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && stat.Nlink > 1
+}
+
+// restoreSnapshotDir restores the mode and ownership of a directory, creating
+// it again if the update replaced it.
+func restoreSnapshotDir(entry snapshotEntry) error {
+	info, err := os.Lstat(entry.Path)
+	switch {
+	case err == nil && !info.IsDir():
+		if err := os.Remove(entry.Path); err != nil {
+			return err
+		}
+		fallthrough
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(entry.Path, entry.Mode.Perm()); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	if err := unix.Chmod(entry.Path, fileModeToUnix(entry.Mode)); err != nil {
+		return err
+	}
+	return os.Lchown(entry.Path, entry.UID, entry.GID)
+}
+
+// fileModeToUnix returns the permission, setuid, setgid and sticky bits of
+// mode as the kernel expects them.
+func fileModeToUnix(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
+// discardUpdateSnapshot drops a snapshot once it is no longer needed and
+// unpins the deployment pinned for the update, unless it is kept as rollback
+// target.
+func (dn *Daemon) discardUpdateSnapshot(snap *updateSnapshot) error {
+	if snap.PinnedDeployment {
+		if err := dn.releaseSnapshotPin(snap); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(snapshotParentDirPath); err != nil {
+		return fmt.Errorf("removing snapshot: %w", err)
+	}
+	return nil
+}
+
+// ostreeDeployments returns the IDs of the ostree deployments, as
+// checksum.serial in the order ostree indexes them, and the index of the
+// booted one, or -1.
+func (dn *Daemon) ostreeDeployments() ([]string, int, error) {
+	if dn.bootc != nil {
+		out, err := runGetOut("ostree", "admin", "status")
+		if err != nil {
+			return nil, -1, fmt.Errorf("querying deployments: %w", err)
+		}
+		ids, booted := parseOstreeAdminStatus(string(out))
+		return ids, booted, nil
+	}
+	status, err := dn.NodeUpdaterClient.Peel().QueryStatus()
+	if err != nil {
+		return nil, -1, fmt.Errorf("querying deployments: %w", err)
+	}
+	ids := make([]string, 0, len(status.Deployments))
+	booted := -1
+	for i, d := range status.Deployments {
+		ids = append(ids, fmt.Sprintf("%s.%d", d.Checksum, d.Serial))
+		if d.Booted {
+			booted = i
+		}
+	}
+	return ids, booted, nil
+}
+
+// ostreeDeployment is a deployment in ostree admin status output.
+type ostreeDeployment struct {
+	// ID is checksum.serial.
+	ID     string
+	Booted bool
+	// Staged is true for deployments staged or pending for the next boot.
+	Staged bool
+	Pinned bool
+}
+
+// parseOstreeDeployments returns the deployments in ostree admin status
+// output, in the order ostree indexes them.
+func parseOstreeDeployments(status string) []ostreeDeployment {
+	var deployments []ostreeDeployment
+	for _, line := range strings.Split(status, "\n") {
+		if len(line) < 3 {
+			continue
+		}
+		// Deployments are indented by two, their details further
+		if line[2] == ' ' {
+			if len(deployments) > 0 && strings.TrimSpace(line) == "Pinned: yes" {
+				deployments[len(deployments)-1].Pinned = true
+			}
+			continue
+		}
+		fields := strings.Fields(line[2:])
+		if len(fields) < 2 {
+			continue
+		}
+		deployments = append(deployments, ostreeDeployment{
+			ID:     fields[1],
+			Booted: strings.HasPrefix(line, "* "),
+			Staged: len(fields) > 2 && (fields[2] == "(staged)" || fields[2] == "(pending)"),
+		})
+	}
+	return deployments
+}
+
+// parseOstreeAdminStatus returns the IDs of the deployments in ostree admin
+// status output and the index of the booted one, or -1.
+func parseOstreeAdminStatus(status string) ([]string, int) {
+	var ids []string
+	booted := -1
+	for i, d := range parseOstreeDeployments(status) {
+		if d.Booted {
+			booted = i
+		}
+		ids = append(ids, d.ID)
+	}
+	return ids, booted
+}
+
+// pinBootedDeployment pins or unpins the booted ostree deployment and returns
+// its ID.
+func (dn *Daemon) pinBootedDeployment(pin bool) (string, error) {
+	ids, booted, err := dn.ostreeDeployments()
+	if err != nil {
+		return "", err
+	}
+	if booted < 0 {
+		return "", fmt.Errorf("no booted deployment found")
+	}
+	if err := pinOstreeDeployment(booted, pin); err != nil {
+		return "", err
+	}
+	return ids[booted], nil
+}
+
+// unpinOstreeDeployment unpins the deployment with id, unless it was removed
+// already.
+func (dn *Daemon) unpinOstreeDeployment(id string) error {
+	ids, _, err := dn.ostreeDeployments()
+	if err != nil {
+		return err
+	}
+	for i := range ids {
+		if ids[i] == id {
+			return pinOstreeDeployment(i, false)
+		}
+	}
+	klog.Infof("Pinned deployment %s no longer exists", id)
+	return nil
+}
+
+func pinOstreeDeployment(idx int, pin bool) error {
+	args := []string{"admin", "pin"}
+	if !pin {
+		args = append(args, "--unpin")
+	}
+	if err := runCmdSync("ostree", append(args, strconv.Itoa(idx))...); err != nil {
+		return fmt.Errorf("pinning deployment %d: %w", idx, err)
+	}
+	return nil
+}
+
+// copyPreservingAttributes copies src to dst, keeping mode, ownership and
+// timestamps and creating dst's parent directories as needed.
+func copyPreservingAttributes(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), defaultDirectoryPermissions); err != nil {
+		return err
+	}
+	if out, err := exec.Command("cp", "-a", "--reflink=auto", src, dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("copying %q to %q: %s: %w", src, dst, string(out), err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStatusReporter fails to record a successful update, which lets tests
+// exercise the rollback of an otherwise complete update.
+type failingStatusReporter struct {
+	noopStatusReporter
+}
+
+func (failingStatusReporter) SetDone(string) error {
+	return fmt.Errorf("status unavailable")
+}
+
+func TestDeviceAgentModeSnapshotRollback(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDeviceAgentDaemon(testDir)
+	d.SetStatusReporter(failingStatusReporter{})
+
+	changedPath := filepath.Join(testDir, "etc", "changed")
+	removedPath := filepath.Join(testDir, "etc", "removed")
+	addedPath := filepath.Join(testDir, "etc", "added")
+
+	oldConfig := newDeviceAgentTestConfig(t, "old", []ign3types.File{
+		newDeviceAgentTestFile(t, changedPath, "old"),
+		newDeviceAgentTestFile(t, removedPath, "removed"),
+	}, nil)
+	oldIgn, err := ctrlcommon.ParseAndConvertConfig(oldConfig.Spec.Config.Raw)
+	require.Nil(t, err)
+	require.Nil(t, d.writeFiles(context.TODO(), oldIgn.Storage.Files, nil, true))
+
+	newConfig := newDeviceAgentTestConfig(t, "new", []ign3types.File{
+		newDeviceAgentTestFile(t, changedPath, "new"),
+		newDeviceAgentTestFile(t, addedPath, "added"),
+	}, nil)
+
+	_, err = d.RunOnceInDeviceAgentMode(context.TODO(), oldConfig, newConfig, deviceAgentTestSelector, DefaultUpdatePolicy())
+	require.NotNil(t, err)
+
+	contents, err := os.ReadFile(changedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "old", string(contents))
+	contents, err = os.ReadFile(removedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "removed", string(contents))
+	assert.NoFileExists(t, addedPath)
+	assert.NoFileExists(t, d.currentConfigPath)
+
+	// The snapshot is released once it has been restored
+	assert.NoDirExists(t, snapshotParentDirPath)
+}
@@ -0,0 +1,256 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_4/types"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// stagedFilesDirPath is where the files of an update are written before they
+// are swapped into place. It mirrors the paths of the files it holds.
+var stagedFilesDirPath = "/etc/machine-config-daemon/staged-files"
+
+// selinuxEnforcePath only exists if SELinux is enabled.
+var selinuxEnforcePath = "/sys/fs/selinux/enforce"
+
+// stagedFile is a file written to the staging tree, waiting to be swapped
+// into place.
+type stagedFile struct {
+	path       string
+	stagedPath string
+	mode       os.FileMode
+	uid, gid   int
+	xattrs     map[string][]byte
+	// delta, if set, updates the file in place instead, with nothing staged
+	delta *deltaWrite
+}
+
+// stageFiles writes files into the staging tree, with their final mode,
+// ownership and extended attributes, without touching their actual paths.
+// Contents referencing http(s) URLs are fetched with fetcher, if given. Large
+// files are copied from store, if given, when it already has their contents,
+// or else staged to be updated in place, or fetched by their changed blocks,
+// if deltaWrites is set. It stops between files once ctx is done.
+func stageFiles(ctx context.Context, files []ign3types.File, xattrs fileXattrs, fetcher *remoteFetcher, store *contentStore, deltaWrites, skipCertificateWrite bool) ([]stagedFile, error) {
+	if err := os.RemoveAll(stagedFilesDirPath); err != nil {
+		return nil, fmt.Errorf("removing stale staged files: %w", err)
+	}
+
+	owners := newOwnershipResolver(files)
+	staged := make([]stagedFile, 0, len(files))
+	stored := sets.Set[string]{}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if skipCertificateWrite && file.Path == caBundleFilePath {
+			// TODO remove this special case once we have a better way to do this
+			klog.V(4).Infof("Skipping file %s during writeFiles", caBundleFilePath)
+			continue
+		}
+		klog.Infof("Staging file %q", file.Path)
+
+		// We don't support appends in the file section, so instead of waiting to fail validation,
+		// let's explicitly fail here.
+		if len(file.Append) > 0 {
+			return nil, &ErrFileWrite{Path: file.Path, Err: fmt.Errorf("found an append section when writing files. Append is not supported")}
+		}
+
+		mode := defaultFilePermissions
+		if file.Mode != nil {
+			mode = os.FileMode(*file.Mode)
+		}
+
+		// set chown if file information is provided
+		uid, gid, err := owners.nodeOwnership(file.Node)
+		if err != nil {
+			return nil, &ErrFileWrite{Path: file.Path, Err: fmt.Errorf("failed to retrieve file ownership for file %q: %w", file.Path, err)}
+		}
+
+		sf := stagedFile{
+			path:       file.Path,
+			stagedPath: filepath.Join(stagedFilesDirPath, file.Path),
+			mode:       mode,
+			uid:        uid,
+			gid:        gid,
+			xattrs:     xattrs[file.Path],
+		}
+		var storeKey string
+		if store != nil {
+			// Contents that fail to decode are reported when writing them
+			storeKey, _ = store.key(file)
+		}
+		if storeKey != "" {
+			stored.Insert(storeKey)
+			copied, err := store.copyTo(storeKey, sf.stagedPath, mode, uid, gid)
+			if err != nil {
+				return nil, &ErrFileWrite{Path: file.Path, Err: fmt.Errorf("staging file %q: %w", file.Path, err)}
+			}
+			if copied {
+				klog.Infof("Reusing stored contents for %q", file.Path)
+				if err := setXattrs(sf.stagedPath, sf.xattrs); err != nil {
+					return nil, &ErrFileWrite{Path: file.Path, Err: err}
+				}
+				staged = append(staged, sf)
+				continue
+			}
+		}
+		if deltaWrites {
+			// Contents that fail to decode are reported when writing them
+			if delta, err := planDeltaWrite(file); err == nil && delta != nil {
+				sf.delta = delta
+				staged = append(staged, sf)
+				continue
+			}
+		}
+		// Contents are streamed to the staging tree, so large files are
+		// never held in memory as a whole
+		var decodeErr error
+		if fetcher != nil && isRemoteSource(file.Contents.Source) {
+			if !deltaWrites || !fetcher.fetchDelta(ctx, file, sf.stagedPath, mode, uid, gid) {
+				decodeErr = fetcher.fetch(ctx, file, sf.stagedPath, mode, uid, gid)
+			}
+		} else {
+			err = writeFileStreaming(sf.stagedPath, defaultDirectoryPermissions, mode, uid, gid, func(w io.Writer) error {
+				decodeErr = writeFileContents(file, w)
+				return decodeErr
+			})
+		}
+		var hashErr *ErrHashMismatch
+		if errors.As(decodeErr, &hashErr) {
+			return nil, decodeErr
+		}
+		if decodeErr != nil {
+			return nil, &ErrFileWrite{Path: file.Path, Err: fmt.Errorf("could not decode file %q: %w", file.Path, decodeErr)}
+		}
+		if err != nil {
+			return nil, &ErrFileWrite{Path: file.Path, Err: fmt.Errorf("staging file %q: %w", file.Path, err)}
+		}
+		if storeKey != "" {
+			store.add(storeKey, sf.stagedPath)
+		}
+		// rename keeps the extended attributes, so the file comes with them
+		if err := setXattrs(sf.stagedPath, sf.xattrs); err != nil {
+			return nil, &ErrFileWrite{Path: file.Path, Err: err}
+		}
+		staged = append(staged, sf)
+	}
+	if store != nil {
+		store.prune(stored)
+	}
+	return staged, nil
+}
+
+// swapStagedFile moves a staged file into place and relabels it. If the file
+// already exists, the two are exchanged atomically with
+// renameat2(RENAME_EXCHANGE) and the old contents are dropped from the staging
+// tree afterwards; a crash never leaves a half-written file behind. Files on
+// another filesystem than the staging tree, or on filesystems without
+// RENAME_EXCHANGE, are replaced atomically by a copy in their own directory
+// instead. Files staged as delta writes are updated in place.
+func swapStagedFile(sf stagedFile) error {
+	if sf.delta != nil {
+		if err := createOrigFile(sf.path, sf.path); err != nil {
+			return err
+		}
+		if err := applyDeltaWrite(sf); err != nil {
+			return err
+		}
+	} else if err := moveStagedFile(sf); err != nil {
+		return err
+	}
+	return restoreSELinuxLabel(sf)
+}
+
+func moveStagedFile(sf stagedFile) error {
+	dir := filepath.Dir(sf.path)
+	if err := os.MkdirAll(dir, defaultDirectoryPermissions); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+	if err := createOrigFile(sf.path, sf.path); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(sf.path)
+	switch {
+	case os.IsNotExist(err):
+		err = os.Rename(sf.stagedPath, sf.path)
+		if errors.Is(err, unix.EXDEV) {
+			return copyStagedFile(sf)
+		}
+		return err
+	case err != nil:
+		return err
+	case info.IsDir():
+		return fmt.Errorf("%q is a directory", sf.path)
+	}
+
+	err = unix.Renameat2(unix.AT_FDCWD, sf.stagedPath, unix.AT_FDCWD, sf.path, unix.RENAME_EXCHANGE)
+	switch {
+	case err == nil:
+		// The old file now lives in the staging tree
+		return os.Remove(sf.stagedPath)
+	case errors.Is(err, unix.EXDEV), errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOSYS):
+		return copyStagedFile(sf)
+	default:
+		return fmt.Errorf("exchanging %q with staged file: %w", sf.path, err)
+	}
+}
+
+// copyStagedFile atomically replaces the file at sf.path with a copy of its
+// staged contents.
+func copyStagedFile(sf stagedFile) error {
+	staged, err := os.Open(sf.stagedPath)
+	if err != nil {
+		return fmt.Errorf("reading staged file: %w", err)
+	}
+	defer staged.Close()
+	if err := writeFileStreaming(sf.path, defaultDirectoryPermissions, sf.mode, sf.uid, sf.gid, func(w io.Writer) error {
+		_, err := io.Copy(w, staged)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setXattrs(sf.path, sf.xattrs); err != nil {
+		return err
+	}
+	return os.Remove(sf.stagedPath)
+}
+
+func setXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			return fmt.Errorf("setting extended attribute %q on %q: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// restoreSELinuxLabel gives a file that was swapped into place the label the
+// policy has for its path, instead of the one of the staging tree it was
+// created in, unless it comes with a label of its own.
+func restoreSELinuxLabel(sf stagedFile) error {
+	if _, ok := sf.xattrs[xattrSELinux]; ok {
+		return nil
+	}
+	if _, err := os.Stat(selinuxEnforcePath); err != nil {
+		// SELinux is disabled
+		return nil
+	}
+	return runCmdSync("restorecon", sf.path)
+}
+
+func removeStagedFiles() error {
+	if err := os.RemoveAll(stagedFilesDirPath); err != nil {
+		return fmt.Errorf("removing staged files: %w", err)
+	}
+	return nil
+}
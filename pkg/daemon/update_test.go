@@ -3,6 +3,7 @@ package daemon
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -37,29 +39,83 @@ func newMockDaemon() Daemon {
 	}
 }
 
-func setupTempDirWithEtc(t *testing.T) (string, func()) {
+// testPathVars are the package path variables a testFixture moves below its
+// test directory, so files get written to our testing location.
+var testPathVars = []*string{
+	&origParentDirPath,
+	&noOrigParentDirPath,
+	&snapshotParentDirPath,
+	&updateJournalPath,
+	&updateLockPath,
+	&greenbootCheckPath,
+	&bootHealthPath,
+	&stagedUpdatePath,
+	&stagedFilesDirPath,
+	&selinuxEnforcePath,
+	&orphanedDirPath,
+	&managedFilesPath,
+	&preservedFilesPath,
+	&driftBackupDirPath,
+	&hostsFilePath,
+	&resolvConfPath,
+	&trustAnchorsDirPath,
+	&updateStatusPath,
+	&osImageOverridePath,
+	&pinnedDeploymentPath,
+	&usrHotfixesPath,
+	&osDeltaBundlesDirPath,
+	&osImageManifestPath,
+	&currentConfigHistoryDirPath,
+	&stateQuarantineDirPath,
+	&deploymentConfigsDirPath,
+	&ostreeDeployDir,
+}
+
+// testFixture is a test directory with the package path variables pointing
+// below it.
+type testFixture struct {
+	dir                 string
+	paths               map[*string]string
+	withWritableSysroot func(fn func() error) error
+}
+
+// newTestFixture makes a temp dir with an etc dir, and overrides testPathVars
+// and withWritableSysroot for it until cleanup.
+func newTestFixture(t *testing.T) *testFixture {
 	t.Helper()
 
 	// Make a temp dir to put the testing files in, and make sure we clean it up
-	testDir := t.TempDir()
+	f := &testFixture{
+		dir:                 t.TempDir(),
+		paths:               make(map[*string]string, len(testPathVars)),
+		withWritableSysroot: withWritableSysroot,
+	}
 
 	// Stub out a test directory structure -- we need to create /etc so createOrigFile can use it
-	etcDir := filepath.Join(testDir, "etc")
-	err := os.MkdirAll(etcDir, 0755)
+	err := os.MkdirAll(filepath.Join(f.dir, "etc"), 0755)
 	require.Nil(t, err)
 
-	oldOrigParentDirPath := origParentDirPath
-	oldNoOrigParentDirPath := noOrigParentDirPath
-
-	// Override these package variables so files get written to our testing location
-	origParentDirPath = filepath.Join(testDir, origParentDirPath)
-	noOrigParentDirPath = filepath.Join(testDir, noOrigParentDirPath)
+	for _, path := range testPathVars {
+		f.paths[path] = *path
+		*path = filepath.Join(f.dir, *path)
+	}
+	// Tests can't remount, the deployments below the test dir are writable
+	withWritableSysroot = func(fn func() error) error { return fn() }
+	return f
+}
 
-	return testDir, func() {
-		// Make sure path variables get put back for other tests
-		origParentDirPath = oldOrigParentDirPath
-		noOrigParentDirPath = oldNoOrigParentDirPath
+// cleanup puts the package variables back for other tests.
+func (f *testFixture) cleanup() {
+	for path, old := range f.paths {
+		*path = old
 	}
+	withWritableSysroot = f.withWritableSysroot
+}
+
+func setupTempDirWithEtc(t *testing.T) (string, func()) {
+	t.Helper()
+	f := newTestFixture(t)
+	return f.dir, f.cleanup
 }
 
 func TestTruncate(t *testing.T) {
@@ -348,6 +404,31 @@ func TestReconcilableDiff(t *testing.T) {
 	assert.Equal(t, diff.files, false)
 }
 
+func TestKernelArgumentsEqual(t *testing.T) {
+	assert.True(t, kernelArgumentsEqual(nil, []string{}))
+	// Reordered arguments and entries repeated as a whole are equal
+	assert.True(t, kernelArgumentsEqual([]string{"foo", "hugepagesz=1G hugepages=4"}, []string{"hugepagesz=1G", "hugepages=4", "foo"}))
+	assert.True(t, kernelArgumentsEqual([]string{"foo"}, []string{"foo", " foo"}))
+	assert.False(t, kernelArgumentsEqual([]string{"foo"}, []string{"foo", "bar"}))
+	// Positional arguments keep their order and repeats
+	assert.False(t, kernelArgumentsEqual([]string{"hugepagesz=1G hugepages=4 hugepagesz=2M hugepages=4"}, []string{"hugepages=4", "hugepages=4", "hugepagesz=2M", "hugepagesz=1G"}))
+	assert.False(t, kernelArgumentsEqual([]string{"hugepagesz=1G hugepages=4", "hugepagesz=2M hugepages=6"}, []string{"hugepagesz=1G hugepages=6", "hugepagesz=2M hugepages=4"}))
+	assert.False(t, kernelArgumentsEqual([]string{"hugepagesz=1G", "hugepages=4"}, []string{"hugepagesz=1G", "hugepages=4", "hugepagesz=1G", "hugepages=4"}))
+
+	// Reordering the entries doesn't change the kernel arguments
+	oldConfig := helpers.CreateMachineConfigFromIgnition(ctrlcommon.NewIgnConfig())
+	oldConfig.Spec.KernelArguments = []string{"foo", "bar=1", "hugepagesz=1G hugepages=4"}
+	newConfig := oldConfig.DeepCopy()
+	newConfig.Spec.KernelArguments = []string{"hugepagesz=1G hugepages=4", "bar=1", "foo", "bar=1"}
+	diff, err := newMachineConfigDiff(oldConfig, newConfig)
+	require.Nil(t, err)
+	assert.False(t, diff.kargs)
+	newConfig.Spec.KernelArguments = []string{"foo", "bar=1", "hugepages=4 hugepagesz=1G"}
+	diff, err = newMachineConfigDiff(oldConfig, newConfig)
+	require.Nil(t, err)
+	assert.True(t, diff.kargs)
+}
+
 func TestKernelAguments(t *testing.T) {
 	tests := []struct {
 		oldKargs []string
@@ -387,6 +468,19 @@ func TestKernelAguments(t *testing.T) {
 			out: []string{"--delete=hugepagesz=1G", "--delete=hugepages=4", "--delete=hugepagesz=2M", "--delete=hugepages=4",
 				"--append=hugepagesz=1G", "--append=hugepages=4", "--append=hugepagesz=2M", "--append=hugepages=6"},
 		},
+		{
+			// Repeated arguments are applied in order
+			oldKargs: nil,
+			newKargs: []string{"hugepagesz=1G hugepages=512 hugepagesz=2M hugepages=512"},
+			out:      []string{"--append=hugepagesz=1G", "--append=hugepages=512", "--append=hugepagesz=2M", "--append=hugepages=512"},
+		},
+		{
+			// Entries repeated as a whole are applied once, unless positional
+			oldKargs: []string{"foo", "foo", "bar=1"},
+			newKargs: []string{"bar=1", " bar=1", "foo", "hugepagesz=2M", "hugepages=4", "hugepagesz=1G", "hugepages=4"},
+			out: []string{"--delete=foo", "--delete=bar=1", "--append=bar=1", "--append=foo",
+				"--append=hugepagesz=2M", "--append=hugepages=4", "--append=hugepagesz=1G", "--append=hugepages=4"},
+		},
 	}
 
 	rand.Seed(time.Now().UnixNano())
@@ -514,13 +608,13 @@ func TestWriteFiles(t *testing.T) {
 				Node:          node,
 				FileEmbedded1: ign3types.FileEmbedded1{Contents: ign3types.Resource{Source: &encodedContents, Compression: helpers.StrToPtr("xz")}, Mode: &mode},
 			}},
-			expectedErr: fmt.Errorf("could not decode file %q: %w", filePath, fmt.Errorf("unsupported compression type %q", "xz")),
+			expectedErr: &ErrFileWrite{Path: filePath, Err: fmt.Errorf("could not decode file %q: %w", filePath, fmt.Errorf("unsupported compression type %q", "xz"))},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			err := d.writeFiles(test.files, true)
+			err := d.writeFiles(context.TODO(), test.files, nil, true)
 			assert.Equal(t, test.expectedErr, err)
 			if test.expectedContents != nil {
 				fileContents, err := os.ReadFile(filePath)
@@ -532,6 +626,53 @@ func TestWriteFiles(t *testing.T) {
 	}
 }
 
+func TestWriteFilesStaged(t *testing.T) {
+	testDir, cleanup := setupTempDirWithEtc(t)
+	defer cleanup()
+
+	d := newMockDaemon()
+
+	currentUser, err := user.Current()
+	require.Nil(t, err)
+	currentUid, err := strconv.Atoi(currentUser.Uid)
+	require.Nil(t, err)
+	currentGid, err := strconv.Atoi(currentUser.Gid)
+	require.Nil(t, err)
+	newFile := func(path, contents string) ign3types.File {
+		f := ctrlcommon.NewIgnFile(path, contents)
+		f.User = ign3types.NodeUser{ID: &currentUid}
+		f.Group = ign3types.NodeGroup{ID: &currentGid}
+		return f
+	}
+
+	existingPath := filepath.Join(testDir, "etc", "existing")
+	addedPath := filepath.Join(testDir, "etc", "added", "file")
+	require.Nil(t, d.writeFiles(context.TODO(), []ign3types.File{newFile(existingPath, "old")}, nil, true))
+
+	// A file that can't be staged keeps all files from being written
+	badFile := newFile(filepath.Join(testDir, "etc", "bad"), "bad")
+	badFile.User = ign3types.NodeUser{Name: helpers.StrToPtr("nonexistent-user")}
+	err = d.writeFiles(context.TODO(), []ign3types.File{newFile(existingPath, "new"), newFile(addedPath, "added"), badFile}, nil, true)
+	require.NotNil(t, err)
+	contents, err := os.ReadFile(existingPath)
+	require.Nil(t, err)
+	assert.Equal(t, "old", string(contents))
+	assert.NoFileExists(t, addedPath)
+	assert.NoDirExists(t, stagedFilesDirPath)
+
+	require.Nil(t, d.writeFiles(context.TODO(), []ign3types.File{newFile(existingPath, "new"), newFile(addedPath, "added")}, nil, true))
+	contents, err = os.ReadFile(existingPath)
+	require.Nil(t, err)
+	assert.Equal(t, "new", string(contents))
+	contents, err = os.ReadFile(addedPath)
+	require.Nil(t, err)
+	assert.Equal(t, "added", string(contents))
+	info, err := os.Stat(existingPath)
+	require.Nil(t, err)
+	assert.Equal(t, defaultFilePermissions, info.Mode().Perm())
+	assert.NoDirExists(t, stagedFilesDirPath)
+}
+
 // This test provides a false sense of security. Given the combination of the
 // mock mode in the MCD coupled with the inputs into this test, it effectively
 // no-ops and does not test what we think it tests.
@@ -666,11 +807,33 @@ func TestCalculatePostConfigChangeAction(t *testing.T) {
 		"policy2":         ctrlcommon.NewIgnFile("/etc/containers/policy.json", "policy2"),
 		"containers-gpg1": ctrlcommon.NewIgnFile("/etc/machine-config-daemon/no-reboot/containers-gpg.pub", "containers-gpg1"),
 		"containers-gpg2": ctrlcommon.NewIgnFile("/etc/machine-config-daemon/no-reboot/containers-gpg.pub", "containers-gpg2"),
+		"keyfile1":        ctrlcommon.NewIgnFile("/etc/NetworkManager/system-connections/eth0.nmconnection", "keyfile1"),
+		"keyfile2":        ctrlcommon.NewIgnFile("/etc/NetworkManager/system-connections/eth0.nmconnection", "keyfile2"),
+		"sssd1":           ctrlcommon.NewIgnFile("/etc/sssd/sssd.conf", "sssd1"),
+		"sssd2":           ctrlcommon.NewIgnFile("/etc/sssd/sssd.conf", "sssd2"),
+		"authselect1":     ctrlcommon.NewIgnFile("/etc/authselect/authselect.conf", "sssd\n"),
+		"authselect2":     ctrlcommon.NewIgnFile("/etc/authselect/authselect.conf", "sssd\nwith-mkhomedir\n"),
+		"chrony1":         ctrlcommon.NewIgnFile("/etc/chrony.conf", "pool pool1.example.com iburst\n"),
+		"chrony2":         ctrlcommon.NewIgnFile("/etc/chrony.conf", "pool pool2.example.com iburst\n"),
+		"chronyd1":        ctrlcommon.NewIgnFile("/etc/chrony.d/site.conf", "server ntp.site.local iburst\n"),
+		"sysusers1":       ctrlcommon.NewIgnFile("/etc/sysusers.d/app.conf", "u app - \"App\" /var/lib/app\n"),
+		"tmpfiles1":       ctrlcommon.NewIgnFile("/etc/tmpfiles.d/app.conf", "d /run/app 0755 app app -\n"),
+		"kubeletenv1":     ctrlcommon.NewIgnFile("/etc/kubernetes/kubelet.env.d/proxy.env", "HTTPS_PROXY=http://proxy1\n"),
+		"kubeletenv2":     ctrlcommon.NewIgnFile("/etc/kubernetes/kubelet.env.d/proxy.env", "HTTPS_PROXY=http://proxy2\n"),
+		"nodesizing1":     ctrlcommon.NewIgnFile("/etc/node-sizing.env", "SYSTEM_RESERVED_MEMORY=1Gi\n"),
+		"crioenv1":        ctrlcommon.NewIgnFile("/etc/sysconfig/crio", "CRIO_STORAGE_OPTIONS=\n"),
+		"sysext1":         ctrlcommon.NewIgnFile("/var/lib/extensions/tools.raw", "sysext1"),
+		"sysext2":         ctrlcommon.NewIgnFile("/var/lib/extensions/tools.raw", "sysext2"),
+		"quadlet1":        ctrlcommon.NewIgnFile("/etc/containers/systemd/app.container", "[Container]\nImage=quay.io/app:1\n"),
+		"quadlet2":        ctrlcommon.NewIgnFile("/etc/containers/systemd/app.container", "[Container]\nImage=quay.io/app:2\n"),
+		"quadletvolume1":  ctrlcommon.NewIgnFile("/etc/containers/systemd/app/data.volume", "[Volume]\n"),
+		"userquadlet1":    ctrlcommon.NewIgnFile("/etc/containers/systemd/users/app.container", "[Container]\nImage=quay.io/app:1\n"),
 	}
 
 	tests := []struct {
 		oldConfig      *mcfgv1.MachineConfig
 		newConfig      *mcfgv1.MachineConfig
+		agentMode      bool
 		expectedAction []string
 	}{
 		{
@@ -745,6 +908,180 @@ func TestCalculatePostConfigChangeAction(t *testing.T) {
 			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["containers-gpg2"]}),
 			expectedAction: []string{postConfigChangeActionReloadCrio},
 		},
+		{
+			// test that updating a NetworkManager keyfile is reboot on cluster
+			// managed nodes
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["keyfile1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["keyfile2"]}),
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that updating a NetworkManager keyfile is NetworkManager
+			// reload in device agent mode
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["keyfile1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["keyfile2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionReloadNetworkManager},
+		},
+		{
+			// test that removing a NetworkManager keyfile is NetworkManager reload
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["keyfile1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionReloadNetworkManager},
+		},
+		{
+			// test that crio and NetworkManager reloads are combined
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["registries1"], files["keyfile1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["registries2"], files["keyfile2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionReloadCrio, postConfigChangeActionReloadNetworkManager},
+		},
+		{
+			// test that updating the SSSD configuration is reboot on cluster
+			// managed nodes
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["sssd1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["sssd2"]}),
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that updating the SSSD configuration is sssd restart in
+			// device agent mode
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["sssd1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["sssd2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRestartSSSD},
+		},
+		{
+			// test that updating the authselect configuration is sssd restart
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["authselect1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["authselect2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRestartSSSD},
+		},
+		{
+			// test that NetworkManager reload and sssd restart are combined
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["keyfile1"], files["sssd1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["keyfile2"], files["sssd2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionReloadNetworkManager, postConfigChangeActionRestartSSSD},
+		},
+		{
+			// test that updating chrony.conf is reboot on cluster managed nodes
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["chrony1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["chrony2"]}),
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that updating chrony.conf is chronyd restart in device agent
+			// mode
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["chrony1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["chrony2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRestartChronyd},
+		},
+		{
+			// test that adding a file to chrony.d is chronyd restart
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["chrony1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["chrony1"], files["chronyd1"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRestartChronyd},
+		},
+		{
+			// test that adding files to sysusers.d and tmpfiles.d is reboot
+			// on cluster managed nodes
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["tmpfiles1"], files["sysusers1"]}),
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that adding a file to sysusers.d is systemd-sysusers run in
+			// device agent mode
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["sysusers1"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRunSysusers},
+		},
+		{
+			// test that systemd-sysusers runs before systemd-tmpfiles
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["tmpfiles1"], files["sysusers1"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRunSysusers, postConfigChangeActionRunTmpfiles},
+		},
+		{
+			// test that changing a kubelet environment file is reboot on
+			// cluster managed nodes
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["kubeletenv1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["kubeletenv2"], files["nodesizing1"]}),
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that changing a kubelet environment file is kubelet restart
+			// in device agent mode
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["kubeletenv1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["kubeletenv2"], files["nodesizing1"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRestartKubelet},
+		},
+		{
+			// test that environment files restart only their own service
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["kubeletenv1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["kubeletenv2"], files["crioenv1"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRestartKubelet, postConfigChangeActionRestartCrio},
+		},
+		{
+			// test that updating a system extension image is reboot on cluster
+			// managed nodes
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["sysext1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["sysext2"]}),
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that updating a system extension image is sysext refresh in
+			// device agent mode
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["sysext1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["sysext2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRefreshSysext},
+		},
+		{
+			// test that removing a system extension image is sysext refresh
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["sysext1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRefreshSysext},
+		},
+		{
+			// test that changing and adding quadlet files is reboot on cluster
+			// managed nodes
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["quadlet1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["quadlet2"], files["quadletvolume1"]}),
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that changing and adding quadlet files restarts quadlets in
+			// device agent mode
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["quadlet1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["quadlet2"], files["quadletvolume1"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionRestartQuadlets},
+		},
+		{
+			// test that quadlet files of rootless workloads require a reboot
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["userquadlet1"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
+		{
+			// test that a normal file change (reboot) overwrites NetworkManager reload
+			oldConfig:      helpers.NewMachineConfig("00-test", nil, "dummy://", []ign3types.File{files["randomfile1"], files["keyfile1"]}),
+			newConfig:      helpers.NewMachineConfig("01-test", nil, "dummy://", []ign3types.File{files["randomfile2"], files["keyfile2"]}),
+			agentMode:      true,
+			expectedAction: []string{postConfigChangeActionReboot},
+		},
 	}
 
 	for idx, test := range tests {
@@ -763,6 +1100,9 @@ func TestCalculatePostConfigChangeAction(t *testing.T) {
 			}
 			diffFileSet := ctrlcommon.CalculateConfigFileDiffs(&oldIgnConfig, &newIgnConfig)
 			calculatedAction, err := calculatePostConfigChangeAction(mcDiff, diffFileSet)
+			if test.agentMode {
+				calculatedAction = calculatePostConfigChangeActionFromDiff(mcDiff, diffFileSet, true)
+			}
 
 			if !reflect.DeepEqual(test.expectedAction, calculatedAction) {
 				t.Errorf("Failed calculating config change action: expected: %v but result is: %v. Error: %v", test.expectedAction, calculatedAction, err)
@@ -785,6 +1125,46 @@ func checkIrreconcilableResults(t *testing.T, key string, reconcilableError erro
 	}
 }
 
+func TestServiceEnvDropin(t *testing.T) {
+	assert.Equal(t, []string{"/etc/systemd/system/crio.service.d/20-mcd-environment.conf", "/etc/systemd/system/kubelet.service.d/20-mcd-environment.conf"},
+		serviceEnvDropinPaths([]string{postConfigChangeActionRestartKubelet, postConfigChangeActionRestartCrio, postConfigChangeActionReloadCrio}))
+	assert.Nil(t, serviceEnvDropinPaths([]string{postConfigChangeActionReloadCrio}))
+
+	assert.Equal(t, "# Written by machine-config-daemon for the environment files of the config\n[Service]\n"+
+		"EnvironmentFile=-/etc/kubernetes/kubelet.env.d/10-proxy.env\nEnvironmentFile=-/etc/kubernetes/kubelet.env.d/20-sizing.env\n",
+		serviceEnvDropinContents([]string{"/etc/kubernetes/kubelet.env.d/10-proxy.env", "/etc/kubernetes/kubelet.env.d/20-sizing.env"}))
+
+	_, ok := envFileService("/etc/kubernetes/kubelet.env.d/proxy.conf")
+	assert.False(t, ok)
+}
+
+func TestQuadletService(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { quadletDir = old }(quadletDir)
+	quadletDir = dir
+
+	assert.True(t, isQuadletFile(filepath.Join(dir, "app", "db.pod")))
+	assert.False(t, isQuadletFile(filepath.Join(dir, "users", "app.container")))
+	assert.False(t, isQuadletFile(filepath.Join(dir, "app.service")))
+	assert.False(t, isQuadletFile("/etc/containers/app.container"))
+
+	// Files without ServiceName= get the default names
+	assert.Equal(t, "app.service", quadletService(filepath.Join(dir, "app.container"), nil))
+	assert.Equal(t, "data-volume.service", quadletService(filepath.Join(dir, "data.volume"), nil))
+	assert.Equal(t, "lan-network.service", quadletService(filepath.Join(dir, "lan.network"), nil))
+	assert.Equal(t, "db-pod.service", quadletService(filepath.Join(dir, "db.pod"), strings.NewReader("[Pod]\n")))
+
+	path := filepath.Join(dir, "web.container")
+	contents := "[Container]\nImage=quay.io/web\nServiceName=frontend\n"
+	assert.Equal(t, "frontend.service", quadletService(path, strings.NewReader(contents)))
+
+	// Removed files are named as the old config has them
+	oldIgnConfig := ctrlcommon.NewIgnConfig()
+	oldIgnConfig.Storage.Files = []ign3types.File{ctrlcommon.NewIgnFile(path, contents)}
+	assert.Equal(t, "frontend.service", removedQuadletService(path, oldIgnConfig))
+	assert.Equal(t, "app.service", removedQuadletService(filepath.Join(dir, "app.container"), oldIgnConfig))
+}
+
 func TestRunGetOut(t *testing.T) {
 	o, err := runGetOut("true")
 	assert.Nil(t, err)